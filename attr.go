@@ -0,0 +1,165 @@
+package esi
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nussjustin/esi/esixml"
+)
+
+const (
+	attrMaxWait = "maxwait"
+	attrNoStore = "no-store"
+	attrTTL     = "ttl"
+)
+
+// MaxWaitDuration returns the value of the non-standard maxwait attribute, which specifies the maximum time to wait
+// for the included fragment in milliseconds.
+//
+// If the attribute is not set, ok is false. If the value is not a non-negative integer, an
+// [*InvalidAttributeValueError] is returned.
+func (e *IncludeElement) MaxWaitDuration() (d time.Duration, ok bool, err error) {
+	return maxWaitAttr(e.Name(), e.Attr)
+}
+
+// NoStore returns the value of the non-standard no-store attribute, which specifies whether the included fragment
+// must not be cached.
+//
+// If the attribute is not set, ok is false. If the value is neither "on" nor "off", an
+// [*InvalidAttributeValueError] is returned.
+func (e *IncludeElement) NoStore() (noStore bool, ok bool, err error) {
+	return noStoreAttr(e.Name(), e.Attr)
+}
+
+// TTL returns the value of the non-standard ttl attribute, which specifies how long the included fragment can be
+// cached.
+//
+// The value must be a non-negative integer followed by an optional unit, which is one of "s" (seconds, the default),
+// "m" (minutes), "h" (hours) or "d" (days).
+//
+// If the attribute is not set, ok is false. If the value is invalid, an [*InvalidAttributeValueError] is returned.
+func (e *IncludeElement) TTL() (d time.Duration, ok bool, err error) {
+	return ttlAttr(e.Name(), e.Attr)
+}
+
+// MaxWaitDuration returns the value of the non-standard maxwait attribute, which specifies the maximum time to wait
+// for the fragment in milliseconds.
+//
+// See [IncludeElement.MaxWaitDuration] for details.
+func (e *InlineElement) MaxWaitDuration() (d time.Duration, ok bool, err error) {
+	return maxWaitAttr(e.Name(), e.Attr)
+}
+
+// NoStore returns the value of the non-standard no-store attribute, which specifies whether the fragment must not be
+// cached.
+//
+// See [IncludeElement.NoStore] for details.
+func (e *InlineElement) NoStore() (noStore bool, ok bool, err error) {
+	return noStoreAttr(e.Name(), e.Attr)
+}
+
+// TTL returns the value of the non-standard ttl attribute, which specifies how long the fragment can be cached.
+//
+// See [IncludeElement.TTL] for details.
+func (e *InlineElement) TTL() (d time.Duration, ok bool, err error) {
+	return ttlAttr(e.Name(), e.Attr)
+}
+
+func findAttr(attrs []esixml.Attr, name string) (esixml.Attr, bool) {
+	for _, attr := range attrs {
+		if attr.Name == (esixml.Name{Local: name}) {
+			return attr, true
+		}
+	}
+
+	return esixml.Attr{}, false
+}
+
+func invalidAttr(element esixml.Name, attr esixml.Attr, allowed ...string) *InvalidAttributeValueError {
+	return &InvalidAttributeValueError{
+		Position: attr.Position,
+		Element:  element,
+		Name:     attr.Name,
+		Value:    attr.Value,
+		Allowed:  allowed,
+	}
+}
+
+func isNotDigit(r rune) bool {
+	return r < '0' || r > '9'
+}
+
+func maxWaitAttr(element esixml.Name, attrs []esixml.Attr) (time.Duration, bool, error) {
+	attr, ok := findAttr(attrs, attrMaxWait)
+	if !ok {
+		return 0, false, nil
+	}
+
+	n, ok := parseDigits(attr.Value)
+	if !ok || time.Duration(n) > math.MaxInt64/time.Millisecond {
+		return 0, true, invalidAttr(element, attr)
+	}
+
+	return time.Duration(n) * time.Millisecond, true, nil
+}
+
+func noStoreAttr(element esixml.Name, attrs []esixml.Attr) (bool, bool, error) {
+	attr, ok := findAttr(attrs, attrNoStore)
+	if !ok {
+		return false, false, nil
+	}
+
+	switch attr.Value {
+	case "off":
+		return false, true, nil
+	case "on":
+		return true, true, nil
+	default:
+		return false, true, invalidAttr(element, attr, "off", "on")
+	}
+}
+
+// parseDigits parses s as a non-negative decimal integer without sign.
+func parseDigits(s string) (int, bool) {
+	if s == "" || strings.IndexFunc(s, isNotDigit) != -1 {
+		return 0, false
+	}
+
+	n, err := strconv.Atoi(s)
+	return n, err == nil
+}
+
+func ttlAttr(element esixml.Name, attrs []esixml.Attr) (time.Duration, bool, error) {
+	attr, ok := findAttr(attrs, attrTTL)
+	if !ok {
+		return 0, false, nil
+	}
+
+	value, unit := attr.Value, time.Second
+
+	if i := strings.IndexFunc(value, isNotDigit); i != -1 {
+		switch value[i:] {
+		case "s":
+			// Seconds are the default
+		case "m":
+			unit = time.Minute
+		case "h":
+			unit = time.Hour
+		case "d":
+			unit = 24 * time.Hour
+		default:
+			return 0, true, invalidAttr(element, attr)
+		}
+
+		value = value[:i]
+	}
+
+	n, ok := parseDigits(value)
+	if !ok || time.Duration(n) > math.MaxInt64/unit {
+		return 0, true, invalidAttr(element, attr)
+	}
+
+	return time.Duration(n) * unit, true, nil
+}
@@ -0,0 +1,183 @@
+package esi_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nussjustin/esi"
+	"github.com/nussjustin/esi/esixml"
+)
+
+func parseElement(tb testing.TB, doc string) esi.Node {
+	tb.Helper()
+
+	for node, err := range esi.NewParser(strings.NewReader(doc)).All {
+		if err != nil {
+			tb.Fatalf("failed to parse %q: %v", doc, err)
+		}
+
+		return node
+	}
+
+	tb.Fatalf("no node found in %q", doc)
+	return nil
+}
+
+func TestIncludeElement_MaxWaitDuration(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Attr     string
+		Expected time.Duration
+		OK       bool
+		Error    error
+	}{
+		{Name: "missing"},
+		{Name: "zero", Attr: `maxwait="0"`, OK: true},
+		{Name: "valid", Attr: `maxwait="1500"`, Expected: 1500 * time.Millisecond, OK: true},
+		{
+			Name:  "negative",
+			Attr:  `maxwait="-1"`,
+			OK:    true,
+			Error: invalidAttr(esi.NameInclude, "maxwait", "-1"),
+		},
+		{
+			Name:  "unit",
+			Attr:  `maxwait="1s"`,
+			OK:    true,
+			Error: invalidAttr(esi.NameInclude, "maxwait", "1s"),
+		},
+		{
+			Name:  "overflow",
+			Attr:  `maxwait="99999999999999999999"`,
+			OK:    true,
+			Error: invalidAttr(esi.NameInclude, "maxwait", "99999999999999999999"),
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			node := parseElement(t, `<esi:include src="/" `+testCase.Attr+`/>`)
+
+			got, ok, err := node.(*esi.IncludeElement).MaxWaitDuration()
+			checkAttr(t, got, ok, err, testCase.Expected, testCase.OK, testCase.Error)
+
+			node = parseElement(t, `<esi:inline name="/" fetchable="no" `+testCase.Attr+`></esi:inline>`)
+
+			var (
+				invalidErr *esi.InvalidAttributeValueError
+				wantErr    error
+			)
+
+			if errors.As(testCase.Error, &invalidErr) {
+				inlineErr := *invalidErr
+				inlineErr.Element.Local = esi.NameInline
+				wantErr = &inlineErr
+			}
+
+			got, ok, err = node.(*esi.InlineElement).MaxWaitDuration()
+			checkAttr(t, got, ok, err, testCase.Expected, testCase.OK, wantErr)
+		})
+	}
+}
+
+func TestIncludeElement_NoStore(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Attr     string
+		Expected bool
+		OK       bool
+		Error    error
+	}{
+		{Name: "missing"},
+		{Name: "off", Attr: `no-store="off"`, OK: true},
+		{Name: "on", Attr: `no-store="on"`, Expected: true, OK: true},
+		{
+			Name:  "invalid",
+			Attr:  `no-store="yes"`,
+			OK:    true,
+			Error: invalidAttr(esi.NameInclude, "no-store", "yes", "off", "on"),
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			node := parseElement(t, `<esi:include src="/" `+testCase.Attr+`/>`)
+
+			got, ok, err := node.(*esi.IncludeElement).NoStore()
+			checkAttr(t, got, ok, err, testCase.Expected, testCase.OK, testCase.Error)
+		})
+	}
+}
+
+func TestIncludeElement_TTL(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Attr     string
+		Expected time.Duration
+		OK       bool
+		Error    error
+	}{
+		{Name: "missing"},
+		{Name: "no unit", Attr: `ttl="30"`, Expected: 30 * time.Second, OK: true},
+		{Name: "seconds", Attr: `ttl="45s"`, Expected: 45 * time.Second, OK: true},
+		{Name: "minutes", Attr: `ttl="5m"`, Expected: 5 * time.Minute, OK: true},
+		{Name: "hours", Attr: `ttl="2h"`, Expected: 2 * time.Hour, OK: true},
+		{Name: "days", Attr: `ttl="1d"`, Expected: 24 * time.Hour, OK: true},
+		{Name: "empty", Attr: `ttl=""`, OK: true, Error: invalidAttr(esi.NameInclude, "ttl", "")},
+		{Name: "unit only", Attr: `ttl="s"`, OK: true, Error: invalidAttr(esi.NameInclude, "ttl", "s")},
+		{Name: "unknown unit", Attr: `ttl="1w"`, OK: true, Error: invalidAttr(esi.NameInclude, "ttl", "1w")},
+		{Name: "fraction", Attr: `ttl="1.5m"`, OK: true, Error: invalidAttr(esi.NameInclude, "ttl", "1.5m")},
+		{
+			Name:  "overflow",
+			Attr:  `ttl="999999999d"`,
+			OK:    true,
+			Error: invalidAttr(esi.NameInclude, "ttl", "999999999d"),
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			node := parseElement(t, `<esi:include src="/" `+testCase.Attr+`/>`)
+
+			got, ok, err := node.(*esi.IncludeElement).TTL()
+			checkAttr(t, got, ok, err, testCase.Expected, testCase.OK, testCase.Error)
+		})
+	}
+}
+
+func TestInlineElement_TTL(t *testing.T) {
+	node := parseElement(t, `<esi:inline name="/" fetchable="no" ttl="10m" no-store="on"></esi:inline>`)
+
+	got, ok, err := node.(*esi.InlineElement).TTL()
+	checkAttr(t, got, ok, err, 10*time.Minute, true, nil)
+
+	noStore, ok, err := node.(*esi.InlineElement).NoStore()
+	checkAttr(t, noStore, ok, err, true, true, nil)
+}
+
+func checkAttr[T comparable](tb testing.TB, got T, gotOK bool, gotErr error, want T, wantOK bool, wantErr error) {
+	tb.Helper()
+
+	if !errors.Is(gotErr, wantErr) {
+		tb.Errorf("got error %v, want %v", gotErr, wantErr)
+	}
+
+	if got != want {
+		tb.Errorf("got %v, want %v", got, want)
+	}
+
+	if gotOK != wantOK {
+		tb.Errorf("got ok %t, want %t", gotOK, wantOK)
+	}
+}
+
+func invalidAttr(element, name, value string, allowed ...string) *esi.InvalidAttributeValueError {
+	return &esi.InvalidAttributeValueError{
+		Element: esixml.Name{Space: esi.Namespace, Local: element},
+		Name:    esixml.Name{Local: name},
+		Value:   value,
+		Allowed: allowed,
+	}
+}
@@ -0,0 +1,329 @@
+package esi
+
+import (
+	"bytes"
+	"slices"
+)
+
+// Clone returns a deep copy of the nodes.
+//
+// If n is nil, nil is returned.
+func (n Nodes) Clone() Nodes {
+	return cloneNodes(n)
+}
+
+// CloneNode returns a deep copy of the given node.
+//
+// The returned node has the same type as the given node. See also the Clone methods on the different [Node] types.
+//
+// If node is nil, nil is returned.
+func CloneNode(node Node) Node {
+	switch v := node.(type) {
+	case nil:
+		return nil
+	case *AttemptElement:
+		return v.Clone()
+	case *ChooseElement:
+		return v.Clone()
+	case *Comment:
+		return v.Clone()
+	case *CommentElement:
+		return v.Clone()
+	case *Doctype:
+		return v.Clone()
+	case *ExceptElement:
+		return v.Clone()
+	case *IncludeElement:
+		return v.Clone()
+	case *InlineElement:
+		return v.Clone()
+	case *OtherwiseElement:
+		return v.Clone()
+	case *RawData:
+		return v.Clone()
+	case *RemoveElement:
+		return v.Clone()
+	case *TryElement:
+		return v.Clone()
+	case *VarsElement:
+		return v.Clone()
+	case *WhenElement:
+		return v.Clone()
+	case *XMLComment:
+		return v.Clone()
+	case *XMLDeclaration:
+		return v.Clone()
+	default:
+		panic("unknown node type")
+	}
+}
+
+func cloneNodes(nodes []Node) []Node {
+	if nodes == nil {
+		return nil
+	}
+
+	clones := make([]Node, len(nodes))
+
+	for i, node := range nodes {
+		clones[i] = CloneNode(node)
+	}
+
+	return clones
+}
+
+// Clone returns a deep copy of the element.
+//
+// If e is nil, nil is returned.
+func (e *AttemptElement) Clone() *AttemptElement {
+	if e == nil {
+		return nil
+	}
+
+	return &AttemptElement{
+		Position: e.Position,
+		Attr:     slices.Clone(e.Attr),
+		Nodes:    cloneNodes(e.Nodes),
+	}
+}
+
+// Clone returns a deep copy of the element.
+//
+// If e is nil, nil is returned.
+func (e *ChooseElement) Clone() *ChooseElement {
+	if e == nil {
+		return nil
+	}
+
+	var when []*WhenElement
+
+	if e.When != nil {
+		when = make([]*WhenElement, len(e.When))
+
+		for i, w := range e.When {
+			when[i] = w.Clone()
+		}
+	}
+
+	return &ChooseElement{
+		Position:  e.Position,
+		Attr:      slices.Clone(e.Attr),
+		When:      when,
+		Otherwise: e.Otherwise.Clone(),
+	}
+}
+
+// Clone returns a deep copy of the comment.
+//
+// If e is nil, nil is returned.
+func (e *Comment) Clone() *Comment {
+	if e == nil {
+		return nil
+	}
+
+	return &Comment{
+		Position: e.Position,
+		Nodes:    cloneNodes(e.Nodes),
+	}
+}
+
+// Clone returns a deep copy of the element.
+//
+// If e is nil, nil is returned.
+func (e *CommentElement) Clone() *CommentElement {
+	if e == nil {
+		return nil
+	}
+
+	return &CommentElement{
+		Position: e.Position,
+		Attr:     slices.Clone(e.Attr),
+		Text:     e.Text,
+	}
+}
+
+// Clone returns a deep copy of the declaration.
+//
+// If d is nil, nil is returned.
+func (d *Doctype) Clone() *Doctype {
+	if d == nil {
+		return nil
+	}
+
+	return &Doctype{
+		Position: d.Position,
+		Bytes:    bytes.Clone(d.Bytes),
+	}
+}
+
+// Clone returns a deep copy of the element.
+//
+// If e is nil, nil is returned.
+func (e *ExceptElement) Clone() *ExceptElement {
+	if e == nil {
+		return nil
+	}
+
+	return &ExceptElement{
+		Position: e.Position,
+		Attr:     slices.Clone(e.Attr),
+		Nodes:    cloneNodes(e.Nodes),
+	}
+}
+
+// Clone returns a deep copy of the element.
+//
+// If e is nil, nil is returned.
+func (e *IncludeElement) Clone() *IncludeElement {
+	if e == nil {
+		return nil
+	}
+
+	return &IncludeElement{
+		Position:     e.Position,
+		Attr:         slices.Clone(e.Attr),
+		Alt:          e.Alt,
+		FragmentName: e.FragmentName,
+		OnError:      e.OnError,
+		Source:       e.Source,
+	}
+}
+
+// Clone returns a deep copy of the element.
+//
+// If e is nil, nil is returned.
+func (e *InlineElement) Clone() *InlineElement {
+	if e == nil {
+		return nil
+	}
+
+	return &InlineElement{
+		Position:     e.Position,
+		Attr:         slices.Clone(e.Attr),
+		FragmentName: e.FragmentName,
+		Fetchable:    e.Fetchable,
+		Nodes:        cloneNodes(e.Nodes),
+	}
+}
+
+// Clone returns a deep copy of the element.
+//
+// If e is nil, nil is returned.
+func (e *OtherwiseElement) Clone() *OtherwiseElement {
+	if e == nil {
+		return nil
+	}
+
+	return &OtherwiseElement{
+		Position: e.Position,
+		Attr:     slices.Clone(e.Attr),
+		Nodes:    cloneNodes(e.Nodes),
+	}
+}
+
+// Clone returns a deep copy of the data.
+//
+// Spilled data is not copied. The copy references the same data as r.
+//
+// If r is nil, nil is returned.
+func (r *RawData) Clone() *RawData {
+	if r == nil {
+		return nil
+	}
+
+	return &RawData{
+		Position: r.Position,
+		Bytes:    bytes.Clone(r.Bytes),
+		Spill:    r.Spill,
+	}
+}
+
+// Clone returns a deep copy of the element.
+//
+// If e is nil, nil is returned.
+func (e *RemoveElement) Clone() *RemoveElement {
+	if e == nil {
+		return nil
+	}
+
+	return &RemoveElement{
+		Position: e.Position,
+		Attr:     slices.Clone(e.Attr),
+		Nodes:    cloneNodes(e.Nodes),
+	}
+}
+
+// Clone returns a deep copy of the element.
+//
+// If e is nil, nil is returned.
+func (e *TryElement) Clone() *TryElement {
+	if e == nil {
+		return nil
+	}
+
+	return &TryElement{
+		Position: e.Position,
+		Attr:     slices.Clone(e.Attr),
+		Attempt:  e.Attempt.Clone(),
+		Except:   e.Except.Clone(),
+	}
+}
+
+// Clone returns a deep copy of the element.
+//
+// If e is nil, nil is returned.
+func (e *VarsElement) Clone() *VarsElement {
+	if e == nil {
+		return nil
+	}
+
+	return &VarsElement{
+		Position: e.Position,
+		Attr:     slices.Clone(e.Attr),
+		Nodes:    cloneNodes(e.Nodes),
+	}
+}
+
+// Clone returns a deep copy of the element.
+//
+// If e is nil, nil is returned.
+func (e *WhenElement) Clone() *WhenElement {
+	if e == nil {
+		return nil
+	}
+
+	return &WhenElement{
+		Position: e.Position,
+		Attr:     slices.Clone(e.Attr),
+		Test:     e.Test,
+		Nodes:    cloneNodes(e.Nodes),
+	}
+}
+
+// Clone returns a deep copy of the comment.
+//
+// If e is nil, nil is returned.
+func (e *XMLComment) Clone() *XMLComment {
+	if e == nil {
+		return nil
+	}
+
+	return &XMLComment{
+		Position: e.Position,
+		Nodes:    cloneNodes(e.Nodes),
+	}
+}
+
+// Clone returns a deep copy of the declaration.
+//
+// If d is nil, nil is returned.
+func (d *XMLDeclaration) Clone() *XMLDeclaration {
+	if d == nil {
+		return nil
+	}
+
+	return &XMLDeclaration{
+		Position: d.Position,
+		Bytes:    bytes.Clone(d.Bytes),
+	}
+}
@@ -0,0 +1,92 @@
+package esi_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/nussjustin/esi"
+)
+
+const cloneTestInput = `before
+<esi:choose x="y">
+	<esi:when test="$(A)">
+		<esi:include src="/a" alt="/b" onerror="continue" data-x="1"/>
+		<esi:comment text="comment"/>
+	</esi:when>
+	<esi:otherwise><esi:remove>removed</esi:remove></esi:otherwise>
+</esi:choose>
+<esi:try>
+	<esi:attempt><esi:vars>$(B)</esi:vars></esi:attempt>
+	<esi:except><esi:inline name="frag" fetchable="yes">inline</esi:inline></esi:except>
+</esi:try>
+<!--esi <!-- xml comment --> -->
+after`
+
+func parseAll(t *testing.T, input string) esi.Nodes {
+	t.Helper()
+
+	var nodes esi.Nodes
+
+	for node, err := range esi.NewParser(strings.NewReader(input)).All {
+		if err != nil {
+			t.Fatalf("failed to parse input: %s", err)
+		}
+
+		nodes = append(nodes, node)
+	}
+
+	return nodes
+}
+
+func TestNodes_Clone(t *testing.T) {
+	nodes := parseAll(t, cloneTestInput)
+	clones := nodes.Clone()
+
+	if diff := cmp.Diff(nodes, clones); diff != "" {
+		t.Fatalf("clone mismatch (-want +got):\n%s", diff)
+	}
+
+	for i := range nodes {
+		if nodes[i] == clones[i] {
+			t.Errorf("node %T at index %d was not cloned", nodes[i], i)
+		}
+	}
+
+	// Mutate the clones and make sure the original nodes are unchanged
+	clones[0].(*esi.RawData).Bytes[0] = 'B'
+
+	choose := clones[1].(*esi.ChooseElement)
+	choose.Attr[0].Value = "changed"
+	choose.When[0].Test = "changed"
+	choose.When[0].Nodes[1].(*esi.IncludeElement).Source = "/changed"
+	choose.When[0].Nodes[1].(*esi.IncludeElement).Attr[0].Value = "changed"
+	choose.Otherwise.Nodes[0].(*esi.RemoveElement).Nodes = nil
+
+	try := clones[3].(*esi.TryElement)
+	try.Attempt.Nodes = append(try.Attempt.Nodes, &esi.RawData{})
+	try.Except.Nodes[0].(*esi.InlineElement).FragmentName = "changed"
+
+	if diff := cmp.Diff(parseAll(t, cloneTestInput), nodes); diff != "" {
+		t.Errorf("original nodes were modified (-want +got):\n%s", diff)
+	}
+}
+
+func TestNodes_Clone_Nil(t *testing.T) {
+	var nodes esi.Nodes
+
+	if got := nodes.Clone(); got != nil {
+		t.Errorf("got %#v, want nil", got)
+	}
+
+	if got := esi.CloneNode(nil); got != nil {
+		t.Errorf("got %#v, want nil", got)
+	}
+
+	var choose *esi.ChooseElement
+
+	if got := choose.Clone(); got != nil {
+		t.Errorf("got %#v, want nil", got)
+	}
+}
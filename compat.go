@@ -0,0 +1,148 @@
+package esi
+
+import (
+	"fmt"
+
+	"github.com/nussjustin/esi/esixml"
+)
+
+// CompatibilityProfile selects a dialect of ESI, as implemented by different ESI processors.
+//
+// Profiles are used to configure the different packages in a consistent way. A profile is applied to a [Parser] using
+// [WithCompatibilityProfile], to a processor using esiproc.WithCompatibilityProfile and to expressions using the
+// Strict field of esiexpr.Env (see [CompatibilityProfile.ExpressionExtensions]).
+//
+// ESI comments (<!--esi ... -->) are supported by all profiles.
+type CompatibilityProfile uint8
+
+const (
+	// ProfileDefault enables all supported elements and extensions.
+	ProfileDefault CompatibilityProfile = iota
+
+	// ProfileSpecStrict only allows what is defined by the ESI Language Specification 1.0.
+	//
+	// Extensions to the expression syntax like escape sequences and raw strings are not allowed, namespaced attributes
+	// on ESI elements are rejected and esi:vars elements may only contain literal text.
+	ProfileSpecStrict
+
+	// ProfileAkamai mirrors the ESI dialect implemented by Akamai.
+	//
+	// Attributes in the esi namespace on ESI elements, like esi:onerror, are treated as if they had no namespace.
+	ProfileAkamai
+
+	// ProfileFastly mirrors the ESI subset implemented by Fastly.
+	//
+	// Only the esi:include, esi:remove and esi:comment elements as well as ESI comments are supported. Invalid ESI tags
+	// are kept in the output instead of failing the whole document.
+	ProfileFastly
+
+	// ProfileVarnish mirrors the ESI subset implemented by Varnish Cache.
+	//
+	// Only the esi:include, esi:remove and esi:comment elements as well as ESI comments are supported. Invalid ESI tags
+	// are kept in the output instead of failing the whole document.
+	ProfileVarnish
+)
+
+// String returns the name of the profile.
+func (c CompatibilityProfile) String() string {
+	switch c {
+	case ProfileDefault:
+		return "ProfileDefault"
+	case ProfileSpecStrict:
+		return "ProfileSpecStrict"
+	case ProfileAkamai:
+		return "ProfileAkamai"
+	case ProfileFastly:
+		return "ProfileFastly"
+	case ProfileVarnish:
+		return "ProfileVarnish"
+	default:
+		panic("unknown compatibility profile")
+	}
+}
+
+// ExpressionExtensions returns true if expressions may use extensions to the syntax defined by the specification,
+// like escape sequences in quoted strings, triple-quoted raw strings and function calls.
+func (c CompatibilityProfile) ExpressionExtensions() bool {
+	return c == ProfileDefault || c == ProfileAkamai
+}
+
+// MarshalText implements the [encoding.TextMarshaler] interface.
+//
+// The profiles are encoded as "default", "spec-strict", "akamai", "fastly" and "varnish".
+func (c CompatibilityProfile) MarshalText() ([]byte, error) {
+	for name, profile := range profileNames {
+		if profile == c {
+			return []byte(name), nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown compatibility profile %d", c)
+}
+
+// SupportsElement returns true if the ESI element with the given local name is supported by the profile.
+func (c CompatibilityProfile) SupportsElement(local string) bool {
+	switch local {
+	case NameComment, NameInclude, NameRemove:
+		return true
+	case NameAttempt, NameChoose, NameExcept, NameInline, NameOtherwise, NameTry, NameVars, NameWhen:
+		return c != ProfileFastly && c != ProfileVarnish
+	default:
+		return false
+	}
+}
+
+// UnmarshalText implements the [encoding.TextUnmarshaler] interface.
+//
+// See [CompatibilityProfile.MarshalText] for the supported names.
+func (c *CompatibilityProfile) UnmarshalText(text []byte) error {
+	profile, ok := profileNames[string(text)]
+	if !ok {
+		return fmt.Errorf("unknown compatibility profile %q", text)
+	}
+
+	*c = profile
+	return nil
+}
+
+var profileNames = map[string]CompatibilityProfile{
+	"default":     ProfileDefault,
+	"spec-strict": ProfileSpecStrict,
+	"akamai":      ProfileAkamai,
+	"fastly":      ProfileFastly,
+	"varnish":     ProfileVarnish,
+}
+
+// WithCompatibilityProfile configures the [Parser] to accept the markup of the given profile.
+//
+// Depending on the profile, the following options are used:
+//
+//   - [ProfileSpecStrict] uses [WithRejectNamespacedAttrs].
+//   - [ProfileAkamai] uses [WithESINamespacedAttrs].
+//   - [ProfileFastly] and [ProfileVarnish] use [esixml.WithSyntaxErrorRecovery].
+//
+// [ProfileDefault] does not change any options.
+//
+// If profile is not a known profile, WithCompatibilityProfile panics.
+func WithCompatibilityProfile(profile CompatibilityProfile) ParserOpt {
+	switch profile {
+	case ProfileDefault:
+		return func(*parserOptions) {}
+	case ProfileSpecStrict:
+		return WithRejectNamespacedAttrs()
+	case ProfileAkamai:
+		return WithESINamespacedAttrs()
+	case ProfileFastly, ProfileVarnish:
+		return WithReaderOptions(esixml.WithSyntaxErrorRecovery())
+	default:
+		panic("WithCompatibilityProfile called with unknown profile")
+	}
+}
+
+// WithVarnishCompatibility configures the [Parser] to parse documents like Varnish Cache.
+//
+// This is the same as using [WithCompatibilityProfile] with [ProfileVarnish] and should be used together with
+// esiproc.WithVarnishCompatibility.
+func WithVarnishCompatibility() ParserOpt {
+	return WithCompatibilityProfile(ProfileVarnish)
+}
@@ -0,0 +1,70 @@
+package esi_test
+
+import (
+	"testing"
+
+	"github.com/nussjustin/esi"
+)
+
+func TestCompatibilityProfile(t *testing.T) {
+	testCases := []struct {
+		Profile              esi.CompatibilityProfile
+		String               string
+		ExpressionExtensions bool
+		Choose               bool
+		Text                 string
+	}{
+		{esi.ProfileDefault, "ProfileDefault", true, true, "default"},
+		{esi.ProfileSpecStrict, "ProfileSpecStrict", false, true, "spec-strict"},
+		{esi.ProfileAkamai, "ProfileAkamai", true, true, "akamai"},
+		{esi.ProfileFastly, "ProfileFastly", false, false, "fastly"},
+		{esi.ProfileVarnish, "ProfileVarnish", false, false, "varnish"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.String, func(t *testing.T) {
+			if got := testCase.Profile.String(); got != testCase.String {
+				t.Errorf("String(): got %q, want %q", got, testCase.String)
+			}
+
+			if got := testCase.Profile.ExpressionExtensions(); got != testCase.ExpressionExtensions {
+				t.Errorf("ExpressionExtensions(): got %t, want %t", got, testCase.ExpressionExtensions)
+			}
+
+			if got := testCase.Profile.SupportsElement("choose"); got != testCase.Choose {
+				t.Errorf("SupportsElement(%q): got %t, want %t", "choose", got, testCase.Choose)
+			}
+
+			if !testCase.Profile.SupportsElement("include") {
+				t.Errorf("SupportsElement(%q): got false, want true", "include")
+			}
+
+			if testCase.Profile.SupportsElement("unknown") {
+				t.Errorf("SupportsElement(%q): got true, want false", "unknown")
+			}
+
+			text, err := testCase.Profile.MarshalText()
+			if err != nil || string(text) != testCase.Text {
+				t.Errorf("MarshalText(): got (%q, %v), want (%q, nil)", text, err, testCase.Text)
+			}
+
+			var profile esi.CompatibilityProfile
+
+			if err := profile.UnmarshalText([]byte(testCase.Text)); err != nil || profile != testCase.Profile {
+				t.Errorf("UnmarshalText(%q): got (%s, %v), want (%s, nil)", testCase.Text, profile, err, testCase.Profile)
+			}
+		})
+	}
+}
+
+func TestCompatibilityProfile_UnmarshalText_Unknown(t *testing.T) {
+	var profile esi.CompatibilityProfile
+
+	if err := profile.UnmarshalText([]byte("unknown")); err == nil {
+		t.Errorf("got nil error for unknown profile")
+	}
+
+	if _, err := esi.CompatibilityProfile(255).MarshalText(); err == nil {
+		t.Errorf("got nil error for unknown profile")
+	}
+}
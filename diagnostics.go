@@ -0,0 +1,88 @@
+package esi
+
+import "encoding/json"
+
+// Diagnostic is a structured, machine-readable description of an error.
+//
+// All error types in this module implement [encoding/json.Marshaler] and are encoded using the fields of Diagnostic,
+// so that tools like linters and editors can consume errors returned by the parser or processor directly. The field
+// names are stable.
+type Diagnostic struct {
+	// Code is the code of the error as returned by its Code method, for example "esi.missing_attribute".
+	//
+	// Code is empty for errors that do not implement a Code method.
+	Code string `json:"code"`
+
+	// Message is the human-readable error message.
+	Message string `json:"message"`
+
+	// Offset is the offset in the input at which the error occurred, for errors that report a single offset.
+	Offset *int `json:"offset,omitempty"`
+
+	// Start is the inclusive start offset of the input range in which the error occurred, if known.
+	Start *int `json:"start,omitempty"`
+
+	// End is the exclusive end offset of the input range in which the error occurred, if known.
+	End *int `json:"end,omitempty"`
+
+	// Element is the name of the element in which the error occurred, if any.
+	Element string `json:"element,omitempty"`
+
+	// Attribute is the name of the attribute in which the error occurred, if any.
+	Attribute string `json:"attribute,omitempty"`
+
+	// Expected contains the expected values, characters or token types, if known.
+	Expected []string `json:"expected,omitempty"`
+
+	// Got is the value, character or token type that was found instead, if known.
+	Got string `json:"got,omitempty"`
+
+	// Details contains additional information specific to the type of error.
+	Details map[string]any `json:"details,omitempty"`
+
+	// Cause describes the underlying error, if any.
+	Cause *Diagnostic `json:"cause,omitempty"`
+}
+
+// Diagnostics converts the given error into a list of diagnostics.
+//
+// Errors joined using [errors.Join] or wrapped using [fmt.Errorf] are unwrapped until an error implementing both a
+// Code method and [encoding/json.Marshaler] is found, which is then converted into a single [Diagnostic]. Errors
+// without a code result in a Diagnostic that only contains the error message.
+//
+// If err is nil, Diagnostics returns nil.
+func Diagnostics(err error) []Diagnostic {
+	if err == nil {
+		return nil
+	}
+
+	return appendDiagnostics(nil, err)
+}
+
+func appendDiagnostics(ds []Diagnostic, err error) []Diagnostic {
+	if m, ok := err.(interface {
+		Code() string
+		json.Marshaler
+	}); ok {
+		var d Diagnostic
+
+		if b, err := m.MarshalJSON(); err == nil && json.Unmarshal(b, &d) == nil {
+			return append(ds, d)
+		}
+	}
+
+	switch x := err.(type) {
+	case interface{ Unwrap() []error }:
+		for _, err := range x.Unwrap() {
+			ds = appendDiagnostics(ds, err)
+		}
+
+		return ds
+	case interface{ Unwrap() error }:
+		if inner := x.Unwrap(); inner != nil {
+			return appendDiagnostics(ds, inner)
+		}
+	}
+
+	return append(ds, Diagnostic{Message: err.Error()})
+}
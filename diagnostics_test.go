@@ -0,0 +1,243 @@
+package esi_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/nussjustin/esi"
+	"github.com/nussjustin/esi/esiexpr"
+	"github.com/nussjustin/esi/esiexpr/ast"
+	"github.com/nussjustin/esi/esiexpr/token"
+	"github.com/nussjustin/esi/esihttp"
+	"github.com/nussjustin/esi/esiproc"
+	"github.com/nussjustin/esi/esissi"
+	"github.com/nussjustin/esi/esitmpl"
+	"github.com/nussjustin/esi/esixml"
+)
+
+func intPtr(v int) *int {
+	return &v
+}
+
+func TestDiagnostics(t *testing.T) {
+	include := &esi.IncludeElement{Position: esi.Position{Start: 5, End: 20}}
+
+	testCases := []struct {
+		Name     string
+		Error    error
+		Expected []esi.Diagnostic
+	}{
+		{
+			Name:     "nil",
+			Error:    nil,
+			Expected: nil,
+		},
+		{
+			Name:     "no code",
+			Error:    errors.New("no code"),
+			Expected: []esi.Diagnostic{{Message: "no code"}},
+		},
+		{
+			Name: "attribute",
+			Error: &esi.MissingAttributeError{
+				Position:  esi.Position{Start: 1, End: 10},
+				Element:   esixml.Name{Space: "esi", Local: "include"},
+				Attribute: esixml.Name{Local: "src"},
+			},
+			Expected: []esi.Diagnostic{{
+				Code:      "esi.missing_attribute",
+				Message:   "missing attribute src in element esi:include at position 1:10",
+				Start:     intPtr(1),
+				End:       intPtr(10),
+				Element:   "esi:include",
+				Attribute: "src",
+			}},
+		},
+		{
+			Name: "expected and got",
+			Error: &esi.InvalidAttributeValueError{
+				Position: esi.Position{Start: 1, End: 10},
+				Element:  esixml.Name{Space: "esi", Local: "include"},
+				Name:     esixml.Name{Local: "onerror"},
+				Value:    "ignore",
+				Allowed:  []string{"continue"},
+			},
+			Expected: []esi.Diagnostic{{
+				Code:      "esi.invalid_attribute_value",
+				Message:   `invalid value "ignore" for attribute onerror in element esi:include at position 1:10`,
+				Start:     intPtr(1),
+				End:       intPtr(10),
+				Element:   "esi:include",
+				Attribute: "onerror",
+				Expected:  []string{"continue"},
+				Got:       "ignore",
+			}},
+		},
+		{
+			Name:  "offset",
+			Error: &esixml.UnexpectedCharacterError{At: 3, Got: 'a', Expected: '>'},
+			Expected: []esi.Diagnostic{{
+				Code:     "esixml.unexpected_character",
+				Message:  "unexpected character 'a' at offset 3, '>' expected",
+				Offset:   intPtr(3),
+				Expected: []string{">"},
+				Got:      "a",
+			}},
+		},
+		{
+			Name:  "details",
+			Error: &esiproc.TooManyIncludesError{Element: include, Max: 1},
+			Expected: []esi.Diagnostic{{
+				Code:    "esiproc.too_many_includes",
+				Message: "too many includes, esi:include at position 5:20 exceeds limit of 1",
+				Start:   intPtr(5),
+				End:     intPtr(20),
+				Element: "esi:include",
+				Details: map[string]any{"max": float64(1)},
+			}},
+		},
+		{
+			Name:  "cause",
+			Error: &esiproc.WriteError{Err: &esixml.InvalidUTF8Error{At: 2}},
+			Expected: []esi.Diagnostic{{
+				Code:    "esiproc.write",
+				Message: "write failed: invalid UTF-8 at offset 2",
+				Cause: &esi.Diagnostic{
+					Code:    "esixml.invalid_utf8",
+					Message: "invalid UTF-8 at offset 2",
+					Offset:  intPtr(2),
+				},
+			}},
+		},
+		{
+			Name:  "cause without code",
+			Error: &esiproc.WriteError{Err: errors.New("broken pipe")},
+			Expected: []esi.Diagnostic{{
+				Code:    "esiproc.write",
+				Message: "write failed: broken pipe",
+				Cause:   &esi.Diagnostic{Message: "broken pipe"},
+			}},
+		},
+		{
+			Name:  "wrapped",
+			Error: fmt.Errorf("wrapped: %w", &esixml.InvalidNameError{At: 4}),
+			Expected: []esi.Diagnostic{{
+				Code:    "esixml.invalid_name",
+				Message: "invalid name at offset 4",
+				Offset:  intPtr(4),
+			}},
+		},
+		{
+			Name: "joined",
+			Error: errors.Join(
+				&esixml.InvalidNameError{At: 4},
+				errors.New("no code"),
+				fmt.Errorf("wrapped: %w", &esihttp.ServerError{StatusCode: 503}),
+			),
+			Expected: []esi.Diagnostic{
+				{
+					Code:    "esixml.invalid_name",
+					Message: "invalid name at offset 4",
+					Offset:  intPtr(4),
+				},
+				{
+					Message: "no code",
+				},
+				{
+					Code:    "esihttp.server",
+					Message: "unexpected status code: 503",
+					Details: map[string]any{"status_code": float64(503)},
+				},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			got := esi.Diagnostics(testCase.Error)
+
+			if diff := cmp.Diff(testCase.Expected, got); diff != "" {
+				t.Errorf("Diagnostics() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestMarshalJSON(t *testing.T) {
+	include := &esi.IncludeElement{Position: esi.Position{Start: 5, End: 20}}
+
+	testCases := []error{
+		&esi.DuplicateElementError{},
+		&esi.EmptyElementError{},
+		&esi.InvalidAttributeValueError{},
+		&esi.InvalidElementError{},
+		&esi.MissingAttributeError{},
+		&esi.MissingElementError{},
+		&esi.UnclosedElementError{},
+		&esi.UnexpectedAttributeError{},
+		&esi.UnexpectedElementError{},
+		&esi.UnexpectedEndElementError{},
+		&esi.UnexpectedTokenError{},
+		&ast.Error{},
+		&ast.LimitError{},
+		&ast.MissingOperandError{},
+		&ast.UnexpectedTokenError{Token: token.Token{Type: token.TypeComma}},
+		&ast.UnexpectedWhiteSpaceError{},
+		&esiexpr.ComparisonUnsupportedError{},
+		&esiexpr.InvalidArgumentError{},
+		&esiexpr.NonBoolValueError{},
+		&esiexpr.UnknownFunctionError{},
+		&esihttp.ClientError{},
+		&esihttp.ServerError{},
+		&esihttp.UnknownRecordingError{},
+		&esihttp.UnsupportedEncodingError{},
+		&esiproc.ClosedError{},
+		&esiproc.ConfigError{},
+		&esiproc.InjectionError{},
+		&esiproc.InvalidDataURLError{},
+		&esiproc.InvalidExpressionResultError{Element: include},
+		&esiproc.PanicError{},
+		&esiproc.TooManyBranchesError{Element: include},
+		&esiproc.TooManyIncludesError{Element: include},
+		&esiproc.UnexpectedElementError{Element: include},
+		&esiproc.UnsupportedElementError{Element: include},
+		&esiproc.WriteError{},
+		&esissi.DirectiveError{},
+		&esitmpl.ExpressionError{Element: include},
+		&esitmpl.LoadError{},
+		&esixml.ControlByteError{},
+		&esixml.DuplicateAttributeError{},
+		&esixml.InvalidNameError{},
+		&esixml.InvalidUTF8Error{},
+		&esixml.SyntaxError{},
+		&esixml.UnexpectedCharacterError{},
+		&esixml.UnexpectedEndOfInput{},
+		&esixml.UnsupportedEntityError{},
+	}
+
+	for _, err := range testCases {
+		t.Run(fmt.Sprintf("%T", err), func(t *testing.T) {
+			b, jerr := json.Marshal(err)
+			if jerr != nil {
+				t.Fatalf("failed to marshal error: %s", jerr)
+			}
+
+			var got esi.Diagnostic
+			if jerr := json.Unmarshal(b, &got); jerr != nil {
+				t.Fatalf("failed to unmarshal diagnostic: %s", jerr)
+			}
+
+			if want := esi.ErrorCode(err); got.Code != want {
+				t.Errorf("got code %q, want %q", got.Code, want)
+			}
+
+			if want := err.Error(); got.Message != want {
+				t.Errorf("got message %q, want %q", got.Message, want)
+			}
+		})
+	}
+}
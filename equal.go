@@ -0,0 +1,159 @@
+package esi
+
+import (
+	"bytes"
+	"slices"
+
+	"github.com/nussjustin/esi/esixml"
+)
+
+// Equal returns true if a and b are of the same type and contain the same attributes, data and children.
+//
+// If ignorePositions is true, the positions of nodes and attributes are not compared. This allows comparing nodes
+// parsed from documents that differ only in formatting outside of nodes.
+//
+// Two nil nodes are equal.
+func Equal(a, b Node, ignorePositions bool) bool {
+	e := equaler{ignorePositions: ignorePositions}
+	return e.node(a, b)
+}
+
+type equaler struct {
+	ignorePositions bool
+}
+
+func (e equaler) attrs(a, b []esixml.Attr) bool {
+	return slices.EqualFunc(a, b, func(a, b esixml.Attr) bool {
+		return e.position(a.Position, b.Position) &&
+			e.position(a.NamePosition, b.NamePosition) &&
+			e.position(a.ValuePosition, b.ValuePosition) &&
+			a.Name == b.Name &&
+			a.Value == b.Value
+	})
+}
+
+func (e equaler) nodes(a, b []Node) bool {
+	return slices.EqualFunc(a, b, e.node)
+}
+
+func (e equaler) position(a, b Position) bool {
+	return e.ignorePositions || a == b
+}
+
+func (e equaler) node(a, b Node) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+
+	switch a := a.(type) {
+	case *AttemptElement:
+		b, ok := b.(*AttemptElement)
+		return ok && e.attempt(a, b)
+	case *ChooseElement:
+		b, ok := b.(*ChooseElement)
+		return ok && e.position(a.Position, b.Position) &&
+			e.attrs(a.Attr, b.Attr) &&
+			slices.EqualFunc(a.When, b.When, e.when) &&
+			e.otherwise(a.Otherwise, b.Otherwise)
+	case *Comment:
+		b, ok := b.(*Comment)
+		return ok && e.position(a.Position, b.Position) && e.nodes(a.Nodes, b.Nodes)
+	case *CommentElement:
+		b, ok := b.(*CommentElement)
+		return ok && e.position(a.Position, b.Position) && e.attrs(a.Attr, b.Attr) && a.Text == b.Text
+	case *Doctype:
+		b, ok := b.(*Doctype)
+		return ok && e.position(a.Position, b.Position) && bytes.Equal(a.Bytes, b.Bytes)
+	case *ExceptElement:
+		b, ok := b.(*ExceptElement)
+		return ok && e.except(a, b)
+	case *IncludeElement:
+		b, ok := b.(*IncludeElement)
+		return ok && e.position(a.Position, b.Position) &&
+			e.attrs(a.Attr, b.Attr) &&
+			a.Alt == b.Alt &&
+			a.FragmentName == b.FragmentName &&
+			a.OnError == b.OnError &&
+			a.Source == b.Source
+	case *InlineElement:
+		b, ok := b.(*InlineElement)
+		return ok && e.position(a.Position, b.Position) &&
+			e.attrs(a.Attr, b.Attr) &&
+			a.FragmentName == b.FragmentName &&
+			a.Fetchable == b.Fetchable &&
+			e.nodes(a.Nodes, b.Nodes)
+	case *OtherwiseElement:
+		b, ok := b.(*OtherwiseElement)
+		return ok && e.otherwise(a, b)
+	case *RawData:
+		b, ok := b.(*RawData)
+		return ok && e.position(a.Position, b.Position) && bytes.Equal(a.Bytes, b.Bytes) && equalSpill(a.Spill, b.Spill)
+	case *RemoveElement:
+		b, ok := b.(*RemoveElement)
+		return ok && e.position(a.Position, b.Position) && e.attrs(a.Attr, b.Attr) && e.nodes(a.Nodes, b.Nodes)
+	case *TryElement:
+		b, ok := b.(*TryElement)
+		return ok && e.position(a.Position, b.Position) &&
+			e.attrs(a.Attr, b.Attr) &&
+			e.attempt(a.Attempt, b.Attempt) &&
+			e.except(a.Except, b.Except)
+	case *VarsElement:
+		b, ok := b.(*VarsElement)
+		return ok && e.position(a.Position, b.Position) && e.attrs(a.Attr, b.Attr) && e.nodes(a.Nodes, b.Nodes)
+	case *WhenElement:
+		b, ok := b.(*WhenElement)
+		return ok && e.when(a, b)
+	case *XMLComment:
+		b, ok := b.(*XMLComment)
+		return ok && e.position(a.Position, b.Position) && e.nodes(a.Nodes, b.Nodes)
+	case *XMLDeclaration:
+		b, ok := b.(*XMLDeclaration)
+		return ok && e.position(a.Position, b.Position) && bytes.Equal(a.Bytes, b.Bytes)
+	default:
+		panic("unknown node type")
+	}
+}
+
+func (e equaler) attempt(a, b *AttemptElement) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+
+	return e.position(a.Position, b.Position) && e.attrs(a.Attr, b.Attr) && e.nodes(a.Nodes, b.Nodes)
+}
+
+func (e equaler) except(a, b *ExceptElement) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+
+	return e.position(a.Position, b.Position) && e.attrs(a.Attr, b.Attr) && e.nodes(a.Nodes, b.Nodes)
+}
+
+func (e equaler) otherwise(a, b *OtherwiseElement) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+
+	return e.position(a.Position, b.Position) && e.attrs(a.Attr, b.Attr) && e.nodes(a.Nodes, b.Nodes)
+}
+
+func (e equaler) when(a, b *WhenElement) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+
+	return e.position(a.Position, b.Position) &&
+		e.attrs(a.Attr, b.Attr) &&
+		a.Test == b.Test &&
+		e.nodes(a.Nodes, b.Nodes)
+}
+
+// equalSpill returns true if a and b are both nil or reference the same data.
+func equalSpill(a, b *Spill) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return *a == *b
+}
@@ -0,0 +1,134 @@
+package esi_test
+
+import (
+	"testing"
+
+	"github.com/nussjustin/esi"
+	"github.com/nussjustin/esi/esixml"
+)
+
+func TestEqual(t *testing.T) {
+	nodes := parseAll(t, cloneTestInput)
+
+	for i, node := range nodes {
+		if !esi.Equal(node, esi.CloneNode(node), false) {
+			t.Errorf("node %T at index %d is not equal to its clone", node, i)
+		}
+	}
+
+	testCases := []struct {
+		Name            string
+		A, B            esi.Node
+		IgnorePositions bool
+		Expected        bool
+	}{
+		{
+			Name:     "nil",
+			Expected: true,
+		},
+		{
+			Name:     "nil and non-nil",
+			A:        &esi.RawData{},
+			Expected: false,
+		},
+		{
+			Name:     "different types",
+			A:        &esi.Comment{},
+			B:        &esi.XMLComment{},
+			Expected: false,
+		},
+		{
+			Name:     "different positions",
+			A:        &esi.RawData{Position: esi.Position{Start: 0, End: 1}, Bytes: []byte("a")},
+			B:        &esi.RawData{Position: esi.Position{Start: 1, End: 2}, Bytes: []byte("a")},
+			Expected: false,
+		},
+		{
+			Name:            "different positions ignored",
+			A:               &esi.RawData{Position: esi.Position{Start: 0, End: 1}, Bytes: []byte("a")},
+			B:               &esi.RawData{Position: esi.Position{Start: 1, End: 2}, Bytes: []byte("a")},
+			IgnorePositions: true,
+			Expected:        true,
+		},
+		{
+			Name:            "different data",
+			A:               &esi.RawData{Bytes: []byte("a")},
+			B:               &esi.RawData{Bytes: []byte("b")},
+			IgnorePositions: true,
+			Expected:        false,
+		},
+		{
+			Name: "different attribute positions ignored",
+			A: &esi.IncludeElement{
+				Position: esi.Position{Start: 0, End: 30},
+				Attr:     []esixml.Attr{{Position: esi.Position{Start: 10, End: 15}, Name: esixml.Name{Local: "a"}}},
+				Source:   "/",
+			},
+			B: &esi.IncludeElement{
+				Position: esi.Position{Start: 5, End: 40},
+				Attr:     []esixml.Attr{{Position: esi.Position{Start: 20, End: 25}, Name: esixml.Name{Local: "a"}}},
+				Source:   "/",
+			},
+			IgnorePositions: true,
+			Expected:        true,
+		},
+		{
+			Name: "different attribute value positions",
+			A: &esi.IncludeElement{
+				Attr: []esixml.Attr{{ValuePosition: esi.Position{Start: 10, End: 15}, Name: esixml.Name{Local: "a"}}},
+			},
+			B: &esi.IncludeElement{
+				Attr: []esixml.Attr{{ValuePosition: esi.Position{Start: 11, End: 15}, Name: esixml.Name{Local: "a"}}},
+			},
+			Expected: false,
+		},
+		{
+			Name:            "different fragment names",
+			A:               &esi.IncludeElement{FragmentName: "a", Source: "/"},
+			B:               &esi.IncludeElement{FragmentName: "b", Source: "/"},
+			IgnorePositions: true,
+			Expected:        false,
+		},
+		{
+			Name:            "different attribute values",
+			A:               &esi.IncludeElement{Attr: []esixml.Attr{{Name: esixml.Name{Local: "a"}, Value: "1"}}},
+			B:               &esi.IncludeElement{Attr: []esixml.Attr{{Name: esixml.Name{Local: "a"}, Value: "2"}}},
+			IgnorePositions: true,
+			Expected:        false,
+		},
+		{
+			Name: "different nested nodes",
+			A: &esi.ChooseElement{
+				When: []*esi.WhenElement{{Test: "a", Nodes: []esi.Node{&esi.RawData{Bytes: []byte("a")}}}},
+			},
+			B: &esi.ChooseElement{
+				When: []*esi.WhenElement{{Test: "a", Nodes: []esi.Node{&esi.RawData{Bytes: []byte("b")}}}},
+			},
+			Expected: false,
+		},
+		{
+			Name:     "missing otherwise",
+			A:        &esi.ChooseElement{Otherwise: &esi.OtherwiseElement{}},
+			B:        &esi.ChooseElement{},
+			Expected: false,
+		},
+		{
+			Name:     "missing except",
+			A:        &esi.TryElement{Attempt: &esi.AttemptElement{}, Except: &esi.ExceptElement{}},
+			B:        &esi.TryElement{Attempt: &esi.AttemptElement{}},
+			Expected: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			if got := esi.Equal(testCase.A, testCase.B, testCase.IgnorePositions); got != testCase.Expected {
+				t.Errorf("Equal(a, b): got %t, want %t", got, testCase.Expected)
+			}
+
+			if got := esi.Equal(testCase.B, testCase.A, testCase.IgnorePositions); got != testCase.Expected {
+				t.Errorf("Equal(b, a): got %t, want %t", got, testCase.Expected)
+			}
+		})
+	}
+}
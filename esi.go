@@ -1,5 +1,15 @@
 package esi
 
+import (
+	"bytes"
+	"errors"
+	"iter"
+	"strings"
+
+	"github.com/nussjustin/esi/esixml"
+	"github.com/nussjustin/esi/internal/markup"
+)
+
 const (
 	// Capability is the capability token for ESI processors.
 	Capability = "ESI/1.0"
@@ -8,6 +18,106 @@ const (
 	InlineCapability = "ESI-Inline/1.0"
 )
 
+// Namespace is the XML namespace prefix used for ESI elements.
+const Namespace = "esi"
+
+// Local names of all ESI elements, without the [Namespace].
+const (
+	// NameAttempt is the local name of the <esi:attempt> element.
+	NameAttempt = "attempt"
+
+	// NameChoose is the local name of the <esi:choose> element.
+	NameChoose = "choose"
+
+	// NameComment is the local name of the <esi:comment> element.
+	NameComment = "comment"
+
+	// NameExcept is the local name of the <esi:except> element.
+	NameExcept = "except"
+
+	// NameInclude is the local name of the <esi:include> element.
+	NameInclude = "include"
+
+	// NameInline is the local name of the <esi:inline> element.
+	NameInline = "inline"
+
+	// NameOtherwise is the local name of the <esi:otherwise> element.
+	NameOtherwise = "otherwise"
+
+	// NameRemove is the local name of the <esi:remove> element.
+	NameRemove = "remove"
+
+	// NameTry is the local name of the <esi:try> element.
+	NameTry = "try"
+
+	// NameVars is the local name of the <esi:vars> element.
+	NameVars = "vars"
+
+	// NameWhen is the local name of the <esi:when> element.
+	NameWhen = "when"
+)
+
+// Contains reports whether data contains any ESI markup, that is ESI start or end tags (like "<esi:include" or
+// "</esi:try") or ESI comments ("<!--esi").
+//
+// Contains only scans for the start of markup, without parsing it, which is considerably cheaper than using a
+// [Parser]. This allows deciding whether data needs to be processed at all. Like [Parse], Contains accepts both
+// []byte and string, so that documents held as string do not need to be converted.
+//
+// Contains never returns false for data containing ESI markup, but may return true for markup that a [Parser] would
+// treat as data, for example "<!--esi" inside an XML comment or invalid elements.
+func Contains[T []byte | string](data T) bool {
+	for {
+		i := indexByte(data, '<')
+		if i == -1 {
+			return false
+		}
+
+		if markup.IsStart(data[i:], true) {
+			return true
+		}
+
+		data = data[i+1:]
+	}
+}
+
+// indexByte returns the index of the first instance of c in s, or -1 if c is not present in s.
+func indexByte[T []byte | string](s T, c byte) int {
+	switch s := any(s).(type) {
+	case []byte:
+		return bytes.IndexByte(s, c)
+	case string:
+		return strings.IndexByte(s, c)
+	default:
+		panic("unreachable")
+	}
+}
+
+// ElementNames returns an iterator over the names of all ESI elements, sorted by their local name.
+func ElementNames() iter.Seq[esixml.Name] {
+	return func(yield func(esixml.Name) bool) {
+		for _, local := range elementNames {
+			if !yield(esixml.Name{Space: Namespace, Local: local}) {
+				return
+			}
+		}
+	}
+}
+
+var elementNames = [...]string{
+	NameAttempt,
+	NameChoose,
+	NameComment,
+	NameExcept,
+	NameInclude,
+	NameInline,
+	NameOtherwise,
+	NameRemove,
+	NameTry,
+	NameVars,
+	NameWhen,
+}
+
 // ErrorBehaviour defines the valid values for the "onerror" attribute of the <esi:include> tag.
 type ErrorBehaviour string
 
@@ -19,6 +129,22 @@ const (
 	ErrorBehaviourDefault ErrorBehaviour = ""
 )
 
+// ErrorBehaviours returns an iterator over all valid error behaviours, including [ErrorBehaviourDefault].
+func ErrorBehaviours() iter.Seq[ErrorBehaviour] {
+	return func(yield func(ErrorBehaviour) bool) {
+		for _, e := range errorBehaviours {
+			if !yield(e) {
+				return
+			}
+		}
+	}
+}
+
+var errorBehaviours = [...]ErrorBehaviour{
+	ErrorBehaviourDefault,
+	ErrorBehaviourContinue,
+}
+
 // String returns the name of the behaviour.
 func (e ErrorBehaviour) String() string {
 	switch e {
@@ -30,3 +156,45 @@ func (e ErrorBehaviour) String() string {
 		panic("unknown error behaviour")
 	}
 }
+
+// ErrorCode returns the machine-readable code of the first error in the tree of err that has a Code method.
+//
+// All error types in this module implement a Code method that returns a stable code in the form "package.name", for
+// example "esi.missing_attribute" or "esixml.syntax". Codes can be used for metrics or to handle errors without
+// depending on error messages.
+//
+// If no error in the tree has a code, ErrorCode returns an empty string.
+func ErrorCode(err error) string {
+	var coder interface{ Code() string }
+
+	if !errors.As(err, &coder) {
+		return ""
+	}
+
+	return coder.Code()
+}
+
+// Nodes is a list of nodes.
+type Nodes []Node
+
+// All returns an iterator over the nodes in n, for use with functions like
+// [github.com/nussjustin/esi/esiproc.Processor.Process] that expect the nodes as returned by [Parser.All].
+//
+// This can be used to process nodes that were parsed ahead of time, for example when caching parsed documents. The
+// returned iterator never yields an error.
+func (n Nodes) All() iter.Seq2[Node, error] {
+	return func(yield func(Node, error) bool) {
+		for _, node := range n {
+			if !yield(node, nil) {
+				return
+			}
+		}
+	}
+}
+
+// Seq returns an iterator over the given nodes.
+//
+// It is a shorthand for Nodes(nodes).All(). See [Nodes.All] for details.
+func Seq(nodes ...Node) iter.Seq2[Node, error] {
+	return Nodes(nodes).All()
+}
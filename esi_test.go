@@ -0,0 +1,222 @@
+package esi_test
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/nussjustin/esi"
+	"github.com/nussjustin/esi/esiexpr"
+	"github.com/nussjustin/esi/esiexpr/ast"
+	"github.com/nussjustin/esi/esihttp"
+	"github.com/nussjustin/esi/esiproc"
+	"github.com/nussjustin/esi/esissi"
+	"github.com/nussjustin/esi/esitmpl"
+	"github.com/nussjustin/esi/esixml"
+)
+
+func TestContains(t *testing.T) {
+	testCases := []struct {
+		Input    string
+		Expected bool
+	}{
+		{Input: ``, Expected: false},
+		{Input: `<p>Hello <b>World</b></p>`, Expected: false},
+		{Input: `<!-- comment --> <esi`, Expected: false},
+		{Input: `<es:include/> <esix:include/> <e <`, Expected: false},
+		{Input: `<!--es`, Expected: false},
+		{Input: `<esi:include src="/"/>`, Expected: true},
+		{Input: `before <ESI:Include src="/"/>`, Expected: true},
+		{Input: `before </esi:try>`, Expected: true},
+		{Input: `<esi:`, Expected: true},
+		{Input: `<!--esi`, Expected: true},
+		{Input: `before <!--ESI <p>data</p> -->`, Expected: true},
+		{Input: `<!-- <!--esi -->`, Expected: true},
+	}
+
+	for _, testCase := range testCases {
+		if got := esi.Contains([]byte(testCase.Input)); got != testCase.Expected {
+			t.Errorf("Contains(%q) = %t, want %t", testCase.Input, got, testCase.Expected)
+		}
+
+		if got := esi.Contains(testCase.Input); got != testCase.Expected {
+			t.Errorf("Contains[string](%q) = %t, want %t", testCase.Input, got, testCase.Expected)
+		}
+	}
+}
+
+func BenchmarkContains(b *testing.B) {
+	data := []byte(strings.Repeat("<p>A paragraph of <b>HTML</b> without any ESI markup.</p>\n", 16*1024))
+
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+
+	for b.Loop() {
+		if esi.Contains(data) {
+			b.Fatal("unexpected markup")
+		}
+	}
+}
+
+func TestElementNames(t *testing.T) {
+	got := slices.Collect(esi.ElementNames())
+
+	want := []esixml.Name{
+		{Space: "esi", Local: "attempt"},
+		{Space: "esi", Local: "choose"},
+		{Space: "esi", Local: "comment"},
+		{Space: "esi", Local: "except"},
+		{Space: "esi", Local: "include"},
+		{Space: "esi", Local: "inline"},
+		{Space: "esi", Local: "otherwise"},
+		{Space: "esi", Local: "remove"},
+		{Space: "esi", Local: "try"},
+		{Space: "esi", Local: "vars"},
+		{Space: "esi", Local: "when"},
+	}
+
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ElementNames() mismatch (-want +got):\n%s", diff)
+	}
+
+	for name := range esi.ElementNames() {
+		if !esi.ProfileDefault.SupportsElement(name.Local) {
+			t.Errorf("element %s not supported by %s", name, esi.ProfileDefault)
+		}
+	}
+}
+
+func TestErrorBehaviours(t *testing.T) {
+	got := slices.Collect(esi.ErrorBehaviours())
+	want := []esi.ErrorBehaviour{esi.ErrorBehaviourDefault, esi.ErrorBehaviourContinue}
+
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ErrorBehaviours() mismatch (-want +got):\n%s", diff)
+	}
+
+	for e := range esi.ErrorBehaviours() {
+		if e.String() == "" {
+			t.Errorf("got empty name for %q", string(e))
+		}
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	testCases := []struct {
+		Error    error
+		Expected string
+	}{
+		{Error: nil, Expected: ""},
+		{Error: errors.New("no code"), Expected: ""},
+		{Error: &esi.DuplicateElementError{}, Expected: "esi.duplicate_element"},
+		{Error: &esi.EmptyElementError{}, Expected: "esi.empty_element"},
+		{Error: &esi.InvalidAttributeValueError{}, Expected: "esi.invalid_attribute_value"},
+		{Error: &esi.InvalidElementError{}, Expected: "esi.invalid_element"},
+		{Error: &esi.MissingAttributeError{}, Expected: "esi.missing_attribute"},
+		{Error: &esi.MissingElementError{}, Expected: "esi.missing_element"},
+		{Error: &esi.UnclosedElementError{}, Expected: "esi.unclosed_element"},
+		{Error: &esi.UnexpectedAttributeError{}, Expected: "esi.unexpected_attribute"},
+		{Error: &esi.UnexpectedElementError{}, Expected: "esi.unexpected_element"},
+		{Error: &esi.UnexpectedEndElementError{}, Expected: "esi.unexpected_end_element"},
+		{Error: &esi.UnexpectedTokenError{}, Expected: "esi.unexpected_token"},
+		{Error: &ast.Error{}, Expected: "ast.syntax"},
+		{Error: &ast.LimitError{}, Expected: "ast.limit_exceeded"},
+		{Error: &ast.MissingOperandError{}, Expected: "ast.missing_operand"},
+		{Error: &ast.UnexpectedTokenError{}, Expected: "ast.unexpected_token"},
+		{Error: &ast.UnexpectedWhiteSpaceError{}, Expected: "ast.unexpected_whitespace"},
+		{Error: &esiexpr.ComparisonUnsupportedError{}, Expected: "esiexpr.comparison_unsupported"},
+		{Error: &esiexpr.InvalidArgumentError{}, Expected: "esiexpr.invalid_argument"},
+		{Error: &esiexpr.NonBoolValueError{}, Expected: "esiexpr.non_bool_value"},
+		{Error: &esiexpr.UnknownFunctionError{}, Expected: "esiexpr.unknown_function"},
+		{Error: &esihttp.ClientError{}, Expected: "esihttp.client"},
+		{Error: &esihttp.ServerError{}, Expected: "esihttp.server"},
+		{Error: &esihttp.UnknownRecordingError{}, Expected: "esihttp.unknown_recording"},
+		{Error: &esihttp.UnsupportedEncodingError{}, Expected: "esihttp.unsupported_encoding"},
+		{Error: &esiproc.ClosedError{}, Expected: "esiproc.closed"},
+		{Error: &esiproc.ConfigError{}, Expected: "esiproc.config"},
+		{Error: &esiproc.InjectionError{}, Expected: "esiproc.injection"},
+		{Error: &esiproc.InvalidDataURLError{}, Expected: "esiproc.invalid_data_url"},
+		{Error: &esiproc.InvalidExpressionResultError{}, Expected: "esiproc.invalid_expression_result"},
+		{Error: &esiproc.PanicError{}, Expected: "esiproc.panic"},
+		{Error: &esiproc.TooManyBranchesError{}, Expected: "esiproc.too_many_branches"},
+		{Error: &esiproc.TooManyIncludesError{}, Expected: "esiproc.too_many_includes"},
+		{Error: &esiproc.UnexpectedElementError{}, Expected: "esiproc.unexpected_element"},
+		{Error: &esiproc.UnsupportedElementError{}, Expected: "esiproc.unsupported_element"},
+		{Error: &esiproc.WriteError{}, Expected: "esiproc.write"},
+		{Error: &esissi.DirectiveError{}, Expected: "esissi.directive"},
+		{Error: &esitmpl.ExpressionError{}, Expected: "esitmpl.expression"},
+		{Error: &esitmpl.LoadError{}, Expected: "esitmpl.load"},
+		{Error: &esixml.ControlByteError{}, Expected: "esixml.control_byte"},
+		{Error: &esixml.DuplicateAttributeError{}, Expected: "esixml.duplicate_attribute"},
+		{Error: &esixml.InvalidNameError{}, Expected: "esixml.invalid_name"},
+		{Error: &esixml.InvalidUTF8Error{}, Expected: "esixml.invalid_utf8"},
+		{Error: &esixml.SyntaxError{}, Expected: "esixml.syntax"},
+		{Error: &esixml.UnexpectedCharacterError{}, Expected: "esixml.unexpected_character"},
+		{Error: &esixml.UnexpectedEndOfInput{}, Expected: "esixml.unexpected_end_of_input"},
+		{Error: &esixml.UnsupportedEntityError{}, Expected: "esixml.unsupported_entity"},
+		{Error: fmt.Errorf("wrapped: %w", &esixml.SyntaxError{}), Expected: "esixml.syntax"},
+		{Error: &esiproc.WriteError{Err: &esixml.SyntaxError{}}, Expected: "esiproc.write"},
+	}
+
+	for _, testCase := range testCases {
+		if got := esi.ErrorCode(testCase.Error); got != testCase.Expected {
+			t.Errorf("ErrorCode(%T): got %q, want %q", testCase.Error, got, testCase.Expected)
+		}
+	}
+}
+
+func TestNodes_All(t *testing.T) {
+	nodes := esi.Nodes{
+		&esi.RawData{Bytes: []byte("a")},
+		&esi.IncludeElement{Source: "/b"},
+		&esi.RawData{Bytes: []byte("c")},
+	}
+
+	var got esi.Nodes
+
+	for node, err := range nodes.All() {
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		got = append(got, node)
+	}
+
+	if diff := cmp.Diff(nodes, got); diff != "" {
+		t.Errorf("nodes mismatch (-want +got):\n%s", diff)
+	}
+
+	for node := range nodes.All() {
+		if node != nodes[0] {
+			t.Errorf("got node %v, want %v", node, nodes[0])
+		}
+
+		break
+	}
+}
+
+func TestSeq(t *testing.T) {
+	include := &esi.IncludeElement{Source: "/a"}
+
+	var got []esi.Node
+
+	for node, err := range esi.Seq(include) {
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		got = append(got, node)
+	}
+
+	if len(got) != 1 || got[0] != include {
+		t.Errorf("got nodes %v, want [%v]", got, include)
+	}
+
+	for range esi.Seq() {
+		t.Error("got node for empty sequence")
+	}
+}
@@ -0,0 +1,261 @@
+// Package esibuild implements helpers for constructing ESI nodes in code.
+//
+// The functions in this package return the same node types as the [esi.Parser] and can be combined to build complete
+// documents, for example:
+//
+//	nodes, err := esibuild.Build(
+//		esibuild.Text("<header>"),
+//		esibuild.Include("/header", esibuild.Alt("/header-fallback"), esibuild.OnError(esi.ErrorBehaviourContinue)),
+//		esibuild.Text("</header>"),
+//		esibuild.Choose(
+//			esibuild.When("$(HTTP_COOKIE{group})=='beta'", esibuild.Include("/beta")),
+//			esibuild.Otherwise(esibuild.Include("/stable")),
+//		),
+//	)
+//
+// [Build] validates the nodes using the same rules as the [esi.Parser], so that the result can be processed and
+// serialized without surprises.
+package esibuild
+
+import (
+	"github.com/nussjustin/esi"
+	"github.com/nussjustin/esi/esixml"
+)
+
+// Attempt returns a new esi:attempt element with the given child nodes, for use with [Try].
+func Attempt(nodes ...esi.Node) *esi.AttemptElement {
+	return &esi.AttemptElement{Nodes: nodes}
+}
+
+// Branch is a single branch of an esi:choose element as returned by [When] and [Otherwise].
+type Branch struct {
+	when      *esi.WhenElement
+	otherwise *esi.OtherwiseElement
+}
+
+// Build validates the given nodes and returns them as [esi.Nodes].
+//
+// Nodes are checked recursively using the same rules as the [esi.Parser]. If a node is invalid, an error of the same
+// type as returned by the parser for the equivalent markup is returned, for example an [*esi.MissingAttributeError]
+// for an esi:include element without src. Positions in the returned errors are always zero.
+//
+// Expressions, like the test attribute of esi:when elements, are not checked.
+func Build(nodes ...esi.Node) (esi.Nodes, error) {
+	if err := validateNodes(nodes); err != nil {
+		return nil, err
+	}
+
+	return nodes, nil
+}
+
+// Choose returns a new esi:choose element with the given branches.
+//
+// The esi:when branches are kept in order. If more than one esi:otherwise branch is given, Choose panics.
+//
+// [Build] fails if there are no esi:when branches.
+func Choose(branches ...Branch) *esi.ChooseElement {
+	e := &esi.ChooseElement{}
+
+	for _, b := range branches {
+		switch {
+		case b.when != nil:
+			e.When = append(e.When, b.when)
+		case e.Otherwise != nil:
+			panic("multiple esi:otherwise branches")
+		default:
+			e.Otherwise = b.otherwise
+		}
+	}
+
+	return e
+}
+
+// Comment returns a new esi:comment element with the given text.
+func Comment(text string) *esi.CommentElement {
+	return &esi.CommentElement{Text: text}
+}
+
+// Except returns a new esi:except element with the given child nodes, for use with [Try].
+func Except(nodes ...esi.Node) *esi.ExceptElement {
+	return &esi.ExceptElement{Nodes: nodes}
+}
+
+// IncludeOpt is the type for options that can be passed to [Include].
+type IncludeOpt func(*esi.IncludeElement)
+
+// Alt sets the alt attribute of an esi:include element.
+func Alt(alt string) IncludeOpt {
+	return func(e *esi.IncludeElement) {
+		e.Alt = alt
+	}
+}
+
+// Attr adds a non-standard attribute to an esi:include element.
+func Attr(name, value string) IncludeOpt {
+	return func(e *esi.IncludeElement) {
+		e.Attr = append(e.Attr, esixml.Attr{Name: esixml.Name{Local: name}, Value: value})
+	}
+}
+
+// FragmentName sets the non-standard name attribute of an esi:include element.
+//
+// As for parsed elements, the attribute is added to the non-standard attributes as well.
+func FragmentName(name string) IncludeOpt {
+	return func(e *esi.IncludeElement) {
+		e.Attr = append(e.Attr, esixml.Attr{Name: esixml.Name{Local: "name"}, Value: name})
+		e.FragmentName = name
+	}
+}
+
+// OnError sets the onerror attribute of an esi:include element.
+func OnError(behaviour esi.ErrorBehaviour) IncludeOpt {
+	return func(e *esi.IncludeElement) {
+		e.OnError = behaviour
+	}
+}
+
+// Include returns a new esi:include element for the given src and options.
+func Include(src string, opts ...IncludeOpt) *esi.IncludeElement {
+	e := &esi.IncludeElement{Source: src}
+
+	for _, opt := range opts {
+		opt(e)
+	}
+
+	return e
+}
+
+// Inline returns a new esi:inline element with the given name and child nodes.
+func Inline(name string, fetchable bool, nodes ...esi.Node) *esi.InlineElement {
+	return &esi.InlineElement{FragmentName: name, Fetchable: fetchable, Nodes: nodes}
+}
+
+// Otherwise returns an esi:otherwise branch with the given child nodes, for use with [Choose].
+func Otherwise(nodes ...esi.Node) Branch {
+	return Branch{otherwise: &esi.OtherwiseElement{Nodes: nodes}}
+}
+
+// Remove returns a new esi:remove element with the given child nodes.
+func Remove(nodes ...esi.Node) *esi.RemoveElement {
+	return &esi.RemoveElement{Nodes: nodes}
+}
+
+// Text returns a new node containing the given data.
+func Text(s string) *esi.RawData {
+	return &esi.RawData{Bytes: []byte(s)}
+}
+
+// Try returns a new esi:try element using the given esi:attempt and esi:except elements.
+//
+// See [Attempt] and [Except].
+func Try(attempt *esi.AttemptElement, except *esi.ExceptElement) *esi.TryElement {
+	return &esi.TryElement{Attempt: attempt, Except: except}
+}
+
+// Vars returns a new esi:vars element with the given child nodes.
+func Vars(nodes ...esi.Node) *esi.VarsElement {
+	return &esi.VarsElement{Nodes: nodes}
+}
+
+// When returns an esi:when branch with the given test expression and child nodes, for use with [Choose].
+func When(test string, nodes ...esi.Node) Branch {
+	return Branch{when: &esi.WhenElement{Test: test, Nodes: nodes}}
+}
+
+func name(local string) esixml.Name {
+	return esixml.Name{Space: esi.Namespace, Local: local}
+}
+
+func validateChoose(e *esi.ChooseElement) error {
+	if len(e.When) == 0 {
+		return &esi.MissingElementError{Name: name(esi.NameWhen), Parent: e.Name()}
+	}
+
+	for _, w := range e.When {
+		if w.Test == "" {
+			return &esi.MissingAttributeError{Element: w.Name(), Attribute: esixml.Name{Local: "test"}}
+		}
+
+		if err := validateNodes(w.Nodes); err != nil {
+			return err
+		}
+	}
+
+	if e.Otherwise != nil {
+		return validateNodes(e.Otherwise.Nodes)
+	}
+
+	return nil
+}
+
+func validateInclude(e *esi.IncludeElement) error {
+	if e.Source == "" {
+		return &esi.MissingAttributeError{Element: e.Name(), Attribute: esixml.Name{Local: "src"}}
+	}
+
+	if e.OnError != esi.ErrorBehaviourDefault && e.OnError != esi.ErrorBehaviourContinue {
+		return &esi.InvalidAttributeValueError{
+			Element: e.Name(),
+			Name:    esixml.Name{Local: "onerror"},
+			Value:   string(e.OnError),
+			Allowed: []string{string(esi.ErrorBehaviourContinue)},
+		}
+	}
+
+	return nil
+}
+
+func validateNode(node esi.Node) error {
+	switch v := node.(type) {
+	case *esi.ChooseElement:
+		return validateChoose(v)
+	case *esi.Comment:
+		return validateNodes(v.Nodes)
+	case *esi.IncludeElement:
+		return validateInclude(v)
+	case *esi.InlineElement:
+		if v.FragmentName == "" {
+			return &esi.MissingAttributeError{Element: v.Name(), Attribute: esixml.Name{Local: "name"}}
+		}
+
+		return validateNodes(v.Nodes)
+	case *esi.RemoveElement:
+		return validateNodes(v.Nodes)
+	case *esi.TryElement:
+		return validateTry(v)
+	case *esi.VarsElement:
+		return validateNodes(v.Nodes)
+	case *esi.XMLComment:
+		return validateNodes(v.Nodes)
+	case *esi.AttemptElement, *esi.ExceptElement, *esi.OtherwiseElement, *esi.WhenElement:
+		return &esi.UnexpectedElementError{Name: v.(esi.Element).Name()}
+	default:
+		return nil
+	}
+}
+
+func validateNodes(nodes []esi.Node) error {
+	for _, node := range nodes {
+		if err := validateNode(node); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func validateTry(e *esi.TryElement) error {
+	if e.Attempt == nil {
+		return &esi.MissingElementError{Name: name(esi.NameAttempt), Parent: e.Name()}
+	}
+
+	if e.Except == nil {
+		return &esi.MissingElementError{Name: name(esi.NameExcept), Parent: e.Name()}
+	}
+
+	if err := validateNodes(e.Attempt.Nodes); err != nil {
+		return err
+	}
+
+	return validateNodes(e.Except.Nodes)
+}
@@ -0,0 +1,179 @@
+package esibuild_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/nussjustin/esi"
+	"github.com/nussjustin/esi/esibuild"
+	"github.com/nussjustin/esi/esixml"
+)
+
+func parse(t *testing.T, input string) esi.Nodes {
+	t.Helper()
+
+	var nodes esi.Nodes
+
+	for node, err := range esi.NewParser(strings.NewReader(input)).All {
+		if err != nil {
+			t.Fatalf("failed to parse input: %v", err)
+		}
+
+		nodes = append(nodes, node)
+	}
+
+	return nodes
+}
+
+func TestBuild(t *testing.T) {
+	got, err := esibuild.Build(
+		esibuild.Text("<p>"),
+		esibuild.Include("/a", esibuild.Alt("/b"), esibuild.OnError(esi.ErrorBehaviourContinue),
+			esibuild.Attr("ttl", "10s"), esibuild.FragmentName("a")),
+		esibuild.Choose(
+			esibuild.When("$(A)", esibuild.Text("a")),
+			esibuild.Otherwise(esibuild.Vars(esibuild.Text("$(B)"))),
+			esibuild.When("$(C)", esibuild.Comment("c")),
+		),
+		esibuild.Try(
+			esibuild.Attempt(esibuild.Include("/c")),
+			esibuild.Except(esibuild.Remove(esibuild.Text("d"))),
+		),
+		esibuild.Inline("e", true, esibuild.Text("e")),
+		esibuild.Text("</p>"),
+	)
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	want := parse(t, `<p>`+
+		`<esi:include src="/a" alt="/b" onerror="continue" ttl="10s" name="a"/>`+
+		`<esi:choose>`+
+		`<esi:when test="$(A)">a</esi:when>`+
+		`<esi:when test="$(C)"><esi:comment text="c"/></esi:when>`+
+		`<esi:otherwise><esi:vars>$(B)</esi:vars></esi:otherwise>`+
+		`</esi:choose>`+
+		`<esi:try>`+
+		`<esi:attempt><esi:include src="/c"/></esi:attempt>`+
+		`<esi:except><esi:remove>d</esi:remove></esi:except>`+
+		`</esi:try>`+
+		`<esi:inline name="e" fetchable="yes">e</esi:inline>`+
+		`</p>`)
+
+	if len(got) != len(want) {
+		t.Fatalf("got %d nodes, want %d", len(got), len(want))
+	}
+
+	for i := range got {
+		if !esi.Equal(want[i], got[i], true) {
+			t.Errorf("node %d: got %#v, want %#v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestBuild_Invalid(t *testing.T) {
+	name := func(local string) esixml.Name {
+		return esixml.Name{Space: esi.Namespace, Local: local}
+	}
+
+	testCases := []struct {
+		Name     string
+		Node     esi.Node
+		Expected error
+	}{
+		{
+			Name: "include without src",
+			Node: esibuild.Include(""),
+			Expected: &esi.MissingAttributeError{
+				Element:   name(esi.NameInclude),
+				Attribute: esixml.Name{Local: "src"},
+			},
+		},
+		{
+			Name: "include with invalid onerror",
+			Node: esibuild.Include("/a", esibuild.OnError("stop")),
+			Expected: &esi.InvalidAttributeValueError{
+				Element: name(esi.NameInclude),
+				Name:    esixml.Name{Local: "onerror"},
+				Value:   "stop",
+				Allowed: []string{"continue"},
+			},
+		},
+		{
+			Name:     "choose without when",
+			Node:     esibuild.Choose(esibuild.Otherwise()),
+			Expected: &esi.MissingElementError{Name: name(esi.NameWhen), Parent: name(esi.NameChoose)},
+		},
+		{
+			Name: "when without test",
+			Node: esibuild.Choose(esibuild.When("")),
+			Expected: &esi.MissingAttributeError{
+				Element:   name(esi.NameWhen),
+				Attribute: esixml.Name{Local: "test"},
+			},
+		},
+		{
+			Name:     "try without attempt",
+			Node:     esibuild.Try(nil, esibuild.Except()),
+			Expected: &esi.MissingElementError{Name: name(esi.NameAttempt), Parent: name(esi.NameTry)},
+		},
+		{
+			Name:     "try without except",
+			Node:     esibuild.Try(esibuild.Attempt(), nil),
+			Expected: &esi.MissingElementError{Name: name(esi.NameExcept), Parent: name(esi.NameTry)},
+		},
+		{
+			Name: "inline without name",
+			Node: esibuild.Inline("", false),
+			Expected: &esi.MissingAttributeError{
+				Element:   name(esi.NameInline),
+				Attribute: esixml.Name{Local: "name"},
+			},
+		},
+		{
+			Name:     "attempt outside of try",
+			Node:     esibuild.Attempt(),
+			Expected: &esi.UnexpectedElementError{Name: name(esi.NameAttempt)},
+		},
+		{
+			Name:     "when outside of choose",
+			Node:     &esi.WhenElement{Test: "true"},
+			Expected: &esi.UnexpectedElementError{Name: name(esi.NameWhen)},
+		},
+		{
+			Name: "nested",
+			Node: esibuild.Try(
+				esibuild.Attempt(esibuild.Vars(esibuild.Include(""))),
+				esibuild.Except(),
+			),
+			Expected: &esi.MissingAttributeError{
+				Element:   name(esi.NameInclude),
+				Attribute: esixml.Name{Local: "src"},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			nodes, err := esibuild.Build(esibuild.Text("a"), testCase.Node)
+			if !errors.Is(err, testCase.Expected) {
+				t.Errorf("got error %v, want %v", err, testCase.Expected)
+			}
+
+			if nodes != nil {
+				t.Errorf("got nodes %v, want nil", nodes)
+			}
+		})
+	}
+}
+
+func TestChoose_MultipleOtherwise(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic")
+		}
+	}()
+
+	esibuild.Choose(esibuild.When("true"), esibuild.Otherwise(), esibuild.Otherwise())
+}
@@ -75,6 +75,25 @@ const (
 	ComparisonOperatorNotEquals ComparisonOperator = "!="
 )
 
+// FunctionNode represents a function call like $now() or $time($(HTTP_COOKIE{exp})).
+type FunctionNode struct {
+	// Position specifies the position of the node inside the expression.
+	Position token.Position
+
+	// Name contains the name of the function without the leading $.
+	Name string
+
+	// Args contains the arguments passed to the function.
+	Args []Node
+}
+
+// Pos returns the position of the node.
+func (n *FunctionNode) Pos() token.Position {
+	return n.Position
+}
+
+func (*FunctionNode) node() {}
+
 // NegateNode represents a sub-expression negated using the unary negation operator (!).
 type NegateNode struct {
 	// Position specifies the position of the node inside the expression.
@@ -111,6 +130,8 @@ func (n *OrNode) Pos() token.Position {
 func (*OrNode) node() {}
 
 // Value is a value of type bool, float64, int, string or nil.
+//
+// Values returned by functions or variables may also have other types, for example [time.Time] or [time.Duration].
 type Value any
 
 // ValueNode represents a parsed value.
@@ -4,18 +4,61 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"slices"
 	"strconv"
 	"strings"
 
 	"github.com/nussjustin/esi/esiexpr/token"
+	"github.com/nussjustin/esi/internal/diag"
 )
 
+// LimitError is returned when an expression exceeds one of the limits configured via [Parser.SetLimits].
+type LimitError struct {
+	// Limit is the name of the exceeded limit. One of "length", "depth" or "nodes".
+	Limit string
+
+	// Max is the configured maximum.
+	Max int
+
+	// Offset is the offset in the expression at which the limit was exceeded.
+	Offset int
+}
+
+// Code returns a machine-readable code identifying the type of the error.
+func (*LimitError) Code() string {
+	return "ast.limit_exceeded"
+}
+
+// Error returns a human-readable message.
+func (l *LimitError) Error() string {
+	return fmt.Sprintf("expression exceeds maximum %s of %d at offset %d", l.Limit, l.Max, l.Offset)
+}
+
+// Is checks if the given error matches the receiver.
+func (l *LimitError) Is(err error) bool {
+	var o *LimitError
+	return errors.As(err, &o) && *o == *l
+}
+
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (l *LimitError) MarshalJSON() ([]byte, error) {
+	return diag.Marshal(l, diag.Diagnostic{
+		Offset:  diag.Int(l.Offset),
+		Details: map[string]any{"limit": l.Limit, "max": l.Max},
+	})
+}
+
 // MissingOperandError is returned when the second operand of an comparison or and/or condition is missing.
 type MissingOperandError struct {
 	// Offset is the position in the input where the error occurred.
 	Offset int
 }
 
+// Code returns a machine-readable code identifying the type of the error.
+func (*MissingOperandError) Code() string {
+	return "ast.missing_operand"
+}
+
 // Error returns a human-readable error message.
 func (m *MissingOperandError) Error() string {
 	return fmt.Sprintf("missing operand at %d", m.Offset)
@@ -27,6 +70,11 @@ func (m *MissingOperandError) Is(err error) bool {
 	return errors.As(err, &o) && *o == *m
 }
 
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (m *MissingOperandError) MarshalJSON() ([]byte, error) {
+	return diag.Marshal(m, diag.Diagnostic{Offset: diag.Int(m.Offset)})
+}
+
 // Error is a generic type for errors occurring during expression parsing.
 type Error struct {
 	// Offset is the position in the input where the error occurred.
@@ -39,6 +87,11 @@ type Error struct {
 	Underlying error
 }
 
+// Code returns a machine-readable code identifying the type of the error.
+func (*Error) Code() string {
+	return "ast.syntax"
+}
+
 // Error returns a human-readable error message.
 func (s *Error) Error() string {
 	if s.Message == "" {
@@ -54,6 +107,11 @@ func (s *Error) Is(err error) bool {
 	return errors.As(err, &o) && o.Error() == s.Error() && errors.Is(o.Underlying, s.Underlying)
 }
 
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (s *Error) MarshalJSON() ([]byte, error) {
+	return diag.Marshal(s, diag.Diagnostic{Offset: diag.Int(s.Offset), Cause: diag.Cause(s.Underlying)})
+}
+
 // Unwrap returns s.Underlying.
 func (s *Error) Unwrap() error {
 	return s.Underlying
@@ -65,6 +123,11 @@ type UnexpectedTokenError struct {
 	Token token.Token
 }
 
+// Code returns a machine-readable code identifying the type of the error.
+func (*UnexpectedTokenError) Code() string {
+	return "ast.unexpected_token"
+}
+
 // Error returns a human-readable error message.
 func (u *UnexpectedTokenError) Error() string {
 	return fmt.Sprintf("unexpected token %s at position %s", u.Token.Type, u.Token.Position)
@@ -76,12 +139,23 @@ func (u *UnexpectedTokenError) Is(err error) bool {
 	return errors.As(err, &o) && *o == *u
 }
 
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (u *UnexpectedTokenError) MarshalJSON() ([]byte, error) {
+	start, end := diag.Position(u.Token.Position.Start, u.Token.Position.End)
+	return diag.Marshal(u, diag.Diagnostic{Start: start, End: end, Got: u.Token.Type.String()})
+}
+
 // UnexpectedWhiteSpaceError is returned when whitespace is encountered in a variable.
 type UnexpectedWhiteSpaceError struct {
 	// Position contains the start and end index of the whitespace.
 	Position token.Position
 }
 
+// Code returns a machine-readable code identifying the type of the error.
+func (*UnexpectedWhiteSpaceError) Code() string {
+	return "ast.unexpected_whitespace"
+}
+
 // Error returns a human-readable error message.
 func (u *UnexpectedWhiteSpaceError) Error() string {
 	return fmt.Sprintf("unexpected whitespace at position %s", u.Position)
@@ -93,6 +167,31 @@ func (u *UnexpectedWhiteSpaceError) Is(err error) bool {
 	return errors.As(err, &o) && *o == *u
 }
 
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (u *UnexpectedWhiteSpaceError) MarshalJSON() ([]byte, error) {
+	start, end := diag.Position(u.Position.Start, u.Position.End)
+	return diag.Marshal(u, diag.Diagnostic{Start: start, End: end})
+}
+
+// Limits defines limits for the size and complexity of parsed expressions.
+//
+// A value of 0 disables the corresponding limit.
+type Limits struct {
+	// MaxLength is the maximum length of an expression in bytes.
+	//
+	// The length is not checked by [Parser.ParseVariable].
+	MaxLength int
+
+	// MaxDepth is the maximum nesting depth of an expression, counting sub-expressions, negations and function calls.
+	//
+	// Since chains of & and | operators are parsed into nested nodes, each operator in a chain also counts as a
+	// level. For example, "a & b & c" has a depth of 3.
+	MaxDepth int
+
+	// MaxNodes is the maximum number of nodes in the parsed tree.
+	MaxNodes int
+}
+
 // Parser implements parsing of ESI expressions from a string or []byte.
 //
 // The main reason this is a type and not just a function is to that users can better manage allocations, be re-using
@@ -107,6 +206,16 @@ type Parser[T []byte | string] struct {
 	bufferedTokenErr error
 
 	lastToken token.Token
+
+	// errs contains the errors found so far by ParseAll. recovering is true while ParseAll is running.
+	errs       []error
+	recovering bool
+
+	strict bool
+
+	limits Limits
+	depth  int
+	nodes  int
 }
 
 // NewParser is a shorthand for creating a new *Parser and calling [Parser.Reset] on it.
@@ -122,6 +231,11 @@ func (p *Parser[T]) Parse() (Node, error) {
 		return nil, err
 	}
 
+	if err := p.checkLength(); err != nil {
+		p.err = err
+		return nil, err
+	}
+
 	node, err := p.parse(false)
 	if err != nil {
 		p.err = err
@@ -131,6 +245,42 @@ func (p *Parser[T]) Parse() (Node, error) {
 	return node, nil
 }
 
+// ParseAll parses the given ESI expression like [Parser.Parse], but instead of stopping at the first error, it skips
+// invalid operands of & and | operators as well as unexpected tokens between operands and continues parsing.
+//
+// This allows tools like linters to report multiple independent errors in a single expression at once.
+//
+// If at least one error was found, the returned node is nil and the errors are returned in the order in which they
+// occurred in the input. Errors while reading tokens, like unterminated strings, stop the parsing.
+func (p *Parser[T]) ParseAll() (Node, []error) {
+	if err := p.err; err != nil {
+		return nil, []error{err}
+	}
+
+	if err := p.checkLength(); err != nil {
+		p.err = err
+		return nil, []error{err}
+	}
+
+	p.errs, p.recovering = p.errs[:0], true
+
+	defer func() {
+		p.recovering = false
+	}()
+
+	node, err := p.parse(false)
+	if err != nil {
+		p.addError(err)
+	}
+
+	if len(p.errs) > 0 {
+		p.err = p.errs[0]
+		return nil, slices.Clone(p.errs)
+	}
+
+	return node, nil
+}
+
 // ParseVariable parses a single variable.
 func (p *Parser[T]) ParseVariable() (*VariableNode, error) {
 	if err := p.err; err != nil {
@@ -146,6 +296,26 @@ func (p *Parser[T]) ParseVariable() (*VariableNode, error) {
 	return node.(*VariableNode), nil
 }
 
+// SetLimits configures limits for the size and complexity of parsed expressions.
+//
+// If a limit is exceeded, parsing stops with a [*LimitError]. This includes [Parser.ParseAll], which does not try to
+// recover from such errors.
+//
+// The setting is kept when calling [Parser.Reset].
+func (p *Parser[T]) SetLimits(limits Limits) {
+	p.limits = limits
+}
+
+// SetStrict configures whether the parser only accepts the syntax defined by the ESI specification.
+//
+// In strict mode escape sequences inside quoted strings, triple-quoted raw strings and function calls like $now() or
+// $time(...) (including their comma-separated arguments) result in an error.
+//
+// The setting is kept when calling [Parser.Reset].
+func (p *Parser[T]) SetStrict(strict bool) {
+	p.strict = strict
+}
+
 // Reset resets the internal state of the parse and switches it to parse data.
 func (p *Parser[T]) Reset(data T) {
 	p.sc.Reset(data)
@@ -157,6 +327,40 @@ func (p *Parser[T]) Reset(data T) {
 	p.bufferedTokenErr = nil
 
 	p.lastToken = token.Token{}
+
+	p.depth = 0
+	p.nodes = 0
+
+	clear(p.errs)
+	p.errs = p.errs[:0]
+}
+
+// addError adds err to the list of errors, unless it was already added.
+func (p *Parser[T]) addError(err error) {
+	if n := len(p.errs); n > 0 && p.errs[n-1] == err {
+		return
+	}
+
+	p.errs = append(p.errs, err)
+}
+
+// addNode counts a new node starting at offset and checks it against the configured maximum number of nodes.
+func (p *Parser[T]) addNode(offset int) error {
+	p.nodes++
+
+	if p.limits.MaxNodes > 0 && p.nodes > p.limits.MaxNodes {
+		return &LimitError{Limit: "nodes", Max: p.limits.MaxNodes, Offset: offset}
+	}
+
+	return nil
+}
+
+func (p *Parser[T]) checkLength() error {
+	if p.limits.MaxLength > 0 && len(p.data) > p.limits.MaxLength {
+		return &LimitError{Limit: "length", Max: p.limits.MaxLength, Offset: p.limits.MaxLength}
+	}
+
+	return nil
 }
 
 func (p *Parser[T]) next() (token.Token, error) {
@@ -222,6 +426,13 @@ func (p *Parser[T]) peekType() token.Type {
 	return tok.Type
 }
 
+// isFunctionCall returns true if tok is a simple string of the form $name that is directly followed by a (.
+func (p *Parser[T]) isFunctionCall(tok token.Token) bool {
+	start, end := tok.Position.Start, tok.Position.End
+
+	return end-start > 1 && p.data[start] == '$' && end < len(p.data) && p.data[end] == '('
+}
+
 func (p *Parser[T]) checkNoWhitespace() error {
 	if p.lastToken.Type == token.TypeInvalid {
 		return nil
@@ -250,11 +461,14 @@ func (p *Parser[T]) readString() (string, token.Token, error) {
 		return "", token.Token{}, err
 	}
 
-	if tok.Type == token.TypeQuotedString {
+	switch tok.Type { //nolint:exhaustive
+	case token.TypeQuotedString:
 		return p.readQuotedString()
+	case token.TypeRawString:
+		return p.readRawString()
+	default:
+		return p.readSimpleString()
 	}
-
-	return p.readSimpleString()
 }
 
 func (p *Parser[T]) readQuotedString() (string, token.Token, error) {
@@ -262,7 +476,77 @@ func (p *Parser[T]) readQuotedString() (string, token.Token, error) {
 	if err != nil {
 		return "", token.Token{}, err
 	}
-	return string(p.data[tok.Position.Start+1 : tok.Position.End-1]), tok, nil
+
+	s, err := p.unquote(tok)
+	if err != nil {
+		return "", token.Token{}, err
+	}
+
+	return string(s), tok, nil
+}
+
+func (p *Parser[T]) readRawString() (string, token.Token, error) {
+	tok, err := p.nextOfType(token.TypeRawString)
+	if err != nil {
+		return "", token.Token{}, err
+	}
+
+	s, err := p.unquoteRaw(tok)
+	if err != nil {
+		return "", token.Token{}, err
+	}
+
+	return string(s), tok, nil
+}
+
+// unquoteRaw returns the content of the given raw string token.
+func (p *Parser[T]) unquoteRaw(tok token.Token) (T, error) {
+	if p.strict {
+		return p.data[:0], &Error{Offset: tok.Position.Start, Message: "raw strings are not allowed"}
+	}
+
+	return p.data[tok.Position.Start+3 : tok.Position.End-3], nil
+}
+
+// unquote returns the content of the given quoted string token with all escape sequences replaced.
+//
+// Supported escape sequences are \', \\ and \n.
+func (p *Parser[T]) unquote(tok token.Token) (T, error) {
+	s := p.data[tok.Position.Start+1 : tok.Position.End-1]
+
+	index := strings.IndexByte(string(s), '\\')
+	if index == -1 {
+		return s, nil
+	}
+
+	if p.strict {
+		return s, &Error{Offset: tok.Position.Start + 1 + index, Message: "escape sequences are not allowed"}
+	}
+
+	var b strings.Builder
+	b.Grow(len(s))
+
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			_ = b.WriteByte(s[i])
+			continue
+		}
+
+		i++
+
+		switch {
+		case i < len(s) && s[i] == '\'':
+			_ = b.WriteByte('\'')
+		case i < len(s) && s[i] == '\\':
+			_ = b.WriteByte('\\')
+		case i < len(s) && s[i] == 'n':
+			_ = b.WriteByte('\n')
+		default:
+			return s, &Error{Offset: tok.Position.Start + i, Message: "invalid escape sequence"}
+		}
+	}
+
+	return T(b.String()), nil
 }
 
 func (p *Parser[T]) readSimpleString() (string, token.Token, error) {
@@ -274,11 +558,15 @@ func (p *Parser[T]) readSimpleString() (string, token.Token, error) {
 }
 
 func (p *Parser[T]) parse(sub bool) (Node, error) {
-	node, err := p.parseSingleOrComparisons()
+	node, err := p.parseOperand(sub)
 	if err != nil {
 		return nil, err
 	}
 
+	// Chains of & and | result in a left-deep tree, so each operator adds a level to the depth.
+	depth := p.depth
+	defer func() { p.depth = depth }()
+
 	for {
 		tok, err := p.peek()
 		if err != nil {
@@ -292,30 +580,50 @@ func (p *Parser[T]) parse(sub bool) (Node, error) {
 			return node, nil
 		}
 
+		if tok.Type == token.TypeAnd || tok.Type == token.TypeOr {
+			p.depth++
+
+			if p.limits.MaxDepth > 0 && p.depth > p.limits.MaxDepth {
+				return nil, &LimitError{Limit: "depth", Max: p.limits.MaxDepth, Offset: tok.Position.Start}
+			}
+		}
+
 		switch tok.Type { //nolint:exhaustive
 		case token.TypeAnd:
-			node, err = p.parseAnd(node)
+			node, err = p.parseAnd(node, sub)
 			if err != nil {
 				return nil, err
 			}
 		case token.TypeOr:
-			node, err = p.parseOr(node)
+			node, err = p.parseOr(node, sub)
 			if err != nil {
 				return nil, err
 			}
 		default:
-			return p.unexpected(tok)
+			if !p.recovering {
+				return p.unexpected(tok)
+			}
+
+			p.addError(&UnexpectedTokenError{Token: tok})
+
+			if err := p.skipOperand(sub); err != nil {
+				return nil, err
+			}
 		}
 	}
 }
 
-func (p *Parser[T]) parseAnd(left Node) (Node, error) {
+func (p *Parser[T]) parseAnd(left Node, sub bool) (Node, error) {
 	tok, err := p.nextOfType(token.TypeAnd)
 	if err != nil {
 		return nil, err
 	}
 
-	right, err := p.parseSingleOrComparisons()
+	if err := p.addNode(tok.Position.Start); err != nil {
+		return nil, err
+	}
+
+	right, err := p.parseOperand(sub)
 	if err != nil {
 		if errors.Is(err, io.EOF) {
 			return nil, &MissingOperandError{Offset: tok.Position.End}
@@ -333,6 +641,38 @@ func (p *Parser[T]) parseAnd(left Node) (Node, error) {
 	}, nil
 }
 
+// parseOperand parses a single operand, including comparisons.
+//
+// When called from [Parser.ParseAll], errors in the operand are recorded and the operand is skipped, in which case a
+// placeholder node is returned.
+func (p *Parser[T]) parseOperand(sub bool) (Node, error) {
+	node, err := p.parseSingleOrComparisons()
+	if err == nil || !p.recovering || errors.Is(err, io.EOF) {
+		return node, err
+	}
+
+	// Exceeding a limit stops the parsing, since continuing would defeat the purpose of the limit
+	var limitErr *LimitError
+	if errors.As(err, &limitErr) {
+		return nil, err
+	}
+
+	// Errors when reading tokens can not be recovered from
+	if _, peekErr := p.peek(); peekErr != nil && peekErr == err { //nolint:errorlint
+		return nil, err
+	}
+
+	p.addError(err)
+
+	start := p.sc.Offset()
+
+	if err := p.skipOperand(sub); err != nil {
+		return nil, err
+	}
+
+	return &ValueNode{Position: token.Position{Start: start, End: p.sc.Offset()}}, nil
+}
+
 func (p *Parser[T]) parseOperator(left Node) (Node, error) {
 	tok, err := p.next()
 	if err != nil {
@@ -358,6 +698,10 @@ func (p *Parser[T]) parseOperator(left Node) (Node, error) {
 		return nil, &UnexpectedTokenError{Token: tok}
 	}
 
+	if err := p.addNode(tok.Position.Start); err != nil {
+		return nil, err
+	}
+
 	right, err := p.parseSingle()
 	if err != nil {
 		if errors.Is(err, io.EOF) {
@@ -377,13 +721,17 @@ func (p *Parser[T]) parseOperator(left Node) (Node, error) {
 	}, nil
 }
 
-func (p *Parser[T]) parseOr(left Node) (Node, error) {
+func (p *Parser[T]) parseOr(left Node, sub bool) (Node, error) {
 	tok, err := p.nextOfType(token.TypeOr)
 	if err != nil {
 		return nil, err
 	}
 
-	right, err := p.parseSingleOrComparisons()
+	if err := p.addNode(tok.Position.Start); err != nil {
+		return nil, err
+	}
+
+	right, err := p.parseOperand(sub)
 	if err != nil {
 		if errors.Is(err, io.EOF) {
 			return nil, &MissingOperandError{Offset: tok.Position.End}
@@ -401,6 +749,52 @@ func (p *Parser[T]) parseOr(left Node) (Node, error) {
 	}, nil
 }
 
+func (p *Parser[T]) parseFunction() (Node, error) {
+	nameTok, err := p.nextOfType(token.TypeSimpleString)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.strict {
+		return nil, &Error{Offset: nameTok.Position.Start, Message: "function calls are not allowed"}
+	}
+
+	// Checked by isFunctionCall
+	_, _ = p.nextOfType(token.TypeOpeningParenthesis)
+
+	f := &FunctionNode{
+		Name: string(p.data[nameTok.Position.Start+1 : nameTok.Position.End]),
+	}
+
+	for p.peekType() != token.TypeClosingParenthesis {
+		if len(f.Args) > 0 {
+			if _, err := p.nextOfType(token.TypeComma); err != nil {
+				return nil, err
+			}
+		}
+
+		arg, err := p.parseSingle()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, &Error{Offset: p.sc.Offset(), Underlying: io.ErrUnexpectedEOF}
+			}
+			return nil, err
+		}
+
+		f.Args = append(f.Args, arg)
+	}
+
+	end, err := p.nextOfType(token.TypeClosingParenthesis)
+	if err != nil {
+		return nil, err
+	}
+
+	f.Position.Start = nameTok.Position.Start
+	f.Position.End = end.Position.End
+
+	return f, nil
+}
+
 func (p *Parser[T]) parseNegation() (Node, error) {
 	tok, err := p.nextOfType(token.TypeNegation)
 	if err != nil {
@@ -428,11 +822,31 @@ func (p *Parser[T]) parseQuotedString() (Node, error) {
 		return nil, err
 	}
 
-	s := p.data[tok.Position.Start:tok.Position.End]
+	s, err := p.unquote(tok)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ValueNode{
+		Position: tok.Position,
+		Value:    s,
+	}, nil
+}
+
+func (p *Parser[T]) parseRawString() (Node, error) {
+	tok, err := p.nextOfType(token.TypeRawString)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := p.unquoteRaw(tok)
+	if err != nil {
+		return nil, err
+	}
 
 	return &ValueNode{
 		Position: tok.Position,
-		Value:    s[1 : len(s)-1],
+		Value:    s,
 	}, nil
 }
 
@@ -442,6 +856,19 @@ func (p *Parser[T]) parseSingle() (Node, error) {
 		return nil, err
 	}
 
+	p.depth++
+	defer func() { p.depth-- }()
+
+	if p.limits.MaxDepth > 0 && p.depth > p.limits.MaxDepth {
+		return nil, &LimitError{Limit: "depth", Max: p.limits.MaxDepth, Offset: tok.Position.Start}
+	}
+
+	if tok.Type != token.TypeOpeningParenthesis {
+		if err := p.addNode(tok.Position.Start); err != nil {
+			return nil, err
+		}
+	}
+
 	switch tok.Type { //nolint:exhaustive
 	case token.TypeDollarOpeningParenthesis:
 		return p.parseVariable()
@@ -450,9 +877,15 @@ func (p *Parser[T]) parseSingle() (Node, error) {
 	case token.TypeOpeningParenthesis:
 		return p.parseSubExpr()
 	case token.TypeSimpleString:
+		if p.isFunctionCall(tok) {
+			return p.parseFunction()
+		}
+
 		return p.parseStringAsScalar()
 	case token.TypeQuotedString:
 		return p.parseQuotedString()
+	case token.TypeRawString:
+		return p.parseRawString()
 	default:
 		return p.unexpected(tok)
 	}
@@ -640,6 +1073,42 @@ func (p *Parser[T]) parseVariable() (Node, error) {
 	return v, nil
 }
 
+// skipOperand skips all tokens until the next & or | operator outside of parentheses or the end of the input. If sub
+// is true, a closing parenthesis outside of other parentheses is also not skipped.
+//
+// Errors when reading tokens can not be recovered from and are returned.
+func (p *Parser[T]) skipOperand(sub bool) error {
+	var depth int
+
+	for {
+		tok, err := p.peek()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		switch tok.Type { //nolint:exhaustive
+		case token.TypeAnd, token.TypeOr:
+			if depth == 0 {
+				return nil
+			}
+		case token.TypeDollarOpeningParenthesis, token.TypeOpeningParenthesis:
+			depth++
+		case token.TypeClosingParenthesis:
+			if depth == 0 && sub {
+				return nil
+			}
+
+			depth = max(depth-1, 0)
+		}
+
+		_, _ = p.next()
+	}
+}
+
 func (p *Parser[T]) unexpected(tok token.Token) (Node, error) {
 	return nil, &UnexpectedTokenError{Token: tok}
 }
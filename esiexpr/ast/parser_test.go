@@ -3,11 +3,13 @@ package ast_test
 import (
 	"errors"
 	"io"
+	"math/rand/v2"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
 
 	"github.com/nussjustin/esi/esiexpr/ast"
+	"github.com/nussjustin/esi/esiexpr/esiexprtest"
 	"github.com/nussjustin/esi/esiexpr/internal/text"
 	"github.com/nussjustin/esi/esiexpr/token"
 )
@@ -146,9 +148,53 @@ func TestParse(t *testing.T) {
 			Expected: &ast.ValueNode{Position: pos(0, 13), Value: "hello world"},
 		},
 		{
-			Name:  "string with quote",
-			Input: `'hello \'world\''`,
-			Error: unexpected(9, 14, token.TypeSimpleString),
+			Name:     "string with quote",
+			Input:    `'hello \'world\''`,
+			Expected: &ast.ValueNode{Position: pos(0, 17), Value: "hello 'world'"},
+		},
+		{
+			Name:     "string with escape sequences",
+			Input:    `'back\\slash\nnew line'`,
+			Expected: &ast.ValueNode{Position: pos(0, 23), Value: "back\\slash\nnew line"},
+		},
+		{
+			Name:  "string with invalid escape sequence",
+			Input: `'hello \world'`,
+			Error: &ast.Error{Offset: 7, Message: "invalid escape sequence"},
+		},
+		{
+			Name:  "string with escaped closing quote",
+			Input: `'hello world\'`,
+			Error: &ast.Error{
+				Offset: 14,
+				Underlying: &text.UnexpectedEndOfInput{
+					At:       14,
+					Expected: '\'',
+				},
+			},
+		},
+		{
+			Name:     "raw string",
+			Input:    `'''it's a \raw string'''`,
+			Expected: &ast.ValueNode{Position: pos(0, 24), Value: `it's a \raw string`},
+		},
+		{
+			Name:     "empty raw string",
+			Input:    `''''''`,
+			Expected: &ast.ValueNode{Position: pos(0, 6), Value: ""},
+		},
+		{
+			Name:  "raw string comparison",
+			Input: `$(HTTP_USER_AGENT) == '''Mozilla/5.0 'quoted' \'''`,
+			Expected: &ast.ComparisonNode{
+				Position: pos(0, 50),
+				Operator: ast.ComparisonOperatorEquals,
+				Left: &ast.VariableNode{
+					Position: pos(0, 18),
+					Name:     "HTTP_USER_AGENT",
+				},
+				Right: &ast.ValueNode{Position: pos(22, 50), Value: `Mozilla/5.0 'quoted' \`},
+			},
 		},
 		{
 			Name:  "string without closing quote",
@@ -750,6 +796,57 @@ func TestParse(t *testing.T) {
 			Error: unexpected(5, 10, token.TypeSimpleString),
 		},
 
+		{
+			Name:     "function without arguments",
+			Input:    `$now()`,
+			Expected: &ast.FunctionNode{Position: pos(0, 6), Name: "now"},
+		},
+		{
+			Name:  "function with arguments",
+			Input: `$time($(A{b}), 'x', 1)`,
+			Expected: &ast.FunctionNode{
+				Position: pos(0, 22),
+				Name:     "time",
+				Args: []ast.Node{
+					&ast.VariableNode{Position: pos(6, 13), Name: "A", Key: ptr("b")},
+					&ast.ValueNode{Position: pos(15, 18), Value: "x"},
+					&ast.ValueNode{Position: pos(20, 21), Value: 1},
+				},
+			},
+		},
+		{
+			Name:  "function comparison",
+			Input: `$time($(A)) > $now('-1h')`,
+			Expected: &ast.ComparisonNode{
+				Position: pos(0, 25),
+				Operator: ast.ComparisonOperatorGreaterThan,
+				Left: &ast.FunctionNode{
+					Position: pos(0, 11),
+					Name:     "time",
+					Args:     []ast.Node{&ast.VariableNode{Position: pos(6, 10), Name: "A"}},
+				},
+				Right: &ast.FunctionNode{
+					Position: pos(14, 25),
+					Name:     "now",
+					Args:     []ast.Node{&ast.ValueNode{Position: pos(19, 24), Value: "-1h"}},
+				},
+			},
+		},
+		{
+			Name:  "function with missing argument",
+			Input: `$f(,)`,
+			Error: unexpected(3, 4, token.TypeComma),
+		},
+		{
+			Name:  "function without closing parenthesis",
+			Input: `$f(1`,
+			Error: &ast.Error{Offset: 4, Underlying: io.ErrUnexpectedEOF},
+		},
+		{
+			Name:  "function without name",
+			Input: `$()`,
+			Error: unexpected(2, 3, token.TypeClosingParenthesis),
+		},
 		{
 			Name:  "left to right",
 			Input: `1 == 2 | 3 & 4`,
@@ -855,6 +952,23 @@ func TestParse(t *testing.T) {
 	}
 }
 
+func TestParse_Generated(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		g := &esiexprtest.Generator{Rand: rand.New(rand.NewPCG(1, 2)), Strict: strict}
+
+		for range 1000 {
+			c := g.Generate()
+
+			p := ast.NewParser(c.Expr)
+			p.SetStrict(strict)
+
+			if _, errs := p.ParseAll(); len(errs) > 0 {
+				t.Fatalf("got errors %v for %q (strict=%t)", errs, c.Expr, strict)
+			}
+		}
+	}
+}
+
 func TestParseVariable(t *testing.T) {
 	testCases := []struct {
 		Name     string
@@ -922,6 +1036,32 @@ func TestParseVariable(t *testing.T) {
 			Input: `prefix $(SOME_DICT{key}|default)`,
 			Error: unexpected(0, 6, token.TypeSimpleString),
 		},
+		{
+			Name:  "with quoted key and default containing quotes",
+			Input: `$(SOME_DICT{'it\'s'}|'default \'value\'')`,
+			Expected: ast.VariableNode{
+				Position: pos(0, 41),
+				Name:     "SOME_DICT",
+				Key:      ptr("it's"),
+				Default: &ast.ValueNode{
+					Position: pos(21, 40),
+					Value:    "default 'value'",
+				},
+			},
+		},
+		{
+			Name:  "with raw key and default",
+			Input: `$(SOME_DICT{'''it's'''}|'''default''')`,
+			Expected: ast.VariableNode{
+				Position: pos(0, 38),
+				Name:     "SOME_DICT",
+				Key:      ptr("it's"),
+				Default: &ast.ValueNode{
+					Position: pos(24, 37),
+					Value:    "default",
+				},
+			},
+		},
 		{
 			Name:  "invalid variable",
 			Input: `$(SOME DICT{key}|default)`,
@@ -965,3 +1105,248 @@ func BenchmarkParse(b *testing.B) {
 		}
 	}
 }
+
+func TestParser_SetLimits(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Input  string
+		Limits ast.Limits
+		Error  error
+	}{
+		{
+			Name:   "length",
+			Input:  `'abc' == 'def'`,
+			Limits: ast.Limits{MaxLength: 13},
+			Error:  &ast.LimitError{Limit: "length", Max: 13, Offset: 13},
+		},
+		{
+			Name:   "length at limit",
+			Input:  `'abc' == 'def'`,
+			Limits: ast.Limits{MaxLength: 14},
+		},
+		{
+			Name:   "depth",
+			Input:  `((!(1)))`,
+			Limits: ast.Limits{MaxDepth: 3},
+			Error:  &ast.LimitError{Limit: "depth", Max: 3, Offset: 3},
+		},
+		{
+			Name:   "depth at limit",
+			Input:  `((!(1)))`,
+			Limits: ast.Limits{MaxDepth: 5},
+		},
+		{
+			Name:   "depth function",
+			Input:  `$f($g($h(1)))`,
+			Limits: ast.Limits{MaxDepth: 3},
+			Error:  &ast.LimitError{Limit: "depth", Max: 3, Offset: 9},
+		},
+		{
+			Name:   "depth chain",
+			Input:  `1 & 2 | 3 & 4`,
+			Limits: ast.Limits{MaxDepth: 3},
+			Error:  &ast.LimitError{Limit: "depth", Max: 3, Offset: 12},
+		},
+		{
+			Name:   "depth chain at limit",
+			Input:  `1 & 2 | 3 & 4`,
+			Limits: ast.Limits{MaxDepth: 4},
+		},
+		{
+			Name:   "depth chain in sub-expression",
+			Input:  `(1 & 2) & 3`,
+			Limits: ast.Limits{MaxDepth: 2},
+			Error:  &ast.LimitError{Limit: "depth", Max: 2, Offset: 5},
+		},
+		{
+			Name:   "nodes",
+			Input:  `1 == 2 & 3 == 4 | 5`,
+			Limits: ast.Limits{MaxNodes: 8},
+			Error:  &ast.LimitError{Limit: "nodes", Max: 8, Offset: 18},
+		},
+		{
+			Name:   "nodes at limit",
+			Input:  `1 == 2 & 3 == 4 | 5`,
+			Limits: ast.Limits{MaxNodes: 9},
+		},
+		{
+			Name:   "nodes sub-expressions",
+			Input:  `((1)) & ((2))`,
+			Limits: ast.Limits{MaxNodes: 3},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			p := ast.NewParser[string]("")
+			p.SetLimits(testCase.Limits)
+			p.Reset(testCase.Input)
+
+			if _, err := p.Parse(); !errors.Is(err, testCase.Error) {
+				t.Errorf("got error %v, want %v", err, testCase.Error)
+			}
+
+			p.Reset(testCase.Input)
+
+			_, errs := p.ParseAll()
+
+			switch {
+			case testCase.Error == nil && len(errs) > 0:
+				t.Errorf("got errors %v from ParseAll, want none", errs)
+			case testCase.Error != nil && (len(errs) != 1 || !errors.Is(errs[0], testCase.Error)):
+				t.Errorf("got errors %v from ParseAll, want %v", errs, testCase.Error)
+			}
+
+			p.SetLimits(ast.Limits{})
+			p.Reset(testCase.Input)
+
+			if _, err := p.Parse(); err != nil {
+				t.Errorf("got error %v without limits", err)
+			}
+		})
+	}
+}
+
+func TestParser_SetStrict(t *testing.T) {
+	testCases := []struct {
+		Name  string
+		Input string
+		Error error
+	}{
+		{
+			Name:  "quoted string",
+			Input: `'value'`,
+		},
+		{
+			Name:  "escape sequence",
+			Input: `'it\'s'`,
+			Error: &ast.Error{Offset: 3, Message: "escape sequences are not allowed"},
+		},
+		{
+			Name:  "raw string",
+			Input: `'''value'''`,
+			Error: &ast.Error{Offset: 0, Message: "raw strings are not allowed"},
+		},
+		{
+			Name:  "function call",
+			Input: `$now()`,
+			Error: &ast.Error{Offset: 0, Message: "function calls are not allowed"},
+		},
+		{
+			Name:  "function call with arguments",
+			Input: `$(A) == $time(1, 'UTC')`,
+			Error: &ast.Error{Offset: 8, Message: "function calls are not allowed"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			p := ast.NewParser[string]("")
+			p.SetStrict(true)
+			p.Reset(testCase.Input)
+
+			if _, err := p.Parse(); !errors.Is(err, testCase.Error) {
+				t.Errorf("got error %v, want %v", err, testCase.Error)
+			}
+
+			p.SetStrict(false)
+			p.Reset(testCase.Input)
+
+			if _, err := p.Parse(); err != nil {
+				t.Errorf("got error %v in non-strict mode", err)
+			}
+		})
+	}
+}
+
+func TestParser_ParseAll(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Input  string
+		Errors []error
+	}{
+		{
+			Name:  "valid",
+			Input: `$(A) == 'a' & ($(B) | !$(C{d}|'e'))`,
+		},
+		{
+			Name:  "missing comparison operands",
+			Input: `$(A) == & $(B) >= | $(C)`,
+			Errors: []error{
+				unexpected(8, 9, token.TypeAnd),
+				unexpected(18, 19, token.TypeOr),
+			},
+		},
+		{
+			Name:  "unexpected tokens",
+			Input: `(1 2) & 3 4 | 5`,
+			Errors: []error{
+				unexpected(3, 4, token.TypeSimpleString),
+				unexpected(10, 11, token.TypeSimpleString),
+			},
+		},
+		{
+			Name:  "invalid variables",
+			Input: `$(A B) | $(C) | $(D{)`,
+			Errors: []error{
+				&ast.UnexpectedWhiteSpaceError{Position: pos(3, 4)},
+				unexpected(20, 21, token.TypeClosingParenthesis),
+			},
+		},
+		{
+			Name:  "missing operand",
+			Input: `1 == ) & 2 &`,
+			Errors: []error{
+				unexpected(5, 6, token.TypeClosingParenthesis),
+				&ast.MissingOperandError{Offset: 12},
+			},
+		},
+		{
+			Name:  "unterminated string",
+			Input: `1 == & 'a`,
+			Errors: []error{
+				unexpected(5, 6, token.TypeAnd),
+				&text.UnexpectedEndOfInput{At: 9, Expected: '\''},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			p := ast.NewParser(testCase.Input)
+
+			node, errs := p.ParseAll()
+
+			if len(errs) != len(testCase.Errors) {
+				t.Fatalf("got %d errors %v, want %d errors %v", len(errs), errs, len(testCase.Errors), testCase.Errors)
+			}
+
+			for i, err := range errs {
+				if !errors.Is(err, testCase.Errors[i]) {
+					t.Errorf("error %d: got %v, want %v", i, err, testCase.Errors[i])
+				}
+			}
+
+			if len(errs) > 0 {
+				if node != nil {
+					t.Errorf("got node %#v, want nil", node)
+				}
+
+				if _, err := p.Parse(); !errors.Is(err, errs[0]) {
+					t.Errorf("got error %v from Parse, want %v", err, errs[0])
+				}
+
+				return
+			}
+
+			want, err := ast.NewParser(testCase.Input).Parse()
+			if err != nil {
+				t.Fatalf("got error %v from Parse", err)
+			}
+
+			if diff := cmp.Diff(want, node); diff != "" {
+				t.Errorf("node mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
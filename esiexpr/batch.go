@@ -0,0 +1,151 @@
+package esiexpr
+
+import (
+	"context"
+	"slices"
+
+	"github.com/nussjustin/esi/esiexpr/ast"
+)
+
+// VarRef identifies a variable referenced in an expression or string, for use with [Env.LookupVars].
+type VarRef struct {
+	// Name is the name of the variable.
+	Name string
+
+	// Key is the key inside the referenced dictionary or list, if HasKey is true.
+	Key string
+
+	// HasKey is true if the variable is referenced with a key, for example $(HTTP_COOKIE{id}).
+	HasKey bool
+}
+
+// varRefOf returns the VarRef for the given variable.
+func varRefOf(node *ast.VariableNode) VarRef {
+	if node.Key == nil {
+		return VarRef{Name: node.Name}
+	}
+
+	return VarRef{Name: node.Name, Key: *node.Key, HasKey: true}
+}
+
+// appendVarRefs appends the references of all variables in node, including variables used as default values, to
+// refs. Variables already in refs are skipped.
+func appendVarRefs(refs []VarRef, node ast.Node) []VarRef {
+	switch v := node.(type) {
+	case *ast.AndNode:
+		return appendVarRefs(appendVarRefs(refs, v.Left), v.Right)
+	case *ast.ComparisonNode:
+		return appendVarRefs(appendVarRefs(refs, v.Left), v.Right)
+	case *ast.FunctionNode:
+		for _, arg := range v.Args {
+			refs = appendVarRefs(refs, arg)
+		}
+
+		return refs
+	case *ast.NegateNode:
+		return appendVarRefs(refs, v.Expr)
+	case *ast.OrNode:
+		return appendVarRefs(appendVarRefs(refs, v.Left), v.Right)
+	case *ast.VariableNode:
+		if ref := varRefOf(v); !slices.Contains(refs, ref) {
+			refs = append(refs, ref)
+		}
+
+		if v.Default != nil {
+			refs = appendVarRefs(refs, v.Default)
+		}
+
+		return refs
+	default:
+		return refs
+	}
+}
+
+// varBatch contains the result of a call to [Env.LookupVars].
+type varBatch struct {
+	values map[VarRef]ast.Value
+	err    error
+}
+
+// lookupVars looks up the values of all given variables using [Env.LookupVars].
+//
+// If LookupVars is nil, lookupVars returns nil and variables are looked up one by one using [Env.LookupVar].
+func (e *Env) lookupVars(ctx context.Context, refs []VarRef) *varBatch {
+	if e.LookupVars == nil {
+		return nil
+	}
+
+	if len(refs) == 0 {
+		return &varBatch{}
+	}
+
+	values, err := e.LookupVars(ctx, refs)
+	return &varBatch{values: values, err: err}
+}
+
+// VarRefs returns the references of all variables in the given expression, including variables used as default
+// values, in the order in which they first appear.
+//
+// The expression is parsed like by [Env.Eval] and parsing errors are returned as is.
+//
+// This can be used to determine the variables on which the result of an expression depends, for example to derive a
+// cache key.
+func (e *Env) VarRefs(expr string) ([]VarRef, error) {
+	p := getParser(expr, e.Strict, e.Limits)
+	defer poolParser(p)
+
+	node, err := p.Parse()
+	if err != nil {
+		return nil, err
+	}
+
+	return appendVarRefs(nil, node), nil
+}
+
+// InterpolationVarRefs returns the references of all variables in s, as interpolated by [Env.Interpolate], in the
+// order in which they first appear.
+//
+// Unlike [Env.Interpolate], InterpolationVarRefs returns an error for invalid variables even if they appear after the
+// first valid one.
+func (e *Env) InterpolationVarRefs(s string) ([]VarRef, error) {
+	p := getParser("", e.Strict, e.Limits)
+	defer poolParser(p)
+
+	return interpolationVarRefs(p, s, true)
+}
+
+// LookupRefs returns the values of the given variables, in the same order as refs.
+//
+// The values are looked up using a single call to [Env.LookupVars] if set and using [Env.LookupVar] otherwise. Default
+// values are not applied.
+func (e *Env) LookupRefs(ctx context.Context, refs []VarRef) ([]ast.Value, error) {
+	values := make([]ast.Value, len(refs))
+
+	if b := e.lookupVars(ctx, refs); b != nil {
+		if b.err != nil {
+			return nil, b.err
+		}
+
+		for i, ref := range refs {
+			values[i] = b.values[ref]
+		}
+
+		return values, nil
+	}
+
+	for i, ref := range refs {
+		var key *string
+		if ref.HasKey {
+			key = &ref.Key
+		}
+
+		val, err := e.LookupVar(ctx, ref.Name, key)
+		if err != nil {
+			return nil, err
+		}
+
+		values[i] = val
+	}
+
+	return values, nil
+}
@@ -8,6 +8,7 @@ import (
 	"sync"
 
 	"github.com/nussjustin/esi/esiexpr/ast"
+	"github.com/nussjustin/esi/internal/diag"
 )
 
 // ComparisonUnsupportedError is returned by [Env.Eval] if comparison should be made but [Env.CompareValues] is nil.
@@ -16,6 +17,11 @@ type ComparisonUnsupportedError struct {
 	Operator ast.ComparisonOperator
 }
 
+// Code returns a machine-readable code identifying the type of the error.
+func (*ComparisonUnsupportedError) Code() string {
+	return "esiexpr.comparison_unsupported"
+}
+
 // Error returns a human-readable message.
 func (c *ComparisonUnsupportedError) Error() string {
 	return "comparison " + string(c.Operator) + " not supported"
@@ -31,12 +37,61 @@ func (c *ComparisonUnsupportedError) Is(target error) bool {
 	return errors.As(target, &o) && o.Operator == c.Operator
 }
 
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (c *ComparisonUnsupportedError) MarshalJSON() ([]byte, error) {
+	return diag.Marshal(c, diag.Diagnostic{Details: map[string]any{"operator": string(c.Operator)}})
+}
+
+// InvalidArgumentError is returned by functions when called with an invalid argument.
+type InvalidArgumentError struct {
+	// Function is the name of the function.
+	Function string
+
+	// Index is the index of the argument.
+	//
+	// If an argument is missing, Index is the index of the missing argument and Value is nil.
+	Index int
+
+	// Value is the value of the argument.
+	Value ast.Value
+}
+
+// Code returns a machine-readable code identifying the type of the error.
+func (*InvalidArgumentError) Code() string {
+	return "esiexpr.invalid_argument"
+}
+
+// Error returns a human-readable message.
+func (i *InvalidArgumentError) Error() string {
+	return fmt.Sprintf("invalid argument %d for function %s: %v", i.Index, i.Function, i.Value)
+}
+
+// Is checks if the given error matches the receiver.
+func (i *InvalidArgumentError) Is(target error) bool {
+	var o *InvalidArgumentError
+	return errors.As(target, &o) && o.Error() == i.Error()
+}
+
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (i *InvalidArgumentError) MarshalJSON() ([]byte, error) {
+	d := diag.Diagnostic{Details: map[string]any{"function": i.Function, "index": i.Index}}
+	if i.Value != nil {
+		d.Got = fmt.Sprint(i.Value)
+	}
+	return diag.Marshal(i, d)
+}
+
 // NonBoolValueError is returned by [Env.Eval] if a non-bool value is encountered in a context that requires a bool.
 type NonBoolValueError struct {
 	// Value is the offending value.
 	Value ast.Value
 }
 
+// Code returns a machine-readable code identifying the type of the error.
+func (*NonBoolValueError) Code() string {
+	return "esiexpr.non_bool_value"
+}
+
 // Error returns a human-readable message.
 func (n *NonBoolValueError) Error() string {
 	return "value is not a boolean"
@@ -52,6 +107,79 @@ func (n *NonBoolValueError) Is(target error) bool {
 	return errors.As(target, &o) && n.Value == o.Value
 }
 
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (n *NonBoolValueError) MarshalJSON() ([]byte, error) {
+	d := diag.Diagnostic{Expected: []string{"bool"}}
+	if n.Value != nil {
+		d.Got = fmt.Sprint(n.Value)
+	}
+	return diag.Marshal(n, d)
+}
+
+// UnknownFunctionError is returned by [Env.Eval] when calling a function that is not defined in [Env.Functions].
+type UnknownFunctionError struct {
+	// Name is the name of the function.
+	Name string
+}
+
+// Code returns a machine-readable code identifying the type of the error.
+func (*UnknownFunctionError) Code() string {
+	return "esiexpr.unknown_function"
+}
+
+// Error returns a human-readable message.
+func (u *UnknownFunctionError) Error() string {
+	return "unknown function " + u.Name
+}
+
+// Is checks if the given error matches the receiver.
+func (u *UnknownFunctionError) Is(target error) bool {
+	if errors.Is(target, errors.ErrUnsupported) {
+		return true
+	}
+
+	var o *UnknownFunctionError
+	return errors.As(target, &o) && o.Name == u.Name
+}
+
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (u *UnknownFunctionError) MarshalJSON() ([]byte, error) {
+	return diag.Marshal(u, diag.Diagnostic{Details: map[string]any{"name": u.Name}})
+}
+
+// Function is the type for functions that can be called from expressions, for example $now().
+//
+// Functions are called with the evaluated arguments.
+type Function func(ctx context.Context, args []ast.Value) (ast.Value, error)
+
+// LookupErrorPolicy defines how [Env.Interpolate] handles variables for which [Env.LookupVar] returns an error.
+type LookupErrorPolicy uint8
+
+const (
+	// LookupErrorFail causes Interpolate to fail with the error. This is the default.
+	LookupErrorFail LookupErrorPolicy = iota
+
+	// LookupErrorEmpty replaces the variable with an empty string. Default values of the variable are not used.
+	LookupErrorEmpty
+
+	// LookupErrorKeepLiteral keeps the variable as written, for example "$(HTTP_COOKIE{id})".
+	LookupErrorKeepLiteral
+)
+
+// String returns the name of the policy.
+func (l LookupErrorPolicy) String() string {
+	switch l {
+	case LookupErrorFail:
+		return "LookupErrorFail"
+	case LookupErrorEmpty:
+		return "LookupErrorEmpty"
+	case LookupErrorKeepLiteral:
+		return "LookupErrorKeepLiteral"
+	default:
+		panic("unknown lookup error policy")
+	}
+}
+
 // Env implements methods for evaluating ESI expressions and interpolating variables in strings.
 type Env struct {
 	// CompareValues is called by [Eval] when comparing values.
@@ -63,8 +191,74 @@ type Env struct {
 	CompareValues func(a, b ast.Value) (int, error)
 
 	// LookupVar is called by [Env.Eval] and [Env.Interpolate] to get the value for a variable.
+	//
+	// LookupVar is not used if LookupVars is set.
 	LookupVar func(ctx context.Context, name string, key *string) (ast.Value, error)
 
+	// LookupVars is called by [Env.Eval], [Env.EvalNode] and [Env.Interpolate] to get the values of all variables used
+	// in an expression or string with a single call, before evaluating it.
+	//
+	// This allows implementations backed by remote stores, like an edge key-value store or a personalization service,
+	// to batch lookups instead of looking up each variable separately. Each variable is only passed once, even if it
+	// is used multiple times. Variables used as default values are always included, even if they are not needed.
+	//
+	// Variables missing from the returned map have no value. If LookupVars returns an error, the lookup of each
+	// variable fails with the error.
+	//
+	// If set, LookupVar is not used.
+	LookupVars func(ctx context.Context, refs []VarRef) (map[VarRef]ast.Value, error)
+
+	// LookupErrorPolicy defines how [Env.Interpolate] handles errors returned by LookupVar.
+	//
+	// By default, a single variable that can not be looked up causes the whole interpolation to fail. Since this
+	// usually breaks the page, for example because of a single malformed cookie, [LookupErrorEmpty] or
+	// [LookupErrorKeepLiteral] can be used to only affect the failed variable instead.
+	//
+	// The policy does not apply to [Env.Eval] or to syntax errors.
+	LookupErrorPolicy LookupErrorPolicy
+
+	// OnLookupError is called by [Env.Interpolate] for each variable whose lookup failed and that was handled
+	// according to LookupErrorPolicy, so that failures can be logged or recorded.
+	//
+	// The variable is passed as node and err is the error returned by LookupVar. If the lookup for the default value
+	// of the variable failed, node is still the outer variable.
+	//
+	// OnLookupError is not called if LookupErrorPolicy is [LookupErrorFail], since the error is returned instead.
+	OnLookupError func(ctx context.Context, node *ast.VariableNode, err error)
+
+	// Escaping is used by [Env.Interpolate] to escape the values of variables.
+	//
+	// Since the same interpolation is used for URLs and for content, it is recommended to use a copy of the Env with
+	// a different Escaping for each context, for example [EscapingURL] for the src attribute of esi:include elements
+	// and [EscapingHTML] for the content of esi:vars elements.
+	//
+	// The default is [EscapingRaw].
+	Escaping Escaping
+
+	// EscapingFor is called by [Env.Interpolate] for each variable and returns the escaping to use for its value.
+	//
+	// This can be used to override the escaping for single variables, for example to allow variables with a special
+	// prefix in their name to contain HTML. The default escaping, as configured via Escaping, is passed as def.
+	//
+	// If nil, Escaping is used for all variables.
+	EscapingFor func(name string, key *string, def Escaping) Escaping
+
+	// Functions contains the functions that can be called from expressions, keyed by their name without the
+	// leading $.
+	//
+	// See [TimeFunctions] for functions for working with dates and times.
+	Functions map[string]Function
+
+	// Limits limits the size and complexity of expressions parsed by [Env.Check], [Env.Eval] and [Env.Interpolate].
+	//
+	// See [ast.Parser.SetLimits].
+	Limits ast.Limits
+
+	// Strict disables extensions to the expression syntax, like escape sequences, raw strings and function calls.
+	//
+	// See [ast.Parser.SetStrict] and [github.com/nussjustin/esi.CompatibilityProfile.ExpressionExtensions].
+	Strict bool
+
 	// ValueToBool is called when trying to convert a non-bool value into a bool.
 	//
 	// If ValueToBool is nil, an error is returned when encountering a non-bool value in a bool context.
@@ -77,8 +271,10 @@ var parserPool = sync.Pool{
 	},
 }
 
-func getParser(data string) *ast.Parser[string] {
+func getParser(data string, strict bool, limits ast.Limits) *ast.Parser[string] {
 	p := parserPool.Get().(*ast.Parser[string])
+	p.SetLimits(limits)
+	p.SetStrict(strict)
 	p.Reset(data)
 	return p
 }
@@ -88,11 +284,22 @@ func poolParser(p *ast.Parser[string]) {
 	parserPool.Put(p)
 }
 
+// Check parses the given expression without evaluating it and returns all syntax errors found.
+//
+// Unlike [Env.Eval], Check does not stop at the first error. See [ast.Parser.ParseAll] for details.
+func (e *Env) Check(data string) []error {
+	p := getParser(data, e.Strict, e.Limits)
+	defer poolParser(p)
+
+	_, errs := p.ParseAll()
+	return errs
+}
+
 // Eval evaluates the given expression and returns the result.
 //
 // It implements the [esiproc.EvalFunc] signature.
 func (e *Env) Eval(ctx context.Context, data string) (any, error) {
-	p := getParser(data)
+	p := getParser(data, e.Strict, e.Limits)
 	defer poolParser(p)
 
 	node, err := p.Parse()
@@ -100,16 +307,40 @@ func (e *Env) Eval(ctx context.Context, data string) (any, error) {
 		return nil, err
 	}
 
-	return e.eval(ctx, node)
+	return e.EvalNode(ctx, node)
+}
+
+// EvalNode evaluates the given parsed expression and returns the result.
+//
+// This can be used to avoid parsing the same expression multiple times, for example when evaluating expressions
+// that were parsed ahead of time using an [ast.Parser].
+func (e *Env) EvalNode(ctx context.Context, node ast.Node) (any, error) {
+	var b *varBatch
+
+	if e.LookupVars != nil {
+		b = e.lookupVars(ctx, appendVarRefs(nil, node))
+	}
+
+	return e.eval(ctx, b, node)
 }
 
 // Interpolate replaces all ESI variables in the given string.
 //
+// Values are escaped according to [Env.Escaping] and [Env.EscapingFor]. Errors when looking up variables are handled
+// according to [Env.LookupErrorPolicy].
+//
 // It implements the [esiproc.InterpolateFunc] signature.
 func (e *Env) Interpolate(ctx context.Context, s string) (string, error) {
-	p := getParser("")
+	p := getParser("", e.Strict, e.Limits)
 	defer poolParser(p)
 
+	var batch *varBatch
+
+	if e.LookupVars != nil {
+		refs, _ := interpolationVarRefs(p, s, false)
+		batch = e.lookupVars(ctx, refs)
+	}
+
 	var b strings.Builder
 
 	for s != "" {
@@ -127,16 +358,30 @@ func (e *Env) Interpolate(ctx context.Context, s string) (string, error) {
 			return "", err
 		}
 
-		val, err := e.evalVariable(ctx, v)
+		literal := s[index : index+v.Position.End]
+
+		s = s[index+v.Position.End:]
+
+		val, err := e.evalVariable(ctx, batch, v)
 		if err != nil {
-			return "", err
+			if e.LookupErrorPolicy == LookupErrorFail {
+				return "", err
+			}
+
+			if e.OnLookupError != nil {
+				e.OnLookupError(ctx, v, err)
+			}
+
+			if e.LookupErrorPolicy == LookupErrorKeepLiteral {
+				_, _ = b.WriteString(literal)
+			}
+
+			continue
 		}
 
 		if val != nil {
-			_, _ = fmt.Fprintf(&b, "%v", val)
+			_, _ = b.WriteString(e.escaping(v).Escape(fmt.Sprint(val)))
 		}
-
-		s = s[index+v.Position.End:]
 	}
 
 	// Optimization: If we have no variables at all, return the original string.
@@ -151,32 +396,73 @@ func (e *Env) Interpolate(ctx context.Context, s string) (string, error) {
 	return b.String(), nil
 }
 
+// interpolationVarRefs returns the references of all variables in s.
+//
+// If failOnError is false, parsing stops at the first invalid variable and the references found before it are
+// returned. This is used by [Env.Interpolate], which reports the error when it reaches the variable. Otherwise the
+// error is returned.
+func interpolationVarRefs(p *ast.Parser[string], s string, failOnError bool) ([]VarRef, error) {
+	var refs []VarRef
+
+	for {
+		index := strings.Index(s, "$(")
+		if index == -1 {
+			return refs, nil
+		}
+
+		p.Reset(s[index:])
+
+		v, err := p.ParseVariable()
+		if err != nil {
+			if failOnError {
+				return nil, err
+			}
+
+			return refs, nil
+		}
+
+		refs = appendVarRefs(refs, v)
+
+		s = s[index+v.Position.End:]
+	}
+}
+
+func (e *Env) escaping(node *ast.VariableNode) Escaping {
+	if e.EscapingFor == nil {
+		return e.Escaping
+	}
+
+	return e.EscapingFor(node.Name, node.Key, e.Escaping)
+}
+
 var (
 	falseVal = ast.Value(false)
 	trueVal  = ast.Value(true)
 )
 
-func (e *Env) eval(ctx context.Context, node ast.Node) (ast.Value, error) {
+func (e *Env) eval(ctx context.Context, b *varBatch, node ast.Node) (ast.Value, error) {
 	switch v := node.(type) {
 	case *ast.AndNode:
-		return e.evalAnd(ctx, v)
+		return e.evalAnd(ctx, b, v)
 	case *ast.ComparisonNode:
-		return e.evalComparison(ctx, v)
+		return e.evalComparison(ctx, b, v)
+	case *ast.FunctionNode:
+		return e.evalFunction(ctx, b, v)
 	case *ast.NegateNode:
-		return e.evalNot(ctx, v)
+		return e.evalNot(ctx, b, v)
 	case *ast.OrNode:
-		return e.evalOr(ctx, v)
+		return e.evalOr(ctx, b, v)
 	case *ast.ValueNode:
 		return v.Value, nil
 	case *ast.VariableNode:
-		return e.evalVariable(ctx, v)
+		return e.evalVariable(ctx, b, v)
 	default:
 		panic("unreachable")
 	}
 }
 
-func (e *Env) evalAnd(ctx context.Context, node *ast.AndNode) (ast.Value, error) {
-	leftVal, err := e.eval(ctx, node.Left)
+func (e *Env) evalAnd(ctx context.Context, b *varBatch, node *ast.AndNode) (ast.Value, error) {
+	leftVal, err := e.eval(ctx, b, node.Left)
 	if err != nil {
 		return nil, err
 	}
@@ -186,7 +472,7 @@ func (e *Env) evalAnd(ctx context.Context, node *ast.AndNode) (ast.Value, error)
 		return nil, err
 	}
 
-	rightVal, err := e.eval(ctx, node.Right)
+	rightVal, err := e.eval(ctx, b, node.Right)
 	if err != nil {
 		return nil, err
 	}
@@ -203,17 +489,17 @@ func (e *Env) evalAnd(ctx context.Context, node *ast.AndNode) (ast.Value, error)
 	return falseVal, nil
 }
 
-func (e *Env) evalComparison(ctx context.Context, node *ast.ComparisonNode) (ast.Value, error) {
+func (e *Env) evalComparison(ctx context.Context, b *varBatch, node *ast.ComparisonNode) (ast.Value, error) {
 	if e.CompareValues == nil {
 		return nil, &ComparisonUnsupportedError{Operator: node.Operator}
 	}
 
-	leftVal, err := e.eval(ctx, node.Left)
+	leftVal, err := e.eval(ctx, b, node.Left)
 	if err != nil {
 		return nil, err
 	}
 
-	rightVal, err := e.eval(ctx, node.Right)
+	rightVal, err := e.eval(ctx, b, node.Right)
 	if err != nil {
 		return nil, err
 	}
@@ -248,8 +534,32 @@ func (e *Env) evalComparison(ctx context.Context, node *ast.ComparisonNode) (ast
 	}
 }
 
-func (e *Env) evalNot(ctx context.Context, node *ast.NegateNode) (ast.Value, error) {
-	exprVal, err := e.eval(ctx, node.Expr)
+func (e *Env) evalFunction(ctx context.Context, b *varBatch, node *ast.FunctionNode) (ast.Value, error) {
+	f, ok := e.Functions[node.Name]
+	if !ok {
+		return nil, &UnknownFunctionError{Name: node.Name}
+	}
+
+	var args []ast.Value
+
+	if len(node.Args) > 0 {
+		args = make([]ast.Value, len(node.Args))
+	}
+
+	for i, arg := range node.Args {
+		val, err := e.eval(ctx, b, arg)
+		if err != nil {
+			return nil, err
+		}
+
+		args[i] = val
+	}
+
+	return f(ctx, args)
+}
+
+func (e *Env) evalNot(ctx context.Context, b *varBatch, node *ast.NegateNode) (ast.Value, error) {
+	exprVal, err := e.eval(ctx, b, node.Expr)
 	if err != nil {
 		return nil, err
 	}
@@ -266,8 +576,8 @@ func (e *Env) evalNot(ctx context.Context, node *ast.NegateNode) (ast.Value, err
 	return trueVal, nil
 }
 
-func (e *Env) evalOr(ctx context.Context, node *ast.OrNode) (ast.Value, error) {
-	leftVal, err := e.eval(ctx, node.Left)
+func (e *Env) evalOr(ctx context.Context, b *varBatch, node *ast.OrNode) (ast.Value, error) {
+	leftVal, err := e.eval(ctx, b, node.Left)
 	if err != nil {
 		return nil, err
 	}
@@ -277,7 +587,7 @@ func (e *Env) evalOr(ctx context.Context, node *ast.OrNode) (ast.Value, error) {
 		return nil, err
 	}
 
-	rightVal, err := e.eval(ctx, node.Right)
+	rightVal, err := e.eval(ctx, b, node.Right)
 	if err != nil {
 		return nil, err
 	}
@@ -294,8 +604,8 @@ func (e *Env) evalOr(ctx context.Context, node *ast.OrNode) (ast.Value, error) {
 	return falseVal, nil
 }
 
-func (e *Env) evalVariable(ctx context.Context, node *ast.VariableNode) (ast.Value, error) {
-	val, err := e.LookupVar(ctx, node.Name, node.Key)
+func (e *Env) evalVariable(ctx context.Context, b *varBatch, node *ast.VariableNode) (ast.Value, error) {
+	val, err := e.lookupVar(ctx, b, node)
 	if err != nil {
 		return nil, err
 	}
@@ -310,7 +620,7 @@ func (e *Env) evalVariable(ctx context.Context, node *ast.VariableNode) (ast.Val
 
 	switch v := node.Default.(type) {
 	case *ast.VariableNode:
-		return e.evalVariable(ctx, v)
+		return e.evalVariable(ctx, b, v)
 	case *ast.ValueNode:
 		return v.Value, nil
 	default:
@@ -318,6 +628,19 @@ func (e *Env) evalVariable(ctx context.Context, node *ast.VariableNode) (ast.Val
 	}
 }
 
+// lookupVar returns the value of the given variable, either from b or, if b is nil, using [Env.LookupVar].
+func (e *Env) lookupVar(ctx context.Context, b *varBatch, node *ast.VariableNode) (ast.Value, error) {
+	if b == nil {
+		return e.LookupVar(ctx, node.Name, node.Key)
+	}
+
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	return b.values[varRefOf(node)], nil
+}
+
 func (e *Env) valueToBool(val ast.Value) (bool, error) {
 	if b, ok := val.(bool); ok {
 		return b, nil
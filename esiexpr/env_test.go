@@ -3,6 +3,7 @@ package esiexpr_test
 import (
 	"context"
 	"errors"
+	"math/rand/v2"
 	"strings"
 	"testing"
 
@@ -10,6 +11,7 @@ import (
 
 	"github.com/nussjustin/esi/esiexpr"
 	"github.com/nussjustin/esi/esiexpr/ast"
+	"github.com/nussjustin/esi/esiexpr/esiexprtest"
 	"github.com/nussjustin/esi/esiexpr/token"
 )
 
@@ -110,6 +112,7 @@ func TestEnv_Eval(t *testing.T) {
 		Input         string
 		CompareValues func(a, b ast.Value) (int, error)
 		ValueToBool   func(v ast.Value) (bool, error)
+		Strict        bool
 		Result        ast.Value
 		Error         error
 	}{
@@ -138,6 +141,11 @@ func TestEnv_Eval(t *testing.T) {
 			Input:  `'hello world'`,
 			Result: `hello world`,
 		},
+		{
+			Name:   "string with escaped quotes",
+			Input:  `'hello \'world\''`,
+			Result: `hello 'world'`,
+		},
 		{
 			Name:   "string var",
 			Input:  `$(STRING)`,
@@ -407,6 +415,12 @@ func TestEnv_Eval(t *testing.T) {
 			CompareValues: func(ast.Value, ast.Value) (int, error) { return 0, errComparison },
 			Error:         errComparison,
 		},
+		{
+			Name:   "strict",
+			Input:  `'''raw'''`,
+			Strict: true,
+			Error:  &ast.Error{Offset: 0, Message: "raw strings are not allowed"},
+		},
 
 		{
 			Name:          "complex",
@@ -422,6 +436,7 @@ func TestEnv_Eval(t *testing.T) {
 			env := *testEnv
 			env.CompareValues = testCase.CompareValues
 			env.ValueToBool = testCase.ValueToBool
+			env.Strict = testCase.Strict
 
 			got, err := env.Eval(t.Context(), testCase.Input)
 			if !errors.Is(err, testCase.Error) {
@@ -439,6 +454,142 @@ func TestEnv_Eval(t *testing.T) {
 	}
 }
 
+func TestEnv_Eval_Generated(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		g := &esiexprtest.Generator{Rand: rand.New(rand.NewPCG(1, 2)), Strict: strict}
+
+		for range 1000 {
+			c := g.Generate()
+
+			env := c.Env()
+			env.Strict = strict
+
+			got, err := env.Eval(context.Background(), c.Expr)
+			if err != nil {
+				t.Fatalf("got error %v for %q (strict=%t)", err, c.Expr, strict)
+			}
+
+			if got != c.Want {
+				t.Fatalf("got %v for %q with vars %v, want %v (strict=%t)", got, c.Expr, c.Vars, c.Want, strict)
+			}
+		}
+	}
+}
+
+func TestEnv_Check(t *testing.T) {
+	env := &esiexpr.Env{Strict: true}
+
+	if errs := env.Check(`$(A) == 'a' | $(B)`); len(errs) != 0 {
+		t.Errorf("got errors %v for valid expression", errs)
+	}
+
+	errs := env.Check(`$(A) == 'it\'s' | $(B) == | $(C)`)
+
+	want := []error{
+		&ast.Error{Offset: 11, Message: "escape sequences are not allowed"},
+		&ast.UnexpectedTokenError{Token: token.Token{Position: pos(26, 27), Type: token.TypeOr}},
+	}
+
+	if len(errs) != len(want) {
+		t.Fatalf("got errors %v, want %v", errs, want)
+	}
+
+	for i := range errs {
+		if !errors.Is(errs[i], want[i]) {
+			t.Errorf("error %d: got %v, want %v", i, errs[i], want[i])
+		}
+	}
+}
+
+func TestEnv_EvalNode(t *testing.T) {
+	env := &esiexpr.Env{
+		LookupVar: func(_ context.Context, name string, _ *string) (ast.Value, error) {
+			return name == "A", nil
+		},
+	}
+
+	node, err := ast.NewParser(`$(A) & !$(B)`).Parse()
+	if err != nil {
+		t.Fatalf("failed to parse expression: %v", err)
+	}
+
+	got, err := env.EvalNode(context.Background(), node)
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	if got != true {
+		t.Errorf("got %v, want true", got)
+	}
+}
+
+func TestEnv_Functions(t *testing.T) {
+	env := *testEnv
+	env.Functions = map[string]esiexpr.Function{
+		"concat": func(_ context.Context, args []ast.Value) (ast.Value, error) {
+			var sb strings.Builder
+			for _, arg := range args {
+				s, _ := arg.(string)
+				sb.WriteString(s)
+			}
+			return sb.String(), nil
+		},
+		"fail": func(context.Context, []ast.Value) (ast.Value, error) {
+			return nil, errInvalidVar
+		},
+	}
+
+	testCases := []struct {
+		Name   string
+		Input  string
+		Result ast.Value
+		Error  error
+	}{
+		{
+			Name:   "no arguments",
+			Input:  `$concat()`,
+			Result: "",
+		},
+		{
+			Name:   "arguments",
+			Input:  `$concat($(STRING), '-', $(DICT{string}))`,
+			Result: "string-STRING",
+		},
+		{
+			Name:  "argument error",
+			Input: `$concat($(ERROR))`,
+			Error: errInvalidVar,
+		},
+		{
+			Name:  "function error",
+			Input: `$fail()`,
+			Error: errInvalidVar,
+		},
+		{
+			Name:  "unknown function",
+			Input: `$unknown(1)`,
+			Error: &esiexpr.UnknownFunctionError{Name: "unknown"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			got, err := env.Eval(t.Context(), testCase.Input)
+			if !errors.Is(err, testCase.Error) {
+				t.Errorf("got error %v, want %v", err, testCase.Error)
+			}
+
+			if diff := cmp.Diff(testCase.Result, got); diff != "" {
+				t.Errorf("result mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	if _, err := env.Eval(t.Context(), `$unknown()`); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("got error %v, want %v", err, errors.ErrUnsupported)
+	}
+}
+
 func TestEnv_Interpolate(t *testing.T) {
 	testsCases := []struct {
 		Name   string
@@ -521,6 +672,11 @@ func TestEnv_Interpolate(t *testing.T) {
 			Input:  `$(DICT{nil}|$(NIL|$(DICT{int})))`,
 			Result: "-2345",
 		},
+		{
+			Name:   "default with escaped quotes",
+			Input:  `$(NIL|'it\'s')`,
+			Result: "it's",
+		},
 	}
 
 	for _, testCase := range testsCases {
@@ -540,3 +696,312 @@ func TestEnv_Interpolate(t *testing.T) {
 		})
 	}
 }
+
+func TestEnv_Interpolate_Escaping(t *testing.T) {
+	env := &esiexpr.Env{
+		LookupVar: func(_ context.Context, name string, _ *string) (ast.Value, error) {
+			return "<b>" + name + "</b>", nil
+		},
+		Escaping: esiexpr.EscapingHTML,
+		EscapingFor: func(name string, _ *string, def esiexpr.Escaping) esiexpr.Escaping {
+			if strings.HasPrefix(name, "RAW_") {
+				return esiexpr.EscapingRaw
+			}
+			return def
+		},
+	}
+
+	got, err := env.Interpolate(t.Context(), `<p>$(NAME) $(RAW_NAME)</p>`)
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	if want := `<p>&lt;b&gt;NAME&lt;/b&gt; <b>RAW_NAME</b></p>`; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestEnv_Interpolate_LookupErrorPolicy(t *testing.T) {
+	const input = `a=$(STRING)&b=$(ERROR{key})&c=$(NIL|$(ERROR))`
+
+	testCases := []struct {
+		Policy   esiexpr.LookupErrorPolicy
+		Expected string
+		Error    error
+		Failed   []string
+	}{
+		{
+			Policy: esiexpr.LookupErrorFail,
+			Error:  errInvalidVar,
+		},
+		{
+			Policy:   esiexpr.LookupErrorEmpty,
+			Expected: `a=string&b=&c=`,
+			Failed:   []string{"ERROR", "NIL"},
+		},
+		{
+			Policy:   esiexpr.LookupErrorKeepLiteral,
+			Expected: `a=string&b=$(ERROR{key})&c=$(NIL|$(ERROR))`,
+			Failed:   []string{"ERROR", "NIL"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Policy.String(), func(t *testing.T) {
+			var failed []string
+
+			env := *testEnv
+			env.LookupErrorPolicy = testCase.Policy
+			env.OnLookupError = func(_ context.Context, node *ast.VariableNode, err error) {
+				if !errors.Is(err, errInvalidVar) {
+					t.Errorf("got error %v, want %v", err, errInvalidVar)
+				}
+
+				failed = append(failed, node.Name)
+			}
+
+			got, err := env.Interpolate(t.Context(), input)
+			if !errors.Is(err, testCase.Error) {
+				t.Errorf("got error %v, want %v", err, testCase.Error)
+			}
+
+			if got != testCase.Expected {
+				t.Errorf("got %q, want %q", got, testCase.Expected)
+			}
+
+			if diff := cmp.Diff(testCase.Failed, failed); diff != "" {
+				t.Errorf("failed variables mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestEnv_LookupVars(t *testing.T) {
+	ptr := func(s string) *string { return &s }
+
+	testCases := []struct {
+		Name     string
+		Eval     string
+		Input    string
+		Refs     []esiexpr.VarRef
+		Expected any
+		Error    error
+	}{
+		{
+			Name:     "Eval",
+			Eval:     `($(INT) == 1234 & $(DICT{int}) == -2345) & $(FLOAT) == $(NIL|$(FLOAT))`,
+			Refs:     []esiexpr.VarRef{{Name: "INT"}, {Name: "DICT", Key: "int", HasKey: true}, {Name: "FLOAT"}, {Name: "NIL"}},
+			Expected: true,
+		},
+		{
+			Name:     "Eval without variables",
+			Eval:     `1 == 1`,
+			Expected: true,
+		},
+		{
+			Name:  "Eval error",
+			Eval:  `$(ERROR) == 1`,
+			Refs:  []esiexpr.VarRef{{Name: "ERROR"}},
+			Error: errInvalidVar,
+		},
+		{
+			Name:     "Interpolate",
+			Input:    `a=$(STRING)&b=$(DICT{string})&c=$(STRING)&d=$(NIL|'default')`,
+			Refs:     []esiexpr.VarRef{{Name: "STRING"}, {Name: "DICT", Key: "string", HasKey: true}, {Name: "NIL"}},
+			Expected: `a=string&b=STRING&c=string&d=default`,
+		},
+		{
+			Name:     "Interpolate without variables",
+			Input:    `a=b`,
+			Expected: `a=b`,
+		},
+		{
+			Name:  "Interpolate error",
+			Input: `a=$(STRING)&b=$(ERROR)`,
+			Refs:  []esiexpr.VarRef{{Name: "STRING"}, {Name: "ERROR"}},
+			Error: errInvalidVar,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			var calls int
+			var refs []esiexpr.VarRef
+
+			env := &esiexpr.Env{
+				CompareValues: compareValues,
+				LookupVar: func(context.Context, string, *string) (ast.Value, error) {
+					t.Error("LookupVar called")
+					return nil, nil
+				},
+				LookupVars: func(ctx context.Context, got []esiexpr.VarRef) (map[esiexpr.VarRef]ast.Value, error) {
+					calls++
+					refs = got
+
+					values := make(map[esiexpr.VarRef]ast.Value, len(got))
+
+					for _, ref := range got {
+						var key *string
+						if ref.HasKey {
+							key = ptr(ref.Key)
+						}
+
+						val, err := testEnv.LookupVar(ctx, ref.Name, key)
+						if err != nil {
+							return nil, err
+						}
+
+						values[ref] = val
+					}
+
+					return values, nil
+				},
+			}
+
+			var got any
+			var err error
+
+			if testCase.Eval != "" {
+				got, err = env.Eval(t.Context(), testCase.Eval)
+			} else {
+				got, err = env.Interpolate(t.Context(), testCase.Input)
+			}
+
+			if !errors.Is(err, testCase.Error) {
+				t.Errorf("got error %v, want %v", err, testCase.Error)
+			}
+
+			if err == nil && got != testCase.Expected {
+				t.Errorf("got %v, want %v", got, testCase.Expected)
+			}
+
+			if want := min(len(testCase.Refs), 1); calls != want {
+				t.Errorf("got %d calls to LookupVars, want %d", calls, want)
+			}
+
+			if diff := cmp.Diff(testCase.Refs, refs); diff != "" {
+				t.Errorf("refs mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestEnv_VarRefs(t *testing.T) {
+	refs, err := testEnv.VarRefs(`$(INT) == 1 & ($(DICT{int}) == $(NIL|$(FLOAT)) | $(INT) == 2)`)
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	want := []esiexpr.VarRef{{Name: "INT"}, {Name: "DICT", Key: "int", HasKey: true}, {Name: "NIL"}, {Name: "FLOAT"}}
+
+	if diff := cmp.Diff(want, refs); diff != "" {
+		t.Errorf("refs mismatch (-want +got):\n%s", diff)
+	}
+
+	if _, err := testEnv.VarRefs(`$(INT) ==`); err == nil {
+		t.Error("got no error for invalid expression")
+	}
+}
+
+func TestEnv_InterpolationVarRefs(t *testing.T) {
+	refs, err := testEnv.InterpolationVarRefs(`a=$(STRING)&b=$(DICT{string})&c=$(STRING)&d=$(NIL|'default')`)
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	want := []esiexpr.VarRef{{Name: "STRING"}, {Name: "DICT", Key: "string", HasKey: true}, {Name: "NIL"}}
+
+	if diff := cmp.Diff(want, refs); diff != "" {
+		t.Errorf("refs mismatch (-want +got):\n%s", diff)
+	}
+
+	if refs, err := testEnv.InterpolationVarRefs(`no variables`); err != nil || refs != nil {
+		t.Errorf("got (%v, %v), want (nil, nil)", refs, err)
+	}
+
+	if _, err := testEnv.InterpolationVarRefs(`a=$(STRING)&b=$(INVALID`); err == nil {
+		t.Error("got no error for invalid variable")
+	}
+}
+
+func TestEnv_LookupRefs(t *testing.T) {
+	refs := []esiexpr.VarRef{{Name: "INT"}, {Name: "DICT", Key: "string", HasKey: true}, {Name: "NIL"}}
+
+	want := []ast.Value{1234, "STRING", nil}
+
+	t.Run("LookupVar", func(t *testing.T) {
+		got, err := testEnv.LookupRefs(t.Context(), refs)
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("values mismatch (-want +got):\n%s", diff)
+		}
+
+		if _, err := testEnv.LookupRefs(t.Context(), []esiexpr.VarRef{{Name: "ERROR"}}); !errors.Is(err, errInvalidVar) {
+			t.Errorf("got error %v, want %v", err, errInvalidVar)
+		}
+	})
+
+	t.Run("LookupVars", func(t *testing.T) {
+		var calls int
+
+		env := &esiexpr.Env{
+			LookupVars: func(_ context.Context, got []esiexpr.VarRef) (map[esiexpr.VarRef]ast.Value, error) {
+				calls++
+
+				if diff := cmp.Diff(refs, got); diff != "" {
+					t.Errorf("refs mismatch (-want +got):\n%s", diff)
+				}
+
+				return map[esiexpr.VarRef]ast.Value{refs[0]: 1234, refs[1]: "STRING"}, nil
+			},
+		}
+
+		got, err := env.LookupRefs(t.Context(), refs)
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("values mismatch (-want +got):\n%s", diff)
+		}
+
+		if calls != 1 {
+			t.Errorf("got %d calls to LookupVars, want 1", calls)
+		}
+	})
+}
+
+func TestEnv_Limits(t *testing.T) {
+	env := &esiexpr.Env{
+		Limits: ast.Limits{MaxLength: 16, MaxDepth: 2},
+	}
+
+	wantLength := &ast.LimitError{Limit: "length", Max: 16, Offset: 16}
+
+	if _, err := env.Eval(t.Context(), `'abcdef' == 'abcdef'`); !errors.Is(err, wantLength) {
+		t.Errorf("got error %v from Eval, want %v", err, wantLength)
+	}
+
+	if errs := env.Check(`'abcdef' == 'abcdef'`); len(errs) != 1 || !errors.Is(errs[0], wantLength) {
+		t.Errorf("got errors %v from Check, want %v", errs, wantLength)
+	}
+
+	wantDepth := &ast.LimitError{Limit: "depth", Max: 2, Offset: 2}
+
+	if _, err := env.Eval(t.Context(), `!!true`); !errors.Is(err, wantDepth) {
+		t.Errorf("got error %v from Eval, want %v", err, wantDepth)
+	}
+
+	// The length of interpolated strings is not limited
+	got, err := env.Interpolate(t.Context(), "a string longer than the limit")
+	if err != nil {
+		t.Errorf("got error %v from Interpolate", err)
+	}
+
+	if want := "a string longer than the limit"; got != want {
+		t.Errorf("got %q from Interpolate, want %q", got, want)
+	}
+}
@@ -0,0 +1,75 @@
+package esiexpr
+
+import (
+	"fmt"
+	"html"
+	"net/url"
+	"strings"
+)
+
+// Escaping defines how values of variables are escaped by [Env.Interpolate].
+type Escaping uint8
+
+const (
+	// EscapingRaw inserts values without any escaping.
+	EscapingRaw Escaping = iota
+
+	// EscapingHTML escapes values for use in HTML text using [html.EscapeString].
+	EscapingHTML
+
+	// EscapingAttribute escapes values for use in HTML attribute values.
+	//
+	// All ASCII characters except letters and digits are replaced by numeric character references. This makes values
+	// safe even inside unquoted attribute values.
+	EscapingAttribute
+
+	// EscapingURL escapes values for use inside a URL using [url.QueryEscape].
+	EscapingURL
+)
+
+// String returns the name of the escaping.
+func (e Escaping) String() string {
+	switch e {
+	case EscapingRaw:
+		return "EscapingRaw"
+	case EscapingHTML:
+		return "EscapingHTML"
+	case EscapingAttribute:
+		return "EscapingAttribute"
+	case EscapingURL:
+		return "EscapingURL"
+	default:
+		panic("unknown escaping")
+	}
+}
+
+// Escape returns s escaped according to e.
+func (e Escaping) Escape(s string) string {
+	switch e {
+	case EscapingRaw:
+		return s
+	case EscapingHTML:
+		return html.EscapeString(s)
+	case EscapingAttribute:
+		return escapeAttribute(s)
+	case EscapingURL:
+		return url.QueryEscape(s)
+	default:
+		panic("unknown escaping")
+	}
+}
+
+func escapeAttribute(s string) string {
+	var b strings.Builder
+
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r >= 0x80:
+			b.WriteRune(r)
+		default:
+			_, _ = fmt.Fprintf(&b, "&#x%X;", r)
+		}
+	}
+
+	return b.String()
+}
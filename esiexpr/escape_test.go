@@ -0,0 +1,51 @@
+package esiexpr_test
+
+import (
+	"testing"
+
+	"github.com/nussjustin/esi/esiexpr"
+)
+
+func TestEscaping(t *testing.T) {
+	const input = `<a href="/x?a=1&b=2">it's ä</a> `
+
+	testCases := []struct {
+		Escaping esiexpr.Escaping
+		String   string
+		Expected string
+	}{
+		{
+			Escaping: esiexpr.EscapingRaw,
+			String:   "EscapingRaw",
+			Expected: input,
+		},
+		{
+			Escaping: esiexpr.EscapingHTML,
+			String:   "EscapingHTML",
+			Expected: `&lt;a href=&#34;/x?a=1&amp;b=2&#34;&gt;it&#39;s ä&lt;/a&gt; `,
+		},
+		{
+			Escaping: esiexpr.EscapingAttribute,
+			String:   "EscapingAttribute",
+			Expected: `&#x3C;a&#x20;href&#x3D;&#x22;&#x2F;x&#x3F;a&#x3D;1&#x26;b&#x3D;2&#x22;&#x3E;it&#x27;s&#x20;ä` +
+				`&#x3C;&#x2F;a&#x3E;&#x20;`,
+		},
+		{
+			Escaping: esiexpr.EscapingURL,
+			String:   "EscapingURL",
+			Expected: `%3Ca+href%3D%22%2Fx%3Fa%3D1%26b%3D2%22%3Eit%27s+%C3%A4%3C%2Fa%3E+`,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.String, func(t *testing.T) {
+			if got := testCase.Escaping.String(); got != testCase.String {
+				t.Errorf("String(): got %q, want %q", got, testCase.String)
+			}
+
+			if got := testCase.Escaping.Escape(input); got != testCase.Expected {
+				t.Errorf("Escape(%q): got %q, want %q", input, got, testCase.Expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,278 @@
+// Package esiexprtest implements utilities for testing code that parses or evaluates ESI expressions.
+//
+// The [Generator] type generates random, valid expressions together with the variables they use and their expected
+// result. This can be used for property-based tests of parsers and evaluators.
+package esiexprtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+
+	"github.com/nussjustin/esi/esiexpr"
+	"github.com/nussjustin/esi/esiexpr/ast"
+)
+
+// ErrIncomparable is returned by [CompareValues] when the given values can not be compared.
+var ErrIncomparable = errors.New("values can not be compared")
+
+// CompareValues compares two values of type int or string.
+//
+// Values of other types or values of different types result in an error wrapping [ErrIncomparable].
+//
+// It implements the signature of [esiexpr.Env.CompareValues].
+func CompareValues(a, b ast.Value) (int, error) {
+	switch av := a.(type) {
+	case int:
+		if bv, ok := b.(int); ok {
+			return compareInts(av, bv), nil
+		}
+	case string:
+		if bv, ok := b.(string); ok {
+			return strings.Compare(av, bv), nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w: %T and %T", ErrIncomparable, a, b)
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Case is a generated expression together with its variables and expected result.
+type Case struct {
+	// Expr is the generated expression.
+	Expr string
+
+	// Vars contains the values of all variables used in the expression.
+	//
+	// Values of dictionary variables are of type map[string]ast.Value.
+	Vars map[string]ast.Value
+
+	// Want is the expected result of evaluating the expression.
+	Want bool
+}
+
+// Env returns an [esiexpr.Env] that resolves variables using Vars and compares values using [CompareValues].
+//
+// Unknown variables and keys resolve to nil.
+func (c *Case) Env() *esiexpr.Env {
+	return &esiexpr.Env{
+		CompareValues: CompareValues,
+		LookupVar: func(_ context.Context, name string, key *string) (ast.Value, error) {
+			v := c.Vars[name]
+
+			if key == nil {
+				return v, nil
+			}
+
+			if dict, ok := v.(map[string]ast.Value); ok {
+				return dict[*key], nil
+			}
+
+			return nil, nil
+		},
+	}
+}
+
+// Generator generates random, valid expressions with known results.
+//
+// Generated expressions make use of all syntax supported by [ast.Parser], including literals, variables with keys and
+// default values, comparisons, negations, sub-expressions and the and and or operators. Sub-expressions are always
+// enclosed in parentheses.
+//
+// A Generator must not be used concurrently.
+type Generator struct {
+	// Rand is used as source of randomness.
+	//
+	// If nil, a randomly seeded source is used. Use a fixed seed to get reproducible results.
+	Rand *rand.Rand
+
+	// MaxDepth is the maximum nesting depth of generated expressions.
+	//
+	// If <= 0, a depth of 4 is used.
+	MaxDepth int
+
+	// Strict restricts generated expressions to the syntax defined by the ESI specification, that is without escape
+	// sequences or raw strings.
+	//
+	// See [esiexpr.Env.Strict].
+	Strict bool
+
+	vars  map[string]ast.Value
+	nvars int
+}
+
+// Generate generates a new random expression.
+func (g *Generator) Generate() Case {
+	if g.Rand == nil {
+		g.Rand = rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64())) //nolint:gosec
+	}
+
+	depth := g.MaxDepth
+	if depth <= 0 {
+		depth = 4
+	}
+
+	g.vars = make(map[string]ast.Value)
+	g.nvars = 0
+
+	expr, want := g.bool(depth)
+
+	return Case{Expr: expr, Vars: g.vars, Want: want}
+}
+
+func (g *Generator) bool(depth int) (string, bool) {
+	if depth <= 1 || g.Rand.IntN(3) == 0 {
+		return g.leaf()
+	}
+
+	switch g.Rand.IntN(3) {
+	case 0:
+		expr, want := g.bool(depth - 1)
+		return "!(" + expr + ")", !want
+	case 1:
+		left, leftWant := g.bool(depth - 1)
+		right, rightWant := g.bool(depth - 1)
+		return "(" + left + ")" + g.space() + "&" + g.space() + "(" + right + ")", leftWant && rightWant
+	default:
+		left, leftWant := g.bool(depth - 1)
+		right, rightWant := g.bool(depth - 1)
+		return "(" + left + ")" + g.space() + "|" + g.space() + "(" + right + ")", leftWant || rightWant
+	}
+}
+
+func (g *Generator) leaf() (string, bool) {
+	switch g.Rand.IntN(5) {
+	case 0:
+		want := g.Rand.IntN(2) == 0
+		return strconv.FormatBool(want), want
+	case 1:
+		want := g.Rand.IntN(2) == 0
+		return g.variable(want), want
+	case 2:
+		a, b := g.Rand.IntN(21)-10, g.Rand.IntN(21)-10
+		return g.comparison(g.intOperand(a), g.intOperand(b), compareInts(a, b))
+	case 3:
+		a, b := g.randomString(), g.randomString()
+		return g.comparison(g.stringOperand(a), g.stringOperand(b), strings.Compare(a, b))
+	default:
+		// Compare a missing variable with default value to the default value.
+		s := g.simpleString()
+		name := g.newVarName()
+		return g.comparison("$("+name+"|"+s+")", "'"+s+"'", 0)
+	}
+}
+
+func (g *Generator) comparison(left, right string, cmp int) (string, bool) {
+	ops := []struct {
+		op   string
+		want bool
+	}{
+		{"==", cmp == 0},
+		{"!=", cmp != 0},
+		{"<", cmp < 0},
+		{"<=", cmp <= 0},
+		{">", cmp > 0},
+		{">=", cmp >= 0},
+	}
+
+	op := ops[g.Rand.IntN(len(ops))]
+
+	return left + g.space() + op.op + g.space() + right, op.want
+}
+
+func (g *Generator) intOperand(v int) string {
+	if g.Rand.IntN(2) == 0 {
+		return strconv.Itoa(v)
+	}
+
+	return g.variable(v)
+}
+
+func (g *Generator) stringOperand(s string) string {
+	switch g.Rand.IntN(3) {
+	case 0:
+		return g.variable(s)
+	case 1:
+		if !g.Strict && !strings.Contains(s, "'") {
+			return "'''" + s + "'''"
+		}
+	}
+
+	return "'" + g.escape(s) + "'"
+}
+
+// variable adds a new variable with the given value and returns a reference to it, either as simple variable or
+// as key inside a dictionary variable.
+func (g *Generator) variable(v ast.Value) string {
+	name := g.newVarName()
+
+	if g.Rand.IntN(2) == 0 {
+		g.vars[name] = v
+		return "$(" + name + ")"
+	}
+
+	key := g.simpleString()
+	g.vars[name] = map[string]ast.Value{key: v}
+	return "$(" + name + "{" + key + "})"
+}
+
+func (g *Generator) newVarName() string {
+	g.nvars++
+	return "VAR_" + strconv.Itoa(g.nvars)
+}
+
+func (g *Generator) escape(s string) string {
+	if g.Strict {
+		return s
+	}
+
+	r := strings.NewReplacer(`\`, `\\`, `'`, `\'`, "\n", `\n`)
+	return r.Replace(s)
+}
+
+func (g *Generator) randomString() string {
+	if g.Strict {
+		return g.simpleString()
+	}
+
+	const chars = "abcXYZ019 _-'\\\n"
+
+	b := make([]byte, g.Rand.IntN(8))
+	for i := range b {
+		b[i] = chars[g.Rand.IntN(len(chars))]
+	}
+
+	return string(b)
+}
+
+func (g *Generator) simpleString() string {
+	const chars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_"
+
+	b := make([]byte, 1+g.Rand.IntN(8))
+	for i := range b {
+		b[i] = chars[g.Rand.IntN(len(chars))]
+	}
+
+	return string(b)
+}
+
+func (g *Generator) space() string {
+	if g.Rand.IntN(2) == 0 {
+		return ""
+	}
+
+	return " "
+}
@@ -0,0 +1,91 @@
+package esiexprtest_test
+
+import (
+	"errors"
+	"math/rand/v2"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/nussjustin/esi/esiexpr/ast"
+	"github.com/nussjustin/esi/esiexpr/esiexprtest"
+)
+
+func TestCompareValues(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		A, B     ast.Value
+		Expected int
+		Error    error
+	}{
+		{Name: "int less", A: 1, B: 2, Expected: -1},
+		{Name: "int equal", A: 2, B: 2, Expected: 0},
+		{Name: "int greater", A: 3, B: 2, Expected: 1},
+		{Name: "string less", A: "a", B: "b", Expected: -1},
+		{Name: "string equal", A: "b", B: "b", Expected: 0},
+		{Name: "string greater", A: "c", B: "b", Expected: 1},
+		{Name: "mixed", A: 1, B: "1", Error: esiexprtest.ErrIncomparable},
+		{Name: "unsupported", A: true, B: true, Error: esiexprtest.ErrIncomparable},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			got, err := esiexprtest.CompareValues(testCase.A, testCase.B)
+
+			if !errors.Is(err, testCase.Error) {
+				t.Errorf("got error %v, want %v", err, testCase.Error)
+			}
+
+			if got != testCase.Expected {
+				t.Errorf("got %d, want %d", got, testCase.Expected)
+			}
+		})
+	}
+}
+
+func TestGenerator(t *testing.T) {
+	generate := func() []esiexprtest.Case {
+		g := &esiexprtest.Generator{Rand: rand.New(rand.NewPCG(1, 2))}
+
+		cases := make([]esiexprtest.Case, 100)
+		for i := range cases {
+			cases[i] = g.Generate()
+		}
+
+		return cases
+	}
+
+	if diff := cmp.Diff(generate(), generate()); diff != "" {
+		t.Errorf("generated cases differ for the same seed (-first +second):\n%s", diff)
+	}
+
+	var trueCount int
+
+	for _, c := range generate() {
+		if c.Want {
+			trueCount++
+		}
+	}
+
+	if trueCount == 0 || trueCount == 100 {
+		t.Errorf("got %d of 100 cases with result true, want a mix of results", trueCount)
+	}
+}
+
+func TestGenerator_MaxDepth(t *testing.T) {
+	g := &esiexprtest.Generator{Rand: rand.New(rand.NewPCG(3, 4)), MaxDepth: 1}
+
+	for range 100 {
+		c := g.Generate()
+
+		node, err := ast.NewParser(c.Expr).Parse()
+		if err != nil {
+			t.Fatalf("failed to parse %q: %v", c.Expr, err)
+		}
+
+		switch node.(type) {
+		case *ast.AndNode, *ast.OrNode, *ast.NegateNode:
+			t.Errorf("got nested expression %q for max depth 1", c.Expr)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package esiexpr
+
+import (
+	"context"
+	"net"
+	"net/netip"
+
+	"github.com/nussjustin/esi/esiexpr/ast"
+)
+
+// VarGeo is the name of the variable containing information about the location of the client.
+const VarGeo = "GEO"
+
+// GeoLocation contains information about the location of a client.
+//
+// Empty fields are unknown.
+type GeoLocation struct {
+	// Continent is the two-letter code of the continent, for example "EU".
+	Continent string
+
+	// CountryCode is the ISO 3166-1 alpha-2 code of the country, for example "DE".
+	CountryCode string
+
+	// RegionCode is the ISO 3166-2 code of the region inside the country, without the country prefix, for example
+	// "BE".
+	RegionCode string
+
+	// City is the name of the city.
+	City string
+}
+
+// GeoProvider is the interface for types that can look up the location of a client by its IP address.
+type GeoProvider interface {
+	// LookupGeo returns the location for the given IP address.
+	LookupGeo(ctx context.Context, addr netip.Addr) (GeoLocation, error)
+}
+
+// GeoProviderFunc implements the [GeoProvider] interface using a function.
+type GeoProviderFunc func(ctx context.Context, addr netip.Addr) (GeoLocation, error)
+
+// LookupGeo implements the [GeoProvider] interface.
+func (f GeoProviderFunc) LookupGeo(ctx context.Context, addr netip.Addr) (GeoLocation, error) {
+	return f(ctx, addr)
+}
+
+// GeoVars returns a function for use as [Env.LookupVar] that handles the variable [VarGeo] and calls lookup for all
+// other variables.
+//
+// The location is looked up using provider with the address returned by clientAddr, which is called once per lookup
+// of the variable. This can be used together with [github.com/nussjustin/esi/esihttp.ClientIP] to get the address of
+// the client that sent the original request.
+//
+// The following keys are supported: "continent", "country_code", "region_code" and "city". Without a key, for other
+// keys, for unknown values and if either provider is nil or clientAddr returns an invalid address, the value is nil.
+// Errors returned by provider are returned as is.
+//
+// If lookup is nil, the value of all other variables is nil.
+func GeoVars(
+	provider GeoProvider,
+	clientAddr func(ctx context.Context) netip.Addr,
+	lookup func(ctx context.Context, name string, key *string) (ast.Value, error),
+) func(ctx context.Context, name string, key *string) (ast.Value, error) {
+	return func(ctx context.Context, name string, key *string) (ast.Value, error) {
+		if name != VarGeo {
+			if lookup == nil {
+				return nil, nil
+			}
+
+			return lookup(ctx, name, key)
+		}
+
+		if provider == nil || key == nil {
+			return nil, nil
+		}
+
+		addr := clientAddr(ctx)
+		if !addr.IsValid() {
+			return nil, nil
+		}
+
+		loc, err := provider.LookupGeo(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		var v string
+
+		switch *key {
+		case "city":
+			v = loc.City
+		case "continent":
+			v = loc.Continent
+		case "country_code":
+			v = loc.CountryCode
+		case "region_code":
+			v = loc.RegionCode
+		}
+
+		if v == "" {
+			return nil, nil
+		}
+
+		return v, nil
+	}
+}
+
+// MaxMindReader is the interface for readers of MaxMind databases.
+//
+// It is implemented by the Reader type of the github.com/oschwald/maxminddb-golang package.
+type MaxMindReader interface {
+	// Lookup looks up the given IP address and decodes the record into result.
+	Lookup(ip net.IP, result any) error
+}
+
+// MaxMindGeoProvider implements a [GeoProvider] using a MaxMind GeoIP2 or GeoLite2 City database.
+type MaxMindGeoProvider struct {
+	// Reader is used to read records from the database.
+	Reader MaxMindReader
+
+	// Language is the language used for names of cities.
+	//
+	// If empty, "en" is used.
+	Language string
+}
+
+var _ GeoProvider = (*MaxMindGeoProvider)(nil)
+
+type maxMindRecord struct {
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+
+	Continent struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"continent"`
+
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+
+	Subdivisions []struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"subdivisions"`
+}
+
+// LookupGeo implements the [GeoProvider] interface.
+func (m *MaxMindGeoProvider) LookupGeo(_ context.Context, addr netip.Addr) (GeoLocation, error) {
+	var record maxMindRecord
+
+	if err := m.Reader.Lookup(net.IP(addr.Unmap().AsSlice()), &record); err != nil {
+		return GeoLocation{}, err
+	}
+
+	lang := m.Language
+	if lang == "" {
+		lang = "en"
+	}
+
+	loc := GeoLocation{
+		Continent:   record.Continent.Code,
+		CountryCode: record.Country.ISOCode,
+		City:        record.City.Names[lang],
+	}
+
+	if len(record.Subdivisions) > 0 {
+		loc.RegionCode = record.Subdivisions[0].ISOCode
+	}
+
+	return loc, nil
+}
@@ -0,0 +1,188 @@
+package esiexpr_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/nussjustin/esi/esiexpr"
+	"github.com/nussjustin/esi/esiexpr/ast"
+)
+
+func TestGeoVars(t *testing.T) {
+	errLookup := errors.New("lookup failed")
+
+	provider := esiexpr.GeoProviderFunc(func(_ context.Context, addr netip.Addr) (esiexpr.GeoLocation, error) {
+		switch addr {
+		case netip.MustParseAddr("192.0.2.1"):
+			return esiexpr.GeoLocation{Continent: "EU", CountryCode: "DE", RegionCode: "BE", City: "Berlin"}, nil
+		case netip.MustParseAddr("192.0.2.2"):
+			return esiexpr.GeoLocation{CountryCode: "DE"}, nil
+		default:
+			return esiexpr.GeoLocation{}, errLookup
+		}
+	})
+
+	type addrKey struct{}
+
+	lookup := esiexpr.GeoVars(
+		provider,
+		func(ctx context.Context) netip.Addr {
+			addr, _ := ctx.Value(addrKey{}).(netip.Addr)
+			return addr
+		},
+		func(_ context.Context, name string, _ *string) (ast.Value, error) {
+			return "other:" + name, nil
+		})
+
+	ptr := func(s string) *string { return &s }
+
+	testCases := []struct {
+		Addr     string
+		Name     string
+		Key      *string
+		Expected ast.Value
+		Error    error
+	}{
+		{Addr: "192.0.2.1", Name: esiexpr.VarGeo, Key: ptr("continent"), Expected: "EU"},
+		{Addr: "192.0.2.1", Name: esiexpr.VarGeo, Key: ptr("country_code"), Expected: "DE"},
+		{Addr: "192.0.2.1", Name: esiexpr.VarGeo, Key: ptr("region_code"), Expected: "BE"},
+		{Addr: "192.0.2.1", Name: esiexpr.VarGeo, Key: ptr("city"), Expected: "Berlin"},
+		{Addr: "192.0.2.1", Name: esiexpr.VarGeo, Key: ptr("unknown")},
+		{Addr: "192.0.2.1", Name: esiexpr.VarGeo},
+		{Addr: "192.0.2.2", Name: esiexpr.VarGeo, Key: ptr("city")},
+		{Name: esiexpr.VarGeo, Key: ptr("country_code")},
+		{Addr: "192.0.2.3", Name: esiexpr.VarGeo, Key: ptr("country_code"), Error: errLookup},
+		{Addr: "192.0.2.1", Name: "HTTP_HOST", Expected: "other:HTTP_HOST"},
+	}
+
+	for _, testCase := range testCases {
+		ctx := t.Context()
+
+		if testCase.Addr != "" {
+			ctx = context.WithValue(ctx, addrKey{}, netip.MustParseAddr(testCase.Addr))
+		}
+
+		got, err := lookup(ctx, testCase.Name, testCase.Key)
+		if !errors.Is(err, testCase.Error) {
+			t.Errorf("got error %v, want %v", err, testCase.Error)
+		}
+
+		if diff := cmp.Diff(testCase.Expected, got); diff != "" {
+			t.Errorf("%s: value mismatch (-want +got):\n%s", testCase.Name, diff)
+		}
+	}
+}
+
+func TestGeoVars_NilProvider(t *testing.T) {
+	env := &esiexpr.Env{
+		LookupVar: esiexpr.GeoVars(nil, func(context.Context) netip.Addr {
+			return netip.MustParseAddr("192.0.2.1")
+		}, nil),
+	}
+
+	got, err := env.Interpolate(t.Context(), "$(GEO{country_code}|'XX')")
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	if want := "XX"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// fakeMaxMindReader decodes records from maps into structs using the maxminddb struct tags, similar to the real
+// reader.
+type fakeMaxMindReader map[string]map[string]any
+
+func (f fakeMaxMindReader) Lookup(ip net.IP, result any) error {
+	record, ok := f[ip.String()]
+	if !ok {
+		return errors.New("not found")
+	}
+
+	decodeMaxMind(record, reflect.ValueOf(result).Elem())
+	return nil
+}
+
+func decodeMaxMind(data any, v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Struct:
+		m, _ := data.(map[string]any)
+
+		for i := range v.NumField() {
+			if value, ok := m[v.Type().Field(i).Tag.Get("maxminddb")]; ok {
+				decodeMaxMind(value, v.Field(i))
+			}
+		}
+	case reflect.Slice:
+		s, _ := data.([]any)
+
+		v.Set(reflect.MakeSlice(v.Type(), len(s), len(s)))
+
+		for i := range s {
+			decodeMaxMind(s[i], v.Index(i))
+		}
+	default:
+		v.Set(reflect.ValueOf(data))
+	}
+}
+
+func TestMaxMindGeoProvider(t *testing.T) {
+	reader := fakeMaxMindReader{
+		"192.0.2.1": {
+			"city":         map[string]any{"names": map[string]string{"de": "München", "en": "Munich"}},
+			"continent":    map[string]any{"code": "EU"},
+			"country":      map[string]any{"iso_code": "DE"},
+			"subdivisions": []any{map[string]any{"iso_code": "BY"}},
+		},
+		"2001:db8::1": {
+			"country": map[string]any{"iso_code": "US"},
+		},
+	}
+
+	testCases := []struct {
+		Addr     string
+		Language string
+		Expected esiexpr.GeoLocation
+		Error    bool
+	}{
+		{
+			Addr:     "192.0.2.1",
+			Expected: esiexpr.GeoLocation{Continent: "EU", CountryCode: "DE", RegionCode: "BY", City: "Munich"},
+		},
+		{
+			Addr:     "::ffff:192.0.2.1",
+			Language: "de",
+			Expected: esiexpr.GeoLocation{Continent: "EU", CountryCode: "DE", RegionCode: "BY", City: "München"},
+		},
+		{
+			Addr:     "2001:db8::1",
+			Expected: esiexpr.GeoLocation{CountryCode: "US"},
+		},
+		{
+			Addr:  "192.0.2.2",
+			Error: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Addr, func(t *testing.T) {
+			provider := &esiexpr.MaxMindGeoProvider{Reader: reader, Language: testCase.Language}
+
+			got, err := provider.LookupGeo(t.Context(), netip.MustParseAddr(testCase.Addr))
+			if (err != nil) != testCase.Error {
+				t.Errorf("got error %v", err)
+			}
+
+			if diff := cmp.Diff(testCase.Expected, got); diff != "" {
+				t.Errorf("location mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
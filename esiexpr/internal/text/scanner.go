@@ -3,6 +3,8 @@ package text
 import (
 	"errors"
 	"fmt"
+
+	"github.com/nussjustin/esi/internal/diag"
 )
 
 // UnexpectedCharacterError is returned by [Scanner.ConsumeOrError] when the next character does not match the expected.
@@ -17,6 +19,11 @@ type UnexpectedCharacterError struct {
 	Expected byte
 }
 
+// Code returns a machine-readable code identifying the type of the error.
+func (*UnexpectedCharacterError) Code() string {
+	return "esiexpr.unexpected_character"
+}
+
 // Error returns a human-readable error message.
 func (u *UnexpectedCharacterError) Error() string {
 	return fmt.Sprintf("unexpected character '%c' at offset %d, '%c' expected", u.Got, u.At, u.Expected)
@@ -28,6 +35,15 @@ func (u *UnexpectedCharacterError) Is(err error) bool {
 	return errors.As(err, &o) && *o == *u
 }
 
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (u *UnexpectedCharacterError) MarshalJSON() ([]byte, error) {
+	return diag.Marshal(u, diag.Diagnostic{
+		Offset:   diag.Int(u.At),
+		Expected: []string{string(u.Expected)},
+		Got:      string(u.Got),
+	})
+}
+
 // Offset returns u.At.
 func (u *UnexpectedCharacterError) Offset() int {
 	return u.At
@@ -42,6 +58,11 @@ type UnexpectedEndOfInput struct {
 	Expected byte
 }
 
+// Code returns a machine-readable code identifying the type of the error.
+func (*UnexpectedEndOfInput) Code() string {
+	return "esiexpr.unexpected_end_of_input"
+}
+
 // Error returns a human-readable error message.
 func (u *UnexpectedEndOfInput) Error() string {
 	return fmt.Sprintf("unexpected end of input at offset %d, character %c expected", u.At, u.Expected)
@@ -53,6 +74,11 @@ func (u *UnexpectedEndOfInput) Is(err error) bool {
 	return errors.As(err, &o) && *o == *u
 }
 
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (u *UnexpectedEndOfInput) MarshalJSON() ([]byte, error) {
+	return diag.Marshal(u, diag.Diagnostic{Offset: diag.Int(u.At), Expected: []string{string(u.Expected)}})
+}
+
 // Offset returns u.At.
 func (u *UnexpectedEndOfInput) Offset() int {
 	return u.At
@@ -0,0 +1,70 @@
+package esiexpr
+
+import (
+	"context"
+	"math/rand/v2"
+	"strconv"
+
+	"github.com/nussjustin/esi/esiexpr/ast"
+)
+
+// VarRand is the name of the variable containing a random number, for example for A/B bucketing.
+const VarRand = "RAND"
+
+var randSeedKey = new(int)
+
+// RandSeed returns the seed associated with the given context using [WithRandSeed].
+func RandSeed(ctx context.Context) (seed uint64, ok bool) {
+	seed, ok = ctx.Value(randSeedKey).(uint64)
+	return seed, ok
+}
+
+// WithRandSeed associates the given seed with the context.
+//
+// The seed is used by the lookup function returned by [RandVars].
+func WithRandSeed(ctx context.Context, seed uint64) context.Context {
+	return context.WithValue(ctx, randSeedKey, seed)
+}
+
+// RandVars returns a function for use as [Env.LookupVar] that handles the variable [VarRand] and calls lookup for all
+// other variables.
+//
+// Without a key, the variable contains a random int in the range [0, 100). With a key n, where n is a positive
+// integer, it contains a random int in the range [0, n). For other keys the value is nil.
+//
+// The values are derived from the seed associated with the context using [WithRandSeed], so that all lookups using
+// the same seed and key return the same value. This makes it possible to consistently use the variable multiple
+// times in a document and, by deriving the seed from a cookie or header, across requests. If the context has no seed,
+// each lookup returns a new random value.
+//
+// If lookup is nil, the value of all other variables is nil.
+func RandVars(
+	lookup func(ctx context.Context, name string, key *string) (ast.Value, error),
+) func(ctx context.Context, name string, key *string) (ast.Value, error) {
+	return func(ctx context.Context, name string, key *string) (ast.Value, error) {
+		if name != VarRand {
+			if lookup == nil {
+				return nil, nil
+			}
+
+			return lookup(ctx, name, key)
+		}
+
+		n := 100
+
+		if key != nil {
+			var err error
+
+			if n, err = strconv.Atoi(*key); err != nil || n <= 0 {
+				return nil, nil
+			}
+		}
+
+		seed, ok := RandSeed(ctx)
+		if !ok {
+			return rand.IntN(n), nil //nolint:gosec
+		}
+
+		return rand.New(rand.NewPCG(seed, 0)).IntN(n), nil //nolint:gosec
+	}
+}
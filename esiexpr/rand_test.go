@@ -0,0 +1,106 @@
+package esiexpr_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/nussjustin/esi/esiexpr"
+	"github.com/nussjustin/esi/esiexpr/ast"
+)
+
+func TestRandVars(t *testing.T) {
+	lookup := esiexpr.RandVars(func(_ context.Context, name string, _ *string) (ast.Value, error) {
+		return "other:" + name, nil
+	})
+
+	ptr := func(s string) *string { return &s }
+
+	ctx := esiexpr.WithRandSeed(t.Context(), 42)
+
+	testCases := []struct {
+		Name string
+		Key  *string
+		Max  int
+	}{
+		{Name: esiexpr.VarRand, Max: 100},
+		{Name: esiexpr.VarRand, Key: ptr("2"), Max: 2},
+		{Name: esiexpr.VarRand, Key: ptr("1000"), Max: 1000},
+	}
+
+	for _, testCase := range testCases {
+		got, err := lookup(ctx, testCase.Name, testCase.Key)
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		n, ok := got.(int)
+		if !ok || n < 0 || n >= testCase.Max {
+			t.Errorf("got %v, want int in range [0, %d)", got, testCase.Max)
+		}
+
+		again, _ := lookup(ctx, testCase.Name, testCase.Key)
+		if again != got {
+			t.Errorf("got %v for second lookup with same seed, want %v", again, got)
+		}
+	}
+
+	for _, key := range []string{"0", "-1", "x"} {
+		got, err := lookup(ctx, esiexpr.VarRand, &key)
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		if got != nil {
+			t.Errorf("got %v for key %q, want nil", got, key)
+		}
+	}
+
+	got, err := lookup(ctx, "HTTP_HOST", nil)
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	if diff := cmp.Diff(ast.Value("other:HTTP_HOST"), got); diff != "" {
+		t.Errorf("value mismatch (-want +got):\n%s", diff)
+	}
+
+	if got, _ := esiexpr.RandVars(nil)(ctx, "HTTP_HOST", nil); got != nil {
+		t.Errorf("got %v for other variable without lookup, want nil", got)
+	}
+}
+
+func TestRandVars_Seed(t *testing.T) {
+	env := &esiexpr.Env{LookupVar: esiexpr.RandVars(nil)}
+
+	values := make(map[string]bool)
+
+	for seed := range uint64(20) {
+		ctx := esiexpr.WithRandSeed(t.Context(), seed)
+
+		first, err := env.Interpolate(ctx, "$(RAND{1000})")
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		second, err := env.Interpolate(ctx, "$(RAND{1000})")
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		if first != second {
+			t.Errorf("got %q and %q for seed %d, want equal values", first, second, seed)
+		}
+
+		values[first] = true
+	}
+
+	if len(values) < 2 {
+		t.Errorf("got the same value for all seeds")
+	}
+
+	if _, ok := esiexpr.RandSeed(t.Context()); ok {
+		t.Errorf("got seed for context without seed")
+	}
+}
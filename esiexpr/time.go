@@ -0,0 +1,242 @@
+package esiexpr
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/nussjustin/esi/esiexpr/ast"
+)
+
+const (
+	// VarDateGMT is the name of the variable containing the current date and time in UTC, formatted like
+	// "Mon, 02 Jan 2006 15:04:05 GMT".
+	VarDateGMT = "DATE_GMT"
+
+	// VarDateLocal is the name of the variable containing the current date and time in the local time zone, formatted
+	// using [time.RFC1123].
+	VarDateLocal = "DATE_LOCAL"
+)
+
+const dateGMTLayout = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// timeLayouts contains the layouts accepted when converting strings to times.
+var timeLayouts = [...]string{
+	dateGMTLayout,
+	time.RFC1123,
+	time.RFC1123Z,
+	time.RFC850,
+	time.ANSIC,
+	time.RFC3339Nano,
+}
+
+// TimeVars returns a function for use as [Env.LookupVar] that handles the time variables [VarDateGMT] and
+// [VarDateLocal] and calls lookup for all other variables.
+//
+// The current time is taken from now, which is called once per lookup of a time variable. This can be used together
+// with [github.com/nussjustin/esi/esiproc.Now] to use the clock configured for the processor.
+//
+// Without a key, the variables contain the formatted date. With the key "unix", they contain the number of seconds
+// since the Unix epoch as int. For other keys the value is nil.
+//
+// If lookup is nil, the value of all other variables is nil.
+func TimeVars(
+	now func(ctx context.Context) time.Time,
+	lookup func(ctx context.Context, name string, key *string) (ast.Value, error),
+) func(ctx context.Context, name string, key *string) (ast.Value, error) {
+	return func(ctx context.Context, name string, key *string) (ast.Value, error) {
+		var layout string
+
+		switch name {
+		case VarDateGMT:
+			layout = dateGMTLayout
+		case VarDateLocal:
+			layout = time.RFC1123
+		default:
+			if lookup == nil {
+				return nil, nil
+			}
+
+			return lookup(ctx, name, key)
+		}
+
+		t := now(ctx)
+
+		switch {
+		case key == nil && name == VarDateGMT:
+			return t.UTC().Format(layout), nil
+		case key == nil:
+			return t.Local().Format(layout), nil
+		case *key == "unix":
+			return int(t.Unix()), nil
+		default:
+			return nil, nil
+		}
+	}
+}
+
+// TimeFunctions returns functions for working with dates and times for use in [Env.Functions].
+//
+// The following functions are returned:
+//
+//   - $now() returns the current time as [time.Time]. If a duration is given, like in $now('-1h'), it is added to
+//     the current time.
+//   - $time(v) converts v into a [time.Time]. v can be a [time.Time], the number of seconds since the Unix epoch as
+//     number or string, or a date string like "Mon, 02 Jan 2006 15:04:05 GMT" (RFC 1123). RFC 850, ANSI C and
+//     RFC 3339 dates are also accepted.
+//   - $duration(v) converts v into a [time.Duration]. v can be a [time.Duration], a number of seconds as number or
+//     string, or a string like "1h30m" as accepted by [time.ParseDuration].
+//
+// Invalid arguments result in an [*InvalidArgumentError].
+//
+// The current time is taken from now. This can be used together with [github.com/nussjustin/esi/esiproc.Now] to
+// use the clock configured for the processor.
+//
+// See [CompareTimes] for comparing the returned values.
+func TimeFunctions(now func(ctx context.Context) time.Time) map[string]Function {
+	return map[string]Function{
+		"duration": func(_ context.Context, args []ast.Value) (ast.Value, error) {
+			if len(args) != 1 {
+				return nil, &InvalidArgumentError{Function: "duration", Index: len(args)}
+			}
+
+			d, ok := toDuration(args[0])
+			if !ok {
+				return nil, &InvalidArgumentError{Function: "duration", Index: 0, Value: args[0]}
+			}
+
+			return d, nil
+		},
+		"now": func(ctx context.Context, args []ast.Value) (ast.Value, error) {
+			if len(args) > 1 {
+				return nil, &InvalidArgumentError{Function: "now", Index: len(args) - 1, Value: args[len(args)-1]}
+			}
+
+			t := now(ctx)
+
+			if len(args) == 1 {
+				d, ok := toDuration(args[0])
+				if !ok {
+					return nil, &InvalidArgumentError{Function: "now", Index: 0, Value: args[0]}
+				}
+
+				t = t.Add(d)
+			}
+
+			return t, nil
+		},
+		"time": func(_ context.Context, args []ast.Value) (ast.Value, error) {
+			if len(args) != 1 {
+				return nil, &InvalidArgumentError{Function: "time", Index: len(args)}
+			}
+
+			t, ok := toTime(args[0])
+			if !ok {
+				return nil, &InvalidArgumentError{Function: "time", Index: 0, Value: args[0]}
+			}
+
+			return t, nil
+		},
+	}
+}
+
+// CompareTimes returns a function for use as [Env.CompareValues] that compares [time.Time] and [time.Duration]
+// values and calls compare for all other values.
+//
+// If only one of the values is a [time.Time] or [time.Duration], the other value is converted using the same rules
+// as for the $time and $duration functions returned by [TimeFunctions]. This allows comparisons like
+// $(HTTP_COOKIE{exp}) > $now(), where the cookie contains a Unix timestamp or an RFC 1123 date. If the conversion
+// fails, an [*InvalidArgumentError] is returned.
+//
+// If compare is nil, comparing other values returns [errors.ErrUnsupported].
+func CompareTimes(compare func(a, b ast.Value) (int, error)) func(a, b ast.Value) (int, error) {
+	return func(a, b ast.Value) (int, error) {
+		switch {
+		case isTime(a) || isTime(b):
+			at, ok := toTime(a)
+			if !ok {
+				return 0, &InvalidArgumentError{Function: "time", Value: a}
+			}
+
+			bt, ok := toTime(b)
+			if !ok {
+				return 0, &InvalidArgumentError{Function: "time", Value: b}
+			}
+
+			return at.Compare(bt), nil
+		case isDuration(a) || isDuration(b):
+			ad, ok := toDuration(a)
+			if !ok {
+				return 0, &InvalidArgumentError{Function: "duration", Value: a}
+			}
+
+			bd, ok := toDuration(b)
+			if !ok {
+				return 0, &InvalidArgumentError{Function: "duration", Value: b}
+			}
+
+			return cmp.Compare(ad, bd), nil
+		case compare == nil:
+			return 0, errors.ErrUnsupported
+		default:
+			return compare(a, b)
+		}
+	}
+}
+
+func isDuration(v ast.Value) bool {
+	_, ok := v.(time.Duration)
+	return ok
+}
+
+func isTime(v ast.Value) bool {
+	_, ok := v.(time.Time)
+	return ok
+}
+
+func toDuration(v ast.Value) (time.Duration, bool) {
+	switch v := v.(type) {
+	case time.Duration:
+		return v, true
+	case int:
+		return time.Duration(v) * time.Second, true
+	case float64:
+		return time.Duration(v * float64(time.Second)), true
+	case string:
+		if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return time.Duration(secs) * time.Second, true
+		}
+
+		d, err := time.ParseDuration(v)
+		return d, err == nil
+	default:
+		return 0, false
+	}
+}
+
+func toTime(v ast.Value) (time.Time, bool) {
+	switch v := v.(type) {
+	case time.Time:
+		return v, true
+	case int:
+		return time.Unix(int64(v), 0), true
+	case float64:
+		return time.UnixMilli(int64(v * 1000)), true
+	case string:
+		if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return time.Unix(secs, 0), true
+		}
+
+		for _, layout := range timeLayouts {
+			if t, err := time.Parse(layout, v); err == nil {
+				return t, true
+			}
+		}
+
+		return time.Time{}, false
+	default:
+		return time.Time{}, false
+	}
+}
@@ -0,0 +1,175 @@
+package esiexpr_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/nussjustin/esi/esiexpr"
+	"github.com/nussjustin/esi/esiexpr/ast"
+)
+
+func TestCompareTimes(t *testing.T) {
+	t0 := time.Unix(1709645415, 0)
+
+	compare := esiexpr.CompareTimes(func(ast.Value, ast.Value) (int, error) {
+		return 0, errComparison
+	})
+
+	testCases := []struct {
+		Name     string
+		A, B     ast.Value
+		Expected int
+		Error    error
+	}{
+		{Name: "time and time", A: t0, B: t0.Add(time.Second), Expected: -1},
+		{Name: "time and int", A: t0, B: 1709645414, Expected: 1},
+		{Name: "string and time", A: "Tue, 05 Mar 2024 13:30:15 GMT", B: t0, Expected: 0},
+		{Name: "time and numeric string", A: t0, B: "1709645416", Expected: -1},
+		{
+			Name:  "time and invalid string",
+			A:     t0,
+			B:     "yesterday",
+			Error: &esiexpr.InvalidArgumentError{Function: "time", Value: "yesterday"},
+		},
+		{Name: "duration and duration", A: time.Hour, B: time.Minute, Expected: 1},
+		{Name: "duration and int", A: time.Minute, B: 60, Expected: 0},
+		{Name: "string and duration", A: "90m", B: time.Hour, Expected: 1},
+		{
+			Name:  "duration and bool",
+			A:     time.Hour,
+			B:     true,
+			Error: &esiexpr.InvalidArgumentError{Function: "duration", Value: true},
+		},
+		{Name: "other", A: 1, B: 2, Error: errComparison},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			got, err := compare(testCase.A, testCase.B)
+			if !errors.Is(err, testCase.Error) {
+				t.Errorf("got error %v, want %v", err, testCase.Error)
+			}
+
+			if got != testCase.Expected {
+				t.Errorf("got %d, want %d", got, testCase.Expected)
+			}
+		})
+	}
+
+	if _, err := esiexpr.CompareTimes(nil)(1, 2); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("got error %v, want %v", err, errors.ErrUnsupported)
+	}
+}
+
+func TestTimeFunctions(t *testing.T) {
+	now := time.Unix(1709645415, 0)
+
+	env := &esiexpr.Env{
+		CompareValues: esiexpr.CompareTimes(nil),
+		Functions:     esiexpr.TimeFunctions(func(context.Context) time.Time { return now }),
+		LookupVar: func(_ context.Context, name string, _ *string) (ast.Value, error) {
+			switch name {
+			case "EXPIRES":
+				return "Tue, 05 Mar 2024 14:30:15 GMT", nil
+			case "CREATED":
+				return "1709641815", nil
+			default:
+				return nil, nil
+			}
+		},
+	}
+
+	testCases := []struct {
+		Input    string
+		Expected ast.Value
+		Error    error
+	}{
+		{Input: `$now()`, Expected: now},
+		{Input: `$now('-1h30m')`, Expected: now.Add(-90 * time.Minute)},
+		{Input: `$now(60)`, Expected: now.Add(time.Minute)},
+		{Input: `$now('x')`, Error: &esiexpr.InvalidArgumentError{Function: "now", Value: "x"}},
+		{Input: `$now(1, 2)`, Error: &esiexpr.InvalidArgumentError{Function: "now", Index: 1, Value: 2}},
+		{Input: `$time(0)`, Expected: time.Unix(0, 0)},
+		{Input: `$time('1709645415')`, Expected: now},
+		{Input: `$time('2024-03-05T13:30:15Z')`, Expected: now.UTC()},
+		{Input: `$time(true)`, Error: &esiexpr.InvalidArgumentError{Function: "time", Value: true}},
+		{Input: `$time()`, Error: &esiexpr.InvalidArgumentError{Function: "time"}},
+		{Input: `$duration('1h')`, Expected: time.Hour},
+		{Input: `$duration(90)`, Expected: 90 * time.Second},
+		{Input: `$duration(null)`, Error: &esiexpr.InvalidArgumentError{Function: "duration"}},
+		{Input: `$time($(EXPIRES)) > $now()`, Expected: true},
+		{Input: `$(EXPIRES) > $now('2h')`, Expected: false},
+		{Input: `$(CREATED) >= $now('-1h')`, Expected: true},
+		{Input: `$duration('1h') < $duration('59m')`, Expected: false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Input, func(t *testing.T) {
+			got, err := env.Eval(t.Context(), testCase.Input)
+			if !errors.Is(err, testCase.Error) {
+				t.Errorf("got error %v, want %v", err, testCase.Error)
+			}
+
+			if diff := cmp.Diff(testCase.Expected, got); diff != "" {
+				t.Errorf("result mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestTimeVars(t *testing.T) {
+	now := time.Date(2024, time.March, 5, 14, 30, 15, 0, time.FixedZone("CET", 3600))
+
+	lookup := esiexpr.TimeVars(
+		func(context.Context) time.Time { return now },
+		func(_ context.Context, name string, _ *string) (ast.Value, error) {
+			return "other:" + name, nil
+		})
+
+	ptr := func(s string) *string { return &s }
+
+	testCases := []struct {
+		Name     string
+		Key      *string
+		Expected ast.Value
+	}{
+		{Name: esiexpr.VarDateGMT, Expected: "Tue, 05 Mar 2024 13:30:15 GMT"},
+		{Name: esiexpr.VarDateGMT, Key: ptr("unix"), Expected: 1709645415},
+		{Name: esiexpr.VarDateGMT, Key: ptr("unknown"), Expected: nil},
+		{Name: esiexpr.VarDateLocal, Expected: now.Local().Format(time.RFC1123)},
+		{Name: esiexpr.VarDateLocal, Key: ptr("unix"), Expected: 1709645415},
+		{Name: "HTTP_HOST", Expected: "other:HTTP_HOST"},
+	}
+
+	for _, testCase := range testCases {
+		got, err := lookup(t.Context(), testCase.Name, testCase.Key)
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		if diff := cmp.Diff(testCase.Expected, got); diff != "" {
+			t.Errorf("%s: value mismatch (-want +got):\n%s", testCase.Name, diff)
+		}
+	}
+}
+
+func TestTimeVars_Interpolate(t *testing.T) {
+	env := &esiexpr.Env{
+		LookupVar: esiexpr.TimeVars(func(context.Context) time.Time {
+			return time.Unix(0, 0)
+		}, nil),
+	}
+
+	got, err := env.Interpolate(t.Context(), "$(DATE_GMT) $(DATE_GMT{unix}) $(UNKNOWN|'default')")
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	if want := "Thu, 01 Jan 1970 00:00:00 GMT 0 default"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
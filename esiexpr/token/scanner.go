@@ -51,6 +51,8 @@ func (s *Scanner[T]) Next() (Token, error) {
 		tok, err = s.scan('|', TypeOr)
 	case '&':
 		tok, err = s.scan('&', TypeAnd)
+	case ',':
+		tok, err = s.scan(',', TypeComma)
 	case '=':
 		tok, err = s.scanEquals()
 	case '>':
@@ -60,7 +62,7 @@ func (s *Scanner[T]) Next() (Token, error) {
 	case '!':
 		tok, err = s.scanNotEqualsOrUnaryNegation()
 	case '\'':
-		tok, err = s.scanQuotedString()
+		tok, err = s.scanQuotedOrRawString()
 	default:
 		tok, err = s.scanString()
 	}
@@ -149,12 +151,51 @@ func (s *Scanner[T]) scanNotEqualsOrUnaryNegation() (Token, error) {
 	return Token{Type: TypeNegation}, nil
 }
 
+func (s *Scanner[T]) scanQuotedOrRawString() (Token, error) {
+	_ = s.in.Consume('\'')
+
+	if !s.in.Consume('\'') {
+		s.in.Unread()
+		return s.scanQuotedString()
+	}
+
+	if !s.in.Consume('\'') {
+		// Empty quoted string
+		return Token{Type: TypeQuotedString}, nil
+	}
+
+	for {
+		s.in.SkipWhile(func(c byte) bool {
+			return c != '\''
+		})
+
+		if err := s.in.ConsumeOrError('\''); err != nil {
+			return Token{Type: TypeInvalid}, err
+		}
+
+		if s.in.Consume('\'') && s.in.Consume('\'') {
+			return Token{Type: TypeRawString}, nil
+		}
+	}
+}
+
 func (s *Scanner[T]) scanQuotedString() (Token, error) {
 	_ = s.in.Consume('\'')
 
-	s.in.SkipWhile(func(c byte) bool {
-		return c != '\''
-	})
+	for {
+		s.in.SkipWhile(func(c byte) bool {
+			return c != '\'' && c != '\\'
+		})
+
+		if !s.in.Consume('\\') {
+			break
+		}
+
+		// Skip the escaped character. Validation of the escape sequence is left to the caller.
+		if c, ok := s.in.Peek(); ok {
+			_ = s.in.Consume(c)
+		}
+	}
 
 	if err := s.in.ConsumeOrError('\''); err != nil {
 		return Token{Type: TypeInvalid}, err
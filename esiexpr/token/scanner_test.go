@@ -141,6 +141,25 @@ func TestScanner(t *testing.T) {
 				{Position: pos(0, 2), Type: token.TypeLessThanEqual},
 			},
 		},
+		{
+			Name:  "comma",
+			Input: `,`,
+			Token: []token.Token{
+				{Position: pos(0, 1), Type: token.TypeComma},
+			},
+		},
+		{
+			Name:  "function call",
+			Input: `$time('a', 1)`,
+			Token: []token.Token{
+				{Position: pos(0, 5), Type: token.TypeSimpleString},
+				{Position: pos(5, 6), Type: token.TypeOpeningParenthesis},
+				{Position: pos(6, 9), Type: token.TypeQuotedString},
+				{Position: pos(9, 10), Type: token.TypeComma},
+				{Position: pos(11, 12), Type: token.TypeSimpleString},
+				{Position: pos(12, 13), Type: token.TypeClosingParenthesis},
+			},
+		},
 		{
 			Name:  "integer",
 			Input: `1234`,
@@ -225,6 +244,53 @@ func TestScanner(t *testing.T) {
 				{Position: pos(0, 15), Type: token.TypeQuotedString},
 			},
 		},
+		{
+			Name:  "quoted string with escaped quotes",
+			Input: `'quoted \'string\''`,
+			Token: []token.Token{
+				{Position: pos(0, 19), Type: token.TypeQuotedString},
+			},
+		},
+		{
+			Name:  "quoted string with escaped backslash",
+			Input: `'quoted \\' string`,
+			Token: []token.Token{
+				{Position: pos(0, 11), Type: token.TypeQuotedString},
+				{Position: pos(12, 18), Type: token.TypeSimpleString},
+			},
+		},
+		{
+			Name:  "quoted string ending in backslash",
+			Input: `'quoted\`,
+			Error: &text.UnexpectedEndOfInput{At: 8, Expected: '\''},
+		},
+		{
+			Name:  "empty quoted string",
+			Input: `'' ''`,
+			Token: []token.Token{
+				{Position: pos(0, 2), Type: token.TypeQuotedString},
+				{Position: pos(3, 5), Type: token.TypeQuotedString},
+			},
+		},
+		{
+			Name:  "raw string",
+			Input: `'''raw 'string' \'''`,
+			Token: []token.Token{
+				{Position: pos(0, 20), Type: token.TypeRawString},
+			},
+		},
+		{
+			Name:  "empty raw string",
+			Input: `''''''`,
+			Token: []token.Token{
+				{Position: pos(0, 6), Type: token.TypeRawString},
+			},
+		},
+		{
+			Name:  "unterminated raw string",
+			Input: `'''raw''`,
+			Error: &text.UnexpectedEndOfInput{At: 8, Expected: '\''},
+		},
 		{
 			Name:  "variable",
 			Input: `$(VARIABLE{key}|default)`,
@@ -22,7 +22,8 @@ func (p Position) String() string {
 type Token struct {
 	// Position contains the start and end indices of the token.
 	//
-	// For tokens of type [TypeSimpleString] or [TypeQuotedString] this can be used to get the string from the input.
+	// For tokens of type [TypeSimpleString], [TypeQuotedString] or [TypeRawString] this can be used to get the string
+	// from the input.
 	Position Position
 
 	// Type describes the type of the token.
@@ -45,6 +46,8 @@ const (
 	TypeSimpleString
 
 	// TypeQuotedString represents a string quoted using single quotes.
+	//
+	// Inside the string a backslash can be used to escape the following character.
 	TypeQuotedString
 
 	// TypeDollarOpeningParenthesis represents the combination of $ and ( at the start of a variable.
@@ -88,6 +91,14 @@ const (
 
 	// TypeLessThanEqual represents the <= operator.
 	TypeLessThanEqual
+
+	// TypeComma represents a single , separating function arguments.
+	TypeComma
+
+	// TypeRawString represents a string quoted using three single quotes, e.g. '''raw'''.
+	//
+	// Raw strings do not support escape sequences.
+	TypeRawString
 )
 
 // String implements the [fmt.Stringer] interface.
@@ -127,6 +138,10 @@ func (t Type) String() string {
 		return "<"
 	case TypeLessThanEqual:
 		return "<="
+	case TypeComma:
+		return ","
+	case TypeRawString:
+		return "raw string"
 	default:
 		panic("invalid token type")
 	}
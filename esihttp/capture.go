@@ -0,0 +1,277 @@
+package esihttp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ResponseCapture is an [http.ResponseWriter] that captures the response of an [http.Handler], so that the body can be
+// processed before it is written to the underlying [http.ResponseWriter].
+//
+// Once the handler writes the final status code, either explicitly using WriteHeader or implicitly by writing the
+// body, ShouldCapture is called to decide whether the response is captured. Responses that are not captured are
+// passed through to the underlying writer as is.
+//
+// For captured responses, the status code and header are held back and the body is written into the buffer, until
+// [ResponseCapture.Finish] is called. Informational (1xx) responses, for example 103 Early Hints, are always written
+// immediately. Changes to the header after the final status code was written are ignored, except for trailers.
+//
+// Trailers, declared using the "Trailer" header or set using the [http.TrailerPrefix], are passed to the underlying
+// writer by [ResponseCapture.Finish], both for captured and not captured responses.
+//
+// ResponseCapture supports [http.Flusher], [http.Hijacker] and [http.Pusher] if the underlying writer does, and can
+// be used with [http.ResponseController]. Flushing a captured response does nothing.
+type ResponseCapture struct {
+	// ShouldCapture is called with the final status code and header of the response and returns true if the
+	// response should be captured.
+	//
+	// If nil, all responses are captured.
+	ShouldCapture func(status int, header http.Header) bool
+
+	// MaxBodySize is the maximum size in bytes of captured bodies.
+	//
+	// If a captured body grows larger than MaxBodySize, the response is no longer captured. The held back status
+	// code, header and data are written to the underlying writer and all further data is passed through.
+	//
+	// If MaxBodySize is <= 0, the body size is not limited.
+	MaxBodySize int64
+
+	w   http.ResponseWriter
+	buf *bytes.Buffer
+
+	header      http.Header
+	finalHeader http.Header
+	status      int
+
+	captured  bool
+	committed bool
+	finished  bool
+	hijacked  bool
+}
+
+var (
+	_ http.Flusher  = (*ResponseCapture)(nil)
+	_ http.Hijacker = (*ResponseCapture)(nil)
+	_ http.Pusher   = (*ResponseCapture)(nil)
+)
+
+// NewResponseCapture returns a new [ResponseCapture] that writes to w and captures the body into buf.
+func NewResponseCapture(w http.ResponseWriter, buf *bytes.Buffer) *ResponseCapture {
+	return &ResponseCapture{w: w, buf: buf, header: make(http.Header)}
+}
+
+// Body returns the captured body.
+func (c *ResponseCapture) Body() []byte {
+	return c.buf.Bytes()
+}
+
+// Captured returns true if the response is captured.
+//
+// Captured returns false until the final status code was written.
+func (c *ResponseCapture) Captured() bool {
+	return c.captured
+}
+
+// Finish finishes the response.
+//
+// For captured responses, Finish writes the held back status code and header and calls process with the
+// underlying writer and the captured body. Since the processed body usually has a different length, the
+// Content-Length header is removed. If process is nil, the captured body is written as is.
+//
+// If the handler did not write any status code or data, the response is handled as an empty response with status
+// 200 OK, as done by [http.Server].
+//
+// Afterward, the trailers set by the handler are passed to the underlying writer.
+//
+// Finish must be called once, after the handler returned. If the connection was hijacked, Finish does nothing.
+func (c *ResponseCapture) Finish(process func(w io.Writer, body []byte) error) error {
+	if c.hijacked || c.finished {
+		return nil
+	}
+
+	c.finished = true
+
+	if c.status == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+
+	if c.captured {
+		c.finalHeader.Del("Content-Length")
+		c.commit()
+
+		if process == nil {
+			if _, err := c.w.Write(c.buf.Bytes()); err != nil {
+				return err
+			}
+		} else if err := process(c.w, c.buf.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	c.copyTrailers()
+
+	return nil
+}
+
+// Flush implements the [http.Flusher] interface.
+//
+// For captured responses Flush does nothing.
+func (c *ResponseCapture) Flush() {
+	_ = c.FlushError()
+}
+
+// FlushError flushes buffered data to the client, like [http.ResponseController.Flush].
+//
+// For captured responses FlushError does nothing and returns nil.
+func (c *ResponseCapture) FlushError() error {
+	if c.status == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+
+	if c.captured {
+		return nil
+	}
+
+	return http.NewResponseController(c.w).Flush()
+}
+
+// Header implements the [http.ResponseWriter] interface.
+func (c *ResponseCapture) Header() http.Header {
+	return c.header
+}
+
+// Hijack implements the [http.Hijacker] interface.
+//
+// After hijacking the connection, the response is no longer captured.
+func (c *ResponseCapture) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(c.w).Hijack()
+	if err == nil {
+		c.hijacked = true
+	}
+
+	return conn, rw, err
+}
+
+// Push implements the [http.Pusher] interface.
+//
+// If the underlying writer does not implement [http.Pusher], Push returns [http.ErrNotSupported].
+func (c *ResponseCapture) Push(target string, opts *http.PushOptions) error {
+	pusher, ok := c.w.(http.Pusher)
+	if !ok {
+		return http.ErrNotSupported
+	}
+
+	return pusher.Push(target, opts)
+}
+
+// StatusCode returns the final status code written by the handler or 0 if no final status code was written yet.
+func (c *ResponseCapture) StatusCode() int {
+	return c.status
+}
+
+// Unwrap returns the underlying [http.ResponseWriter].
+//
+// This is used by [http.ResponseController].
+func (c *ResponseCapture) Unwrap() http.ResponseWriter {
+	return c.w
+}
+
+// Write implements the [http.ResponseWriter] interface.
+func (c *ResponseCapture) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+
+	if !c.captured {
+		return c.w.Write(b)
+	}
+
+	if c.MaxBodySize > 0 && int64(c.buf.Len()+len(b)) > c.MaxBodySize {
+		if err := c.release(); err != nil {
+			return 0, err
+		}
+
+		return c.w.Write(b)
+	}
+
+	return c.buf.Write(b)
+}
+
+// WriteHeader implements the [http.ResponseWriter] interface.
+func (c *ResponseCapture) WriteHeader(statusCode int) {
+	if c.status != 0 || c.hijacked {
+		return
+	}
+
+	// Informational responses are written immediately, except for 101 Switching Protocols which is a final response.
+	if statusCode >= 100 && statusCode < 200 && statusCode != http.StatusSwitchingProtocols {
+		replaceHeader(c.w.Header(), c.header)
+		c.w.WriteHeader(statusCode)
+		return
+	}
+
+	c.status = statusCode
+	c.finalHeader = c.header.Clone()
+	c.captured = c.ShouldCapture == nil || c.ShouldCapture(statusCode, c.finalHeader)
+
+	if !c.captured {
+		c.commit()
+	}
+}
+
+// commit writes the status code and final header to the underlying writer.
+func (c *ResponseCapture) commit() {
+	if c.committed {
+		return
+	}
+
+	c.committed = true
+
+	replaceHeader(c.w.Header(), c.finalHeader)
+	c.w.WriteHeader(c.status)
+}
+
+// copyTrailers copies all trailers from the header used by the handler to the header of the underlying writer.
+func (c *ResponseCapture) copyTrailers() {
+	dst := c.w.Header()
+
+	for _, declared := range c.finalHeader.Values("Trailer") {
+		for name := range strings.SplitSeq(declared, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+
+			if values, ok := c.header[name]; ok {
+				dst[name] = values
+			}
+		}
+	}
+
+	for name, values := range c.header {
+		if strings.HasPrefix(name, http.TrailerPrefix) {
+			dst[name] = values
+		}
+	}
+}
+
+// release stops capturing the response and writes the held back status code, header and data.
+func (c *ResponseCapture) release() error {
+	c.captured = false
+	c.commit()
+
+	_, err := c.w.Write(c.buf.Bytes())
+	c.buf.Reset()
+
+	return err
+}
+
+// replaceHeader replaces all values in dst with the values from src.
+func replaceHeader(dst, src http.Header) {
+	clear(dst)
+
+	for name, values := range src {
+		dst[name] = values
+	}
+}
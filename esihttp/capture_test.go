@@ -0,0 +1,212 @@
+package esihttp_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/nussjustin/esi/esihttp"
+)
+
+func TestResponseCapture(t *testing.T) {
+	testCases := []struct {
+		Name          string
+		ShouldCapture func(status int, header http.Header) bool
+		MaxBodySize   int64
+		Handler       http.HandlerFunc
+
+		ExpectedStatus   int
+		ExpectedCaptured bool
+		ExpectedBody     string
+		ExpectedHeader   http.Header
+	}{
+		{
+			Name: "captured",
+			Handler: func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Length", "5")
+				w.Header().Set("X-Test", "value")
+				w.WriteHeader(http.StatusNotFound)
+				w.Header().Set("X-Ignored", "value")
+				_, _ = io.WriteString(w, "hello")
+			},
+			ExpectedStatus:   http.StatusNotFound,
+			ExpectedCaptured: true,
+			ExpectedBody:     "HELLO",
+			ExpectedHeader:   http.Header{"X-Test": {"value"}},
+		},
+		{
+			Name: "implicit status",
+			Handler: func(w http.ResponseWriter, _ *http.Request) {
+				_, _ = io.WriteString(w, "hello")
+			},
+			ExpectedStatus:   http.StatusOK,
+			ExpectedCaptured: true,
+			ExpectedBody:     "HELLO",
+			ExpectedHeader:   http.Header{},
+		},
+		{
+			Name:             "empty response",
+			Handler:          func(http.ResponseWriter, *http.Request) {},
+			ExpectedStatus:   http.StatusOK,
+			ExpectedCaptured: true,
+			ExpectedHeader:   http.Header{},
+		},
+		{
+			Name: "not captured",
+			ShouldCapture: func(status int, _ http.Header) bool {
+				return status == http.StatusOK
+			},
+			Handler: func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Length", "5")
+				w.WriteHeader(http.StatusNotFound)
+				_, _ = io.WriteString(w, "hello")
+			},
+			ExpectedStatus:   http.StatusNotFound,
+			ExpectedCaptured: false,
+			ExpectedBody:     "hello",
+			ExpectedHeader:   http.Header{"Content-Length": {"5"}},
+		},
+		{
+			Name:        "body too large",
+			MaxBodySize: 8,
+			Handler: func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Length", "10")
+				_, _ = io.WriteString(w, "hello")
+				_, _ = io.WriteString(w, "world")
+			},
+			ExpectedStatus:   http.StatusOK,
+			ExpectedCaptured: false,
+			ExpectedBody:     "helloworld",
+			ExpectedHeader:   http.Header{"Content-Length": {"10"}},
+		},
+		{
+			Name: "trailers",
+			Handler: func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Trailer", "X-Checksum, X-Missing")
+				_, _ = io.WriteString(w, "hello")
+				w.Header().Set("X-Checksum", "abc")
+				w.Header().Set(http.TrailerPrefix+"X-Other", "def")
+			},
+			ExpectedStatus:   http.StatusOK,
+			ExpectedCaptured: true,
+			ExpectedBody:     "HELLO",
+			ExpectedHeader: http.Header{
+				"Trailer":                      {"X-Checksum, X-Missing"},
+				"X-Checksum":                   {"abc"},
+				http.TrailerPrefix + "X-Other": {"def"},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+
+			c := esihttp.NewResponseCapture(rec, &bytes.Buffer{})
+			c.ShouldCapture = testCase.ShouldCapture
+			c.MaxBodySize = testCase.MaxBodySize
+
+			testCase.Handler(c, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			err := c.Finish(func(w io.Writer, body []byte) error {
+				_, err := w.Write(bytes.ToUpper(body))
+				return err
+			})
+			if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+
+			if got, want := c.Captured(), testCase.ExpectedCaptured; got != want {
+				t.Errorf("got captured %t, want %t", got, want)
+			}
+
+			if got, want := c.StatusCode(), testCase.ExpectedStatus; got != want {
+				t.Errorf("got status %d, want %d", got, want)
+			}
+
+			if got, want := rec.Code, testCase.ExpectedStatus; got != want {
+				t.Errorf("got written status %d, want %d", got, want)
+			}
+
+			if diff := cmp.Diff(testCase.ExpectedBody, rec.Body.String()); diff != "" {
+				t.Errorf("body mismatch (-want +got):\n%s", diff)
+			}
+
+			if diff := cmp.Diff(testCase.ExpectedHeader, rec.Header()); diff != "" {
+				t.Errorf("header mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestResponseCapture_Server(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		c := esihttp.NewResponseCapture(w, &bytes.Buffer{})
+
+		c.Header().Set("Link", "</style.css>; rel=preload")
+		c.WriteHeader(http.StatusEarlyHints)
+
+		c.Header().Set("Content-Type", "text/html")
+		c.Header().Set("Trailer", "X-Checksum")
+		c.WriteHeader(http.StatusCreated)
+
+		_, _ = io.WriteString(c, "hello")
+		c.Flush()
+
+		c.Header().Set("X-Checksum", "abc")
+
+		_ = c.Finish(func(w io.Writer, body []byte) error {
+			_, err := w.Write(bytes.ToUpper(body))
+			return err
+		})
+	}))
+	t.Cleanup(srv.Close)
+
+	var informational []int
+
+	ctx := httptrace.WithClientTrace(context.Background(), &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, _ textproto.MIMEHeader) error {
+			informational = append(informational, code)
+			return nil
+		},
+	})
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatalf("failed to send request: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read body: %v", err)
+	}
+
+	if diff := cmp.Diff([]int{http.StatusEarlyHints}, informational); diff != "" {
+		t.Errorf("informational responses mismatch (-want +got):\n%s", diff)
+	}
+
+	if got, want := resp.StatusCode, http.StatusCreated; got != want {
+		t.Errorf("got status %d, want %d", got, want)
+	}
+
+	if got, want := string(body), "HELLO"; got != want {
+		t.Errorf("got body %q, want %q", got, want)
+	}
+
+	if got, want := resp.Trailer.Get("X-Checksum"), "abc"; got != want {
+		t.Errorf("got trailer %q, want %q", got, want)
+	}
+}
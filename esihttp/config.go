@@ -0,0 +1,278 @@
+package esihttp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/nussjustin/esi/esiproc"
+)
+
+// ClientConfig contains the settings of a [Client] that can be loaded from configuration files.
+//
+// The zero value uses the defaults of [http.DefaultTransport], without a timeout for the whole request. Settings that
+// can not be represented as data, like [Client.BeforeRequest] or [Client.Signer], can be set on the returned [Client]:
+//
+//	var cfg esihttp.ClientConfig
+//
+//	if err := json.Unmarshal(data, &cfg); err != nil {
+//		return err
+//	}
+//
+//	client, err := cfg.Client()
+//	if err != nil {
+//		return err
+//	}
+//
+//	client.Signer = signer
+//
+// Invalid values are reported using [*esiproc.ConfigError].
+type ClientConfig struct {
+	// AcceptEncoding is the value for [Client.AcceptEncoding].
+	AcceptEncoding string `json:"accept_encoding,omitempty" yaml:"accept_encoding,omitempty"`
+
+	// DialTimeout is the maximum time for establishing a connection.
+	//
+	// If 0, the default of [http.DefaultTransport] is used.
+	DialTimeout esiproc.Duration `json:"dial_timeout,omitempty" yaml:"dial_timeout,omitempty"`
+
+	// HeaderTimeout is the maximum time to wait for the response headers after sending the request. It is the value
+	// for [http.Transport.ResponseHeaderTimeout].
+	//
+	// If 0, there is no timeout.
+	HeaderTimeout esiproc.Duration `json:"header_timeout,omitempty" yaml:"header_timeout,omitempty"`
+
+	// IdleConnTimeout is the value for [http.Transport.IdleConnTimeout].
+	//
+	// If 0, the default of [http.DefaultTransport] is used.
+	IdleConnTimeout esiproc.Duration `json:"idle_conn_timeout,omitempty" yaml:"idle_conn_timeout,omitempty"`
+
+	// Origins maps host names to the origins used for connecting to them. See [NewOriginTransport] for the format of
+	// the keys.
+	Origins map[string]OriginConfig `json:"origins,omitempty" yaml:"origins,omitempty"`
+
+	// Timeout is the value for [http.Client.Timeout] and limits the time for the whole request, including reading
+	// the response body.
+	//
+	// If 0, there is no timeout.
+	Timeout esiproc.Duration `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+
+	// TLS configures HTTPS connections to hosts without a custom [OriginConfig.TLS].
+	//
+	// If nil, the defaults of the [crypto/tls] package are used.
+	TLS *TLSConfig `json:"tls,omitempty" yaml:"tls,omitempty"`
+
+	// TLSHandshakeTimeout is the value for [http.Transport.TLSHandshakeTimeout].
+	//
+	// If 0, the default of [http.DefaultTransport] is used.
+	TLSHandshakeTimeout esiproc.Duration `json:"tls_handshake_timeout,omitempty" yaml:"tls_handshake_timeout,omitempty"`
+}
+
+// OriginConfig contains the settings of an [Origin] that can be loaded from configuration files.
+type OriginConfig struct {
+	// Network is the value for [Origin.Network].
+	Network string `json:"network,omitempty" yaml:"network,omitempty"`
+
+	// Address is the value for [Origin.Address].
+	Address string `json:"address,omitempty" yaml:"address,omitempty"`
+
+	// TLS configures HTTPS connections to the origin.
+	//
+	// If nil, [ClientConfig.TLS] is used.
+	TLS *TLSConfig `json:"tls,omitempty" yaml:"tls,omitempty"`
+}
+
+// TLSConfig contains the settings of a [tls.Config] that can be loaded from configuration files.
+type TLSConfig struct {
+	// CAFile is the path to a file with PEM encoded certificates used to verify server certificates.
+	//
+	// If empty, the system roots are used.
+	CAFile string `json:"ca_file,omitempty" yaml:"ca_file,omitempty"`
+
+	// CertFile is the path to a file with a PEM encoded client certificate. Requires KeyFile.
+	CertFile string `json:"cert_file,omitempty" yaml:"cert_file,omitempty"`
+
+	// KeyFile is the path to a file with the PEM encoded private key for CertFile. Requires CertFile.
+	KeyFile string `json:"key_file,omitempty" yaml:"key_file,omitempty"`
+
+	// MinVersion is the minimum TLS version, one of "1.2" or "1.3".
+	//
+	// If empty, the default of the [crypto/tls] package is used.
+	MinVersion string `json:"min_version,omitempty" yaml:"min_version,omitempty"`
+
+	// ServerName is used to verify the host name of server certificates.
+	//
+	// If empty, the host name from the request is used.
+	ServerName string `json:"server_name,omitempty" yaml:"server_name,omitempty"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Client validates the configuration and returns a new [Client] that uses it.
+//
+// If the configuration is invalid, the error returned by [ClientConfig.Validate] is returned. Errors reading the
+// files referenced by a [TLSConfig] are returned as [*esiproc.ConfigError] for the corresponding field.
+func (c *ClientConfig) Client() (*Client, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	base := http.DefaultTransport.(*http.Transport).Clone()
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if c.DialTimeout > 0 {
+		dialer.Timeout = time.Duration(c.DialTimeout)
+	}
+
+	base.DialContext = dialer.DialContext
+
+	base.ResponseHeaderTimeout = time.Duration(c.HeaderTimeout)
+
+	if c.IdleConnTimeout > 0 {
+		base.IdleConnTimeout = time.Duration(c.IdleConnTimeout)
+	}
+
+	if c.TLSHandshakeTimeout > 0 {
+		base.TLSHandshakeTimeout = time.Duration(c.TLSHandshakeTimeout)
+	}
+
+	if c.TLS != nil {
+		tlsConfig, err := c.TLS.config("TLS")
+		if err != nil {
+			return nil, err
+		}
+
+		base.TLSClientConfig = tlsConfig
+	}
+
+	var transport http.RoundTripper = base
+
+	if len(c.Origins) > 0 {
+		origins := make(map[string]Origin, len(c.Origins))
+
+		for key, oc := range c.Origins {
+			// Use the same dialer so that DialTimeout also applies to origins.
+			o := Origin{Network: oc.Network, Address: oc.Address, DialContext: dialer.DialContext}
+
+			if oc.TLS != nil {
+				tlsConfig, err := oc.TLS.config("Origins[" + key + "].TLS")
+				if err != nil {
+					return nil, err
+				}
+
+				o.TLSConfig = tlsConfig
+			}
+
+			origins[key] = o
+		}
+
+		transport = NewOriginTransport(base, origins)
+	}
+
+	return &Client{
+		HTTPClient:     &http.Client{Transport: transport, Timeout: time.Duration(c.Timeout)},
+		AcceptEncoding: c.AcceptEncoding,
+	}, nil
+}
+
+// Validate checks the configuration for invalid values.
+//
+// The returned error contains a [*esiproc.ConfigError] for each invalid field. Files referenced by a [TLSConfig] are
+// not read.
+func (c *ClientConfig) Validate() error {
+	var errs []error
+
+	checkNotNegative := func(field string, d esiproc.Duration) {
+		if d < 0 {
+			errs = append(errs, &esiproc.ConfigError{Field: field, Message: "must not be negative"})
+		}
+	}
+
+	checkNotNegative("DialTimeout", c.DialTimeout)
+	checkNotNegative("HeaderTimeout", c.HeaderTimeout)
+	checkNotNegative("IdleConnTimeout", c.IdleConnTimeout)
+
+	for _, key := range slices.Sorted(maps.Keys(c.Origins)) {
+		oc := c.Origins[key]
+
+		if key == "" {
+			errs = append(errs, &esiproc.ConfigError{Field: "Origins", Message: "keys must not be empty"})
+		}
+
+		if oc.TLS != nil {
+			errs = append(errs, oc.TLS.validate("Origins["+key+"].TLS")...)
+		}
+	}
+
+	checkNotNegative("Timeout", c.Timeout)
+
+	if c.TLS != nil {
+		errs = append(errs, c.TLS.validate("TLS")...)
+	}
+
+	checkNotNegative("TLSHandshakeTimeout", c.TLSHandshakeTimeout)
+
+	return errors.Join(errs...)
+}
+
+func (c *TLSConfig) validate(prefix string) []error {
+	var errs []error
+
+	if c.CertFile == "" && c.KeyFile != "" {
+		errs = append(errs, &esiproc.ConfigError{Field: prefix + ".CertFile", Message: "must be set if KeyFile is set"})
+	}
+
+	if c.CertFile != "" && c.KeyFile == "" {
+		errs = append(errs, &esiproc.ConfigError{Field: prefix + ".KeyFile", Message: "must be set if CertFile is set"})
+	}
+
+	if _, ok := tlsVersions[c.MinVersion]; c.MinVersion != "" && !ok {
+		errs = append(errs, &esiproc.ConfigError{
+			Field:   prefix + ".MinVersion",
+			Message: fmt.Sprintf("unknown version %q", c.MinVersion),
+		})
+	}
+
+	return errs
+}
+
+func (c *TLSConfig) config(prefix string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tlsVersions[c.MinVersion],
+		ServerName: c.ServerName,
+	}
+
+	if c.CAFile != "" {
+		data, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, &esiproc.ConfigError{Field: prefix + ".CAFile", Message: err.Error()}
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(data) {
+			return nil, &esiproc.ConfigError{Field: prefix + ".CAFile", Message: "no certificates found"}
+		}
+	}
+
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, &esiproc.ConfigError{Field: prefix + ".CertFile", Message: err.Error()}
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
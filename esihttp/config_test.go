@@ -0,0 +1,166 @@
+package esihttp_test
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/nussjustin/esi/esihttp"
+	"github.com/nussjustin/esi/esiproc"
+)
+
+func TestClientConfig_JSON(t *testing.T) {
+	const input = `{
+		"accept_encoding": "identity",
+		"dial_timeout": "1s",
+		"header_timeout": "2s",
+		"origins": {
+			"cart": {"network": "unix", "address": "/run/cart.sock"},
+			"search:8443": {"tls": {"ca_file": "/etc/ca.pem", "server_name": "search.internal"}}
+		},
+		"timeout": "5s",
+		"tls": {"cert_file": "/etc/client.pem", "key_file": "/etc/client.key", "min_version": "1.3"}
+	}`
+
+	var got esihttp.ClientConfig
+
+	if err := json.Unmarshal([]byte(input), &got); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	want := esihttp.ClientConfig{
+		AcceptEncoding: "identity",
+		DialTimeout:    esiproc.Duration(time.Second),
+		HeaderTimeout:  esiproc.Duration(2 * time.Second),
+		Origins: map[string]esihttp.OriginConfig{
+			"cart":        {Network: "unix", Address: "/run/cart.sock"},
+			"search:8443": {TLS: &esihttp.TLSConfig{CAFile: "/etc/ca.pem", ServerName: "search.internal"}},
+		},
+		Timeout: esiproc.Duration(5 * time.Second),
+		TLS:     &esihttp.TLSConfig{CertFile: "/etc/client.pem", KeyFile: "/etc/client.key", MinVersion: "1.3"},
+	}
+
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("config mismatch (-want +got):\n%s", diff)
+	}
+
+	if err := got.Validate(); err != nil {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestClientConfig_Validate(t *testing.T) {
+	cfg := esihttp.ClientConfig{
+		DialTimeout: esiproc.Duration(-time.Second),
+		Origins: map[string]esihttp.OriginConfig{
+			"":     {},
+			"cart": {TLS: &esihttp.TLSConfig{CertFile: "/etc/client.pem"}},
+		},
+		Timeout: esiproc.Duration(-time.Second),
+		TLS:     &esihttp.TLSConfig{KeyFile: "/etc/client.key", MinVersion: "1.0"},
+	}
+
+	var fields []string
+
+	for _, err := range cfg.Validate().(interface{ Unwrap() []error }).Unwrap() {
+		var configErr *esiproc.ConfigError
+
+		if errors.As(err, &configErr) {
+			fields = append(fields, configErr.Field)
+		}
+	}
+
+	want := []string{
+		"DialTimeout",
+		"Origins",
+		"Origins[cart].TLS.KeyFile",
+		"Timeout",
+		"TLS.CertFile",
+		"TLS.MinVersion",
+	}
+
+	if diff := cmp.Diff(want, fields); diff != "" {
+		t.Errorf("invalid fields mismatch (-want +got):\n%s", diff)
+	}
+
+	if _, err := cfg.Client(); err == nil {
+		t.Errorf("Client: got nil error for invalid config")
+	}
+
+	if err := (&esihttp.ClientConfig{}).Validate(); err != nil {
+		t.Errorf("got error %v for zero config", err)
+	}
+}
+
+func TestClientConfig_Client(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Header.Get("Accept-Encoding") + " " + r.Host + r.URL.Path))
+	}))
+	defer srv.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+
+	caData := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+
+	if err := os.WriteFile(caFile, caData, 0o600); err != nil {
+		t.Fatalf("failed to write CA file: %s", err)
+	}
+
+	cfg := esihttp.ClientConfig{
+		AcceptEncoding: "identity",
+		Origins: map[string]esihttp.OriginConfig{
+			"backend": {
+				Address: srv.Listener.Addr().String(),
+				TLS:     &esihttp.TLSConfig{CAFile: caFile, ServerName: "example.com"},
+			},
+		},
+		Timeout: esiproc.Duration(5 * time.Second),
+		TLS:     &esihttp.TLSConfig{CAFile: caFile, MinVersion: "1.2"},
+	}
+
+	client, err := cfg.Client()
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	if got, want := client.HTTPClient.(*http.Client).Timeout, 5*time.Second; got != want {
+		t.Errorf("got timeout %s, want %s", got, want)
+	}
+
+	testCases := []struct {
+		URL      string
+		Expected string
+	}{
+		{URL: "https://backend/fragment", Expected: "identity backend/fragment"},
+		{URL: srv.URL + "/fragment", Expected: "identity " + srv.Listener.Addr().String() + "/fragment"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.URL, func(t *testing.T) {
+			got, err := client.Do(t.Context(), testCase.URL, nil)
+			if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+
+			if string(got) != testCase.Expected {
+				t.Errorf("got %q, want %q", got, testCase.Expected)
+			}
+		})
+	}
+
+	cfg.TLS.CAFile = filepath.Join(t.TempDir(), "missing.pem")
+
+	var configErr *esiproc.ConfigError
+
+	if _, err := cfg.Client(); !errors.As(err, &configErr) || configErr.Field != "TLS.CAFile" {
+		t.Errorf("got error %v, want config error for TLS.CAFile", err)
+	}
+}
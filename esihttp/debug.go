@@ -0,0 +1,52 @@
+package esihttp
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+)
+
+// DefaultDebugHeader is the name of the request header used by [DebugEnabled] if no other header is configured.
+const DefaultDebugHeader = "X-Esi-Debug"
+
+// DebugEnabled returns a function for use with [github.com/nussjustin/esi/esiproc.WithDebugComments] that enables
+// debug comments for requests containing the given header with the given secret as value.
+//
+// The request is taken from the context (see [WithOriginalRequest]). See [DebugRequested] for details.
+//
+// If header is empty, [DefaultDebugHeader] is used.
+//
+// If secret is empty, DebugEnabled panics.
+func DebugEnabled(header, secret string) func(ctx context.Context) bool {
+	if secret == "" {
+		panic("DebugEnabled called with empty secret")
+	}
+
+	return func(ctx context.Context) bool {
+		r := OriginalRequest(ctx)
+		return r != nil && DebugRequested(r, header, secret)
+	}
+}
+
+// DebugRequested returns true if the given request contains the given header with the given secret as value.
+//
+// The value is compared in constant time, so that the secret can not be guessed using timing attacks. Requests with
+// multiple values for the header are rejected.
+//
+// If header is empty, [DefaultDebugHeader] is used. If secret is empty, DebugRequested always returns false.
+func DebugRequested(r *http.Request, header, secret string) bool {
+	if secret == "" {
+		return false
+	}
+
+	if header == "" {
+		header = DefaultDebugHeader
+	}
+
+	values := r.Header.Values(header)
+	if len(values) != 1 {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(values[0]), []byte(secret)) == 1
+}
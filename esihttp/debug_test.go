@@ -0,0 +1,95 @@
+package esihttp_test
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nussjustin/esi/esihttp"
+)
+
+func TestDebugRequested(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Header   string
+		Values   []string
+		Secret   string
+		Expected bool
+	}{
+		{
+			Name:     "no header",
+			Secret:   "secret",
+			Expected: false,
+		},
+		{
+			Name:     "default header",
+			Values:   []string{"secret"},
+			Secret:   "secret",
+			Expected: true,
+		},
+		{
+			Name:     "custom header",
+			Header:   "X-Debug",
+			Values:   []string{"secret"},
+			Secret:   "secret",
+			Expected: true,
+		},
+		{
+			Name:     "wrong secret",
+			Values:   []string{"wrong"},
+			Secret:   "secret",
+			Expected: false,
+		},
+		{
+			Name:     "secret prefix",
+			Values:   []string{"secre"},
+			Secret:   "secret",
+			Expected: false,
+		},
+		{
+			Name:     "multiple values",
+			Values:   []string{"secret", "secret"},
+			Secret:   "secret",
+			Expected: false,
+		},
+		{
+			Name:     "empty secret",
+			Values:   []string{""},
+			Secret:   "",
+			Expected: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			header := testCase.Header
+			if header == "" {
+				header = esihttp.DefaultDebugHeader
+			}
+
+			r := httptest.NewRequest("GET", "/", nil)
+
+			for _, v := range testCase.Values {
+				r.Header.Add(header, v)
+			}
+
+			if got := esihttp.DebugRequested(r, testCase.Header, testCase.Secret); got != testCase.Expected {
+				t.Errorf("got %t, want %t", got, testCase.Expected)
+			}
+		})
+	}
+}
+
+func TestDebugEnabled(t *testing.T) {
+	enabled := esihttp.DebugEnabled("", "secret")
+
+	if enabled(t.Context()) {
+		t.Error("got true for context without request, want false")
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(esihttp.DefaultDebugHeader, "secret")
+
+	if !enabled(esihttp.WithOriginalRequest(t.Context(), r)) {
+		t.Error("got false for request with secret, want true")
+	}
+}
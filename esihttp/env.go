@@ -0,0 +1,85 @@
+package esihttp
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+
+	"github.com/nussjustin/esi"
+	"github.com/nussjustin/esi/esiexpr"
+	"github.com/nussjustin/esi/esiexpr/ast"
+)
+
+// EnvConfig configures the environment returned by [NewEnv].
+type EnvConfig struct {
+	// Cookies configures the handling of the HTTP_COOKIE variable. See [CookieVars] for details.
+	//
+	// If nil, the defaults are used.
+	Cookies *CookieVarsConfig
+
+	// Escaping specifies how values are escaped when interpolated. See [esiexpr.Env.Escaping].
+	Escaping esiexpr.Escaping
+
+	// LookupVar is called for all variables not defined by the ESI specification.
+	//
+	// If nil, the value of all other variables is nil.
+	LookupVar func(ctx context.Context, name string, key *string) (ast.Value, error)
+
+	// Profile restricts the expression syntax to the one supported by the profile.
+	//
+	// If the profile does not support extensions to the expression syntax (see
+	// [esi.CompatibilityProfile.ExpressionExtensions]), [esiexpr.Env.Strict] is set.
+	Profile esi.CompatibilityProfile
+}
+
+// NewEnv returns a new [esiexpr.Env] that provides the variables defined by the ESI specification based on the
+// original request associated with the context (see [WithOriginalRequest]).
+//
+// See [RequestVars] and [CookieVars] for the supported variables.
+//
+// The returned environment can compare ints, floats and strings with values of the same type. Missing values (nil)
+// compare less than all other values. Comparisons between other values fail.
+//
+// If config is nil, the defaults are used.
+func NewEnv(config *EnvConfig) *esiexpr.Env {
+	if config == nil {
+		config = &EnvConfig{}
+	}
+
+	return &esiexpr.Env{
+		CompareValues: compareValues,
+		LookupVar:     RequestVars(CookieVars(config.Cookies, config.LookupVar)),
+		Escaping:      config.Escaping,
+		Strict:        !config.Profile.ExpressionExtensions(),
+	}
+}
+
+// compareValues compares ints, floats and strings. Missing values (nil) compare less than all other values.
+func compareValues(a, b ast.Value) (int, error) {
+	switch av := a.(type) {
+	case nil:
+		if b == nil {
+			return 0, nil
+		}
+
+		return -1, nil
+	case int:
+		if bv, ok := b.(int); ok {
+			return cmp.Compare(av, bv), nil
+		}
+	case float64:
+		if bv, ok := b.(float64); ok {
+			return cmp.Compare(av, bv), nil
+		}
+	case string:
+		if bv, ok := b.(string); ok {
+			return cmp.Compare(av, bv), nil
+		}
+	}
+
+	if b == nil {
+		return 1, nil
+	}
+
+	return 0, fmt.Errorf("can not compare %T and %T", a, b)
+}
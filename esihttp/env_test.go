@@ -0,0 +1,194 @@
+package esihttp_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nussjustin/esi"
+	"github.com/nussjustin/esi/esiexpr"
+	"github.com/nussjustin/esi/esiexpr/ast"
+	"github.com/nussjustin/esi/esihttp"
+	"github.com/nussjustin/esi/esiproc"
+)
+
+func TestNewEnv(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/?page=2", nil)
+	r.Header.Set("Accept-Language", "de, en;q=0.5")
+	r.Header.Set("Cookie", "group=beta")
+	r.Header.Set("User-Agent", "Mozilla/4.0 (compatible; MSIE 6.0; Windows NT 5.1)")
+
+	env := esihttp.NewEnv(nil)
+
+	ctx := esihttp.WithOriginalRequest(t.Context(), r)
+
+	for expr, want := range map[string]bool{
+		"$(HTTP_ACCEPT_LANGUAGE{en})":           true,
+		"$(HTTP_COOKIE{group}) == 'beta'":       true,
+		"$(HTTP_COOKIE{missing}) < 'a'":         true,
+		"$(HTTP_HOST) == 'example.com'":         true,
+		"$(HTTP_USER_AGENT{browser}) == 'MSIE'": true,
+		"$(HTTP_USER_AGENT{os}) == 'WIN'":       true,
+		"$(QUERY_STRING{page}) == '2'":          true,
+		"$(QUERY_STRING{page}) == '3'":          false,
+	} {
+		got, err := env.Eval(ctx, expr)
+		if err != nil {
+			t.Fatalf("%s: got error %v", expr, err)
+		}
+
+		if got != want {
+			t.Errorf("%s: got %t, want %t", expr, got, want)
+		}
+	}
+
+	if _, err := env.Eval(ctx, "$(HTTP_HOST) == 1"); err == nil {
+		t.Error("got no error comparing string and int")
+	}
+}
+
+func TestNewEnv_Config(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/?q=a%26b", nil)
+
+	env := esihttp.NewEnv(&esihttp.EnvConfig{
+		Escaping: esiexpr.EscapingURL,
+		LookupVar: func(_ context.Context, name string, _ *string) (ast.Value, error) {
+			return "custom:" + name, nil
+		},
+	})
+
+	ctx := esihttp.WithOriginalRequest(t.Context(), r)
+
+	got, err := env.Interpolate(ctx, "/search?q=$(QUERY_STRING{q})&v=$(OTHER)")
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	if want := "/search?q=a%26b&v=custom%3AOTHER"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestCompatibilityProfile(t *testing.T) {
+	profiles := []esi.CompatibilityProfile{
+		esi.ProfileDefault,
+		esi.ProfileSpecStrict,
+		esi.ProfileAkamai,
+		esi.ProfileFastly,
+		esi.ProfileVarnish,
+	}
+
+	client := esiproc.ClientFunc(func(_ context.Context, urlStr string, _ map[string]string) ([]byte, error) {
+		if urlStr == "/error" {
+			return nil, errors.New("include failed")
+		}
+
+		return []byte(strings.TrimPrefix(urlStr, "/")), nil
+	})
+
+	process := func(profile esi.CompatibilityProfile, input string) string {
+		env := esihttp.NewEnv(&esihttp.EnvConfig{Profile: profile})
+
+		p := esiproc.New(
+			esiproc.WithClient(client),
+			esiproc.WithCompatibilityProfile(profile),
+			esiproc.WithEvalFunc(env.Eval),
+			esiproc.WithInterpolateFunc(env.Interpolate),
+		)
+
+		var buf strings.Builder
+
+		_, err := p.ProcessReader(t.Context(), &buf, strings.NewReader(input), esi.WithCompatibilityProfile(profile))
+		if err != nil {
+			return strings.TrimSpace("error " + esi.ErrorCode(err))
+		}
+
+		return buf.String()
+	}
+
+	// Expected results in the order of profiles.
+	testCases := []struct {
+		Name     string
+		Input    string
+		Expected [5]string
+	}{
+		{
+			Name:     "ESI comment",
+			Input:    `<!--esi a-->`,
+			Expected: [5]string{" a", " a", " a", " a", " a"},
+		},
+		{
+			Name:     "choose",
+			Input:    `<esi:choose><esi:when test="1 == 1">a</esi:when><esi:otherwise>b</esi:otherwise></esi:choose>`,
+			Expected: [5]string{"a", "a", "a", "ab", "ab"},
+		},
+		{
+			Name:  "expression extensions",
+			Input: `<esi:choose><esi:when test="'a\'b' == '''a'b'''">a</esi:when></esi:choose>`,
+			Expected: [5]string{
+				"a",
+				"error ast.syntax",
+				"a",
+				"a",
+				"a",
+			},
+		},
+		{
+			Name:  "include alt",
+			Input: `<esi:include src="/error" alt="/a"/>`,
+			Expected: [5]string{
+				"a",
+				"a",
+				"a",
+				"error",
+				"error",
+			},
+		},
+		{
+			Name:  "include in vars",
+			Input: `<esi:vars><esi:include src="/a"/></esi:vars>`,
+			Expected: [5]string{
+				"a",
+				"error esiproc.unexpected_element",
+				"a",
+				"a",
+				"a",
+			},
+		},
+		{
+			Name:  "invalid tag",
+			Input: `<esi:include src=/a/>`,
+			Expected: [5]string{
+				"error esixml.unexpected_character",
+				"error esixml.unexpected_character",
+				"error esixml.unexpected_character",
+				"<esi:include src=/a/>",
+				"<esi:include src=/a/>",
+			},
+		},
+		{
+			Name:  "namespaced attribute",
+			Input: `<esi:include src="/error" esi:onerror="continue"/>`,
+			Expected: [5]string{
+				"error",
+				"error esi.unexpected_attribute",
+				"",
+				"error",
+				"error",
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			for i, profile := range profiles {
+				if got, want := process(profile, testCase.Input), testCase.Expected[i]; got != want {
+					t.Errorf("%s: got %q, want %q", profile, got, want)
+				}
+			}
+		})
+	}
+}
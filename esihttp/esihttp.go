@@ -2,13 +2,23 @@
 package esihttp
 
 import (
+	"compress/gzip"
+	"compress/zlib"
 	"context"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"iter"
+	"math/rand/v2"
 	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
 
+	"github.com/nussjustin/esi"
 	"github.com/nussjustin/esi/esiproc"
+	"github.com/nussjustin/esi/internal/diag"
 )
 
 var cookieJarKey = new(int)
@@ -50,12 +60,90 @@ func WithOriginalResponse(ctx context.Context, origResp *http.Response) context.
 	return context.WithValue(ctx, origRespKey, origResp)
 }
 
+// ClientIP returns the IP address of the client that sent r.
+//
+// The address is taken from r.RemoteAddr. If the address is contained in any of the trusted proxy prefixes, the
+// X-Forwarded-For header is checked from right to left, skipping all addresses of trusted proxies, and the first
+// untrusted address is returned. If all addresses are trusted, the left-most address is returned.
+//
+// If r is nil or no valid address was found, the returned address is invalid.
+func ClientIP(r *http.Request, trustedProxies []netip.Prefix) netip.Addr {
+	if r == nil {
+		return netip.Addr{}
+	}
+
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}
+	}
+
+	addr := addrPort.Addr().Unmap()
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+
+	for i := len(forwarded) - 1; i >= 0 && isTrustedProxy(addr, trustedProxies); i-- {
+		next, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			break
+		}
+
+		addr = next.Unmap()
+	}
+
+	return addr
+}
+
+func isTrustedProxy(addr netip.Addr, trustedProxies []netip.Prefix) bool {
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SeedFromRequest returns a seed for use with [github.com/nussjustin/esi/esiexpr.WithRandSeed] that is derived from a
+// cookie or header of r.
+//
+// If r has a cookie with the given name, the seed is derived from the value of the cookie. Otherwise, if r has a
+// header with the given name, the seed is derived from the value of the header. If neither is set, a random seed is
+// returned. Empty names are ignored.
+//
+// Using for example a session cookie allows consistently assigning users to the same bucket across requests.
+func SeedFromRequest(r *http.Request, cookie, header string) uint64 {
+	var value string
+
+	if cookie != "" {
+		if c, err := r.Cookie(cookie); err == nil {
+			value = c.Value
+		}
+	}
+
+	if value == "" && header != "" {
+		value = r.Header.Get(header)
+	}
+
+	if value == "" {
+		return rand.Uint64() //nolint:gosec
+	}
+
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(value))
+	return h.Sum64()
+}
+
 // ClientError is returned by [Client.Do] when receiving a 4xx response and [Client.On4xx] is nil.
 type ClientError struct {
 	// StatusCode is the returned status code.
 	StatusCode int
 }
 
+// Code returns a machine-readable code identifying the type of the error.
+func (*ClientError) Code() string {
+	return "esihttp.client"
+}
+
 // Error returns a human-readable error message.
 func (e *ClientError) Error() string {
 	return fmt.Sprintf("unexpected status code: %d", e.StatusCode)
@@ -67,12 +155,22 @@ func (e *ClientError) Is(err error) bool {
 	return errors.As(err, &o) && *o == *e
 }
 
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (e *ClientError) MarshalJSON() ([]byte, error) {
+	return diag.Marshal(e, diag.Diagnostic{Details: map[string]any{"status_code": e.StatusCode}})
+}
+
 // ServerError is returned by [Client.Do] when receiving a 5xx response and [Client.On5xx] is nil.
 type ServerError struct {
 	// StatusCode is the returned status code.
 	StatusCode int
 }
 
+// Code returns a machine-readable code identifying the type of the error.
+func (*ServerError) Code() string {
+	return "esihttp.server"
+}
+
 // Error returns a human-readable error message.
 func (e *ServerError) Error() string {
 	return fmt.Sprintf("unexpected status code: %d", e.StatusCode)
@@ -84,6 +182,38 @@ func (e *ServerError) Is(err error) bool {
 	return errors.As(err, &o) && *o == *e
 }
 
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (e *ServerError) MarshalJSON() ([]byte, error) {
+	return diag.Marshal(e, diag.Diagnostic{Details: map[string]any{"status_code": e.StatusCode}})
+}
+
+// UnsupportedEncodingError is returned by [Client.Do] when receiving a response with an unsupported Content-Encoding.
+type UnsupportedEncodingError struct {
+	// Encoding is the unsupported content encoding.
+	Encoding string
+}
+
+// Code returns a machine-readable code identifying the type of the error.
+func (*UnsupportedEncodingError) Code() string {
+	return "esihttp.unsupported_encoding"
+}
+
+// Error returns a human-readable error message.
+func (e *UnsupportedEncodingError) Error() string {
+	return fmt.Sprintf("unsupported content encoding: %q", e.Encoding)
+}
+
+// Is returns true if the given error matches the receiver.
+func (e *UnsupportedEncodingError) Is(err error) bool {
+	var o *UnsupportedEncodingError
+	return errors.As(err, &o) && *o == *e
+}
+
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (e *UnsupportedEncodingError) MarshalJSON() ([]byte, error) {
+	return diag.Marshal(e, diag.Diagnostic{Got: e.Encoding})
+}
+
 // Client implements a [esiproc.Client] using HTTP to fetch data from URLs.
 //
 // See [Client.Do] for more information on how requests are configured.
@@ -92,14 +222,35 @@ type Client struct {
 	//
 	// The client should not have an associated cookie jar.
 	//
+	// To route requests for some hosts to other addresses, for example Unix domain sockets, use a transport created
+	// by [NewOriginTransport].
+	//
 	// If nil, [http.DefaultClient] is used.
 	HTTPClient HTTPClient
 
+	// AcceptEncoding is the value of the Accept-Encoding header sent with each request.
+	//
+	// If empty, no header is set and compression depends on HTTPClient. An [http.Transport] for example requests
+	// gzip compression and transparently decompresses the response, unless DisableCompression is set.
+	//
+	// If set, the header is set to the given value, which disables transparent decompression in [http.Transport].
+	// Use "identity" to request uncompressed responses, for example to avoid the overhead of decompressing fragments.
+	//
+	// Independent of this setting, responses that were not already decompressed by the transport are decompressed
+	// based on their Content-Encoding header. The encodings "gzip", "x-gzip" and "deflate" are supported. Other
+	// encodings result in an [UnsupportedEncodingError].
+	AcceptEncoding string
+
 	// BeforeRequest is called before sending the request and can be used to customize it.
 	//
 	// The extra map contains all extra attributes given to the <esi:include/> element.
 	BeforeRequest func(req *http.Request, extra map[string]string) error
 
+	// Signer is used to sign each request after calling BeforeRequest.
+	//
+	// If nil, requests are not signed.
+	Signer RequestSigner
+
 	// On4xx is called when receiving a request with a 4xx status code.
 	//
 	// Its return values are used as the return value for [Client.Do].
@@ -113,6 +264,22 @@ type Client struct {
 	//
 	// If nil, a 5xx response will result in an [ServerError].
 	On5xx func(resp *http.Response) ([]byte, error)
+
+	// OnFreshness is called with the freshness of each successfully fetched fragment, as returned by
+	// [ResponseFreshness]. It can be used to pass the lifetime of fragments to a cache.
+	//
+	// The current time for the calculation is taken from [esiproc.Now].
+	//
+	// See also [WithFreshnessRecorder].
+	OnFreshness func(ctx context.Context, f Freshness)
+
+	// Transformers maps media types to transformers for the body of successful responses with the matching
+	// Content-Type, for example to render JSON responses as HTML using [JSONTemplate].
+	//
+	// Keys must be lower case and can either be a full media type, like "application/json", or a type with a
+	// wildcard subtype, like "text/*". A transformer for the full media type takes precedence over one for the
+	// wildcard. Responses without a matching transformer are returned as is.
+	Transformers map[string]Transformer
 }
 
 // HTTPClient is the interface for types that can be used to executed requests.
@@ -131,6 +298,13 @@ var _ esiproc.Client = (*Client)(nil)
 //
 // Similarly, if the context has an associated cookie jar (see [WithCookieJar]), it will be used to add cookies to the
 // request. Note that cookies are only read from the jar, but not updated based on the response.
+//
+// If the context has an associated [FreshnessRecorder] (see [WithFreshnessRecorder]), the freshness of successful
+// responses is recorded in it.
+//
+// The body of successful responses is transformed based on their Content-Type using [Client.Transformers].
+//
+// The status code of each response is reported using [esiproc.ReportStatus].
 func (c *Client) Do(ctx context.Context, urlStr string, extra map[string]string) ([]byte, error) {
 	client := c.HTTPClient
 	if client == nil {
@@ -152,12 +326,22 @@ func (c *Client) Do(ctx context.Context, urlStr string, extra map[string]string)
 		}
 	}
 
+	if c.AcceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", c.AcceptEncoding)
+	}
+
 	if c.BeforeRequest != nil {
 		if err = c.BeforeRequest(req, extra); err != nil {
 			return nil, err
 		}
 	}
 
+	if c.Signer != nil {
+		if err = c.Signer.SignRequest(req); err != nil {
+			return nil, err
+		}
+	}
+
 	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
@@ -166,6 +350,8 @@ func (c *Client) Do(ctx context.Context, urlStr string, extra map[string]string)
 		_ = resp.Body.Close()
 	}()
 
+	esiproc.ReportStatus(ctx, resp.StatusCode)
+
 	switch {
 	case resp.StatusCode >= 400 && resp.StatusCode <= 499 && c.On4xx != nil:
 		return c.On4xx(resp)
@@ -177,5 +363,173 @@ func (c *Client) Do(ctx context.Context, urlStr string, extra map[string]string)
 		return nil, &ServerError{StatusCode: resp.StatusCode}
 	}
 
-	return io.ReadAll(resp.Body)
+	data, err := readBody(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	if t := c.transformerFor(resp); t != nil {
+		if data, err = t.Transform(ctx, resp, data); err != nil {
+			return nil, err
+		}
+	}
+
+	if rec := freshnessRecorder(ctx); rec != nil || c.OnFreshness != nil {
+		f := ResponseFreshness(resp, esiproc.Now(ctx))
+
+		if rec != nil {
+			rec.Record(f)
+		}
+
+		if c.OnFreshness != nil {
+			c.OnFreshness(ctx, f)
+		}
+	}
+
+	return data, nil
+}
+
+// readBody reads the body of resp, decompressing it based on the Content-Encoding header if necessary.
+func readBody(resp *http.Response) ([]byte, error) {
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+
+	if resp.Uncompressed {
+		encoding = ""
+	}
+
+	var r io.Reader
+
+	switch encoding {
+	case "", "identity":
+		r = resp.Body
+	case "gzip", "x-gzip":
+		gr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer func() { _ = gr.Close() }()
+
+		r = gr
+	case "deflate":
+		zr, err := zlib.NewReader(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer func() { _ = zr.Close() }()
+
+		r = zr
+	default:
+		return nil, &UnsupportedEncodingError{Encoding: encoding}
+	}
+
+	return io.ReadAll(r)
+}
+
+// WithEarlyHints returns a sequence that yields all nodes from nodes and sends an HTTP 103 (Early Hints) response to w
+// for each node that contains <esi:include> elements.
+//
+// Each response contains a "Link" header with rel=preload for every include discovered in the node. The headers are
+// removed from w again after sending the response, so that they are neither repeated in later responses nor sent with
+// the final response.
+//
+// Includes are only considered if they are processed unconditionally, that is includes inside <esi:choose>,
+// <esi:except>, <esi:inline> and <esi:remove> elements as well as XML comments are ignored. Includes with a source
+// containing variables are also ignored, since the final URL is not known before processing, as are sources with
+// other schemes than http and https, like data: URLs, which are not fetched by the client.
+//
+// Since informational responses must be sent before the final response header, w must not be written to while the
+// returned sequence is consumed. This is the case when processing into a buffer that is only written to w after
+// processing has finished.
+func WithEarlyHints(w http.ResponseWriter, nodes iter.Seq2[esi.Node, error]) iter.Seq2[esi.Node, error] {
+	return func(yield func(esi.Node, error) bool) {
+		for node, err := range nodes {
+			if err == nil {
+				sendEarlyHints(w, node)
+			}
+
+			if !yield(node, err) {
+				return
+			}
+		}
+	}
+}
+
+func sendEarlyHints(w http.ResponseWriter, node esi.Node) {
+	var links []string
+
+	for src := range preloadableIncludes(node) {
+		links = append(links, "<"+src+">; rel=preload")
+	}
+
+	if len(links) == 0 {
+		return
+	}
+
+	header := w.Header()
+
+	// Only send the new links and restore the original header afterward, so that links are neither repeated in later
+	// informational responses nor added to the final response.
+	orig, ok := header["Link"]
+
+	header["Link"] = links
+	w.WriteHeader(http.StatusEarlyHints)
+
+	if ok {
+		header["Link"] = orig
+	} else {
+		delete(header, "Link")
+	}
+}
+
+func preloadableIncludes(node esi.Node) iter.Seq[string] {
+	return func(yield func(string) bool) {
+		var walk func(nodes ...esi.Node) bool
+
+		walk = func(nodes ...esi.Node) bool {
+			for _, node := range nodes {
+				switch v := node.(type) {
+				case *esi.AttemptElement:
+					if !walk(v.Nodes...) {
+						return false
+					}
+				case *esi.Comment:
+					if !walk(v.Nodes...) {
+						return false
+					}
+				case *esi.IncludeElement:
+					if !isPreloadable(v.Source) {
+						continue
+					}
+
+					if !yield(v.Source) {
+						return false
+					}
+				case *esi.TryElement:
+					if v.Attempt != nil && !walk(v.Attempt) {
+						return false
+					}
+				case *esi.VarsElement:
+					if !walk(v.Nodes...) {
+						return false
+					}
+				default:
+					// Other elements are either conditional or never processed
+				}
+			}
+
+			return true
+		}
+
+		walk(node)
+	}
+}
+
+// isPreloadable returns true if src is a relative reference or an absolute HTTP or HTTPS URL without variables.
+func isPreloadable(src string) bool {
+	if src == "" || strings.Contains(src, "$(") || strings.ContainsAny(src, "<>") {
+		return false
+	}
+
+	u, err := url.Parse(src)
+	return err == nil && (u.Scheme == "" || u.Scheme == "http" || u.Scheme == "https")
 }
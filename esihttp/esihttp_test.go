@@ -1,17 +1,25 @@
 package esihttp_test
 
 import (
+	"compress/gzip"
+	"compress/zlib"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/netip"
 	"net/url"
 	"strings"
 	"testing"
 
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/nussjustin/esi"
 	"github.com/nussjustin/esi/esihttp"
+	"github.com/nussjustin/esi/esiproc"
 )
 
 type roundTripperFunc func(*http.Request) (*http.Response, error)
@@ -130,6 +138,102 @@ func TestOriginalResponse(t *testing.T) {
 	}
 }
 
+func TestClientIP(t *testing.T) {
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("fd00::/8")}
+
+	testCases := []struct {
+		Name       string
+		RemoteAddr string
+		Forwarded  []string
+		Expected   string
+	}{
+		{Name: "untrusted", RemoteAddr: "192.0.2.1:1234", Forwarded: []string{"198.51.100.1"}, Expected: "192.0.2.1"},
+		{Name: "trusted", RemoteAddr: "10.0.0.1:1234", Forwarded: []string{"198.51.100.1"}, Expected: "198.51.100.1"},
+		{
+			Name:       "chain",
+			RemoteAddr: "10.0.0.1:1234",
+			Forwarded:  []string{"203.0.113.1, 198.51.100.1", "10.0.0.2"},
+			Expected:   "198.51.100.1",
+		},
+		{Name: "all trusted", RemoteAddr: "10.0.0.1:1234", Forwarded: []string{"10.0.0.2, 10.0.0.3"}, Expected: "10.0.0.2"},
+		{Name: "no header", RemoteAddr: "10.0.0.1:1234", Expected: "10.0.0.1"},
+		{Name: "invalid header", RemoteAddr: "10.0.0.1:1234", Forwarded: []string{"unknown"}, Expected: "10.0.0.1"},
+		{Name: "ipv6", RemoteAddr: "[fd00::1]:1234", Forwarded: []string{"2001:db8::1"}, Expected: "2001:db8::1"},
+		{
+			Name:       "mapped",
+			RemoteAddr: "[::ffff:10.0.0.1]:1234",
+			Forwarded:  []string{"::ffff:192.0.2.1"},
+			Expected:   "192.0.2.1",
+		},
+		{Name: "invalid remote address", RemoteAddr: "invalid"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = testCase.RemoteAddr
+
+			for _, v := range testCase.Forwarded {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+
+			var want netip.Addr
+
+			if testCase.Expected != "" {
+				want = netip.MustParseAddr(testCase.Expected)
+			}
+
+			if got := esihttp.ClientIP(r, trusted); got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+
+	if got := esihttp.ClientIP(nil, trusted); got.IsValid() {
+		t.Errorf("got %v for nil request, want invalid address", got)
+	}
+}
+
+func TestSeedFromRequest(t *testing.T) {
+	newRequest := func(cookie, header string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+		if cookie != "" {
+			r.AddCookie(&http.Cookie{Name: "bucket", Value: cookie})
+		}
+
+		if header != "" {
+			r.Header.Set("X-Bucket", header)
+		}
+
+		return r
+	}
+
+	seed := func(r *http.Request) uint64 {
+		return esihttp.SeedFromRequest(r, "bucket", "X-Bucket")
+	}
+
+	if a, b := seed(newRequest("a", "")), seed(newRequest("a", "b")); a != b {
+		t.Errorf("got different seeds %d and %d for same cookie", a, b)
+	}
+
+	if a, b := seed(newRequest("", "a")), seed(newRequest("", "a")); a != b {
+		t.Errorf("got different seeds %d and %d for same header", a, b)
+	}
+
+	if a, b := seed(newRequest("a", "")), seed(newRequest("b", "")); a == b {
+		t.Errorf("got same seed %d for different cookies", a)
+	}
+
+	if a, b := seed(newRequest("", "")), seed(newRequest("", "")); a == b {
+		t.Errorf("got same seed %d for requests without cookie and header", a)
+	}
+
+	if a, b := esihttp.SeedFromRequest(newRequest("a", "a"), "", ""), seed(newRequest("a", "")); a == b {
+		t.Errorf("got seed %d derived from cookie without cookie name", a)
+	}
+}
+
 func TestClient(t *testing.T) {
 	testCases := []struct {
 		Name          string
@@ -351,3 +455,205 @@ func TestClient(t *testing.T) {
 		})
 	}
 }
+
+type hintsRecorder struct {
+	header http.Header
+	hints  [][]string
+}
+
+func (h *hintsRecorder) Header() http.Header {
+	return h.header
+}
+
+func (h *hintsRecorder) Write([]byte) (int, error) {
+	panic("unexpected write")
+}
+
+func (h *hintsRecorder) WriteHeader(statusCode int) {
+	if statusCode != http.StatusEarlyHints {
+		panic(fmt.Sprintf("unexpected status code %d", statusCode))
+	}
+
+	h.hints = append(h.hints, h.header.Values("Link"))
+}
+
+func TestClient_AcceptEncoding(t *testing.T) {
+	const body = "compressible fragment body"
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Accept-Encoding", r.Header.Get("Accept-Encoding"))
+
+		var (
+			wc  io.WriteCloser
+			err error
+		)
+
+		switch encoding := r.URL.Query().Get("encoding"); encoding {
+		case "gzip":
+			wc = gzip.NewWriter(w)
+		case "deflate":
+			wc = zlib.NewWriter(w)
+		case "br":
+			w.Header().Set("Content-Encoding", encoding)
+			_, _ = io.WriteString(w, body)
+			return
+		default:
+			_, _ = io.WriteString(w, body)
+			return
+		}
+
+		w.Header().Set("Content-Encoding", r.URL.Query().Get("encoding"))
+
+		if _, err = io.WriteString(wc, body); err == nil {
+			err = wc.Close()
+		}
+
+		if err != nil {
+			t.Errorf("failed to write body: %v", err)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	testCases := []struct {
+		Name           string
+		AcceptEncoding string
+		Encoding       string
+		Error          error
+	}{
+		{Name: "transport", Encoding: "gzip"},
+		{Name: "identity", AcceptEncoding: "identity"},
+		{Name: "gzip", AcceptEncoding: "gzip", Encoding: "gzip"},
+		{Name: "deflate", AcceptEncoding: "deflate", Encoding: "deflate"},
+		{
+			Name:           "unsupported",
+			AcceptEncoding: "br",
+			Encoding:       "br",
+			Error:          &esihttp.UnsupportedEncodingError{Encoding: "br"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			var header http.Header
+
+			transport := srv.Client().Transport
+
+			client := &esihttp.Client{
+				HTTPClient: testClient(roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+					resp, err := transport.RoundTrip(r)
+					if err == nil {
+						header = resp.Header
+					}
+					return resp, err
+				})),
+				AcceptEncoding: testCase.AcceptEncoding,
+			}
+
+			got, err := client.Do(t.Context(), srv.URL+"/?encoding="+testCase.Encoding, nil)
+			if !errors.Is(err, testCase.Error) {
+				t.Fatalf("got error %v, want %v", err, testCase.Error)
+			}
+
+			if testCase.Error != nil {
+				return
+			}
+
+			if string(got) != body {
+				t.Errorf("got body %q, want %q", got, body)
+			}
+
+			wantHeader := testCase.AcceptEncoding
+			if wantHeader == "" {
+				wantHeader = "gzip"
+			}
+
+			if got := header.Get("X-Accept-Encoding"); got != wantHeader {
+				t.Errorf("got Accept-Encoding %q, want %q", got, wantHeader)
+			}
+		})
+	}
+}
+
+func TestClient_ReportStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		_, _ = io.WriteString(w, "ok")
+	}))
+	t.Cleanup(srv.Close)
+
+	client := &esihttp.Client{HTTPClient: srv.Client()}
+
+	p := esiproc.New(esiproc.WithClient(client))
+
+	input := `<esi:include src="` + srv.URL + `/missing" onerror="continue"/><esi:include src="` + srv.URL + `/ok"/>`
+
+	res, err := p.ProcessResult(t.Context(), io.Discard, esi.NewParser(strings.NewReader(input)).All)
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	var statuses []int
+
+	for _, inc := range res.Includes {
+		statuses = append(statuses, inc.Status)
+	}
+
+	if diff := cmp.Diff([]int{http.StatusNotFound, http.StatusOK}, statuses); diff != "" {
+		t.Errorf("statuses mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestWithEarlyHints(t *testing.T) {
+	const input = `
+		<p>before</p>
+		<esi:include src="/first"/>
+		<esi:include src="/$(VAR)"/>
+		<esi:include src="data:,inline"/>
+		<esi:include src="HTTPS://cdn.example.com/fragment"/>
+		<esi:choose>
+			<esi:when test="true"><esi:include src="/when"/></esi:when>
+		</esi:choose>
+		<esi:try>
+			<esi:attempt><esi:include src="/attempt"/></esi:attempt>
+			<esi:except><esi:include src="/except"/></esi:except>
+		</esi:try>
+		<esi:remove><esi:include src="/remove"/></esi:remove>
+		<!--esi <esi:include src="/comment"/> -->
+		<p>after</p>
+	`
+
+	w := &hintsRecorder{header: http.Header{"Link": {"</style.css>; rel=preload"}}}
+
+	var nodes int
+
+	for _, err := range esihttp.WithEarlyHints(w, esi.NewParser(strings.NewReader(input)).All) {
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		nodes++
+	}
+
+	if nodes == 0 {
+		t.Error("no nodes yielded")
+	}
+
+	want := [][]string{
+		{"</first>; rel=preload"},
+		{"<HTTPS://cdn.example.com/fragment>; rel=preload"},
+		{"</attempt>; rel=preload"},
+		{"</comment>; rel=preload"},
+	}
+
+	if diff := cmp.Diff(want, w.hints); diff != "" {
+		t.Errorf("hints mismatch (-want +got):\n%s", diff)
+	}
+
+	if diff := cmp.Diff([]string{"</style.css>; rel=preload"}, w.header.Values("Link")); diff != "" {
+		t.Errorf("header mismatch (-want +got):\n%s", diff)
+	}
+}
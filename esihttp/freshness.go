@@ -0,0 +1,187 @@
+package esihttp
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Freshness contains the freshness information of a fragment as returned by [ResponseFreshness].
+type Freshness struct {
+	// URL is the URL of the fragment.
+	URL string
+
+	// Lifetime is the freshness lifetime of the fragment.
+	//
+	// Lifetime is 0 for fragments that must not be stored by a shared cache.
+	Lifetime time.Duration
+
+	// Age is the age of the fragment, as given by the Age header.
+	Age time.Duration
+
+	// Explicit is true if the lifetime was explicitly given using the Cache-Control or Expires header.
+	Explicit bool
+}
+
+// TTL returns the remaining time for which the fragment is fresh, which is Lifetime minus Age.
+//
+// If the fragment is already stale, TTL returns 0.
+func (f Freshness) TTL() time.Duration {
+	return max(f.Lifetime-f.Age, 0)
+}
+
+// ResponseFreshness returns the freshness of the given response, as seen by a shared cache.
+//
+// The lifetime is determined using the following rules, in order:
+//
+//   - If the Surrogate-Control header contains the no-store or no-store-remote directive, the lifetime is 0.
+//   - If the Surrogate-Control header contains the max-age directive, its value is used.
+//   - If the Cache-Control header contains the no-store, no-cache or private directive, the lifetime is 0.
+//   - If the Cache-Control header contains the s-maxage directive, its value is used.
+//   - If the Cache-Control header contains the max-age directive, its value is used.
+//   - If the response has an Expires header, the lifetime is the difference between Expires and the Date header. If
+//     the response has no Date header, now is used instead. Invalid dates result in a lifetime of 0.
+//
+// Only Surrogate-Control directives without a target are considered. See [ParseSurrogateControl].
+//
+// If none of the rules apply, the lifetime is 0 and [Freshness.Explicit] is false.
+func ResponseFreshness(resp *http.Response, now time.Time) Freshness {
+	f := Freshness{
+		Age: parseSeconds(resp.Header.Get("Age")),
+	}
+
+	if resp.Request != nil {
+		f.URL = resp.Request.URL.String()
+	}
+
+	switch control := ParseSurrogateControl(resp.Header, ""); {
+	case control.NoStore, control.NoStoreRemote:
+		f.Explicit = true
+		return f
+	case control.HasMaxAge:
+		f.Lifetime, f.Explicit = control.MaxAge, true
+		return f
+	}
+
+	var maxAge, sMaxAge string
+	var hasMaxAge, hasSMaxAge bool
+
+	for _, v := range resp.Header.Values("Cache-Control") {
+		for directive := range strings.SplitSeq(v, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+
+			switch strings.ToLower(name) {
+			case "no-store", "no-cache", "private":
+				f.Explicit = true
+				return f
+			case "max-age":
+				maxAge, hasMaxAge = value, true
+			case "s-maxage":
+				sMaxAge, hasSMaxAge = value, true
+			}
+		}
+	}
+
+	switch {
+	case hasSMaxAge:
+		f.Lifetime, f.Explicit = parseSeconds(sMaxAge), true
+	case hasMaxAge:
+		f.Lifetime, f.Explicit = parseSeconds(maxAge), true
+	case resp.Header.Get("Expires") != "":
+		f.Lifetime, f.Explicit = expiresLifetime(resp.Header, now), true
+	}
+
+	return f
+}
+
+// FreshnessRecorder records the freshness of all fragments fetched by a [Client] for a single page.
+//
+// This can be used to derive the lifetime of the page from the lifetimes of its fragments. See
+// [WithFreshnessRecorder].
+//
+// FreshnessRecorder is safe for concurrent use.
+type FreshnessRecorder struct {
+	mu        sync.Mutex
+	fragments []Freshness
+}
+
+// Fragments returns the recorded freshness information in the order in which it was recorded.
+func (r *FreshnessRecorder) Fragments() []Freshness {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]Freshness(nil), r.fragments...)
+}
+
+// Record records the freshness of a fragment.
+func (r *FreshnessRecorder) Record(f Freshness) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.fragments = append(r.fragments, f)
+}
+
+// TTL returns the smallest [Freshness.TTL] of all recorded fragments with an explicit lifetime.
+//
+// If no fragment with an explicit lifetime was recorded, the second return value is false.
+func (r *FreshnessRecorder) TTL() (time.Duration, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var ttl time.Duration
+	var ok bool
+
+	for _, f := range r.fragments {
+		if !f.Explicit {
+			continue
+		}
+
+		if !ok || f.TTL() < ttl {
+			ttl, ok = f.TTL(), true
+		}
+	}
+
+	return ttl, ok
+}
+
+var freshnessRecorderKey = new(int)
+
+// WithFreshnessRecorder associates the given recorder with the context.
+//
+// [Client.Do] records the freshness of each fetched fragment in the recorder associated with its context.
+func WithFreshnessRecorder(ctx context.Context, r *FreshnessRecorder) context.Context {
+	return context.WithValue(ctx, freshnessRecorderKey, r)
+}
+
+func freshnessRecorder(ctx context.Context) *FreshnessRecorder {
+	v, _ := ctx.Value(freshnessRecorderKey).(*FreshnessRecorder)
+	return v
+}
+
+func expiresLifetime(header http.Header, now time.Time) time.Duration {
+	expires, err := http.ParseTime(header.Get("Expires"))
+	if err != nil {
+		return 0
+	}
+
+	if date := header.Get("Date"); date != "" {
+		if now, err = http.ParseTime(date); err != nil {
+			return 0
+		}
+	}
+
+	return max(expires.Sub(now), 0)
+}
+
+func parseSeconds(s string) time.Duration {
+	n, err := strconv.ParseInt(strings.Trim(s, `"`), 10, 64)
+	if err != nil || n < 0 {
+		return 0
+	}
+
+	return time.Duration(min(n, math.MaxInt64/int64(time.Second))) * time.Second
+}
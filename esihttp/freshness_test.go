@@ -0,0 +1,207 @@
+package esihttp_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/nussjustin/esi/esihttp"
+)
+
+func TestResponseFreshness(t *testing.T) {
+	now := time.Date(2024, time.March, 5, 13, 30, 0, 0, time.UTC)
+
+	testCases := []struct {
+		Name     string
+		Header   http.Header
+		Expected esihttp.Freshness
+	}{
+		{
+			Name:     "no headers",
+			Header:   http.Header{},
+			Expected: esihttp.Freshness{},
+		},
+		{
+			Name:     "max-age",
+			Header:   http.Header{"Cache-Control": {"public, max-age=60"}},
+			Expected: esihttp.Freshness{Lifetime: time.Minute, Explicit: true},
+		},
+		{
+			Name:     "s-maxage over max-age",
+			Header:   http.Header{"Cache-Control": {"max-age=60, S-Maxage=300"}},
+			Expected: esihttp.Freshness{Lifetime: 5 * time.Minute, Explicit: true},
+		},
+		{
+			Name:     "multiple headers",
+			Header:   http.Header{"Cache-Control": {"s-maxage=\"300\"", "max-age=60"}},
+			Expected: esihttp.Freshness{Lifetime: 5 * time.Minute, Explicit: true},
+		},
+		{
+			Name:     "invalid max-age",
+			Header:   http.Header{"Cache-Control": {"max-age=soon"}},
+			Expected: esihttp.Freshness{Explicit: true},
+		},
+		{
+			Name:     "no-store",
+			Header:   http.Header{"Cache-Control": {"max-age=60, no-store"}},
+			Expected: esihttp.Freshness{Explicit: true},
+		},
+		{
+			Name:     "private",
+			Header:   http.Header{"Cache-Control": {"private, max-age=60"}},
+			Expected: esihttp.Freshness{Explicit: true},
+		},
+		{
+			Name:     "surrogate-control max-age over cache-control",
+			Header:   http.Header{"Cache-Control": {"private"}, "Surrogate-Control": {`content="ESI/1.0", max-age=300`}},
+			Expected: esihttp.Freshness{Lifetime: 5 * time.Minute, Explicit: true},
+		},
+		{
+			Name:     "surrogate-control no-store-remote",
+			Header:   http.Header{"Cache-Control": {"max-age=60"}, "Surrogate-Control": {"max-age=60, no-store-remote"}},
+			Expected: esihttp.Freshness{Explicit: true},
+		},
+		{
+			Name:     "targeted surrogate-control",
+			Header:   http.Header{"Cache-Control": {"max-age=60"}, "Surrogate-Control": {"max-age=300;edge"}},
+			Expected: esihttp.Freshness{Lifetime: time.Minute, Explicit: true},
+		},
+		{
+			Name:     "max-age over expires",
+			Header:   http.Header{"Cache-Control": {"max-age=60"}, "Expires": {"Tue, 05 Mar 2024 14:30:00 GMT"}},
+			Expected: esihttp.Freshness{Lifetime: time.Minute, Explicit: true},
+		},
+		{
+			Name:     "expires",
+			Header:   http.Header{"Expires": {"Tue, 05 Mar 2024 14:30:00 GMT"}},
+			Expected: esihttp.Freshness{Lifetime: time.Hour, Explicit: true},
+		},
+		{
+			Name: "expires with date",
+			Header: http.Header{
+				"Date":    {"Tue, 05 Mar 2024 14:00:00 GMT"},
+				"Expires": {"Tue, 05 Mar 2024 14:30:00 GMT"},
+			},
+			Expected: esihttp.Freshness{Lifetime: 30 * time.Minute, Explicit: true},
+		},
+		{
+			Name:     "expires in the past",
+			Header:   http.Header{"Expires": {"Tue, 05 Mar 2024 12:30:00 GMT"}},
+			Expected: esihttp.Freshness{Explicit: true},
+		},
+		{
+			Name:     "invalid expires",
+			Header:   http.Header{"Expires": {"0"}},
+			Expected: esihttp.Freshness{Explicit: true},
+		},
+		{
+			Name:     "age",
+			Header:   http.Header{"Age": {"20"}, "Cache-Control": {"max-age=60"}},
+			Expected: esihttp.Freshness{Lifetime: time.Minute, Age: 20 * time.Second, Explicit: true},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			got := esihttp.ResponseFreshness(&http.Response{Header: testCase.Header}, now)
+
+			if diff := cmp.Diff(testCase.Expected, got); diff != "" {
+				t.Errorf("freshness mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestFreshness_TTL(t *testing.T) {
+	f := esihttp.Freshness{Lifetime: time.Minute, Age: 20 * time.Second}
+
+	if got, want := f.TTL(), 40*time.Second; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	f.Age = 2 * time.Minute
+
+	if got := f.TTL(); got != 0 {
+		t.Errorf("got %s, want 0", got)
+	}
+}
+
+func TestFreshnessRecorder_TTL(t *testing.T) {
+	var r esihttp.FreshnessRecorder
+
+	if _, ok := r.TTL(); ok {
+		t.Errorf("got ok for empty recorder")
+	}
+
+	r.Record(esihttp.Freshness{URL: "/a"})
+
+	if _, ok := r.TTL(); ok {
+		t.Errorf("got ok without explicit freshness")
+	}
+
+	r.Record(esihttp.Freshness{URL: "/b", Lifetime: time.Hour, Explicit: true})
+	r.Record(esihttp.Freshness{URL: "/c", Lifetime: time.Minute, Age: 10 * time.Second, Explicit: true})
+	r.Record(esihttp.Freshness{URL: "/d", Lifetime: 5 * time.Minute, Explicit: true})
+
+	if got, ok := r.TTL(); !ok || got != 50*time.Second {
+		t.Errorf("got (%s, %t), want (%s, true)", got, ok, 50*time.Second)
+	}
+
+	if got := len(r.Fragments()); got != 4 {
+		t.Errorf("got %d fragments, want 4", got)
+	}
+}
+
+func TestClient_Freshness(t *testing.T) {
+	transport := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		resp := &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{},
+			Body:       io.NopCloser(strings.NewReader("ok")),
+			Request:    req,
+		}
+
+		if req.URL.Path == "/cached" {
+			resp.Header.Set("Cache-Control", "max-age=60, s-maxage=120")
+		}
+
+		return resp, nil
+	})
+
+	var called []esihttp.Freshness
+
+	client := &esihttp.Client{
+		HTTPClient: testClient(transport),
+		OnFreshness: func(_ context.Context, f esihttp.Freshness) {
+			called = append(called, f)
+		},
+	}
+
+	var rec esihttp.FreshnessRecorder
+
+	ctx := esihttp.WithFreshnessRecorder(t.Context(), &rec)
+
+	for _, urlStr := range []string{"http://example.com/cached", "http://example.com/uncached"} {
+		if _, err := client.Do(ctx, urlStr, nil); err != nil {
+			t.Fatalf("got error %v", err)
+		}
+	}
+
+	want := []esihttp.Freshness{
+		{URL: "http://example.com/cached", Lifetime: 2 * time.Minute, Explicit: true},
+		{URL: "http://example.com/uncached"},
+	}
+
+	if diff := cmp.Diff(want, called); diff != "" {
+		t.Errorf("OnFreshness mismatch (-want +got):\n%s", diff)
+	}
+
+	if diff := cmp.Diff(want, rec.Fragments()); diff != "" {
+		t.Errorf("recorded freshness mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,428 @@
+package esihttp
+
+import (
+	"bytes"
+	"io"
+	"iter"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nussjustin/esi"
+	"github.com/nussjustin/esi/esiproc"
+)
+
+// DefaultMaxPooledBufferSize is the maximum capacity of buffers kept by a [BufferPool] if no other size is configured.
+const DefaultMaxPooledBufferSize = 1 << 20
+
+// DefaultOptOutHeader is the name of the response header used by [ResponseFilter] if no other header is configured.
+const DefaultOptOutHeader = "X-Esi-Skip"
+
+// BufferPool is a pool of buffers that can be used to buffer response bodies before processing them.
+//
+// Reusing buffers avoids allocating new, possibly large, buffers for each response, which can put a lot of pressure
+// on the garbage collector for servers with a high number of requests.
+//
+// The zero value is ready to use. A BufferPool must not be copied after first use.
+type BufferPool struct {
+	// InitialSize is the capacity in bytes of newly allocated buffers.
+	//
+	// Setting this to the typical size of a response avoids growing new buffers multiple times.
+	//
+	// If InitialSize is <= 0, new buffers start empty and grow as needed.
+	InitialSize int
+
+	// MaxPooledSize is the maximum capacity in bytes of buffers that are kept for reuse.
+	//
+	// Buffers that grew larger, for example because of a single very large response, are dropped by
+	// [BufferPool.Put] so that their memory can be reclaimed.
+	//
+	// If MaxPooledSize is 0, [DefaultMaxPooledBufferSize] is used. If MaxPooledSize is < 0, the size is not limited.
+	MaxPooledSize int
+
+	pool sync.Pool
+}
+
+// Get returns an empty buffer from the pool or allocates a new one.
+//
+// The buffer should be returned to the pool using [BufferPool.Put] once it is no longer used.
+func (p *BufferPool) Get() *bytes.Buffer {
+	if b, ok := p.pool.Get().(*bytes.Buffer); ok {
+		return b
+	}
+
+	return bytes.NewBuffer(make([]byte, 0, max(p.InitialSize, 0)))
+}
+
+// Put resets the given buffer and returns it to the pool.
+//
+// The buffer must not be used after calling Put. If the capacity of the buffer exceeds the configured
+// [BufferPool.MaxPooledSize], it is dropped instead.
+func (p *BufferPool) Put(b *bytes.Buffer) {
+	maxSize := p.MaxPooledSize
+	if maxSize == 0 {
+		maxSize = DefaultMaxPooledBufferSize
+	}
+
+	if maxSize > 0 && b.Cap() > maxSize {
+		return
+	}
+
+	b.Reset()
+	p.pool.Put(b)
+}
+
+// ResponseFilter decides which responses should be processed.
+//
+// Responses that are not selected by the filter should be passed through without any buffering or processing.
+//
+// The zero value selects all responses with a media type of "text/html" and without the [DefaultOptOutHeader].
+type ResponseFilter struct {
+	// ContentTypes contains the media types of the responses that should be processed.
+	//
+	// Each entry is either a full media type (e.g. "text/html") or a wildcard for all subtypes of a type
+	// (e.g. "text/*"). Matching is case-insensitive and ignores any parameters.
+	//
+	// If empty, only responses with media type "text/html" are processed.
+	ContentTypes []string
+
+	// MaxBodySize is the maximum size in bytes of bodies that should be processed.
+	//
+	// Responses with a Content-Length larger than MaxBodySize are not processed. For responses without a known length
+	// callers must check the size using [ResponseFilter.AllowBodySize] while reading the body.
+	//
+	// If MaxBodySize is <= 0, the body size is not limited.
+	MaxBodySize int64
+
+	// OptOutHeader is the name of a response header that can be set to disable processing for a response.
+	//
+	// If the response contains the header, regardless of its value, it is not processed.
+	//
+	// If empty, [DefaultOptOutHeader] is used.
+	OptOutHeader string
+}
+
+// ShouldProcess returns true if a response with the given header should be processed.
+func (f *ResponseFilter) ShouldProcess(header http.Header) bool {
+	optOutHeader := f.OptOutHeader
+	if optOutHeader == "" {
+		optOutHeader = DefaultOptOutHeader
+	}
+
+	if _, ok := header[http.CanonicalHeaderKey(optOutHeader)]; ok {
+		return false
+	}
+
+	if !f.matchesContentType(header.Get("Content-Type")) {
+		return false
+	}
+
+	if contentLength := header.Get("Content-Length"); contentLength != "" {
+		n, err := strconv.ParseInt(contentLength, 10, 64)
+		if err != nil || !f.AllowBodySize(n) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// AllowBodySize returns true if a body with the given size in bytes can be processed.
+func (f *ResponseFilter) AllowBodySize(n int64) bool {
+	return f.MaxBodySize <= 0 || n <= f.MaxBodySize
+}
+
+func (f *ResponseFilter) matchesContentType(contentType string) bool {
+	if contentType == "" {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	if len(f.ContentTypes) == 0 {
+		return mediaType == "text/html"
+	}
+
+	for _, allowed := range f.ContentTypes {
+		allowed = strings.ToLower(allowed)
+
+		if prefix, ok := strings.CutSuffix(allowed, "/*"); ok {
+			if typ, _, _ := strings.Cut(mediaType, "/"); typ == prefix {
+				return true
+			}
+
+			continue
+		}
+
+		if mediaType == allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Handler is an [http.Handler] middleware that processes the ESI markup in the responses of another handler, making
+// it possible for a service to act as its own edge.
+//
+// Responses selected for processing are buffered, processed using [esiproc.Processor.ProcessReader], or
+// [esiproc.Processor.Process] if the response was already parsed for [Handler.EarlyHints], and written to the
+// client. Since the processed body usually has a different length, the Content-Length header is removed. All other
+// responses are passed through as is, without buffering.
+//
+// Handler acts as a surrogate as defined by the Edge Architecture Specification: Surrogate-Control directives that
+// apply to the handler are removed from all responses before they are sent to the client. See [Handler.SurrogateName]
+// and [StripSurrogateControl].
+//
+// Processing uses a context associated with the request using [WithOriginalRequest], with its URL made absolute using
+// the Host header, so that relative URLs of includes fetched using a [Client] are resolved against the request.
+type Handler struct {
+	// Handler is the handler whose responses are processed.
+	Handler http.Handler
+
+	// Processor is used for processing the responses.
+	Processor *esiproc.Processor
+
+	// ParserOptions are passed to [esiproc.Processor.ProcessReader] when parsing a response.
+	ParserOptions []esi.ParserOpt
+
+	// Buffers is used for buffering responses.
+	//
+	// If nil, a pool shared by all Handlers with a nil pool is used.
+	Buffers *BufferPool
+
+	// Filter decides which responses are processed, in addition to the checks described below.
+	//
+	// Only responses with status 200 OK and without Content-Encoding are processed. Responses that turn out to be
+	// larger than Filter.MaxBodySize while being written are passed through unprocessed.
+	Filter ResponseFilter
+
+	// RequireSurrogateControl restricts processing to responses with a Surrogate-Control header announcing ESI
+	// content, like
+	//
+	//	Surrogate-Control: content="ESI/1.0"
+	//
+	// See [ParseSurrogateControl] for how directives are selected.
+	RequireSurrogateControl bool
+
+	// SurrogateName is the device token used to target this handler in Surrogate-Control directives.
+	//
+	// If not empty, a Surrogate-Capability header advertising ESI support under this name is added to each request
+	// before calling Handler, and Surrogate-Control directives targeted at the name, for example
+	// `content="ESI/1.0";name`, are used and removed from responses. If empty, only directives without a target are
+	// considered.
+	SurrogateName string
+
+	// Cache caches the processed output of pages, so that pages that were already processed for the same variables
+	// do not need to be processed again. See [PageCache] for details.
+	//
+	// If nil, the output is not cached.
+	Cache *PageCache
+
+	// EarlyHints enables sending HTTP 103 (Early Hints) responses for the includes of responses that are processed,
+	// so that clients can start preloading them while the response is processed. See [WithEarlyHints] for details.
+	//
+	// The captured response is parsed while it is written by Handler and the informational responses are sent as
+	// soon as the includes are parsed. The parsed nodes are then used for processing, so that the response is only
+	// parsed once.
+	EarlyHints bool
+
+	// ErrorHandler is called when processing a response fails.
+	//
+	// Since parts of the processed response may already have been sent, the error can not be reported to the client
+	// anymore. ErrorHandler should only log the error or record it for monitoring.
+	//
+	// If nil, errors are logged using [log.Printf].
+	ErrorHandler func(r *http.Request, err error)
+
+	// ResultHandler is called with the result of processing each response, for example to record metrics.
+	//
+	// If ResultHandler is set, responses are processed using [esiproc.Processor.ProcessResult] instead of
+	// [esiproc.Processor.ProcessReader]. Errors are passed to both ResultHandler and ErrorHandler.
+	//
+	// ResultHandler is not called for responses that are processed using Cache.
+	ResultHandler func(r *http.Request, res *esiproc.Result, err error)
+}
+
+var defaultBuffers BufferPool
+
+// ServeHTTP implements the [http.Handler] interface.
+//
+// ServeHTTP panics if Handler or Processor is nil.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.Handler == nil {
+		panic("Handler.ServeHTTP called with nil Handler")
+	}
+
+	if h.Processor == nil {
+		panic("Handler.ServeHTTP called with nil Processor")
+	}
+
+	buffers := h.Buffers
+	if buffers == nil {
+		buffers = &defaultBuffers
+	}
+
+	buf := buffers.Get()
+	defer buffers.Put(buf)
+
+	capture := NewResponseCapture(w, buf)
+	capture.MaxBodySize = h.Filter.MaxBodySize
+	capture.ShouldCapture = h.shouldProcess
+
+	var page pageInfo
+	var cacheable bool
+
+	if h.Cache != nil {
+		capture.ShouldCapture = func(status int, header http.Header) bool {
+			// The freshness depends on the Surrogate-Control header, which is removed by shouldProcess.
+			page, cacheable = h.Cache.page(r, header)
+
+			return h.shouldProcess(status, header)
+		}
+	}
+
+	if h.SurrogateName != "" {
+		r = r.Clone(r.Context())
+		AddSurrogateCapability(r.Header, h.SurrogateName, esi.Capability)
+	}
+
+	var hints *earlyHintsWriter
+
+	if h.EarlyHints {
+		hints = &earlyHintsWriter{ResponseCapture: capture, w: w}
+		hints.parser.Reset(nil, h.ParserOptions...)
+		defer func() { _ = hints.parser.Close() }()
+
+		h.Handler.ServeHTTP(hints, r)
+
+		// Send the hints for the rest of the response before the final response header is written.
+		if capture.Captured() {
+			hints.parser.CloseFeed()
+			hints.parse()
+		}
+	} else {
+		h.Handler.ServeHTTP(capture, r)
+	}
+
+	err := capture.Finish(func(w io.Writer, body []byte) error {
+		orig := r.Clone(r.Context())
+		orig.URL = requestURL(r)
+
+		ctx := WithOriginalRequest(r.Context(), orig)
+
+		// Debug comments must neither be cached nor be missing because the output was taken from the cache.
+		useCache := cacheable && !h.Processor.DebugComments(ctx)
+
+		var nodes iter.Seq2[esi.Node, error]
+
+		if hints != nil {
+			nodes = hints.All
+		} else if useCache || h.ResultHandler != nil {
+			p := esi.NewParser(bytes.NewReader(body), h.ParserOptions...)
+			defer func() { _ = p.Close() }()
+
+			nodes = p.All
+		}
+
+		switch {
+		case useCache:
+			return h.Cache.process(ctx, w, page, h.Processor, nodes)
+		case h.ResultHandler != nil:
+			res, err := h.Processor.ProcessResult(ctx, w, nodes)
+			h.ResultHandler(r, &res, err)
+			return err
+		case nodes != nil:
+			_, err := h.Processor.Process(ctx, w, nodes)
+			return err
+		default:
+			_, err := h.Processor.ProcessReader(ctx, w, bytes.NewReader(body), h.ParserOptions...)
+			return err
+		}
+	})
+	if err == nil {
+		return
+	}
+
+	if h.ErrorHandler != nil {
+		h.ErrorHandler(r, err)
+		return
+	}
+
+	log.Printf("esihttp: failed to process response for %s: %s", r.URL, err)
+}
+
+// shouldProcess returns true if a response with the given status code and header should be processed.
+//
+// The Surrogate-Control directives that apply to h are removed from header, independent of the result.
+func (h *Handler) shouldProcess(status int, header http.Header) bool {
+	control := ParseSurrogateControl(header, h.SurrogateName)
+	StripSurrogateControl(header, h.SurrogateName)
+
+	if status != http.StatusOK || header.Get("Content-Encoding") != "" || !h.Filter.ShouldProcess(header) {
+		return false
+	}
+
+	return !h.RequireSurrogateControl || control.HasContent(esi.Capability)
+}
+
+// earlyHintsWriter parses the body of a captured response while it is written and sends early hints for the includes
+// parsed so far.
+type earlyHintsWriter struct {
+	*ResponseCapture
+
+	// w is the writer to which the early hints are sent.
+	w http.ResponseWriter
+
+	parser esi.Parser
+	nodes  esi.Nodes
+	err    error
+}
+
+// All yields the parsed nodes, followed by the parse error, if any.
+func (e *earlyHintsWriter) All(yield func(esi.Node, error) bool) {
+	for _, node := range e.nodes {
+		if !yield(node, nil) {
+			return
+		}
+	}
+
+	if e.err != nil {
+		yield(nil, e.err)
+	}
+}
+
+// Write implements the [http.ResponseWriter] interface.
+func (e *earlyHintsWriter) Write(b []byte) (int, error) {
+	n, err := e.ResponseCapture.Write(b)
+
+	if e.Captured() && e.err == nil {
+		e.parser.Feed(b[:n])
+		e.parse()
+	}
+
+	return n, err
+}
+
+// parse parses the data fed so far and sends early hints for the parsed nodes.
+func (e *earlyHintsWriter) parse() {
+	if e.err != nil {
+		return
+	}
+
+	for node, err := range WithEarlyHints(e.w, e.parser.All) {
+		if err != nil {
+			// The error is reported when processing the response.
+			e.err = err
+			return
+		}
+
+		e.nodes = append(e.nodes, node)
+	}
+}
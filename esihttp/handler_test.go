@@ -0,0 +1,576 @@
+package esihttp_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/nussjustin/esi/esihttp"
+	"github.com/nussjustin/esi/esiproc"
+)
+
+func TestResponseFilter(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Filter   esihttp.ResponseFilter
+		Header   http.Header
+		Expected bool
+	}{
+		{
+			Name:     "default",
+			Header:   http.Header{"Content-Type": {"text/html; charset=utf-8"}},
+			Expected: true,
+		},
+		{
+			Name:     "default with upper case media type",
+			Header:   http.Header{"Content-Type": {"TEXT/HTML"}},
+			Expected: true,
+		},
+		{
+			Name:     "default with other media type",
+			Header:   http.Header{"Content-Type": {"application/json"}},
+			Expected: false,
+		},
+		{
+			Name:     "missing content type",
+			Header:   http.Header{},
+			Expected: false,
+		},
+		{
+			Name:     "invalid content type",
+			Header:   http.Header{"Content-Type": {"text/html;;"}},
+			Expected: false,
+		},
+		{
+			Name: "custom content types",
+			Filter: esihttp.ResponseFilter{
+				ContentTypes: []string{"application/xml", "application/xhtml+xml"},
+			},
+			Header:   http.Header{"Content-Type": {"application/xhtml+xml"}},
+			Expected: true,
+		},
+		{
+			Name: "custom content types without match",
+			Filter: esihttp.ResponseFilter{
+				ContentTypes: []string{"application/xml", "application/xhtml+xml"},
+			},
+			Header:   http.Header{"Content-Type": {"text/html"}},
+			Expected: false,
+		},
+		{
+			Name: "wildcard content type",
+			Filter: esihttp.ResponseFilter{
+				ContentTypes: []string{"Text/*"},
+			},
+			Header:   http.Header{"Content-Type": {"text/plain"}},
+			Expected: true,
+		},
+		{
+			Name: "wildcard content type without match",
+			Filter: esihttp.ResponseFilter{
+				ContentTypes: []string{"text/*"},
+			},
+			Header:   http.Header{"Content-Type": {"textual/plain"}},
+			Expected: false,
+		},
+		{
+			Name: "body size within limit",
+			Filter: esihttp.ResponseFilter{
+				MaxBodySize: 1024,
+			},
+			Header:   http.Header{"Content-Type": {"text/html"}, "Content-Length": {"1024"}},
+			Expected: true,
+		},
+		{
+			Name: "body size exceeding limit",
+			Filter: esihttp.ResponseFilter{
+				MaxBodySize: 1024,
+			},
+			Header:   http.Header{"Content-Type": {"text/html"}, "Content-Length": {"1025"}},
+			Expected: false,
+		},
+		{
+			Name: "invalid body size",
+			Filter: esihttp.ResponseFilter{
+				MaxBodySize: 1024,
+			},
+			Header:   http.Header{"Content-Type": {"text/html"}, "Content-Length": {"invalid"}},
+			Expected: false,
+		},
+		{
+			Name: "unknown body size",
+			Filter: esihttp.ResponseFilter{
+				MaxBodySize: 1024,
+			},
+			Header:   http.Header{"Content-Type": {"text/html"}},
+			Expected: true,
+		},
+		{
+			Name:     "default opt-out header",
+			Header:   http.Header{"Content-Type": {"text/html"}, esihttp.DefaultOptOutHeader: {""}},
+			Expected: false,
+		},
+		{
+			Name: "custom opt-out header",
+			Filter: esihttp.ResponseFilter{
+				OptOutHeader: "x-no-esi",
+			},
+			Header:   http.Header{"Content-Type": {"text/html"}, "X-No-Esi": {"1"}},
+			Expected: false,
+		},
+		{
+			Name: "custom opt-out header ignores default",
+			Filter: esihttp.ResponseFilter{
+				OptOutHeader: "X-No-Esi",
+			},
+			Header:   http.Header{"Content-Type": {"text/html"}, esihttp.DefaultOptOutHeader: {"1"}},
+			Expected: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			if got := testCase.Filter.ShouldProcess(testCase.Header); got != testCase.Expected {
+				t.Errorf("ShouldProcess(%v): got %t, want %t", testCase.Header, got, testCase.Expected)
+			}
+		})
+	}
+}
+
+func TestResponseFilter_AllowBodySize(t *testing.T) {
+	var unlimited esihttp.ResponseFilter
+
+	if !unlimited.AllowBodySize(1 << 40) {
+		t.Error("AllowBodySize: got false for filter without limit, want true")
+	}
+
+	limited := esihttp.ResponseFilter{MaxBodySize: 10}
+
+	if !limited.AllowBodySize(10) {
+		t.Error("AllowBodySize(10): got false, want true")
+	}
+
+	if limited.AllowBodySize(11) {
+		t.Error("AllowBodySize(11): got true, want false")
+	}
+}
+
+func TestBufferPool(t *testing.T) {
+	var zero esihttp.BufferPool
+
+	b := zero.Get()
+	if b.Len() != 0 {
+		t.Errorf("got buffer with length %d, want 0", b.Len())
+	}
+
+	b.WriteString("data")
+	zero.Put(b)
+
+	if b := zero.Get(); b.Len() != 0 {
+		t.Errorf("got buffer with length %d after Put, want 0", b.Len())
+	}
+
+	p := esihttp.BufferPool{InitialSize: 1024, MaxPooledSize: 4096}
+
+	if b := p.Get(); b.Cap() < 1024 {
+		t.Errorf("got buffer with capacity %d, want at least %d", b.Cap(), 1024)
+	}
+
+	large := bytes.NewBuffer(make([]byte, 0, 8192))
+	p.Put(large)
+
+	for range 10 {
+		if b := p.Get(); b == large {
+			t.Fatal("got buffer exceeding MaxPooledSize from pool")
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	client := esiproc.ClientFunc(func(ctx context.Context, urlStr string, _ map[string]string) ([]byte, error) {
+		if urlStr == "/error" {
+			return nil, errors.New("include failed")
+		}
+
+		return []byte(urlStr + " from " + esihttp.OriginalRequest(ctx).URL.String()), nil
+	})
+
+	proc := esiproc.New(esiproc.WithClient(client))
+
+	const input = `before <esi:include src="/fragment"/> after`
+
+	const processed = `before /fragment from http://example.com/page after`
+
+	testCases := []struct {
+		Name           string
+		Handler        esihttp.Handler
+		Status         int
+		Header         http.Header
+		Body           string
+		ExpectedBody   string
+		ExpectedHeader http.Header
+		ExpectedError  string
+	}{
+		{
+			Name:           "processed",
+			Header:         http.Header{"Content-Type": {"text/html"}, "Content-Length": {"43"}},
+			Body:           input,
+			ExpectedBody:   processed,
+			ExpectedHeader: http.Header{"Content-Type": {"text/html"}},
+		},
+		{
+			Name:           "without markup",
+			Header:         http.Header{"Content-Type": {"text/html"}},
+			Body:           "<p>no markup</p>",
+			ExpectedBody:   "<p>no markup</p>",
+			ExpectedHeader: http.Header{"Content-Type": {"text/html"}},
+		},
+		{
+			Name:           "other content type",
+			Header:         http.Header{"Content-Type": {"text/plain"}},
+			Body:           input,
+			ExpectedBody:   input,
+			ExpectedHeader: http.Header{"Content-Type": {"text/plain"}},
+		},
+		{
+			Name:           "other status",
+			Status:         http.StatusNotFound,
+			Header:         http.Header{"Content-Type": {"text/html"}},
+			Body:           input,
+			ExpectedBody:   input,
+			ExpectedHeader: http.Header{"Content-Type": {"text/html"}},
+		},
+		{
+			Name:           "compressed",
+			Header:         http.Header{"Content-Type": {"text/html"}, "Content-Encoding": {"gzip"}},
+			Body:           input,
+			ExpectedBody:   input,
+			ExpectedHeader: http.Header{"Content-Type": {"text/html"}, "Content-Encoding": {"gzip"}},
+		},
+		{
+			Name:           "too large",
+			Handler:        esihttp.Handler{Filter: esihttp.ResponseFilter{MaxBodySize: 10}},
+			Header:         http.Header{"Content-Type": {"text/html"}},
+			Body:           input,
+			ExpectedBody:   input,
+			ExpectedHeader: http.Header{"Content-Type": {"text/html"}},
+		},
+		{
+			Name:           "surrogate control removed",
+			Header:         http.Header{"Content-Type": {"text/html"}, "Surrogate-Control": {`max-age=60`}},
+			Body:           input,
+			ExpectedBody:   processed,
+			ExpectedHeader: http.Header{"Content-Type": {"text/html"}},
+		},
+		{
+			Name:           "surrogate control required",
+			Handler:        esihttp.Handler{RequireSurrogateControl: true},
+			Header:         http.Header{"Content-Type": {"text/html"}, "Surrogate-Control": {`content="ESI/1.0"`}},
+			Body:           input,
+			ExpectedBody:   processed,
+			ExpectedHeader: http.Header{"Content-Type": {"text/html"}},
+		},
+		{
+			Name:    "surrogate control required with multiple directives",
+			Handler: esihttp.Handler{RequireSurrogateControl: true},
+			Header: http.Header{
+				"Content-Type":      {"text/html"},
+				"Surrogate-Control": {`max-age=60, content="ESI-Inline/1.0 ESI/1.0"`},
+			},
+			Body:           input,
+			ExpectedBody:   processed,
+			ExpectedHeader: http.Header{"Content-Type": {"text/html"}},
+		},
+		{
+			Name:           "surrogate control required but missing",
+			Handler:        esihttp.Handler{RequireSurrogateControl: true},
+			Header:         http.Header{"Content-Type": {"text/html"}},
+			Body:           input,
+			ExpectedBody:   input,
+			ExpectedHeader: http.Header{"Content-Type": {"text/html"}},
+		},
+		{
+			Name:    "surrogate control required without esi content",
+			Handler: esihttp.Handler{RequireSurrogateControl: true},
+			Header: http.Header{
+				"Content-Type":      {"text/html"},
+				"Surrogate-Control": {`content="ESI-Inline/1.0"`},
+			},
+			Body:           input,
+			ExpectedBody:   input,
+			ExpectedHeader: http.Header{"Content-Type": {"text/html"}},
+		},
+		{
+			Name:    "surrogate control with directives for other devices",
+			Handler: esihttp.Handler{SurrogateName: "edge"},
+			Header: http.Header{
+				"Content-Type":      {"text/html"},
+				"Surrogate-Control": {`max-age=60, no-store;edge, content="ESI/1.0";other`},
+			},
+			Body:         input,
+			ExpectedBody: processed,
+			ExpectedHeader: http.Header{
+				"Content-Type":      {"text/html"},
+				"Surrogate-Control": {`content="ESI/1.0";other`},
+			},
+		},
+		{
+			Name:    "surrogate control targeted at this handler",
+			Handler: esihttp.Handler{RequireSurrogateControl: true, SurrogateName: "edge"},
+			Header: http.Header{
+				"Content-Type":      {"text/html"},
+				"Surrogate-Control": {`content="ESI/1.0";edge`},
+			},
+			Body:           input,
+			ExpectedBody:   processed,
+			ExpectedHeader: http.Header{"Content-Type": {"text/html"}},
+		},
+		{
+			Name:    "surrogate control targeted at other device",
+			Handler: esihttp.Handler{RequireSurrogateControl: true, SurrogateName: "edge"},
+			Header: http.Header{
+				"Content-Type":      {"text/html"},
+				"Surrogate-Control": {`content="ESI/1.0";other`},
+			},
+			Body:         input,
+			ExpectedBody: input,
+			ExpectedHeader: http.Header{
+				"Content-Type":      {"text/html"},
+				"Surrogate-Control": {`content="ESI/1.0";other`},
+			},
+		},
+		{
+			Name:           "error",
+			Header:         http.Header{"Content-Type": {"text/html"}},
+			Body:           `before <esi:include src="/error"/> after`,
+			ExpectedBody:   "before ",
+			ExpectedHeader: http.Header{"Content-Type": {"text/html"}},
+			ExpectedError:  "include failed",
+		},
+		{
+			// The recorder does not support informational responses, so use an include for which no hints are sent.
+			Name:           "early hints",
+			Handler:        esihttp.Handler{EarlyHints: true},
+			Header:         http.Header{"Content-Type": {"text/html"}},
+			Body:           `before <esi:include src="data:,fragment"/> after`,
+			ExpectedBody:   "before fragment after",
+			ExpectedHeader: http.Header{"Content-Type": {"text/html"}},
+		},
+		{
+			Name:           "early hints with parse error",
+			Handler:        esihttp.Handler{EarlyHints: true},
+			Header:         http.Header{"Content-Type": {"text/html"}},
+			Body:           `before <esi:include src="data:,fragment"/> <esi:vars> after`,
+			ExpectedBody:   "before fragment ",
+			ExpectedHeader: http.Header{"Content-Type": {"text/html"}},
+			ExpectedError:  "esi:vars",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			var gotErr error
+
+			h := testCase.Handler
+			h.Processor = proc
+			h.Handler = http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				for name, values := range testCase.Header {
+					w.Header()[name] = values
+				}
+
+				if testCase.Status != 0 {
+					w.WriteHeader(testCase.Status)
+				}
+
+				_, _ = io.WriteString(w, testCase.Body)
+			})
+			h.ErrorHandler = func(_ *http.Request, err error) {
+				gotErr = err
+			}
+
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/page", nil))
+
+			if got := rec.Body.String(); got != testCase.ExpectedBody {
+				t.Errorf("got body %q, want %q", got, testCase.ExpectedBody)
+			}
+
+			if diff := cmp.Diff(testCase.ExpectedHeader, rec.Header()); diff != "" {
+				t.Errorf("header mismatch (-want +got):\n%s", diff)
+			}
+
+			switch {
+			case testCase.ExpectedError == "" && gotErr != nil:
+				t.Errorf("got error %v", gotErr)
+			case testCase.ExpectedError != "" && !strings.Contains(fmt.Sprint(gotErr), testCase.ExpectedError):
+				t.Errorf("got error %v, want error containing %q", gotErr, testCase.ExpectedError)
+			}
+		})
+	}
+}
+
+func TestHandler_SurrogateCapability(t *testing.T) {
+	var got []string
+
+	h := &esihttp.Handler{
+		Handler: http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+			got = r.Header.Values("Surrogate-Capability")
+		}),
+		Processor:     esiproc.New(),
+		SurrogateName: "edge",
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Surrogate-Capability", `other="ESI/1.0"`)
+
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	if want := []string{`other="ESI/1.0"`, `edge="ESI/1.0"`}; !slices.Equal(got, want) {
+		t.Errorf("got Surrogate-Capability %q, want %q", got, want)
+	}
+
+	if got := req.Header.Values("Surrogate-Capability"); len(got) != 1 {
+		t.Errorf("original request was modified: got %q", got)
+	}
+}
+
+func TestHandler_ResultHandler(t *testing.T) {
+	client := esiproc.ClientFunc(func(_ context.Context, urlStr string, _ map[string]string) ([]byte, error) {
+		if urlStr == "/error" {
+			return nil, errors.New("include failed")
+		}
+
+		return []byte(urlStr), nil
+	})
+
+	var body string
+	var results []esiproc.Result
+	var errs []error
+
+	h := &esihttp.Handler{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = io.WriteString(w, body)
+		}),
+		Processor:    esiproc.New(esiproc.WithClient(client)),
+		ErrorHandler: func(*http.Request, error) {},
+		ResultHandler: func(_ *http.Request, res *esiproc.Result, err error) {
+			results = append(results, *res)
+			errs = append(errs, err)
+		},
+	}
+
+	for _, body = range []string{
+		`<esi:include src="/a"/><esi:include src="/error" onerror="continue"/>`,
+		`<esi:include src="/error"/>`,
+	} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/page", nil))
+	}
+
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+
+	if got, want := results[0].Fetched, 2; got != want {
+		t.Errorf("got %d fetched, want %d", got, want)
+	}
+
+	if got, want := len(slices.Collect(results[0].Degraded())), 1; got != want {
+		t.Errorf("got %d degraded includes, want %d", got, want)
+	}
+
+	if errs[0] != nil {
+		t.Errorf("got error %v for first response", errs[0])
+	}
+
+	if errs[1] == nil {
+		t.Error("got no error for second response")
+	}
+}
+
+func TestHandler_EarlyHints(t *testing.T) {
+	client := esiproc.ClientFunc(func(_ context.Context, urlStr string, _ map[string]string) ([]byte, error) {
+		return []byte(urlStr), nil
+	})
+
+	// firstHint is closed when the client received the first hint, which must happen while the response is written.
+	firstHint := make(chan struct{})
+
+	srv := httptest.NewServer(&esihttp.Handler{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = io.WriteString(w, `<esi:include src="/a"/><esi:inc`)
+
+			select {
+			case <-firstHint:
+			case <-time.After(5 * time.Second):
+				t.Error("no early hints received while writing the response")
+			case <-r.Context().Done():
+				return
+			}
+
+			_, _ = io.WriteString(w, `lude src="/b"/><esi:include src="data:,c"/>`)
+		}),
+		Processor:  esiproc.New(esiproc.WithClient(client)),
+		EarlyHints: true,
+	})
+	defer srv.Close()
+
+	var hints [][]string
+
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			if code == http.StatusEarlyHints {
+				hints = append(hints, header.Values("Link"))
+
+				if len(hints) == 1 {
+					close(firstHint)
+				}
+			}
+			return nil
+		},
+	}
+
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(t.Context(), trace), http.MethodGet, srv.URL, nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %s", err)
+	}
+
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read body: %s", err)
+	}
+
+	if got, want := string(body), "/a/bc"; got != want {
+		t.Errorf("got body %q, want %q", got, want)
+	}
+
+	want := [][]string{{"</a>; rel=preload"}, {"</b>; rel=preload"}}
+
+	if diff := cmp.Diff(want, hints); diff != "" {
+		t.Errorf("hints mismatch (-want +got):\n%s", diff)
+	}
+
+	if got := resp.Header.Values("Link"); len(got) != 0 {
+		t.Errorf("got Link headers %q in final response", got)
+	}
+}
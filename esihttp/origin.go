@@ -0,0 +1,177 @@
+package esihttp
+
+import (
+	"context"
+	"crypto/tls"
+	"maps"
+	"net"
+	"net/http"
+)
+
+// Origin configures how connections to the host of an include URL are established.
+//
+// This can be used to route requests for fragments to other addresses than the one given in the URL, for example to
+// a sidecar process listening on a Unix domain socket.
+type Origin struct {
+	// Network is the network used for connecting to the origin, for example "tcp" or "unix".
+	//
+	// If empty, the network requested by the [http.Transport] is used.
+	Network string
+
+	// Address is the address to connect to, for example "127.0.0.1:8080" or the path to a Unix domain socket.
+	//
+	// If empty, the address requested by the [http.Transport] is used.
+	Address string
+
+	// DialContext is used to establish connections to the origin.
+	//
+	// It is called with the network and address after applying Network and Address.
+	//
+	// If nil, a [net.Dialer] with default settings is used.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// TLSConfig is used for HTTPS connections to the origin.
+	//
+	// This can be used to configure client certificates for mutual TLS, custom root CAs or a minimum TLS version per
+	// origin. If the ServerName is empty, the host name from the request is used.
+	//
+	// If nil, the TLSClientConfig of the base transport is used.
+	TLSConfig *tls.Config
+}
+
+func (o *Origin) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if o.Network != "" {
+		network = o.Network
+	}
+
+	if o.Address != "" {
+		addr = o.Address
+	}
+
+	if o.DialContext != nil {
+		return o.DialContext(ctx, network, addr)
+	}
+
+	var d net.Dialer
+	return d.DialContext(ctx, network, addr)
+}
+
+func lookupOrigin(origins map[string]Origin, addr string) (string, *Origin, bool) {
+	if o, ok := origins[addr]; ok {
+		return addr, &o, true
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", nil, false
+	}
+
+	o, ok := origins[host]
+	return host, &o, ok
+}
+
+// OriginTransport is a [http.RoundTripper] that connects to hosts using the corresponding [Origin].
+//
+// See [NewOriginTransport] for details.
+type OriginTransport struct {
+	base    *http.Transport
+	origins map[string]Origin
+
+	// tls contains the transports for origins with a custom TLSConfig, using the same keys as origins.
+	tls map[string]*http.Transport
+}
+
+var _ http.RoundTripper = (*OriginTransport)(nil)
+
+// NewOriginTransport returns a transport based on a copy of base that connects to the hosts in origins using the
+// corresponding [Origin].
+//
+// Keys in origins are either a host name (e.g. "cart-sidecar") or a host name with a port (e.g. "cart-sidecar:8080").
+// Entries with a port take precedence over entries without one. Connections to hosts that are not found in origins
+// are established using the dialer of base.
+//
+// Only the connection is affected. The URL of the request, including the Host header, is not changed. For HTTPS
+// requests the certificate is verified against the host name in the URL, unless a custom [Origin.TLSConfig] with a
+// different ServerName is used.
+//
+// HTTPS requests to origins with a TLSConfig use a separate copy of base that uses the TLSConfig instead of the
+// TLSClientConfig and DialTLSContext of base. All other requests, including requests to hosts without a custom
+// TLSConfig, use the same copy of base and are not affected.
+//
+// If base is nil, [http.DefaultTransport] is used.
+//
+// The returned transport can be used by setting it as the transport of the [http.Client] used for
+// [Client.HTTPClient]:
+//
+//	client := &esihttp.Client{
+//		HTTPClient: &http.Client{
+//			Transport: esihttp.NewOriginTransport(nil, map[string]esihttp.Origin{
+//				"cart-sidecar": {Network: "unix", Address: "/run/cart.sock"},
+//			}),
+//		},
+//	}
+func NewOriginTransport(base *http.Transport, origins map[string]Origin) *OriginTransport {
+	if base == nil {
+		base = http.DefaultTransport.(*http.Transport)
+	}
+
+	t := &OriginTransport{base: base.Clone(), origins: maps.Clone(origins)}
+
+	baseDial := t.base.DialContext
+	if baseDial == nil {
+		var d net.Dialer
+		baseDial = d.DialContext
+	}
+
+	t.base.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if _, o, ok := lookupOrigin(t.origins, addr); ok {
+			return o.dial(ctx, network, addr)
+		}
+
+		return baseDial(ctx, network, addr)
+	}
+
+	for key, o := range t.origins {
+		if o.TLSConfig == nil {
+			continue
+		}
+
+		ot := t.base.Clone()
+		ot.DialTLS = nil //nolint:staticcheck // Must be cleared so that TLSClientConfig is used.
+		ot.DialTLSContext = nil
+		ot.TLSClientConfig = o.TLSConfig.Clone()
+
+		if t.tls == nil {
+			t.tls = make(map[string]*http.Transport)
+		}
+
+		t.tls[key] = ot
+	}
+
+	return t
+}
+
+// CloseIdleConnections closes all idle connections of the underlying transports.
+func (t *OriginTransport) CloseIdleConnections() {
+	t.base.CloseIdleConnections()
+
+	for _, ot := range t.tls {
+		ot.CloseIdleConnections()
+	}
+}
+
+// RoundTrip implements the [http.RoundTripper] interface.
+func (t *OriginTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "https" && len(t.tls) > 0 {
+		addr := req.URL.Host
+		if req.URL.Port() == "" {
+			addr = net.JoinHostPort(req.URL.Hostname(), "443")
+		}
+
+		if key, _, ok := lookupOrigin(t.origins, addr); ok && t.tls[key] != nil {
+			return t.tls[key].RoundTrip(req)
+		}
+	}
+
+	return t.base.RoundTrip(req)
+}
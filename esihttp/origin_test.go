@@ -0,0 +1,283 @@
+package esihttp_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nussjustin/esi/esihttp"
+)
+
+func newUnixServer(t *testing.T, body string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "origin.sock")
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("unix sockets not supported: %s", err)
+	}
+
+	srv := &httptest.Server{
+		Listener: l,
+		Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(body + " " + r.Host + r.URL.Path))
+		})},
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	return path
+}
+
+func TestNewOriginTransport(t *testing.T) {
+	socketPath := newUnixServer(t, "unix")
+
+	tcpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("tcp " + r.Host + r.URL.Path))
+	}))
+	defer tcpSrv.Close()
+
+	var dialed []string
+
+	transport := esihttp.NewOriginTransport(nil, map[string]esihttp.Origin{
+		"cart-sidecar": {Network: "unix", Address: socketPath},
+		"custom:8080": {
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				dialed = append(dialed, addr)
+
+				var d net.Dialer
+				return d.DialContext(ctx, network, tcpSrv.Listener.Addr().String())
+			},
+		},
+	})
+	defer transport.CloseIdleConnections()
+
+	client := &esihttp.Client{HTTPClient: &http.Client{Transport: transport}}
+
+	testCases := []struct {
+		URL      string
+		Expected string
+	}{
+		{URL: "http://cart-sidecar/fragment", Expected: "unix cart-sidecar/fragment"},
+		{URL: "http://cart-sidecar:8080/fragment", Expected: "unix cart-sidecar:8080/fragment"},
+		{URL: "http://custom:8080/fragment", Expected: "tcp custom:8080/fragment"},
+		{URL: tcpSrv.URL + "/fragment", Expected: "tcp " + tcpSrv.Listener.Addr().String() + "/fragment"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.URL, func(t *testing.T) {
+			body, err := client.Do(t.Context(), testCase.URL, nil)
+			if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+
+			if got := string(body); got != testCase.Expected {
+				t.Errorf("got body %q, want %q", got, testCase.Expected)
+			}
+		})
+	}
+
+	if got, want := len(dialed), 1; got != want {
+		t.Errorf("got %d calls to custom dialer, want %d", got, want)
+	} else if dialed[0] != "custom:8080" {
+		t.Errorf("custom dialer called with %q, want %q", dialed[0], "custom:8080")
+	}
+}
+
+func newClientCertificate(t *testing.T) (tls.Certificate, *x509.Certificate) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %s", err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert
+}
+
+func TestNewOriginTransport_TLSConfig(t *testing.T) {
+	clientCert, clientCA := newClientCertificate(t)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCA)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.TLS.ServerName + r.URL.Path))
+	}))
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	srv.StartTLS()
+	defer srv.Close()
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(srv.Certificate())
+
+	srvAddr := srv.Listener.Addr().String()
+
+	testCases := []struct {
+		Name      string
+		Origin    esihttp.Origin
+		Expected  string
+		ExpectErr bool
+	}{
+		{
+			Name: "mTLS",
+			Origin: esihttp.Origin{
+				Address: srvAddr,
+				TLSConfig: &tls.Config{
+					Certificates: []tls.Certificate{clientCert},
+					RootCAs:      rootCAs,
+					ServerName:   "example.com",
+				},
+			},
+			Expected: "example.com/fragment",
+		},
+		{
+			Name: "missing client certificate",
+			Origin: esihttp.Origin{
+				Address:   srvAddr,
+				TLSConfig: &tls.Config{RootCAs: rootCAs, ServerName: "example.com"},
+			},
+			ExpectErr: true,
+		},
+		{
+			Name: "unknown CA",
+			Origin: esihttp.Origin{
+				Address: srvAddr,
+				TLSConfig: &tls.Config{
+					Certificates: []tls.Certificate{clientCert},
+					ServerName:   "example.com",
+				},
+			},
+			ExpectErr: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			transport := esihttp.NewOriginTransport(nil, map[string]esihttp.Origin{"fragments": testCase.Origin})
+			defer transport.CloseIdleConnections()
+
+			client := &esihttp.Client{HTTPClient: &http.Client{Transport: transport}}
+
+			body, err := client.Do(t.Context(), "https://fragments/fragment", nil)
+			if testCase.ExpectErr {
+				if err == nil {
+					t.Error("expected error")
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+
+			if got := string(body); got != testCase.Expected {
+				t.Errorf("got body %q, want %q", got, testCase.Expected)
+			}
+		})
+	}
+}
+
+func TestNewOriginTransport_HTTP2(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Proto))
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	transport := esihttp.NewOriginTransport(srv.Client().Transport.(*http.Transport), map[string]esihttp.Origin{
+		"fragments": {TLSConfig: &tls.Config{ServerName: "example.com"}},
+	})
+	defer transport.CloseIdleConnections()
+
+	client := &esihttp.Client{HTTPClient: &http.Client{Transport: transport}}
+
+	body, err := client.Do(t.Context(), srv.URL+"/fragment", nil)
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	if got, want := string(body), "HTTP/2.0"; got != want {
+		t.Errorf("got protocol %q, want %q", got, want)
+	}
+}
+
+func TestNewOriginTransport_TLSHandshakeTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer func() { _ = l.Close() }()
+
+	// Accept connections, but never complete the handshake.
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			t.Cleanup(func() { _ = conn.Close() })
+		}
+	}()
+
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	base.TLSHandshakeTimeout = 10 * time.Millisecond
+
+	transport := esihttp.NewOriginTransport(base, map[string]esihttp.Origin{
+		"fragments": {TLSConfig: &tls.Config{ServerName: "example.com"}},
+	})
+	defer transport.CloseIdleConnections()
+
+	client := &esihttp.Client{HTTPClient: &http.Client{Transport: transport}}
+
+	ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+	defer cancel()
+
+	_, err = client.Do(ctx, "https://"+l.Addr().String()+"/fragment", nil)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	if !strings.Contains(err.Error(), "TLS handshake timeout") {
+		t.Errorf("got error %v, want TLS handshake timeout", err)
+	}
+}
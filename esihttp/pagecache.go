@@ -0,0 +1,504 @@
+package esihttp
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"iter"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/nussjustin/esi"
+	"github.com/nussjustin/esi/esiexpr"
+	"github.com/nussjustin/esi/esiproc"
+)
+
+// DefaultPageCacheMaxEntrySize is the default value for [PageCache.MaxEntrySize].
+const DefaultPageCacheMaxEntrySize = 1 << 20
+
+// DefaultPageCacheMaxEntries is the default value for [PageCache.MaxEntries].
+const DefaultPageCacheMaxEntries = 1024
+
+// PageCache caches the processed output of whole pages for a [Handler], so that on a cache hit the page is neither
+// parsed nor processed.
+//
+// Entries are keyed by the URL of the request, the validators (ETag and Last-Modified) of the response of the
+// wrapped handler and the values of all variables used by the page for the current request. The variables are
+// determined by analysing the src and alt attributes of esi:include elements, the test attributes of esi:when
+// elements and the content of esi:vars elements using [PageCache.Env].
+//
+// Only responses to GET requests with at least one validator are cached. The output is only cached if processing
+// succeeded without using fallback content (see [esiproc.Result.Degraded]) and if its size does not exceed
+// [PageCache.MaxEntrySize].
+//
+// The lifetime of an entry is the smallest remaining lifetime of the page, as given by [ResponseFreshness], and of all
+// fragments fetched by a [Client], as recorded by a [FreshnessRecorder]. Pages for which neither the page nor any
+// fragment has an explicit lifetime are not cached.
+//
+// Since only variables are considered, the output of a page must not depend on anything else, for example on
+// headers forwarded by [Client.BeforeRequest] or on custom functions used in expressions.
+//
+// Variables whose values are not deterministic are handled as follows:
+//
+//   - [esiproc.VarIncludeStatus] is not part of the vary key. Like the content of the fragments, the status of
+//     includes is part of the cached output.
+//   - Pages using [esiexpr.VarRand] are only cached if the context has a seed (see [esiexpr.WithRandSeed]), since
+//     the value is otherwise different for each lookup.
+//
+// Other variables provided by Env must return the same value for all lookups using the same request.
+//
+// Requests for which debug comments are enabled (see [esiproc.Processor.DebugComments]) are neither served from nor
+// stored in the cache.
+//
+// PageCache is safe for concurrent use. A PageCache must not be copied after first use.
+type PageCache struct {
+	// Env is used to determine the variables used by a page and to look up their values. It should use the same
+	// variables as the environment used by the [esiproc.Processor].
+	//
+	// If nil, no pages are cached.
+	Env *esiexpr.Env
+
+	// MaxEntrySize is the maximum size of the processed output of a page in bytes. Larger pages are not cached.
+	//
+	// If <= 0, [DefaultPageCacheMaxEntrySize] is used.
+	MaxEntrySize int
+
+	// MaxEntries is the maximum number of cached outputs over all pages. If the cache is full, expired entries are
+	// removed. If the cache is still full afterward, the output is not cached.
+	//
+	// If <= 0, [DefaultPageCacheMaxEntries] is used.
+	MaxEntries int
+
+	// MaxTTL limits the time for which an entry is cached.
+	//
+	// If <= 0, the time is only limited by the freshness of the page and its fragments.
+	MaxTTL time.Duration
+
+	// Now returns the current time.
+	//
+	// If nil, [time.Now] is used.
+	Now func() time.Time
+
+	mu      sync.Mutex
+	pages   map[string]*cachedPage
+	entries int
+}
+
+// cachedPage contains the variables used by a page and the cached outputs by vary key.
+type cachedPage struct {
+	refs    []esiexpr.VarRef
+	outputs map[string]cachedOutput
+}
+
+type cachedOutput struct {
+	body    []byte
+	expires time.Time
+}
+
+// pageInfo contains information about a captured response needed for caching.
+type pageInfo struct {
+	key       string
+	freshness Freshness
+}
+
+// Len returns the number of cached outputs, including expired ones that were not yet removed.
+func (c *PageCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.entries
+}
+
+// Purge removes all entries from the cache.
+func (c *PageCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pages, c.entries = nil, 0
+}
+
+func (c *PageCache) now() time.Time {
+	if c.Now == nil {
+		return time.Now()
+	}
+
+	return c.Now()
+}
+
+// page returns the information needed for caching the response with the given header for r.
+//
+// If the response can not be cached, the second return value is false.
+func (c *PageCache) page(r *http.Request, header http.Header) (pageInfo, bool) {
+	if c.Env == nil || r.Method != http.MethodGet {
+		return pageInfo{}, false
+	}
+
+	etag, lastModified := header.Get("ETag"), header.Get("Last-Modified")
+	if etag == "" && lastModified == "" {
+		return pageInfo{}, false
+	}
+
+	f := ResponseFreshness(&http.Response{Header: header}, c.now())
+	if f.Explicit && f.TTL() == 0 {
+		return pageInfo{}, false
+	}
+
+	return pageInfo{key: requestURL(r).String() + "\x00" + etag + "\x00" + lastModified, freshness: f}, true
+}
+
+// process writes the cached output for the page to w or, if there is none, processes the parsed nodes of the page
+// using proc and caches the output if possible.
+func (c *PageCache) process(
+	ctx context.Context,
+	w io.Writer,
+	page pageInfo,
+	proc *esiproc.Processor,
+	parsed iter.Seq2[esi.Node, error],
+) error {
+	if out, ok := c.lookup(ctx, page.key); ok {
+		_, err := proc.WriteOutput(ctx, w, out)
+		return err
+	}
+
+	var nodes esi.Nodes
+
+	for node, err := range parsed {
+		if err != nil {
+			return err
+		}
+
+		nodes = append(nodes, node)
+	}
+
+	rec := &FreshnessRecorder{}
+
+	if parent := freshnessRecorder(ctx); parent != nil {
+		defer func() {
+			for _, f := range rec.Fragments() {
+				parent.Record(f)
+			}
+		}()
+	}
+
+	out := &cacheWriter{w: w, limit: c.maxEntrySize()}
+
+	res, err := proc.ProcessResult(WithFreshnessRecorder(ctx, rec), out, nodes.All())
+	if err != nil {
+		return err
+	}
+
+	for range res.Degraded() {
+		return nil
+	}
+
+	if out.exceeded {
+		return nil
+	}
+
+	ttl, ok := mergeTTL(page.freshness, rec)
+	if !ok {
+		return nil
+	}
+
+	if c.MaxTTL > 0 {
+		ttl = min(ttl, c.MaxTTL)
+	}
+
+	refs, err := c.varRefs(nil, nodes, false)
+	if err != nil {
+		return nil
+	}
+
+	// Without a seed, each lookup of the variable returns a new random value, so the page would never be found again.
+	if _, ok := esiexpr.RandSeed(ctx); !ok && slices.ContainsFunc(refs, isRandRef) {
+		return nil
+	}
+
+	varyKey, err := c.varyKey(ctx, refs)
+	if err != nil {
+		return nil
+	}
+
+	c.store(page.key, refs, varyKey, cachedOutput{body: out.buf, expires: c.now().Add(ttl)})
+
+	return nil
+}
+
+// mergeTTL returns the smallest TTL of the page and the recorded fragments with an explicit lifetime.
+//
+// If the TTL is 0 or neither the page nor any fragment has an explicit lifetime, the second return value is false.
+func mergeTTL(page Freshness, rec *FreshnessRecorder) (time.Duration, bool) {
+	ttl, ok := rec.TTL()
+
+	if page.Explicit && (!ok || page.TTL() < ttl) {
+		ttl, ok = page.TTL(), true
+	}
+
+	return ttl, ok && ttl > 0
+}
+
+func (c *PageCache) maxEntrySize() int {
+	if c.MaxEntrySize <= 0 {
+		return DefaultPageCacheMaxEntrySize
+	}
+
+	return c.MaxEntrySize
+}
+
+func (c *PageCache) maxEntries() int {
+	if c.MaxEntries <= 0 {
+		return DefaultPageCacheMaxEntries
+	}
+
+	return c.MaxEntries
+}
+
+// lookup returns the cached output for the page with the given key for the current request.
+func (c *PageCache) lookup(ctx context.Context, key string) ([]byte, bool) {
+	c.mu.Lock()
+	page := c.pages[key]
+	c.mu.Unlock()
+
+	if page == nil {
+		return nil, false
+	}
+
+	varyKey, err := c.varyKey(ctx, page.refs)
+	if err != nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	out, ok := page.outputs[varyKey]
+	if !ok || !c.now().Before(out.expires) {
+		return nil, false
+	}
+
+	return out.body, true
+}
+
+// store adds the output for the page with the given key and vary key to the cache.
+func (c *PageCache) store(key string, refs []esiexpr.VarRef, varyKey string, out cachedOutput) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries >= c.maxEntries() {
+		c.removeExpired()
+	}
+
+	page := c.pages[key]
+
+	var replace bool
+	if page != nil {
+		_, replace = page.outputs[varyKey]
+	}
+
+	if !replace && c.entries >= c.maxEntries() {
+		return
+	}
+
+	if c.pages == nil {
+		c.pages = make(map[string]*cachedPage)
+	}
+
+	if page == nil {
+		page = &cachedPage{refs: refs, outputs: make(map[string]cachedOutput)}
+		c.pages[key] = page
+	}
+
+	if !replace {
+		c.entries++
+	}
+
+	page.outputs[varyKey] = out
+}
+
+// removeExpired removes all expired outputs and pages without outputs. c.mu must be held.
+func (c *PageCache) removeExpired() {
+	now := c.now()
+
+	for key, page := range c.pages {
+		for varyKey, out := range page.outputs {
+			if !now.Before(out.expires) {
+				delete(page.outputs, varyKey)
+				c.entries--
+			}
+		}
+
+		if len(page.outputs) == 0 {
+			delete(c.pages, key)
+		}
+	}
+}
+
+// varRefs appends the references of all variables used by nodes to refs.
+//
+// If inVars is true, the nodes are inside an esi:vars element.
+func (c *PageCache) varRefs(refs []esiexpr.VarRef, nodes []esi.Node, inVars bool) ([]esiexpr.VarRef, error) {
+	var err error
+
+	for _, node := range nodes {
+		switch v := node.(type) {
+		case *esi.AttemptElement:
+			refs, err = c.varRefs(refs, v.Nodes, inVars)
+		case *esi.ChooseElement:
+			for _, when := range v.When {
+				if refs, err = c.appendVarRefs(refs, c.Env.VarRefs, when.Test); err != nil {
+					return nil, err
+				}
+
+				if refs, err = c.varRefs(refs, when.Nodes, inVars); err != nil {
+					return nil, err
+				}
+			}
+
+			if v.Otherwise != nil {
+				refs, err = c.varRefs(refs, v.Otherwise.Nodes, inVars)
+			}
+		case *esi.Comment:
+			refs, err = c.varRefs(refs, v.Nodes, inVars)
+		case *esi.ExceptElement:
+			refs, err = c.varRefs(refs, v.Nodes, inVars)
+		case *esi.IncludeElement:
+			if refs, err = c.appendVarRefs(refs, c.Env.InterpolationVarRefs, v.Source); err == nil {
+				refs, err = c.appendVarRefs(refs, c.Env.InterpolationVarRefs, v.Alt)
+			}
+		case *esi.InlineElement:
+			refs, err = c.varRefs(refs, v.Nodes, inVars)
+		case *esi.RawData:
+			if inVars {
+				refs, err = c.appendVarRefs(refs, c.Env.InterpolationVarRefs, string(v.Bytes))
+			}
+		case *esi.TryElement:
+			if v.Attempt != nil {
+				if refs, err = c.varRefs(refs, v.Attempt.Nodes, inVars); err != nil {
+					return nil, err
+				}
+			}
+
+			if v.Except != nil {
+				refs, err = c.varRefs(refs, v.Except.Nodes, inVars)
+			}
+		case *esi.VarsElement:
+			refs, err = c.varRefs(refs, v.Nodes, true)
+		case *esi.XMLComment:
+			refs, err = c.varRefs(refs, v.Nodes, inVars)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return refs, nil
+}
+
+// appendVarRefs appends the references returned by f for s to refs, skipping references already in refs.
+func (c *PageCache) appendVarRefs(
+	refs []esiexpr.VarRef,
+	f func(string) ([]esiexpr.VarRef, error),
+	s string,
+) ([]esiexpr.VarRef, error) {
+	if s == "" {
+		return refs, nil
+	}
+
+	found, err := f(s)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ref := range found {
+		// The status of includes is part of the processed output, like the content of the fragments, and is not
+		// known before processing.
+		if ref.Name == esiproc.VarIncludeStatus {
+			continue
+		}
+
+		if !slices.Contains(refs, ref) {
+			refs = append(refs, ref)
+		}
+	}
+
+	return refs, nil
+}
+
+func isRandRef(ref esiexpr.VarRef) bool {
+	return ref.Name == esiexpr.VarRand
+}
+
+// varyKey returns a key for the values of the given variables in ctx.
+func (c *PageCache) varyKey(ctx context.Context, refs []esiexpr.VarRef) (string, error) {
+	if len(refs) == 0 {
+		return "", nil
+	}
+
+	values, err := c.Env.LookupRefs(ctx, refs)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+
+	for _, v := range values {
+		_, _ = fmt.Fprintf(h, "%T %#v\n", v, v)
+	}
+
+	return string(h.Sum(nil)), nil
+}
+
+// cacheWriter writes to another writer and collects the written data up to a limit.
+//
+// Flushing and write deadlines are forwarded to the underlying writer, so that [esiproc.WithFlush] and
+// [esiproc.WithWriteTimeout] work as when writing to it directly.
+type cacheWriter struct {
+	w        io.Writer
+	buf      []byte
+	limit    int
+	exceeded bool
+}
+
+// FlushError flushes the underlying writer, if supported.
+func (c *cacheWriter) FlushError() error {
+	switch f := c.w.(type) {
+	case interface{ FlushError() error }:
+		return f.FlushError()
+	case http.Flusher:
+		f.Flush()
+	}
+
+	return nil
+}
+
+// SetWriteDeadline sets the write deadline of the underlying writer, if supported.
+//
+// If the underlying writer does not support deadlines, [http.ErrNotSupported] is returned.
+func (c *cacheWriter) SetWriteDeadline(t time.Time) error {
+	if d, ok := c.w.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		return d.SetWriteDeadline(t)
+	}
+
+	return http.ErrNotSupported
+}
+
+// Write implements the [io.Writer] interface.
+//
+// Once the limit is exceeded, the collected data is discarded.
+func (c *cacheWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+
+	switch {
+	case c.exceeded:
+	case len(c.buf)+n > c.limit:
+		c.buf, c.exceeded = nil, true
+	default:
+		c.buf = append(c.buf, p[:n]...)
+	}
+
+	return n, err
+}
@@ -0,0 +1,441 @@
+package esihttp_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nussjustin/esi/esiexpr"
+	"github.com/nussjustin/esi/esihttp"
+	"github.com/nussjustin/esi/esiproc"
+)
+
+var debugCommentsRegexp = regexp.MustCompile(`<!-- /?esi:include .*? -->`)
+
+func TestHandler_Cache(t *testing.T) {
+	const page = `<esi:include src="/fragment?id=$(QUERY_STRING{id})"/>` +
+		`<esi:vars>|$(HTTP_COOKIE{user})</esi:vars>` +
+		`<esi:include src="/optional" onerror="continue"/>`
+
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var fetched int
+	var failOptional bool
+
+	client := esiproc.ClientFunc(func(_ context.Context, urlStr string, _ map[string]string) ([]byte, error) {
+		fetched++
+
+		if strings.HasSuffix(urlStr, "/optional") {
+			if failOptional {
+				return nil, errors.New("failed")
+			}
+
+			return nil, nil
+		}
+
+		return []byte("fragment:" + urlStr), nil
+	})
+
+	env := esihttp.NewEnv(nil)
+
+	cache := &esihttp.PageCache{
+		Env: env,
+		Now: func() time.Time { return now },
+	}
+
+	header := http.Header{
+		"Cache-Control": {"max-age=60"},
+		"Content-Type":  {"text/html"},
+		"Etag":          {`"v1"`},
+	}
+
+	handler := &esihttp.Handler{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for name, values := range header {
+				w.Header()[name] = values
+			}
+
+			_, _ = io.WriteString(w, page)
+		}),
+		Processor: esiproc.New(
+			esiproc.WithClient(client),
+			esiproc.WithInterpolateFunc(env.Interpolate),
+			esiproc.WithDebugComments(esihttp.DebugEnabled("", "secret")),
+		),
+		Cache: cache,
+	}
+
+	serve := func(method, target, cookie string, debug bool) string {
+		t.Helper()
+
+		r := httptest.NewRequest(method, target, nil)
+		if cookie != "" {
+			r.Header.Set("Cookie", cookie)
+		}
+
+		if debug {
+			r.Header.Set(esihttp.DefaultDebugHeader, "secret")
+		}
+
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, r)
+
+		return w.Body.String()
+	}
+
+	steps := []struct {
+		Name     string
+		Method   string
+		Target   string
+		Cookie   string
+		Debug    bool
+		Before   func()
+		Expected string
+		Fetched  int
+		Len      int
+	}{
+		{
+			Name:     "miss",
+			Target:   "/page?id=1",
+			Cookie:   "user=a",
+			Expected: "fragment:/fragment?id=1|a",
+			Fetched:  2,
+			Len:      1,
+		},
+		{
+			Name:     "hit",
+			Target:   "/page?id=1",
+			Cookie:   "user=a",
+			Expected: "fragment:/fragment?id=1|a",
+			Len:      1,
+		},
+		{
+			Name:     "hit with unused cookie",
+			Target:   "/page?id=1",
+			Cookie:   "user=a; other=b",
+			Expected: "fragment:/fragment?id=1|a",
+			Len:      1,
+		},
+		{
+			Name:     "miss with other variable value",
+			Target:   "/page?id=1",
+			Cookie:   "user=b",
+			Expected: "fragment:/fragment?id=1|b",
+			Fetched:  2,
+			Len:      2,
+		},
+		{
+			Name:     "miss with other URL",
+			Target:   "/page?id=2",
+			Cookie:   "user=a",
+			Expected: "fragment:/fragment?id=2|a",
+			Fetched:  2,
+			Len:      3,
+		},
+		{
+			Name:     "not cached for other methods",
+			Method:   http.MethodPost,
+			Target:   "/page?id=1",
+			Cookie:   "user=a",
+			Expected: "fragment:/fragment?id=1|a",
+			Fetched:  2,
+			Len:      3,
+		},
+		{
+			Name:     "miss after validator changed",
+			Target:   "/page?id=1",
+			Cookie:   "user=a",
+			Before:   func() { header.Set("ETag", `"v2"`) },
+			Expected: "fragment:/fragment?id=1|a",
+			Fetched:  2,
+			Len:      4,
+		},
+		{
+			Name:     "miss after expiration",
+			Target:   "/page?id=1",
+			Cookie:   "user=a",
+			Before:   func() { now = now.Add(time.Minute) },
+			Expected: "fragment:/fragment?id=1|a",
+			Fetched:  2,
+			Len:      4,
+		},
+		{
+			Name:     "degraded output is not cached",
+			Target:   "/page?id=3",
+			Before:   func() { failOptional = true },
+			Expected: "fragment:/fragment?id=3|",
+			Fetched:  2,
+			Len:      4,
+		},
+		{
+			Name:   "not cached without validators",
+			Target: "/page?id=4",
+			Before: func() {
+				failOptional = false
+				header.Del("ETag")
+			},
+			Expected: "fragment:/fragment?id=4|",
+			Fetched:  2,
+			Len:      4,
+		},
+		{
+			Name:   "not cached without lifetime",
+			Target: "/page?id=4",
+			Before: func() {
+				header.Set("ETag", `"v2"`)
+				header.Set("Cache-Control", "no-cache")
+			},
+			Expected: "fragment:/fragment?id=4|",
+			Fetched:  2,
+			Len:      4,
+		},
+		{
+			Name:     "debug request is not cached",
+			Target:   "/page?id=5",
+			Debug:    true,
+			Before:   func() { header.Set("Cache-Control", "max-age=60") },
+			Expected: "fragment:/fragment?id=5|",
+			Fetched:  2,
+			Len:      4,
+		},
+		{
+			Name:     "miss after debug request",
+			Target:   "/page?id=5",
+			Expected: "fragment:/fragment?id=5|",
+			Fetched:  2,
+			Len:      5,
+		},
+		{
+			Name:     "debug request is not served from cache",
+			Target:   "/page?id=5",
+			Debug:    true,
+			Expected: "fragment:/fragment?id=5|",
+			Fetched:  2,
+			Len:      5,
+		},
+		{
+			Name:     "hit after debug request",
+			Target:   "/page?id=5",
+			Expected: "fragment:/fragment?id=5|",
+			Len:      5,
+		},
+	}
+
+	for _, step := range steps {
+		if step.Before != nil {
+			step.Before()
+		}
+
+		method := step.Method
+		if method == "" {
+			method = http.MethodGet
+		}
+
+		fetched = 0
+
+		got := serve(method, step.Target, step.Cookie, step.Debug)
+
+		if hasComments := debugCommentsRegexp.MatchString(got); hasComments != step.Debug {
+			t.Errorf("%s: got debug comments %t, want %t", step.Name, hasComments, step.Debug)
+		}
+
+		if got := debugCommentsRegexp.ReplaceAllString(got, ""); got != step.Expected {
+			t.Errorf("%s: got %q, want %q", step.Name, got, step.Expected)
+		}
+
+		if fetched != step.Fetched {
+			t.Errorf("%s: got %d fetches, want %d", step.Name, fetched, step.Fetched)
+		}
+
+		if got := cache.Len(); got != step.Len {
+			t.Errorf("%s: got %d entries, want %d", step.Name, got, step.Len)
+		}
+	}
+
+	cache.Purge()
+
+	if got := cache.Len(); got != 0 {
+		t.Errorf("got %d entries after purge, want 0", got)
+	}
+}
+
+func TestHandler_Cache_Limits(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// processed counts the number of processed pages.
+	var processed int
+
+	newHandler := func(cache *esihttp.PageCache) *esihttp.Handler {
+		interpolate := func(ctx context.Context, s string) (string, error) {
+			processed++
+			return cache.Env.Interpolate(ctx, s)
+		}
+
+		return &esihttp.Handler{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html")
+				w.Header().Set("Last-Modified", "Wed, 01 Jan 2025 00:00:00 GMT")
+				w.Header().Set("Surrogate-Control", "max-age=60")
+
+				_, _ = io.WriteString(w, `<esi:vars>`+r.URL.Path+`</esi:vars>`)
+			}),
+			Processor: esiproc.New(esiproc.WithInterpolateFunc(interpolate)),
+			Cache:     cache,
+		}
+	}
+
+	serve := func(h http.Handler, target string) {
+		t.Helper()
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+
+		if got, want := w.Body.String(), target; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+
+		if w.Header().Get("Surrogate-Control") != "" {
+			t.Error("Surrogate-Control header was not removed")
+		}
+	}
+
+	t.Run("MaxEntries", func(t *testing.T) {
+		cache := &esihttp.PageCache{
+			Env:        esihttp.NewEnv(nil),
+			MaxEntries: 2,
+			Now:        func() time.Time { return now },
+		}
+
+		h := newHandler(cache)
+
+		serve(h, "/a")
+		serve(h, "/b")
+		serve(h, "/c")
+
+		if got := cache.Len(); got != 2 {
+			t.Errorf("got %d entries, want 2", got)
+		}
+
+		now = now.Add(time.Minute)
+
+		serve(h, "/c")
+
+		if got := cache.Len(); got != 1 {
+			t.Errorf("got %d entries after expiration, want 1", got)
+		}
+	})
+
+	t.Run("MaxEntrySize", func(t *testing.T) {
+		cache := &esihttp.PageCache{
+			Env:          esihttp.NewEnv(nil),
+			MaxEntrySize: 4,
+			Now:          func() time.Time { return now },
+		}
+
+		h := newHandler(cache)
+
+		serve(h, "/abc")
+		serve(h, "/abcd")
+
+		if got := cache.Len(); got != 1 {
+			t.Errorf("got %d entries, want 1", got)
+		}
+	})
+
+	t.Run("MaxTTL", func(t *testing.T) {
+		cache := &esihttp.PageCache{
+			Env:    esihttp.NewEnv(nil),
+			MaxTTL: time.Second,
+			Now:    func() time.Time { return now },
+		}
+
+		h := newHandler(cache)
+
+		processed = 0
+
+		serve(h, "/a")
+		serve(h, "/a")
+
+		now = now.Add(time.Second)
+
+		serve(h, "/a")
+
+		if processed != 2 {
+			t.Errorf("got %d processed pages, want 2", processed)
+		}
+	})
+}
+
+func TestHandler_Cache_Variables(t *testing.T) {
+	const page = `<esi:include src="/a" name="a"/><esi:vars>|$(INCLUDE_STATUS{a})|$(RAND{1000000})</esi:vars>`
+
+	var fetched int
+
+	client := esiproc.ClientFunc(func(ctx context.Context, urlStr string, _ map[string]string) ([]byte, error) {
+		fetched++
+		esiproc.ReportStatus(ctx, http.StatusOK)
+		return []byte(urlStr), nil
+	})
+
+	env := esihttp.NewEnv(&esihttp.EnvConfig{LookupVar: esiexpr.RandVars(esiproc.IncludeStatusVars(nil))})
+
+	cache := &esihttp.PageCache{Env: env}
+
+	h := &esihttp.Handler{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Content-Type", "text/html")
+			w.Header().Set("ETag", `"v1"`)
+
+			_, _ = io.WriteString(w, page)
+		}),
+		Processor: esiproc.New(esiproc.WithClient(client), esiproc.WithInterpolateFunc(env.Interpolate)),
+		Cache:     cache,
+	}
+
+	serve := func(ctx context.Context) string {
+		t.Helper()
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, httptest.NewRequestWithContext(ctx, http.MethodGet, "/page", nil))
+
+		if got := w.Body.String(); !strings.HasPrefix(got, "/a|200|") {
+			t.Errorf("got %q, want output with include status", got)
+		}
+
+		return w.Body.String()
+	}
+
+	serve(t.Context())
+
+	if got := cache.Len(); got != 0 {
+		t.Errorf("got %d entries without seed, want 0", got)
+	}
+
+	seeded := esiexpr.WithRandSeed(t.Context(), 1)
+
+	first := serve(seeded)
+
+	fetched = 0
+
+	if got := serve(seeded); got != first {
+		t.Errorf("got %q from cache, want %q", got, first)
+	}
+
+	if fetched != 0 {
+		t.Errorf("got %d fetches for cached page, want 0", fetched)
+	}
+
+	if got := cache.Len(); got != 1 {
+		t.Errorf("got %d entries with seed, want 1", got)
+	}
+}
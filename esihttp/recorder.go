@@ -0,0 +1,241 @@
+package esihttp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/nussjustin/esi/internal/diag"
+)
+
+// UnknownRecordingError is returned by [Recorder.Do] in [RecordModeReplay] when no recording exists for a request.
+type UnknownRecordingError struct {
+	// Method is the method of the request.
+	Method string
+
+	// URL is the URL of the request.
+	URL string
+}
+
+// Code returns a machine-readable code identifying the type of the error.
+func (*UnknownRecordingError) Code() string {
+	return "esihttp.unknown_recording"
+}
+
+// Error returns a human-readable error message.
+func (u *UnknownRecordingError) Error() string {
+	return fmt.Sprintf("no recording for %s %s", u.Method, u.URL)
+}
+
+// Is returns true if the given error matches the receiver.
+func (u *UnknownRecordingError) Is(err error) bool {
+	var o *UnknownRecordingError
+	return errors.As(err, &o) && o.Method == u.Method && o.URL == u.URL
+}
+
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (u *UnknownRecordingError) MarshalJSON() ([]byte, error) {
+	return diag.Marshal(u, diag.Diagnostic{Details: map[string]any{"method": u.Method, "url": u.URL}})
+}
+
+// RecordMode specifies whether a [Recorder] records or replays responses.
+type RecordMode int
+
+const (
+	// RecordModeReplay serves responses from existing recordings and fails for requests without a recording.
+	RecordModeReplay RecordMode = iota
+
+	// RecordModeRecord sends requests using the underlying client and records all responses.
+	RecordModeRecord
+)
+
+// Recording contains a single recorded response.
+//
+// Recordings are stored as JSON, one file per method and URL. This allows creating or modifying recordings by hand.
+type Recording struct {
+	// Method is the method of the recorded request.
+	Method string `json:"method"`
+
+	// URL is the URL of the recorded request.
+	URL string `json:"url"`
+
+	// StatusCode is the status code of the response.
+	StatusCode int `json:"status_code"`
+
+	// Header contains the headers of the response.
+	Header http.Header `json:"header,omitempty"`
+
+	// Body is the body of the response, if it is valid UTF-8.
+	Body string `json:"body,omitempty"`
+
+	// BodyBase64 is the body of the response, if it is not valid UTF-8.
+	//
+	// When encoded as JSON, the body is encoded using base64.
+	BodyBase64 []byte `json:"body_base64,omitempty"`
+}
+
+// Recorder is an [HTTPClient] that records responses to a directory and replays them later.
+//
+// This can be used to make tests that process documents with includes hermetic, by recording the responses once and
+// replaying them afterward.
+//
+// Recordings are identified by the method and URL of the request. Other parts of the request, like headers, are
+// ignored when looking up recordings.
+type Recorder struct {
+	// Dir is the directory containing the recordings.
+	Dir string
+
+	// Mode specifies whether requests are recorded or replayed.
+	Mode RecordMode
+
+	// HTTPClient is used to make HTTP requests in [RecordModeRecord].
+	//
+	// If nil, [http.DefaultClient] is used.
+	HTTPClient HTTPClient
+}
+
+var _ HTTPClient = (*Recorder)(nil)
+
+// Do implements the [HTTPClient] interface.
+//
+// In [RecordModeRecord] the request is sent using the underlying client and the response is written to the
+// directory, replacing any existing recording for the request. Failed requests are not recorded.
+//
+// In [RecordModeReplay] the response is read from the directory. If no recording exists, an [UnknownRecordingError] is
+// returned.
+func (r *Recorder) Do(req *http.Request) (*http.Response, error) {
+	switch r.Mode {
+	case RecordModeRecord:
+		return r.record(req)
+	case RecordModeReplay:
+		return r.replay(req)
+	default:
+		return nil, fmt.Errorf("invalid record mode %d", r.Mode)
+	}
+}
+
+func (r *Recorder) path(req *http.Request) string {
+	sum := sha256.Sum256([]byte(req.Method + " " + req.URL.String()))
+	return filepath.Join(r.Dir, hex.EncodeToString(sum[:16])+".json")
+}
+
+func (r *Recorder) record(req *http.Request) (*http.Response, error) {
+	client := r.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	rec := Recording{
+		Method:     req.Method,
+		URL:        req.URL.String(),
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+	}
+
+	if utf8.Valid(body) {
+		rec.Body = string(body)
+	} else {
+		rec.BodyBase64 = body
+	}
+
+	data, err := json.MarshalIndent(rec, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeFileAtomic(r.path(req), data); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+func (r *Recorder) replay(req *http.Request) (*http.Response, error) {
+	data, err := os.ReadFile(r.path(req))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, &UnknownRecordingError{Method: req.Method, URL: req.URL.String()}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var rec Recording
+
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, fmt.Errorf("failed to decode recording for %s %s: %w", req.Method, req.URL, err)
+	}
+
+	body := rec.BodyBase64
+	if body == nil {
+		body = []byte(rec.Body)
+	}
+
+	header := rec.Header
+	if header == nil {
+		header = make(http.Header)
+	}
+
+	return &http.Response{
+		Status:        strconv.Itoa(rec.StatusCode) + " " + http.StatusText(rec.StatusCode),
+		StatusCode:    rec.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// writeFileAtomic writes data to a temporary file and renames it to name, so that concurrent readers never see a
+// partially written file.
+func writeFileAtomic(name string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(name), ".recording-*")
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+
+	if err := os.Rename(f.Name(), name); err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,136 @@
+package esihttp_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/nussjustin/esi/esihttp"
+)
+
+func TestRecorder(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/text":
+			w.Header().Set("X-Test", "text")
+			_, _ = w.Write([]byte("hello world"))
+		case "/binary":
+			_, _ = w.Write([]byte{0xff, 0x00, 0xfe})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	dir := t.TempDir()
+
+	fetch := func(t *testing.T, mode esihttp.RecordMode, path string) ([]byte, error) {
+		t.Helper()
+
+		recorder := &esihttp.Recorder{Dir: dir, Mode: mode, HTTPClient: srv.Client()}
+
+		client := &esihttp.Client{HTTPClient: recorder}
+
+		return client.Do(context.Background(), srv.URL+path, nil)
+	}
+
+	for _, path := range []string{"/text", "/binary", "/missing"} {
+		_, _ = fetch(t, esihttp.RecordModeRecord, path)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read directory: %v", err)
+	}
+
+	if got, want := len(entries), 3; got != want {
+		t.Errorf("got %d recordings, want %d", got, want)
+	}
+
+	// Make sure the server is not used anymore.
+	srv.Close()
+
+	testCases := []struct {
+		Name          string
+		Path          string
+		Expected      []byte
+		ExpectedError error
+	}{
+		{
+			Name:     "text",
+			Path:     "/text",
+			Expected: []byte("hello world"),
+		},
+		{
+			Name:     "binary",
+			Path:     "/binary",
+			Expected: []byte{0xff, 0x00, 0xfe},
+		},
+		{
+			Name:          "error status",
+			Path:          "/missing",
+			ExpectedError: &esihttp.ClientError{StatusCode: http.StatusNotFound},
+		},
+		{
+			Name:          "unknown",
+			Path:          "/unknown",
+			ExpectedError: &esihttp.UnknownRecordingError{Method: http.MethodGet, URL: srv.URL + "/unknown"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			got, err := fetch(t, esihttp.RecordModeReplay, testCase.Path)
+
+			if !errors.Is(err, testCase.ExpectedError) {
+				t.Errorf("got error %v, want %v", err, testCase.ExpectedError)
+			}
+
+			if diff := cmp.Diff(testCase.Expected, got); diff != "" {
+				t.Errorf("body mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRecorder_Header(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("X-Test", "value")
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(srv.Close)
+
+	dir := t.TempDir()
+
+	req := httptest.NewRequest(http.MethodGet, srv.URL, nil)
+	req.RequestURI = ""
+
+	recorder := &esihttp.Recorder{Dir: dir, Mode: esihttp.RecordModeRecord, HTTPClient: srv.Client()}
+
+	resp, err := recorder.Do(req)
+	if err != nil {
+		t.Fatalf("failed to record: %v", err)
+	}
+	_ = resp.Body.Close()
+
+	recorder.Mode = esihttp.RecordModeReplay
+
+	resp, err = recorder.Do(req)
+	if err != nil {
+		t.Fatalf("failed to replay: %v", err)
+	}
+	_ = resp.Body.Close()
+
+	if got, want := resp.StatusCode, http.StatusAccepted; got != want {
+		t.Errorf("got status %d, want %d", got, want)
+	}
+
+	if got, want := resp.Header.Get("X-Test"), "value"; got != want {
+		t.Errorf("got header %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,216 @@
+package esihttp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// ExpiresHeader is the header used by [HMACSigner] for the expiry of signatures.
+	ExpiresHeader = "X-Esi-Expires"
+
+	// ExpiresParam is the query parameter used by [HMACSigner] for the expiry of signatures if InQuery is true.
+	ExpiresParam = "esi_expires"
+
+	// SignatureHeader is the header used by [HMACSigner] for signatures.
+	SignatureHeader = "X-Esi-Signature"
+
+	// SignatureParam is the query parameter used by [HMACSigner] for signatures if InQuery is true.
+	SignatureParam = "esi_signature"
+)
+
+var (
+	// ErrInvalidSignature is returned by [HMACSigner.Verify] if the signature of a request does not match.
+	ErrInvalidSignature = errors.New("invalid signature")
+
+	// ErrMissingSignature is returned by [HMACSigner.Verify] if a request is not signed.
+	ErrMissingSignature = errors.New("missing signature")
+
+	// ErrSignatureExpired is returned by [HMACSigner.Verify] if the signature of a request is expired.
+	ErrSignatureExpired = errors.New("signature expired")
+)
+
+// RequestSigner is the interface for types that can sign requests made by a [Client].
+type RequestSigner interface {
+	// SignRequest signs the given request, for example by adding a header or a query parameter.
+	SignRequest(req *http.Request) error
+}
+
+// RequestSignerFunc implements a [RequestSigner] by calling itself.
+type RequestSignerFunc func(req *http.Request) error
+
+// SignRequest calls f and returns the result.
+func (f RequestSignerFunc) SignRequest(req *http.Request) error {
+	return f(req)
+}
+
+// CanonicalRequest returns the canonical representation of a request, as signed by [HMACSigner].
+//
+// The representation consists of the following lines, separated by a newline:
+//
+//   - the request method
+//   - the escaped path of the URL
+//   - the query of the URL with parameters sorted by key and without [ExpiresParam] and [SignatureParam]
+//   - the hex encoded SHA-256 hash of the body
+//   - the expiry as Unix timestamp in seconds
+//
+// If the request has a body, it is read completely and replaced with a new reader for the same data.
+func CanonicalRequest(req *http.Request, expires time.Time) ([]byte, error) {
+	query := req.URL.Query()
+	query.Del(ExpiresParam)
+	query.Del(SignatureParam)
+
+	bodyHash := sha256.New()
+
+	if req.Body != nil && req.Body != http.NoBody {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		_ = req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(body))
+
+		_, _ = bodyHash.Write(body)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(req.Method)
+	buf.WriteByte('\n')
+	buf.WriteString(req.URL.EscapedPath())
+	buf.WriteByte('\n')
+	buf.WriteString(query.Encode())
+	buf.WriteByte('\n')
+	buf.WriteString(hex.EncodeToString(bodyHash.Sum(nil)))
+	buf.WriteByte('\n')
+	buf.WriteString(strconv.FormatInt(expires.Unix(), 10))
+
+	return buf.Bytes(), nil
+}
+
+// HMACSigner implements a [RequestSigner] that signs requests using HMAC-SHA256.
+//
+// The signature is calculated over the result of [CanonicalRequest] and added as hex encoded string together with the
+// expiry to the request, either as headers ([ExpiresHeader] and [SignatureHeader]) or, if InQuery is true, as query
+// parameters ([ExpiresParam] and [SignatureParam]).
+//
+// The same configuration can be used on the receiving side to verify requests using [HMACSigner.Verify].
+type HMACSigner struct {
+	// Key is the secret key used for the HMAC.
+	Key []byte
+
+	// TTL is the duration for which signatures are valid.
+	//
+	// If 0, signatures are valid for 1 minute.
+	TTL time.Duration
+
+	// InQuery configures the signer to add the signature to the query instead of the headers.
+	InQuery bool
+
+	// Now returns the current time. If nil, [time.Now] is used.
+	Now func() time.Time
+}
+
+var _ RequestSigner = (*HMACSigner)(nil)
+
+// SignRequest adds a signature to the request.
+func (s *HMACSigner) SignRequest(req *http.Request) error {
+	expires := s.now().Add(s.ttl())
+
+	sig, err := s.sign(req, expires)
+	if err != nil {
+		return err
+	}
+
+	expiresStr := strconv.FormatInt(expires.Unix(), 10)
+
+	if !s.InQuery {
+		req.Header.Set(ExpiresHeader, expiresStr)
+		req.Header.Set(SignatureHeader, hex.EncodeToString(sig))
+		return nil
+	}
+
+	query := req.URL.Query()
+	query.Set(ExpiresParam, expiresStr)
+	query.Set(SignatureParam, hex.EncodeToString(sig))
+	req.URL.RawQuery = query.Encode()
+
+	return nil
+}
+
+// Verify checks that the request has a valid signature that is not yet expired.
+//
+// It returns [ErrMissingSignature], [ErrInvalidSignature] or [ErrSignatureExpired] if the request can not be verified.
+func (s *HMACSigner) Verify(req *http.Request) error {
+	var expiresStr, sigStr string
+
+	if s.InQuery {
+		query := req.URL.Query()
+		expiresStr, sigStr = query.Get(ExpiresParam), query.Get(SignatureParam)
+	} else {
+		expiresStr, sigStr = req.Header.Get(ExpiresHeader), req.Header.Get(SignatureHeader)
+	}
+
+	if expiresStr == "" || sigStr == "" {
+		return ErrMissingSignature
+	}
+
+	expiresUnix, err := strconv.ParseInt(expiresStr, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+
+	got, err := hex.DecodeString(sigStr)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+
+	expires := time.Unix(expiresUnix, 0)
+
+	want, err := s.sign(req, expires)
+	if err != nil {
+		return err
+	}
+
+	if !hmac.Equal(got, want) {
+		return ErrInvalidSignature
+	}
+
+	if !s.now().Before(expires) {
+		return ErrSignatureExpired
+	}
+
+	return nil
+}
+
+func (s *HMACSigner) now() time.Time {
+	if s.Now == nil {
+		return time.Now()
+	}
+	return s.Now()
+}
+
+func (s *HMACSigner) sign(req *http.Request, expires time.Time) ([]byte, error) {
+	data, err := CanonicalRequest(req, expires)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, s.Key)
+	_, _ = mac.Write(data)
+	return mac.Sum(nil), nil
+}
+
+func (s *HMACSigner) ttl() time.Duration {
+	if s.TTL == 0 {
+		return time.Minute
+	}
+	return s.TTL
+}
@@ -0,0 +1,117 @@
+package esihttp_test
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nussjustin/esi/esihttp"
+)
+
+func TestCanonicalRequest(t *testing.T) {
+	const target = "/a%20b/c?z=1&a=2&esi_signature=x&esi_expires=1"
+
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader("body"))
+
+	got, err := esihttp.CanonicalRequest(req, time.Unix(1234, 0))
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	want := "POST\n/a%20b/c\na=2&z=1\n230d8358dc8e8890b4c58deeb62912ee2f20357ae92a5cc861b98e68fe31acb5\n1234"
+
+	if string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	body, _ := io.ReadAll(req.Body)
+
+	if got, want := string(body), "body"; got != want {
+		t.Errorf("got body %q after canonicalization, want %q", got, want)
+	}
+}
+
+func TestHMACSigner(t *testing.T) {
+	now := time.Unix(1000, 0)
+
+	for _, inQuery := range []bool{false, true} {
+		signer := &esihttp.HMACSigner{
+			Key:     []byte("secret"),
+			TTL:     time.Minute,
+			InQuery: inQuery,
+			Now:     func() time.Time { return now },
+		}
+
+		var signed *http.Request
+
+		client := &esihttp.Client{
+			HTTPClient: testClient(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				signed = req
+				return newResponse(http.StatusOK, "ok"), nil
+			})),
+			Signer: signer,
+		}
+
+		if _, err := client.Do(t.Context(), "https://example.com/fragment?a=b", nil); err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		if got, want := signed.URL.Query().Has(esihttp.SignatureParam), inQuery; got != want {
+			t.Errorf("InQuery=%t: got signature in query %t, want %t", inQuery, got, want)
+		}
+
+		if got, want := signed.Header.Get(esihttp.SignatureHeader) != "", !inQuery; got != want {
+			t.Errorf("InQuery=%t: got signature in header %t, want %t", inQuery, got, want)
+		}
+
+		if err := signer.Verify(signed); err != nil {
+			t.Errorf("InQuery=%t: got error %v", inQuery, err)
+		}
+
+		tampered := signed.Clone(t.Context())
+		tampered.URL.Path = "/other"
+
+		if err := signer.Verify(tampered); !errors.Is(err, esihttp.ErrInvalidSignature) {
+			t.Errorf("InQuery=%t: got error %v, want %v", inQuery, err, esihttp.ErrInvalidSignature)
+		}
+
+		otherKey := *signer
+		otherKey.Key = []byte("other")
+
+		if err := otherKey.Verify(signed); !errors.Is(err, esihttp.ErrInvalidSignature) {
+			t.Errorf("InQuery=%t: got error %v, want %v", inQuery, err, esihttp.ErrInvalidSignature)
+		}
+
+		later := *signer
+		later.Now = func() time.Time { return now.Add(time.Minute) }
+
+		if err := later.Verify(signed); !errors.Is(err, esihttp.ErrSignatureExpired) {
+			t.Errorf("InQuery=%t: got error %v, want %v", inQuery, err, esihttp.ErrSignatureExpired)
+		}
+
+		unsigned := httptest.NewRequest(http.MethodGet, "/fragment", nil)
+
+		if err := signer.Verify(unsigned); !errors.Is(err, esihttp.ErrMissingSignature) {
+			t.Errorf("InQuery=%t: got error %v, want %v", inQuery, err, esihttp.ErrMissingSignature)
+		}
+	}
+}
+
+func TestClient_SignerError(t *testing.T) {
+	errSign := errors.New("sign failed")
+
+	client := &esihttp.Client{
+		HTTPClient: testClient(unreachableTransport()),
+		Signer: esihttp.RequestSignerFunc(func(*http.Request) error {
+			return errSign
+		}),
+	}
+
+	if _, err := client.Do(t.Context(), "/test", nil); !errors.Is(err, errSign) {
+		t.Errorf("got error %v, want %v", err, errSign)
+	}
+}
@@ -0,0 +1,205 @@
+package esihttp
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// SurrogateControlHeader is the name of the response header used by origins to tell surrogates how to handle a
+// response, for example whether it contains ESI markup.
+//
+// See https://www.w3.org/TR/edge-arch/.
+const SurrogateControlHeader = "Surrogate-Control"
+
+// SurrogateCapabilityHeader is the name of the request header used by surrogates to advertise their capabilities to
+// the origin.
+//
+// See https://www.w3.org/TR/edge-arch/.
+const SurrogateCapabilityHeader = "Surrogate-Capability"
+
+// SurrogateCapability contains the capabilities advertised by a single surrogate in a Surrogate-Capability header.
+type SurrogateCapability struct {
+	// Device is the device token identifying the surrogate.
+	Device string
+
+	// Capabilities contains the capability tokens, for example [github.com/nussjustin/esi.Capability].
+	Capabilities []string
+}
+
+// ParseSurrogateCapability parses all Surrogate-Capability headers in header.
+//
+// Each header contains a comma separated list of device tokens with their capabilities, for example
+//
+//	Surrogate-Capability: abc="ESI/1.0 ESI-Inline/1.0", def="ESI/1.0"
+//
+// Malformed entries are ignored.
+func ParseSurrogateCapability(header http.Header) []SurrogateCapability {
+	var caps []SurrogateCapability
+
+	for _, value := range header.Values(SurrogateCapabilityHeader) {
+		for entry := range strings.SplitSeq(value, ",") {
+			device, capabilities, ok := strings.Cut(strings.TrimSpace(entry), "=")
+			if !ok || device == "" {
+				continue
+			}
+
+			caps = append(caps, SurrogateCapability{
+				Device:       device,
+				Capabilities: strings.Fields(strings.Trim(capabilities, `"`)),
+			})
+		}
+	}
+
+	return caps
+}
+
+// HasSurrogateCapability returns true if any surrogate advertises the given capability in the Surrogate-Capability
+// headers in header.
+func HasSurrogateCapability(header http.Header, capability string) bool {
+	for _, c := range ParseSurrogateCapability(header) {
+		if slices.Contains(c.Capabilities, capability) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AddSurrogateCapability adds a Surrogate-Capability header advertising the given capabilities for the device to
+// header. Existing headers, for example from surrogates in front of the caller, are kept.
+//
+// If no capabilities are given, AddSurrogateCapability does nothing.
+func AddSurrogateCapability(header http.Header, device string, capabilities ...string) {
+	if len(capabilities) == 0 {
+		return
+	}
+
+	header.Add(SurrogateCapabilityHeader, device+`="`+strings.Join(capabilities, " ")+`"`)
+}
+
+// SurrogateControl contains the directives of a Surrogate-Control header that apply to a surrogate.
+type SurrogateControl struct {
+	// Content contains the capabilities required for processing the response, as given by the content directive.
+	Content []string
+
+	// MaxAge is the freshness lifetime given by the max-age directive. Extensions of the lifetime for stale
+	// responses, as in max-age=60+30, are ignored.
+	MaxAge time.Duration
+
+	// HasMaxAge is true if a max-age directive was given.
+	HasMaxAge bool
+
+	// NoStore is true if the response must not be stored by any surrogate.
+	NoStore bool
+
+	// NoStoreRemote is true if the response must not be stored by surrogates that are not close to the origin, for
+	// example surrogates in a CDN.
+	NoStoreRemote bool
+}
+
+// ParseSurrogateControl parses the Surrogate-Control headers in header and returns the directives that apply to the
+// surrogate with the given device token.
+//
+// Directives can be targeted at a single surrogate by appending its device token, for example
+//
+//	Surrogate-Control: content="ESI/1.0";abc, max-age=60
+//
+// Directives without a target apply to all surrogates. Directives targeted at device take precedence over directives
+// without a target. If device is empty, only directives without a target are used. Unknown directives are ignored.
+func ParseSurrogateControl(header http.Header, device string) SurrogateControl {
+	var untargeted, targeted SurrogateControl
+	var hasUntargeted, hasTargeted bool
+
+	for _, value := range header.Values(SurrogateControlHeader) {
+		for directive := range strings.SplitSeq(value, ",") {
+			directive, target, isTargeted := strings.Cut(directive, ";")
+
+			switch {
+			case !isTargeted:
+				hasUntargeted = true
+				untargeted.apply(directive)
+			case device != "" && strings.TrimSpace(target) == device:
+				hasTargeted = true
+				targeted.apply(directive)
+			}
+		}
+	}
+
+	if !hasTargeted {
+		return untargeted
+	}
+
+	if !hasUntargeted {
+		return targeted
+	}
+
+	if targeted.Content != nil {
+		untargeted.Content = targeted.Content
+	}
+
+	if targeted.HasMaxAge {
+		untargeted.MaxAge, untargeted.HasMaxAge = targeted.MaxAge, true
+	}
+
+	untargeted.NoStore = untargeted.NoStore || targeted.NoStore
+	untargeted.NoStoreRemote = untargeted.NoStoreRemote || targeted.NoStoreRemote
+
+	return untargeted
+}
+
+// apply sets the field for the given directive.
+func (c *SurrogateControl) apply(directive string) {
+	name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "content":
+		c.Content = strings.Fields(strings.Trim(strings.TrimSpace(value), `"`))
+	case "max-age":
+		value, _, _ = strings.Cut(value, "+")
+		c.MaxAge, c.HasMaxAge = parseSeconds(strings.TrimSpace(value)), true
+	case "no-store":
+		c.NoStore = true
+	case "no-store-remote":
+		c.NoStoreRemote = true
+	}
+}
+
+// HasContent returns true if the content directive contains the given capability.
+func (c SurrogateControl) HasContent(capability string) bool {
+	return slices.Contains(c.Content, capability)
+}
+
+// StripSurrogateControl removes the Surrogate-Control directives that apply to the surrogate with the given device
+// token from header, so that they are not passed on to the client.
+//
+// This removes all directives without a target and, if device is not empty, all directives targeted at device.
+// Directives targeted at other surrogates are kept. If no directives remain, the header is removed.
+func StripSurrogateControl(header http.Header, device string) {
+	values := header.Values(SurrogateControlHeader)
+	if len(values) == 0 {
+		return
+	}
+
+	var kept []string
+
+	for _, value := range values {
+		for directive := range strings.SplitSeq(value, ",") {
+			_, target, isTargeted := strings.Cut(directive, ";")
+
+			if !isTargeted || (device != "" && strings.TrimSpace(target) == device) {
+				continue
+			}
+
+			kept = append(kept, strings.TrimSpace(directive))
+		}
+	}
+
+	if len(kept) == 0 {
+		header.Del(SurrogateControlHeader)
+		return
+	}
+
+	header.Set(SurrogateControlHeader, strings.Join(kept, ", "))
+}
@@ -0,0 +1,185 @@
+package esihttp_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/nussjustin/esi/esihttp"
+)
+
+func TestParseSurrogateCapability(t *testing.T) {
+	header := http.Header{
+		"Surrogate-Capability": {`abc="ESI/1.0 ESI-Inline/1.0", def="ESI/1.0"`, `invalid, ="ESI/1.0", ghi=""`},
+	}
+
+	got := esihttp.ParseSurrogateCapability(header)
+
+	want := []esihttp.SurrogateCapability{
+		{Device: "abc", Capabilities: []string{"ESI/1.0", "ESI-Inline/1.0"}},
+		{Device: "def", Capabilities: []string{"ESI/1.0"}},
+		{Device: "ghi", Capabilities: []string{}},
+	}
+
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ParseSurrogateCapability(...): (-want +got):\n%s", diff)
+	}
+
+	if !esihttp.HasSurrogateCapability(header, "ESI-Inline/1.0") {
+		t.Errorf("HasSurrogateCapability(...) = false for existing capability")
+	}
+
+	if esihttp.HasSurrogateCapability(header, "ESI/2.0") {
+		t.Errorf("HasSurrogateCapability(...) = true for missing capability")
+	}
+}
+
+func TestAddSurrogateCapability(t *testing.T) {
+	header := http.Header{"Surrogate-Capability": {`abc="ESI/1.0"`}}
+
+	esihttp.AddSurrogateCapability(header, "def")
+	esihttp.AddSurrogateCapability(header, "def", "ESI/1.0", "ESI-Inline/1.0")
+
+	want := []string{`abc="ESI/1.0"`, `def="ESI/1.0 ESI-Inline/1.0"`}
+
+	if diff := cmp.Diff(want, header.Values("Surrogate-Capability")); diff != "" {
+		t.Errorf("Surrogate-Capability mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestParseSurrogateControl(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Values   []string
+		Device   string
+		Expected esihttp.SurrogateControl
+	}{
+		{
+			Name:     "empty",
+			Expected: esihttp.SurrogateControl{},
+		},
+		{
+			Name:   "all directives",
+			Values: []string{`content="ESI/1.0 ESI-Inline/1.0", max-age=60+30, no-store, No-Store-Remote, unknown=1`},
+			Expected: esihttp.SurrogateControl{
+				Content:       []string{"ESI/1.0", "ESI-Inline/1.0"},
+				MaxAge:        time.Minute,
+				HasMaxAge:     true,
+				NoStore:       true,
+				NoStoreRemote: true,
+			},
+		},
+		{
+			Name:   "multiple headers",
+			Values: []string{`content="ESI/1.0"`, `max-age=60`},
+			Expected: esihttp.SurrogateControl{
+				Content:   []string{"ESI/1.0"},
+				MaxAge:    time.Minute,
+				HasMaxAge: true,
+			},
+		},
+		{
+			Name:     "targeted without device",
+			Values:   []string{`content="ESI/1.0";abc, max-age=60;abc`},
+			Expected: esihttp.SurrogateControl{},
+		},
+		{
+			Name:     "targeted at other device",
+			Values:   []string{`content="ESI/1.0";abc, max-age=60`},
+			Device:   "def",
+			Expected: esihttp.SurrogateControl{MaxAge: time.Minute, HasMaxAge: true},
+		},
+		{
+			Name:   "targeted only",
+			Values: []string{`content="ESI/1.0";abc, no-store;abc`},
+			Device: "abc",
+			Expected: esihttp.SurrogateControl{
+				Content: []string{"ESI/1.0"},
+				NoStore: true,
+			},
+		},
+		{
+			Name:   "targeted over untargeted",
+			Values: []string{`content="ESI/1.0", max-age=60, max-age=300; abc, no-store-remote;abc`},
+			Device: "abc",
+			Expected: esihttp.SurrogateControl{
+				Content:       []string{"ESI/1.0"},
+				MaxAge:        5 * time.Minute,
+				HasMaxAge:     true,
+				NoStoreRemote: true,
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			header := http.Header{"Surrogate-Control": testCase.Values}
+
+			got := esihttp.ParseSurrogateControl(header, testCase.Device)
+
+			if diff := cmp.Diff(testCase.Expected, got); diff != "" {
+				t.Errorf("ParseSurrogateControl(...): (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSurrogateControl_HasContent(t *testing.T) {
+	c := esihttp.SurrogateControl{Content: []string{"ESI/1.0", "ESI-Inline/1.0"}}
+
+	if !c.HasContent("ESI/1.0") {
+		t.Errorf("HasContent(%q) = false, want true", "ESI/1.0")
+	}
+
+	if c.HasContent("ESI/2.0") {
+		t.Errorf("HasContent(%q) = true, want false", "ESI/2.0")
+	}
+}
+
+func TestStripSurrogateControl(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Values   []string
+		Device   string
+		Expected []string
+	}{
+		{
+			Name:     "missing",
+			Expected: nil,
+		},
+		{
+			Name:     "untargeted",
+			Values:   []string{`content="ESI/1.0", max-age=60`, `no-store`},
+			Expected: nil,
+		},
+		{
+			Name:     "targeted at other device",
+			Values:   []string{`content="ESI/1.0", max-age=60;abc`, `no-store;def`},
+			Expected: []string{`max-age=60;abc, no-store;def`},
+		},
+		{
+			Name:     "targeted at device",
+			Values:   []string{`content="ESI/1.0";abc, max-age=60;def, no-store; abc`},
+			Device:   "abc",
+			Expected: []string{`max-age=60;def`},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			header := http.Header{}
+
+			if testCase.Values != nil {
+				header["Surrogate-Control"] = testCase.Values
+			}
+
+			esihttp.StripSurrogateControl(header, testCase.Device)
+
+			if diff := cmp.Diff(testCase.Expected, header.Values("Surrogate-Control")); diff != "" {
+				t.Errorf("Surrogate-Control mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
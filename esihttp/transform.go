@@ -0,0 +1,83 @@
+package esihttp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Transformer transforms the body of a fragment fetched by a [Client] before it is returned, for example to render
+// data returned by an API as HTML.
+//
+// See [Client.Transformers].
+type Transformer interface {
+	// Transform returns the transformed body. The response body is already read and must not be used.
+	Transform(ctx context.Context, resp *http.Response, body []byte) ([]byte, error)
+}
+
+// TransformerFunc implements a [Transformer] by calling itself.
+type TransformerFunc func(ctx context.Context, resp *http.Response, body []byte) ([]byte, error)
+
+// Transform implements the [Transformer] interface.
+func (f TransformerFunc) Transform(ctx context.Context, resp *http.Response, body []byte) ([]byte, error) {
+	return f(ctx, resp, body)
+}
+
+// Template is the interface implemented by templates that can be used with [JSONTemplate].
+//
+// It is implemented by [html/template.Template] and [text/template.Template].
+type Template interface {
+	Execute(w io.Writer, data any) error
+}
+
+// JSONTemplate returns a [Transformer] that decodes the body as JSON and renders the decoded value using t.
+//
+// Numbers are decoded as [encoding/json.Number], so that large integers are rendered without loss of precision.
+//
+// If the body is not valid JSON or executing the template fails, the error is returned.
+func JSONTemplate(t Template) Transformer {
+	if t == nil {
+		panic("JSONTemplate called with nil template")
+	}
+
+	return TransformerFunc(func(_ context.Context, _ *http.Response, body []byte) ([]byte, error) {
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+
+		var data any
+		if err := dec.Decode(&data); err != nil {
+			return nil, err
+		}
+
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, data); err != nil {
+			return nil, err
+		}
+
+		return buf.Bytes(), nil
+	})
+}
+
+// transformerFor returns the transformer for the media type of resp or nil if there is none.
+func (c *Client) transformerFor(resp *http.Response) Transformer {
+	if len(c.Transformers) == 0 {
+		return nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return nil
+	}
+
+	if t, ok := c.Transformers[mediaType]; ok {
+		return t
+	}
+
+	typ, _, _ := strings.Cut(mediaType, "/")
+
+	return c.Transformers[typ+"/*"]
+}
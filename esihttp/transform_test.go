@@ -0,0 +1,100 @@
+package esihttp_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/nussjustin/esi/esihttp"
+)
+
+func TestClient_Transformers(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		_, _ = io.WriteString(w, r.URL.Query().Get("body"))
+	}))
+	t.Cleanup(srv.Close)
+
+	upper := esihttp.TransformerFunc(func(_ context.Context, _ *http.Response, body []byte) ([]byte, error) {
+		return []byte(strings.ToUpper(string(body))), nil
+	})
+
+	tmpl := template.Must(template.New("").Parse(`<p>{{.name}} ({{.id}})</p>`))
+
+	client := &esihttp.Client{
+		HTTPClient: srv.Client(),
+		Transformers: map[string]esihttp.Transformer{
+			"application/json": esihttp.JSONTemplate(tmpl),
+			"text/*":           upper,
+			"text/html": esihttp.TransformerFunc(func(context.Context, *http.Response, []byte) ([]byte, error) {
+				return []byte("html"), nil
+			}),
+		},
+	}
+
+	testCases := []struct {
+		Name     string
+		Type     string
+		Body     string
+		Expected string
+		Error    bool
+	}{
+		{
+			Name:     "JSON",
+			Type:     "application/json; charset=utf-8",
+			Body:     `{"name":"<b>","id":9007199254740993}`,
+			Expected: "<p>&lt;b&gt; (9007199254740993)</p>",
+		},
+		{Name: "Invalid JSON", Type: "application/json", Body: `{`, Error: true},
+		{Name: "Exact", Type: "text/html", Body: "body", Expected: "html"},
+		{Name: "Wildcard", Type: "text/plain", Body: "body", Expected: "BODY"},
+		{Name: "No match", Type: "image/svg+xml", Body: "<svg/>", Expected: "<svg/>"},
+		{Name: "Invalid type", Type: ";", Body: "body", Expected: "body"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			u := srv.URL + "/?type=" + url.QueryEscape(testCase.Type) + "&body=" + url.QueryEscape(testCase.Body)
+
+			got, err := client.Do(t.Context(), u, nil)
+
+			switch {
+			case testCase.Error && err == nil:
+				t.Fatal("got no error")
+			case !testCase.Error && err != nil:
+				t.Fatalf("got error %v", err)
+			}
+
+			if string(got) != testCase.Expected {
+				t.Errorf("got %q, want %q", got, testCase.Expected)
+			}
+		})
+	}
+}
+
+func TestJSONTemplate(t *testing.T) {
+	tmpl := template.Must(template.New("").Parse(`{{range .}}<li>{{.}}</li>{{end}}`))
+
+	got, err := esihttp.JSONTemplate(tmpl).Transform(t.Context(), nil, []byte(`["a", 1.5]`))
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	if want := "<li>a</li><li>1.5</li>"; string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	_, err = esihttp.JSONTemplate(tmpl).Transform(t.Context(), nil, []byte(`"a`))
+
+	var syntaxErr *json.SyntaxError
+	if !errors.As(err, &syntaxErr) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("got error %v, want JSON error", err)
+	}
+}
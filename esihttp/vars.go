@@ -0,0 +1,479 @@
+package esihttp
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/nussjustin/esi/esiexpr/ast"
+)
+
+const (
+	// VarHTTPAcceptLanguage is the name of the variable containing the value of the Accept-Language header.
+	VarHTTPAcceptLanguage = "HTTP_ACCEPT_LANGUAGE"
+
+	// VarHTTPCookie is the name of the variable containing the cookies of the request.
+	VarHTTPCookie = "HTTP_COOKIE"
+
+	// VarHTTPHost is the name of the variable containing the host of the request.
+	VarHTTPHost = "HTTP_HOST"
+
+	// VarHTTPReferer is the name of the variable containing the value of the Referer header.
+	VarHTTPReferer = "HTTP_REFERER"
+
+	// VarHTTPUserAgent is the name of the variable containing the value of the User-Agent header.
+	VarHTTPUserAgent = "HTTP_USER_AGENT"
+
+	// VarQueryString is the name of the variable containing the query string of the request.
+	VarQueryString = "QUERY_STRING"
+)
+
+// LanguageRange is a single entry in an Accept-Language header.
+type LanguageRange struct {
+	// Tag is the language tag in lower case, for example "en-gb" or "*".
+	Tag string
+
+	// Q is the quality value of the tag in the range [0, 1].
+	Q float64
+}
+
+// AcceptLanguage contains the parsed entries of an Accept-Language header.
+type AcceptLanguage []LanguageRange
+
+// ParseAcceptLanguage parses the value of an Accept-Language header.
+//
+// Entries are returned in order of descending quality, keeping the order of entries with the same quality. Entries
+// with an invalid quality value are ignored.
+func ParseAcceptLanguage(s string) AcceptLanguage {
+	var langs AcceptLanguage
+
+	for entry := range strings.SplitSeq(s, ",") {
+		tag, params, _ := strings.Cut(entry, ";")
+
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" {
+			continue
+		}
+
+		q, ok := parseQuality(params)
+		if !ok {
+			continue
+		}
+
+		langs = append(langs, LanguageRange{Tag: tag, Q: q})
+	}
+
+	slices.SortStableFunc(langs, func(a, b LanguageRange) int {
+		switch {
+		case a.Q > b.Q:
+			return -1
+		case a.Q < b.Q:
+			return 1
+		default:
+			return 0
+		}
+	})
+
+	return langs
+}
+
+func parseQuality(params string) (float64, bool) {
+	for param := range strings.SplitSeq(params, ";") {
+		name, value, _ := strings.Cut(param, "=")
+
+		if !strings.EqualFold(strings.TrimSpace(name), "q") {
+			continue
+		}
+
+		q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || q < 0 || q > 1 {
+			return 0, false
+		}
+
+		return q, true
+	}
+
+	return 1, true
+}
+
+// Contains returns true if the given language tag is acceptable, that is if a has an entry for the tag with a
+// quality greater than 0.
+//
+// Tags are compared case-insensitively.
+func (a AcceptLanguage) Contains(tag string) bool {
+	for _, lang := range a {
+		if strings.EqualFold(lang.Tag, tag) {
+			return lang.Q > 0
+		}
+	}
+
+	return false
+}
+
+// DuplicateCookiePolicy defines which cookie is used when there are multiple cookies with the same name.
+type DuplicateCookiePolicy uint8
+
+const (
+	// DuplicateCookieFirst uses the first cookie with a given name.
+	//
+	// This is the default.
+	DuplicateCookieFirst DuplicateCookiePolicy = iota
+
+	// DuplicateCookieLast uses the last cookie with a given name.
+	DuplicateCookieLast
+)
+
+// String returns the name of the policy.
+func (d DuplicateCookiePolicy) String() string {
+	switch d {
+	case DuplicateCookieFirst:
+		return "DuplicateCookieFirst"
+	case DuplicateCookieLast:
+		return "DuplicateCookieLast"
+	default:
+		panic("unknown duplicate cookie policy")
+	}
+}
+
+// CookieVarsConfig configures the variable returned by [CookieVars].
+type CookieVarsConfig struct {
+	// Duplicates specifies which cookie is used if there are multiple cookies with the same name.
+	Duplicates DuplicateCookiePolicy
+
+	// Metadata enables access to the attributes of cookies from the cookie jar associated with the context (see
+	// [WithCookieJar]) using keys of the form "name:attribute", for example $(HTTP_COOKIE{session:expires}).
+	//
+	// The following attributes are supported: "domain", "expires" (as [time.Time]), "http_only", "max_age",
+	// "path", "same_site" and "secure". Attributes that are not set have the value nil.
+	//
+	// Note that the cookie jar implementation in [net/http/cookiejar] only returns the name and value of cookies.
+	Metadata bool
+}
+
+// CookieVars returns a function for use as [github.com/nussjustin/esi/esiexpr.Env.LookupVar] that handles the
+// variable [VarHTTPCookie] based on the original request associated with the context (see [WithOriginalRequest])
+// and calls lookup for all other variables.
+//
+// Without a key, the variable contains the value of the Cookie header. With a key, like in $(HTTP_COOKIE{session}),
+// it contains the value of the cookie with the given name or nil if there is no such cookie.
+//
+// See [CookieVarsConfig] for the available options. If config is nil, the defaults are used.
+//
+// If lookup is nil, the value of all other variables is nil.
+func CookieVars(
+	config *CookieVarsConfig,
+	lookup func(ctx context.Context, name string, key *string) (ast.Value, error),
+) func(ctx context.Context, name string, key *string) (ast.Value, error) {
+	if config == nil {
+		config = &CookieVarsConfig{}
+	}
+
+	return func(ctx context.Context, name string, key *string) (ast.Value, error) {
+		if name != VarHTTPCookie {
+			if lookup == nil {
+				return nil, nil
+			}
+
+			return lookup(ctx, name, key)
+		}
+
+		r := OriginalRequest(ctx)
+		if r == nil {
+			return nil, nil
+		}
+
+		if key == nil {
+			values := r.Header.Values("Cookie")
+			if len(values) == 0 {
+				return nil, nil
+			}
+
+			return strings.Join(values, "; "), nil
+		}
+
+		if cookieName, attr, ok := strings.Cut(*key, ":"); ok {
+			if !config.Metadata {
+				return nil, nil
+			}
+
+			jar := CookieJar(ctx)
+			if jar == nil {
+				return nil, nil
+			}
+
+			c := selectCookie(jar.Cookies(requestURL(r)), cookieName, config.Duplicates)
+			if c == nil {
+				return nil, nil
+			}
+
+			return cookieAttr(c, attr), nil
+		}
+
+		c := selectCookie(r.Cookies(), *key, config.Duplicates)
+		if c == nil {
+			return nil, nil
+		}
+
+		return c.Value, nil
+	}
+}
+
+func cookieAttr(c *http.Cookie, attr string) ast.Value {
+	switch attr {
+	case "domain":
+		if c.Domain != "" {
+			return c.Domain
+		}
+	case "expires":
+		if !c.Expires.IsZero() {
+			return c.Expires
+		}
+	case "http_only":
+		return c.HttpOnly
+	case "max_age":
+		if c.MaxAge != 0 {
+			return c.MaxAge
+		}
+	case "path":
+		if c.Path != "" {
+			return c.Path
+		}
+	case "same_site":
+		switch c.SameSite {
+		case http.SameSiteLaxMode:
+			return "Lax"
+		case http.SameSiteStrictMode:
+			return "Strict"
+		case http.SameSiteNoneMode:
+			return "None"
+		case http.SameSiteDefaultMode:
+		}
+	case "secure":
+		return c.Secure
+	}
+
+	return nil
+}
+
+// requestURL returns the absolute URL of the server request r.
+func requestURL(r *http.Request) *url.URL {
+	u := *r.URL
+
+	if u.Host == "" {
+		u.Host = r.Host
+	}
+
+	if u.Scheme == "" {
+		u.Scheme = "http"
+
+		if r.TLS != nil {
+			u.Scheme = "https"
+		}
+	}
+
+	return &u
+}
+
+func selectCookie(cookies []*http.Cookie, name string, policy DuplicateCookiePolicy) *http.Cookie {
+	var found *http.Cookie
+
+	for _, c := range cookies {
+		if c.Name != name {
+			continue
+		}
+
+		if policy == DuplicateCookieFirst {
+			return c
+		}
+
+		found = c
+	}
+
+	return found
+}
+
+// RequestVars returns a function for use as [github.com/nussjustin/esi/esiexpr.Env.LookupVar] that handles variables
+// based on the original request associated with the context (see [WithOriginalRequest]) and calls lookup for all
+// other variables.
+//
+// The following variables are handled:
+//
+//   - [VarHTTPAcceptLanguage] contains the value of the Accept-Language header. With a key, like in
+//     $(HTTP_ACCEPT_LANGUAGE{en-gb}), it is true if the language is acceptable (see [AcceptLanguage.Contains]) and
+//     false otherwise.
+//   - [VarHTTPHost] contains the host of the request, including the port if given.
+//   - [VarHTTPReferer] contains the value of the Referer header.
+//   - [VarHTTPUserAgent] contains the value of the User-Agent header. With one of the keys "browser", "version" or
+//     "os", like in $(HTTP_USER_AGENT{browser}), it contains the corresponding field of the [UserAgent] returned by
+//     [ParseUserAgent]. For other keys the value is nil.
+//   - [VarQueryString] contains the query string of the request, without the leading "?". With a key, like in
+//     $(QUERY_STRING{page}), it contains the first value of the query parameter with the given name.
+//
+// If the context has no original request or the request does not contain the needed header or value, the value is
+// nil.
+//
+// [VarHTTPCookie] is handled by [CookieVars].
+//
+// If lookup is nil, the value of all other variables is nil.
+func RequestVars(
+	lookup func(ctx context.Context, name string, key *string) (ast.Value, error),
+) func(ctx context.Context, name string, key *string) (ast.Value, error) {
+	return func(ctx context.Context, name string, key *string) (ast.Value, error) {
+		switch name {
+		case VarHTTPAcceptLanguage, VarHTTPHost, VarHTTPReferer, VarHTTPUserAgent, VarQueryString:
+		default:
+			if lookup == nil {
+				return nil, nil
+			}
+
+			return lookup(ctx, name, key)
+		}
+
+		r := OriginalRequest(ctx)
+		if r == nil {
+			return nil, nil
+		}
+
+		switch name {
+		case VarHTTPAcceptLanguage:
+			return acceptLanguageVar(r, key), nil
+		case VarHTTPHost:
+			return stringVar(r.Host), nil
+		case VarHTTPReferer:
+			return stringVar(r.Header.Get("Referer")), nil
+		case VarHTTPUserAgent:
+			return userAgentVar(r, key), nil
+		default:
+			return queryStringVar(r, key), nil
+		}
+	}
+}
+
+// stringVar returns s or nil if s is empty.
+func stringVar(s string) ast.Value {
+	if s == "" {
+		return nil
+	}
+
+	return s
+}
+
+func acceptLanguageVar(r *http.Request, key *string) ast.Value {
+	values := r.Header.Values("Accept-Language")
+	if len(values) == 0 {
+		return nil
+	}
+
+	header := strings.Join(values, ", ")
+
+	if key == nil {
+		return header
+	}
+
+	return ParseAcceptLanguage(header).Contains(*key)
+}
+
+func queryStringVar(r *http.Request, key *string) ast.Value {
+	if key == nil {
+		return stringVar(r.URL.RawQuery)
+	}
+
+	values, ok := r.URL.Query()[*key]
+	if !ok || len(values) == 0 {
+		return nil
+	}
+
+	return values[0]
+}
+
+func userAgentVar(r *http.Request, key *string) ast.Value {
+	header := r.Header.Get("User-Agent")
+	if header == "" {
+		return nil
+	}
+
+	if key == nil {
+		return header
+	}
+
+	ua := ParseUserAgent(header)
+
+	switch *key {
+	case "browser":
+		return ua.Browser
+	case "os":
+		return ua.OS
+	case "version":
+		return stringVar(ua.Version)
+	default:
+		return nil
+	}
+}
+
+// UserAgent contains the information about a client as defined for the HTTP_USER_AGENT variable by the ESI
+// specification.
+//
+// See https://www.w3.org/TR/esi-lang/, 5. Variables.
+type UserAgent struct {
+	// Browser is the browser of the client, either "MSIE", "MOZILLA" or "OTHER".
+	Browser string
+
+	// Version is the version of the browser, for example "5.0", or an empty string if unknown.
+	Version string
+
+	// OS is the operating system of the client, either "WIN", "MAC", "UNIX" or "OTHER".
+	OS string
+}
+
+// ParseUserAgent parses the value of a User-Agent header.
+//
+// Internet Explorer is detected using the "MSIE" and "Trident" tokens, other browsers using the "Mozilla" token. Since
+// almost all current browsers send a "Mozilla" token, they are all detected as "MOZILLA".
+func ParseUserAgent(s string) UserAgent {
+	ua := UserAgent{Browser: "OTHER", OS: "OTHER"}
+
+	switch {
+	case strings.Contains(s, "MSIE "):
+		ua.Browser = "MSIE"
+		ua.Version = versionAfter(s, "MSIE ")
+	case strings.Contains(s, "Trident/"):
+		ua.Browser = "MSIE"
+		ua.Version = versionAfter(s, "rv:")
+	case strings.HasPrefix(s, "Mozilla/"):
+		ua.Browser = "MOZILLA"
+		ua.Version = versionAfter(s, "Mozilla/")
+	}
+
+	switch {
+	case strings.Contains(s, "Windows") || strings.Contains(s, "Win32") || strings.Contains(s, "Win64"):
+		ua.OS = "WIN"
+	case strings.Contains(s, "Macintosh") || strings.Contains(s, "Mac OS"):
+		ua.OS = "MAC"
+	case strings.Contains(s, "X11") || strings.Contains(s, "Linux") || strings.Contains(s, "BSD") ||
+		strings.Contains(s, "SunOS"):
+		ua.OS = "UNIX"
+	}
+
+	return ua
+}
+
+// versionAfter returns the version number following the first occurrence of prefix in s.
+func versionAfter(s, prefix string) string {
+	_, rest, ok := strings.Cut(s, prefix)
+	if !ok {
+		return ""
+	}
+
+	end := strings.IndexFunc(rest, func(r rune) bool {
+		return r != '.' && (r < '0' || r > '9')
+	})
+
+	if end == -1 {
+		return rest
+	}
+
+	return rest[:end]
+}
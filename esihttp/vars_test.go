@@ -0,0 +1,373 @@
+package esihttp_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/nussjustin/esi/esiexpr"
+	"github.com/nussjustin/esi/esiexpr/ast"
+	"github.com/nussjustin/esi/esihttp"
+)
+
+func TestParseAcceptLanguage(t *testing.T) {
+	testCases := []struct {
+		Input    string
+		Expected esihttp.AcceptLanguage
+	}{
+		{Input: ""},
+		{Input: "en", Expected: esihttp.AcceptLanguage{{Tag: "en", Q: 1}}},
+		{
+			Input: "da, en-GB;q=0.8, en;q=0.7",
+			Expected: esihttp.AcceptLanguage{
+				{Tag: "da", Q: 1},
+				{Tag: "en-gb", Q: 0.8},
+				{Tag: "en", Q: 0.7},
+			},
+		},
+		{
+			Input: "de;q=0.5 , fr ;Q=0.9,it;level=1;q=0.5,*;q=0",
+			Expected: esihttp.AcceptLanguage{
+				{Tag: "fr", Q: 0.9},
+				{Tag: "de", Q: 0.5},
+				{Tag: "it", Q: 0.5},
+				{Tag: "*", Q: 0},
+			},
+		},
+		{
+			Input:    "en;q=2, de;q=x, fr;q=-1, ,nl",
+			Expected: esihttp.AcceptLanguage{{Tag: "nl", Q: 1}},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Input, func(t *testing.T) {
+			got := esihttp.ParseAcceptLanguage(testCase.Input)
+
+			if diff := cmp.Diff(testCase.Expected, got); diff != "" {
+				t.Errorf("result mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestAcceptLanguage_Contains(t *testing.T) {
+	langs := esihttp.ParseAcceptLanguage("en-GB, de;q=0.5, fr;q=0")
+
+	testCases := []struct {
+		Tag      string
+		Expected bool
+	}{
+		{Tag: "en-gb", Expected: true},
+		{Tag: "EN-GB", Expected: true},
+		{Tag: "de", Expected: true},
+		{Tag: "en", Expected: false},
+		{Tag: "fr", Expected: false},
+		{Tag: "it", Expected: false},
+	}
+
+	for _, testCase := range testCases {
+		if got := langs.Contains(testCase.Tag); got != testCase.Expected {
+			t.Errorf("%s: got %t, want %t", testCase.Tag, got, testCase.Expected)
+		}
+	}
+}
+
+func TestRequestVars(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/?page=2&page=3&q=esi", nil)
+	r.Header.Add("Accept-Language", "en-GB, en;q=0.8")
+	r.Header.Add("Accept-Language", "de;q=0")
+	r.Header.Set("Referer", "https://example.com/start")
+	r.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0")
+
+	lookup := esihttp.RequestVars(func(_ context.Context, name string, _ *string) (ast.Value, error) {
+		return "other:" + name, nil
+	})
+
+	ctx := esihttp.WithOriginalRequest(t.Context(), r)
+
+	ptr := func(s string) *string { return &s }
+
+	testCases := []struct {
+		Name     string
+		Key      *string
+		Expected ast.Value
+	}{
+		{Name: esihttp.VarHTTPAcceptLanguage, Expected: "en-GB, en;q=0.8, de;q=0"},
+		{Name: esihttp.VarHTTPAcceptLanguage, Key: ptr("en-gb"), Expected: true},
+		{Name: esihttp.VarHTTPAcceptLanguage, Key: ptr("EN"), Expected: true},
+		{Name: esihttp.VarHTTPAcceptLanguage, Key: ptr("de"), Expected: false},
+		{Name: esihttp.VarHTTPAcceptLanguage, Key: ptr("fr"), Expected: false},
+		{Name: esihttp.VarHTTPHost, Expected: "example.com"},
+		{Name: esihttp.VarHTTPReferer, Expected: "https://example.com/start"},
+		{
+			Name:     esihttp.VarHTTPUserAgent,
+			Expected: "Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0",
+		},
+		{Name: esihttp.VarHTTPUserAgent, Key: ptr("browser"), Expected: "MOZILLA"},
+		{Name: esihttp.VarHTTPUserAgent, Key: ptr("version"), Expected: "5.0"},
+		{Name: esihttp.VarHTTPUserAgent, Key: ptr("os"), Expected: "UNIX"},
+		{Name: esihttp.VarHTTPUserAgent, Key: ptr("other"), Expected: nil},
+		{Name: esihttp.VarQueryString, Expected: "page=2&page=3&q=esi"},
+		{Name: esihttp.VarQueryString, Key: ptr("page"), Expected: "2"},
+		{Name: esihttp.VarQueryString, Key: ptr("q"), Expected: "esi"},
+		{Name: esihttp.VarQueryString, Key: ptr("missing"), Expected: nil},
+		{Name: "OTHER", Expected: "other:OTHER"},
+	}
+
+	for _, testCase := range testCases {
+		got, err := lookup(ctx, testCase.Name, testCase.Key)
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		if diff := cmp.Diff(testCase.Expected, got); diff != "" {
+			t.Errorf("%s: value mismatch (-want +got):\n%s", testCase.Name, diff)
+		}
+	}
+
+	if got, _ := lookup(t.Context(), esihttp.VarHTTPAcceptLanguage, ptr("en")); got != nil {
+		t.Errorf("got %v without original request, want nil", got)
+	}
+}
+
+func TestRequestVars_Missing(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	lookup := esihttp.RequestVars(nil)
+
+	ctx := esihttp.WithOriginalRequest(t.Context(), r)
+
+	for _, name := range []string{
+		esihttp.VarHTTPAcceptLanguage,
+		esihttp.VarHTTPReferer,
+		esihttp.VarHTTPUserAgent,
+		esihttp.VarQueryString,
+		"OTHER",
+	} {
+		got, err := lookup(ctx, name, nil)
+		if err != nil {
+			t.Fatalf("%s: got error %v", name, err)
+		}
+
+		if got != nil {
+			t.Errorf("%s: got %v, want nil", name, got)
+		}
+	}
+}
+
+func TestParseUserAgent(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Input    string
+		Expected esihttp.UserAgent
+	}{
+		{
+			Name:     "Empty",
+			Input:    "",
+			Expected: esihttp.UserAgent{Browser: "OTHER", OS: "OTHER"},
+		},
+		{
+			Name:     "MSIE",
+			Input:    "Mozilla/4.0 (compatible; MSIE 6.0; Windows NT 5.1)",
+			Expected: esihttp.UserAgent{Browser: "MSIE", Version: "6.0", OS: "WIN"},
+		},
+		{
+			Name:     "Trident",
+			Input:    "Mozilla/5.0 (Windows NT 10.0; Trident/7.0; rv:11.0) like Gecko",
+			Expected: esihttp.UserAgent{Browser: "MSIE", Version: "11.0", OS: "WIN"},
+		},
+		{
+			Name:     "Safari",
+			Input:    "Mozilla/5.0 (Macintosh; Intel Mac OS X 14_5) AppleWebKit/605.1.15 Version/17.5 Safari/605.1.15",
+			Expected: esihttp.UserAgent{Browser: "MOZILLA", Version: "5.0", OS: "MAC"},
+		},
+		{
+			Name:     "Firefox",
+			Input:    "Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0",
+			Expected: esihttp.UserAgent{Browser: "MOZILLA", Version: "5.0", OS: "UNIX"},
+		},
+		{
+			Name:     "FreeBSD",
+			Input:    "Mozilla/5.0 (FreeBSD amd64)",
+			Expected: esihttp.UserAgent{Browser: "MOZILLA", Version: "5.0", OS: "UNIX"},
+		},
+		{
+			Name:     "Other",
+			Input:    "curl/8.5.0",
+			Expected: esihttp.UserAgent{Browser: "OTHER", OS: "OTHER"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			got := esihttp.ParseUserAgent(testCase.Input)
+
+			if diff := cmp.Diff(testCase.Expected, got); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRequestVars_Eval(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Language", "da, en-gb;q=0.8")
+
+	env := &esiexpr.Env{LookupVar: esihttp.RequestVars(nil)}
+
+	ctx := esihttp.WithOriginalRequest(t.Context(), r)
+
+	for expr, want := range map[string]bool{
+		"$(HTTP_ACCEPT_LANGUAGE{en-gb})":                             true,
+		"$(HTTP_ACCEPT_LANGUAGE{en-us})":                             false,
+		"$(HTTP_ACCEPT_LANGUAGE{da}) & !$(HTTP_ACCEPT_LANGUAGE{de})": true,
+	} {
+		got, err := env.Eval(ctx, expr)
+		if err != nil {
+			t.Fatalf("%s: got error %v", expr, err)
+		}
+
+		if got != want {
+			t.Errorf("%s: got %t, want %t", expr, got, want)
+		}
+	}
+}
+
+type staticCookieJar []*http.Cookie
+
+func (s staticCookieJar) Cookies(*url.URL) []*http.Cookie {
+	return s
+}
+
+func (s staticCookieJar) SetCookies(*url.URL, []*http.Cookie) {}
+
+func TestCookieVars(t *testing.T) {
+	expires := time.Date(2030, time.January, 2, 3, 4, 5, 0, time.UTC)
+
+	jar := staticCookieJar{
+		{Name: "session", Value: "jar1", Path: "/", Domain: "example.com", Expires: expires, Secure: true},
+		{Name: "session", Value: "jar2", MaxAge: 60, HttpOnly: true, SameSite: http.SameSiteLaxMode},
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Add("Cookie", "session=first; other=x")
+	r.Header.Add("Cookie", "session=last")
+
+	ctx := esihttp.WithCookieJar(esihttp.WithOriginalRequest(t.Context(), r), jar)
+
+	ptr := func(s string) *string { return &s }
+
+	testCases := []struct {
+		Name     string
+		Config   *esihttp.CookieVarsConfig
+		Key      *string
+		Expected ast.Value
+	}{
+		{Name: "header", Expected: "session=first; other=x; session=last"},
+		{Name: "first", Key: ptr("session"), Expected: "first"},
+		{
+			Name:     "last",
+			Config:   &esihttp.CookieVarsConfig{Duplicates: esihttp.DuplicateCookieLast},
+			Key:      ptr("session"),
+			Expected: "last",
+		},
+		{Name: "other", Key: ptr("other"), Expected: "x"},
+		{Name: "missing", Key: ptr("missing")},
+		{Name: "metadata disabled", Key: ptr("session:path")},
+		{
+			Name:     "path",
+			Config:   &esihttp.CookieVarsConfig{Metadata: true},
+			Key:      ptr("session:path"),
+			Expected: "/",
+		},
+		{
+			Name:     "domain",
+			Config:   &esihttp.CookieVarsConfig{Metadata: true},
+			Key:      ptr("session:domain"),
+			Expected: "example.com",
+		},
+		{
+			Name:     "expires",
+			Config:   &esihttp.CookieVarsConfig{Metadata: true},
+			Key:      ptr("session:expires"),
+			Expected: expires,
+		},
+		{
+			Name:     "secure",
+			Config:   &esihttp.CookieVarsConfig{Metadata: true},
+			Key:      ptr("session:secure"),
+			Expected: true,
+		},
+		{
+			Name:   "unset",
+			Config: &esihttp.CookieVarsConfig{Metadata: true},
+			Key:    ptr("session:max_age"),
+		},
+		{
+			Name:     "last max age",
+			Config:   &esihttp.CookieVarsConfig{Duplicates: esihttp.DuplicateCookieLast, Metadata: true},
+			Key:      ptr("session:max_age"),
+			Expected: 60,
+		},
+		{
+			Name:     "last http only",
+			Config:   &esihttp.CookieVarsConfig{Duplicates: esihttp.DuplicateCookieLast, Metadata: true},
+			Key:      ptr("session:http_only"),
+			Expected: true,
+		},
+		{
+			Name:     "last same site",
+			Config:   &esihttp.CookieVarsConfig{Duplicates: esihttp.DuplicateCookieLast, Metadata: true},
+			Key:      ptr("session:same_site"),
+			Expected: "Lax",
+		},
+		{
+			Name:   "unknown attribute",
+			Config: &esihttp.CookieVarsConfig{Metadata: true},
+			Key:    ptr("session:unknown"),
+		},
+		{
+			Name:   "missing jar cookie",
+			Config: &esihttp.CookieVarsConfig{Metadata: true},
+			Key:    ptr("other:path"),
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			got, err := esihttp.CookieVars(testCase.Config, nil)(ctx, esihttp.VarHTTPCookie, testCase.Key)
+			if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+
+			if diff := cmp.Diff(testCase.Expected, got); diff != "" {
+				t.Errorf("value mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCookieVars_Other(t *testing.T) {
+	lookup := esihttp.CookieVars(nil, func(_ context.Context, name string, _ *string) (ast.Value, error) {
+		return "other:" + name, nil
+	})
+
+	got, err := lookup(t.Context(), "HTTP_HOST", nil)
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	if diff := cmp.Diff(ast.Value("other:HTTP_HOST"), got); diff != "" {
+		t.Errorf("value mismatch (-want +got):\n%s", diff)
+	}
+
+	if got, _ := lookup(t.Context(), esihttp.VarHTTPCookie, nil); got != nil {
+		t.Errorf("got %v without original request, want nil", got)
+	}
+}
@@ -0,0 +1,272 @@
+package esiproc
+
+import (
+	"fmt"
+
+	"github.com/nussjustin/esi"
+)
+
+// Behaviour identifies a specific behaviour of a [Processor] for an element or attribute.
+//
+// See [Processor.Capabilities].
+type Behaviour string
+
+const (
+	// BehaviourBranchLimit means that the number of evaluated branches is limited. See [WithMaxBranches].
+	BehaviourBranchLimit Behaviour = "branch-limit"
+
+	// BehaviourContinue means that onerror="continue" suppresses errors.
+	BehaviourContinue Behaviour = "continue"
+
+	// BehaviourDataURL means that data: URLs are decoded by the [Processor] instead of being passed to the [Client].
+	BehaviourDataURL Behaviour = "data-url"
+
+	// BehaviourDebugComments means that the output of includes can be annotated with HTML comments. See
+	// [WithDebugComments].
+	BehaviourDebugComments Behaviour = "debug-comments"
+
+	// BehaviourExtraAttributes means that non-standard attributes are passed to the [Client].
+	BehaviourExtraAttributes Behaviour = "extra-attributes"
+
+	// BehaviourFetchBudget means that includes are not started when the deadline is too close. See
+	// [WithMinIncludeBudget].
+	BehaviourFetchBudget Behaviour = "fetch-budget"
+
+	// BehaviourFetchLimit means that the number of includes is limited. See [WithMaxIncludes].
+	BehaviourFetchLimit Behaviour = "fetch-limit"
+
+	// BehaviourInjectionGuard means that interpolated URLs are checked for injected URL parts. See
+	// [WithInjectionGuard].
+	BehaviourInjectionGuard Behaviour = "injection-guard"
+
+	// BehaviourInterpolation means that variables are interpolated.
+	BehaviourInterpolation Behaviour = "interpolation"
+
+	// BehaviourOptionalIncludes means that some includes are treated as optional. See [WithOptionalIncludes].
+	BehaviourOptionalIncludes Behaviour = "optional-includes"
+
+	// BehaviourParallelEval means that the tests of esi:when elements are evaluated concurrently. See
+	// [WithParallelEval].
+	BehaviourParallelEval Behaviour = "parallel-eval"
+
+	// BehaviourQueryModification means that query parameters are added to URLs. See [WithAppendQuery] and
+	// [WithSetQuery].
+	BehaviourQueryModification Behaviour = "query-modification"
+
+	// BehaviourReuse means that the results of includes with the same name are reused.
+	BehaviourReuse Behaviour = "reuse"
+)
+
+// Capabilities describes the ESI elements and attributes supported by a [Processor] with its current configuration.
+//
+// Capabilities can be encoded as JSON, for example to be exposed via an HTTP endpoint.
+type Capabilities struct {
+	// Elements contains the capabilities for each ESI element, in the order of [esi.ElementNames].
+	Elements []ElementCapabilities `json:"elements"`
+}
+
+// Element returns the capabilities for the ESI element with the given local name.
+func (c Capabilities) Element(local string) (ElementCapabilities, bool) {
+	for _, e := range c.Elements {
+		if e.Name == local {
+			return e, true
+		}
+	}
+
+	return ElementCapabilities{}, false
+}
+
+// ElementCapabilities describes how a single ESI element is handled.
+type ElementCapabilities struct {
+	// Name is the local name of the element, without the namespace.
+	Name string `json:"name"`
+
+	// Support describes if and how the element is supported.
+	Support Support `json:"support"`
+
+	// Attributes contains the attributes of the element.
+	Attributes []AttributeCapabilities `json:"attributes,omitempty"`
+
+	// Behaviours contains additional behaviours that apply to the element.
+	Behaviours []Behaviour `json:"behaviours,omitempty"`
+}
+
+// AttributeCapabilities describes how a single attribute of an ESI element is handled.
+type AttributeCapabilities struct {
+	// Name is the name of the attribute.
+	Name string `json:"name"`
+
+	// Standard is true if the attribute is defined by the ESI Language Specification 1.0.
+	Standard bool `json:"standard"`
+
+	// Supported is true if the attribute is used during processing.
+	Supported bool `json:"supported"`
+
+	// Behaviours contains additional behaviours that apply to the attribute.
+	Behaviours []Behaviour `json:"behaviours,omitempty"`
+}
+
+// Support describes if and how an ESI element is supported.
+type Support uint8
+
+const (
+	// SupportNone means that processing the element fails with an error.
+	SupportNone Support = iota
+
+	// SupportContentOnly means that the start and end tags of the element are removed, but the content is processed.
+	//
+	// See [WithVarnishCompatibility].
+	SupportContentOnly
+
+	// SupportFull means that the element is fully supported.
+	SupportFull
+)
+
+// MarshalText implements the [encoding.TextMarshaler] interface.
+//
+// The values are encoded as "none", "content-only" and "full".
+func (s Support) MarshalText() ([]byte, error) {
+	switch s {
+	case SupportNone:
+		return []byte("none"), nil
+	case SupportContentOnly:
+		return []byte("content-only"), nil
+	case SupportFull:
+		return []byte("full"), nil
+	default:
+		return nil, fmt.Errorf("unknown support value %d", s)
+	}
+}
+
+// String returns the name of the support value.
+func (s Support) String() string {
+	switch s {
+	case SupportNone:
+		return "SupportNone"
+	case SupportContentOnly:
+		return "SupportContentOnly"
+	case SupportFull:
+		return "SupportFull"
+	default:
+		panic("unknown support value")
+	}
+}
+
+// Capabilities returns a description of the ESI elements and attributes supported by p.
+//
+// The result is derived from the options of p, so that documentation and tests can not get out of sync with the actual
+// behaviour.
+func (p *Processor) Capabilities() Capabilities {
+	var c Capabilities
+
+	for name := range esi.ElementNames() {
+		c.Elements = append(c.Elements, p.elementCapabilities(name.Local))
+	}
+
+	return c
+}
+
+func (p *Processor) elementCapabilities(local string) ElementCapabilities {
+	e := ElementCapabilities{Name: local, Support: SupportFull}
+
+	support := func(ok bool) Support {
+		switch {
+		case !p.opts.profile.SupportsElement(local):
+			return SupportContentOnly
+		case ok:
+			return SupportFull
+		default:
+			return SupportNone
+		}
+	}
+
+	switch local {
+	case esi.NameAttempt, esi.NameExcept, esi.NameOtherwise, esi.NameTry:
+		e.Support = support(true)
+	case esi.NameChoose:
+		e.Support = support(p.opts.evalFunc != nil)
+
+		if p.opts.maxBranches > 0 {
+			e.Behaviours = append(e.Behaviours, BehaviourBranchLimit)
+		}
+
+		if p.opts.parallelEval > 1 {
+			e.Behaviours = append(e.Behaviours, BehaviourParallelEval)
+		}
+	case esi.NameComment:
+		e.Attributes = []AttributeCapabilities{{Name: "text", Standard: true, Supported: true}}
+	case esi.NameInclude:
+		e = p.includeCapabilities(e)
+	case esi.NameInline:
+		e.Support = support(p.opts.fragmentStore != nil)
+	case esi.NameRemove:
+	case esi.NameVars:
+		e.Support = support(p.varsInterpolateFunc() != nil)
+
+		if e.Support == SupportFull {
+			e.Behaviours = append(e.Behaviours, BehaviourInterpolation)
+		}
+	case esi.NameWhen:
+		e.Support = support(p.opts.evalFunc != nil)
+		e.Attributes = []AttributeCapabilities{{Name: "test", Standard: true, Supported: e.Support == SupportFull}}
+	}
+
+	return e
+}
+
+func (p *Processor) includeCapabilities(e ElementCapabilities) ElementCapabilities {
+	if p.opts.client == nil {
+		e.Support = SupportNone
+	}
+
+	src := AttributeCapabilities{Name: "src", Standard: true, Supported: true, Behaviours: []Behaviour{BehaviourDataURL}}
+
+	if !p.opts.varnish() && p.opts.interpolateFunc != nil {
+		src.Behaviours = append(src.Behaviours, BehaviourInterpolation)
+
+		if p.opts.injectionGuard {
+			src.Behaviours = append(src.Behaviours, BehaviourInjectionGuard)
+		}
+	}
+
+	if len(p.opts.queryModifiers) > 0 {
+		src.Behaviours = append(src.Behaviours, BehaviourQueryModification)
+	}
+
+	alt := AttributeCapabilities{Name: "alt", Standard: true, Supported: !p.opts.varnish()}
+	if alt.Supported {
+		alt.Behaviours = src.Behaviours
+	}
+
+	name := AttributeCapabilities{Name: "name", Supported: !p.opts.varnish()}
+	if name.Supported {
+		name.Behaviours = []Behaviour{BehaviourReuse}
+	}
+
+	e.Attributes = []AttributeCapabilities{
+		src,
+		alt,
+		{Name: "onerror", Standard: true, Supported: true, Behaviours: []Behaviour{BehaviourContinue}},
+		name,
+	}
+
+	if p.opts.debugComments != nil {
+		e.Behaviours = append(e.Behaviours, BehaviourDebugComments)
+	}
+
+	e.Behaviours = append(e.Behaviours, BehaviourExtraAttributes)
+
+	if p.opts.maxIncludes > 0 {
+		e.Behaviours = append(e.Behaviours, BehaviourFetchLimit)
+	}
+
+	if p.opts.minIncludeBudget > 0 {
+		e.Behaviours = append(e.Behaviours, BehaviourFetchBudget)
+	}
+
+	if p.opts.optionalFunc != nil {
+		e.Behaviours = append(e.Behaviours, BehaviourOptionalIncludes)
+	}
+
+	return e
+}
@@ -0,0 +1,162 @@
+package esiproc_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/nussjustin/esi"
+	"github.com/nussjustin/esi/esiproc"
+)
+
+func TestProcessor_Capabilities(t *testing.T) {
+	client := esiproc.ClientFunc(func(context.Context, string, map[string]string) ([]byte, error) {
+		return nil, nil
+	})
+
+	testCases := []struct {
+		Name       string
+		Opts       []esiproc.ProcessorOpt
+		Support    map[string]esiproc.Support
+		Attributes []esiproc.AttributeCapabilities
+		Behaviours []esiproc.Behaviour
+	}{
+		{
+			Name: "default",
+			Support: map[string]esiproc.Support{
+				esi.NameAttempt:   esiproc.SupportFull,
+				esi.NameChoose:    esiproc.SupportNone,
+				esi.NameComment:   esiproc.SupportFull,
+				esi.NameExcept:    esiproc.SupportFull,
+				esi.NameInclude:   esiproc.SupportNone,
+				esi.NameInline:    esiproc.SupportNone,
+				esi.NameOtherwise: esiproc.SupportFull,
+				esi.NameRemove:    esiproc.SupportFull,
+				esi.NameTry:       esiproc.SupportFull,
+				esi.NameVars:      esiproc.SupportNone,
+				esi.NameWhen:      esiproc.SupportNone,
+			},
+			Attributes: []esiproc.AttributeCapabilities{
+				{Name: "src", Standard: true, Supported: true, Behaviours: []esiproc.Behaviour{esiproc.BehaviourDataURL}},
+				{Name: "alt", Standard: true, Supported: true, Behaviours: []esiproc.Behaviour{esiproc.BehaviourDataURL}},
+				{Name: "onerror", Standard: true, Supported: true, Behaviours: []esiproc.Behaviour{esiproc.BehaviourContinue}},
+				{Name: "name", Supported: true, Behaviours: []esiproc.Behaviour{esiproc.BehaviourReuse}},
+			},
+			Behaviours: []esiproc.Behaviour{esiproc.BehaviourExtraAttributes},
+		},
+		{
+			Name: "configured",
+			Opts: []esiproc.ProcessorOpt{
+				esiproc.WithClient(client),
+				esiproc.WithDebugComments(func(context.Context) bool { return true }),
+				esiproc.WithEvalFunc(testEnv{}.Eval),
+				esiproc.WithInjectionGuard(),
+				esiproc.WithInterpolateFunc(testEnv{}.Interpolate),
+				esiproc.WithMaxIncludes(10),
+			},
+			Support: map[string]esiproc.Support{
+				esi.NameChoose:  esiproc.SupportFull,
+				esi.NameInclude: esiproc.SupportFull,
+				esi.NameInline:  esiproc.SupportNone,
+				esi.NameVars:    esiproc.SupportFull,
+				esi.NameWhen:    esiproc.SupportFull,
+			},
+			Attributes: []esiproc.AttributeCapabilities{
+				{
+					Name:      "src",
+					Standard:  true,
+					Supported: true,
+					Behaviours: []esiproc.Behaviour{
+						esiproc.BehaviourDataURL,
+						esiproc.BehaviourInterpolation,
+						esiproc.BehaviourInjectionGuard,
+					},
+				},
+				{
+					Name:      "alt",
+					Standard:  true,
+					Supported: true,
+					Behaviours: []esiproc.Behaviour{
+						esiproc.BehaviourDataURL,
+						esiproc.BehaviourInterpolation,
+						esiproc.BehaviourInjectionGuard,
+					},
+				},
+				{Name: "onerror", Standard: true, Supported: true, Behaviours: []esiproc.Behaviour{esiproc.BehaviourContinue}},
+				{Name: "name", Supported: true, Behaviours: []esiproc.Behaviour{esiproc.BehaviourReuse}},
+			},
+			Behaviours: []esiproc.Behaviour{
+				esiproc.BehaviourDebugComments,
+				esiproc.BehaviourExtraAttributes,
+				esiproc.BehaviourFetchLimit,
+			},
+		},
+		{
+			Name: "varnish",
+			Opts: []esiproc.ProcessorOpt{
+				esiproc.WithClient(client),
+				esiproc.WithInterpolateFunc(testEnv{}.Interpolate),
+				esiproc.WithVarnishCompatibility(),
+			},
+			Support: map[string]esiproc.Support{
+				esi.NameChoose:  esiproc.SupportContentOnly,
+				esi.NameComment: esiproc.SupportFull,
+				esi.NameInclude: esiproc.SupportFull,
+				esi.NameInline:  esiproc.SupportContentOnly,
+				esi.NameRemove:  esiproc.SupportFull,
+				esi.NameTry:     esiproc.SupportContentOnly,
+				esi.NameVars:    esiproc.SupportContentOnly,
+			},
+			Attributes: []esiproc.AttributeCapabilities{
+				{Name: "src", Standard: true, Supported: true, Behaviours: []esiproc.Behaviour{esiproc.BehaviourDataURL}},
+				{Name: "alt", Standard: true},
+				{Name: "onerror", Standard: true, Supported: true, Behaviours: []esiproc.Behaviour{esiproc.BehaviourContinue}},
+				{Name: "name"},
+			},
+			Behaviours: []esiproc.Behaviour{esiproc.BehaviourExtraAttributes},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			c := esiproc.New(testCase.Opts...).Capabilities()
+
+			for name := range esi.ElementNames() {
+				if _, ok := c.Element(name.Local); !ok {
+					t.Errorf("missing capabilities for element %s", name)
+				}
+			}
+
+			for name, want := range testCase.Support {
+				if e, _ := c.Element(name); e.Support != want {
+					t.Errorf("got support %s for element %s, want %s", e.Support, name, want)
+				}
+			}
+
+			include, _ := c.Element(esi.NameInclude)
+
+			if diff := cmp.Diff(testCase.Attributes, include.Attributes); diff != "" {
+				t.Errorf("include attributes mismatch (-want +got):\n%s", diff)
+			}
+
+			if diff := cmp.Diff(testCase.Behaviours, include.Behaviours); diff != "" {
+				t.Errorf("include behaviours mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCapabilities_JSON(t *testing.T) {
+	c := esiproc.New().Capabilities()
+
+	data, err := json.Marshal(c.Elements[0])
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	if got, want := string(data), `{"name":"attempt","support":"full"}`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
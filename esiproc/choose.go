@@ -0,0 +1,214 @@
+package esiproc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nussjustin/esi"
+	"github.com/nussjustin/esi/internal/diag"
+)
+
+// TooManyBranchesError is returned for esi:choose elements with more esi:when elements than the limit configured
+// using [WithMaxBranches], if none of the evaluated branches matched.
+type TooManyBranchesError struct {
+	// Element is the element for which the error was reported.
+	Element esi.Element
+
+	// Max is the maximum number of evaluated branches.
+	Max int
+}
+
+// Code returns a machine-readable code identifying the type of the error.
+func (*TooManyBranchesError) Code() string {
+	return "esiproc.too_many_branches"
+}
+
+// Error returns a human-readable error message.
+func (e *TooManyBranchesError) Error() string {
+	start, end := e.Element.Pos()
+	return fmt.Sprintf("too many branches, %s at position %d:%d exceeds limit of %d", e.Element.Name(), start, end, e.Max)
+}
+
+// Is checks if the given error matches the receiver.
+func (e *TooManyBranchesError) Is(err error) bool {
+	var o *TooManyBranchesError
+	return errors.As(err, &o) && o.Error() == e.Error()
+}
+
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (e *TooManyBranchesError) MarshalJSON() ([]byte, error) {
+	d := elementDiagnostic(e.Element)
+	d.Details = map[string]any{"max": e.Max}
+	return diag.Marshal(e, d)
+}
+
+// WithMaxBranches configures a [Processor] to evaluate at most the tests of the first n esi:when elements of each
+// esi:choose element.
+//
+// If none of the evaluated tests matched and the element has more esi:when elements, processing fails with a
+// [*TooManyBranchesError] instead of falling back to the esi:otherwise element.
+//
+// If n is 0, no limit will be set. This is the default.
+//
+// If n is < 0, WithMaxBranches panics.
+func WithMaxBranches(n int) ProcessorOpt {
+	if n < 0 {
+		panic("WithMaxBranches called with n < 0")
+	}
+
+	return func(p *processorOptions) {
+		p.maxBranches = n
+	}
+}
+
+// WithParallelEval configures a [Processor] to evaluate the tests of up to n esi:when elements of the same esi:choose
+// element concurrently.
+//
+// The selected branch is the same as with serial evaluation: the first esi:when element whose test matches, unless
+// evaluating the test of an earlier element failed. Once the result is known, the context passed to the [EvalFunc]
+// for all remaining evaluations is canceled.
+//
+// This can speed up the processing of large, generated templates with many branches, but requires the [EvalFunc] to
+// be safe for concurrent use.
+//
+// If n is 0 or 1, tests are evaluated serially. This is the default.
+//
+// If n is < 0, WithParallelEval panics.
+func WithParallelEval(n int) ProcessorOpt {
+	if n < 0 {
+		panic("WithParallelEval called with n < 0")
+	}
+
+	return func(p *processorOptions) {
+		p.parallelEval = n
+	}
+}
+
+// choose returns the first esi:when element of the given element whose test matches or nil if no test matched.
+func (p *Processor) choose(ctx context.Context, choose *esi.ChooseElement) (*esi.WhenElement, error) {
+	whens := choose.When
+
+	if p.opts.maxBranches > 0 && len(whens) > p.opts.maxBranches {
+		whens = whens[:p.opts.maxBranches]
+	}
+
+	var when *esi.WhenElement
+	var err error
+
+	if p.opts.parallelEval > 1 && len(whens) > 1 {
+		when, err = p.chooseParallel(ctx, choose, whens)
+	} else {
+		when, err = p.chooseSerial(ctx, choose, whens)
+	}
+
+	if err == nil && when == nil && len(whens) < len(choose.When) {
+		err = &TooManyBranchesError{Element: choose, Max: p.opts.maxBranches}
+	}
+
+	return when, err
+}
+
+func (p *Processor) chooseParallel(
+	ctx context.Context,
+	choose *esi.ChooseElement,
+	whens []*esi.WhenElement,
+) (*esi.WhenElement, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	type evalResult struct {
+		done   bool
+		result bool
+		err    error
+	}
+
+	results := make([]evalResult, len(whens))
+
+	// Buffered so that workers never block, even after we stopped receiving.
+	doneC := make(chan int, len(whens))
+
+	var next atomic.Int64
+	var wg sync.WaitGroup
+
+	for range min(p.opts.parallelEval, len(whens)) {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for ctx.Err() == nil {
+				i := int(next.Add(1) - 1)
+				if i >= len(whens) {
+					return
+				}
+
+				results[i].result, results[i].err = p.evalRecover(ctx, choose, whens[i])
+				doneC <- i
+			}
+		}()
+	}
+
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	// Index of the first branch for which the result is not yet known
+	var first int
+
+	for first < len(whens) {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case i := <-doneC:
+			results[i].done = true
+		}
+
+		for ; first < len(whens) && results[first].done; first++ {
+			switch res := results[first]; {
+			case res.err != nil:
+				return nil, res.err
+			case res.result:
+				return whens[first], nil
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+func (p *Processor) chooseSerial(
+	ctx context.Context,
+	choose *esi.ChooseElement,
+	whens []*esi.WhenElement,
+) (*esi.WhenElement, error) {
+	for _, w := range whens {
+		result, err := p.eval(ctx, choose, w)
+		if err != nil {
+			return nil, err
+		}
+
+		if result {
+			return w, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// evalRecover calls [Processor.eval] and converts panics into a [*PanicError].
+func (p *Processor) evalRecover(
+	ctx context.Context,
+	choose *esi.ChooseElement,
+	when *esi.WhenElement,
+) (result bool, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			result, err = false, newPanicError(v)
+		}
+	}()
+
+	return p.eval(ctx, choose, when)
+}
@@ -0,0 +1,219 @@
+package esiproc_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nussjustin/esi"
+	"github.com/nussjustin/esi/esiproc"
+)
+
+func chooseInput(tests ...string) string {
+	var b strings.Builder
+
+	b.WriteString("<esi:choose>")
+
+	for _, test := range tests {
+		b.WriteString(`<esi:when test="` + test + `">` + test + `</esi:when>`)
+	}
+
+	b.WriteString("<esi:otherwise>otherwise</esi:otherwise></esi:choose>")
+
+	return b.String()
+}
+
+func TestProcessor_Choose(t *testing.T) {
+	errEval := errors.New("eval failed")
+
+	testCases := []struct {
+		Name        string
+		Tests       []string
+		MaxBranches int
+		Expected    string
+		Error       error
+	}{
+		{
+			Name:     "first",
+			Tests:    []string{"true1", "true2", "false3"},
+			Expected: "true1",
+		},
+		{
+			Name:     "later",
+			Tests:    []string{"false1", "false2", "slow-true3", "true4"},
+			Expected: "slow-true3",
+		},
+		{
+			Name:     "otherwise",
+			Tests:    []string{"false1", "slow-false2", "false3"},
+			Expected: "otherwise",
+		},
+		{
+			Name:     "error before match",
+			Tests:    []string{"false1", "slow-error2", "true3"},
+			Error:    errEval,
+			Expected: "",
+		},
+		{
+			Name:     "error after match",
+			Tests:    []string{"false1", "slow-true2", "error3"},
+			Expected: "slow-true2",
+		},
+		{
+			Name:        "match within limit",
+			Tests:       []string{"false1", "true2", "false3", "true4"},
+			MaxBranches: 2,
+			Expected:    "true2",
+		},
+		{
+			Name:        "no match within limit",
+			Tests:       []string{"false1", "false2", "false3", "true4"},
+			MaxBranches: 2,
+			Error:       &esiproc.TooManyBranchesError{},
+		},
+		{
+			Name:        "otherwise within limit",
+			Tests:       []string{"false1", "false2"},
+			MaxBranches: 2,
+			Expected:    "otherwise",
+		},
+	}
+
+	evalFunc := func(ctx context.Context, expr string) (any, error) {
+		if strings.HasPrefix(expr, "slow-") {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(10 * time.Millisecond):
+			}
+
+			expr = strings.TrimPrefix(expr, "slow-")
+		}
+
+		switch {
+		case strings.HasPrefix(expr, "error"):
+			return nil, errEval
+		case strings.HasPrefix(expr, "true"):
+			return true, nil
+		default:
+			return false, nil
+		}
+	}
+
+	for _, parallel := range []int{0, 2, 16} {
+		for _, testCase := range testCases {
+			t.Run(fmt.Sprintf("%s/parallel=%d", testCase.Name, parallel), func(t *testing.T) {
+				p := esiproc.New(
+					esiproc.WithEvalFunc(evalFunc),
+					esiproc.WithMaxBranches(testCase.MaxBranches),
+					esiproc.WithParallelEval(parallel))
+
+				var buf bytes.Buffer
+
+				nodes := esi.NewParser(strings.NewReader(chooseInput(testCase.Tests...))).All
+
+				_, err := p.Process(t.Context(), &buf, nodes)
+
+				var branchesErr *esiproc.TooManyBranchesError
+
+				switch {
+				case errors.As(testCase.Error, &branchesErr):
+					if !errors.As(err, &branchesErr) || branchesErr.Max != testCase.MaxBranches {
+						t.Errorf("got error %v, want %T", err, testCase.Error)
+					}
+				case !errors.Is(err, testCase.Error):
+					t.Errorf("got error %v, want %v", err, testCase.Error)
+				}
+
+				if got := buf.String(); got != testCase.Expected {
+					t.Errorf("got %q, want %q", got, testCase.Expected)
+				}
+			})
+		}
+	}
+}
+
+func TestProcessor_WithParallelEval(t *testing.T) {
+	const n = 4
+
+	var active, maxActive atomic.Int64
+
+	var mu sync.Mutex
+	var evaluated []string
+
+	// concurrent is closed once two evaluations are active at the same time.
+	concurrent := make(chan struct{})
+
+	var concurrentOnce sync.Once
+
+	evalFunc := func(ctx context.Context, expr string) (any, error) {
+		cur := active.Add(1)
+		defer active.Add(-1)
+
+		for {
+			old := maxActive.Load()
+			if cur <= old || maxActive.CompareAndSwap(old, cur) {
+				break
+			}
+		}
+
+		if cur >= 2 {
+			concurrentOnce.Do(func() { close(concurrent) })
+		}
+
+		<-concurrent
+
+		mu.Lock()
+		evaluated = append(evaluated, expr)
+		mu.Unlock()
+
+		// Branches after the matching one can only finish once they are canceled, so not all branches are evaluated.
+		if expr > "16" {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+
+		return expr == "16", nil
+	}
+
+	tests := make([]string, 32)
+	for i := range tests {
+		tests[i] = fmt.Sprintf("%02d", i)
+	}
+
+	p := esiproc.New(esiproc.WithEvalFunc(evalFunc), esiproc.WithParallelEval(n))
+
+	var buf bytes.Buffer
+
+	if _, err := p.Process(t.Context(), &buf, esi.NewParser(strings.NewReader(chooseInput(tests...))).All); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	if got, want := buf.String(), "16"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if got := maxActive.Load(); got < 2 || got > n {
+		t.Errorf("got %d concurrent evaluations, want between 2 and %d", got, n)
+	}
+
+	if got := len(evaluated); got >= len(tests) {
+		t.Errorf("got %d evaluations, want less than %d", got, len(tests))
+	}
+}
+
+func TestTooManyBranchesError(t *testing.T) {
+	choose := &esi.ChooseElement{Position: esi.Position{Start: 1, End: 2}}
+
+	err := &esiproc.TooManyBranchesError{Element: choose, Max: 3}
+
+	if got, want := err.Error(), "too many branches, esi:choose at position 1:2 exceeds limit of 3"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,78 @@
+package esiproc
+
+import (
+	"context"
+	"time"
+)
+
+// ClientWithRecover returns a [Client] that calls c and converts panics inside c into a [*PanicError].
+func ClientWithRecover(c Client) Client {
+	return ClientFunc(func(ctx context.Context, urlStr string, extra map[string]string) (data []byte, err error) {
+		defer func() {
+			if v := recover(); v != nil {
+				data, err = nil, newPanicError(v)
+			}
+		}()
+
+		return c.Do(ctx, urlStr, extra)
+	})
+}
+
+// ClientWithTimeout returns a [Client] that calls c with a context that is canceled after d and that returns as soon
+// as the context is canceled, even if c does not return.
+//
+// When returning early, the error from the context is returned, for example [context.DeadlineExceeded], and the
+// result of c is discarded once c returns. This ensures that processing can finish even if c does not honor the
+// cancellation of the context, at the cost of leaving the call to c running in the background.
+//
+// Since c is called in a separate goroutine, panics inside c are always recovered and returned as [*PanicError].
+//
+// If d is 0, no timeout is set, but cancellation of the parent context is still enforced.
+//
+// If d is < 0, ClientWithTimeout panics.
+func ClientWithTimeout(c Client, d time.Duration) Client {
+	if d < 0 {
+		panic("ClientWithTimeout called with d < 0")
+	}
+
+	type result struct {
+		data []byte
+		err  error
+	}
+
+	return ClientFunc(func(ctx context.Context, urlStr string, extra map[string]string) ([]byte, error) {
+		var cancel context.CancelFunc
+
+		if d > 0 {
+			ctx, cancel = context.WithTimeout(ctx, d)
+		} else {
+			ctx, cancel = context.WithCancel(ctx)
+		}
+
+		defer cancel()
+
+		// Buffered so that the goroutine can finish even if we already returned.
+		resC := make(chan result, 1)
+
+		go func() {
+			var res result
+
+			defer func() {
+				if v := recover(); v != nil {
+					res = result{err: newPanicError(v)}
+				}
+
+				resC <- res
+			}()
+
+			res.data, res.err = c.Do(ctx, urlStr, extra)
+		}()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case res := <-resC:
+			return res.data, res.err
+		}
+	})
+}
@@ -0,0 +1,162 @@
+package esiproc_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nussjustin/esi"
+	"github.com/nussjustin/esi/esiproc"
+)
+
+func TestClientWithRecover(t *testing.T) {
+	errPanic := errors.New("panic error")
+
+	client := esiproc.ClientWithRecover(esiproc.ClientFunc(
+		func(_ context.Context, urlStr string, _ map[string]string) ([]byte, error) {
+			switch urlStr {
+			case "/error":
+				panic(errPanic)
+			case "/string":
+				panic("panic string")
+			default:
+				return []byte(urlStr), nil
+			}
+		}))
+
+	data, err := client.Do(t.Context(), "/ok", nil)
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	if got, want := string(data), "/ok"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	_, err = client.Do(t.Context(), "/error", nil)
+	if !errors.Is(err, errPanic) {
+		t.Errorf("got error %v, want %v", err, errPanic)
+	}
+
+	_, err = client.Do(t.Context(), "/string", nil)
+
+	var panicErr *esiproc.PanicError
+
+	if !errors.As(err, &panicErr) {
+		t.Fatalf("got error %v, want %T", err, panicErr)
+	}
+
+	if got, want := panicErr.Value, any("panic string"); got != want {
+		t.Errorf("got value %v, want %v", got, want)
+	}
+
+	if got, want := panicErr.Error(), "recovered panic: panic string"; got != want {
+		t.Errorf("got message %q, want %q", got, want)
+	}
+
+	if !bytes.Contains(panicErr.Stack, []byte("TestClientWithRecover")) {
+		t.Errorf("stack does not contain test function:\n%s", panicErr.Stack)
+	}
+}
+
+func TestClientWithRecover_Processor(t *testing.T) {
+	client := esiproc.ClientWithRecover(esiproc.ClientFunc(
+		func(context.Context, string, map[string]string) ([]byte, error) {
+			panic("oops")
+		}))
+
+	p := esiproc.New(esiproc.WithClient(client))
+
+	input := `<esi:try><esi:attempt><esi:include src="/"/></esi:attempt><esi:except>except</esi:except></esi:try>`
+
+	var buf bytes.Buffer
+
+	if _, err := p.Process(t.Context(), &buf, esi.NewParser(strings.NewReader(input)).All); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	if got, want := buf.String(), "except"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestClientWithTimeout(t *testing.T) {
+	unblock := make(chan struct{})
+	defer close(unblock)
+
+	// Ignores the context and blocks until the test finishes
+	blocking := esiproc.ClientFunc(func(_ context.Context, urlStr string, _ map[string]string) ([]byte, error) {
+		if urlStr == "/block" {
+			<-unblock
+		}
+
+		return []byte(urlStr), nil
+	})
+
+	t.Run("result", func(t *testing.T) {
+		data, err := esiproc.ClientWithTimeout(blocking, time.Minute).Do(t.Context(), "/ok", nil)
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		if got, want := string(data), "/ok"; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		_, err := esiproc.ClientWithTimeout(blocking, time.Millisecond).Do(t.Context(), "/block", nil)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("got error %v, want %v", err, context.DeadlineExceeded)
+		}
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(t.Context())
+
+		time.AfterFunc(time.Millisecond, cancel)
+
+		_, err := esiproc.ClientWithTimeout(blocking, 0).Do(ctx, "/block", nil)
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("got error %v, want %v", err, context.Canceled)
+		}
+	})
+
+	t.Run("panic", func(t *testing.T) {
+		client := esiproc.ClientFunc(func(context.Context, string, map[string]string) ([]byte, error) {
+			panic("oops")
+		})
+
+		_, err := esiproc.ClientWithTimeout(client, time.Minute).Do(t.Context(), "/", nil)
+		if want := (&esiproc.PanicError{Value: "oops"}); !errors.Is(err, want) {
+			t.Errorf("got error %v, want %v", err, want)
+		}
+	})
+
+	t.Run("context", func(t *testing.T) {
+		client := esiproc.ClientFunc(func(ctx context.Context, _ string, _ map[string]string) ([]byte, error) {
+			if _, ok := ctx.Deadline(); !ok {
+				return nil, errors.New("context has no deadline")
+			}
+
+			return nil, nil
+		})
+
+		if _, err := esiproc.ClientWithTimeout(client, time.Minute).Do(t.Context(), "/", nil); err != nil {
+			t.Errorf("got error %v", err)
+		}
+	})
+}
+
+func TestClientWithTimeout_Negative(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic")
+		}
+	}()
+
+	esiproc.ClientWithTimeout(esiproc.ClientFunc(nil), -1)
+}
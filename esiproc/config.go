@@ -0,0 +1,201 @@
+package esiproc
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nussjustin/esi"
+	"github.com/nussjustin/esi/internal/diag"
+)
+
+// ConfigError is returned by [ProcessorConfig.Validate] for invalid configuration values.
+type ConfigError struct {
+	// Field is the name of the invalid field.
+	Field string
+
+	// Message describes the error.
+	Message string
+}
+
+// Code returns a machine-readable code identifying the type of the error.
+func (*ConfigError) Code() string {
+	return "esiproc.config"
+}
+
+// Error returns a human-readable error message.
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("invalid config field %s: %s", e.Field, e.Message)
+}
+
+// Is checks if the given error matches the receiver.
+func (e *ConfigError) Is(err error) bool {
+	var o *ConfigError
+	return errors.As(err, &o) && *o == *e
+}
+
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (e *ConfigError) MarshalJSON() ([]byte, error) {
+	return diag.Marshal(e, diag.Diagnostic{Details: map[string]any{"field": e.Field}})
+}
+
+// Duration is a [time.Duration] that is encoded as text using [time.Duration.String] and [time.ParseDuration].
+//
+// This allows durations to be written as "1.5s" or "250ms" in configuration files.
+type Duration time.Duration
+
+// MarshalText implements the [encoding.TextMarshaler] interface.
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// UnmarshalText implements the [encoding.TextUnmarshaler] interface.
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(v)
+	return nil
+}
+
+// ProcessorConfig contains the settings of a [Processor] that can be loaded from configuration files.
+//
+// The zero value uses the same defaults as [New]. Settings that can not be represented as data, like the [Client]
+// or the [EvalFunc], must still be given as options:
+//
+//	var cfg esiproc.ProcessorConfig
+//
+//	if err := json.Unmarshal(data, &cfg); err != nil {
+//		return err
+//	}
+//
+//	opts, err := cfg.Options()
+//	if err != nil {
+//		return err
+//	}
+//
+//	p := esiproc.New(append(opts, esiproc.WithClient(client))...)
+type ProcessorConfig struct {
+	// ClientConcurrency is the maximum number of concurrent calls to the [Client]. See [WithClientConcurrency].
+	//
+	// If nil, the default of 1 is used. If the value is 0, no limit is set.
+	ClientConcurrency *int `json:"client_concurrency,omitempty" yaml:"client_concurrency,omitempty"`
+
+	// CompatibilityProfile is the profile passed to [WithCompatibilityProfile].
+	CompatibilityProfile esi.CompatibilityProfile `json:"profile,omitempty" yaml:"profile,omitempty"`
+
+	// Flush enables [WithFlush].
+	Flush bool `json:"flush,omitempty" yaml:"flush,omitempty"`
+
+	// InjectionGuard enables [WithInjectionGuard].
+	InjectionGuard bool `json:"injection_guard,omitempty" yaml:"injection_guard,omitempty"`
+
+	// MaxBranches is the value passed to [WithMaxBranches].
+	MaxBranches int `json:"max_branches,omitempty" yaml:"max_branches,omitempty"`
+
+	// MaxIncludes is the value passed to [WithMaxIncludes].
+	MaxIncludes int `json:"max_includes,omitempty" yaml:"max_includes,omitempty"`
+
+	// MaxPendingNodes is the value passed to [WithMaxPendingNodes].
+	MaxPendingNodes int `json:"max_pending_nodes,omitempty" yaml:"max_pending_nodes,omitempty"`
+
+	// MinIncludeBudget is the value passed to [WithMinIncludeBudget].
+	MinIncludeBudget Duration `json:"min_include_budget,omitempty" yaml:"min_include_budget,omitempty"`
+
+	// ParallelEval is the value passed to [WithParallelEval].
+	ParallelEval int `json:"parallel_eval,omitempty" yaml:"parallel_eval,omitempty"`
+
+	// TrimWhitespace enables [WithTrimWhitespace].
+	TrimWhitespace bool `json:"trim_whitespace,omitempty" yaml:"trim_whitespace,omitempty"`
+
+	// VarsNesting is the value passed to [WithVarsNesting].
+	//
+	// If this is [VarsNestingProcess], the option is not used and the default of the profile applies.
+	VarsNesting VarsNesting `json:"vars_nesting,omitempty" yaml:"vars_nesting,omitempty"`
+
+	// WriteBufferSize is the value passed to [WithWriteBuffer].
+	WriteBufferSize int `json:"write_buffer_size,omitempty" yaml:"write_buffer_size,omitempty"`
+
+	// WriteTimeout is the value passed to [WithWriteTimeout].
+	WriteTimeout Duration `json:"write_timeout,omitempty" yaml:"write_timeout,omitempty"`
+}
+
+// Options validates the configuration and returns options for [New] that apply it.
+//
+// If the configuration is invalid, the error returned by [ProcessorConfig.Validate] is returned.
+func (c *ProcessorConfig) Options() ([]ProcessorOpt, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	opts := []ProcessorOpt{
+		WithCompatibilityProfile(c.CompatibilityProfile),
+		WithMaxBranches(c.MaxBranches),
+		WithMaxIncludes(c.MaxIncludes),
+		WithMaxPendingNodes(c.MaxPendingNodes),
+		WithMinIncludeBudget(time.Duration(c.MinIncludeBudget)),
+		WithParallelEval(c.ParallelEval),
+		WithWriteBuffer(c.WriteBufferSize),
+		WithWriteTimeout(time.Duration(c.WriteTimeout)),
+	}
+
+	if c.ClientConcurrency != nil {
+		opts = append(opts, WithClientConcurrency(*c.ClientConcurrency))
+	}
+
+	if c.Flush {
+		opts = append(opts, WithFlush())
+	}
+
+	if c.InjectionGuard {
+		opts = append(opts, WithInjectionGuard())
+	}
+
+	if c.TrimWhitespace {
+		opts = append(opts, WithTrimWhitespace())
+	}
+
+	if c.VarsNesting != VarsNestingProcess {
+		opts = append(opts, WithVarsNesting(c.VarsNesting))
+	}
+
+	return opts, nil
+}
+
+// Validate checks the configuration for invalid values.
+//
+// The returned error contains a [*ConfigError] for each invalid field.
+func (c *ProcessorConfig) Validate() error {
+	var errs []error
+
+	checkNotNegative := func(field string, n int64) {
+		if n < 0 {
+			errs = append(errs, &ConfigError{Field: field, Message: "must not be negative"})
+		}
+	}
+
+	if c.ClientConcurrency != nil {
+		checkNotNegative("ClientConcurrency", int64(*c.ClientConcurrency))
+	}
+
+	if _, err := c.CompatibilityProfile.MarshalText(); err != nil {
+		errs = append(errs, &ConfigError{Field: "CompatibilityProfile", Message: err.Error()})
+	}
+
+	checkNotNegative("MaxBranches", int64(c.MaxBranches))
+	checkNotNegative("MaxIncludes", int64(c.MaxIncludes))
+	checkNotNegative("MaxPendingNodes", int64(c.MaxPendingNodes))
+	checkNotNegative("MinIncludeBudget", int64(c.MinIncludeBudget))
+	checkNotNegative("ParallelEval", int64(c.ParallelEval))
+
+	if _, err := c.VarsNesting.MarshalText(); err != nil {
+		errs = append(errs, &ConfigError{Field: "VarsNesting", Message: err.Error()})
+	}
+
+	checkNotNegative("WriteBufferSize", int64(c.WriteBufferSize))
+	checkNotNegative("WriteTimeout", int64(c.WriteTimeout))
+
+	return errors.Join(errs...)
+}
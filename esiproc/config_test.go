@@ -0,0 +1,160 @@
+package esiproc_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/nussjustin/esi"
+	"github.com/nussjustin/esi/esiproc"
+)
+
+func TestProcessorConfig_JSON(t *testing.T) {
+	const input = `{
+		"client_concurrency": 0,
+		"profile": "akamai",
+		"flush": true,
+		"injection_guard": true,
+		"max_includes": 10,
+		"max_pending_nodes": 8,
+		"min_include_budget": "250ms",
+		"vars_nesting": "literal",
+		"write_buffer_size": 4096,
+		"write_timeout": "5s"
+	}`
+
+	var got esiproc.ProcessorConfig
+
+	if err := json.Unmarshal([]byte(input), &got); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	zero := 0
+
+	want := esiproc.ProcessorConfig{
+		ClientConcurrency:    &zero,
+		CompatibilityProfile: esi.ProfileAkamai,
+		Flush:                true,
+		InjectionGuard:       true,
+		MaxIncludes:          10,
+		MaxPendingNodes:      8,
+		MinIncludeBudget:     esiproc.Duration(250 * time.Millisecond),
+		VarsNesting:          esiproc.VarsNestingLiteral,
+		WriteBufferSize:      4096,
+		WriteTimeout:         esiproc.Duration(5 * time.Second),
+	}
+
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("config mismatch (-want +got):\n%s", diff)
+	}
+
+	encoded, err := json.Marshal(got)
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	var decoded esiproc.ProcessorConfig
+
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	if diff := cmp.Diff(want, decoded); diff != "" {
+		t.Errorf("round trip mismatch (-want +got):\n%s", diff)
+	}
+
+	if err := json.Unmarshal([]byte(`{"vars_nesting": "unknown"}`), &decoded); err == nil {
+		t.Errorf("got nil error for unknown vars nesting")
+	}
+}
+
+func TestProcessorConfig_Validate(t *testing.T) {
+	negative := -1
+
+	cfg := esiproc.ProcessorConfig{
+		ClientConcurrency:    &negative,
+		CompatibilityProfile: esi.CompatibilityProfile(255),
+		MaxIncludes:          -1,
+		MaxPendingNodes:      -1,
+		MinIncludeBudget:     esiproc.Duration(-time.Second),
+		VarsNesting:          esiproc.VarsNesting(255),
+		WriteTimeout:         esiproc.Duration(-time.Second),
+	}
+
+	var fields []string
+
+	for _, err := range cfg.Validate().(interface{ Unwrap() []error }).Unwrap() {
+		var configErr *esiproc.ConfigError
+
+		if errors.As(err, &configErr) {
+			fields = append(fields, configErr.Field)
+		}
+	}
+
+	want := []string{
+		"ClientConcurrency",
+		"CompatibilityProfile",
+		"MaxIncludes",
+		"MaxPendingNodes",
+		"MinIncludeBudget",
+		"VarsNesting",
+		"WriteTimeout",
+	}
+
+	if diff := cmp.Diff(want, fields); diff != "" {
+		t.Errorf("invalid fields mismatch (-want +got):\n%s", diff)
+	}
+
+	if _, err := cfg.Options(); err == nil {
+		t.Errorf("Options: got nil error for invalid config")
+	}
+
+	if err := (&esiproc.ProcessorConfig{}).Validate(); err != nil {
+		t.Errorf("got error %v for zero config", err)
+	}
+}
+
+func TestProcessorConfig_Options(t *testing.T) {
+	cfg := esiproc.ProcessorConfig{
+		MaxIncludes: 1,
+		VarsNesting: esiproc.VarsNestingReject,
+	}
+
+	opts, err := cfg.Options()
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	client := esiproc.ClientFunc(func(_ context.Context, urlStr string, _ map[string]string) ([]byte, error) {
+		return []byte(urlStr), nil
+	})
+
+	p := esiproc.New(append(opts, esiproc.WithClient(client))...)
+
+	input := `<esi:include src="/a"/><esi:include src="/b" onerror="continue"/>`
+
+	var buf strings.Builder
+
+	if _, err := p.Process(t.Context(), &buf, esi.NewParser(strings.NewReader(input)).All); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	if got, want := buf.String(), "/a"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	input = `<esi:vars><esi:comment text="x"/></esi:vars>`
+
+	p = esiproc.New(append(opts, esiproc.WithInterpolateFunc(testEnv{}.Interpolate))...)
+
+	_, err = p.Process(t.Context(), io.Discard, esi.NewParser(strings.NewReader(input)).All)
+	if want := (&esiproc.UnexpectedElementError{}); !errors.As(err, &want) {
+		t.Errorf("got error %v, want %T", err, want)
+	}
+}
@@ -0,0 +1,125 @@
+package esiproc_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/nussjustin/esi"
+	"github.com/nussjustin/esi/esiexpr"
+	"github.com/nussjustin/esi/esiexpr/ast"
+	"github.com/nussjustin/esi/esiproc"
+)
+
+// corpusVars contains the variables used by the documents in testdata.
+var corpusVars = map[string]string{
+	"HTTP_ACCEPT_LANGUAGE{en}": "true",
+	"HTTP_COOKIE{segment}":     "premium",
+	"HTTP_COOKIE{user}":        "12345",
+	"QUERY_STRING{path}":       "/a/b/c",
+}
+
+func init() {
+	// Take the deepest path through the nested conditions
+	for i := 1; i <= 12; i++ {
+		corpusVars["HTTP_COOKIE{level"+strconv.Itoa(i)+"}"] = "a"
+	}
+}
+
+func newCorpusProcessor() *esiproc.Processor {
+	env := &esiexpr.Env{
+		CompareValues: func(a, b ast.Value) (int, error) {
+			return strings.Compare(a.(string), b.(string)), nil
+		},
+		LookupVar: func(_ context.Context, name string, key *string) (ast.Value, error) {
+			if key != nil {
+				name += "{" + *key + "}"
+			}
+			return corpusVars[name], nil
+		},
+	}
+
+	client := esiproc.ClientFunc(func(_ context.Context, urlStr string, _ map[string]string) ([]byte, error) {
+		return []byte(urlStr), nil
+	})
+
+	return esiproc.New(
+		esiproc.WithClient(client),
+		esiproc.WithClientConcurrency(8),
+		esiproc.WithEvalFunc(env.Eval),
+		esiproc.WithInterpolateFunc(env.Interpolate))
+}
+
+type corpusDocument struct {
+	Name string
+	Data []byte
+}
+
+func readCorpus(tb testing.TB) []corpusDocument {
+	tb.Helper()
+
+	files, err := filepath.Glob(filepath.Join("testdata", "*.html"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	if len(files) == 0 {
+		tb.Fatal("no documents found in testdata")
+	}
+
+	corpus := make([]corpusDocument, 0, len(files))
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			tb.Fatal(err)
+		}
+
+		corpus = append(corpus, corpusDocument{Name: filepath.Base(file), Data: data})
+	}
+
+	return corpus
+}
+
+func TestCorpus(t *testing.T) {
+	p := newCorpusProcessor()
+
+	for _, doc := range readCorpus(t) {
+		t.Run(doc.Name, func(t *testing.T) {
+			var buf bytes.Buffer
+
+			if _, err := p.Process(t.Context(), &buf, esi.NewParser(bytes.NewReader(doc.Data)).All); err != nil {
+				t.Fatalf("got error %v", err)
+			}
+
+			if bytes.Contains(buf.Bytes(), []byte("<esi:")) {
+				t.Error("output contains unprocessed ESI elements")
+			}
+		})
+	}
+}
+
+func BenchmarkCorpus(b *testing.B) {
+	p := newCorpusProcessor()
+
+	for _, doc := range readCorpus(b) {
+		b.Run(doc.Name, func(b *testing.B) {
+			b.SetBytes(int64(len(doc.Data)))
+			b.ReportAllocs()
+
+			var buf bytes.Buffer
+
+			for b.Loop() {
+				buf.Reset()
+
+				if _, err := p.Process(b.Context(), &buf, esi.NewParser(bytes.NewReader(doc.Data)).All); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
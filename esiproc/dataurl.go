@@ -0,0 +1,91 @@
+package esiproc
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/nussjustin/esi/internal/diag"
+)
+
+// InvalidDataURLError is returned for esi:include elements with a data: URL that can not be decoded.
+//
+// See [Processor] for details on data: URLs.
+type InvalidDataURLError struct {
+	// URL is the invalid URL.
+	URL string
+
+	// Err is the underlying error, if any.
+	Err error
+}
+
+// Code returns a machine-readable code identifying the type of the error.
+func (*InvalidDataURLError) Code() string {
+	return "esiproc.invalid_data_url"
+}
+
+// Error returns a human-readable error message.
+func (e *InvalidDataURLError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("invalid data URL %q", e.URL)
+	}
+
+	return fmt.Sprintf("invalid data URL %q: %s", e.URL, e.Err)
+}
+
+// Is checks if the given error matches the receiver.
+func (e *InvalidDataURLError) Is(err error) bool {
+	var o *InvalidDataURLError
+	return errors.As(err, &o) && *o == *e
+}
+
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (e *InvalidDataURLError) MarshalJSON() ([]byte, error) {
+	return diag.Marshal(e, diag.Diagnostic{Details: map[string]any{"url": e.URL}, Cause: diag.Cause(e.Err)})
+}
+
+// Unwrap returns e.Err.
+func (e *InvalidDataURLError) Unwrap() error {
+	return e.Err
+}
+
+// decodeDataURL decodes the payload of a data: URL as described in RFC 2397.
+//
+// The media type is ignored.
+func decodeDataURL(urlStr string) ([]byte, error) {
+	header, payload, ok := strings.Cut(urlStr[len("data:"):], ",")
+	if !ok {
+		return nil, &InvalidDataURLError{URL: urlStr}
+	}
+
+	if strings.HasSuffix(strings.ToLower(header), ";base64") {
+		// Allow both the standard and the URL-safe alphabet as well as missing padding
+		payload = strings.TrimRight(payload, "=")
+
+		enc := base64.RawStdEncoding
+		if strings.ContainsAny(payload, "-_") {
+			enc = base64.RawURLEncoding
+		}
+
+		data, err := enc.DecodeString(payload)
+		if err != nil {
+			return nil, &InvalidDataURLError{URL: urlStr, Err: err}
+		}
+
+		return data, nil
+	}
+
+	data, err := url.PathUnescape(payload)
+	if err != nil {
+		return nil, &InvalidDataURLError{URL: urlStr, Err: err}
+	}
+
+	return []byte(data), nil
+}
+
+// isDataURL returns true if urlStr uses the data: scheme.
+func isDataURL(urlStr string) bool {
+	return len(urlStr) >= len("data:") && strings.EqualFold(urlStr[:len("data:")], "data:")
+}
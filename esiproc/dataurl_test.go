@@ -0,0 +1,163 @@
+package esiproc_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/nussjustin/esi"
+	"github.com/nussjustin/esi/esiproc"
+)
+
+func TestProcessor_DataURL(t *testing.T) {
+	errFetch := errors.New("fetch failed")
+
+	client := esiproc.ClientFunc(func(_ context.Context, urlStr string, _ map[string]string) ([]byte, error) {
+		if urlStr == "/error" {
+			return nil, errFetch
+		}
+
+		return []byte("fetched " + urlStr), nil
+	})
+
+	interpolate := func(_ context.Context, s string) (string, error) {
+		return strings.ReplaceAll(s, "$(URL)", "data:,injected"), nil
+	}
+
+	p := esiproc.New(esiproc.WithClient(client), esiproc.WithInterpolateFunc(interpolate))
+
+	testCases := []struct {
+		Name     string
+		Input    string
+		Expected string
+		Fetched  int
+		Error    error
+	}{
+		{
+			Name:     "plain",
+			Input:    `<esi:include src="data:,hello"/>`,
+			Expected: "hello",
+		},
+		{
+			Name:     "percent-encoded",
+			Input:    `<esi:include src="data:text/html,%3Cb%3Ehi%3C%2Fb%3E"/>`,
+			Expected: "<b>hi</b>",
+		},
+		{
+			Name:     "base64",
+			Input:    `<esi:include src="DATA:text/html;BASE64,PGI+aGk8L2I+"/>`,
+			Expected: "<b>hi</b>",
+		},
+		{
+			Name:     "base64 url-safe without padding",
+			Input:    `<esi:include src="data:;base64,` + base64.RawURLEncoding.EncodeToString([]byte("<?>>")) + `"/>`,
+			Expected: "<?>>",
+		},
+		{
+			Name:     "alt",
+			Input:    `<esi:include src="/error" alt="data:,fallback"/>`,
+			Expected: "fallback",
+			Fetched:  1,
+		},
+		{
+			Name:     "interpolated",
+			Input:    `<esi:include src="$(URL)"/>`,
+			Expected: "fetched data:,injected",
+			Fetched:  1,
+		},
+		{
+			Name:  "missing comma",
+			Input: `<esi:include src="data:hello"/>`,
+			Error: &esiproc.InvalidDataURLError{URL: "data:hello"},
+		},
+		{
+			Name:  "invalid base64",
+			Input: `<esi:include src="data:;base64,!!"/>`,
+			Error: &esiproc.InvalidDataURLError{URL: "data:;base64,!!", Err: base64.CorruptInputError(0)},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			var buf bytes.Buffer
+
+			res, err := p.ProcessResult(t.Context(), &buf, esi.NewParser(strings.NewReader(testCase.Input)).All)
+			if !errors.Is(err, testCase.Error) {
+				t.Fatalf("got error %v, want %v", err, testCase.Error)
+			}
+
+			if testCase.Error != nil {
+				return
+			}
+
+			if got := buf.String(); got != testCase.Expected {
+				t.Errorf("got %q, want %q", got, testCase.Expected)
+			}
+
+			if res.Fetched != testCase.Fetched {
+				t.Errorf("got %d fetched includes, want %d", res.Fetched, testCase.Fetched)
+			}
+		})
+	}
+}
+
+func TestProcessor_DataURL_NoClient(t *testing.T) {
+	p := esiproc.New()
+
+	testCases := []struct {
+		Name        string
+		Input       string
+		Expected    string
+		Unsupported bool
+	}{
+		{
+			Name:     "data URL",
+			Input:    `a<esi:include src="data:,b"/>c`,
+			Expected: "abc",
+		},
+		{
+			Name:     "data URL with alt",
+			Input:    `<esi:include src="data:,b" alt="/alt"/>`,
+			Expected: "b",
+		},
+		{
+			Name:        "other URL",
+			Input:       `<esi:include src="/a"/>`,
+			Unsupported: true,
+		},
+		{
+			Name:        "invalid data URL with alt",
+			Input:       `<esi:include src="data:b" alt="/alt"/>`,
+			Unsupported: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			var buf bytes.Buffer
+
+			_, err := p.Process(t.Context(), &buf, esi.NewParser(strings.NewReader(testCase.Input)).All)
+
+			if testCase.Unsupported {
+				var unsupportedErr *esiproc.UnsupportedElementError
+
+				if !errors.As(err, &unsupportedErr) {
+					t.Fatalf("got error %v, want %T", err, unsupportedErr)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+
+			if got := buf.String(); got != testCase.Expected {
+				t.Errorf("got %q, want %q", got, testCase.Expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package esiproc
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WithDebugComments configures a [Processor] to surround the output of each esi:include element with HTML comments
+// that describe how the include was resolved, if enabled returns true for the context passed to [Processor.Process].
+//
+// The comment before the output contains the src attribute of the element, before interpolation. The comment after
+// the output contains the status code reported by the [Client] (see [ReportStatus]), the cache status (see
+// [ReportCacheHit]), the outcome (see [IncludeOutcome]) and the duration of the include. For example:
+//
+//	<!-- esi:include src="/fragments/header" -->...<!-- /esi:include status=200 cache=hit outcome=success time=1.2ms -->
+//
+// Since the comments can reveal details about the infrastructure, they should only be enabled for trusted requests.
+// See [github.com/nussjustin/esi/esihttp.DebugEnabled] for a function that checks for a request header containing a
+// shared secret.
+//
+// Debug comments are only written by [Processor.Process] and [Processor.ProcessResult] and not produced as events by
+// [Processor.Events].
+//
+// If enabled is nil, WithDebugComments panics.
+func WithDebugComments(enabled func(ctx context.Context) bool) ProcessorOpt {
+	if enabled == nil {
+		panic("WithDebugComments called with nil func")
+	}
+
+	return func(p *processorOptions) {
+		p.debugComments = enabled
+	}
+}
+
+// DebugComments returns true if debug comments are enabled for the given context. See [WithDebugComments].
+func (p *Processor) DebugComments(ctx context.Context) bool {
+	return p.opts.debugComments != nil && p.opts.debugComments(ctx)
+}
+
+// appendDebugStart appends the comment written before the output of an include to b.
+func appendDebugStart(b []byte, e IncludeStart) []byte {
+	b = append(b, `<!-- esi:include src="`...)
+	b = append(b, escapeComment(e.Element.Source)...)
+	b = append(b, `" -->`...)
+	return b
+}
+
+// appendDebugEnd appends the comment written after the output of an include to b.
+func appendDebugEnd(b []byte, e IncludeEnd) []byte {
+	b = append(b, `<!-- /esi:include status=`...)
+	b = strconv.AppendInt(b, int64(e.Status), 10)
+	b = append(b, ` cache=`...)
+
+	switch {
+	case e.Reused:
+		b = append(b, "reused"...)
+	case e.CacheHit:
+		b = append(b, "hit"...)
+	default:
+		b = append(b, "miss"...)
+	}
+
+	b = append(b, ` outcome=`...)
+	b = append(b, strings.ToLower(strings.TrimPrefix(e.Outcome.String(), "IncludeOutcome"))...)
+	b = append(b, ` time=`...)
+	b = append(b, e.Duration.Round(100*time.Microsecond).String()...)
+	b = append(b, ` -->`...)
+	return b
+}
+
+// escapeComment escapes s for use inside an HTML comment, so that s can not end the comment.
+func escapeComment(s string) string {
+	return strings.ReplaceAll(s, "--", "-%2D")
+}
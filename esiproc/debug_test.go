@@ -0,0 +1,88 @@
+package esiproc_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nussjustin/esi"
+	"github.com/nussjustin/esi/esiproc"
+)
+
+func TestWithDebugComments(t *testing.T) {
+	const input = `<esi:include src="/a"/>|<esi:include src="/b--c" alt="/alt"/>|` +
+		`<esi:include src="/error" onerror="continue"/>`
+
+	client := esiproc.ClientFunc(func(ctx context.Context, urlStr string, _ map[string]string) ([]byte, error) {
+		switch urlStr {
+		case "/a":
+			esiproc.ReportStatus(ctx, 200)
+			esiproc.ReportCacheHit(ctx)
+		case "/alt":
+			esiproc.ReportStatus(ctx, 203)
+		default:
+			esiproc.ReportStatus(ctx, 500)
+			return nil, errors.New("fetch failed")
+		}
+
+		return []byte(strings.ToUpper(urlStr)), nil
+	})
+
+	type debugKey struct{}
+
+	p := esiproc.New(
+		esiproc.WithClient(client),
+		esiproc.WithClock(func() time.Time { return time.Unix(0, 0) }),
+		esiproc.WithDebugComments(func(ctx context.Context) bool {
+			v, _ := ctx.Value(debugKey{}).(bool)
+			return v
+		}))
+
+	testCases := []struct {
+		Name     string
+		Debug    bool
+		Expected string
+	}{
+		{
+			Name:     "disabled",
+			Expected: `/A|/ALT|`,
+		},
+		{
+			Name:  "enabled",
+			Debug: true,
+			Expected: `<!-- esi:include src="/a" -->/A` +
+				`<!-- /esi:include status=200 cache=hit outcome=success time=0s -->|` +
+				`<!-- esi:include src="/b-%2Dc" -->/ALT` +
+				`<!-- /esi:include status=203 cache=miss outcome=alt time=0s -->|` +
+				`<!-- esi:include src="/error" -->` +
+				`<!-- /esi:include status=500 cache=miss outcome=suppressed time=0s -->`,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			ctx := context.WithValue(t.Context(), debugKey{}, testCase.Debug)
+
+			var buf bytes.Buffer
+
+			if _, err := p.Process(ctx, &buf, esi.NewParser(strings.NewReader(input)).All); err != nil {
+				t.Fatalf("got error %v", err)
+			}
+
+			if got := buf.String(); got != testCase.Expected {
+				t.Errorf("got output %q, want %q", got, testCase.Expected)
+			}
+
+			if got := p.DebugComments(ctx); got != testCase.Debug {
+				t.Errorf("got DebugComments %t, want %t", got, testCase.Debug)
+			}
+		})
+	}
+
+	if esiproc.New().DebugComments(t.Context()) {
+		t.Error("got DebugComments true without WithDebugComments")
+	}
+}
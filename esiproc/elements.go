@@ -0,0 +1,56 @@
+package esiproc
+
+import (
+	"context"
+
+	"github.com/nussjustin/esi"
+)
+
+type elementsKey struct{}
+
+// elementChain is an immutable, linked list of elements, with the innermost element at the head.
+type elementChain struct {
+	parent *elementChain
+	ele    esi.Element
+	depth  int
+}
+
+// Elements returns the chain of elements containing the node that is currently processed for ctx, starting with the
+// outermost element.
+//
+// The chain includes the element that is currently processed. For example, when a [Client] is called for an
+// esi:include element inside an esi:attempt element, the result is [*esi.TryElement], [*esi.AttemptElement],
+// [*esi.IncludeElement]. When the test of an esi:when element is evaluated, the chain ends with the
+// [*esi.ChooseElement] and the [*esi.WhenElement].
+//
+// This can be used by an [EvalFunc], [InterpolateFunc] or [Client] to make decisions based on the position in the
+// document at which they are invoked.
+//
+// If ctx does not belong to a [Processor], or no element is processed, Elements returns nil.
+func Elements(ctx context.Context) []esi.Element {
+	c, _ := ctx.Value(elementsKey{}).(*elementChain)
+	if c == nil {
+		return nil
+	}
+
+	elements := make([]esi.Element, c.depth)
+
+	for i := len(elements) - 1; c != nil; i, c = i-1, c.parent {
+		elements[i] = c.ele
+	}
+
+	return elements
+}
+
+// withElement returns a context that has the given element added to the element chain of ctx.
+func withElement(ctx context.Context, ele esi.Element) context.Context {
+	parent, _ := ctx.Value(elementsKey{}).(*elementChain)
+
+	c := &elementChain{parent: parent, ele: ele, depth: 1}
+
+	if parent != nil {
+		c.depth = parent.depth + 1
+	}
+
+	return context.WithValue(ctx, elementsKey{}, c)
+}
@@ -0,0 +1,91 @@
+package esiproc_test
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/nussjustin/esi"
+	"github.com/nussjustin/esi/esiproc"
+)
+
+func TestElements(t *testing.T) {
+	if got := esiproc.Elements(t.Context()); got != nil {
+		t.Errorf("got %v for context without processor, want nil", got)
+	}
+
+	const input = `<esi:try>` +
+		`<esi:attempt><esi:include src="/attempt"/></esi:attempt>` +
+		`<esi:except><esi:include src="/except"/></esi:except>` +
+		`</esi:try>` +
+		`<esi:choose>` +
+		`<esi:when test="false">no</esi:when>` +
+		`<esi:when test="true"><esi:include src="/when"/></esi:when>` +
+		`<esi:otherwise>otherwise</esi:otherwise>` +
+		`</esi:choose>` +
+		`<esi:include src="/top"/>`
+
+	names := func(ctx context.Context) string {
+		var s []string
+
+		for _, ele := range esiproc.Elements(ctx) {
+			s = append(s, ele.Name().Local)
+		}
+
+		return strings.Join(s, ">")
+	}
+
+	var mu sync.Mutex
+	got := make(map[string]string)
+
+	record := func(key, value string) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		got[key] = value
+	}
+
+	p := esiproc.New(
+		esiproc.WithClient(esiproc.ClientFunc(func(ctx context.Context, urlStr string, _ map[string]string) ([]byte, error) {
+			record("client "+urlStr, names(ctx))
+
+			if urlStr == "/attempt" {
+				return nil, io.ErrUnexpectedEOF
+			}
+
+			return nil, nil
+		})),
+		esiproc.WithEvalFunc(func(ctx context.Context, expr string) (any, error) {
+			record("eval "+expr, names(ctx))
+			return expr == "true", nil
+		}),
+		esiproc.WithInterpolateFunc(func(ctx context.Context, s string) (string, error) {
+			record("interpolate "+s, names(ctx))
+			return s, nil
+		}))
+
+	if _, err := p.Process(t.Context(), io.Discard, esi.NewParser(strings.NewReader(input)).All); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	want := map[string]string{
+		"client /attempt":      "try>attempt>include",
+		"client /except":       "try>except>include",
+		"client /top":          "include",
+		"client /when":         "choose>when>include",
+		"eval false":           "choose>when",
+		"eval true":            "choose>when",
+		"interpolate /attempt": "try>attempt>include",
+		"interpolate /except":  "try>except>include",
+		"interpolate /top":     "include",
+		"interpolate /when":    "choose>when>include",
+	}
+
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("element chains mismatch (-want +got):\n%s", diff)
+	}
+}
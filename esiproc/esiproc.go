@@ -2,17 +2,31 @@
 package esiproc
 
 import (
+	"cmp"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"iter"
-	"sync"
+	"runtime/debug"
+	"slices"
+	"sync/atomic"
+	"time"
 
 	"github.com/nussjustin/esi"
 	"github.com/nussjustin/esi/esiexpr/ast"
+	"github.com/nussjustin/esi/internal/diag"
 )
 
+// ErrInsufficientBudget is returned for includes that were not started, because the time remaining until the deadline
+// of the context was less than the minimum configured using [WithMinIncludeBudget].
+var ErrInsufficientBudget = errors.New("insufficient time remaining for include")
+
+// ErrOptionalIncludeSkipped is reported via [IncludeEnd.Suppressed] for optional includes that were skipped or
+// cancelled, because the time remaining until the deadline of the context was less than the time reserved using
+// [WithOptionalIncludes].
+var ErrOptionalIncludeSkipped = errors.New("optional include skipped")
+
 // InvalidExpressionResultError is returned when the result of an expression has the wrong type.
 type InvalidExpressionResultError struct {
 	// Element is the element for which the error was reported.
@@ -25,6 +39,11 @@ type InvalidExpressionResultError struct {
 	Result ast.Value
 }
 
+// Code returns a machine-readable code identifying the type of the error.
+func (*InvalidExpressionResultError) Code() string {
+	return "esiproc.invalid_expression_result"
+}
+
 // Error returns a human-readable error message.
 func (e *InvalidExpressionResultError) Error() string {
 	return fmt.Sprintf("invalid expression result %q", fmt.Sprint(e.Result))
@@ -36,12 +55,116 @@ func (e *InvalidExpressionResultError) Is(err error) bool {
 	return errors.As(err, &o) && o.Error() == e.Error()
 }
 
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (e *InvalidExpressionResultError) MarshalJSON() ([]byte, error) {
+	d := elementDiagnostic(e.Element)
+	d.Details = map[string]any{"expr": e.Expr}
+	if e.Result != nil {
+		d.Got = fmt.Sprint(e.Result)
+	}
+	return diag.Marshal(e, d)
+}
+
+// PanicError is returned when a panic was recovered, for example inside a [Client] wrapped using [ClientWithRecover]
+// or inside one of the goroutines used by a [Processor].
+type PanicError struct {
+	// Value is the value passed to panic.
+	Value any
+
+	// Stack contains the formatted stack trace of the panicking goroutine, as returned by [debug.Stack].
+	Stack []byte
+}
+
+// Code returns a machine-readable code identifying the type of the error.
+func (*PanicError) Code() string {
+	return "esiproc.panic"
+}
+
+// Error returns a human-readable error message.
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("recovered panic: %v", e.Value)
+}
+
+// Is checks if the given error matches the receiver.
+func (e *PanicError) Is(err error) bool {
+	var o *PanicError
+	return errors.As(err, &o) && o.Error() == e.Error()
+}
+
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (e *PanicError) MarshalJSON() ([]byte, error) {
+	d := diag.Diagnostic{Details: map[string]any{"value": fmt.Sprint(e.Value)}}
+	if err, ok := e.Value.(error); ok {
+		d.Cause = diag.Cause(err)
+	}
+	return diag.Marshal(e, d)
+}
+
+// Unwrap returns e.Value if it is an error or nil otherwise.
+func (e *PanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
+func newPanicError(v any) *PanicError {
+	return &PanicError{Value: v, Stack: debug.Stack()}
+}
+
+// elementDiagnostic returns a [diag.Diagnostic] with the name and position of the given element, if not nil.
+func elementDiagnostic(el esi.Element) diag.Diagnostic {
+	if el == nil {
+		return diag.Diagnostic{}
+	}
+
+	start, end := el.Pos()
+
+	return diag.Diagnostic{Start: diag.Int(start), End: diag.Int(end), Element: el.Name().String()}
+}
+
+// TooManyIncludesError is returned for esi:include elements that exceed the limit configured using [WithMaxIncludes].
+type TooManyIncludesError struct {
+	// Element is the element for which the error was reported.
+	Element esi.Element
+
+	// Max is the maximum number of includes per document.
+	Max int
+}
+
+// Code returns a machine-readable code identifying the type of the error.
+func (*TooManyIncludesError) Code() string {
+	return "esiproc.too_many_includes"
+}
+
+// Error returns a human-readable error message.
+func (e *TooManyIncludesError) Error() string {
+	start, end := e.Element.Pos()
+	return fmt.Sprintf("too many includes, %s at position %d:%d exceeds limit of %d", e.Element.Name(), start, end, e.Max)
+}
+
+// Is checks if the given error matches the receiver.
+func (e *TooManyIncludesError) Is(err error) bool {
+	var o *TooManyIncludesError
+	return errors.As(err, &o) && o.Error() == e.Error()
+}
+
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (e *TooManyIncludesError) MarshalJSON() ([]byte, error) {
+	d := elementDiagnostic(e.Element)
+	d.Details = map[string]any{"max": e.Max}
+	return diag.Marshal(e, d)
+}
+
 // UnexpectedElementError is returned when encountering an element that is not expected in the given context.
 type UnexpectedElementError struct {
 	// Element is the element for which the error was reported.
 	Element esi.Element
 }
 
+// Code returns a machine-readable code identifying the type of the error.
+func (*UnexpectedElementError) Code() string {
+	return "esiproc.unexpected_element"
+}
+
 // Error returns a human-readable error message.
 func (e *UnexpectedElementError) Error() string {
 	start, end := e.Element.Pos()
@@ -54,6 +177,11 @@ func (e *UnexpectedElementError) Is(err error) bool {
 	return errors.As(err, &o) && o.Error() == e.Error()
 }
 
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (e *UnexpectedElementError) MarshalJSON() ([]byte, error) {
+	return diag.Marshal(e, elementDiagnostic(e.Element))
+}
+
 // UnsupportedElementError is returned when encountering an element that is not supported, either because it is not
 // implemented or because the configuration of the [Processor] is not configured to handle it.
 type UnsupportedElementError struct {
@@ -61,6 +189,11 @@ type UnsupportedElementError struct {
 	Element esi.Element
 }
 
+// Code returns a machine-readable code identifying the type of the error.
+func (*UnsupportedElementError) Code() string {
+	return "esiproc.unsupported_element"
+}
+
 // Error returns a human-readable error message.
 func (e *UnsupportedElementError) Error() string {
 	start, end := e.Element.Pos()
@@ -73,15 +206,60 @@ func (e *UnsupportedElementError) Is(err error) bool {
 	return errors.As(err, &o) && o.Error() == e.Error()
 }
 
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (e *UnsupportedElementError) MarshalJSON() ([]byte, error) {
+	return diag.Marshal(e, elementDiagnostic(e.Element))
+}
+
 // Unwrap returns [errors.ErrUnsupported].
 func (e *UnsupportedElementError) Unwrap() error {
 	return errors.ErrUnsupported
 }
 
+// WriteError is returned by [Processor.Process] when writing to the given [io.Writer] fails.
+type WriteError struct {
+	// Err is the error returned by the writer.
+	Err error
+}
+
+// Code returns a machine-readable code identifying the type of the error.
+func (*WriteError) Code() string {
+	return "esiproc.write"
+}
+
+// Error returns a human-readable error message.
+func (e *WriteError) Error() string {
+	return fmt.Sprintf("write failed: %s", e.Err)
+}
+
+// Is checks if the given error matches the receiver.
+func (e *WriteError) Is(err error) bool {
+	var o *WriteError
+	return errors.As(err, &o) && errors.Is(o.Err, e.Err)
+}
+
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (e *WriteError) MarshalJSON() ([]byte, error) {
+	return diag.Marshal(e, diag.Diagnostic{Cause: diag.Cause(e.Err)})
+}
+
+// Unwrap returns e.Err.
+func (e *WriteError) Unwrap() error {
+	return e.Err
+}
+
 // Client defines methods used for fetching URLs for the processing of <esi:include/> elements.
+//
+// Implementations must be safe for concurrent use. See [ClientWithTimeout] and [ClientWithRecover] for wrappers that
+// protect the [Processor] against implementations that do not follow the contract of Do.
+//
+// The elements containing the esi:include element can be retrieved from the context using [Elements].
 type Client interface {
 	// Do is called with the URL that should be included (either the src or alt attribute) and should return the
 	// data to include.
+	//
+	// Do must return as soon as possible once ctx is canceled, since processing can not finish before all calls to
+	// Do have returned. Do must not panic.
 	Do(ctx context.Context, urlStr string, extra map[string]string) ([]byte, error)
 }
 
@@ -94,9 +272,13 @@ func (c ClientFunc) Do(ctx context.Context, urlStr string, extra map[string]stri
 }
 
 // EvalFunc defines the signature for functions used to evaluate bool-producing ESI expressions.
+//
+// The element for which the expression is evaluated can be retrieved from the context using [Elements].
 type EvalFunc func(ctx context.Context, expr string) (any, error)
 
 // InterpolateFunc defines the signature for functions used to interpolate variables in a given string.
+//
+// The element for which the string is interpolated can be retrieved from the context using [Elements].
 type InterpolateFunc func(ctx context.Context, s string) (string, error)
 
 // ProcessorOpt is the type for functions that can be used to customize the behaviour of a [Processor].
@@ -105,13 +287,38 @@ type ProcessorOpt func(*processorOptions)
 type processorOptions struct {
 	client            Client
 	clientConcurrency int
+	contextFuncs      []func(context.Context) (context.Context, func())
+	debugComments     func(context.Context) bool
 	evalFunc          EvalFunc
+	flush             bool
+	fragmentStore     FragmentStore
+	injectionGuard    bool
 	interpolateFunc   InterpolateFunc
+	maxBranches       int
+	maxIncludes       int
+	maxPendingNodes   int
+	minIncludeBudget  time.Duration
+	now               func() time.Time
+	optionalFunc      func(*esi.IncludeElement) bool
+	optionalReserve   time.Duration
+	parallelEval      int
+	profile           esi.CompatibilityProfile
+	queryModifiers    []queryModifier
+	trimWhitespace    bool
+	varsInterpolate   InterpolateFunc
+	varsNesting       VarsNesting
+	writeBufferSize   int
+	writeTimeout      time.Duration
+}
+
+// varnish returns true if the processor mirrors the ESI subset implemented by Varnish.
+func (o *processorOptions) varnish() bool {
+	return o.profile == esi.ProfileFastly || o.profile == esi.ProfileVarnish
 }
 
 // WithClient specifies the client used to process <esi:include/> elements.
 //
-// If c is nil, <esi:include/> elements will be unsupported.
+// If c is nil, <esi:include/> elements will be unsupported, unless they use a data: URL (see [Processor]).
 func WithClient(c Client) ProcessorOpt {
 	return func(p *processorOptions) {
 		p.client = c
@@ -144,6 +351,9 @@ func WithEvalFunc(f EvalFunc) ProcessorOpt {
 
 // WithInterpolateFunc specifies the function used to interpolate variables into URLs for <esi:include> elements.
 //
+// Unless a different function is given using [WithVarsInterpolateFunc], the function is also used for the content of
+// <esi:vars> elements.
+//
 // If not given or if the last given function is nil, no interpolation is performance.
 func WithInterpolateFunc(f InterpolateFunc) ProcessorOpt {
 	return func(p *processorOptions) {
@@ -151,6 +361,243 @@ func WithInterpolateFunc(f InterpolateFunc) ProcessorOpt {
 	}
 }
 
+// WithClock specifies the function used to get the current time, for example when checking the budget for includes
+// (see [WithMinIncludeBudget]).
+//
+// The function is also made available to the [EvalFunc] and [InterpolateFunc] via [Now], so that time-based
+// variables like DATE_GMT use the same clock. This allows rendering timestamps deterministically in tests.
+//
+// The default is [time.Now].
+//
+// If now is nil, WithClock panics.
+func WithClock(now func() time.Time) ProcessorOpt {
+	if now == nil {
+		panic("WithClock called with nil function")
+	}
+
+	return func(p *processorOptions) {
+		p.now = now
+	}
+}
+
+// WithCompatibilityProfile configures a [Processor] to mirror the behaviour of the given profile.
+//
+// Depending on the profile, the following options are used:
+//
+//   - [esi.ProfileSpecStrict] uses [WithVarsNesting] with [VarsNestingReject].
+//   - [esi.ProfileFastly] and [esi.ProfileVarnish] use [WithVarnishCompatibility].
+//
+// Documents should be parsed using [esi.WithCompatibilityProfile] with the same profile.
+//
+// Expressions are not affected by the profile. To restrict the expression syntax, set the Strict field of the
+// [github.com/nussjustin/esi/esiexpr.Env] used for evaluating expressions based on
+// [esi.CompatibilityProfile.ExpressionExtensions].
+//
+// If profile is not a known profile, WithCompatibilityProfile panics.
+func WithCompatibilityProfile(profile esi.CompatibilityProfile) ProcessorOpt {
+	if _, err := profile.MarshalText(); err != nil {
+		panic("WithCompatibilityProfile called with unknown profile")
+	}
+
+	return func(p *processorOptions) {
+		p.profile = profile
+
+		if profile == esi.ProfileSpecStrict {
+			p.varsNesting = VarsNestingReject
+		}
+	}
+}
+
+// WithContextFunc specifies a function that is called once at the start of each call to [Processor.Process],
+// [Processor.ProcessResult] or [Processor.Events] to decorate the context used for processing the document.
+//
+// The returned context is passed to all callbacks for the document, like the [EvalFunc], [InterpolateFunc] and
+// [Client], instead of the original context. This allows attaching values, like a tracing span, once per document
+// instead of in each callback.
+//
+// If the returned function is not nil, it is called once processing the document has finished, for example to end
+// the span.
+//
+// WithContextFunc can be given multiple times. The functions are applied in the order given and the returned
+// functions are called in reverse order.
+//
+// If f is nil, WithContextFunc panics.
+func WithContextFunc(f func(ctx context.Context) (context.Context, func())) ProcessorOpt {
+	if f == nil {
+		panic("WithContextFunc called with nil function")
+	}
+
+	return func(p *processorOptions) {
+		p.contextFuncs = append(p.contextFuncs, f)
+	}
+}
+
+// WithMaxIncludes configures a [Processor] to process at most n esi:include elements per call to [Processor.Process].
+//
+// Includes exceeding the limit are not fetched and instead fail with a [*TooManyIncludesError]. The alt attribute is
+// ignored for these includes, but onerror and esi:try are handled as for any other failed include.
+//
+// If n is 0, no limit will be set. This is the default.
+//
+// If n is < 0, WithMaxIncludes panics.
+func WithMaxIncludes(n int) ProcessorOpt {
+	if n < 0 {
+		panic("WithMaxIncludes called with n < 0")
+	}
+
+	return func(p *processorOptions) {
+		p.maxIncludes = n
+	}
+}
+
+// WithMaxPendingNodes configures a [Processor] to read at most n nodes ahead of the consumer.
+//
+// By default, nodes are read and processed as fast as possible, independent of how fast the output is consumed. This
+// means includes are started early, but for documents with many includes, many nodes and include responses may be
+// held in memory at once.
+//
+// With a limit, the next node is only read once less than n of the nodes read so far are still waiting to be
+// written or returned as events. This bounds the memory used for pending nodes and their includes at the cost of
+// starting includes later.
+//
+// If n is 0, no limit will be set. This is the default.
+//
+// If n is < 0, WithMaxPendingNodes panics.
+func WithMaxPendingNodes(n int) ProcessorOpt {
+	if n < 0 {
+		panic("WithMaxPendingNodes called with n < 0")
+	}
+
+	return func(p *processorOptions) {
+		p.maxPendingNodes = n
+	}
+}
+
+// WithMinIncludeBudget configures a [Processor] to not start fetching includes if the context has a deadline and the
+// time remaining until the deadline is less than d.
+//
+// Includes that are not started fail immediately with [ErrInsufficientBudget], so that alt, onerror and esi:try are
+// handled as for any other failed include, instead of the whole processing failing with
+// [context.DeadlineExceeded].
+//
+// The remaining time is checked right before calling the [Client], after waiting for the concurrency limit (see
+// [WithClientConcurrency]).
+//
+// If d is 0, includes are always started. This is the default.
+//
+// If d is < 0, WithMinIncludeBudget panics.
+func WithMinIncludeBudget(d time.Duration) ProcessorOpt {
+	if d < 0 {
+		panic("WithMinIncludeBudget called with d < 0")
+	}
+
+	return func(p *processorOptions) {
+		p.minIncludeBudget = d
+	}
+}
+
+// WithOptionalIncludes configures a [Processor] to treat includes for which f returns true as optional.
+//
+// Optional includes are meant for content that is nice to have, but not required, like ads or recommendations. They
+// are handled differently from other includes in the following ways:
+//
+//   - When waiting for the concurrency limit (see [WithClientConcurrency]), other includes are always started before
+//     optional includes.
+//   - If the context has a deadline, optional includes are only started and allowed to run as long as the time
+//     remaining until the deadline is at least reserve. Otherwise the include is cancelled and produces no output,
+//     independent of the alt and onerror attributes or any esi:try element.
+//
+// Skipped optional includes are reported with [IncludeOutcomeSkipped] and [ErrOptionalIncludeSkipped].
+//
+// Independent of this option, includes with the same priority that are waiting for the concurrency limit are started
+// in the order in which they appear in the input.
+//
+// For example, to treat all includes with a non-standard optional="yes" attribute as optional:
+//
+//	esiproc.WithOptionalIncludes(func(ele *esi.IncludeElement) bool {
+//		return slices.Contains(ele.Attr, esixml.Attr{Name: esixml.Name{Local: "optional"}, Value: "yes"})
+//	}, 100*time.Millisecond)
+//
+// If f is nil, no includes are optional. This is the default.
+//
+// If reserve is < 0, WithOptionalIncludes panics.
+func WithOptionalIncludes(f func(*esi.IncludeElement) bool, reserve time.Duration) ProcessorOpt {
+	if reserve < 0 {
+		panic("WithOptionalIncludes called with reserve < 0")
+	}
+
+	return func(p *processorOptions) {
+		p.optionalFunc = f
+		p.optionalReserve = reserve
+	}
+}
+
+// WithTrimWhitespace configures a [Processor] to remove whitespace around ESI block elements, like esi:choose or
+// esi:remove, so that the output does not contain empty lines where the ESI markup used to be.
+//
+// See [esi.TrimWhitespace] for details.
+func WithTrimWhitespace() ProcessorOpt {
+	return func(p *processorOptions) {
+		p.trimWhitespace = true
+	}
+}
+
+// WithVarnishCompatibility configures a [Processor] to mirror the ESI handling of Varnish Cache.
+//
+// Varnish only implements the esi:include, esi:remove and esi:comment elements as well as ESI comments
+// (<!--esi ... -->). When using WithVarnishCompatibility the following changes apply:
+//
+//   - Start and end tags of other ESI elements are removed, but their content is kept. For esi:choose the content of
+//     all esi:when and esi:otherwise elements is kept and for esi:try the content of both esi:attempt and esi:except.
+//   - The alt attribute of esi:include elements is ignored and no variables are interpolated in the src attribute.
+//   - Raw data inside esi:remove elements is removed, but esi:include elements inside are still processed and their
+//     result included in the output.
+//
+// Documents should be parsed using [esi.WithVarnishCompatibility].
+func WithVarnishCompatibility() ProcessorOpt {
+	return func(p *processorOptions) {
+		p.profile = esi.ProfileVarnish
+	}
+}
+
+// WithWriteBuffer configures a [Processor] to buffer up to n bytes of output before writing to the [io.Writer]
+// given to [Processor.Process].
+//
+// Without a buffer, Process writes each processed part of the output separately, which can result in many small
+// writes. When writing directly to a network connection, batching writes reduces the number of system calls.
+//
+// Buffered data is written before the buffer would exceed n bytes, when processing finishes and each time before
+// Process has to wait for the result of an include or other element, so that buffering does not delay output.
+// Parts that are larger than the buffer are written directly.
+//
+// If n is 0, output is not buffered. This is the default.
+//
+// If n is < 0, WithWriteBuffer panics.
+func WithWriteBuffer(n int) ProcessorOpt {
+	if n < 0 {
+		panic("WithWriteBuffer called with n < 0")
+	}
+
+	return func(p *processorOptions) {
+		p.writeBufferSize = n
+	}
+}
+
+// WithFlush configures a [Processor] to flush the [io.Writer] given to [Processor.Process] each time before Process
+// has to wait for the result of an include or other element or for more input, so that processed output is sent to
+// the client while includes are still being fetched.
+//
+// The writer is flushed if it has a FlushError or Flush method returning an error, like [*bufio.Writer], or a Flush
+// method without result, like [net/http.Flusher]. Writers without such a method are not flushed.
+//
+// Flushing only happens if data was written since the last flush. If a [WithWriteBuffer] is configured, the buffer
+// is written first. An error returned by the flush is returned as [*WriteError].
+func WithFlush() ProcessorOpt {
+	return func(p *processorOptions) {
+		p.flush = true
+	}
+}
+
 // Processor implements the handling of ESI elements.
 //
 // The following elements are supported:
@@ -170,24 +617,127 @@ func WithInterpolateFunc(f InterpolateFunc) ProcessorOpt {
 // If a non-nil [Env] is specified, using [WithEnv], both the src and alt attributes of the esi:include element will
 // have any variables inside replaced via [Env.Interpolate].
 //
+// Includes with the non-standard name attribute (see [esi.IncludeElement.FragmentName]) are fetched only once per
+// document. Later includes with the same name reuse the result of the earlier include, independent of their own src
+// and alt attributes, and are reported with [IncludeEnd.Reused] set to true. The onerror attribute of each include is
+// still respected. See also [VarIncludeStatus].
+//
+// Includes with a data: URL (RFC 2397) in the src or alt attribute, like "data:,fallback" or
+// "data:text/html;base64,PGI+aGk8L2I+", are handled by the Processor itself by decoding the payload, without calling
+// the [Client] and without applying limits or query modifications. This is useful for tests and for embedding small
+// fallback fragments. Only URLs that use the data: scheme in the markup are handled this way and variables inside
+// them are not interpolated, so a data: URL can never be the result of interpolation. Invalid data: URLs cause the
+// include to fail with an [*InvalidDataURLError].
+//
 // Other elements are not supported and will result in an error when trying to process them.
 //
-// Processor is safe for concurrent use.
+// All callbacks, like the [EvalFunc], [InterpolateFunc], [QueryFunc] and [Client], are called with a context derived
+// from the context given to [Processor.Process], [Processor.ProcessResult] or [Processor.Events], so that all values
+// of that context are available to them. See also [WithContextFunc].
+//
+// Processor is safe for concurrent use. Use [Processor.Close] to wait for all outstanding work, for example during a
+// graceful shutdown.
 type Processor struct {
 	opts    processorOptions
-	incSema chan struct{}
+	incSema *semaphore
+	life    *lifecycle
+
+	// ownSema is true if incSema was created for this processor and not shared with the processor it was created from.
+	ownSema bool
 }
 
+type clockKey struct{}
+
+type includeCountKey struct{}
+
+type includeKey struct{}
+
 type include struct {
+	ele  *esi.IncludeElement
 	done chan struct{}
 	data []byte
 	err  error
+
+	// Scheduling information, see [semaphore]
+	optional bool
+	seq      uint64
+
+	// Information for [IncludeEnd]
+	cacheHit   atomic.Bool
+	status     atomic.Int32
+	duration   time.Duration
+	reused     bool
+	outcome    IncludeOutcome
+	sourceErr  error
+	suppressed error
 }
 
 type processedNode struct {
-	inc  *include
-	data []byte
-	err  error
+	inc           *include
+	data          []byte
+	err           error
+	attemptFailed *AttemptFailed
+	branch        *BranchTaken
+
+	// nodeDone marks the end of the results for a node read from the input when using [WithMaxPendingNodes].
+	nodeDone bool
+}
+
+// end returns the [IncludeEnd] event for the include. It must only be called once the include is finished.
+func (i *include) end() IncludeEnd {
+	return IncludeEnd{
+		Element:     i.ele,
+		Duration:    i.duration,
+		CacheHit:    i.cacheHit.Load(),
+		Status:      int(i.status.Load()),
+		Reused:      i.reused,
+		Outcome:     i.outcome,
+		SourceError: i.sourceErr,
+		Suppressed:  i.suppressed,
+	}
+}
+
+// finished returns true if the include is finished and waiting for it does not block.
+func (i *include) finished() bool {
+	select {
+	case <-i.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// reuse sets the result of i to the result of prev once prev is finished.
+func (i *include) reuse(ctx context.Context, prev *include) {
+	defer close(i.done)
+
+	start := Now(ctx)
+
+	defer func() {
+		i.duration = Now(ctx).Sub(start)
+	}()
+
+	i.reused = true
+
+	select {
+	case <-ctx.Done():
+		i.err = ctx.Err()
+	case <-prev.done:
+		if prev.outcome == IncludeOutcomeSkipped {
+			i.outcome, i.suppressed = prev.outcome, prev.suppressed
+			return
+		}
+
+		i.data, i.err = prev.data, cmp.Or(prev.err, prev.suppressed)
+		i.outcome, i.sourceErr = prev.outcome, prev.sourceErr
+		i.cacheHit.Store(prev.cacheHit.Load())
+		i.status.Store(prev.status.Load())
+	}
+
+	if i.err != nil && i.ele.OnError == esi.ErrorBehaviourContinue {
+		i.err, i.suppressed = nil, i.err
+		i.outcome = IncludeOutcomeSuppressed
+	}
 }
 
 func (p *processedNode) wait(ctx context.Context) ([]byte, error) {
@@ -208,7 +758,7 @@ func (p *processedNode) wait(ctx context.Context) ([]byte, error) {
 //
 // The default is equivalent to: New(WithClientConcurrency(1)).
 func New(opts ...ProcessorOpt) *Processor {
-	p := &Processor{}
+	p := &Processor{life: &lifecycle{}}
 	p.opts.clientConcurrency = 1
 
 	for _, opt := range opts {
@@ -216,77 +766,256 @@ func New(opts ...ProcessorOpt) *Processor {
 	}
 
 	if p.opts.clientConcurrency > 0 {
-		p.incSema = make(chan struct{}, p.opts.clientConcurrency)
+		p.incSema = newSemaphore(p.opts.clientConcurrency)
+		p.ownSema = true
 	}
 
 	return p
 }
 
+// With returns a new Processor that uses the options of p, overridden by the given options.
+//
+// This can be used to change single options for some calls, for example to use a different [EvalFunc] or client for
+// preview requests, without having to construct and configure a separate Processor for each combination.
+//
+// The returned Processor shares the limit for concurrent calls to the [Client] with p, unless the limit is changed
+// using [WithClientConcurrency], in which case the returned Processor uses its own limit.
+//
+// If no options are given, p is returned.
+func (p *Processor) With(opts ...ProcessorOpt) *Processor {
+	if len(opts) == 0 {
+		return p
+	}
+
+	o := &Processor{opts: p.opts, incSema: p.incSema, life: &lifecycle{parent: p.life}}
+
+	// Make sure options that append to slices do not modify the options of p
+	o.opts.contextFuncs = slices.Clip(o.opts.contextFuncs)
+	o.opts.queryModifiers = slices.Clip(o.opts.queryModifiers)
+
+	for _, opt := range opts {
+		opt(&o.opts)
+	}
+
+	if o.opts.clientConcurrency != p.opts.clientConcurrency {
+		o.incSema = nil
+
+		if o.opts.clientConcurrency > 0 {
+			o.incSema = newSemaphore(o.opts.clientConcurrency)
+			o.ownSema = true
+		}
+	}
+
+	return o
+}
+
+// Now returns the current time according to the clock of the [Processor] that is processing the nodes for ctx.
+//
+// If ctx does not belong to a Processor, or the Processor uses the default clock, Now returns [time.Now].
+//
+// See also [WithClock].
+func Now(ctx context.Context) time.Time {
+	if now, ok := ctx.Value(clockKey{}).(func() time.Time); ok {
+		return now()
+	}
+
+	return time.Now()
+}
+
 // Process processes the given data and writes the result to w.
 //
-// When encountering an unsupported element, [errors.ErrUnsupported] is returned.
+// It returns the number of bytes written to w, even if an error occurred.
+//
+// When encountering an unsupported element, [errors.ErrUnsupported] is returned. If writing to w fails, a
+// [*WriteError] wrapping the error returned by w is returned.
 //
-// If Process is called after Release, an error is returned.
+// If p was closed using [Processor.Close], a [*ClosedError] is returned.
+//
+// See also [Processor.Events].
 func (p *Processor) Process(ctx context.Context, w io.Writer, nodes iter.Seq2[esi.Node, error]) (int, error) {
-	ctx, cancel := context.WithCancel(ctx)
+	return p.process(ctx, w, nodes, nil)
+}
 
-	resC := make(chan processedNode, 32)
+// process implements [Processor.Process] and [Processor.ProcessResult].
+//
+// If res is not nil, information about includes and branches is added to it.
+func (p *Processor) process(
+	ctx context.Context,
+	w io.Writer,
+	nodes iter.Seq2[esi.Node, error],
+	res *Result,
+) (int, error) {
+	ow := p.newOutputWriter(w)
+	bw := &batchWriter{w: &ow}
+
+	var beforeWait func() error
+
+	if p.opts.writeBufferSize > 0 {
+		bw.buf = make([]byte, 0, p.opts.writeBufferSize)
+		beforeWait = bw.flush
+	}
 
-	var wg sync.WaitGroup
-	wg.Add(2)
+	if p.opts.flush {
+		if bw.flusher = ow.flusher(flusherFor(w)); bw.flusher != nil {
+			beforeWait = bw.flushAll
+		}
+	}
 
-	var firstErr error
-	var totalWritten int
+	debug := p.DebugComments(ctx)
 
-	go func() {
-		defer wg.Done()
-		defer close(resC)
+	// debugBuf is reused for the debug comments, since the data is either copied or written directly.
+	var debugBuf []byte
 
-		p.processNodesIter(ctx, resC, nodes)
-	}()
+	for event, err := range p.events(ctx, nodes, beforeWait) {
+		if err != nil {
+			// Do not hide the original error if writing the buffered data fails, too.
+			_ = bw.flush()
 
-	go func() {
-		defer wg.Done()
-		defer cancel()
+			return bw.written, err
+		}
 
-		for {
-			var res processedNode
-			var ok bool
+		var data []byte
 
-			select {
-			case <-ctx.Done():
-				firstErr = ctx.Err()
-				return
-			case res, ok = <-resC:
-				if !ok {
-					return
-				}
+		switch event := event.(type) {
+		case AttemptFailed:
+			if res != nil {
+				res.FailedAttempts = append(res.FailedAttempts, event)
+			}
 
-				data, err := res.wait(ctx)
-				if err != nil {
-					firstErr = err
-					return
-				}
+			continue
+		case BranchTaken:
+			if res != nil {
+				res.Branches = append(res.Branches, event)
+			}
 
-				n1, err := w.Write(data)
-				if err != nil {
-					firstErr = err
-					return
-				}
+			continue
+		case DataChunk:
+			data = event.Data
+		case IncludeData:
+			data = event.Data
+		case IncludeEnd:
+			if res != nil {
+				res.Includes = append(res.Includes, event)
+			}
 
-				totalWritten += n1
+			if !debug {
+				continue
+			}
+
+			debugBuf = appendDebugEnd(debugBuf[:0], event)
+			data = debugBuf
+		case IncludeStart:
+			if !debug {
+				continue
 			}
+
+			debugBuf = appendDebugStart(debugBuf[:0], event)
+			data = debugBuf
+		default:
+			continue
 		}
-	}()
 
-	// Ensure we are completely finished with reading from nodes to avoid data races when re-using parsers.
-	wg.Wait()
+		if err := bw.write(data); err != nil {
+			return bw.written, err
+		}
+	}
+
+	if err := bw.flush(); err != nil {
+		return bw.written, err
+	}
+
+	return bw.written, nil
+}
+
+// batchWriter writes data to an [io.Writer], batching small writes using buf.
+type batchWriter struct {
+	w       io.Writer
+	buf     []byte
+	written int
+
+	// flusher flushes w, if not nil. dirty is true if data was written to w since the last flush.
+	flusher func() error
+	dirty   bool
+}
+
+// flush writes the buffered data to the underlying writer.
+func (b *batchWriter) flush() error {
+	if len(b.buf) == 0 {
+		return nil
+	}
+
+	err := b.writeDirect(b.buf)
+	b.buf = b.buf[:0]
+	return err
+}
+
+// flushAll writes the buffered data and flushes the underlying writer if data was written since the last flush.
+func (b *batchWriter) flushAll() error {
+	if err := b.flush(); err != nil {
+		return err
+	}
+
+	if b.flusher == nil || !b.dirty {
+		return nil
+	}
+
+	b.dirty = false
+
+	if err := b.flusher(); err != nil {
+		return &WriteError{Err: err}
+	}
+
+	return nil
+}
+
+// write buffers data or writes it to the underlying writer if it does not fit into the buffer.
+func (b *batchWriter) write(data []byte) error {
+	if cap(b.buf) == 0 {
+		return b.writeDirect(data)
+	}
+
+	if len(b.buf)+len(data) > cap(b.buf) {
+		if err := b.flush(); err != nil {
+			return err
+		}
+
+		if len(data) >= cap(b.buf) {
+			return b.writeDirect(data)
+		}
+	}
+
+	b.buf = append(b.buf, data...)
+	return nil
+}
+
+func (b *batchWriter) writeDirect(data []byte) error {
+	n, err := b.w.Write(data)
 
-	if firstErr != nil {
-		return 0, firstErr
+	b.written += n
+	b.dirty = b.dirty || n > 0
+
+	if err != nil {
+		return &WriteError{Err: err}
 	}
 
-	return totalWritten, nil
+	return nil
+}
+
+// flusherFor returns a function that flushes w or nil if w can not be flushed.
+func flusherFor(w io.Writer) func() error {
+	switch f := w.(type) {
+	case interface{ FlushError() error }:
+		return f.FlushError
+	case interface{ Flush() error }:
+		return f.Flush
+	case interface{ Flush() }:
+		return func() error {
+			f.Flush()
+			return nil
+		}
+	default:
+		return nil
+	}
 }
 
 func (p *Processor) eval(ctx context.Context, choose *esi.ChooseElement, when *esi.WhenElement) (bool, error) {
@@ -294,7 +1023,7 @@ func (p *Processor) eval(ctx context.Context, choose *esi.ChooseElement, when *e
 		return false, &UnsupportedElementError{Element: choose}
 	}
 
-	result, err := p.opts.evalFunc(ctx, when.Test)
+	result, err := p.opts.evalFunc(withElement(ctx, when), when.Test)
 	if err != nil {
 		return false, err
 	}
@@ -316,11 +1045,29 @@ func (p *Processor) interpolate(ctx context.Context, s string) (string, error) {
 }
 
 func (p *Processor) processNode(ctx context.Context, resC chan<- processedNode, node esi.Node) {
-	send := func(data []byte, inc *include, err error) {
+	sendNode := func(node processedNode) {
 		select {
 		case <-ctx.Done():
-		case resC <- processedNode{inc: inc, data: data, err: err}:
+		case resC <- node:
+		}
+	}
+
+	send := func(data []byte, inc *include, err error) {
+		sendNode(processedNode{inc: inc, data: data, err: err})
+	}
+
+	if p.opts.varnish() {
+		p.processVarnishNode(ctx, resC, node, false)
+		return
+	}
+
+	if ele, ok := node.(esi.Element); ok {
+		if p.rejectInVars(ctx) {
+			send(nil, nil, &UnexpectedElementError{Element: ele})
+			return
 		}
+
+		ctx = withElement(ctx, ele)
 	}
 
 	switch v := node.(type) {
@@ -330,18 +1077,15 @@ func (p *Processor) processNode(ctx context.Context, resC chan<- processedNode,
 		p.processNodes(ctx, resC, v.Nodes)
 	case *esi.CommentElement:
 	case *esi.ChooseElement:
-		for _, w := range v.When {
-			result, err := p.eval(ctx, v, w)
-			if err != nil {
-				send(nil, nil, err)
-				return
-			}
-
-			if !result {
-				continue
-			}
+		w, err := p.choose(ctx, v)
+		if err != nil {
+			send(nil, nil, err)
+			return
+		}
 
-			p.processNodes(ctx, resC, w.Nodes)
+		if w != nil {
+			sendNode(processedNode{branch: &BranchTaken{Choose: v, Branch: w}})
+			p.processNodes(withElement(ctx, w), resC, w.Nodes)
 			return
 		}
 
@@ -349,11 +1093,15 @@ func (p *Processor) processNode(ctx context.Context, resC chan<- processedNode,
 			return
 		}
 
-		p.processNodes(ctx, resC, v.Otherwise.Nodes)
+		sendNode(processedNode{branch: &BranchTaken{Choose: v, Branch: v.Otherwise}})
+		p.processNodes(withElement(ctx, v.Otherwise), resC, v.Otherwise.Nodes)
+	case *esi.Doctype:
+		send(v.Bytes, nil, nil)
 	case *esi.ExceptElement:
 		send(nil, nil, &UnexpectedElementError{Element: v})
 	case *esi.IncludeElement:
-		if p.opts.client == nil {
+		// data: URLs are decoded without calling the client.
+		if p.opts.client == nil && !isDataURL(v.Source) {
 			send(nil, nil, &UnsupportedElementError{Element: v})
 			return
 		}
@@ -362,12 +1110,33 @@ func (p *Processor) processNode(ctx context.Context, resC chan<- processedNode,
 
 		send(nil, inc, err)
 	case *esi.InlineElement:
-		send(nil, nil, &UnsupportedElementError{Element: v})
+		if p.opts.fragmentStore == nil {
+			send(nil, nil, &UnsupportedElementError{Element: v})
+			return
+		}
+
+		p.processInline(ctx, resC, v)
 	case *esi.OtherwiseElement:
 		send(nil, nil, &UnexpectedElementError{Element: v})
 	case *esi.RemoveElement:
 	case *esi.RawData:
-		send(v.Bytes, nil, nil)
+		if v.Spill != nil {
+			processSpill(ctx, resC, v.Spill)
+			return
+		}
+
+		if !p.interpolateData(ctx) {
+			send(v.Bytes, nil, nil)
+			return
+		}
+
+		data, err := p.varsInterpolateFunc()(ctx, string(v.Bytes))
+		if err != nil {
+			send(nil, nil, err)
+			return
+		}
+
+		send([]byte(data), nil, nil)
 	case *esi.TryElement:
 		attemptCtx, cancel := context.WithCancel(ctx)
 		defer cancel()
@@ -376,43 +1145,235 @@ func (p *Processor) processNode(ctx context.Context, resC chan<- processedNode,
 
 		go func() {
 			defer close(attemptC)
-			p.processNodes(attemptCtx, attemptC, v.Attempt.Nodes)
+			defer p.recoverPanic(attemptCtx, attemptC)
+
+			p.processNodes(withElement(attemptCtx, v.Attempt), attemptC, v.Attempt.Nodes)
 		}()
 
-		var allData [][]byte
+		var attempts []processedNode
 
 		for attempt := range attemptC {
-			data, err := attempt.wait(ctx)
-			if err != nil {
-				p.processNodes(ctx, resC, v.Except.Nodes)
+			if _, err := attempt.wait(ctx); err != nil {
+				failed := &AttemptFailed{Try: v, Err: err}
+
+				if attempt.inc != nil && attempt.inc.finished() {
+					end := attempt.inc.end()
+					end.Outcome = IncludeOutcomeCaught
+					failed.Include = &end
+				}
+
+				sendNode(processedNode{attemptFailed: failed})
+
+				p.processNodes(withElement(ctx, v.Except), resC, v.Except.Nodes)
 				return
 			}
-			allData = append(allData, data)
+			attempts = append(attempts, attempt)
 		}
 
-		for _, data := range allData {
-			send(data, nil, nil)
+		// Forward the results, which are complete at this point, including information about includes and branches
+		for _, attempt := range attempts {
+			sendNode(attempt)
 		}
 	case *esi.VarsElement:
-		send(nil, nil, &UnsupportedElementError{Element: v})
+		if p.varsInterpolateFunc() == nil {
+			send(nil, nil, &UnsupportedElementError{Element: v})
+			return
+		}
+
+		p.processNodes(ctx, resC, v.Nodes)
 	case *esi.WhenElement:
 		send(nil, nil, &UnexpectedElementError{Element: v})
 	case *esi.XMLComment:
 		send([]byte("<!--"), nil, nil)
 		p.processNodes(ctx, resC, v.Nodes)
 		send([]byte("-->"), nil, nil)
+	case *esi.XMLDeclaration:
+		send(v.Bytes, nil, nil)
 	default:
 		panic("unreachable")
 	}
 }
 
+func (p *Processor) processVarnishNode(ctx context.Context, resC chan<- processedNode, node esi.Node, removed bool) {
+	send := func(data []byte, inc *include, err error) {
+		select {
+		case <-ctx.Done():
+		case resC <- processedNode{inc: inc, data: data, err: err}:
+		}
+	}
+
+	if ele, ok := node.(esi.Element); ok {
+		ctx = withElement(ctx, ele)
+	}
+
+	processNodes := func(nodes []esi.Node, removed bool) {
+		for _, node := range nodes {
+			p.processVarnishNode(ctx, resC, node, removed)
+		}
+	}
+
+	switch v := node.(type) {
+	case *esi.AttemptElement:
+		processNodes(v.Nodes, removed)
+	case *esi.Comment:
+		processNodes(v.Nodes, removed)
+	case *esi.CommentElement:
+	case *esi.ChooseElement:
+		for _, w := range v.When {
+			processNodes(w.Nodes, removed)
+		}
+
+		if v.Otherwise != nil {
+			processNodes(v.Otherwise.Nodes, removed)
+		}
+	case *esi.Doctype:
+		if !removed {
+			send(v.Bytes, nil, nil)
+		}
+	case *esi.ExceptElement:
+		processNodes(v.Nodes, removed)
+	case *esi.IncludeElement:
+		if p.opts.client == nil {
+			send(nil, nil, &UnsupportedElementError{Element: v})
+			return
+		}
+
+		inc, err := p.include(ctx, &esi.IncludeElement{
+			Position: v.Position,
+			Attr:     v.Attr,
+			OnError:  v.OnError,
+			Source:   v.Source,
+		})
+
+		send(nil, inc, err)
+	case *esi.InlineElement:
+		processNodes(v.Nodes, removed)
+	case *esi.OtherwiseElement:
+		processNodes(v.Nodes, removed)
+	case *esi.RemoveElement:
+		processNodes(v.Nodes, true)
+	case *esi.RawData:
+		switch {
+		case removed:
+		case v.Spill != nil:
+			processSpill(ctx, resC, v.Spill)
+		default:
+			send(v.Bytes, nil, nil)
+		}
+	case *esi.TryElement:
+		if v.Attempt != nil {
+			processNodes(v.Attempt.Nodes, removed)
+		}
+
+		if v.Except != nil {
+			processNodes(v.Except.Nodes, removed)
+		}
+	case *esi.VarsElement:
+		processNodes(v.Nodes, removed)
+	case *esi.WhenElement:
+		processNodes(v.Nodes, removed)
+	case *esi.XMLComment:
+		if !removed {
+			send([]byte("<!--"), nil, nil)
+		}
+
+		processNodes(v.Nodes, removed)
+
+		if !removed {
+			send([]byte("-->"), nil, nil)
+		}
+	case *esi.XMLDeclaration:
+		if !removed {
+			send(v.Bytes, nil, nil)
+		}
+	default:
+		panic("unreachable")
+	}
+}
+
+// spillChunkSize is the size of the chunks in which spilled data is read.
+const spillChunkSize = 32 * 1024
+
+// processSpill reads the spilled data in chunks and sends each chunk to resC, so that the data is never held in
+// memory at once.
+func processSpill(ctx context.Context, resC chan<- processedNode, spill *esi.Spill) {
+	send := func(node processedNode) bool {
+		select {
+		case <-ctx.Done():
+			return false
+		case resC <- node:
+			return true
+		}
+	}
+
+	r := spill.Reader()
+
+	for remaining := spill.Length; remaining > 0; {
+		// Each chunk needs a new buffer, since previous chunks may not be written yet.
+		buf := make([]byte, min(remaining, spillChunkSize))
+
+		if _, err := io.ReadFull(r, buf); err != nil {
+			send(processedNode{err: err})
+			return
+		}
+
+		remaining -= int64(len(buf))
+
+		if !send(processedNode{data: buf}) {
+			return
+		}
+	}
+}
+
+// recoverPanic recovers a panic in the calling goroutine and sends it as [*PanicError] to resC.
+//
+// It must be called directly using defer.
+func (p *Processor) recoverPanic(ctx context.Context, resC chan<- processedNode) {
+	v := recover()
+	if v == nil {
+		return
+	}
+
+	select {
+	case <-ctx.Done():
+	case resC <- processedNode{err: newPanicError(v)}:
+	}
+}
+
 func (p *Processor) processNodes(ctx context.Context, resC chan<- processedNode, nodes []esi.Node) {
 	for _, node := range nodes {
 		p.processNode(ctx, resC, node)
 	}
 }
 
-func (p *Processor) processNodesIter(ctx context.Context, resC chan<- processedNode, nodes iter.Seq2[esi.Node, error]) {
+// processNodesIter processes all nodes from the given sequence.
+//
+// If pending is not nil, a value is sent to pending before reading each node and a result with nodeDone set is sent
+// after the results for each node, so that the consumer can limit the number of pending nodes by receiving from
+// pending for each such result.
+func (p *Processor) processNodesIter(
+	ctx context.Context,
+	resC chan<- processedNode,
+	pending chan<- struct{},
+	nodes iter.Seq2[esi.Node, error],
+) {
+	acquire := func() bool {
+		if pending == nil {
+			return true
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case pending <- struct{}{}:
+			return true
+		}
+	}
+
+	if !acquire() {
+		return
+	}
+
 	for node, err := range nodes {
 		if err != nil {
 			select {
@@ -423,6 +1384,18 @@ func (p *Processor) processNodesIter(ctx context.Context, resC chan<- processedN
 		}
 
 		p.processNode(ctx, resC, node)
+
+		if pending != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case resC <- processedNode{nodeDone: true}:
+			}
+		}
+
+		if !acquire() {
+			return
+		}
 	}
 }
 
@@ -431,11 +1404,47 @@ func (p *Processor) include(ctx context.Context, ele *esi.IncludeElement) (*incl
 		return nil, err
 	}
 
-	inc := &include{done: make(chan struct{})}
+	inc := &include{ele: ele, done: make(chan struct{})}
+
+	if prev := namedInclude(ctx, ele.FragmentName); prev != nil {
+		p.life.goTracked(func() { inc.reuse(ctx, prev) })
+		return inc, nil
+	}
+
+	registerInclude(ctx, inc)
+
+	if p.opts.optionalFunc != nil {
+		inc.optional = p.opts.optionalFunc(ele)
+	}
+
+	if p.incSema != nil {
+		inc.seq = p.incSema.next()
+	}
+
+	if count, _ := ctx.Value(includeCountKey{}).(*atomic.Int64); count != nil &&
+		count.Add(1) > int64(p.opts.maxIncludes) {
+		inc.err = &TooManyIncludesError{Element: ele, Max: p.opts.maxIncludes}
+
+		if ele.OnError == esi.ErrorBehaviourContinue {
+			inc.err, inc.suppressed = nil, inc.err
+			inc.outcome = IncludeOutcomeSuppressed
+		}
+
+		close(inc.done)
+		return inc, nil
+	}
 
-	go func() {
+	p.life.goTracked(func() {
 		defer close(inc.done)
 
+		ctx := context.WithValue(ctx, includeKey{}, inc)
+
+		start := Now(ctx)
+
+		defer func() {
+			inc.duration = Now(ctx).Sub(start)
+		}()
+
 		var extra map[string]string
 
 		if len(ele.Attr) != 0 {
@@ -445,37 +1454,115 @@ func (p *Processor) include(ctx context.Context, ele *esi.IncludeElement) (*incl
 			}
 		}
 
-		inc.data, inc.err = p.doInclude(ctx, ele.Source, extra)
+		fetchCtx := ctx
+
+		if inc.optional {
+			if deadline, ok := ctx.Deadline(); ok {
+				var cancel context.CancelFunc
+				fetchCtx, cancel = context.WithDeadline(ctx, deadline.Add(-p.opts.optionalReserve))
+				defer cancel()
+			}
+		}
+
+		inc.data, inc.err = p.doIncludeRecover(fetchCtx, inc, ele.Source, extra)
+
+		if inc.err != nil && ele.Alt != "" && fetchCtx.Err() == nil {
+			inc.sourceErr = inc.err
+			inc.data, inc.err = p.doIncludeRecover(fetchCtx, inc, ele.Alt, extra)
 
-		if inc.err != nil && ele.Alt != "" {
-			inc.data, inc.err = p.doInclude(ctx, ele.Alt, extra)
+			if inc.err == nil {
+				inc.outcome = IncludeOutcomeAlt
+			}
+		}
+
+		if inc.err != nil && fetchCtx.Err() != nil && ctx.Err() == nil {
+			inc.data, inc.err, inc.suppressed = nil, nil, ErrOptionalIncludeSkipped
+			inc.outcome = IncludeOutcomeSkipped
+			return
 		}
 
 		if inc.err != nil && ele.OnError == esi.ErrorBehaviourContinue {
-			inc.err = nil
+			inc.err, inc.suppressed = nil, inc.err
+			inc.outcome = IncludeOutcomeSuppressed
 		}
-	}()
+	})
 
 	return inc, nil
 }
 
-func (p *Processor) doInclude(ctx context.Context, urlStr string, extra map[string]string) ([]byte, error) {
+// doIncludeRecover calls [Processor.doInclude] and converts panics into a [*PanicError], so that they are handled like
+// any other include error.
+func (p *Processor) doIncludeRecover(
+	ctx context.Context,
+	inc *include,
+	urlStr string,
+	extra map[string]string,
+) (data []byte, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			data, err = nil, newPanicError(v)
+		}
+	}()
+
+	return p.doInclude(ctx, inc, urlStr, extra)
+}
+
+func (p *Processor) doInclude(
+	ctx context.Context,
+	inc *include,
+	urlStr string,
+	extra map[string]string,
+) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if isDataURL(urlStr) {
+		return decodeDataURL(urlStr)
+	}
+
+	// Only possible for the alt attribute, since elements whose src requires the client are rejected earlier.
+	if p.opts.client == nil {
+		return nil, &UnsupportedElementError{Element: inc.ele}
+	}
+
 	if p.incSema != nil {
-		select {
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		case p.incSema <- struct{}{}:
+		if err := p.incSema.acquire(ctx, inc.optional, inc.seq); err != nil {
+			return nil, err
 		}
 
-		defer func() {
-			<-p.incSema
-		}()
+		defer p.incSema.release()
+	}
+
+	if p.opts.minIncludeBudget > 0 {
+		if deadline, ok := ctx.Deadline(); ok && deadline.Sub(Now(ctx)) < p.opts.minIncludeBudget {
+			return nil, ErrInsufficientBudget
+		}
 	}
 
-	interpolatedURL, err := p.interpolate(ctx, urlStr)
+	if !p.opts.varnish() {
+		interpolatedURL, err := p.interpolate(ctx, urlStr)
+		if err != nil {
+			return nil, err
+		}
+
+		if p.opts.injectionGuard {
+			if err := checkInjection(urlStr, interpolatedURL); err != nil {
+				return nil, err
+			}
+		}
+
+		urlStr = interpolatedURL
+	}
+
+	urlStr, err := p.modifyQuery(ctx, urlStr)
 	if err != nil {
 		return nil, err
 	}
 
-	return p.opts.client.Do(ctx, interpolatedURL, extra)
+	if count, _ := ctx.Value(fetchCountKey{}).(*atomic.Int64); count != nil {
+		count.Add(1)
+	}
+
+	return p.opts.client.Do(ctx, urlStr, extra)
 }
@@ -8,12 +8,19 @@ import (
 	"io"
 	"iter"
 	"net/url"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 
 	"github.com/nussjustin/esi"
+	"github.com/nussjustin/esi/esiexpr"
 	"github.com/nussjustin/esi/esiproc"
 )
 
@@ -46,14 +53,21 @@ func (t testEnv) Interpolate(_ context.Context, s string) (string, error) {
 	return s, nil
 }
 
-func nodesToSeq(nodes []esi.Node) iter.Seq2[esi.Node, error] {
-	return func(yield func(esi.Node, error) bool) {
-		for _, node := range nodes {
-			if !yield(node, nil) {
-				return
-			}
-		}
+// limitedWriter accepts up to n bytes and fails after that.
+type limitedWriter struct {
+	buf bytes.Buffer
+	n   int
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if len(p) > l.n {
+		n, _ := l.buf.Write(p[:l.n])
+		l.n = 0
+		return n, io.ErrShortWrite
 	}
+
+	l.n -= len(p)
+	return l.buf.Write(p)
 }
 
 func TestProcessor(t *testing.T) {
@@ -287,15 +301,171 @@ func TestProcessor(t *testing.T) {
 		},
 		{
 			Name: "vars",
+			Input: `
+				<esi:vars>
+					hello $(VAR1)
+				</esi:vars>
+				$(VAR2)
+			`,
+			Expected: "hello var 1\n\t\t\t\t\n\t\t\t\t$(VAR2)",
+		},
+		{
+			Name: "vars without interpolate func",
 			Input: `
 				<esi:vars>
 					hello world
 				</esi:vars>
 			`,
+			Opts: []esiproc.ProcessorOpt{esiproc.WithInterpolateFunc(nil)},
 			Error: &esiproc.UnsupportedElementError{
 				Element: &esi.VarsElement{Position: esi.Position{Start: 5, End: 48}},
 			},
 		},
+		{
+			Name:  "vars with vars interpolate func",
+			Input: `<esi:vars>hello $(VAR1)</esi:vars><esi:include src="/$(VAR2)"/>`,
+			Opts: []esiproc.ProcessorOpt{
+				esiproc.WithVarsInterpolateFunc(func(_ context.Context, s string) (string, error) {
+					return strings.ToUpper(s), nil
+				}),
+			},
+			Expected: `HELLO $(VAR1){"extra":null,"url":"/var 2"}`,
+		},
+		{
+			Name:  "vars with only vars interpolate func",
+			Input: `<esi:vars>hello</esi:vars>`,
+			Opts: []esiproc.ProcessorOpt{
+				esiproc.WithInterpolateFunc(nil),
+				esiproc.WithVarsInterpolateFunc(func(_ context.Context, s string) (string, error) {
+					return strings.ToUpper(s), nil
+				}),
+			},
+			Expected: "HELLO",
+		},
+		{
+			Name:  "vars with interpolation error",
+			Input: `<esi:vars>$(ERROR)</esi:vars>`,
+			Error: errInterpolation,
+		},
+		{
+			Name: "vars with choose",
+			Input: `<esi:vars>$(VAR1) <esi:choose>` +
+				`<esi:when test="true">$(VAR2)</esi:when>` +
+				`<esi:otherwise>otherwise</esi:otherwise>` +
+				`</esi:choose></esi:vars>`,
+			Expected: `var 1 var 2`,
+		},
+		{
+			Name: "vars with choose and literal nesting",
+			Input: `<esi:vars>$(VAR1) <esi:choose>` +
+				`<esi:when test="true">$(VAR2) <esi:vars>$(VAR2)</esi:vars></esi:when>` +
+				`</esi:choose></esi:vars>`,
+			Opts:     []esiproc.ProcessorOpt{esiproc.WithVarsNesting(esiproc.VarsNestingLiteral)},
+			Expected: `var 1 $(VAR2) var 2`,
+		},
+		{
+			Name:  "vars with choose and rejected nesting",
+			Input: `<esi:vars>$(VAR1) <esi:choose><esi:when test="true">$(VAR2)</esi:when></esi:choose></esi:vars>`,
+			Opts:  []esiproc.ProcessorOpt{esiproc.WithVarsNesting(esiproc.VarsNestingReject)},
+			Error: &esiproc.UnexpectedElementError{
+				Element: &esi.ChooseElement{Position: esi.Position{Start: 18, End: 83}},
+			},
+		},
+		{
+			Name: "vars in choose",
+			Input: `<esi:choose>` +
+				`<esi:when test="false"><esi:vars>$(VAR1)</esi:vars></esi:when>` +
+				`<esi:otherwise>$(VAR1) <esi:vars>$(VAR2)</esi:vars></esi:otherwise>` +
+				`</esi:choose>`,
+			Opts:     []esiproc.ProcessorOpt{esiproc.WithVarsNesting(esiproc.VarsNestingReject)},
+			Expected: `$(VAR1) var 2`,
+		},
+		{
+			Name:     "vars with include",
+			Input:    `<esi:vars>$(VAR1) <esi:include src="/$(VAR2)" data="$(VAR1)"/></esi:vars>`,
+			Expected: `var 1 {"extra":{"data":"$(VAR1)"},"url":"/var 2"}`,
+		},
+		{
+			Name: "varnish choose",
+			Opts: []esiproc.ProcessorOpt{
+				esiproc.WithVarnishCompatibility(),
+			},
+			Input:    `<esi:choose><esi:when test="false">one</esi:when><esi:otherwise>two</esi:otherwise></esi:choose>`,
+			Expected: `onetwo`,
+		},
+		{
+			Name: "fastly profile",
+			Opts: []esiproc.ProcessorOpt{
+				esiproc.WithCompatibilityProfile(esi.ProfileFastly),
+			},
+			Input:    `<esi:choose><esi:when test="false">one</esi:when></esi:choose>`,
+			Expected: `one`,
+		},
+		{
+			Name: "default profile after varnish",
+			Opts: []esiproc.ProcessorOpt{
+				esiproc.WithVarnishCompatibility(),
+				esiproc.WithCompatibilityProfile(esi.ProfileAkamai),
+			},
+			Input:    `<esi:choose><esi:when test="false">one</esi:when></esi:choose>`,
+			Expected: ``,
+		},
+		{
+			Name: "varnish include",
+			Opts: []esiproc.ProcessorOpt{
+				esiproc.WithVarnishCompatibility(),
+			},
+			Input:    `before <esi:include src="/$(VAR1)"/> after`,
+			Expected: `before {"extra":null,"url":"/$(VAR1)"} after`,
+		},
+		{
+			Name: "varnish include error with alt",
+			Opts: []esiproc.ProcessorOpt{
+				esiproc.WithVarnishCompatibility(),
+			},
+			Input: `before <esi:include src="/error" alt="/alt"/> after`,
+			Error: errInvalid,
+		},
+		{
+			Name: "varnish include error with onerror=continue",
+			Opts: []esiproc.ProcessorOpt{
+				esiproc.WithVarnishCompatibility(),
+			},
+			Input:    `before <esi:include src="/error" alt="/panic" onerror="continue"/> after`,
+			Expected: `before  after`,
+		},
+		{
+			Name: "varnish include inside remove",
+			Opts: []esiproc.ProcessorOpt{
+				esiproc.WithVarnishCompatibility(),
+			},
+			Input:    `before <esi:remove> inside <esi:include src="/test"/> inside </esi:remove> after`,
+			Expected: `before {"extra":null,"url":"/test"} after`,
+		},
+		{
+			Name: "varnish try",
+			Opts: []esiproc.ProcessorOpt{
+				esiproc.WithVarnishCompatibility(),
+			},
+			Input:    `<esi:try><esi:attempt>attempt</esi:attempt><esi:except>except</esi:except></esi:try>`,
+			Expected: `attemptexcept`,
+		},
+		{
+			Name: "varnish vars",
+			Opts: []esiproc.ProcessorOpt{
+				esiproc.WithVarnishCompatibility(),
+			},
+			Input:    `<esi:vars>hello $(VAR1)</esi:vars>`,
+			Expected: `hello $(VAR1)`,
+		},
+		{
+			Name: "varnish comments",
+			Opts: []esiproc.ProcessorOpt{
+				esiproc.WithVarnishCompatibility(),
+			},
+			Input:    `<!--esi <esi:comment text="some comment"/>esi--><!-- xml -->`,
+			Expected: ` esi<!-- xml -->`,
+		},
 		{
 			Name: "when outside choose",
 			InputNodes: []esi.Node{
@@ -397,7 +567,7 @@ func TestProcessor(t *testing.T) {
 			var nodes iter.Seq2[esi.Node, error]
 
 			if testCase.InputNodes != nil {
-				nodes = nodesToSeq(testCase.InputNodes)
+				nodes = esi.Seq(testCase.InputNodes...)
 			} else {
 				nodes = esi.NewParser(strings.NewReader(testCase.Input)).All
 			}
@@ -419,6 +589,960 @@ func TestProcessor(t *testing.T) {
 	}
 }
 
+func TestProcessor_WriteError(t *testing.T) {
+	client := esiproc.ClientFunc(func(context.Context, string, map[string]string) ([]byte, error) {
+		return []byte("included"), nil
+	})
+
+	p := esiproc.New(esiproc.WithClient(client))
+
+	w := &limitedWriter{n: 10}
+
+	n, err := p.Process(t.Context(), w, esi.NewParser(strings.NewReader(`before <esi:include src="/"/> after`)).All)
+
+	if want := (&esiproc.WriteError{Err: io.ErrShortWrite}); !errors.Is(err, want) {
+		t.Errorf("got error %v, want %v", err, want)
+	}
+
+	if !errors.Is(err, io.ErrShortWrite) {
+		t.Errorf("got error %v, want error wrapping %v", err, io.ErrShortWrite)
+	}
+
+	if got, want := n, 10; got != want {
+		t.Errorf("got %d bytes written, want %d", got, want)
+	}
+
+	if got, want := w.buf.String(), "before inc"; got != want {
+		t.Errorf("got output %q, want %q", got, want)
+	}
+}
+
+func TestProcessor_ProcessError(t *testing.T) {
+	p := esiproc.New()
+
+	var buf bytes.Buffer
+
+	n, err := p.Process(t.Context(), &buf, esi.NewParser(strings.NewReader(`before <esi:include src="/"/> after`)).All)
+
+	var writeErr *esiproc.WriteError
+	if errors.As(err, &writeErr) {
+		t.Errorf("got unexpected write error %v", err)
+	}
+
+	if !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("got error %v, want %v", err, errors.ErrUnsupported)
+	}
+
+	if got, want := n, len("before "); got != want {
+		t.Errorf("got %d bytes written, want %d", got, want)
+	}
+}
+
+func TestProcessor_WithMaxIncludes(t *testing.T) {
+	const input = `<esi:include src="/a" alt="/alt"/>` +
+		`<esi:include src="/b" alt="/alt" onerror="continue"/>` +
+		`<esi:try><esi:attempt><esi:include src="/c"/></esi:attempt><esi:except>except</esi:except></esi:try>`
+
+	var calls atomic.Int64
+
+	client := esiproc.ClientFunc(func(_ context.Context, urlStr string, _ map[string]string) ([]byte, error) {
+		calls.Add(1)
+		return []byte(urlStr), nil
+	})
+
+	p := esiproc.New(esiproc.WithClient(client), esiproc.WithMaxIncludes(1))
+
+	// Run twice to make sure the limit applies per document
+	for range 2 {
+		var buf bytes.Buffer
+
+		if _, err := p.Process(t.Context(), &buf, esi.NewParser(strings.NewReader(input)).All); err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		if got, want := buf.String(), "/aexcept"; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+
+	if got, want := calls.Load(), int64(2); got != want {
+		t.Errorf("got %d calls, want %d", got, want)
+	}
+
+	nodes := esi.NewParser(strings.NewReader(`<esi:include src="/a"/><esi:include src="/b"/>`)).All
+
+	want := &esiproc.TooManyIncludesError{
+		Element: &esi.IncludeElement{
+			Position: esi.Position{Start: 23, End: 46},
+			Source:   "/b",
+		},
+		Max: 1,
+	}
+
+	if _, err := p.Process(t.Context(), io.Discard, nodes); !errors.Is(err, want) {
+		t.Errorf("got error %v, want %v", err, want)
+	}
+}
+
+func TestProcessor_WithMaxPendingNodes(t *testing.T) {
+	const maxPending = 3
+
+	var pulled atomic.Int64
+
+	nodes := func(yield func(esi.Node, error) bool) {
+		for i := range 50 {
+			pulled.Add(1)
+
+			var node esi.Node = &esi.RawData{Bytes: []byte(strconv.Itoa(i))}
+			if i%2 == 1 {
+				node = &esi.IncludeElement{Source: "/" + strconv.Itoa(i)}
+			}
+
+			if !yield(node, nil) {
+				return
+			}
+		}
+	}
+
+	client := esiproc.ClientFunc(func(_ context.Context, urlStr string, _ map[string]string) ([]byte, error) {
+		return []byte(urlStr), nil
+	})
+
+	p := esiproc.New(esiproc.WithClient(client), esiproc.WithMaxPendingNodes(maxPending))
+
+	var (
+		consumed int64
+		output   strings.Builder
+	)
+
+	for event, err := range p.Events(t.Context(), nodes) {
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		var data []byte
+
+		switch event := event.(type) {
+		case esiproc.DataChunk:
+			data = event.Data
+		case esiproc.IncludeData:
+			data = event.Data
+		default:
+			continue
+		}
+
+		// Wait until the producer read ahead as far as allowed, so that reading further would be noticed below
+		for pulled.Load() < min(consumed+maxPending, 50) {
+			runtime.Gosched()
+		}
+
+		if got := pulled.Load(); got > consumed+maxPending {
+			t.Fatalf("got %d nodes read after consuming %d nodes, want at most %d", got, consumed, consumed+maxPending)
+		}
+
+		output.Write(data)
+		consumed++
+	}
+
+	var want strings.Builder
+
+	for i := range 50 {
+		if i%2 == 1 {
+			want.WriteString("/")
+		}
+
+		want.WriteString(strconv.Itoa(i))
+	}
+
+	if got := output.String(); got != want.String() {
+		t.Errorf("got %q, want %q", got, want.String())
+	}
+}
+
+func TestProcessor_WithTrimWhitespace(t *testing.T) {
+	const input = "<ul>\n" +
+		"  <esi:choose>\n" +
+		"    <esi:when test=\"false\">\n" +
+		"    <li>a</li>\n" +
+		"    </esi:when>\n" +
+		"    <esi:otherwise>\n" +
+		"    <li>b</li>\n" +
+		"    </esi:otherwise>\n" +
+		"  </esi:choose>\n" +
+		"  <esi:remove>removed</esi:remove>\n" +
+		"</ul>\n"
+
+	p := esiproc.New(esiproc.WithEvalFunc(testEnv{}.Eval), esiproc.WithTrimWhitespace())
+
+	var buf bytes.Buffer
+
+	if _, err := p.Process(t.Context(), &buf, esi.NewParser(strings.NewReader(input)).All); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	if got, want := buf.String(), "<ul>\n    <li>b</li>\n</ul>\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestProcessor_WithVarnishCompatibility(t *testing.T) {
+	const input = `<script>if (a <esi:b) {}</script>` +
+		`<esi:choose><esi:when test="false">a</esi:when><esi:otherwise>b</esi:otherwise></esi:choose>` +
+		`<esi:remove>removed <esi:include src="/c"/></esi:remove>` +
+		`<!--esi <esi:include src="/$(VAR)"/>-->`
+
+	client := esiproc.ClientFunc(func(_ context.Context, urlStr string, _ map[string]string) ([]byte, error) {
+		return []byte(urlStr), nil
+	})
+
+	p := esiproc.New(esiproc.WithClient(client), esiproc.WithVarnishCompatibility())
+
+	var buf bytes.Buffer
+
+	if _, err := p.ProcessReader(t.Context(), &buf, strings.NewReader(input), esi.WithVarnishCompatibility()); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	if got, want := buf.String(), `<script>if (a <esi:b) {}</script>ab/c /$(VAR)`; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestProcessor_WithMinIncludeBudget(t *testing.T) {
+	const input = `<esi:include src="/a" onerror="continue"/>` +
+		`<esi:try><esi:attempt><esi:include src="/b"/></esi:attempt><esi:except>except</esi:except></esi:try>`
+
+	client := esiproc.ClientFunc(func(_ context.Context, urlStr string, _ map[string]string) ([]byte, error) {
+		return []byte(urlStr), nil
+	})
+
+	testCases := []struct {
+		Name     string
+		Budget   time.Duration
+		Timeout  time.Duration
+		Expected string
+	}{
+		{
+			Name:     "no deadline",
+			Budget:   time.Hour,
+			Expected: "/a/b",
+		},
+		{
+			Name:     "enough time",
+			Budget:   time.Minute,
+			Timeout:  time.Hour,
+			Expected: "/a/b",
+		},
+		{
+			Name:     "not enough time",
+			Budget:   time.Hour,
+			Timeout:  time.Minute,
+			Expected: "except",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			ctx := t.Context()
+
+			if testCase.Timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, testCase.Timeout)
+				defer cancel()
+			}
+
+			p := esiproc.New(esiproc.WithClient(client), esiproc.WithMinIncludeBudget(testCase.Budget))
+
+			var buf bytes.Buffer
+
+			if _, err := p.Process(ctx, &buf, esi.NewParser(strings.NewReader(input)).All); err != nil {
+				t.Fatalf("got error %v", err)
+			}
+
+			if got := buf.String(); got != testCase.Expected {
+				t.Errorf("got %q, want %q", got, testCase.Expected)
+			}
+		})
+	}
+
+	t.Run("error", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(t.Context(), time.Minute)
+		defer cancel()
+
+		p := esiproc.New(esiproc.WithClient(client), esiproc.WithMinIncludeBudget(time.Hour))
+
+		nodes := esi.NewParser(strings.NewReader(`<esi:include src="/a"/>`)).All
+
+		if _, err := p.Process(ctx, io.Discard, nodes); !errors.Is(err, esiproc.ErrInsufficientBudget) {
+			t.Errorf("got error %v, want %v", err, esiproc.ErrInsufficientBudget)
+		}
+	})
+}
+
+type unknownNode struct {
+	esi.Node
+}
+
+func TestProcessor_WithOptionalIncludes(t *testing.T) {
+	optional := func(ele *esi.IncludeElement) bool {
+		return strings.HasPrefix(ele.Source, "/optional")
+	}
+
+	t.Run("priority", func(t *testing.T) {
+		var (
+			mu      sync.Mutex
+			fetched []string
+		)
+
+		blocking, unblock := make(chan struct{}), make(chan struct{})
+
+		client := esiproc.ClientFunc(func(_ context.Context, urlStr string, _ map[string]string) ([]byte, error) {
+			if urlStr == "/block" {
+				close(blocking)
+				<-unblock
+				return nil, nil
+			}
+
+			mu.Lock()
+			fetched = append(fetched, urlStr)
+			mu.Unlock()
+
+			return []byte(urlStr), nil
+		})
+
+		p := esiproc.New(esiproc.WithClient(client))
+
+		// Use the shared concurrency limit, so that all includes have to wait until /block is finished
+		go func() {
+			_, _ = p.Process(t.Context(), io.Discard, esi.Seq(&esi.IncludeElement{Source: "/block"}))
+		}()
+
+		<-blocking
+
+		go func() {
+			// Wait until all includes wait for the concurrency limit
+			for esiproc.WaitingIncludes(p) < 5 {
+				runtime.Gosched()
+			}
+
+			close(unblock)
+		}()
+
+		const input = `<esi:include src="/optional1"/><esi:include src="/first"/><esi:include src="/optional2"/>` +
+			`<esi:include src="/second"/><esi:include src="/third"/>`
+
+		var buf bytes.Buffer
+
+		_, err := p.With(esiproc.WithOptionalIncludes(optional, 0)).
+			Process(t.Context(), &buf, esi.NewParser(strings.NewReader(input)).All)
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		if got, want := buf.String(), "/optional1/first/optional2/second/third"; got != want {
+			t.Errorf("got output %q, want %q", got, want)
+		}
+
+		want := []string{"/first", "/second", "/third", "/optional1", "/optional2"}
+
+		if diff := cmp.Diff(want, fetched); diff != "" {
+			t.Errorf("fetch order mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		client := esiproc.ClientFunc(func(ctx context.Context, urlStr string, _ map[string]string) ([]byte, error) {
+			if urlStr == "/optional/slow" {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}
+
+			return []byte(urlStr), nil
+		})
+
+		p := esiproc.New(
+			esiproc.WithClient(client),
+			esiproc.WithClientConcurrency(0),
+			esiproc.WithOptionalIncludes(optional, time.Hour))
+
+		const input = `[<esi:include src="/required"/>]` +
+			`[<esi:include src="/optional/slow" alt="/optional/alt"/>]` +
+			`[<esi:try><esi:attempt><esi:include src="/optional/slow"/></esi:attempt>` +
+			`<esi:except>except</esi:except></esi:try>]`
+
+		testCases := []struct {
+			Name     string
+			Deadline time.Duration
+		}{
+			{Name: "skipped", Deadline: 30 * time.Minute},
+			{Name: "cancelled", Deadline: time.Hour + 50*time.Millisecond},
+		}
+
+		for _, testCase := range testCases {
+			t.Run(testCase.Name, func(t *testing.T) {
+				ctx, cancel := context.WithTimeout(t.Context(), testCase.Deadline)
+				defer cancel()
+
+				var buf bytes.Buffer
+
+				res, err := p.ProcessResult(ctx, &buf, esi.NewParser(strings.NewReader(input)).All)
+				if err != nil {
+					t.Fatalf("got error %v", err)
+				}
+
+				if got, want := buf.String(), "[/required][][]"; got != want {
+					t.Errorf("got output %q, want %q", got, want)
+				}
+
+				var outcomes []esiproc.IncludeOutcome
+
+				for _, inc := range res.Includes {
+					outcomes = append(outcomes, inc.Outcome)
+
+					if inc.Outcome == esiproc.IncludeOutcomeSkipped && !errors.Is(inc.Suppressed, esiproc.ErrOptionalIncludeSkipped) {
+						t.Errorf("got suppressed error %v, want %v", inc.Suppressed, esiproc.ErrOptionalIncludeSkipped)
+					}
+				}
+
+				want := []esiproc.IncludeOutcome{
+					esiproc.IncludeOutcomeSuccess,
+					esiproc.IncludeOutcomeSkipped,
+					esiproc.IncludeOutcomeSkipped,
+				}
+
+				if diff := cmp.Diff(want, outcomes); diff != "" {
+					t.Errorf("outcome mismatch (-want +got):\n%s", diff)
+				}
+			})
+		}
+	})
+}
+
+func TestProcessor_Panic(t *testing.T) {
+	panicClient := esiproc.ClientFunc(func(context.Context, string, map[string]string) ([]byte, error) {
+		panic("client panic")
+	})
+
+	panicEval := func(context.Context, string) (any, error) {
+		panic("eval panic")
+	}
+
+	parse := func(input string) iter.Seq2[esi.Node, error] {
+		return esi.NewParser(strings.NewReader(input)).All
+	}
+
+	testCases := []struct {
+		Name     string
+		Opts     []esiproc.ProcessorOpt
+		Nodes    iter.Seq2[esi.Node, error]
+		Expected string
+		Panic    any
+	}{
+		{
+			Name:  "include",
+			Opts:  []esiproc.ProcessorOpt{esiproc.WithClient(panicClient)},
+			Nodes: parse(`<esi:include src="/"/>`),
+			Panic: "client panic",
+		},
+		{
+			Name:     "include in try",
+			Opts:     []esiproc.ProcessorOpt{esiproc.WithClient(panicClient)},
+			Nodes:    parse(`<esi:try><esi:attempt><esi:include src="/"/></esi:attempt><esi:except>e</esi:except></esi:try>`),
+			Expected: "e",
+		},
+		{
+			Name:     "include with alt",
+			Opts:     []esiproc.ProcessorOpt{esiproc.WithClient(panicClient)},
+			Nodes:    parse(`<esi:include src="/" alt="data:,alt"/>`),
+			Expected: "alt",
+		},
+		{
+			Name:  "include with onerror",
+			Opts:  []esiproc.ProcessorOpt{esiproc.WithClient(panicClient)},
+			Nodes: parse(`<esi:include src="/" onerror="continue"/>`),
+		},
+		{
+			Name:  "eval",
+			Opts:  []esiproc.ProcessorOpt{esiproc.WithEvalFunc(panicEval)},
+			Nodes: parse(`<esi:choose><esi:when test="a">a</esi:when></esi:choose>`),
+			Panic: "eval panic",
+		},
+		{
+			Name:  "parallel eval",
+			Opts:  []esiproc.ProcessorOpt{esiproc.WithEvalFunc(panicEval), esiproc.WithParallelEval(2)},
+			Nodes: parse(`<esi:choose><esi:when test="a">a</esi:when><esi:when test="b">b</esi:when></esi:choose>`),
+			Panic: "eval panic",
+		},
+		{
+			Name: "unknown node",
+			Nodes: func(yield func(esi.Node, error) bool) {
+				yield(unknownNode{}, nil)
+			},
+			Panic: "unreachable",
+		},
+		{
+			Name: "nodes",
+			Nodes: func(func(esi.Node, error) bool) {
+				panic("nodes panic")
+			},
+			Panic: "nodes panic",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			p := esiproc.New(testCase.Opts...)
+
+			var buf bytes.Buffer
+
+			_, err := p.Process(t.Context(), &buf, testCase.Nodes)
+
+			var panicErr *esiproc.PanicError
+
+			switch {
+			case testCase.Panic == nil && err != nil:
+				t.Errorf("got error %v", err)
+			case testCase.Panic != nil && !errors.As(err, &panicErr):
+				t.Errorf("got error %v, want %T", err, panicErr)
+			case testCase.Panic != nil && panicErr.Value != testCase.Panic:
+				t.Errorf("got panic value %v, want %v", panicErr.Value, testCase.Panic)
+			case testCase.Panic != nil && len(panicErr.Stack) == 0:
+				t.Error("got empty stack")
+			}
+
+			if got := buf.String(); got != testCase.Expected {
+				t.Errorf("got %q, want %q", got, testCase.Expected)
+			}
+		})
+	}
+}
+
+type contextKey string
+
+func TestProcessor_Context(t *testing.T) {
+	const input = `<esi:include src="/$(VAR1)"/>` +
+		`<esi:choose><esi:when test="true"><esi:vars>$(VAR2)</esi:vars></esi:when></esi:choose>`
+
+	var (
+		mu    sync.Mutex
+		calls []string
+	)
+
+	check := func(ctx context.Context, name string) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		calls = append(calls, name)
+
+		for _, key := range []contextKey{"process", "first", "second"} {
+			if ctx.Value(key) == nil {
+				t.Errorf("%s: missing context value %q", name, key)
+			}
+		}
+	}
+
+	decorate := func(key contextKey) func(context.Context) (context.Context, func()) {
+		return func(ctx context.Context) (context.Context, func()) {
+			mu.Lock()
+			calls = append(calls, "start "+string(key))
+			mu.Unlock()
+
+			return context.WithValue(ctx, key, true), func() {
+				mu.Lock()
+				calls = append(calls, "done "+string(key))
+				mu.Unlock()
+			}
+		}
+	}
+
+	p := esiproc.New(
+		esiproc.WithClient(esiproc.ClientFunc(func(ctx context.Context, urlStr string, _ map[string]string) ([]byte, error) {
+			check(ctx, "client")
+			return []byte(urlStr), nil
+		})),
+		esiproc.WithContextFunc(decorate("first")),
+		esiproc.WithContextFunc(decorate("second")),
+		esiproc.WithEvalFunc(func(ctx context.Context, expr string) (any, error) {
+			check(ctx, "eval")
+			return testEnv{}.Eval(ctx, expr)
+		}),
+		esiproc.WithInterpolateFunc(func(ctx context.Context, s string) (string, error) {
+			check(ctx, "interpolate")
+			return testEnv{}.Interpolate(ctx, s)
+		}),
+		esiproc.WithSetQuery(func(ctx context.Context, _ string) (url.Values, error) {
+			check(ctx, "query")
+			return nil, nil
+		}))
+
+	ctx := context.WithValue(t.Context(), contextKey("process"), true)
+
+	var buf bytes.Buffer
+
+	if _, err := p.Process(ctx, &buf, esi.NewParser(strings.NewReader(input)).All); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	if got, want := buf.String(), "/var 1var 2"; got != want {
+		t.Errorf("got output %q, want %q", got, want)
+	}
+
+	if got, want := calls[:2], []string{"start first", "start second"}; !cmp.Equal(got, want) {
+		t.Errorf("got first calls %q, want %q", got, want)
+	}
+
+	if got, want := calls[len(calls)-2:], []string{"done second", "done first"}; !cmp.Equal(got, want) {
+		t.Errorf("got last calls %q, want %q", got, want)
+	}
+
+	for _, name := range []string{"client", "eval", "interpolate", "query"} {
+		if !slices.Contains(calls, name) {
+			t.Errorf("%s was not called", name)
+		}
+	}
+}
+
+func TestProcessor_WithClock(t *testing.T) {
+	const input = `<esi:try><esi:attempt><esi:include src="/$(DATE_GMT{unix})"/></esi:attempt>` +
+		`<esi:except>except</esi:except></esi:try>`
+
+	deadline := time.Now().Add(time.Hour)
+
+	ctx, cancel := context.WithDeadline(t.Context(), deadline)
+	defer cancel()
+
+	client := esiproc.ClientFunc(func(_ context.Context, urlStr string, _ map[string]string) ([]byte, error) {
+		return []byte(urlStr), nil
+	})
+
+	env := &esiexpr.Env{LookupVar: esiexpr.TimeVars(esiproc.Now, nil)}
+
+	testCases := []struct {
+		Name     string
+		Now      time.Time
+		Expected string
+	}{
+		{
+			Name:     "enough time",
+			Now:      time.Unix(0, 0),
+			Expected: "/0",
+		},
+		{
+			Name:     "not enough time",
+			Now:      deadline.Add(-time.Minute),
+			Expected: "except",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			p := esiproc.New(
+				esiproc.WithClient(client),
+				esiproc.WithClock(func() time.Time { return testCase.Now }),
+				esiproc.WithInterpolateFunc(env.Interpolate),
+				esiproc.WithMinIncludeBudget(10*time.Minute))
+
+			var buf bytes.Buffer
+
+			if _, err := p.Process(ctx, &buf, esi.NewParser(strings.NewReader(input)).All); err != nil {
+				t.Fatalf("got error %v", err)
+			}
+
+			if got := buf.String(); got != testCase.Expected {
+				t.Errorf("got %q, want %q", got, testCase.Expected)
+			}
+		})
+	}
+}
+
+func TestProcessor_With(t *testing.T) {
+	const input = `<esi:include src="/a"/><esi:choose><esi:when test="true">true</esi:when>` +
+		`<esi:otherwise>otherwise</esi:otherwise></esi:choose>`
+
+	client := esiproc.ClientFunc(func(_ context.Context, urlStr string, _ map[string]string) ([]byte, error) {
+		return []byte(urlStr), nil
+	})
+
+	base := esiproc.New(
+		esiproc.WithClient(client),
+		esiproc.WithEvalFunc(testEnv{}.Eval),
+		esiproc.WithSetQuery(esiproc.StaticQuery(url.Values{"a": {"1"}})))
+
+	if got := base.With(); got != base {
+		t.Errorf("got new processor without options")
+	}
+
+	derived := base.With(
+		esiproc.WithClientConcurrency(2),
+		esiproc.WithEvalFunc(func(context.Context, string) (any, error) { return false, nil }),
+		esiproc.WithSetQuery(esiproc.StaticQuery(url.Values{"b": {"2"}})))
+
+	// Derive another processor from the same base to check that the query modifiers are not shared
+	_ = base.With(esiproc.WithSetQuery(esiproc.StaticQuery(url.Values{"c": {"3"}})))
+
+	testCases := []struct {
+		Name      string
+		Processor *esiproc.Processor
+		Expected  string
+	}{
+		{
+			Name:      "base",
+			Processor: base,
+			Expected:  "/a?a=1true",
+		},
+		{
+			Name:      "derived",
+			Processor: derived,
+			Expected:  "/a?a=1&b=2otherwise",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			var buf bytes.Buffer
+
+			if _, err := testCase.Processor.Process(t.Context(), &buf, esi.NewParser(strings.NewReader(input)).All); err != nil {
+				t.Fatalf("got error %v", err)
+			}
+
+			if got := buf.String(); got != testCase.Expected {
+				t.Errorf("got %q, want %q", got, testCase.Expected)
+			}
+		})
+	}
+}
+
+// recordingWriter records all writes.
+type recordingWriter struct {
+	writes  []string
+	written chan struct{}
+}
+
+func (r *recordingWriter) Write(p []byte) (int, error) {
+	r.writes = append(r.writes, string(p))
+
+	if r.written != nil {
+		close(r.written)
+		r.written = nil
+	}
+
+	return len(p), nil
+}
+
+func TestProcessor_WithWriteBuffer(t *testing.T) {
+	t.Run("batching", func(t *testing.T) {
+		p := esiproc.New(esiproc.WithWriteBuffer(16))
+
+		nodes := []esi.Node{
+			&esi.RawData{Bytes: []byte("aaaa")},
+			&esi.RawData{Bytes: []byte("bbbb")},
+			&esi.RawData{Bytes: []byte("cccc")},
+			&esi.RawData{Bytes: []byte("dddd")},
+			&esi.RawData{Bytes: []byte("eeee")},
+			&esi.RawData{Bytes: []byte("larger than the buffer")},
+			&esi.RawData{Bytes: []byte("ffff")},
+		}
+
+		w := &recordingWriter{}
+
+		n, err := p.Process(t.Context(), w, esi.Seq(nodes...))
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		want := "aaaabbbbccccddddeeeelarger than the bufferffff"
+
+		if got := strings.Join(w.writes, ""); got != want {
+			t.Errorf("got output %q, want %q", got, want)
+		}
+
+		if n != len(want) {
+			t.Errorf("got %d bytes written, want %d", n, len(want))
+		}
+
+		// Depending on timing, data may be written before the buffer is full, but never more than fits.
+		for _, write := range w.writes {
+			if len(write) > 16 && write != "larger than the buffer" {
+				t.Errorf("got write of %d bytes exceeding the buffer: %q", len(write), write)
+			}
+		}
+	})
+
+	t.Run("flush before include", func(t *testing.T) {
+		written := make(chan struct{})
+
+		client := esiproc.ClientFunc(func(ctx context.Context, _ string, _ map[string]string) ([]byte, error) {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-written:
+				return []byte("included"), nil
+			case <-time.After(5 * time.Second):
+				return nil, errors.New("buffered data was not written before waiting for include")
+			}
+		})
+
+		p := esiproc.New(esiproc.WithClient(client), esiproc.WithWriteBuffer(1024))
+
+		w := &recordingWriter{written: written}
+
+		input := `before <esi:include src="/"/> after`
+
+		if _, err := p.Process(t.Context(), w, esi.NewParser(strings.NewReader(input)).All); err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		if got, want := strings.Join(w.writes, ""), "before included after"; got != want {
+			t.Errorf("got output %q, want %q", got, want)
+		}
+
+		if got, want := w.writes[0], "before "; got != want {
+			t.Errorf("got first write %q, want %q", got, want)
+		}
+	})
+
+	t.Run("write error", func(t *testing.T) {
+		client := esiproc.ClientFunc(func(context.Context, string, map[string]string) ([]byte, error) {
+			return []byte("included"), nil
+		})
+
+		p := esiproc.New(esiproc.WithClient(client), esiproc.WithWriteBuffer(1024))
+
+		w := &limitedWriter{n: 10}
+
+		input := `before <esi:include src="/"/> after`
+
+		n, err := p.Process(t.Context(), w, esi.NewParser(strings.NewReader(input)).All)
+
+		if want := (&esiproc.WriteError{Err: io.ErrShortWrite}); !errors.Is(err, want) {
+			t.Errorf("got error %v, want %v", err, want)
+		}
+
+		if got, want := n, 10; got != want {
+			t.Errorf("got %d bytes written, want %d", got, want)
+		}
+	})
+
+	t.Run("process error", func(t *testing.T) {
+		p := esiproc.New(esiproc.WithWriteBuffer(1024))
+
+		var buf bytes.Buffer
+
+		input := `before <esi:include src="/"/> after`
+
+		n, err := p.Process(t.Context(), &buf, esi.NewParser(strings.NewReader(input)).All)
+		if !errors.Is(err, errors.ErrUnsupported) {
+			t.Errorf("got error %v, want %v", err, errors.ErrUnsupported)
+		}
+
+		if got, want := buf.String(), "before "; got != want || n != len(want) {
+			t.Errorf("got output %q (%d bytes), want %q", got, n, want)
+		}
+	})
+}
+
+// flushingWriter records all writes and flushes.
+type flushingWriter struct {
+	recordingWriter
+
+	flushErr error
+}
+
+func (f *flushingWriter) Flush() error {
+	f.writes = append(f.writes, "<flush>")
+	return f.flushErr
+}
+
+// plainFlushingWriter closes flushed on the first flush, like a [net/http.Flusher].
+type plainFlushingWriter struct {
+	buf     bytes.Buffer
+	flushed chan struct{}
+}
+
+func (p *plainFlushingWriter) Write(b []byte) (int, error) {
+	return p.buf.Write(b)
+}
+
+func (p *plainFlushingWriter) Flush() {
+	if p.flushed != nil {
+		close(p.flushed)
+		p.flushed = nil
+	}
+}
+
+func TestProcessor_WithFlush(t *testing.T) {
+	newClient := func(written chan struct{}) esiproc.Client {
+		return esiproc.ClientFunc(func(ctx context.Context, _ string, _ map[string]string) ([]byte, error) {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-written:
+				return []byte("included"), nil
+			case <-time.After(5 * time.Second):
+				return nil, errors.New("data was not flushed before waiting for include")
+			}
+		})
+	}
+
+	const input = `before <esi:include src="/"/> after`
+
+	t.Run("flush before include", func(t *testing.T) {
+		written := make(chan struct{})
+
+		p := esiproc.New(esiproc.WithClient(newClient(written)), esiproc.WithFlush(), esiproc.WithWriteBuffer(1024))
+
+		w := &flushingWriter{recordingWriter: recordingWriter{written: written}}
+
+		if _, err := p.Process(t.Context(), w, esi.NewParser(strings.NewReader(input)).All); err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		if got, want := w.writes[:2], []string{"before ", "<flush>"}; !slices.Equal(got, want) {
+			t.Errorf("got writes %q, want %q", got, want)
+		}
+
+		if got, want := strings.ReplaceAll(strings.Join(w.writes, ""), "<flush>", ""), "before included after"; got != want {
+			t.Errorf("got output %q, want %q", got, want)
+		}
+	})
+
+	t.Run("flush without error", func(t *testing.T) {
+		flushed := make(chan struct{})
+
+		p := esiproc.New(esiproc.WithClient(newClient(flushed)), esiproc.WithFlush())
+
+		w := &plainFlushingWriter{flushed: flushed}
+
+		if _, err := p.Process(t.Context(), w, esi.NewParser(strings.NewReader(input)).All); err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		if got, want := w.buf.String(), "before included after"; got != want {
+			t.Errorf("got output %q, want %q", got, want)
+		}
+	})
+
+	t.Run("flush error", func(t *testing.T) {
+		p := esiproc.New(esiproc.WithClient(newClient(nil)), esiproc.WithFlush())
+
+		w := &flushingWriter{flushErr: io.ErrClosedPipe}
+
+		_, err := p.Process(t.Context(), w, esi.NewParser(strings.NewReader(input)).All)
+
+		if want := (&esiproc.WriteError{Err: io.ErrClosedPipe}); !errors.Is(err, want) {
+			t.Errorf("got error %v, want %v", err, want)
+		}
+	})
+}
+
+func TestNow(t *testing.T) {
+	before := time.Now()
+
+	if got := esiproc.Now(t.Context()); got.Before(before) || got.After(time.Now()) {
+		t.Errorf("got %v, want current time", got)
+	}
+}
+
 func BenchmarkProcessor(b *testing.B) {
 	b.Run("Multiple includes", func(b *testing.B) {
 		const input = `
@@ -458,7 +1582,7 @@ func BenchmarkProcessor(b *testing.B) {
 		b.ResetTimer()
 
 		for b.Loop() {
-			if _, err := p.Process(b.Context(), io.Discard, nodesToSeq(nodes)); err != nil {
+			if _, err := p.Process(b.Context(), io.Discard, esi.Seq(nodes...)); err != nil {
 				b.Fatal(err)
 			}
 		}
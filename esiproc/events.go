@@ -0,0 +1,341 @@
+package esiproc
+
+import (
+	"context"
+	"iter"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nussjustin/esi"
+)
+
+// Event is the interface implemented by all events produced by [Processor.Events].
+//
+// The following types implement Event:
+//
+//   - [AttemptFailed]
+//   - [BranchTaken]
+//   - [DataChunk]
+//   - [IncludeData]
+//   - [IncludeEnd]
+//   - [IncludeStart]
+type Event interface {
+	event()
+}
+
+// AttemptFailed is produced when the content of an esi:attempt element failed and the content of the esi:except
+// element is used instead.
+//
+// The events for the content of the esi:except element follow the AttemptFailed event. No events are produced for the
+// content of the esi:attempt element.
+type AttemptFailed struct {
+	// Try is the esi:try element.
+	Try *esi.TryElement
+
+	// Err is the error that caused the failure.
+	Err error
+
+	// Include contains information about the failed include, with Outcome set to [IncludeOutcomeCaught].
+	//
+	// Include is nil if the failure was not caused by an esi:include element.
+	Include *IncludeEnd
+}
+
+func (AttemptFailed) event() {}
+
+// BranchTaken is produced when an esi:when or esi:otherwise element of an esi:choose element was selected.
+//
+// The events for the content of the branch follow the BranchTaken event.
+type BranchTaken struct {
+	// Choose is the esi:choose element.
+	Choose *esi.ChooseElement
+
+	// Branch is the selected branch. Either a [*esi.WhenElement] or an [*esi.OtherwiseElement].
+	Branch esi.Element
+}
+
+func (BranchTaken) event() {}
+
+// DataChunk contains data that is part of the output, other than the data of includes.
+type DataChunk struct {
+	// Data is the data.
+	Data []byte
+}
+
+func (DataChunk) event() {}
+
+// IncludeData contains the result of an esi:include element.
+//
+// IncludeData is always preceded by [IncludeStart] and followed by [IncludeEnd] for the same element.
+type IncludeData struct {
+	// Element is the esi:include element.
+	Element *esi.IncludeElement
+
+	// Data is the included data. It is empty if the include failed and onerror="continue" was used.
+	Data []byte
+}
+
+func (IncludeData) event() {}
+
+// IncludeEnd is produced after the data of an esi:include element.
+type IncludeEnd struct {
+	// Element is the esi:include element.
+	Element *esi.IncludeElement
+
+	// Duration is the time it took to fetch the include, including waiting for the concurrency limit (see
+	// [WithClientConcurrency]) and fetching the alt URL, if needed.
+	Duration time.Duration
+
+	// CacheHit is true if the [Client] reported that the data was served from a cache using [ReportCacheHit].
+	CacheHit bool
+
+	// Status is the status code reported by the [Client] using [ReportStatus] or 0 if no status code was reported.
+	Status int
+
+	// Reused is true if the result was not fetched, but taken from an earlier include with the same name.
+	//
+	// See [Processor] for details on named includes.
+	Reused bool
+
+	// Outcome describes how the include was resolved.
+	Outcome IncludeOutcome
+
+	// SourceError contains the error for the src URL if the alt URL was used instead.
+	SourceError error
+
+	// Suppressed contains the error that was ignored because the element used onerror="continue" or, for skipped
+	// optional includes, [ErrOptionalIncludeSkipped].
+	Suppressed error
+}
+
+func (IncludeEnd) event() {}
+
+// IncludeOutcome describes how an esi:include element was resolved.
+type IncludeOutcome uint8
+
+const (
+	// IncludeOutcomeSuccess means that the src URL was fetched successfully.
+	IncludeOutcomeSuccess IncludeOutcome = iota
+
+	// IncludeOutcomeAlt means that fetching the src URL failed, but the alt URL was fetched successfully.
+	//
+	// The error for the src URL is available via [IncludeEnd.SourceError].
+	IncludeOutcomeAlt
+
+	// IncludeOutcomeSuppressed means that the include failed, but the error was ignored because the element used
+	// onerror="continue".
+	//
+	// The error is available via [IncludeEnd.Suppressed].
+	IncludeOutcomeSuppressed
+
+	// IncludeOutcomeCaught means that the include failed inside an esi:attempt element and the content of the
+	// esi:except element was used instead.
+	//
+	// This outcome is only reported via [AttemptFailed].
+	IncludeOutcomeCaught
+
+	// IncludeOutcomeSkipped means that the include was optional and was skipped or cancelled, because the time
+	// remaining until the deadline was not enough. See [WithOptionalIncludes].
+	//
+	// The include produces no output and [IncludeEnd.Suppressed] is set to [ErrOptionalIncludeSkipped].
+	IncludeOutcomeSkipped
+)
+
+// String returns the name of the outcome.
+func (o IncludeOutcome) String() string {
+	switch o {
+	case IncludeOutcomeSuccess:
+		return "IncludeOutcomeSuccess"
+	case IncludeOutcomeAlt:
+		return "IncludeOutcomeAlt"
+	case IncludeOutcomeSuppressed:
+		return "IncludeOutcomeSuppressed"
+	case IncludeOutcomeCaught:
+		return "IncludeOutcomeCaught"
+	case IncludeOutcomeSkipped:
+		return "IncludeOutcomeSkipped"
+	default:
+		panic("unknown include outcome")
+	}
+}
+
+// IncludeStart is produced when the position of an esi:include element in the output is reached.
+//
+// Since includes are fetched concurrently, the request for the include may already have been started or even
+// finished before.
+type IncludeStart struct {
+	// Element is the esi:include element.
+	Element *esi.IncludeElement
+}
+
+func (IncludeStart) event() {}
+
+// Events processes the given nodes and returns an iterator over the resulting events, in output order.
+//
+// This can be used instead of [Processor.Process] by consumers that need to know which parts of the output were
+// produced by which elements, for example to post-process or route the output of includes differently.
+//
+// If an error occurs, it is yielded once and the iteration stops. Errors are the same as returned by
+// [Processor.Process], except for write errors.
+//
+// Processing is started when iterating over the returned sequence and stopped once the iteration stops.
+func (p *Processor) Events(ctx context.Context, nodes iter.Seq2[esi.Node, error]) iter.Seq2[Event, error] {
+	return p.events(ctx, nodes, nil)
+}
+
+// events implements [Processor.Events].
+//
+// If beforeWait is not nil, it is called each time before blocking to wait for the next result. If it returns an
+// error, the error is yielded and the iteration stops.
+func (p *Processor) events(
+	ctx context.Context,
+	nodes iter.Seq2[esi.Node, error],
+	beforeWait func() error,
+) iter.Seq2[Event, error] {
+	return func(yield func(Event, error) bool) {
+		// Calls via [Processor.ProcessReader] already hold a reference.
+		if ctx.Value(lifecycleKey{}) != p.life {
+			if !p.life.acquire() {
+				yield(nil, &ClosedError{})
+				return
+			}
+
+			defer p.life.release()
+		}
+
+		// Do not modify the captured context and nodes, so that the sequence can be iterated more than once
+		ctx, nodes := ctx, nodes
+
+		for _, f := range p.opts.contextFuncs {
+			var done func()
+
+			if ctx, done = f(ctx); done != nil {
+				defer done()
+			}
+		}
+
+		ctx, cancel := context.WithCancel(ctx)
+
+		if p.opts.trimWhitespace {
+			nodes = esi.TrimWhitespace(nodes)
+		}
+
+		if p.opts.maxIncludes > 0 {
+			ctx = context.WithValue(ctx, includeCountKey{}, new(atomic.Int64))
+		}
+
+		if p.opts.now != nil {
+			ctx = context.WithValue(ctx, clockKey{}, p.opts.now)
+		}
+
+		ctx = context.WithValue(ctx, includeRegistryKey{}, &includeRegistry{})
+
+		resC := make(chan processedNode, 32)
+
+		var pending chan struct{}
+
+		if p.opts.maxPendingNodes > 0 {
+			pending = make(chan struct{}, p.opts.maxPendingNodes)
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			defer close(resC)
+			defer p.recoverPanic(ctx, resC)
+
+			p.processNodesIter(ctx, resC, pending, nodes)
+		}()
+
+		// Ensure we are completely finished with reading from nodes to avoid data races when re-using parsers.
+		defer func() {
+			cancel()
+			wg.Wait()
+		}()
+
+		for {
+			res, ok, err := receive(ctx, resC, beforeWait)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+
+			if !ok {
+				return
+			}
+
+			if res.nodeDone {
+				<-pending
+				continue
+			}
+
+			if !yieldEvents(ctx, res, beforeWait, yield) {
+				return
+			}
+		}
+	}
+}
+
+// receive returns the next result from resC. If beforeWait is not nil and no result is available yet, beforeWait is
+// called before blocking.
+func receive(ctx context.Context, resC <-chan processedNode, beforeWait func() error) (processedNode, bool, error) {
+	if beforeWait != nil {
+		select {
+		case res, ok := <-resC:
+			return res, ok, nil
+		default:
+		}
+
+		if err := beforeWait(); err != nil {
+			return processedNode{}, false, err
+		}
+	}
+
+	select {
+	case <-ctx.Done():
+		return processedNode{}, false, ctx.Err()
+	case res, ok := <-resC:
+		return res, ok, nil
+	}
+}
+
+func yieldEvents(
+	ctx context.Context,
+	res processedNode,
+	beforeWait func() error,
+	yield func(Event, error) bool,
+) bool {
+	switch {
+	case res.err != nil:
+		yield(nil, res.err)
+		return false
+	case res.attemptFailed != nil:
+		return yield(*res.attemptFailed, nil)
+	case res.branch != nil:
+		return yield(*res.branch, nil)
+	case res.inc == nil:
+		return yield(DataChunk{Data: res.data}, nil)
+	}
+
+	if !yield(IncludeStart{Element: res.inc.ele}, nil) {
+		return false
+	}
+
+	if beforeWait != nil && !res.inc.finished() {
+		if err := beforeWait(); err != nil {
+			yield(nil, err)
+			return false
+		}
+	}
+
+	data, err := res.wait(ctx)
+	if err != nil {
+		yield(nil, err)
+		return false
+	}
+
+	return yield(IncludeData{Element: res.inc.ele, Data: data}, nil) && yield(res.inc.end(), nil)
+}
@@ -0,0 +1,174 @@
+package esiproc_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/nussjustin/esi"
+	"github.com/nussjustin/esi/esiproc"
+)
+
+func describeEvent(event esiproc.Event) string {
+	switch event := event.(type) {
+	case esiproc.AttemptFailed:
+		if event.Include == nil {
+			return fmt.Sprintf("attempt failed %v", event.Err)
+		}
+
+		return fmt.Sprintf("attempt failed %s %s", event.Include.Element.Source, event.Include.Outcome)
+	case esiproc.BranchTaken:
+		return fmt.Sprintf("branch %s", event.Branch.Name().Local)
+	case esiproc.DataChunk:
+		return fmt.Sprintf("data %q", event.Data)
+	case esiproc.IncludeData:
+		return fmt.Sprintf("include data %s %q", event.Element.Source, event.Data)
+	case esiproc.IncludeEnd:
+		return fmt.Sprintf("include end %s %s", event.Element.Source, event.Outcome)
+	case esiproc.IncludeStart:
+		return fmt.Sprintf("include start %s", event.Element.Source)
+	default:
+		panic("unknown event")
+	}
+}
+
+func TestProcessor_Events(t *testing.T) {
+	const input = `a<esi:include src="/b"/>` +
+		`<esi:choose><esi:when test="false">c</esi:when><esi:otherwise>d</esi:otherwise></esi:choose>` +
+		`<esi:try><esi:attempt><esi:include src="/e"/></esi:attempt><esi:except>except</esi:except></esi:try>` +
+		`<esi:try><esi:attempt><esi:include src="/error"/></esi:attempt><esi:except>f</esi:except></esi:try>` +
+		`<esi:include src="/error" onerror="continue"/>` +
+		`<esi:include src="/error" alt="/g"/>`
+
+	client := esiproc.ClientFunc(func(_ context.Context, urlStr string, _ map[string]string) ([]byte, error) {
+		if urlStr == "/error" {
+			return nil, errors.New("include failed")
+		}
+		return []byte(strings.TrimPrefix(urlStr, "/")), nil
+	})
+
+	p := esiproc.New(esiproc.WithClient(client), esiproc.WithEvalFunc(testEnv{}.Eval))
+
+	var got []string
+
+	for event, err := range p.Events(t.Context(), esi.NewParser(strings.NewReader(input)).All) {
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		got = append(got, describeEvent(event))
+	}
+
+	want := []string{
+		`data "a"`,
+		`include start /b`,
+		`include data /b "b"`,
+		`include end /b IncludeOutcomeSuccess`,
+		`branch otherwise`,
+		`data "d"`,
+		`include start /e`,
+		`include data /e "e"`,
+		`include end /e IncludeOutcomeSuccess`,
+		`attempt failed /error IncludeOutcomeCaught`,
+		`data "f"`,
+		`include start /error`,
+		`include data /error ""`,
+		`include end /error IncludeOutcomeSuppressed`,
+		`include start /error`,
+		`include data /error "g"`,
+		`include end /error IncludeOutcomeAlt`,
+	}
+
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("events mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestProcessor_Events_Error(t *testing.T) {
+	p := esiproc.New()
+
+	var got []string
+
+	for event, err := range p.Events(t.Context(), esi.NewParser(strings.NewReader(`a<esi:include src="/"/>b`)).All) {
+		if err != nil {
+			if !errors.Is(err, errors.ErrUnsupported) {
+				t.Errorf("got error %v, want %v", err, errors.ErrUnsupported)
+			}
+
+			got = append(got, "error")
+			continue
+		}
+
+		got = append(got, describeEvent(event))
+	}
+
+	if diff := cmp.Diff([]string{`data "a"`, "error"}, got); diff != "" {
+		t.Errorf("events mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestProcessor_Events_Break(t *testing.T) {
+	client := esiproc.ClientFunc(func(ctx context.Context, _ string, _ map[string]string) ([]byte, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+
+	p := esiproc.New(esiproc.WithClient(client))
+
+	for event, err := range p.Events(t.Context(), esi.NewParser(strings.NewReader(`<esi:include src="/"/>`)).All) {
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		if _, ok := event.(esiproc.IncludeStart); !ok {
+			t.Fatalf("got event %s, want include start", describeEvent(event))
+		}
+
+		break
+	}
+}
+
+func TestProcessor_Events_Reuse(t *testing.T) {
+	nodes, err := esi.Parse("a\n  <esi:remove>b</esi:remove>  \nc")
+	if err != nil {
+		t.Fatalf("failed to parse input: %v", err)
+	}
+
+	p := esiproc.New(esiproc.WithTrimWhitespace())
+
+	seq := p.Events(t.Context(), esi.Seq(nodes...))
+
+	collect := func() []string {
+		var got []string
+
+		for event, err := range seq {
+			if err != nil {
+				t.Errorf("got error %v", err)
+				return nil
+			}
+
+			got = append(got, describeEvent(event))
+		}
+
+		return got
+	}
+
+	want := collect()
+
+	var wg sync.WaitGroup
+
+	for range 2 {
+		wg.Go(func() {
+			if diff := cmp.Diff(want, collect()); diff != "" {
+				t.Errorf("events mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	wg.Wait()
+}
@@ -0,0 +1,9 @@
+package esiproc
+
+// WaitingIncludes returns the number of includes of p that are waiting for the concurrency limit.
+func WaitingIncludes(p *Processor) int {
+	p.incSema.mu.Lock()
+	defer p.incSema.mu.Unlock()
+
+	return len(p.incSema.waiters)
+}
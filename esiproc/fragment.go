@@ -0,0 +1,138 @@
+package esiproc
+
+import (
+	"bytes"
+	"context"
+	"sync"
+
+	"github.com/nussjustin/esi"
+)
+
+// FragmentStore stores the content of <esi:inline> elements.
+//
+// See [WithFragmentStore].
+type FragmentStore interface {
+	// Put is called with the name of the fragment, the value of the fetchable attribute and the processed content of
+	// an esi:inline element once all content, including the data of nested esi:include elements, is available.
+	//
+	// Put is not called if processing the content of the element fails.
+	//
+	// data must not be modified or retained after Put returns. Put must be safe for concurrent use.
+	Put(name string, fetchable bool, data []byte)
+}
+
+// FragmentStoreFunc implements a [FragmentStore] by calling itself.
+type FragmentStoreFunc func(name string, fetchable bool, data []byte)
+
+// Put calls f with the given arguments.
+func (f FragmentStoreFunc) Put(name string, fetchable bool, data []byte) {
+	f(name, fetchable, data)
+}
+
+// WithFragmentStore specifies the store used for the content of <esi:inline> elements.
+//
+// The content of esi:inline elements is processed and written to the output like any other content and additionally
+// passed to s. Fetchable fragments can then be used for matching esi:include elements, for example using a
+// [MemoryFragmentStore] together with [ClientWithFragments].
+//
+// If s is nil, <esi:inline> elements will be unsupported.
+func WithFragmentStore(s FragmentStore) ProcessorOpt {
+	return func(p *processorOptions) {
+		p.fragmentStore = s
+	}
+}
+
+// MemoryFragmentStore is a [FragmentStore] that keeps fetchable fragments in memory.
+//
+// The zero value is ready to use. A MemoryFragmentStore must not be copied after first use.
+type MemoryFragmentStore struct {
+	mu        sync.RWMutex
+	fragments map[string][]byte
+}
+
+var _ FragmentStore = (*MemoryFragmentStore)(nil)
+
+// Put stores a copy of data under the given name, replacing any existing fragment with the same name.
+//
+// If fetchable is false, any existing fragment with the same name is removed instead.
+func (s *MemoryFragmentStore) Put(name string, fetchable bool, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !fetchable {
+		delete(s.fragments, name)
+		return
+	}
+
+	if s.fragments == nil {
+		s.fragments = make(map[string][]byte)
+	}
+
+	s.fragments[name] = bytes.Clone(data)
+}
+
+// Get returns the content of the fetchable fragment with the given name.
+//
+// The returned slice must not be modified.
+func (s *MemoryFragmentStore) Get(name string) (data []byte, ok bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	data, ok = s.fragments[name]
+	return data, ok
+}
+
+// ClientWithFragments returns a [Client] that serves esi:include elements from fragments returned by lookup and that
+// calls c for all URLs for which lookup returns false.
+//
+// lookup is called with the URL that should be included and is typically the Get method of a [MemoryFragmentStore].
+// Since the name of a fragment must match the URL exactly, fragments should be named using absolute URLs.
+func ClientWithFragments(c Client, lookup func(name string) ([]byte, bool)) Client {
+	return ClientFunc(func(ctx context.Context, urlStr string, extra map[string]string) ([]byte, error) {
+		if data, ok := lookup(urlStr); ok {
+			return data, nil
+		}
+
+		return c.Do(ctx, urlStr, extra)
+	})
+}
+
+// processInline processes the content of the given element and passes the result to the configured [FragmentStore].
+func (p *Processor) processInline(ctx context.Context, resC chan<- processedNode, inline *esi.InlineElement) {
+	inlineCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	inlineC := make(chan processedNode, 32)
+
+	go func() {
+		defer close(inlineC)
+		defer p.recoverPanic(inlineCtx, inlineC)
+
+		p.processNodes(inlineCtx, inlineC, inline.Nodes)
+	}()
+
+	var nodes []processedNode
+
+	// Forward the results as they become available, so that the content is written like any other content.
+	for node := range inlineC {
+		select {
+		case <-ctx.Done():
+		case resC <- node:
+		}
+
+		nodes = append(nodes, node)
+	}
+
+	var buf bytes.Buffer
+
+	for _, node := range nodes {
+		data, err := node.wait(ctx)
+		if err != nil {
+			return
+		}
+
+		_, _ = buf.Write(data)
+	}
+
+	p.opts.fragmentStore.Put(inline.FragmentName, inline.Fetchable, buf.Bytes())
+}
@@ -0,0 +1,180 @@
+package esiproc_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/nussjustin/esi/esiproc"
+)
+
+type storedFragment struct {
+	Name      string
+	Fetchable bool
+	Data      string
+}
+
+func TestProcessor_WithFragmentStore(t *testing.T) {
+	errFailed := errors.New("failed")
+
+	client := esiproc.ClientFunc(func(_ context.Context, urlStr string, _ map[string]string) ([]byte, error) {
+		if urlStr == "/error" {
+			return nil, errFailed
+		}
+
+		return []byte("[" + urlStr + "]"), nil
+	})
+
+	testCases := []struct {
+		Name        string
+		Input       string
+		Store       bool
+		Expected    string
+		Error       error
+		Unsupported bool
+		Fragments   []storedFragment
+	}{
+		{
+			Name:        "without store",
+			Input:       `<esi:inline name="/a" fetchable="yes">a</esi:inline>`,
+			Unsupported: true,
+		},
+		{
+			Name:     "text",
+			Input:    `before<esi:inline name="/a" fetchable="yes">a</esi:inline>after`,
+			Store:    true,
+			Expected: `beforeaafter`,
+			Fragments: []storedFragment{
+				{Name: "/a", Fetchable: true, Data: "a"},
+			},
+		},
+		{
+			Name: "nested",
+			Input: `<esi:inline name="/a" fetchable="no">` +
+				`a<esi:include src="/b"/><esi:inline name="/c" fetchable="yes">c</esi:inline>` +
+				`</esi:inline>`,
+			Store:    true,
+			Expected: `a[/b]c`,
+			Fragments: []storedFragment{
+				{Name: "/c", Fetchable: true, Data: "c"},
+				{Name: "/a", Fetchable: false, Data: "a[/b]c"},
+			},
+		},
+		{
+			Name:  "error",
+			Input: `<esi:inline name="/a" fetchable="yes">a<esi:include src="/error"/></esi:inline>`,
+			Store: true,
+			Error: errFailed,
+		},
+		{
+			Name: "error caught",
+			Input: `<esi:try><esi:attempt><esi:inline name="/a" fetchable="yes">` +
+				`a<esi:include src="/error"/>` +
+				`</esi:inline></esi:attempt><esi:except>except</esi:except></esi:try>`,
+			Store:    true,
+			Expected: `except`,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			var mu sync.Mutex
+			var fragments []storedFragment
+
+			opts := []esiproc.ProcessorOpt{esiproc.WithClient(client)}
+
+			if testCase.Store {
+				opts = append(opts, esiproc.WithFragmentStore(esiproc.FragmentStoreFunc(
+					func(name string, fetchable bool, data []byte) {
+						mu.Lock()
+						defer mu.Unlock()
+
+						fragments = append(fragments, storedFragment{Name: name, Fetchable: fetchable, Data: string(data)})
+					})))
+			}
+
+			var buf bytes.Buffer
+
+			_, err := esiproc.New(opts...).ProcessReader(t.Context(), &buf, strings.NewReader(testCase.Input))
+
+			var unsupportedErr *esiproc.UnsupportedElementError
+
+			switch {
+			case testCase.Unsupported:
+				if !errors.As(err, &unsupportedErr) {
+					t.Errorf("got error %v, want %T", err, unsupportedErr)
+				}
+			case !errors.Is(err, testCase.Error):
+				t.Errorf("got error %v, want %v", err, testCase.Error)
+			}
+
+			if err == nil && buf.String() != testCase.Expected {
+				t.Errorf("got output %q, want %q", buf.String(), testCase.Expected)
+			}
+
+			if diff := cmp.Diff(testCase.Fragments, fragments); diff != "" {
+				t.Errorf("fragments mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestMemoryFragmentStore(t *testing.T) {
+	var store esiproc.MemoryFragmentStore
+
+	store.Put("/a", true, []byte("a"))
+	store.Put("/b", false, []byte("b"))
+
+	if data, ok := store.Get("/a"); !ok || string(data) != "a" {
+		t.Errorf("got (%q, %v) for /a, want (%q, true)", data, ok, "a")
+	}
+
+	if data, ok := store.Get("/b"); ok {
+		t.Errorf("got (%q, %v) for non-fetchable fragment /b, want no fragment", data, ok)
+	}
+
+	store.Put("/a", false, []byte("a2"))
+
+	if data, ok := store.Get("/a"); ok {
+		t.Errorf("got (%q, %v) for /a after replacing with non-fetchable fragment, want no fragment", data, ok)
+	}
+}
+
+func TestClientWithFragments(t *testing.T) {
+	var store esiproc.MemoryFragmentStore
+
+	client := esiproc.ClientWithFragments(
+		esiproc.ClientFunc(func(_ context.Context, urlStr string, _ map[string]string) ([]byte, error) {
+			return []byte("[" + urlStr + "]"), nil
+		}),
+		store.Get)
+
+	p := esiproc.New(esiproc.WithClient(client), esiproc.WithFragmentStore(&store))
+
+	process := func(input string) string {
+		var buf bytes.Buffer
+
+		if _, err := p.ProcessReader(t.Context(), &buf, strings.NewReader(input)); err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		return buf.String()
+	}
+
+	if got, want := process(`<esi:include src="/a"/>`), "[/a]"; got != want {
+		t.Errorf("got %q before storing fragment, want %q", got, want)
+	}
+
+	if got, want := process(`<esi:inline name="/a" fetchable="yes">fragment</esi:inline>`), "fragment"; got != want {
+		t.Errorf("got %q while storing fragment, want %q", got, want)
+	}
+
+	if got, want := process(`<esi:include src="/a"/>`), "fragment"; got != want {
+		t.Errorf("got %q after storing fragment, want %q", got, want)
+	}
+}
@@ -0,0 +1,169 @@
+package esiproc
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/nussjustin/esi/esiexpr/ast"
+	"github.com/nussjustin/esi/internal/diag"
+)
+
+// InjectionError is returned for esi:include elements where interpolating variables into the URL changed parts of the
+// URL that were fixed in the template.
+//
+// See [WithInjectionGuard].
+type InjectionError struct {
+	// Template is the URL before interpolation.
+	Template string
+
+	// URL is the URL after interpolation.
+	URL string
+
+	// Component is the name of the changed component. One of "url", "scheme", "userinfo", "host" or "path".
+	Component string
+}
+
+// Code returns a machine-readable code identifying the type of the error.
+func (*InjectionError) Code() string {
+	return "esiproc.injection"
+}
+
+// Error returns a human-readable error message.
+func (e *InjectionError) Error() string {
+	return fmt.Sprintf("interpolated URL %q changes the %s of template %q", e.URL, e.Component, e.Template)
+}
+
+// Is checks if the given error matches the receiver.
+func (e *InjectionError) Is(err error) bool {
+	var o *InjectionError
+	return errors.As(err, &o) && *o == *e
+}
+
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (e *InjectionError) MarshalJSON() ([]byte, error) {
+	return diag.Marshal(e, diag.Diagnostic{
+		Details: map[string]any{"template": e.Template, "url": e.URL, "component": e.Component},
+	})
+}
+
+// WithInjectionGuard configures a [Processor] to validate URLs of esi:include elements after interpolating variables.
+//
+// Since variables like cookies and headers can be controlled by clients, interpolating them into a URL could be
+// used to make the [Client] request other URLs than intended. To prevent this, each interpolated URL is checked
+// against its template and must fulfill the following conditions:
+//
+//   - The URL must be parseable by [url.Parse].
+//   - The scheme, user information and host must be unchanged, unless the template contains a variable inside them.
+//     This also means that relative URLs must stay relative.
+//   - If the template contains a variable inside the path, the path must start with the part of the template path
+//     before the first variable and must not contain "." or ".." segments, unless the template already does.
+//   - Otherwise the path must be unchanged.
+//
+// If a URL fails the validation, the include fails with an [*InjectionError]. As for other failed includes, alt,
+// onerror and esi:try are handled as usual.
+func WithInjectionGuard() ProcessorOpt {
+	return func(p *processorOptions) {
+		p.injectionGuard = true
+	}
+}
+
+// injectionPlaceholder replaces variables in templates when parsing them. It is a valid part of all URL components.
+const injectionPlaceholder = "x-esi-var-x"
+
+func checkInjection(template, urlStr string) error {
+	if !strings.Contains(template, "$(") {
+		return nil
+	}
+
+	newErr := func(component string) error {
+		return &InjectionError{Template: template, URL: urlStr, Component: component}
+	}
+
+	tmpl, err := replaceVariables(template, injectionPlaceholder)
+	if err != nil {
+		// If we can not parse the template, we can not tell what changed
+		return newErr("url")
+	}
+
+	tmplURL, err := url.Parse(tmpl)
+	if err != nil {
+		return newErr("url")
+	}
+
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return newErr("url")
+	}
+
+	hasVar := func(s string) bool {
+		return strings.Contains(s, injectionPlaceholder)
+	}
+
+	switch {
+	case !hasVar(tmplURL.Scheme) && u.Scheme != tmplURL.Scheme:
+		return newErr("scheme")
+	case !hasVar(tmplURL.User.String()) && u.User.String() != tmplURL.User.String():
+		return newErr("userinfo")
+	case !hasVar(tmplURL.Host) && !strings.EqualFold(u.Host, tmplURL.Host):
+		return newErr("host")
+	case !hasVar(tmplURL.Path) && u.Path != tmplURL.Path:
+		return newErr("path")
+	}
+
+	if i := strings.Index(tmplURL.Path, injectionPlaceholder); i != -1 {
+		if !strings.HasPrefix(u.Path, tmplURL.Path[:i]) {
+			return newErr("path")
+		}
+
+		if hasDotSegment(u.Path) && !hasDotSegment(tmplURL.Path) {
+			return newErr("path")
+		}
+	}
+
+	return nil
+}
+
+func hasDotSegment(path string) bool {
+	for segment := range strings.SplitSeq(path, "/") {
+		if segment == "." || segment == ".." {
+			return true
+		}
+	}
+
+	return false
+}
+
+// replaceVariables replaces all variables in s with the given replacement.
+//
+// Variables are parsed like in [github.com/nussjustin/esi/esiexpr.Env.Interpolate], so that variables with defaults
+// that contain parentheses or other variables, like $(A|$(B)), are replaced as a whole.
+func replaceVariables(s, replacement string) (string, error) {
+	p := ast.NewParser("")
+
+	var b strings.Builder
+
+	for {
+		start := strings.Index(s, "$(")
+		if start == -1 {
+			break
+		}
+
+		p.Reset(s[start:])
+
+		v, err := p.ParseVariable()
+		if err != nil {
+			return "", err
+		}
+
+		b.WriteString(s[:start])
+		b.WriteString(replacement)
+
+		s = s[start+v.Position.End:]
+	}
+
+	b.WriteString(s)
+
+	return b.String(), nil
+}
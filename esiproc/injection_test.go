@@ -0,0 +1,97 @@
+package esiproc_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/nussjustin/esi"
+	"github.com/nussjustin/esi/esiproc"
+)
+
+func TestProcessor_WithInjectionGuard(t *testing.T) {
+	testCases := []struct {
+		Template  string
+		Value     string
+		Component string
+	}{
+		{Template: "/static", Value: "ignored"},
+		{Template: "/fragment?user=$(X)", Value: "123"},
+		{Template: "/fragment?user=$(X)", Value: "1/../../admin"},
+		{Template: "/fragment?user=$(X)", Value: "1#"},
+		{Template: "/fragment/$(X)", Value: "123"},
+		{Template: "/fragment/$(X)", Value: "../admin", Component: "path"},
+		{Template: "/fragment/$(X)", Value: "%2e%2e/admin", Component: "path"},
+		{Template: "/fragment/$(X)/info", Value: "1/../2", Component: "path"},
+		{Template: "/fragment$(X)", Value: "/../../admin", Component: "path"},
+		{Template: "/$(X)", Value: "/evil.example.com/x", Component: "host"},
+		{Template: "$(X)", Value: "https://evil.example.com/", Component: "scheme"},
+		{Template: "https://example.com/$(X)", Value: "x"},
+		{Template: "https://example.com$(X)", Value: "@evil.example.com", Component: "userinfo"},
+		{Template: "https://example.com/?a=$(X)", Value: "1"},
+		{Template: "https://$(X).example.com/", Value: "tenant"},
+		{Template: "https://$(X)/", Value: "user@evil.example.com", Component: "userinfo"},
+		{Template: "https://$(X|$(Y)).example.com/", Value: "tenant"},
+		{Template: "https://$(X|'a)/b').example.com/", Value: "tenant"},
+		{Template: "https://$(X|$(Y)).example.com/", Value: "evil.example.com/", Component: "path"},
+		{Template: "https://example.com/%zz$(X)", Value: "x", Component: "url"},
+		{Template: "/fragment?q=$(X)", Value: "%zz"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Template+" "+testCase.Value, func(t *testing.T) {
+			var requested string
+
+			client := esiproc.ClientFunc(func(_ context.Context, urlStr string, _ map[string]string) ([]byte, error) {
+				requested = urlStr
+				return nil, nil
+			})
+
+			variables := strings.NewReplacer(
+				"$(X|$(Y))", testCase.Value,
+				"$(X|'a)/b')", testCase.Value,
+				"$(X)", testCase.Value)
+
+			interpolate := func(_ context.Context, s string) (string, error) {
+				return variables.Replace(s), nil
+			}
+
+			p := esiproc.New(
+				esiproc.WithClient(client),
+				esiproc.WithInterpolateFunc(interpolate),
+				esiproc.WithInjectionGuard())
+
+			nodes := esi.Seq(&esi.IncludeElement{Source: testCase.Template})
+
+			_, err := p.Process(t.Context(), io.Discard, nodes)
+
+			if testCase.Component == "" {
+				if err != nil {
+					t.Fatalf("got error %v", err)
+				}
+
+				if want := variables.Replace(testCase.Template); requested != want {
+					t.Errorf("got request for %q, want %q", requested, want)
+				}
+
+				return
+			}
+
+			want := &esiproc.InjectionError{
+				Template:  testCase.Template,
+				URL:       variables.Replace(testCase.Template),
+				Component: testCase.Component,
+			}
+
+			if !errors.Is(err, want) {
+				t.Errorf("got error %v, want %v", err, want)
+			}
+
+			if requested != "" {
+				t.Errorf("got request for %q, want none", requested)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package esiproc
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/nussjustin/esi/internal/diag"
+)
+
+// ClosedError is returned when using a [Processor] after [Processor.Close] was called.
+type ClosedError struct{}
+
+// Code returns a machine-readable code identifying the type of the error.
+func (*ClosedError) Code() string {
+	return "esiproc.closed"
+}
+
+// Error returns a human-readable error message.
+func (*ClosedError) Error() string {
+	return "processor closed"
+}
+
+// Is checks if the given error matches the receiver.
+func (*ClosedError) Is(err error) bool {
+	var o *ClosedError
+	return errors.As(err, &o)
+}
+
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (e *ClosedError) MarshalJSON() ([]byte, error) {
+	return diag.Marshal(e, diag.Diagnostic{})
+}
+
+// lifecycleKey is used to mark contexts of calls that already hold a reference to the lifecycle stored under the key.
+type lifecycleKey struct{}
+
+// lifecycle tracks the outstanding work of a [Processor].
+//
+// Each processor has its own lifecycle. The lifecycle of a processor created using [Processor.With] has the lifecycle
+// of the original processor as parent, so that work is also tracked by the parent and closing the parent also closes
+// all processors derived from it.
+type lifecycle struct {
+	parent *lifecycle
+
+	mu     sync.Mutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// acquire registers a new call that must be waited for when closing. If the processor or any of its parents is
+// closed, acquire returns false.
+func (l *lifecycle) acquire() bool {
+	if l == nil {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed || !l.parent.acquire() {
+		return false
+	}
+
+	l.wg.Add(1)
+	return true
+}
+
+// goTracked runs f in a new goroutine, which is waited for when closing.
+//
+// It must only be called while holding a reference acquired using acquire.
+func (l *lifecycle) goTracked(f func()) {
+	for o := l; o != nil; o = o.parent {
+		o.wg.Add(1)
+	}
+
+	go func() {
+		defer l.release()
+		f()
+	}()
+}
+
+// release releases a reference acquired using acquire.
+func (l *lifecycle) release() {
+	for o := l; o != nil; o = o.parent {
+		o.wg.Done()
+	}
+}
+
+// Close marks the processor as closed and waits until all outstanding work is finished or ctx is done.
+//
+// After Close was called, [Processor.Process], [Processor.ProcessReader], [Processor.ProcessResult] and
+// [Processor.Events] fail with a [*ClosedError]. Calls that are already running are not affected and finish as usual,
+// including all includes started by them.
+//
+// Closing a processor also closes all processors created from it using [Processor.With] and waits for their work.
+// Closing a processor created using With does not affect the processor it was created from.
+//
+// Once all work is finished, the limit for concurrent calls to the [Client] (see [WithClientConcurrency]) is torn down,
+// unless it is shared with the processor p was created from.
+//
+// If ctx is done before all work is finished, Close returns the context error. Close can be called again to continue
+// waiting.
+func (p *Processor) Close(ctx context.Context) error {
+	p.life.mu.Lock()
+	p.life.closed = true
+	p.life.mu.Unlock()
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		p.life.wg.Wait()
+	}()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-done:
+	}
+
+	if p.ownSema {
+		p.incSema.close()
+	}
+
+	return nil
+}
@@ -0,0 +1,140 @@
+package esiproc_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nussjustin/esi"
+	"github.com/nussjustin/esi/esiproc"
+)
+
+func TestProcessor_Close(t *testing.T) {
+	started, unblock := make(chan struct{}), make(chan struct{})
+
+	client := esiproc.ClientFunc(func(_ context.Context, urlStr string, _ map[string]string) ([]byte, error) {
+		if urlStr == "/block" {
+			close(started)
+			<-unblock
+		}
+
+		return []byte(urlStr), nil
+	})
+
+	p := esiproc.New(esiproc.WithClient(client))
+
+	type result struct {
+		output string
+		err    error
+	}
+
+	resultC := make(chan result, 1)
+
+	go func() {
+		var buf bytes.Buffer
+
+		_, err := p.Process(t.Context(), &buf, esi.NewParser(strings.NewReader(`<esi:include src="/block"/>`)).All)
+
+		resultC <- result{buf.String(), err}
+	}()
+
+	<-started
+
+	ctx, cancel := context.WithTimeout(t.Context(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := p.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v while processing, want %v", err, context.DeadlineExceeded)
+	}
+
+	for _, p := range []*esiproc.Processor{p, p.With(esiproc.WithTrimWhitespace())} {
+		_, err := p.Process(t.Context(), &bytes.Buffer{}, esi.NewParser(strings.NewReader(`<esi:include src="/a"/>`)).All)
+		if !errors.Is(err, &esiproc.ClosedError{}) {
+			t.Errorf("got error %v after close, want %v", err, &esiproc.ClosedError{})
+		}
+
+		// Documents without markup are not parsed, but must be rejected, too.
+		_, err = p.ProcessReader(t.Context(), &bytes.Buffer{}, strings.NewReader(`no markup`))
+		if !errors.Is(err, &esiproc.ClosedError{}) {
+			t.Errorf("got error %v from ProcessReader after close, want %v", err, &esiproc.ClosedError{})
+		}
+	}
+
+	close(unblock)
+
+	if err := p.Close(t.Context()); err != nil {
+		t.Errorf("got error %v", err)
+	}
+
+	if res := <-resultC; res.err != nil || res.output != "/block" {
+		t.Errorf("got (%q, %v) for running call, want (%q, nil)", res.output, res.err, "/block")
+	}
+}
+
+func TestProcessor_Close_Derived(t *testing.T) {
+	started, unblock := make(chan struct{}), make(chan struct{})
+
+	client := esiproc.ClientFunc(func(_ context.Context, urlStr string, _ map[string]string) ([]byte, error) {
+		if urlStr == "/block" {
+			close(started)
+			<-unblock
+		}
+
+		return []byte(urlStr), nil
+	})
+
+	parent := esiproc.New(esiproc.WithClient(client))
+	derived := parent.With(esiproc.WithTrimWhitespace())
+
+	if err := derived.Close(t.Context()); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	process := func(p *esiproc.Processor, input string) error {
+		_, err := p.ProcessReader(t.Context(), &bytes.Buffer{}, strings.NewReader(input))
+		return err
+	}
+
+	if err := process(derived, `<esi:include src="/a"/>`); !errors.Is(err, &esiproc.ClosedError{}) {
+		t.Errorf("got error %v from closed processor, want %v", err, &esiproc.ClosedError{})
+	}
+
+	if err := process(parent, `<esi:include src="/a"/>`); err != nil {
+		t.Errorf("got error %v from parent after closing derived processor", err)
+	}
+
+	// Closing the parent must wait for work of derived processors.
+	other := parent.With(esiproc.WithTrimWhitespace())
+
+	errC := make(chan error, 1)
+
+	go func() {
+		errC <- process(other, `<esi:include src="/block"/>`)
+	}()
+
+	<-started
+
+	ctx, cancel := context.WithTimeout(t.Context(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := parent.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v while derived processor is busy, want %v", err, context.DeadlineExceeded)
+	}
+
+	close(unblock)
+
+	if err := <-errC; err != nil {
+		t.Errorf("got error %v from running call", err)
+	}
+
+	if err := parent.Close(t.Context()); err != nil {
+		t.Errorf("got error %v", err)
+	}
+
+	if err := process(other, `<esi:include src="/a"/>`); !errors.Is(err, &esiproc.ClosedError{}) {
+		t.Errorf("got error %v from derived processor after closing parent, want %v", err, &esiproc.ClosedError{})
+	}
+}
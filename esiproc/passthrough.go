@@ -0,0 +1,264 @@
+package esiproc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/nussjustin/esi"
+	"github.com/nussjustin/esi/esixml"
+	"github.com/nussjustin/esi/internal/markup"
+)
+
+// passThroughBufferSize is the size of the buffers used by [Processor.ProcessReader].
+const passThroughBufferSize = 32 * 1024
+
+// maxMarkupPrefix is the length of the longest prefix needed to detect ESI markup ("<![CDATA[").
+const maxMarkupPrefix = 9
+
+var passThroughBufferPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, passThroughBufferSize)
+		return &b
+	},
+}
+
+// ProcessReader parses the document read from r and processes it like [Processor.Process].
+//
+// The document is parsed using a [esi.Parser] created with the given options. Data before the first ESI element, ESI
+// comment or CDATA section is copied to w as is, without being parsed. For documents without any ESI markup or CDATA
+// sections, ProcessReader is equivalent to [io.Copy] and does not allocate. If the options check or modify data (see
+// [esi.ChecksData]), the whole document is parsed instead.
+//
+// The document is processed as a stream: it is parsed while it is read from r and processed output is written to w
+// as soon as it is available, while later includes are still being fetched. Only the output of an element must wait
+// until all output before it was written. The number of nodes read ahead of the output can be limited using
+// [WithMaxPendingNodes]. Use [WithFlush] to flush w each time output is waiting, for example when writing to an
+// [net/http.ResponseWriter].
+//
+// Positions in errors are relative to the start of the document read from r. Large documents can be processed with
+// bounded memory by passing [esi.WithSpill].
+func (p *Processor) ProcessReader(ctx context.Context, w io.Writer, r io.Reader, opts ...esi.ParserOpt) (int, error) {
+	if !p.life.acquire() {
+		return 0, &ClosedError{}
+	}
+
+	defer p.life.release()
+
+	bufp := passThroughBufferPool.Get().(*[]byte)
+	defer passThroughBufferPool.Put(bufp)
+
+	buf := *bufp
+
+	// offset is the offset of buf[0] in the document and n the number of bytes in buf.
+	var offset, n int
+
+	s := passThroughScanner{trim: p.opts.trimWhitespace}
+
+	ow := p.newOutputWriter(w)
+
+	var flush func() error
+
+	if p.opts.flush {
+		flush = ow.flusher(flusherFor(w))
+	}
+
+	// Data that is checked by the parser must not be passed through, so parse the whole document in that case.
+	passThrough := len(opts) == 0 || !esi.ChecksData(opts...)
+
+	for passThrough {
+		if err := ctx.Err(); err != nil {
+			return offset, err
+		}
+
+		m, err := r.Read(buf[n:])
+		n += m
+
+		eof := errors.Is(err, io.EOF)
+		if err != nil && !eof {
+			return offset, err
+		}
+
+		safe, done := s.scan(buf[:n], eof)
+
+		if safe > 0 {
+			written, err := ow.Write(buf[:safe])
+			if err != nil {
+				return offset + written, &WriteError{Err: err}
+			}
+
+			// Reading the next data from r may block, so flush what we have.
+			if flush != nil {
+				if err := flush(); err != nil {
+					return offset + written, &WriteError{Err: err}
+				}
+			}
+
+			offset += safe
+			n = copy(buf, buf[safe:n])
+			s.shift(safe)
+		}
+
+		if done && n == 0 {
+			return offset, nil
+		}
+
+		// Parse the rest if markup was found or if the undecided data does not fit into the buffer
+		if done || eof || n == len(buf) {
+			break
+		}
+	}
+
+	in := io.MultiReader(bytes.NewReader(buf[:n]), r)
+
+	opts = append(opts[:len(opts):len(opts)], esi.WithReaderOptions(esixml.WithStartOffset(offset)))
+
+	parser := esi.NewParser(in, opts...)
+	defer func() { _ = parser.Close() }()
+
+	// The reference acquired above is used for processing the rest of the document
+	ctx = context.WithValue(ctx, lifecycleKey{}, p.life)
+
+	written, err := p.Process(ctx, w, parser.All)
+	return offset + written, err
+}
+
+// passThroughScanner finds the data at the start of a document that can be written as is, without being parsed.
+//
+// The scan mirrors the handling of [esixml.Reader]: inside XML comments, "<!--esi" does not start an ESI comment.
+// If ESI markup is found inside an XML comment, the data must be parsed from the start of the comment.
+type passThroughScanner struct {
+	// trim is true if parsing must start at the start of a line, so that whitespace before block elements can be
+	// trimmed.
+	trim bool
+
+	// pos is the index up to which the data was scanned.
+	pos int
+
+	// lineStart is the index of the start of the line containing pos.
+	lineStart int
+
+	inComment        bool
+	commentStart     int
+	commentLineStart int
+}
+
+// scan scans b, starting where the last call stopped, and returns the number of bytes at the start of b that can be
+// written as is.
+//
+// If done is true, either b contains ESI markup after safe or, if safe == len(b), all data was scanned and no further
+// data needs to be parsed.
+func (s *passThroughScanner) scan(b []byte, eof bool) (safe int, done bool) {
+	var found bool
+
+	for s.pos < len(b) {
+		var k int
+
+		// Outside of comments only '<' can start markup, so we can use the faster IndexByte.
+		if s.inComment {
+			k = bytes.IndexAny(b[s.pos:], "<-")
+		} else {
+			k = bytes.IndexByte(b[s.pos:], '<')
+		}
+
+		if k == -1 {
+			s.advance(b, len(b))
+			break
+		}
+
+		j := s.pos + k
+		rest := b[j:]
+
+		s.advance(b, j)
+
+		// Fast path for other tags
+		if isOtherTag(rest) {
+			s.pos = j + 1
+			continue
+		}
+
+		if !eof && len(rest) < maxMarkupPrefix {
+			// Wait for more data before deciding
+			break
+		}
+
+		switch {
+		case isMarkupStart(rest, s.inComment):
+			found = true
+		case !s.inComment && bytes.HasPrefix(rest, []byte("<!--")):
+			s.inComment, s.commentStart, s.commentLineStart = true, j, s.lineStart
+			s.pos = j + 4
+			continue
+		case s.inComment && bytes.HasPrefix(rest, []byte("-->")):
+			s.inComment = false
+			s.pos = j + 3
+			continue
+		default:
+			s.pos = j + 1
+			continue
+		}
+
+		break
+	}
+
+	if !found && eof && !s.inComment {
+		return len(b), true
+	}
+
+	safe, lineStart := s.pos, s.lineStart
+
+	if s.inComment {
+		safe, lineStart = s.commentStart, s.commentLineStart
+	}
+
+	if s.trim {
+		safe = lineStart
+	}
+
+	return safe, found || eof
+}
+
+// advance moves the position to i, keeping track of the start of the current line if needed.
+func (s *passThroughScanner) advance(b []byte, i int) {
+	if !s.trim {
+		s.pos = i
+		return
+	}
+
+	if n := bytes.LastIndexByte(b[s.pos:i], '\n'); n != -1 {
+		s.lineStart = s.pos + n + 1
+	}
+
+	s.pos = i
+}
+
+// shift adjusts the scanner after the first n bytes were removed from the data.
+func (s *passThroughScanner) shift(n int) {
+	s.pos -= n
+	s.lineStart = max(s.lineStart-n, 0)
+	s.commentStart = max(s.commentStart-n, 0)
+	s.commentLineStart = max(s.commentLineStart-n, 0)
+}
+
+// isMarkupStart returns true if b starts with an ESI start or end tag or, outside of comments, an ESI comment or a
+// CDATA section.
+//
+// CDATA sections are handled by the parser, since their markers may need to be stripped (see
+// [esixml.WithCDATAStripping]).
+func isMarkupStart(b []byte, inComment bool) bool {
+	return markup.IsStart(b, !inComment) || !inComment && bytes.HasPrefix(b, []byte("<![CDATA["))
+}
+
+// isOtherTag returns true if b starts with '<' followed by bytes that can not start ESI markup or an XML comment.
+func isOtherTag(b []byte) bool {
+	switch {
+	case len(b) < 2 || b[0] != '<':
+		return false
+	case b[1] == '/':
+		return len(b) >= 3 && b[2] != 'e' && b[2] != 'E'
+	default:
+		return b[1] != 'e' && b[1] != 'E' && b[1] != '!'
+	}
+}
@@ -0,0 +1,354 @@
+package esiproc_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/nussjustin/esi"
+	"github.com/nussjustin/esi/esiproc"
+	"github.com/nussjustin/esi/esixml"
+)
+
+func TestProcessor_ProcessReader(t *testing.T) {
+	client := esiproc.ClientFunc(func(_ context.Context, urlStr string, _ map[string]string) ([]byte, error) {
+		return []byte(urlStr), nil
+	})
+
+	long := strings.Repeat("0123456789abcdef<-", 4096)
+
+	inputs := []string{
+		``,
+		`no markup at all`,
+		`<p>some <b>html</b> with -- dashes --> and < brackets</p>`,
+		`<esi:include src="/start"/>`,
+		`before <esi:include src="/middle"/> after`,
+		"line\n  <esi:remove>removed</esi:remove>  \nnext line",
+		`before </esi:remove> after`,
+		`before <!--esi <esi:include src="/esi-comment"/> --> after`,
+		`before <!-- comment <esi:include src="/comment"/> --> after`,
+		`before <!-- comment <!--esi --> <esi:include src="/comment"/> after`,
+		`before <!-- unterminated comment`,
+		`before <ESI:INCLUDE SRC="/upper"/> after`,
+		`before <esi:unknown/> after`,
+		`before <esi:include/> after`,
+		`ends with prefix <!--es`,
+		`before <![CDATA[ <esi:include src="/cdata"/> ]]> <esi:include src="/after-cdata"/> after`,
+		`before <![CDATA[ unterminated <esi:include src="/cdata"/>`,
+		`before <!-- <![CDATA[ --> <esi:include src="/comment-cdata"/> after`,
+		`ends with prefix <![CDAT`,
+		long,
+		long + `<esi:include src="/long"/>` + long,
+		"<!--" + long + `<esi:include src="/long-comment"/>-->`,
+		"line" + long + "\n\t<esi:try><esi:attempt>a</esi:attempt></esi:try>",
+	}
+
+	readers := map[string]func(io.Reader) io.Reader{
+		"full":     func(r io.Reader) io.Reader { return r },
+		"half":     iotest.HalfReader,
+		"one byte": iotest.OneByteReader,
+		"data err": iotest.DataErrReader,
+	}
+
+	for _, trim := range []bool{false, true} {
+		opts := []esiproc.ProcessorOpt{esiproc.WithClient(client)}
+
+		if trim {
+			opts = append(opts, esiproc.WithTrimWhitespace())
+		}
+
+		p := esiproc.New(opts...)
+
+		for _, input := range inputs {
+			var want bytes.Buffer
+
+			wantN, wantErr := p.Process(t.Context(), &want, esi.NewParser(strings.NewReader(input)).All)
+
+			for name, newReader := range readers {
+				var got bytes.Buffer
+
+				gotN, gotErr := p.ProcessReader(t.Context(), &got, newReader(strings.NewReader(input)))
+
+				if gotErr != wantErr && (gotErr == nil || wantErr == nil || gotErr.Error() != wantErr.Error()) {
+					t.Errorf("trim=%t, %s, %.40q: got error %v, want %v", trim, name, input, gotErr, wantErr)
+				}
+
+				if gotN != wantN {
+					t.Errorf("trim=%t, %s, %.40q: got %d bytes written, want %d", trim, name, input, gotN, wantN)
+				}
+
+				if got.String() != want.String() {
+					t.Errorf("trim=%t, %s, %.40q: got output %.80q, want %.80q",
+						trim, name, input, got.String(), want.String())
+				}
+			}
+		}
+	}
+}
+
+func TestProcessor_ProcessReader_CDATAStripping(t *testing.T) {
+	const input = `<script>//<![CDATA[
+var s = '<esi:include src="/x"/>';
+//]]></script>`
+
+	const want = `<script>//
+var s = '<esi:include src="/x"/>';
+//</script>`
+
+	var got bytes.Buffer
+
+	_, err := esiproc.New().ProcessReader(t.Context(), &got, strings.NewReader(input),
+		esi.WithReaderOptions(esixml.WithCDATAStripping()))
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	if got.String() != want {
+		t.Errorf("got %q, want %q", got.String(), want)
+	}
+}
+
+func TestProcessor_ProcessReader_ChecksData(t *testing.T) {
+	testCases := []struct {
+		Name  string
+		Input string
+		Opts  []esi.ParserOpt
+	}{
+		{
+			Name:  "invalid UTF-8",
+			Input: "a\x00b\xffc",
+			Opts: []esi.ParserOpt{
+				esi.WithReaderOptions(esixml.WithControlBytePolicy(esixml.ControlBytesReject)),
+				esi.WithReaderOptions(esixml.WithUTF8Validation()),
+			},
+		},
+		{
+			Name:  "control byte",
+			Input: "a\x00b<esi:include src=\"data:,c\"/>",
+			Opts:  []esi.ParserOpt{esi.WithReaderOptions(esixml.WithControlBytePolicy(esixml.ControlBytesReject))},
+		},
+		{
+			Name:  "control byte replaced",
+			Input: "a\x00b\x01c",
+			Opts:  []esi.ParserOpt{esi.WithReaderOptions(esixml.WithControlBytePolicy(esixml.ControlBytesReplace))},
+		},
+	}
+
+	p := esiproc.New()
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			var want, got bytes.Buffer
+
+			_, wantErr := p.Process(t.Context(), &want, esi.NewParser(strings.NewReader(testCase.Input), testCase.Opts...).All)
+			_, gotErr := p.ProcessReader(t.Context(), &got, strings.NewReader(testCase.Input), testCase.Opts...)
+
+			if fmt.Sprint(gotErr) != fmt.Sprint(wantErr) {
+				t.Errorf("got error %v, want %v", gotErr, wantErr)
+			}
+
+			if got.String() != want.String() {
+				t.Errorf("got %q, want %q", got.String(), want.String())
+			}
+		})
+	}
+}
+
+func TestProcessor_ProcessReader_Allocs(t *testing.T) {
+	p := esiproc.New()
+
+	input := []byte(strings.Repeat("<p>no markup -- in <b>this</b> document</p>\n", 4096))
+
+	r := bytes.NewReader(input)
+
+	// Warm up the buffer pool
+	if _, err := p.ProcessReader(t.Context(), io.Discard, r); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		r.Reset(input)
+
+		if _, err := p.ProcessReader(t.Context(), io.Discard, r); err != nil {
+			t.Fatalf("got error %v", err)
+		}
+	})
+
+	if allocs != 0 {
+		t.Errorf("got %f allocations, want 0", allocs)
+	}
+}
+
+// blockingReader returns the first chunk and waits for unblock before returning the rest.
+type blockingReader struct {
+	first, rest io.Reader
+	unblock     <-chan struct{}
+}
+
+func (b *blockingReader) Read(p []byte) (int, error) {
+	if n, err := b.first.Read(p); !errors.Is(err, io.EOF) {
+		return n, err
+	}
+
+	select {
+	case <-b.unblock:
+	case <-time.After(5 * time.Second):
+		return 0, errors.New("data was not flushed before reading")
+	}
+
+	return b.rest.Read(p)
+}
+
+func TestProcessor_ProcessReader_Flush(t *testing.T) {
+	client := esiproc.ClientFunc(func(_ context.Context, urlStr string, _ map[string]string) ([]byte, error) {
+		return []byte(urlStr), nil
+	})
+
+	p := esiproc.New(esiproc.WithClient(client), esiproc.WithFlush())
+
+	flushed := make(chan struct{})
+
+	r := &blockingReader{
+		first:   strings.NewReader("before "),
+		rest:    strings.NewReader(`<esi:include src="/include"/> after`),
+		unblock: flushed,
+	}
+
+	w := &plainFlushingWriter{flushed: flushed}
+
+	if _, err := p.ProcessReader(t.Context(), w, r); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	if got, want := w.buf.String(), "before /include after"; got != want {
+		t.Errorf("got output %q, want %q", got, want)
+	}
+}
+
+func TestProcessor_ProcessReader_Spill(t *testing.T) {
+	client := esiproc.ClientFunc(func(_ context.Context, urlStr string, _ map[string]string) ([]byte, error) {
+		return []byte(urlStr), nil
+	})
+
+	large := strings.Repeat("<p>large data</p>\n", 10_000)
+
+	input := `<esi:include src="/a"/>` + large + `<esi:remove>` + large + `</esi:remove>` + large +
+		`<esi:include src="/b"/>`
+
+	want := "/a" + large + large + "/b"
+
+	for _, varnish := range []bool{false, true} {
+		t.Run(fmt.Sprintf("varnish=%v", varnish), func(t *testing.T) {
+			opts := []esiproc.ProcessorOpt{esiproc.WithClient(client)}
+
+			if varnish {
+				opts = append(opts, esiproc.WithVarnishCompatibility())
+			}
+
+			dir := t.TempDir()
+
+			var buf bytes.Buffer
+
+			_, err := esiproc.New(opts...).ProcessReader(t.Context(), &buf, strings.NewReader(input),
+				esi.WithSpill(1024, dir))
+			if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+
+			if buf.String() != want {
+				t.Errorf("got %d bytes of output, want %d", buf.Len(), len(want))
+			}
+
+			if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+				t.Errorf("got entries %v and error %v after processing, want empty directory", entries, err)
+			}
+		})
+	}
+}
+
+func TestProcessor_ProcessReader_Errors(t *testing.T) {
+	errRead := errors.New("read error")
+
+	p := esiproc.New()
+
+	r := io.MultiReader(strings.NewReader("data"), iotest.ErrReader(errRead))
+
+	if _, err := p.ProcessReader(t.Context(), io.Discard, r); !errors.Is(err, errRead) {
+		t.Errorf("got error %v, want %v", err, errRead)
+	}
+
+	w := &limitedWriter{n: 2}
+
+	n, err := p.ProcessReader(t.Context(), w, strings.NewReader("data"))
+	if want := (&esiproc.WriteError{Err: io.ErrShortWrite}); !errors.Is(err, want) {
+		t.Errorf("got error %v, want %v", err, want)
+	}
+
+	if n != 2 {
+		t.Errorf("got %d bytes written, want 2", n)
+	}
+}
+
+func BenchmarkProcessor_ProcessReader(b *testing.B) {
+	input := []byte(strings.Repeat("<p>A paragraph of <b>HTML</b> without any ESI markup.</p>\n", 16*1024))
+
+	b.Run("io.Copy", func(b *testing.B) {
+		b.SetBytes(int64(len(input)))
+		b.ReportAllocs()
+
+		r := bytes.NewReader(input)
+
+		for b.Loop() {
+			r.Reset(input)
+
+			// Hide the io.ReaderFrom and io.WriterTo implementations to force copying the data
+			if _, err := io.Copy(struct{ io.Writer }{io.Discard}, struct{ io.Reader }{r}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("ProcessReader", func(b *testing.B) {
+		b.SetBytes(int64(len(input)))
+		b.ReportAllocs()
+
+		p := esiproc.New()
+
+		r := bytes.NewReader(input)
+
+		for b.Loop() {
+			r.Reset(input)
+
+			if _, err := p.ProcessReader(b.Context(), io.Discard, r); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("Process", func(b *testing.B) {
+		b.SetBytes(int64(len(input)))
+		b.ReportAllocs()
+
+		p := esiproc.New()
+
+		r := bytes.NewReader(input)
+
+		var parser esi.Parser
+
+		for b.Loop() {
+			r.Reset(input)
+			parser.Reset(r)
+
+			if _, err := p.Process(b.Context(), io.Discard, parser.All); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
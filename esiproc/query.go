@@ -0,0 +1,164 @@
+package esiproc
+
+import (
+	"context"
+	"net/url"
+	"strings"
+)
+
+// QueryFunc defines the signature for functions that return query parameters for the URL of an esi:include element.
+//
+// See [WithAppendQuery] and [WithSetQuery].
+type QueryFunc func(ctx context.Context, urlStr string) (url.Values, error)
+
+type queryModifier struct {
+	f   QueryFunc
+	set bool
+}
+
+// WithAppendQuery configures a [Processor] to append the query parameters returned by f to the URLs of esi:include
+// elements. Existing parameters with the same names are kept.
+//
+// The parameters are added after variables in the URL have been interpolated and after the URL was checked by
+// [WithInjectionGuard]. Names and values are encoded using [url.Values.Encode], so they can not change other parts
+// of the URL.
+//
+// If f returns an error, the include fails with the returned error.
+//
+// WithAppendQuery and [WithSetQuery] can be given multiple times. The functions are applied in the order given.
+//
+// See also [StaticQuery] and [InterpolatedQuery].
+func WithAppendQuery(f QueryFunc) ProcessorOpt {
+	return func(p *processorOptions) {
+		p.queryModifiers = append(p.queryModifiers, queryModifier{f: f})
+	}
+}
+
+// WithSetQuery works like [WithAppendQuery], but removes existing parameters with the same names from the URL.
+func WithSetQuery(f QueryFunc) ProcessorOpt {
+	return func(p *processorOptions) {
+		p.queryModifiers = append(p.queryModifiers, queryModifier{f: f, set: true})
+	}
+}
+
+// AppendQuery returns urlStr with the given parameters appended to the query.
+//
+// Only the query of urlStr is modified. The remaining URL, including any fragment, is returned as is.
+func AppendQuery(urlStr string, values url.Values) string {
+	if len(values) == 0 {
+		return urlStr
+	}
+
+	base, query, fragment := splitQuery(urlStr)
+
+	if query != "" {
+		query += "&"
+	}
+
+	return joinQuery(base, query+values.Encode(), fragment)
+}
+
+// SetQuery returns urlStr with the given parameters added to the query, replacing existing parameters with the same
+// names.
+//
+// Only the query of urlStr is modified. The remaining URL, including any fragment, is returned as is.
+func SetQuery(urlStr string, values url.Values) string {
+	if len(values) == 0 {
+		return urlStr
+	}
+
+	base, query, fragment := splitQuery(urlStr)
+
+	var kept []string
+
+	for part := range strings.SplitSeq(query, "&") {
+		if part == "" {
+			continue
+		}
+
+		name, _, _ := strings.Cut(part, "=")
+
+		if name, err := url.QueryUnescape(name); err == nil && values.Has(name) {
+			continue
+		}
+
+		kept = append(kept, part)
+	}
+
+	kept = append(kept, values.Encode())
+
+	return joinQuery(base, strings.Join(kept, "&"), fragment)
+}
+
+// InterpolatedQuery returns a [QueryFunc] that returns the given parameters with variables in their values replaced
+// using f.
+//
+// This can be used to add parameters based on variables, for example to add the preferred language as parameter:
+//
+//	esiproc.WithAppendQuery(esiproc.InterpolatedQuery(url.Values{
+//		"locale": {"$(HTTP_ACCEPT_LANGUAGE{best})"},
+//	}, env.Interpolate))
+//
+// Parameters for which the interpolated value is empty are omitted.
+//
+// Since the values are encoded when adding them to the URL, f should not escape values itself.
+func InterpolatedQuery(values url.Values, f InterpolateFunc) QueryFunc {
+	return func(ctx context.Context, _ string) (url.Values, error) {
+		result := make(url.Values, len(values))
+
+		for name, vs := range values {
+			for _, v := range vs {
+				v, err := f(ctx, v)
+				if err != nil {
+					return nil, err
+				}
+
+				if v != "" {
+					result.Add(name, v)
+				}
+			}
+		}
+
+		return result, nil
+	}
+}
+
+// StaticQuery returns a [QueryFunc] that always returns the given parameters.
+func StaticQuery(values url.Values) QueryFunc {
+	return func(context.Context, string) (url.Values, error) {
+		return values, nil
+	}
+}
+
+func (p *Processor) modifyQuery(ctx context.Context, urlStr string) (string, error) {
+	for _, m := range p.opts.queryModifiers {
+		values, err := m.f(ctx, urlStr)
+		if err != nil {
+			return "", err
+		}
+
+		if m.set {
+			urlStr = SetQuery(urlStr, values)
+		} else {
+			urlStr = AppendQuery(urlStr, values)
+		}
+	}
+
+	return urlStr, nil
+}
+
+func joinQuery(base, query, fragment string) string {
+	urlStr := base + "?" + query
+
+	if fragment != "" {
+		urlStr += "#" + fragment
+	}
+
+	return urlStr
+}
+
+func splitQuery(urlStr string) (base, query, fragment string) {
+	urlStr, fragment, _ = strings.Cut(urlStr, "#")
+	base, query, _ = strings.Cut(urlStr, "?")
+	return base, query, fragment
+}
@@ -0,0 +1,130 @@
+package esiproc_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/nussjustin/esi"
+	"github.com/nussjustin/esi/esiproc"
+)
+
+func TestAppendQuery(t *testing.T) {
+	values := url.Values{"a": {"1 2"}, "b": {"x&y"}}
+
+	testCases := []struct {
+		URL      string
+		Values   url.Values
+		Expected string
+	}{
+		{URL: "/path", Values: nil, Expected: "/path"},
+		{URL: "/path", Values: values, Expected: "/path?a=1+2&b=x%26y"},
+		{URL: "/path?", Values: values, Expected: "/path?a=1+2&b=x%26y"},
+		{URL: "/path?a=0", Values: values, Expected: "/path?a=0&a=1+2&b=x%26y"},
+		{URL: "/path?c=3#frag", Values: values, Expected: "/path?c=3&a=1+2&b=x%26y#frag"},
+		{URL: "https://example.com", Values: values, Expected: "https://example.com?a=1+2&b=x%26y"},
+	}
+
+	for _, testCase := range testCases {
+		if got := esiproc.AppendQuery(testCase.URL, testCase.Values); got != testCase.Expected {
+			t.Errorf("AppendQuery(%q) = %q, want %q", testCase.URL, got, testCase.Expected)
+		}
+	}
+}
+
+func TestSetQuery(t *testing.T) {
+	values := url.Values{"a": {"1"}, "b c": {"2"}}
+
+	testCases := []struct {
+		URL      string
+		Values   url.Values
+		Expected string
+	}{
+		{URL: "/path?a=0", Values: nil, Expected: "/path?a=0"},
+		{URL: "/path", Values: values, Expected: "/path?a=1&b+c=2"},
+		{URL: "/path?a=0&x=%zz&a&b%20c=0", Values: values, Expected: "/path?x=%zz&a=1&b+c=2"},
+		{URL: "/path?aa=0&&x=1#a=0", Values: values, Expected: "/path?aa=0&x=1&a=1&b+c=2#a=0"},
+	}
+
+	for _, testCase := range testCases {
+		if got := esiproc.SetQuery(testCase.URL, testCase.Values); got != testCase.Expected {
+			t.Errorf("SetQuery(%q) = %q, want %q", testCase.URL, got, testCase.Expected)
+		}
+	}
+}
+
+func TestProcessor_WithQuery(t *testing.T) {
+	var mu sync.Mutex
+	var requested []string
+
+	client := esiproc.ClientFunc(func(_ context.Context, urlStr string, _ map[string]string) ([]byte, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		requested = append(requested, urlStr)
+		return nil, nil
+	})
+
+	interpolate := func(_ context.Context, s string) (string, error) {
+		r := strings.NewReplacer("$(LANG)", "de&en", "$(EMPTY)", "")
+		return r.Replace(s), nil
+	}
+
+	p := esiproc.New(
+		esiproc.WithClient(client),
+		esiproc.WithInterpolateFunc(interpolate),
+		esiproc.WithInjectionGuard(),
+		esiproc.WithSetQuery(esiproc.StaticQuery(url.Values{"v": {"2"}})),
+		esiproc.WithAppendQuery(esiproc.InterpolatedQuery(url.Values{
+			"empty":  {"$(EMPTY)"},
+			"locale": {"$(LANG)"},
+		}, interpolate)))
+
+	nodes := esi.Seq(
+		&esi.IncludeElement{Source: "/a?v=1&lang=$(LANG)"},
+		&esi.IncludeElement{Source: "/b#top"},
+	)
+
+	if _, err := p.Process(t.Context(), io.Discard, nodes); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	want := []string{
+		"/a?lang=de&en&v=2&locale=de%26en",
+		"/b?v=2&locale=de%26en#top",
+	}
+
+	slices.Sort(requested)
+
+	if diff := cmp.Diff(want, requested); diff != "" {
+		t.Errorf("requested URLs mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestProcessor_WithQuery_Error(t *testing.T) {
+	errQuery := errors.New("query error")
+
+	client := esiproc.ClientFunc(func(context.Context, string, map[string]string) ([]byte, error) {
+		t.Error("client called")
+		return nil, nil
+	})
+
+	p := esiproc.New(
+		esiproc.WithClient(client),
+		esiproc.WithAppendQuery(func(context.Context, string) (url.Values, error) {
+			return nil, errQuery
+		}))
+
+	nodes := esi.Seq(&esi.IncludeElement{Source: "/a"})
+
+	if _, err := p.Process(t.Context(), io.Discard, nodes); !errors.Is(err, errQuery) {
+		t.Errorf("got error %v, want %v", err, errQuery)
+	}
+}
@@ -0,0 +1,118 @@
+package esiproc
+
+import (
+	"context"
+	"io"
+	"iter"
+	"sync/atomic"
+
+	"github.com/nussjustin/esi"
+)
+
+type fetchCountKey struct{}
+
+// Result contains information about a call to [Processor.ProcessResult].
+type Result struct {
+	// Written is the number of bytes written.
+	Written int
+
+	// Fetched is the number of calls made to the [Client].
+	//
+	// This includes calls for alt URLs and for includes inside esi:attempt elements whose results were discarded, but
+	// not includes that were skipped, for example because of [WithMaxIncludes] or [WithMinIncludeBudget].
+	Fetched int
+
+	// Includes contains information about each esi:include element that is part of the output, in output order.
+	Includes []IncludeEnd
+
+	// Branches contains the branches selected for each esi:choose element that is part of the output, in output
+	// order.
+	Branches []BranchTaken
+
+	// FailedAttempts contains information about each esi:try element that is part of the output and for which the
+	// content of the esi:except element was used, in output order.
+	FailedAttempts []AttemptFailed
+}
+
+// CacheHits returns the number of includes in r.Includes for which the [Client] reported a cache hit.
+func (r *Result) CacheHits() int {
+	var n int
+
+	for _, inc := range r.Includes {
+		if inc.CacheHit {
+			n++
+		}
+	}
+
+	return n
+}
+
+// Degraded returns an iterator over all includes that did not succeed on the first try, that is all includes in
+// r.Includes whose Outcome is not [IncludeOutcomeSuccess], followed by the failed includes in r.FailedAttempts.
+//
+// This can be used to detect responses that are missing content or use fallback content, even though the processing
+// itself succeeded.
+func (r *Result) Degraded() iter.Seq[IncludeEnd] {
+	return func(yield func(IncludeEnd) bool) {
+		for _, inc := range r.Includes {
+			if inc.Outcome != IncludeOutcomeSuccess && !yield(inc) {
+				return
+			}
+		}
+
+		for _, failed := range r.FailedAttempts {
+			if failed.Include != nil && !yield(*failed.Include) {
+				return
+			}
+		}
+	}
+}
+
+// Suppressed returns an iterator over all includes in r.Includes that failed, but whose error was ignored because of
+// onerror="continue".
+func (r *Result) Suppressed() iter.Seq[IncludeEnd] {
+	return func(yield func(IncludeEnd) bool) {
+		for _, inc := range r.Includes {
+			if inc.Suppressed != nil && !yield(inc) {
+				return
+			}
+		}
+	}
+}
+
+// ProcessResult processes the given data like [Processor.Process] and returns information about the processing.
+//
+// The result is returned even if an error occurred, in which case it contains the information collected up to the
+// error.
+//
+// This can be used instead of [Processor.Events] when only a summary of the processing is needed.
+func (p *Processor) ProcessResult(
+	ctx context.Context,
+	w io.Writer,
+	nodes iter.Seq2[esi.Node, error],
+) (Result, error) {
+	var fetched atomic.Int64
+
+	ctx = context.WithValue(ctx, fetchCountKey{}, &fetched)
+
+	var res Result
+
+	n, err := p.process(ctx, w, nodes, &res)
+
+	res.Written = n
+	res.Fetched = int(fetched.Load())
+
+	return res, err
+}
+
+// ReportCacheHit can be called by a [Client] to report that the data for the include for which it was called was
+// served from a cache.
+//
+// Cache hits are reported via [IncludeEnd.CacheHit] and [Result.CacheHits].
+//
+// If ctx does not belong to an include, ReportCacheHit does nothing.
+func ReportCacheHit(ctx context.Context) {
+	if inc, _ := ctx.Value(includeKey{}).(*include); inc != nil {
+		inc.cacheHit.Store(true)
+	}
+}
@@ -0,0 +1,149 @@
+package esiproc_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/nussjustin/esi"
+	"github.com/nussjustin/esi/esiproc"
+)
+
+func TestProcessor_ProcessResult(t *testing.T) {
+	const input = `<esi:include src="/cached"/>` +
+		`<esi:choose><esi:when test="true"><esi:include src="/error" onerror="continue"/></esi:when></esi:choose>` +
+		`<esi:try><esi:attempt><esi:include src="/error"/></esi:attempt>` +
+		`<esi:except><esi:include src="/error" alt="/alt"/></esi:except></esi:try>`
+
+	errFetch := errors.New("fetch failed")
+
+	// Each call to the clock advances the time by one second
+	var ticks atomic.Int64
+
+	now := func() time.Time {
+		return time.Unix(ticks.Add(1), 0)
+	}
+
+	client := esiproc.ClientFunc(func(ctx context.Context, urlStr string, _ map[string]string) ([]byte, error) {
+		switch urlStr {
+		case "/cached":
+			esiproc.ReportCacheHit(ctx)
+		case "/error":
+			return nil, errFetch
+		}
+
+		return []byte(urlStr), nil
+	})
+
+	p := esiproc.New(
+		esiproc.WithClient(client),
+		esiproc.WithClock(now),
+		esiproc.WithEvalFunc(testEnv{}.Eval))
+
+	var buf bytes.Buffer
+
+	res, err := p.ProcessResult(t.Context(), &buf, esi.NewParser(strings.NewReader(input)).All)
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	if got, want := buf.String(), "/cached/alt"; got != want {
+		t.Errorf("got output %q, want %q", got, want)
+	}
+
+	if got, want := res.Written, buf.Len(); got != want {
+		t.Errorf("got %d bytes written, want %d", got, want)
+	}
+
+	// /cached, /error (continue), /error (attempt), /error and /alt (except)
+	if got, want := res.Fetched, 5; got != want {
+		t.Errorf("got %d fetched includes, want %d", got, want)
+	}
+
+	var sources []string
+
+	for _, inc := range res.Includes {
+		sources = append(sources, inc.Element.Source)
+
+		// Concurrent includes may advance the clock between the start and end of an include
+		if inc.Duration < time.Second {
+			t.Errorf("got duration %s for %s, want at least %s", inc.Duration, inc.Element.Source, time.Second)
+		}
+	}
+
+	if diff := cmp.Diff([]string{"/cached", "/error", "/error"}, sources); diff != "" {
+		t.Errorf("includes mismatch (-want +got):\n%s", diff)
+	}
+
+	if got, want := res.CacheHits(), 1; got != want {
+		t.Errorf("got %d cache hits, want %d", got, want)
+	}
+
+	suppressed := slices.Collect(res.Suppressed())
+
+	if len(suppressed) != 1 || !errors.Is(suppressed[0].Suppressed, errFetch) {
+		t.Errorf("got suppressed includes %v, want one include with error %v", suppressed, errFetch)
+	}
+
+	if len(res.Branches) != 1 || res.Branches[0].Branch.Name().Local != "when" {
+		t.Errorf("got branches %v, want one esi:when branch", res.Branches)
+	}
+
+	if len(res.FailedAttempts) != 1 || !errors.Is(res.FailedAttempts[0].Err, errFetch) {
+		t.Errorf("got failed attempts %v, want one attempt with error %v", res.FailedAttempts, errFetch)
+	}
+
+	var outcomes []esiproc.IncludeOutcome
+
+	for inc := range res.Degraded() {
+		outcomes = append(outcomes, inc.Outcome)
+	}
+
+	wantOutcomes := []esiproc.IncludeOutcome{
+		esiproc.IncludeOutcomeSuppressed,
+		esiproc.IncludeOutcomeAlt,
+		esiproc.IncludeOutcomeCaught,
+	}
+
+	if diff := cmp.Diff(wantOutcomes, outcomes); diff != "" {
+		t.Errorf("degraded includes mismatch (-want +got):\n%s", diff)
+	}
+
+	if got := res.Includes[2].SourceError; !errors.Is(got, errFetch) {
+		t.Errorf("got source error %v for alt include, want %v", got, errFetch)
+	}
+}
+
+func TestProcessor_ProcessResult_Error(t *testing.T) {
+	errFetch := errors.New("fetch failed")
+
+	client := esiproc.ClientFunc(func(_ context.Context, urlStr string, _ map[string]string) ([]byte, error) {
+		if urlStr == "/error" {
+			return nil, errFetch
+		}
+
+		return []byte(urlStr), nil
+	})
+
+	p := esiproc.New(esiproc.WithClient(client))
+
+	input := `<esi:include src="/a"/><esi:include src="/error"/>`
+
+	var buf bytes.Buffer
+
+	res, err := p.ProcessResult(t.Context(), &buf, esi.NewParser(strings.NewReader(input)).All)
+	if !errors.Is(err, errFetch) {
+		t.Errorf("got error %v, want %v", err, errFetch)
+	}
+
+	if res.Written != 2 || len(res.Includes) != 1 || res.Fetched != 2 {
+		t.Errorf("got result %+v, want 2 bytes written, 1 include and 2 fetches", res)
+	}
+}
@@ -0,0 +1,126 @@
+package esiproc
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// semaphore limits the number of concurrent calls to the [Client].
+//
+// Unlike a buffered channel, waiters are woken in order of priority. Includes that are not optional are always
+// preferred over optional includes (see [WithOptionalIncludes]) and waiting includes with the same priority are
+// started in the order in which they were found in the input.
+type semaphore struct {
+	mu      sync.Mutex
+	closed  bool
+	n       int
+	limit   int
+	waiters []*semaphoreWaiter
+
+	seq atomic.Uint64
+}
+
+type semaphoreWaiter struct {
+	optional bool
+	seq      uint64
+	ready    chan struct{}
+}
+
+func newSemaphore(limit int) *semaphore {
+	return &semaphore{limit: limit}
+}
+
+// acquire waits until a slot is available or ctx is done.
+//
+// The given sequence number should be obtained via next before starting any asynchronous work, so that the order
+// matches the order of the includes in the input.
+//
+// If the semaphore was closed, acquire returns a [*ClosedError].
+func (s *semaphore) acquire(ctx context.Context, optional bool, seq uint64) error {
+	s.mu.Lock()
+
+	if s.closed {
+		s.mu.Unlock()
+		return &ClosedError{}
+	}
+
+	if s.n < s.limit && len(s.waiters) == 0 {
+		s.n++
+		s.mu.Unlock()
+		return nil
+	}
+
+	w := &semaphoreWaiter{optional: optional, seq: seq, ready: make(chan struct{})}
+
+	i, _ := slices.BinarySearchFunc(s.waiters, w, compareWaiters)
+	s.waiters = slices.Insert(s.waiters, i, w)
+
+	s.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		// The slot was handed over after the context was done, so it must be passed on.
+		s.releaseLocked()
+	default:
+		s.waiters = slices.DeleteFunc(s.waiters, func(o *semaphoreWaiter) bool { return o == w })
+	}
+
+	return ctx.Err()
+}
+
+// close closes the semaphore, causing all future calls to acquire to fail.
+func (s *semaphore) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+}
+
+// next returns the next sequence number for use with acquire.
+func (s *semaphore) next() uint64 {
+	return s.seq.Add(1)
+}
+
+// release releases a slot acquired using acquire.
+func (s *semaphore) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.releaseLocked()
+}
+
+func (s *semaphore) releaseLocked() {
+	if len(s.waiters) == 0 {
+		s.n--
+		return
+	}
+
+	w := s.waiters[0]
+	s.waiters = slices.Delete(s.waiters, 0, 1)
+
+	// The slot is handed over to the waiter, so n stays the same.
+	close(w.ready)
+}
+
+func compareWaiters(a, b *semaphoreWaiter) int {
+	switch {
+	case a.optional == b.optional:
+		return cmp.Compare(a.seq, b.seq)
+	case b.optional:
+		return -1
+	default:
+		return 1
+	}
+}
@@ -0,0 +1,135 @@
+package esiproc
+
+import (
+	"context"
+	"sync"
+
+	"github.com/nussjustin/esi/esiexpr/ast"
+)
+
+// VarIncludeStatus is the name of the variable containing the status codes of named includes.
+//
+// See [IncludeStatusVars].
+const VarIncludeStatus = "INCLUDE_STATUS"
+
+type includeRegistryKey struct{}
+
+// includeRegistry contains the results of all named includes for a single call to [Processor.Events].
+type includeRegistry struct {
+	mu     sync.Mutex
+	byName map[string]*include
+}
+
+func (r *includeRegistry) add(name string, inc *include) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.byName == nil {
+		r.byName = make(map[string]*include)
+	}
+
+	r.byName[name] = inc
+}
+
+func (r *includeRegistry) get(name string) *include {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.byName[name]
+}
+
+// IncludeStatus returns the status code reported for the esi:include element with the given name attribute (see
+// [esi.IncludeElement.FragmentName]) that was processed so far using ctx.
+//
+// If the include is not finished yet, IncludeStatus waits for it to finish.
+//
+// If there is no such include or no status code was reported for it, ok is false.
+//
+// See [ReportStatus] for how status codes are reported.
+func IncludeStatus(ctx context.Context, name string) (status int, ok bool, err error) {
+	inc := namedInclude(ctx, name)
+	if inc == nil {
+		return 0, false, nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return 0, false, ctx.Err()
+	case <-inc.done:
+	}
+
+	status = int(inc.status.Load())
+	return status, status != 0, nil
+}
+
+// IncludeStatusVars returns a function for use as [github.com/nussjustin/esi/esiexpr.Env.LookupVar] that handles
+// the variable [VarIncludeStatus] and calls lookup for all other variables.
+//
+// The variable must be used with the name of an include as key. For example, given the element
+//
+//	<esi:include src="/recommendations" name="recs" onerror="continue"/>
+//
+// the variable $(INCLUDE_STATUS{recs}) contains the status code of the response for the include, which can be used
+// to show alternative content when the include failed. See [IncludeStatus] for details.
+//
+// Without a key or if there is no status code for the include, the value is nil.
+//
+// If lookup is nil, the value of all other variables is nil.
+func IncludeStatusVars(
+	lookup func(ctx context.Context, name string, key *string) (ast.Value, error),
+) func(ctx context.Context, name string, key *string) (ast.Value, error) {
+	return func(ctx context.Context, name string, key *string) (ast.Value, error) {
+		if name != VarIncludeStatus {
+			if lookup == nil {
+				return nil, nil
+			}
+
+			return lookup(ctx, name, key)
+		}
+
+		if key == nil {
+			return nil, nil
+		}
+
+		status, ok, err := IncludeStatus(ctx, *key)
+		if err != nil || !ok {
+			return nil, err
+		}
+
+		return status, nil
+	}
+}
+
+// ReportStatus can be called by a [Client] to report the status code of the response for the include for which it
+// was called.
+//
+// If the alt URL of an include is used, the status code for the alt URL replaces the status code for the src URL.
+//
+// Status codes are reported via [IncludeEnd.Status] and the [VarIncludeStatus] variable.
+//
+// If ctx does not belong to an include, ReportStatus does nothing.
+func ReportStatus(ctx context.Context, status int) {
+	if inc, _ := ctx.Value(includeKey{}).(*include); inc != nil {
+		inc.status.Store(int32(status)) //nolint:gosec
+	}
+}
+
+// namedInclude returns the include with the given name from the include registry associated with ctx, if any.
+func namedInclude(ctx context.Context, name string) *include {
+	r, _ := ctx.Value(includeRegistryKey{}).(*includeRegistry)
+	if r == nil || name == "" {
+		return nil
+	}
+
+	return r.get(name)
+}
+
+// registerInclude adds inc to the include registry associated with ctx, if the element has a name.
+func registerInclude(ctx context.Context, inc *include) {
+	r, _ := ctx.Value(includeRegistryKey{}).(*includeRegistry)
+	if r == nil || inc.ele.FragmentName == "" {
+		return
+	}
+
+	r.add(inc.ele.FragmentName, inc)
+}
@@ -0,0 +1,158 @@
+package esiproc_test
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/nussjustin/esi"
+	"github.com/nussjustin/esi/esiexpr"
+	"github.com/nussjustin/esi/esiexpr/ast"
+	"github.com/nussjustin/esi/esiproc"
+)
+
+func TestIncludeStatusVars(t *testing.T) {
+	const input = `<esi:include src="/missing" name="a" onerror="continue"/>` +
+		`<esi:include src="/slow" name="b"/>` +
+		`<esi:choose>` +
+		`<esi:when test="$(INCLUDE_STATUS{a})==404">a missing</esi:when>` +
+		`</esi:choose>` +
+		`<esi:vars>[$(INCLUDE_STATUS{b})][$(INCLUDE_STATUS{c})][$(INCLUDE_STATUS)][$(OTHER)]</esi:vars>`
+
+	// lookedUp is closed when the status of b is looked up.
+	lookedUp := make(chan struct{})
+
+	client := esiproc.ClientFunc(func(ctx context.Context, urlStr string, _ map[string]string) ([]byte, error) {
+		switch urlStr {
+		case "/missing":
+			esiproc.ReportStatus(ctx, http.StatusNotFound)
+			return nil, errors.New("not found")
+		case "/slow":
+			// Ensure that the variable is looked up before the include is finished
+			select {
+			case <-lookedUp:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		esiproc.ReportStatus(ctx, http.StatusOK)
+		return []byte(urlStr), nil
+	})
+
+	env := &esiexpr.Env{
+		CompareValues: func(a, b ast.Value) (int, error) {
+			return cmp.Compare(a.(int), b.(int)), nil
+		},
+	}
+
+	lookupVar := esiproc.IncludeStatusVars(func(context.Context, string, *string) (ast.Value, error) {
+		return "other", nil
+	})
+
+	env.LookupVar = func(ctx context.Context, name string, key *string) (ast.Value, error) {
+		if name == esiproc.VarIncludeStatus && key != nil && *key == "b" {
+			close(lookedUp)
+		}
+
+		return lookupVar(ctx, name, key)
+	}
+
+	p := esiproc.New(
+		esiproc.WithClient(client),
+		esiproc.WithClientConcurrency(2),
+		esiproc.WithEvalFunc(env.Eval),
+		esiproc.WithInterpolateFunc(env.Interpolate))
+
+	var buf bytes.Buffer
+
+	res, err := p.ProcessResult(t.Context(), &buf, esi.NewParser(strings.NewReader(input)).All)
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	if got, want := buf.String(), "/slowa missing[200][][][other]"; got != want {
+		t.Errorf("got output %q, want %q", got, want)
+	}
+
+	var statuses []int
+
+	for _, inc := range res.Includes {
+		statuses = append(statuses, inc.Status)
+	}
+
+	if len(statuses) != 2 || statuses[0] != http.StatusNotFound || statuses[1] != http.StatusOK {
+		t.Errorf("got statuses %v, want [404 200]", statuses)
+	}
+}
+
+func TestIncludeStatus_NoProcessor(t *testing.T) {
+	status, ok, err := esiproc.IncludeStatus(t.Context(), "a")
+	if status != 0 || ok || err != nil {
+		t.Errorf("got (%d, %t, %v), want (0, false, nil)", status, ok, err)
+	}
+
+	// Must not panic
+	esiproc.ReportStatus(t.Context(), http.StatusOK)
+}
+
+func TestProcessor_NamedIncludes(t *testing.T) {
+	errFetch := errors.New("fetch failed")
+
+	client := esiproc.ClientFunc(func(_ context.Context, urlStr string, _ map[string]string) ([]byte, error) {
+		if urlStr == "/error" {
+			return nil, errFetch
+		}
+
+		return []byte(urlStr), nil
+	})
+
+	p := esiproc.New(esiproc.WithClient(client), esiproc.WithClientConcurrency(4))
+
+	const input = `<esi:include src="/nav" name="nav"/>|<esi:include src="/other" name="nav"/>|` +
+		`<esi:include src="/error" name="err" onerror="continue"/>|` +
+		`<esi:include src="/other" name="err" onerror="continue"/>|` +
+		`<esi:include src="/other" name="other"/>`
+
+	var buf bytes.Buffer
+
+	res, err := p.ProcessResult(t.Context(), &buf, esi.NewParser(strings.NewReader(input)).All)
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	if got, want := buf.String(), "/nav|/nav|||/other"; got != want {
+		t.Errorf("got output %q, want %q", got, want)
+	}
+
+	if got, want := res.Fetched, 3; got != want {
+		t.Errorf("got %d fetched includes, want %d", got, want)
+	}
+
+	var reused []bool
+
+	for _, inc := range res.Includes {
+		reused = append(reused, inc.Reused)
+	}
+
+	if want := []bool{false, true, false, true, false}; !slices.Equal(reused, want) {
+		t.Errorf("got reused %v, want %v", reused, want)
+	}
+
+	if got := res.Includes[3]; got.Outcome != esiproc.IncludeOutcomeSuppressed || !errors.Is(got.Suppressed, errFetch) {
+		t.Errorf("got outcome %s with error %v for reused include, want %s with error %v",
+			got.Outcome, got.Suppressed, esiproc.IncludeOutcomeSuppressed, errFetch)
+	}
+
+	// Without onerror="continue" the error of the earlier include is returned
+	_, err = p.Process(t.Context(), &buf, esi.NewParser(strings.NewReader(
+		`<esi:include src="/error" name="err" onerror="continue"/><esi:include src="/other" name="err"/>`)).All)
+	if !errors.Is(err, errFetch) {
+		t.Errorf("got error %v, want %v", err, errFetch)
+	}
+}
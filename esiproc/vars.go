@@ -0,0 +1,153 @@
+package esiproc
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nussjustin/esi"
+)
+
+// VarsNesting defines how a [Processor] handles ESI elements inside esi:vars elements.
+//
+// See [WithVarsNesting].
+type VarsNesting uint8
+
+const (
+	// VarsNestingProcess processes ESI elements inside esi:vars elements like any other elements.
+	//
+	// Literal text inside nested elements, for example inside the selected esi:when element of an esi:choose element,
+	// is interpolated like all other text inside the esi:vars element. Data fetched by esi:include elements is never
+	// interpolated.
+	//
+	// This is the default.
+	VarsNestingProcess VarsNesting = iota
+
+	// VarsNestingLiteral processes ESI elements inside esi:vars elements, but only interpolates literal text that is
+	// a direct child of an esi:vars element.
+	//
+	// Literal text inside nested elements, for example inside an esi:when element, is written as is, unless it is
+	// itself inside a nested esi:vars element.
+	VarsNestingLiteral
+
+	// VarsNestingReject rejects ESI elements inside esi:vars elements with an [*UnexpectedElementError].
+	//
+	// This only allows literal text inside esi:vars elements, as described by the specification.
+	VarsNestingReject
+)
+
+// MarshalText implements the [encoding.TextMarshaler] interface.
+//
+// The policies are encoded as "process", "literal" and "reject".
+func (v VarsNesting) MarshalText() ([]byte, error) {
+	for name, nesting := range varsNestingNames {
+		if nesting == v {
+			return []byte(name), nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown vars nesting policy %d", v)
+}
+
+// String returns the name of the policy.
+func (v VarsNesting) String() string {
+	switch v {
+	case VarsNestingProcess:
+		return "VarsNestingProcess"
+	case VarsNestingLiteral:
+		return "VarsNestingLiteral"
+	case VarsNestingReject:
+		return "VarsNestingReject"
+	default:
+		panic("unknown vars nesting policy")
+	}
+}
+
+// UnmarshalText implements the [encoding.TextUnmarshaler] interface.
+//
+// See [VarsNesting.MarshalText] for the supported names.
+func (v *VarsNesting) UnmarshalText(text []byte) error {
+	nesting, ok := varsNestingNames[string(text)]
+	if !ok {
+		return fmt.Errorf("unknown vars nesting policy %q", text)
+	}
+
+	*v = nesting
+	return nil
+}
+
+var varsNestingNames = map[string]VarsNesting{
+	"process": VarsNestingProcess,
+	"literal": VarsNestingLiteral,
+	"reject":  VarsNestingReject,
+}
+
+// WithVarsNesting configures how a [Processor] handles ESI elements inside esi:vars elements.
+//
+// esi:vars elements inside the branches of esi:choose elements or inside esi:attempt and esi:except elements are
+// always processed, independent of this option.
+//
+// The default is [VarsNestingProcess].
+func WithVarsNesting(v VarsNesting) ProcessorOpt {
+	return func(p *processorOptions) {
+		p.varsNesting = v
+	}
+}
+
+// WithVarsInterpolateFunc specifies the function used to interpolate variables in the content of <esi:vars> elements.
+//
+// Since the content of esi:vars elements is usually HTML, while the src attribute of esi:include elements is a URL,
+// the values of variables must be escaped differently. For example, when using an
+// [github.com/nussjustin/esi/esiexpr.Env], the function can be the Interpolate method of a copy of the Env used for
+// [WithInterpolateFunc] that uses [github.com/nussjustin/esi/esiexpr.EscapingHTML].
+//
+// If not given or if the last given function is nil, the function given to [WithInterpolateFunc] is used.
+func WithVarsInterpolateFunc(f InterpolateFunc) ProcessorOpt {
+	return func(p *processorOptions) {
+		p.varsInterpolate = f
+	}
+}
+
+// varsInterpolateFunc returns the function used to interpolate the content of esi:vars elements or nil.
+func (p *Processor) varsInterpolateFunc() InterpolateFunc {
+	if p.opts.varsInterpolate != nil {
+		return p.opts.varsInterpolate
+	}
+
+	return p.opts.interpolateFunc
+}
+
+// interpolateData returns true if literal text that is processed for ctx must be interpolated.
+func (p *Processor) interpolateData(ctx context.Context) bool {
+	c, _ := ctx.Value(elementsKey{}).(*elementChain)
+
+	for ; c != nil; c = c.parent {
+		if _, ok := c.ele.(*esi.VarsElement); ok {
+			return true
+		}
+
+		if p.opts.varsNesting == VarsNestingLiteral {
+			return false
+		}
+	}
+
+	return false
+}
+
+// rejectInVars returns true if the given element must be rejected, because it is nested inside an esi:vars element.
+//
+// ctx must not yet contain ele.
+func (p *Processor) rejectInVars(ctx context.Context) bool {
+	if p.opts.varsNesting != VarsNestingReject {
+		return false
+	}
+
+	c, _ := ctx.Value(elementsKey{}).(*elementChain)
+
+	for ; c != nil; c = c.parent {
+		if _, ok := c.ele.(*esi.VarsElement); ok {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,226 @@
+package esiproc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// errInvalidWrite is returned when a writer returns an invalid count.
+var errInvalidWrite = errors.New("invalid write result")
+
+// WithWriteTimeout configures a [Processor] to fail if a single write to, or flush of, the [io.Writer] given to
+// [Processor.Process] or [Processor.ProcessReader] does not finish within d.
+//
+// If the writer has a SetWriteDeadline method, like [net.Conn] and the [net/http.ResponseWriter] of the HTTP server,
+// a deadline is set before each write and cleared afterward. Note that this also clears any deadline set before,
+// for example from [net/http.Server.WriteTimeout].
+//
+// For other writers, each write is started in a separate goroutine with a copy of the data. If the write does not
+// finish in time, processing fails and the write is left running in the background. No further calls are made to the
+// writer in this case.
+//
+// If a write does not finish in time, a [*WriteError] wrapping [os.ErrDeadlineExceeded] is returned. For writers
+// with a SetWriteDeadline method, the error is returned by the writer and usually wraps [os.ErrDeadlineExceeded] as
+// well.
+//
+// If d is 0, writes can block indefinitely. This is the default.
+//
+// If d is < 0, WithWriteTimeout panics.
+func WithWriteTimeout(d time.Duration) ProcessorOpt {
+	if d < 0 {
+		panic("WithWriteTimeout called with d < 0")
+	}
+
+	return func(p *processorOptions) {
+		p.writeTimeout = d
+	}
+}
+
+// WriteOutput writes data to w as is, for example output that was processed before and cached.
+//
+// Writes are handled as for [Processor.Process]: short writes are retried, the timeout configured using
+// [WithWriteTimeout] is enforced and, if [WithFlush] is used, w is flushed afterward. Errors returned by w are wrapped
+// in a [*WriteError].
+//
+// If the processor was closed, a [*ClosedError] is returned.
+func (p *Processor) WriteOutput(ctx context.Context, w io.Writer, data []byte) (int, error) {
+	if !p.life.acquire() {
+		return 0, &ClosedError{}
+	}
+
+	defer p.life.release()
+
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	ow := p.newOutputWriter(w)
+
+	n, err := ow.Write(data)
+	if err != nil {
+		return n, &WriteError{Err: err}
+	}
+
+	if p.opts.flush {
+		if flush := ow.flusher(flusherFor(w)); flush != nil {
+			if err := flush(); err != nil {
+				return n, &WriteError{Err: err}
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// writeDeadliner is implemented by writers that support write deadlines.
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+// outputWriter wraps the [io.Writer] given to [Processor.Process] and [Processor.ProcessReader].
+//
+// It retries short writes until all data is written and enforces the timeout configured using [WithWriteTimeout].
+type outputWriter struct {
+	w       io.Writer
+	timeout time.Duration
+
+	// deadliner is w, if w supports write deadlines.
+	deadliner writeDeadliner
+
+	// timedOut is true if a write or flush without deadline did not finish in time and may still be running.
+	timedOut bool
+}
+
+// newOutputWriter returns an outputWriter for w.
+func (p *Processor) newOutputWriter(w io.Writer) outputWriter {
+	o := outputWriter{w: w, timeout: p.opts.writeTimeout}
+
+	if d, ok := w.(writeDeadliner); ok && o.timeout > 0 {
+		// Clearing the deadline fails if the writer does not actually support deadlines, for example for an
+		// [*os.File] that is not backed by a pipe or socket.
+		if err := d.SetWriteDeadline(time.Time{}); err == nil {
+			o.deadliner = d
+		}
+	}
+
+	return o
+}
+
+// Write writes all of data to the underlying writer.
+//
+// If the writer returns a short write without an error, the remaining data is written using further calls to Write.
+// If a call makes no progress, [io.ErrShortWrite] is returned.
+func (o *outputWriter) Write(data []byte) (int, error) {
+	if o.timeout == 0 {
+		return writeFull(o.w, data)
+	}
+
+	if o.deadliner == nil {
+		// The data may be changed once we return, even if the write is still running.
+		data = bytes.Clone(data)
+	}
+
+	w := o.w
+
+	return o.do(func() (int, error) {
+		return writeFull(w, data)
+	})
+}
+
+// flusher returns a function that calls flush with the configured timeout, or nil if flush is nil.
+func (o *outputWriter) flusher(flush func() error) func() error {
+	if flush == nil || o.timeout == 0 {
+		return flush
+	}
+
+	return func() error {
+		_, err := o.do(func() (int, error) {
+			return 0, flush()
+		})
+		return err
+	}
+}
+
+// do calls f and enforces the configured timeout.
+func (o *outputWriter) do(f func() (int, error)) (int, error) {
+	switch {
+	case o.timedOut:
+		return 0, os.ErrDeadlineExceeded
+	case o.timeout == 0:
+		return f()
+	case o.deadliner != nil:
+		if err := o.deadliner.SetWriteDeadline(time.Now().Add(o.timeout)); err != nil {
+			return 0, err
+		}
+
+		n, err := f()
+
+		if clearErr := o.deadliner.SetWriteDeadline(time.Time{}); err == nil {
+			err = clearErr
+		}
+
+		return n, err
+	}
+
+	type result struct {
+		n   int
+		err error
+	}
+
+	// Buffered so that the goroutine can finish even if we already returned.
+	resC := make(chan result, 1)
+
+	go func() {
+		var res result
+
+		defer func() {
+			if v := recover(); v != nil {
+				res = result{err: newPanicError(v)}
+			}
+
+			resC <- res
+		}()
+
+		res.n, res.err = f()
+	}()
+
+	timer := time.NewTimer(o.timeout)
+	defer timer.Stop()
+
+	select {
+	case res := <-resC:
+		return res.n, res.err
+	case <-timer.C:
+		o.timedOut = true
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+// writeFull writes all of data to w, retrying after short writes without an error.
+func writeFull(w io.Writer, data []byte) (int, error) {
+	var written int
+
+	for len(data) > 0 {
+		n, err := w.Write(data)
+		if n < 0 || n > len(data) {
+			return written, errInvalidWrite
+		}
+
+		written += n
+		data = data[n:]
+
+		if err != nil {
+			return written, err
+		}
+
+		if n == 0 {
+			return written, io.ErrShortWrite
+		}
+	}
+
+	return written, nil
+}
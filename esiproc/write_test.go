@@ -0,0 +1,284 @@
+package esiproc_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nussjustin/esi"
+	"github.com/nussjustin/esi/esiproc"
+)
+
+// shortWriter writes at most n bytes per call, without returning an error.
+type shortWriter struct {
+	buf bytes.Buffer
+	n   int
+}
+
+func (s *shortWriter) Write(p []byte) (int, error) {
+	return s.buf.Write(p[:min(len(p), s.n)])
+}
+
+// stuckWriter never makes any progress, without returning an error.
+type stuckWriter struct{}
+
+func (stuckWriter) Write([]byte) (int, error) {
+	return 0, nil
+}
+
+// invalidWriter returns more bytes than given.
+type invalidWriter struct{}
+
+func (invalidWriter) Write(p []byte) (int, error) {
+	return len(p) + 1, nil
+}
+
+// blockingWriter blocks each call to Write until release is closed.
+type blockingWriter struct {
+	release chan struct{}
+}
+
+func (b *blockingWriter) Write(p []byte) (int, error) {
+	<-b.release
+	return len(p), nil
+}
+
+// blockingFlusher blocks each call to Flush until release is closed.
+type blockingFlusher struct {
+	bytes.Buffer
+	release chan struct{}
+}
+
+func (b *blockingFlusher) Flush() {
+	<-b.release
+}
+
+func TestProcessor_ShortWrites(t *testing.T) {
+	const input = `before<esi:include src="/a"/>between<esi:include src="/b"/>after`
+
+	client := esiproc.ClientFunc(func(_ context.Context, urlStr string, _ map[string]string) ([]byte, error) {
+		return []byte("[" + strings.Repeat(urlStr, 10) + "]"), nil
+	})
+
+	want := `before[` + strings.Repeat("/a", 10) + `]between[` + strings.Repeat("/b", 10) + `]after`
+
+	for _, bufferSize := range []int{0, 8, 4096} {
+		p := esiproc.New(esiproc.WithClient(client), esiproc.WithWriteBuffer(bufferSize))
+
+		t.Run(fmt.Sprintf("Process/%d", bufferSize), func(t *testing.T) {
+			w := &shortWriter{n: 3}
+
+			n, err := p.Process(t.Context(), w, esi.NewParser(strings.NewReader(input)).All)
+			if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+
+			if got := w.buf.String(); got != want {
+				t.Errorf("got output %q, want %q", got, want)
+			}
+
+			if n != len(want) {
+				t.Errorf("got %d bytes written, want %d", n, len(want))
+			}
+		})
+
+		t.Run(fmt.Sprintf("ProcessReader/%d", bufferSize), func(t *testing.T) {
+			w := &shortWriter{n: 3}
+
+			n, err := p.ProcessReader(t.Context(), w, strings.NewReader(input))
+			if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+
+			if got := w.buf.String(); got != want {
+				t.Errorf("got output %q, want %q", got, want)
+			}
+
+			if n != len(want) {
+				t.Errorf("got %d bytes written, want %d", n, len(want))
+			}
+		})
+	}
+}
+
+func TestProcessor_InvalidWrites(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Writer io.Writer
+		Error  error
+	}{
+		{Name: "no progress", Writer: stuckWriter{}, Error: io.ErrShortWrite},
+		{Name: "invalid count", Writer: invalidWriter{}},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			p := esiproc.New()
+
+			for name, process := range map[string]func() error{
+				"Process": func() error {
+					_, err := p.Process(t.Context(), testCase.Writer, esi.NewParser(strings.NewReader("data")).All)
+					return err
+				},
+				"ProcessReader": func() error {
+					_, err := p.ProcessReader(t.Context(), testCase.Writer, strings.NewReader("data"))
+					return err
+				},
+			} {
+				err := process()
+
+				var writeErr *esiproc.WriteError
+
+				if !errors.As(err, &writeErr) {
+					t.Fatalf("%s: got error %v, want %T", name, err, writeErr)
+				}
+
+				if testCase.Error != nil && !errors.Is(err, testCase.Error) {
+					t.Errorf("%s: got error %v, want %v", name, err, testCase.Error)
+				}
+			}
+		})
+	}
+}
+
+func TestProcessor_WithWriteTimeout(t *testing.T) {
+	const input = `before<esi:include src="/a"/>after`
+
+	client := esiproc.ClientFunc(func(_ context.Context, urlStr string, _ map[string]string) ([]byte, error) {
+		return []byte(urlStr), nil
+	})
+
+	t.Run("Deadline", func(t *testing.T) {
+		// Writes to a pipe block until the other end reads the data
+		w, r := net.Pipe()
+		defer func() { _ = r.Close() }()
+		defer func() { _ = w.Close() }()
+
+		p := esiproc.New(esiproc.WithClient(client), esiproc.WithWriteTimeout(10*time.Millisecond))
+
+		_, err := p.ProcessReader(t.Context(), w, strings.NewReader(input))
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("got error %v, want %v", err, os.ErrDeadlineExceeded)
+		}
+
+		// The deadline must be cleared after the write
+		go func() { _, _ = io.Copy(io.Discard, r) }()
+
+		if _, err := w.Write([]byte("after")); err != nil {
+			t.Errorf("got error %v after processing, want nil", err)
+		}
+	})
+
+	t.Run("Write", func(t *testing.T) {
+		w := &blockingWriter{release: make(chan struct{})}
+		defer close(w.release)
+
+		p := esiproc.New(esiproc.WithClient(client), esiproc.WithWriteTimeout(10*time.Millisecond))
+
+		_, err := p.Process(t.Context(), w, esi.NewParser(strings.NewReader(input)).All)
+
+		var writeErr *esiproc.WriteError
+
+		if !errors.As(err, &writeErr) || !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("got error %v, want %T wrapping %v", err, writeErr, os.ErrDeadlineExceeded)
+		}
+	})
+
+	t.Run("Flush", func(t *testing.T) {
+		w := &blockingFlusher{release: make(chan struct{})}
+		defer close(w.release)
+
+		p := esiproc.New(esiproc.WithClient(client), esiproc.WithFlush(), esiproc.WithWriteTimeout(10*time.Millisecond))
+
+		_, err := p.ProcessReader(t.Context(), w, strings.NewReader(input))
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("got error %v, want %v", err, os.ErrDeadlineExceeded)
+		}
+	})
+
+	t.Run("No timeout", func(t *testing.T) {
+		var buf bytes.Buffer
+
+		p := esiproc.New(esiproc.WithClient(client), esiproc.WithWriteTimeout(time.Second))
+
+		if _, err := p.ProcessReader(t.Context(), &buf, strings.NewReader(input)); err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		if got, want := buf.String(), "before/aafter"; got != want {
+			t.Errorf("got output %q, want %q", got, want)
+		}
+	})
+}
+
+func TestProcessor_WriteOutput(t *testing.T) {
+	const data = "<esi:include src=\"/a\"/> is written as is"
+
+	t.Run("Short writes", func(t *testing.T) {
+		w := &shortWriter{n: 3}
+
+		n, err := esiproc.New().WriteOutput(t.Context(), w, []byte(data))
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		if got := w.buf.String(); got != data {
+			t.Errorf("got output %q, want %q", got, data)
+		}
+
+		if n != len(data) {
+			t.Errorf("got %d bytes written, want %d", n, len(data))
+		}
+	})
+
+	t.Run("No progress", func(t *testing.T) {
+		_, err := esiproc.New().WriteOutput(t.Context(), stuckWriter{}, []byte(data))
+
+		var writeErr *esiproc.WriteError
+
+		if !errors.As(err, &writeErr) || !errors.Is(err, io.ErrShortWrite) {
+			t.Errorf("got error %v, want %T wrapping %v", err, writeErr, io.ErrShortWrite)
+		}
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		w := &blockingWriter{release: make(chan struct{})}
+		defer close(w.release)
+
+		p := esiproc.New(esiproc.WithWriteTimeout(10 * time.Millisecond))
+
+		if _, err := p.WriteOutput(t.Context(), w, []byte(data)); !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("got error %v, want %v", err, os.ErrDeadlineExceeded)
+		}
+	})
+
+	t.Run("Flush", func(t *testing.T) {
+		w := &blockingFlusher{release: make(chan struct{})}
+		defer close(w.release)
+
+		p := esiproc.New(esiproc.WithFlush(), esiproc.WithWriteTimeout(10*time.Millisecond))
+
+		if _, err := p.WriteOutput(t.Context(), w, []byte(data)); !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("got error %v, want %v", err, os.ErrDeadlineExceeded)
+		}
+	})
+
+	t.Run("Closed", func(t *testing.T) {
+		p := esiproc.New()
+
+		if err := p.Close(t.Context()); err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		if _, err := p.WriteOutput(t.Context(), io.Discard, []byte(data)); !errors.Is(err, &esiproc.ClosedError{}) {
+			t.Errorf("got error %v, want %v", err, &esiproc.ClosedError{})
+		}
+	})
+}
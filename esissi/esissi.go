@@ -0,0 +1,478 @@
+// Package esissi implements support for Apache-style SSI (Server Side Includes) directives in ESI documents.
+//
+// SSI directives are XML comments starting with a "#", for example <!--#include virtual="/footer" -->. The ESI parser
+// returns them as [esi.XMLComment] nodes, which [Transform] replaces with the equivalent ESI nodes.
+//
+// The following directives are supported:
+//
+//   - <!--#include virtual="..." --> and <!--#include file="..." --> are mapped to [esi.IncludeElement].
+//   - <!--#if expr="..." -->, <!--#elif expr="..." -->, <!--#else --> and <!--#endif --> are mapped to
+//     [esi.ChooseElement] with [esi.WhenElement] and [esi.OtherwiseElement] nodes.
+//
+// Expressions are passed on unchanged and must use the ESI expression syntax.
+package esissi
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"iter"
+
+	"github.com/nussjustin/esi"
+	"github.com/nussjustin/esi/esixml"
+	"github.com/nussjustin/esi/internal/diag"
+)
+
+// DirectiveError is returned when encountering an invalid or unsupported SSI directive.
+type DirectiveError struct {
+	Position esi.Position
+
+	// Directive is the name of the directive, if known.
+	Directive string
+
+	// Message describes the error.
+	Message string
+
+	// Underlying optionally contains the underlying error that lead to this error.
+	//
+	// Offsets reported by the underlying error are relative to the start of the directive after the "<!--".
+	Underlying error
+}
+
+// Code returns a machine-readable code identifying the type of the error.
+func (*DirectiveError) Code() string {
+	return "esissi.directive"
+}
+
+// Error returns a human-readable error message.
+func (d *DirectiveError) Error() string {
+	msg := fmt.Sprintf("%s at position %s", d.Message, d.Position)
+
+	if d.Directive != "" {
+		msg = fmt.Sprintf("directive #%s: %s", d.Directive, msg)
+	}
+
+	if d.Underlying != nil {
+		msg += fmt.Sprintf(" (%s)", d.Underlying)
+	}
+
+	return msg
+}
+
+// Is checks if the given error matches the receiver.
+func (d *DirectiveError) Is(err error) bool {
+	var o *DirectiveError
+	return errors.As(err, &o) && o.Position == d.Position && o.Directive == d.Directive && o.Message == d.Message
+}
+
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (d *DirectiveError) MarshalJSON() ([]byte, error) {
+	start, end := diag.Position(d.Position.Start, d.Position.End)
+
+	dd := diag.Diagnostic{Start: start, End: end, Cause: diag.Cause(d.Underlying)}
+	if d.Directive != "" {
+		dd.Details = map[string]any{"directive": d.Directive}
+	}
+	return diag.Marshal(d, dd)
+}
+
+// Unwrap returns d.Underlying.
+func (d *DirectiveError) Unwrap() error {
+	return d.Underlying
+}
+
+// Transform returns an iterator that yields the nodes from the given iterator with all SSI directives replaced by the
+// equivalent ESI nodes.
+//
+// Directives nested inside ESI elements are replaced as well. Conditional blocks must be closed using
+// <!--#endif --> inside the same element in which they were opened.
+//
+// Nodes that are not part of a conditional block are yielded as soon as they are read.
+//
+// Example:
+//
+//	nodes := esissi.Transform(esi.NewParser(r).All)
+func Transform(nodes iter.Seq2[esi.Node, error]) iter.Seq2[esi.Node, error] {
+	return func(yield func(esi.Node, error) bool) {
+		var t transformer
+
+		for node, err := range nodes {
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+
+			node, err = t.push(node)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+
+			if node != nil && !yield(node, nil) {
+				return
+			}
+		}
+
+		if err := t.close(); err != nil {
+			yield(nil, err)
+		}
+	}
+}
+
+// block is an open <!--#if --> directive.
+type block struct {
+	choose *esi.ChooseElement
+
+	// branch is the currently open branch.
+	branch *esi.Position
+
+	// nodes points to the nodes of the currently open branch.
+	nodes *[]esi.Node
+}
+
+type transformer struct {
+	stack []*block
+}
+
+// push adds the node to the current block.
+//
+// If node is not inside a block, or if it closes the outermost block, the resulting node is returned.
+func (t *transformer) push(node esi.Node) (esi.Node, error) {
+	node, err := transformChildren(node)
+	if err != nil {
+		return nil, err
+	}
+
+	if c, ok := node.(*esi.XMLComment); ok {
+		d, ok, err := parseDirective(c)
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			node, err = t.pushDirective(d)
+			if node == nil || err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(t.stack) == 0 {
+		return node, nil
+	}
+
+	top := t.stack[len(t.stack)-1]
+	*top.nodes = append(*top.nodes, node)
+	return nil, nil
+}
+
+func (t *transformer) pushDirective(d directive) (esi.Node, error) {
+	var top *block
+	if len(t.stack) > 0 {
+		top = t.stack[len(t.stack)-1]
+	}
+
+	switch d.name {
+	case "include":
+		return d.include()
+	case "if":
+		test, err := d.expr()
+		if err != nil {
+			return nil, err
+		}
+
+		when := &esi.WhenElement{Position: d.position, Test: test}
+
+		t.stack = append(t.stack, &block{
+			choose: &esi.ChooseElement{Position: d.position, When: []*esi.WhenElement{when}},
+			branch: &when.Position,
+			nodes:  &when.Nodes,
+		})
+
+		return nil, nil
+	case "elif":
+		if top == nil || top.choose.Otherwise != nil {
+			return nil, d.error("unexpected directive", nil)
+		}
+
+		test, err := d.expr()
+		if err != nil {
+			return nil, err
+		}
+
+		top.branch.End = d.position.Start
+
+		when := &esi.WhenElement{Position: d.position, Test: test}
+
+		top.choose.When = append(top.choose.When, when)
+		top.branch = &when.Position
+		top.nodes = &when.Nodes
+
+		return nil, nil
+	case "else":
+		if top == nil || top.choose.Otherwise != nil {
+			return nil, d.error("unexpected directive", nil)
+		}
+
+		if err := d.noAttributes(); err != nil {
+			return nil, err
+		}
+
+		top.branch.End = d.position.Start
+
+		otherwise := &esi.OtherwiseElement{Position: d.position}
+
+		top.choose.Otherwise = otherwise
+		top.branch = &otherwise.Position
+		top.nodes = &otherwise.Nodes
+
+		return nil, nil
+	case "endif":
+		if top == nil {
+			return nil, d.error("unexpected directive", nil)
+		}
+
+		if err := d.noAttributes(); err != nil {
+			return nil, err
+		}
+
+		top.branch.End = d.position.Start
+		top.choose.Position.End = d.position.End
+
+		t.stack = t.stack[:len(t.stack)-1]
+
+		return top.choose, nil
+	default:
+		return nil, d.error("unsupported directive", nil)
+	}
+}
+
+// close returns an error if there are unclosed blocks.
+func (t *transformer) close() error {
+	if len(t.stack) == 0 {
+		return nil
+	}
+
+	return &DirectiveError{
+		Position:  t.stack[len(t.stack)-1].choose.Position,
+		Directive: "if",
+		Message:   "missing #endif",
+	}
+}
+
+func transformNodes(nodes []esi.Node) ([]esi.Node, error) {
+	if len(nodes) == 0 {
+		return nodes, nil
+	}
+
+	var t transformer
+
+	out := make([]esi.Node, 0, len(nodes))
+
+	for _, node := range nodes {
+		node, err := t.push(node)
+		if err != nil {
+			return nil, err
+		}
+
+		if node != nil {
+			out = append(out, node)
+		}
+	}
+
+	if err := t.close(); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// transformChildren replaces directives in all child nodes of node.
+//
+// The node is modified in place.
+func transformChildren(node esi.Node) (esi.Node, error) {
+	var err error
+
+	switch v := node.(type) {
+	case *esi.AttemptElement:
+		v.Nodes, err = transformNodes(v.Nodes)
+	case *esi.ChooseElement:
+		for _, w := range v.When {
+			if _, err = transformChildren(w); err != nil {
+				break
+			}
+		}
+
+		if err == nil && v.Otherwise != nil {
+			_, err = transformChildren(v.Otherwise)
+		}
+	case *esi.Comment:
+		v.Nodes, err = transformNodes(v.Nodes)
+	case *esi.ExceptElement:
+		v.Nodes, err = transformNodes(v.Nodes)
+	case *esi.InlineElement:
+		v.Nodes, err = transformNodes(v.Nodes)
+	case *esi.OtherwiseElement:
+		v.Nodes, err = transformNodes(v.Nodes)
+	case *esi.TryElement:
+		if v.Attempt != nil {
+			_, err = transformChildren(v.Attempt)
+		}
+
+		if err == nil && v.Except != nil {
+			_, err = transformChildren(v.Except)
+		}
+	case *esi.VarsElement:
+		v.Nodes, err = transformNodes(v.Nodes)
+	case *esi.WhenElement:
+		v.Nodes, err = transformNodes(v.Nodes)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return node, nil
+}
+
+type directive struct {
+	position esi.Position
+	name     string
+	attr     []esixml.Attr
+}
+
+// parseDirective parses the given comment as SSI directive.
+//
+// If the comment is not a directive, false is returned.
+func parseDirective(c *esi.XMLComment) (directive, bool, error) {
+	var content []byte
+
+	for _, node := range c.Nodes {
+		data, ok := node.(*esi.RawData)
+		if !ok {
+			return directive{}, false, nil
+		}
+
+		content = append(content, data.Bytes...)
+	}
+
+	if len(content) == 0 || content[0] != '#' {
+		return directive{}, false, nil
+	}
+
+	d := directive{position: c.Position}
+
+	s := esixml.NewScanner(bytes.NewReader(content[1:]))
+
+	name, err := s.ReadName(true)
+	if err != nil {
+		return directive{}, false, d.error("invalid directive name", err)
+	}
+
+	d.name = name.Local
+
+	for {
+		s.DiscardSpaces()
+
+		if _, ok := s.Peek(); !ok {
+			break
+		}
+
+		start := s.Offset()
+
+		attrName, err := s.ReadName(true)
+		if err != nil {
+			return directive{}, false, d.error("invalid attribute name", err)
+		}
+
+		nameEnd := s.Offset()
+
+		s.DiscardSpaces()
+
+		if err := s.ConsumeOrError('='); err != nil {
+			return directive{}, false, d.error("invalid attribute", err)
+		}
+
+		s.DiscardSpaces()
+
+		valueStart := s.Offset()
+
+		quoted := false
+		if b, _ := s.Peek(); b == '"' || b == '\'' {
+			quoted = true
+		}
+
+		attrValue, err := s.ReadAttrValue()
+		if err != nil {
+			return directive{}, false, d.error("invalid attribute value", err)
+		}
+
+		valueEnd := s.Offset()
+
+		if quoted {
+			valueStart, valueEnd = valueStart+1, valueEnd-1
+		}
+
+		// Skip "<!--#"
+		const prefixLen = 5
+
+		position := func(start, end int) esi.Position {
+			return esi.Position{
+				Start: c.Position.Start + prefixLen + start,
+				End:   c.Position.Start + prefixLen + end,
+			}
+		}
+
+		d.attr = append(d.attr, esixml.Attr{
+			Position:      position(start, s.Offset()),
+			NamePosition:  position(start, nameEnd),
+			ValuePosition: position(valueStart, valueEnd),
+			Name:          attrName,
+			Value:         attrValue,
+		})
+	}
+
+	return d, true, nil
+}
+
+func (d directive) error(msg string, underlying error) error {
+	return &DirectiveError{Position: d.position, Directive: d.name, Message: msg, Underlying: underlying}
+}
+
+// onlyAttr returns the value of the only attribute of the directive, which must have one of the given names.
+func (d directive) onlyAttr(names ...string) (esixml.Attr, error) {
+	if len(d.attr) != 1 {
+		return esixml.Attr{}, d.error("exactly one attribute expected", nil)
+	}
+
+	for _, name := range names {
+		if d.attr[0].Name.Local == name {
+			return d.attr[0], nil
+		}
+	}
+
+	return esixml.Attr{}, d.error(fmt.Sprintf("unsupported attribute %q", d.attr[0].Name.Local), nil)
+}
+
+func (d directive) noAttributes() error {
+	if len(d.attr) != 0 {
+		return d.error("unexpected attribute", nil)
+	}
+	return nil
+}
+
+func (d directive) expr() (string, error) {
+	attr, err := d.onlyAttr("expr")
+	if err != nil {
+		return "", err
+	}
+	return attr.Value, nil
+}
+
+func (d directive) include() (esi.Node, error) {
+	attr, err := d.onlyAttr("virtual", "file")
+	if err != nil {
+		return nil, err
+	}
+	return &esi.IncludeElement{Position: d.position, Source: attr.Value}, nil
+}
@@ -0,0 +1,315 @@
+package esissi_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/nussjustin/esi"
+	"github.com/nussjustin/esi/esissi"
+)
+
+func TestTransform(t *testing.T) {
+	position := func(start, end int) esi.Position {
+		return esi.Position{Start: start, End: end}
+	}
+
+	data := func(start int, s string) *esi.RawData {
+		return &esi.RawData{Position: position(start, start+len(s)), Bytes: []byte(s)}
+	}
+
+	testCases := []struct {
+		Name  string
+		Input string
+		Nodes []esi.Node
+		Error error
+	}{
+		{
+			Name: "empty",
+		},
+		{
+			Name:  "no directives",
+			Input: `<!-- comment --><esi:include src="/esi"/>`,
+			Nodes: []esi.Node{
+				&esi.XMLComment{
+					Position: position(0, 16),
+					Nodes:    []esi.Node{data(4, " comment ")},
+				},
+				&esi.IncludeElement{
+					Position: position(16, 41),
+					Source:   "/esi",
+				},
+			},
+		},
+		{
+			Name:  "include virtual",
+			Input: `a<!--#include virtual="/ssi" -->b`,
+			Nodes: []esi.Node{
+				data(0, "a"),
+				&esi.IncludeElement{
+					Position: position(1, 32),
+					Source:   "/ssi",
+				},
+				data(32, "b"),
+			},
+		},
+		{
+			Name:  "include file",
+			Input: `<!--#include file='footer.html'-->`,
+			Nodes: []esi.Node{
+				&esi.IncludeElement{
+					Position: position(0, 34),
+					Source:   "footer.html",
+				},
+			},
+		},
+		{
+			Name:  "include with unsupported attribute",
+			Input: `<!--#include src="/ssi" -->`,
+			Error: &esissi.DirectiveError{
+				Position:  position(0, 27),
+				Directive: "include",
+				Message:   `unsupported attribute "src"`,
+			},
+		},
+		{
+			Name:  "include without attribute",
+			Input: `<!--#include -->`,
+			Error: &esissi.DirectiveError{
+				Position:  position(0, 16),
+				Directive: "include",
+				Message:   "exactly one attribute expected",
+			},
+		},
+		{
+			Name:  "invalid attribute",
+			Input: `<!--#include virtual -->`,
+			Error: &esissi.DirectiveError{
+				Position:  position(0, 24),
+				Directive: "include",
+				Message:   "invalid attribute",
+			},
+		},
+		{
+			Name:  "unsupported directive",
+			Input: `<!--#echo var="DATE_LOCAL" -->`,
+			Error: &esissi.DirectiveError{
+				Position:  position(0, 30),
+				Directive: "echo",
+				Message:   "unsupported directive",
+			},
+		},
+		{
+			Name:  "if",
+			Input: `<!--#if expr="$(a)" -->a<!--#endif -->`,
+			Nodes: []esi.Node{
+				&esi.ChooseElement{
+					Position: position(0, 38),
+					When: []*esi.WhenElement{
+						{
+							Position: position(0, 24),
+							Test:     "$(a)",
+							Nodes:    []esi.Node{data(23, "a")},
+						},
+					},
+				},
+			},
+		},
+		{
+			Name: "if with elif and else",
+			Input: `<!--#if expr="$(a)" -->a<!--#elif expr="$(b)" -->b<!--#else -->c<!--#endif -->` +
+				`<esi:include src="/esi"/>`,
+			Nodes: []esi.Node{
+				&esi.ChooseElement{
+					Position: position(0, 78),
+					When: []*esi.WhenElement{
+						{
+							Position: position(0, 24),
+							Test:     "$(a)",
+							Nodes:    []esi.Node{data(23, "a")},
+						},
+						{
+							Position: position(24, 50),
+							Test:     "$(b)",
+							Nodes:    []esi.Node{data(49, "b")},
+						},
+					},
+					Otherwise: &esi.OtherwiseElement{
+						Position: position(50, 64),
+						Nodes:    []esi.Node{data(63, "c")},
+					},
+				},
+				&esi.IncludeElement{
+					Position: position(78, 103),
+					Source:   "/esi",
+				},
+			},
+		},
+		{
+			Name:  "nested if",
+			Input: `<!--#if expr="a" --><!--#if expr="b" -->b<!--#endif --><!--#endif -->`,
+			Nodes: []esi.Node{
+				&esi.ChooseElement{
+					Position: position(0, 69),
+					When: []*esi.WhenElement{
+						{
+							Position: position(0, 55),
+							Test:     "a",
+							Nodes: []esi.Node{
+								&esi.ChooseElement{
+									Position: position(20, 55),
+									When: []*esi.WhenElement{
+										{
+											Position: position(20, 41),
+											Test:     "b",
+											Nodes:    []esi.Node{data(40, "b")},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:  "directive inside ESI element",
+			Input: `<esi:try><esi:attempt><!--#include virtual="/ssi" --></esi:attempt><esi:except></esi:except></esi:try>`,
+			Nodes: []esi.Node{
+				&esi.TryElement{
+					Position: position(0, 102),
+					Attempt: &esi.AttemptElement{
+						Position: position(9, 67),
+						Nodes: []esi.Node{
+							&esi.IncludeElement{
+								Position: position(22, 53),
+								Source:   "/ssi",
+							},
+						},
+					},
+					Except: &esi.ExceptElement{
+						Position: position(67, 92),
+					},
+				},
+			},
+		},
+		{
+			Name:  "if without expression",
+			Input: `<!--#if -->`,
+			Error: &esissi.DirectiveError{
+				Position:  position(0, 11),
+				Directive: "if",
+				Message:   "exactly one attribute expected",
+			},
+		},
+		{
+			Name:  "missing endif",
+			Input: `<!--#if expr="a" -->a`,
+			Error: &esissi.DirectiveError{
+				Position:  position(0, 20),
+				Directive: "if",
+				Message:   "missing #endif",
+			},
+		},
+		{
+			Name:  "missing endif inside ESI element",
+			Input: `<esi:remove></esi:remove><esi:try><esi:attempt><!--#if expr="a" --></esi:attempt><esi:except></esi:except></esi:try>`,
+			Nodes: []esi.Node{
+				&esi.RemoveElement{Position: position(0, 25)},
+			},
+			Error: &esissi.DirectiveError{
+				Position:  position(47, 67),
+				Directive: "if",
+				Message:   "missing #endif",
+			},
+		},
+		{
+			Name:  "elif without if",
+			Input: `<!--#elif expr="a" -->`,
+			Error: &esissi.DirectiveError{
+				Position:  position(0, 22),
+				Directive: "elif",
+				Message:   "unexpected directive",
+			},
+		},
+		{
+			Name:  "elif after else",
+			Input: `<!--#if expr="a" --><!--#else --><!--#elif expr="b" -->`,
+			Error: &esissi.DirectiveError{
+				Position:  position(33, 55),
+				Directive: "elif",
+				Message:   "unexpected directive",
+			},
+		},
+		{
+			Name:  "endif without if",
+			Input: `<!--#endif -->`,
+			Error: &esissi.DirectiveError{
+				Position:  position(0, 14),
+				Directive: "endif",
+				Message:   "unexpected directive",
+			},
+		},
+		{
+			Name:  "else with attribute",
+			Input: `<!--#if expr="a" --><!--#else expr="b" -->`,
+			Error: &esissi.DirectiveError{
+				Position:  position(20, 42),
+				Directive: "else",
+				Message:   "unexpected attribute",
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			var nodes []esi.Node
+			var err error
+
+			for node, nodeErr := range esissi.Transform(esi.NewParser(strings.NewReader(testCase.Input)).All) {
+				if nodeErr != nil {
+					err = nodeErr
+					break
+				}
+
+				nodes = append(nodes, node)
+			}
+
+			if diff := cmp.Diff(testCase.Nodes, nodes); diff != "" {
+				t.Errorf("nodes mismatch (-want +got):\n%s", diff)
+			}
+
+			if !errors.Is(testCase.Error, err) {
+				t.Errorf("got error %v, want %v", err, testCase.Error)
+			}
+		})
+	}
+}
+
+func TestTransform_Streaming(t *testing.T) {
+	input := `a<!--#if expr="a" -->b<!--#endif -->`
+
+	var got []esi.Node
+
+	for node, err := range esissi.Transform(esi.NewParser(strings.NewReader(input)).All) {
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		got = append(got, node)
+
+		if len(got) == 1 {
+			if _, ok := node.(*esi.RawData); !ok {
+				t.Fatalf("got first node %T, want %T", node, &esi.RawData{})
+			}
+
+			break
+		}
+	}
+
+	if len(got) != 1 {
+		t.Fatalf("got %d nodes, want 1", len(got))
+	}
+}
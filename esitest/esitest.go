@@ -0,0 +1,316 @@
+// Package esitest implements a harness for comparing the output of an [esiproc.Processor] with the output of a
+// reference implementation.
+//
+// This can be used to validate compatibility profiles, by processing the same documents using this module and, for
+// example, a Varnish instance or files containing output produced by an Akamai or Fastly simulator.
+package esitest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/nussjustin/esi"
+	"github.com/nussjustin/esi/esiproc"
+)
+
+// Reference is the interface for reference implementations that documents are compared against.
+type Reference interface {
+	// Process processes the given document and returns the result.
+	//
+	// The name identifies the document, for example the name of the file it was read from.
+	Process(ctx context.Context, name string, doc []byte) ([]byte, error)
+}
+
+// ReferenceFunc implements the [Reference] interface using a function.
+type ReferenceFunc func(ctx context.Context, name string, doc []byte) ([]byte, error)
+
+// Process implements the [Reference] interface.
+func (f ReferenceFunc) Process(ctx context.Context, name string, doc []byte) ([]byte, error) {
+	return f(ctx, name, doc)
+}
+
+// CommandReference is a [Reference] that runs an external command for each document.
+//
+// The document is written to the standard input of the command and the standard output is used as result. The name
+// of the document is passed in the ESI_DOCUMENT_NAME environment variable.
+//
+// A command exiting with a non-zero exit code results in an error that includes the standard error output.
+type CommandReference struct {
+	// Path is the path or name of the command.
+	Path string
+
+	// Args contains the arguments passed to the command.
+	Args []string
+
+	// Dir is the working directory of the command.
+	//
+	// If empty, the command runs in the current directory.
+	Dir string
+
+	// Env contains additional environment variables in the form "key=value".
+	Env []string
+}
+
+var _ Reference = (*CommandReference)(nil)
+
+// Process implements the [Reference] interface.
+func (c *CommandReference) Process(ctx context.Context, name string, doc []byte) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, c.Path, c.Args...) //nolint:gosec
+	cmd.Dir = c.Dir
+	cmd.Env = append(append(os.Environ(), c.Env...), "ESI_DOCUMENT_NAME="+name)
+	cmd.Stdin = bytes.NewReader(doc)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("reference command failed for %q: %w: %s", name, err, msg)
+		}
+
+		return nil, fmt.Errorf("reference command failed for %q: %w", name, err)
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// FileReference is a [Reference] that reads previously generated results from files.
+//
+// The result for a document is read from the file with the name of the document plus Ext.
+type FileReference struct {
+	// FS contains the result files.
+	FS fs.FS
+
+	// Ext is appended to the name of the document to get the name of the result file.
+	//
+	// If empty, ".out" is used.
+	Ext string
+}
+
+var _ Reference = (*FileReference)(nil)
+
+// Process implements the [Reference] interface.
+func (f *FileReference) Process(_ context.Context, name string, _ []byte) ([]byte, error) {
+	ext := f.Ext
+	if ext == "" {
+		ext = ".out"
+	}
+
+	return fs.ReadFile(f.FS, name+ext)
+}
+
+// Harness processes documents using a [esiproc.Processor] and a [Reference] and compares the results.
+type Harness struct {
+	// Processor is used to process documents.
+	//
+	// If nil, a processor without any options is used.
+	Processor *esiproc.Processor
+
+	// ParserOptions contains options used for parsing documents.
+	ParserOptions []esi.ParserOpt
+
+	// Reference is the reference implementation to compare against.
+	Reference Reference
+
+	// Normalize is called with both results before comparing them and can be used to ignore irrelevant differences,
+	// for example in whitespace.
+	//
+	// If nil, results are compared as is.
+	Normalize func(b []byte) []byte
+}
+
+// Result contains the result of comparing the output for a single document.
+type Result struct {
+	// Name is the name of the document.
+	Name string
+
+	// Got is the (normalized) output of the [esiproc.Processor].
+	Got []byte
+
+	// Want is the (normalized) output of the [Reference].
+	Want []byte
+
+	// Err is the error returned when processing the document using the [esiproc.Processor], if any.
+	//
+	// If Err is not nil, Got contains the output written until the error occurred.
+	Err error
+}
+
+// Diff returns a line based diff between the outputs or an empty string if the outputs are equal.
+//
+// Lines only found in the reference output are prefixed with "-", lines only found in the processor output with "+".
+func (r *Result) Diff() string {
+	if r.Equal() {
+		return ""
+	}
+
+	return diffLines(string(r.Want), string(r.Got))
+}
+
+// Equal returns true if the document was processed without error and the outputs are equal.
+func (r *Result) Equal() bool {
+	return r.Err == nil && bytes.Equal(r.Got, r.Want)
+}
+
+// Compare processes the given document and compares the result with the result of the [Reference].
+//
+// Errors from processing the document using the [esiproc.Processor] are reported via [Result.Err]. Errors from the
+// [Reference] are returned.
+func (h *Harness) Compare(ctx context.Context, name string, doc []byte) (*Result, error) {
+	want, err := h.Reference.Process(ctx, name, doc)
+	if err != nil {
+		return nil, err
+	}
+
+	proc := h.Processor
+	if proc == nil {
+		proc = esiproc.New()
+	}
+
+	var got bytes.Buffer
+
+	_, procErr := proc.Process(ctx, &got, esi.NewParser(bytes.NewReader(doc), h.ParserOptions...).All)
+
+	res := &Result{Name: name, Got: got.Bytes(), Want: want, Err: procErr}
+
+	if h.Normalize != nil {
+		res.Got, res.Want = h.Normalize(res.Got), h.Normalize(res.Want)
+	}
+
+	return res, nil
+}
+
+// CompareFS compares all documents in fsys that match any of the given patterns.
+//
+// The patterns use the syntax of [fs.Glob]. Results are returned in the order of the patterns and, for each pattern,
+// in lexical order. Documents matching multiple patterns are only compared once.
+//
+// If the [Reference] fails for any document, CompareFS stops and returns the results so far and the error.
+func (h *Harness) CompareFS(ctx context.Context, fsys fs.FS, patterns ...string) ([]*Result, error) {
+	var results []*Result
+
+	seen := make(map[string]bool)
+
+	for _, pattern := range patterns {
+		names, err := fs.Glob(fsys, pattern)
+		if err != nil {
+			return results, err
+		}
+
+		for _, name := range names {
+			if seen[name] {
+				continue
+			}
+
+			seen[name] = true
+
+			doc, err := fs.ReadFile(fsys, name)
+			if err != nil {
+				return results, err
+			}
+
+			res, err := h.Compare(ctx, name, doc)
+			if err != nil {
+				return results, err
+			}
+
+			results = append(results, res)
+		}
+	}
+
+	return results, nil
+}
+
+// Mismatches returns an error describing all results that are not equal, joined using [errors.Join].
+//
+// If all results are equal, nil is returned.
+func Mismatches(results []*Result) error {
+	var errs []error
+
+	for _, res := range results {
+		switch {
+		case res.Err != nil:
+			errs = append(errs, fmt.Errorf("%s: processing failed: %w", res.Name, res.Err))
+		case !res.Equal():
+			errs = append(errs, fmt.Errorf("%s: output mismatch (-want +got):\n%s", res.Name, res.Diff()))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// diffLines returns a line based diff between a and b using the longest common subsequence of lines.
+func diffLines(a, b string) string {
+	x, y := splitLines(a), splitLines(b)
+
+	// lcs[i][j] is the length of the longest common subsequence of x[i:] and y[j:].
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var sb strings.Builder
+
+	writeLine := func(prefix, line string) {
+		sb.WriteString(prefix)
+		sb.WriteString(line)
+
+		if !strings.HasSuffix(line, "\n") {
+			sb.WriteString("\n")
+		}
+	}
+
+	i, j := 0, 0
+
+	for i < len(x) && j < len(y) {
+		switch {
+		case x[i] == y[j]:
+			writeLine(" ", x[i])
+			i, j = i+1, j+1
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			writeLine("-", x[i])
+			i++
+		default:
+			writeLine("+", y[j])
+			j++
+		}
+	}
+
+	for ; i < len(x); i++ {
+		writeLine("-", x[i])
+	}
+
+	for ; j < len(y); j++ {
+		writeLine("+", y[j])
+	}
+
+	return sb.String()
+}
+
+// splitLines splits s into lines, keeping the line endings.
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	return lines
+}
@@ -0,0 +1,149 @@
+package esitest_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/nussjustin/esi/esiproc"
+	"github.com/nussjustin/esi/esitest"
+)
+
+func TestHarness_Compare(t *testing.T) {
+	errReference := errors.New("reference failed")
+
+	reference := esitest.ReferenceFunc(func(_ context.Context, name string, _ []byte) ([]byte, error) {
+		switch name {
+		case "error":
+			return nil, errReference
+		case "mismatch":
+			return []byte("a\nb\nc\n"), nil
+		default:
+			return []byte("a\nB\nc\n"), nil
+		}
+	})
+
+	h := &esitest.Harness{
+		Reference: reference,
+		Processor: esiproc.New(esiproc.WithClient(esiproc.ClientFunc(
+			func(context.Context, string, map[string]string) ([]byte, error) {
+				return []byte("B"), nil
+			},
+		))),
+	}
+
+	doc := []byte("a\n<esi:include src=\"/b\"/>\nc\n")
+
+	res, err := h.Compare(context.Background(), "equal", doc)
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	if !res.Equal() {
+		t.Errorf("got unequal result with diff:\n%s", res.Diff())
+	}
+
+	if got := res.Diff(); got != "" {
+		t.Errorf("got diff %q for equal result", got)
+	}
+
+	res, err = h.Compare(context.Background(), "mismatch", doc)
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	if res.Equal() {
+		t.Errorf("got equal result for mismatch")
+	}
+
+	if diff := cmp.Diff(" a\n-b\n+B\n c\n", res.Diff()); diff != "" {
+		t.Errorf("diff mismatch (-want +got):\n%s", diff)
+	}
+
+	if _, err := h.Compare(context.Background(), "error", doc); !errors.Is(err, errReference) {
+		t.Errorf("got error %v, want %v", err, errReference)
+	}
+}
+
+func TestHarness_CompareFS(t *testing.T) {
+	docs := fstest.MapFS{
+		"docs/a.html":     {Data: []byte(`a<esi:remove>x</esi:remove>`)},
+		"docs/b.html":     {Data: []byte(`b<esi:comment text="x"/>`)},
+		"docs/c.html":     {Data: []byte(`<esi:include src="/c"/>`)},
+		"docs/a.html.out": {Data: []byte(`a`)},
+		"docs/b.html.out": {Data: []byte(`B`)},
+		"docs/c.html.out": {Data: []byte(`c`)},
+	}
+
+	h := &esitest.Harness{
+		Reference: &esitest.FileReference{FS: docs},
+		Normalize: bytes.ToLower,
+	}
+
+	results, err := h.CompareFS(context.Background(), docs, "docs/*.html", "docs/a.html")
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	var names []string
+
+	for _, res := range results {
+		names = append(names, res.Name)
+	}
+
+	if diff := cmp.Diff([]string{"docs/a.html", "docs/b.html", "docs/c.html"}, names); diff != "" {
+		t.Errorf("names mismatch (-want +got):\n%s", diff)
+	}
+
+	if _, err := h.CompareFS(context.Background(), docs, "docs/*.out"); err == nil {
+		t.Errorf("got no error for missing reference file")
+	}
+
+	err = esitest.Mismatches(results[:3])
+	if err == nil {
+		t.Fatalf("got no error for mismatches")
+	}
+
+	if msg := err.Error(); !strings.HasPrefix(msg, "docs/c.html: processing failed") || strings.Contains(msg, "docs/a") {
+		t.Errorf("got unexpected error message %q", msg)
+	}
+
+	if err := esitest.Mismatches(results[:2]); err != nil {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestCommandReference(t *testing.T) {
+	path, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh not found")
+	}
+
+	ref := &esitest.CommandReference{
+		Path: path,
+		Args: []string{"-c", `tr a-z A-Z; printf "$ESI_DOCUMENT_NAME$SUFFIX"`},
+		Env:  []string{"SUFFIX=!"},
+	}
+
+	got, err := ref.Process(context.Background(), "name", []byte("doc:"))
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	if diff := cmp.Diff("DOC:name!", string(got)); diff != "" {
+		t.Errorf("output mismatch (-want +got):\n%s", diff)
+	}
+
+	ref.Args = []string{"-c", "echo failure >&2; exit 1"}
+
+	_, err = ref.Process(context.Background(), "name", nil)
+	if err == nil || !strings.Contains(err.Error(), "failure") {
+		t.Errorf("got error %v, want error containing stderr output", err)
+	}
+}
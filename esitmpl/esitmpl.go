@@ -0,0 +1,432 @@
+// Package esitmpl implements precompiled templates that can be parsed once and processed many times.
+//
+// A [Template] holds the parsed nodes of a document together with the parsed expressions of all esi:when elements.
+// Templates are immutable and can be shared and processed concurrently, for example by servers that render the same
+// document for many requests.
+package esitmpl
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"strings"
+
+	"github.com/nussjustin/esi"
+	"github.com/nussjustin/esi/esiexpr"
+	"github.com/nussjustin/esi/esiexpr/ast"
+	"github.com/nussjustin/esi/esiproc"
+	"github.com/nussjustin/esi/internal/diag"
+)
+
+// ExpressionError is returned by [Compile] when an expression or variable inside the template is invalid.
+type ExpressionError struct {
+	// Element is the element containing the expression or variable.
+	Element esi.Element
+
+	// Expr is the invalid expression or the string containing the invalid variable.
+	Expr string
+
+	// Err is the underlying error.
+	Err error
+}
+
+// Code returns a machine-readable code identifying the type of the error.
+func (*ExpressionError) Code() string {
+	return "esitmpl.expression"
+}
+
+// Error returns a human-readable error message.
+func (e *ExpressionError) Error() string {
+	start, end := e.Element.Pos()
+	return fmt.Sprintf("invalid expression %q in element %s at position %d:%d: %s",
+		e.Expr, e.Element.Name(), start, end, e.Err)
+}
+
+// Is checks if the given error matches the receiver.
+func (e *ExpressionError) Is(err error) bool {
+	var o *ExpressionError
+	return errors.As(err, &o) && o.Error() == e.Error()
+}
+
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (e *ExpressionError) MarshalJSON() ([]byte, error) {
+	start, end := e.Element.Pos()
+	return diag.Marshal(e, diag.Diagnostic{
+		Start:   diag.Int(start),
+		End:     diag.Int(end),
+		Element: e.Element.Name().String(),
+		Details: map[string]any{"expr": e.Expr},
+		Cause:   diag.Cause(e.Err),
+	})
+}
+
+// Unwrap returns the underlying error.
+func (e *ExpressionError) Unwrap() error {
+	return e.Err
+}
+
+// CompileOpt is the type for functions that can be used to customize the behaviour of [Compile].
+type CompileOpt func(*compileOptions)
+
+type compileOptions struct {
+	parserOpts []esi.ParserOpt
+	strict     bool
+}
+
+// WithParserOptions sets the options used for parsing the template.
+func WithParserOptions(opts ...esi.ParserOpt) CompileOpt {
+	return func(o *compileOptions) {
+		o.parserOpts = opts
+	}
+}
+
+// WithStrictExpressions configures [Compile] to reject extensions to the expression syntax, like escape sequences
+// and raw strings.
+//
+// This should be used together with a strict [esiexpr.Env]. See [esiexpr.Env.Strict]. When processing a template
+// compiled without WithStrictExpressions using a strict Env, expressions are not precompiled, but parsed by the Env
+// for each evaluation, so that extensions are rejected as configured by the Env.
+func WithStrictExpressions() CompileOpt {
+	return func(o *compileOptions) {
+		o.strict = true
+	}
+}
+
+// Template is a compiled, immutable template.
+//
+// Templates are safe for concurrent use.
+type Template struct {
+	nodes  esi.Nodes
+	exprs  map[string]ast.Node
+	strict bool
+}
+
+// Compile parses and validates the given data and returns a [Template] for it.
+//
+// The template holds a copy of all data, so data can be modified or reused after Compile returns.
+//
+// The expressions of all esi:when elements are parsed and simplified ahead of time. The variables inside the
+// attributes of esi:include elements and inside esi:vars elements are validated. This includes elements inside ESI
+// comments (<!--esi ... -->) and XML comments. Invalid expressions and variables are reported as [ExpressionError].
+func Compile(data []byte, opts ...CompileOpt) (*Template, error) {
+	var o compileOptions
+
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	var nodes esi.Nodes
+
+	for node, err := range esi.NewParser(bytes.NewReader(data), o.parserOpts...).All {
+		if err != nil {
+			return nil, err
+		}
+
+		nodes = append(nodes, node)
+	}
+
+	t := &Template{nodes: nodes.Clone(), exprs: make(map[string]ast.Node), strict: o.strict}
+
+	c := compiler{strict: o.strict, exprs: t.exprs}
+
+	if err := c.compileNodes(nil, t.nodes); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// Bindings contains the per-call values used by [Template.Process].
+type Bindings struct {
+	// Client is used to fetch included fragments.
+	//
+	// See [esiproc.WithClient].
+	Client esiproc.Client
+
+	// Env is used for evaluating expressions and interpolating variables.
+	//
+	// If nil, expressions and variables are not supported.
+	Env *esiexpr.Env
+
+	// Options contains additional options for the [esiproc.Processor].
+	Options []esiproc.ProcessorOpt
+
+	// Processor is the processor from which the processor used for the template is derived using
+	// [esiproc.Processor.With].
+	//
+	// The derived processor shares the limit for concurrent calls to the [esiproc.Client] with Processor, unless the
+	// limit is changed via Options.
+	//
+	// If nil, a new [esiproc.Processor] is created.
+	Processor *esiproc.Processor
+}
+
+// All returns an iterator over the nodes of the template.
+//
+// The yielded nodes must not be modified.
+func (t *Template) All() iter.Seq2[esi.Node, error] {
+	return func(yield func(esi.Node, error) bool) {
+		for _, node := range t.nodes {
+			if !yield(node, nil) {
+				return
+			}
+		}
+	}
+}
+
+// Nodes returns a deep copy of the nodes of the template.
+func (t *Template) Nodes() esi.Nodes {
+	return t.nodes.Clone()
+}
+
+// Bind returns a [BoundTemplate] that processes t using the given bindings.
+//
+// The [esiproc.Processor] used for processing is created once by Bind and used for all calls to the methods of the
+// returned BoundTemplate.
+func (t *Template) Bind(b Bindings) *BoundTemplate {
+	opts := make([]esiproc.ProcessorOpt, 0, len(b.Options)+3)
+	opts = append(opts, b.Options...)
+
+	if b.Client != nil {
+		opts = append(opts, esiproc.WithClient(b.Client))
+	}
+
+	if env := b.Env; env != nil {
+		// Only use precompiled expressions if they were compiled with the same strictness as used by env.
+		exprs := t.exprs
+		if env.Strict && !t.strict {
+			exprs = nil
+		}
+
+		opts = append(opts,
+			esiproc.WithEvalFunc(func(ctx context.Context, expr string) (any, error) {
+				if node, ok := exprs[expr]; ok {
+					return env.EvalNode(ctx, node)
+				}
+
+				return env.Eval(ctx, expr)
+			}),
+			esiproc.WithInterpolateFunc(env.Interpolate),
+		)
+	}
+
+	p := b.Processor
+	if p == nil {
+		p = esiproc.New(opts...)
+	} else {
+		p = p.With(opts...)
+	}
+
+	return &BoundTemplate{tmpl: t, proc: p}
+}
+
+// Process processes the template using the given bindings and writes the result to w.
+//
+// It returns the number of bytes written to w. See [esiproc.Processor.Process] for details.
+//
+// This is a shorthand for calling [Template.Bind] followed by [BoundTemplate.Process]. When processing the template
+// many times with the same bindings, Bind should be used instead.
+func (t *Template) Process(ctx context.Context, w io.Writer, b Bindings) (int, error) {
+	return t.Bind(b).Process(ctx, w)
+}
+
+// ProcessResult is like [Template.Process], but returns a summary of the processing.
+//
+// See [esiproc.Processor.ProcessResult] for details.
+func (t *Template) ProcessResult(ctx context.Context, w io.Writer, b Bindings) (esiproc.Result, error) {
+	return t.Bind(b).ProcessResult(ctx, w)
+}
+
+// BoundTemplate is a [Template] bound to a set of [Bindings].
+//
+// BoundTemplates are safe for concurrent use.
+type BoundTemplate struct {
+	tmpl *Template
+	proc *esiproc.Processor
+}
+
+// Process processes the template and writes the result to w.
+//
+// It returns the number of bytes written to w. See [esiproc.Processor.Process] for details.
+func (b *BoundTemplate) Process(ctx context.Context, w io.Writer) (int, error) {
+	return b.proc.Process(ctx, w, b.tmpl.All())
+}
+
+// ProcessResult is like [BoundTemplate.Process], but returns a summary of the processing.
+//
+// See [esiproc.Processor.ProcessResult] for details.
+func (b *BoundTemplate) ProcessResult(ctx context.Context, w io.Writer) (esiproc.Result, error) {
+	return b.proc.ProcessResult(ctx, w, b.tmpl.All())
+}
+
+type compiler struct {
+	strict bool
+	exprs  map[string]ast.Node
+}
+
+func (c *compiler) compileNodes(parent esi.Element, nodes []esi.Node) error {
+	for _, node := range nodes {
+		if err := c.compileNode(parent, node); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *compiler) compileNode(parent esi.Element, node esi.Node) error {
+	switch v := node.(type) {
+	case *esi.AttemptElement:
+		return c.compileNodes(v, v.Nodes)
+	case *esi.Comment:
+		return c.compileNodes(parent, v.Nodes)
+	case *esi.ChooseElement:
+		for _, when := range v.When {
+			if err := c.compileWhen(when); err != nil {
+				return err
+			}
+		}
+
+		if v.Otherwise != nil {
+			return c.compileNodes(v.Otherwise, v.Otherwise.Nodes)
+		}
+	case *esi.ExceptElement:
+		return c.compileNodes(v, v.Nodes)
+	case *esi.IncludeElement:
+		if err := c.checkVariables(v, v.Source); err != nil {
+			return err
+		}
+
+		return c.checkVariables(v, v.Alt)
+	case *esi.InlineElement:
+		return c.compileNodes(v, v.Nodes)
+	case *esi.RawData:
+		if _, ok := parent.(*esi.VarsElement); ok {
+			return c.checkVariables(parent, string(v.Bytes))
+		}
+	case *esi.RemoveElement:
+		return c.compileNodes(v, v.Nodes)
+	case *esi.TryElement:
+		if v.Attempt != nil {
+			if err := c.compileNodes(v.Attempt, v.Attempt.Nodes); err != nil {
+				return err
+			}
+		}
+
+		if v.Except != nil {
+			return c.compileNodes(v.Except, v.Except.Nodes)
+		}
+	case *esi.VarsElement:
+		return c.compileNodes(v, v.Nodes)
+	case *esi.XMLComment:
+		return c.compileNodes(parent, v.Nodes)
+	}
+
+	return nil
+}
+
+func (c *compiler) compileWhen(when *esi.WhenElement) error {
+	if _, ok := c.exprs[when.Test]; !ok {
+		p := ast.NewParser(when.Test)
+		p.SetStrict(c.strict)
+
+		node, err := p.Parse()
+		if err != nil {
+			return &ExpressionError{Element: when, Expr: when.Test, Err: err}
+		}
+
+		c.exprs[when.Test] = simplify(node)
+	}
+
+	return c.compileNodes(when, when.Nodes)
+}
+
+func (c *compiler) checkVariables(ele esi.Element, s string) error {
+	p := ast.NewParser("")
+	p.SetStrict(c.strict)
+
+	for rest := s; rest != ""; {
+		index := strings.Index(rest, "$(")
+		if index == -1 {
+			break
+		}
+
+		p.Reset(rest[index:])
+
+		v, err := p.ParseVariable()
+		if err != nil {
+			return &ExpressionError{Element: ele, Expr: s, Err: err}
+		}
+
+		rest = rest[index+v.Position.End:]
+	}
+
+	return nil
+}
+
+// simplify returns a simplified version of the given expression.
+//
+// Only sub-expressions without side effects that always produce the same result are simplified. These are negations
+// of boolean values and combinations of boolean values using the and and or operators.
+func simplify(node ast.Node) ast.Node {
+	switch v := node.(type) {
+	case *ast.AndNode:
+		left, right := simplify(v.Left), simplify(v.Right)
+
+		if l, ok := boolValue(left); ok {
+			if r, ok := boolValue(right); ok {
+				return &ast.ValueNode{Position: v.Position, Value: l && r}
+			}
+		}
+
+		return &ast.AndNode{Position: v.Position, Left: left, Right: right}
+	case *ast.ComparisonNode:
+		return &ast.ComparisonNode{
+			Position: v.Position,
+			Operator: v.Operator,
+			Left:     simplify(v.Left),
+			Right:    simplify(v.Right),
+		}
+	case *ast.FunctionNode:
+		args := make([]ast.Node, len(v.Args))
+
+		for i, arg := range v.Args {
+			args[i] = simplify(arg)
+		}
+
+		return &ast.FunctionNode{Position: v.Position, Name: v.Name, Args: args}
+	case *ast.NegateNode:
+		expr := simplify(v.Expr)
+
+		if b, ok := boolValue(expr); ok {
+			return &ast.ValueNode{Position: v.Position, Value: !b}
+		}
+
+		return &ast.NegateNode{Position: v.Position, Expr: expr}
+	case *ast.OrNode:
+		left, right := simplify(v.Left), simplify(v.Right)
+
+		if l, ok := boolValue(left); ok {
+			if r, ok := boolValue(right); ok {
+				return &ast.ValueNode{Position: v.Position, Value: l || r}
+			}
+		}
+
+		return &ast.OrNode{Position: v.Position, Left: left, Right: right}
+	default:
+		return node
+	}
+}
+
+func boolValue(node ast.Node) (value, ok bool) {
+	v, ok := node.(*ast.ValueNode)
+	if !ok {
+		return false, false
+	}
+
+	value, ok = v.Value.(bool)
+	return value, ok
+}
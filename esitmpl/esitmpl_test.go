@@ -0,0 +1,298 @@
+package esitmpl_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/nussjustin/esi"
+	"github.com/nussjustin/esi/esiexpr"
+	"github.com/nussjustin/esi/esiexpr/ast"
+	"github.com/nussjustin/esi/esiproc"
+	"github.com/nussjustin/esi/esitmpl"
+	"github.com/nussjustin/esi/esixml"
+)
+
+func newEnv(vars map[string]string) *esiexpr.Env {
+	return &esiexpr.Env{
+		LookupVar: func(_ context.Context, name string, _ *string) (ast.Value, error) {
+			if v, ok := vars[name]; ok {
+				return v, nil
+			}
+			return nil, nil
+		},
+		CompareValues: func(a, b ast.Value) (int, error) {
+			return strings.Compare(a.(string), b.(string)), nil
+		},
+		ValueToBool: func(v ast.Value) (bool, error) {
+			return v != nil, nil
+		},
+	}
+}
+
+func TestCompile(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Input    string
+		Opts     []esitmpl.CompileOpt
+		Expected error
+	}{
+		{
+			Name:  "valid",
+			Input: `<esi:choose><esi:when test="$(A) == 'a'">a</esi:when></esi:choose><esi:include src="/$(A)"/>`,
+		},
+		{
+			Name:  "parser error",
+			Input: `<esi:choose>`,
+			Expected: &esi.UnclosedElementError{
+				Position: esi.Position{Start: 0, End: 12},
+				Name:     esixml.Name{Space: esi.Namespace, Local: esi.NameChoose},
+			},
+		},
+		{
+			Name:  "invalid test",
+			Input: `<esi:choose><esi:when test="$(A) ==">a</esi:when></esi:choose>`,
+			Expected: &esitmpl.ExpressionError{
+				Element: &esi.WhenElement{Position: esi.Position{Start: 12, End: 49}},
+				Expr:    "$(A) ==",
+			},
+		},
+		{
+			Name:  "strict test",
+			Input: `<esi:choose><esi:when test="$(A) == '\'a'">a</esi:when></esi:choose>`,
+			Opts:  []esitmpl.CompileOpt{esitmpl.WithStrictExpressions()},
+			Expected: &esitmpl.ExpressionError{
+				Element: &esi.WhenElement{Position: esi.Position{Start: 12, End: 55}},
+				Expr:    `$(A) == '\'a'`,
+			},
+		},
+		{
+			Name:  "invalid include variable",
+			Input: `<esi:include src="/$(A{x)"/>`,
+			Expected: &esitmpl.ExpressionError{
+				Element: &esi.IncludeElement{Position: esi.Position{Start: 0, End: 28}},
+				Expr:    "/$(A{x)",
+			},
+		},
+		{
+			Name:  "invalid vars variable",
+			Input: `<esi:vars>$(A{x)</esi:vars>`,
+			Expected: &esitmpl.ExpressionError{
+				Element: &esi.VarsElement{Position: esi.Position{Start: 0, End: 27}},
+				Expr:    "$(A{x)",
+			},
+		},
+		{
+			Name: "nested invalid test",
+			Input: `<esi:try><esi:attempt><esi:choose><esi:when test="!">a</esi:when></esi:choose></esi:attempt>` +
+				`<esi:except></esi:except></esi:try>`,
+			Expected: &esitmpl.ExpressionError{
+				Element: &esi.WhenElement{Position: esi.Position{Start: 34, End: 65}},
+				Expr:    "!",
+			},
+		},
+		{
+			Name:  "invalid test in ESI comment",
+			Input: `<!--esi <esi:choose><esi:when test="!">a</esi:when></esi:choose>-->`,
+			Expected: &esitmpl.ExpressionError{
+				Element: &esi.WhenElement{Position: esi.Position{Start: 20, End: 51}},
+				Expr:    "!",
+			},
+		},
+		{
+			Name:  "invalid include variable in ESI comment",
+			Input: `<!--esi <esi:include src="/$(A{x)"/>-->`,
+			Expected: &esitmpl.ExpressionError{
+				Element: &esi.IncludeElement{Position: esi.Position{Start: 8, End: 36}},
+				Expr:    "/$(A{x)",
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			_, err := esitmpl.Compile([]byte(testCase.Input), testCase.Opts...)
+
+			if testCase.Expected == nil {
+				if err != nil {
+					t.Fatalf("got error %v", err)
+				}
+				return
+			}
+
+			var exprErr *esitmpl.ExpressionError
+			if errors.As(err, &exprErr) {
+				if exprErr.Err == nil {
+					t.Errorf("got expression error without underlying error")
+				}
+
+				want := testCase.Expected.(*esitmpl.ExpressionError)
+				want.Err = exprErr.Err
+			}
+
+			if !errors.Is(err, testCase.Expected) {
+				t.Errorf("got error %v, want %v", err, testCase.Expected)
+			}
+		})
+	}
+}
+
+func TestTemplate_Process(t *testing.T) {
+	input := []byte(`<esi:choose>` +
+		`<esi:when test="$(A) == 'a' &amp; !false">A</esi:when>` +
+		`<esi:when test="$(B) | false &amp; true">B</esi:when>` +
+		`<esi:otherwise>other</esi:otherwise>` +
+		`</esi:choose>|<esi:include src="/$(A)"/>|<esi:vars>$(B)</esi:vars>`)
+
+	tmpl, err := esitmpl.Compile(input)
+	if err != nil {
+		t.Fatalf("failed to compile template: %v", err)
+	}
+
+	// The template must not depend on the input after compilation.
+	clear(input)
+
+	client := esiproc.ClientFunc(func(_ context.Context, urlStr string, _ map[string]string) ([]byte, error) {
+		return []byte("include " + urlStr), nil
+	})
+
+	testCases := []struct {
+		Name     string
+		Vars     map[string]string
+		Expected string
+	}{
+		{
+			Name:     "first branch",
+			Vars:     map[string]string{"A": "a"},
+			Expected: "A|include /a|",
+		},
+		{
+			Name:     "second branch",
+			Vars:     map[string]string{"A": "x", "B": "b"},
+			Expected: "B|include /x|b",
+		},
+		{
+			Name:     "otherwise",
+			Vars:     map[string]string{"A": "x"},
+			Expected: "other|include /x|",
+		},
+	}
+
+	var wg sync.WaitGroup
+
+	for _, testCase := range testCases {
+		wg.Go(func() {
+			var b strings.Builder
+
+			_, err := tmpl.Process(context.Background(), &b, esitmpl.Bindings{
+				Client: client,
+				Env:    newEnv(testCase.Vars),
+			})
+			if err != nil {
+				t.Errorf("%s: got error %v", testCase.Name, err)
+				return
+			}
+
+			if diff := cmp.Diff(testCase.Expected, b.String()); diff != "" {
+				t.Errorf("%s: output mismatch (-want +got):\n%s", testCase.Name, diff)
+			}
+		})
+	}
+
+	wg.Wait()
+}
+
+func TestTemplate_Process_Options(t *testing.T) {
+	tmpl, err := esitmpl.Compile([]byte(`<esi:include src="/a"/><esi:include src="/b"/>`))
+	if err != nil {
+		t.Fatalf("failed to compile template: %v", err)
+	}
+
+	client := esiproc.ClientFunc(func(context.Context, string, map[string]string) ([]byte, error) {
+		return []byte("x"), nil
+	})
+
+	var b strings.Builder
+
+	_, err = tmpl.Process(context.Background(), &b, esitmpl.Bindings{
+		Client:  client,
+		Options: []esiproc.ProcessorOpt{esiproc.WithMaxIncludes(1)},
+	})
+
+	if want := (&esiproc.TooManyIncludesError{}); !errors.As(err, &want) {
+		t.Errorf("got error %v, want %T", err, want)
+	}
+}
+
+func TestTemplate_Bind(t *testing.T) {
+	tmpl, err := esitmpl.Compile([]byte(`<esi:include src="/$(A)"/>`))
+	if err != nil {
+		t.Fatalf("failed to compile template: %v", err)
+	}
+
+	client := esiproc.ClientFunc(func(_ context.Context, urlStr string, _ map[string]string) ([]byte, error) {
+		return []byte("include " + urlStr), nil
+	})
+
+	p := esiproc.New(esiproc.WithClient(client))
+
+	bound := tmpl.Bind(esitmpl.Bindings{Env: newEnv(map[string]string{"A": "a"}), Processor: p})
+
+	for range 2 {
+		var b strings.Builder
+
+		if _, err := bound.Process(t.Context(), &b); err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		if diff := cmp.Diff("include /a", b.String()); diff != "" {
+			t.Errorf("output mismatch (-want +got):\n%s", diff)
+		}
+	}
+
+	if err := p.Close(t.Context()); err != nil {
+		t.Fatalf("failed to close processor: %v", err)
+	}
+
+	if _, err := bound.Process(t.Context(), io.Discard); !errors.Is(err, &esiproc.ClosedError{}) {
+		t.Errorf("got error %v after closing processor, want %v", err, &esiproc.ClosedError{})
+	}
+}
+
+func TestTemplate_Process_StrictEnv(t *testing.T) {
+	tmpl, err := esitmpl.Compile([]byte(`<esi:choose><esi:when test="'\'a' == '\'a'">a</esi:when></esi:choose>`))
+	if err != nil {
+		t.Fatalf("failed to compile template: %v", err)
+	}
+
+	env := newEnv(nil)
+
+	if _, err := tmpl.Process(t.Context(), io.Discard, esitmpl.Bindings{Env: env}); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	env.Strict = true
+
+	if _, err := tmpl.Process(t.Context(), io.Discard, esitmpl.Bindings{Env: env}); err == nil {
+		t.Error("expected error for extended syntax with strict environment")
+	}
+}
+
+func TestTemplate_Nodes(t *testing.T) {
+	tmpl, err := esitmpl.Compile([]byte(`<esi:remove>a</esi:remove>b`))
+	if err != nil {
+		t.Fatalf("failed to compile template: %v", err)
+	}
+
+	nodes := tmpl.Nodes()
+	nodes[1].(*esi.RawData).Bytes[0] = 'x'
+
+	if diff := cmp.Diff("b", string(tmpl.Nodes()[1].(*esi.RawData).Bytes)); diff != "" {
+		t.Errorf("template was modified (-want +got):\n%s", diff)
+	}
+}
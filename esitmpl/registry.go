@@ -0,0 +1,328 @@
+package esitmpl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"iter"
+	"maps"
+	"path"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nussjustin/esi/internal/diag"
+)
+
+// LoadError is returned by [Registry] when loading or compiling a template fails.
+type LoadError struct {
+	// Name is the name of the template.
+	Name string
+
+	// Err is the underlying error.
+	Err error
+}
+
+// Code returns a machine-readable code identifying the type of the error.
+func (*LoadError) Code() string {
+	return "esitmpl.load"
+}
+
+// Error returns a human-readable error message.
+func (l *LoadError) Error() string {
+	return fmt.Sprintf("failed to load template %q: %s", l.Name, l.Err)
+}
+
+// Is checks if the given error matches the receiver.
+func (l *LoadError) Is(err error) bool {
+	var o *LoadError
+	return errors.As(err, &o) && o.Name == l.Name && errors.Is(o.Err, l.Err)
+}
+
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (l *LoadError) MarshalJSON() ([]byte, error) {
+	return diag.Marshal(l, diag.Diagnostic{Details: map[string]any{"name": l.Name}, Cause: diag.Cause(l.Err)})
+}
+
+// Unwrap returns the underlying error.
+func (l *LoadError) Unwrap() error {
+	return l.Err
+}
+
+// Notifier blocks until one or more templates may have changed and returns the names of the changed templates.
+//
+// If the names of the changed templates are not known, Notifier may return an empty slice, in which case all
+// templates are reloaded.
+//
+// Notifier must return when the given context is canceled.
+type Notifier func(ctx context.Context) ([]string, error)
+
+// Registry holds compiled templates loaded from an [fs.FS].
+//
+// Templates can be reloaded at any time. Reloading compiles the changed templates and then replaces the set of
+// templates atomically, so that concurrent lookups see either the old or the new set, but never a mix of both.
+//
+// To load templates from a directory, use [os.DirFS].
+//
+// A Registry is safe for concurrent use.
+type Registry struct {
+	fsys     fs.FS
+	patterns []string
+	opts     []CompileOpt
+
+	// mu serializes loads.
+	mu        sync.Mutex
+	templates atomic.Pointer[map[string]*Template]
+}
+
+// NewRegistry returns a new, empty [Registry] for the templates in fsys matching any of the given patterns.
+//
+// The patterns use the syntax of [path.Match] and are matched against the slash-separated names of the files in
+// fsys. If no patterns are given, all regular files are used.
+//
+// The given options are used when compiling templates.
+//
+// Templates must be loaded using [Registry.Load] before they can be looked up.
+func NewRegistry(fsys fs.FS, patterns []string, opts ...CompileOpt) *Registry {
+	r := &Registry{fsys: fsys, patterns: slices.Clone(patterns), opts: opts}
+	r.templates.Store(&map[string]*Template{})
+	return r
+}
+
+// Load loads and compiles all matching templates and replaces all currently loaded templates.
+//
+// If any template fails to load, no templates are replaced and the errors for all failed templates are returned
+// joined using [errors.Join]. Each error is a [LoadError].
+func (r *Registry) Load() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	names, err := r.list()
+	if err != nil {
+		return err
+	}
+
+	templates := make(map[string]*Template, len(names))
+
+	if err := r.compile(templates, names); err != nil {
+		return err
+	}
+
+	r.templates.Store(&templates)
+	return nil
+}
+
+// Lookup returns the template with the given name.
+func (r *Registry) Lookup(name string) (*Template, bool) {
+	t, ok := (*r.templates.Load())[name]
+	return t, ok
+}
+
+// Names returns an iterator over the names of all loaded templates in lexical order.
+func (r *Registry) Names() iter.Seq[string] {
+	return slices.Values(slices.Sorted(maps.Keys(*r.templates.Load())))
+}
+
+// PollNotifier returns a [Notifier] that checks the files of the registry for changes in the given interval.
+//
+// Files are compared using their modification time and size. New and removed files are reported as changed.
+//
+// The returned Notifier must not be called concurrently.
+func (r *Registry) PollNotifier(interval time.Duration) Notifier {
+	type fileState struct {
+		modTime time.Time
+		size    int64
+	}
+
+	scan := func() (map[string]fileState, error) {
+		names, err := r.list()
+		if err != nil {
+			return nil, err
+		}
+
+		states := make(map[string]fileState, len(names))
+
+		for _, name := range names {
+			info, err := fs.Stat(r.fsys, name)
+			if err != nil {
+				// The file was removed while scanning. It will be reported by the next scan.
+				continue
+			}
+
+			states[name] = fileState{modTime: info.ModTime(), size: info.Size()}
+		}
+
+		return states, nil
+	}
+
+	last, lastErr := scan()
+
+	return func(ctx context.Context) ([]string, error) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-ticker.C:
+			}
+
+			states, err := scan()
+			if err != nil {
+				return nil, err
+			}
+
+			// Without a previous successful scan the changes are unknown, so report all templates as changed.
+			if lastErr != nil {
+				last, lastErr = states, nil
+				return nil, nil
+			}
+
+			var changed []string
+
+			for name, state := range states {
+				if old, ok := last[name]; !ok || !old.modTime.Equal(state.modTime) || old.size != state.size {
+					changed = append(changed, name)
+				}
+			}
+
+			for name := range last {
+				if _, ok := states[name]; !ok {
+					changed = append(changed, name)
+				}
+			}
+
+			last = states
+
+			if len(changed) > 0 {
+				slices.Sort(changed)
+				return changed, nil
+			}
+		}
+	}
+}
+
+// Reload reloads the templates with the given names.
+//
+// Templates that do not exist anymore are removed. Names that do not match the patterns of the registry are ignored.
+// If no names are given, Reload is the same as [Registry.Load].
+//
+// If any template fails to load, no templates are replaced and the errors for all failed templates are returned
+// joined using [errors.Join]. Each error is a [LoadError].
+func (r *Registry) Reload(names ...string) error {
+	if len(names) == 0 {
+		return r.Load()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	templates := maps.Clone(*r.templates.Load())
+
+	var load []string
+
+	for _, name := range names {
+		if !r.match(name) {
+			continue
+		}
+
+		info, err := fs.Stat(r.fsys, name)
+
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			delete(templates, name)
+		case err != nil:
+			return &LoadError{Name: name, Err: err}
+		case !info.Mode().IsRegular():
+			delete(templates, name)
+		default:
+			load = append(load, name)
+		}
+	}
+
+	if err := r.compile(templates, load); err != nil {
+		return err
+	}
+
+	r.templates.Store(&templates)
+	return nil
+}
+
+// Watch calls n in a loop and reloads all templates reported as changed, until ctx is canceled or n returns an error.
+//
+// Errors returned by [Registry.Reload] are passed to onError, if not nil, and do not stop watching.
+//
+// Watch returns the error returned by n, or the error of ctx if ctx was canceled.
+func (r *Registry) Watch(ctx context.Context, n Notifier, onError func(error)) error {
+	for {
+		names, err := n(ctx)
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+
+			return err
+		}
+
+		if err := r.Reload(names...); err != nil && onError != nil {
+			onError(err)
+		}
+	}
+}
+
+func (r *Registry) compile(templates map[string]*Template, names []string) error {
+	var errs []error
+
+	for _, name := range names {
+		data, err := fs.ReadFile(r.fsys, name)
+		if err != nil {
+			errs = append(errs, &LoadError{Name: name, Err: err})
+			continue
+		}
+
+		t, err := Compile(data, r.opts...)
+		if err != nil {
+			errs = append(errs, &LoadError{Name: name, Err: err})
+			continue
+		}
+
+		templates[name] = t
+	}
+
+	return errors.Join(errs...)
+}
+
+func (r *Registry) list() ([]string, error) {
+	var names []string
+
+	err := fs.WalkDir(r.fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.Type().IsRegular() && r.match(name) {
+			names = append(names, name)
+		}
+
+		return nil
+	})
+
+	return names, err
+}
+
+func (r *Registry) match(name string) bool {
+	if len(r.patterns) == 0 {
+		return true
+	}
+
+	for _, pattern := range r.patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
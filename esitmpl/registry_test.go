@@ -0,0 +1,222 @@
+package esitmpl_test
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/nussjustin/esi/esitmpl"
+)
+
+func render(t *testing.T, r *esitmpl.Registry, name string) string {
+	t.Helper()
+
+	tmpl, ok := r.Lookup(name)
+	if !ok {
+		t.Fatalf("template %q not found", name)
+	}
+
+	var b strings.Builder
+
+	if _, err := tmpl.Process(context.Background(), &b, esitmpl.Bindings{}); err != nil {
+		t.Fatalf("failed to process template %q: %v", name, err)
+	}
+
+	return b.String()
+}
+
+func TestRegistry(t *testing.T) {
+	fsys := fstest.MapFS{
+		"layouts/a.html":  {Data: []byte(`a<esi:remove>removed</esi:remove>`)},
+		"layouts/b.html":  {Data: []byte(`b`)},
+		"layouts/c.txt":   {Data: []byte(`c`)},
+		"other/d.html":    {Data: []byte(`d`)},
+		"layouts/sub/e.h": {Data: []byte(`e`)},
+	}
+
+	r := esitmpl.NewRegistry(fsys, []string{"layouts/*.html"})
+
+	if _, ok := r.Lookup("layouts/a.html"); ok {
+		t.Errorf("found template before loading")
+	}
+
+	if err := r.Load(); err != nil {
+		t.Fatalf("failed to load templates: %v", err)
+	}
+
+	if diff := cmp.Diff([]string{"layouts/a.html", "layouts/b.html"}, slices.Collect(r.Names())); diff != "" {
+		t.Errorf("names mismatch (-want +got):\n%s", diff)
+	}
+
+	if got := render(t, r, "layouts/a.html"); got != "a" {
+		t.Errorf("got %q, want %q", got, "a")
+	}
+
+	t.Run("Reload", func(t *testing.T) {
+		fsys["layouts/a.html"] = &fstest.MapFile{Data: []byte(`a2`)}
+		fsys["layouts/new.html"] = &fstest.MapFile{Data: []byte(`new`)}
+		delete(fsys, "layouts/b.html")
+
+		if err := r.Reload("layouts/a.html", "layouts/b.html", "layouts/new.html", "other/d.html"); err != nil {
+			t.Fatalf("failed to reload templates: %v", err)
+		}
+
+		want := []string{"layouts/a.html", "layouts/new.html"}
+		if diff := cmp.Diff(want, slices.Collect(r.Names())); diff != "" {
+			t.Errorf("names mismatch (-want +got):\n%s", diff)
+		}
+
+		if got := render(t, r, "layouts/a.html"); got != "a2" {
+			t.Errorf("got %q, want %q", got, "a2")
+		}
+
+		if got := render(t, r, "layouts/new.html"); got != "new" {
+			t.Errorf("got %q, want %q", got, "new")
+		}
+	})
+
+	t.Run("Reload error", func(t *testing.T) {
+		fsys["layouts/a.html"] = &fstest.MapFile{Data: []byte(`a3`)}
+		fsys["layouts/new.html"] = &fstest.MapFile{Data: []byte(`<esi:choose>`)}
+
+		err := r.Reload("layouts/a.html", "layouts/new.html")
+
+		var loadErr *esitmpl.LoadError
+		if !errors.As(err, &loadErr) || loadErr.Name != "layouts/new.html" {
+			t.Fatalf("got error %v, want LoadError for layouts/new.html", err)
+		}
+
+		// No template must have been replaced.
+		if got := render(t, r, "layouts/a.html"); got != "a2" {
+			t.Errorf("got %q, want %q", got, "a2")
+		}
+
+		if got := render(t, r, "layouts/new.html"); got != "new" {
+			t.Errorf("got %q, want %q", got, "new")
+		}
+	})
+
+	t.Run("Load error", func(t *testing.T) {
+		err := r.Load()
+
+		var loadErr *esitmpl.LoadError
+		if !errors.As(err, &loadErr) || loadErr.Name != "layouts/new.html" {
+			t.Fatalf("got error %v, want LoadError for layouts/new.html", err)
+		}
+
+		if got := render(t, r, "layouts/a.html"); got != "a2" {
+			t.Errorf("got %q, want %q", got, "a2")
+		}
+	})
+}
+
+func TestRegistry_AllFiles(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.html":     {Data: []byte(`a`)},
+		"sub/b.html": {Data: []byte(`b`)},
+	}
+
+	r := esitmpl.NewRegistry(fsys, nil)
+
+	if err := r.Load(); err != nil {
+		t.Fatalf("failed to load templates: %v", err)
+	}
+
+	if diff := cmp.Diff([]string{"a.html", "sub/b.html"}, slices.Collect(r.Names())); diff != "" {
+		t.Errorf("names mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestRegistry_PollNotifier(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.html": {Data: []byte(`a`), ModTime: time.Unix(1, 0)},
+		"b.html": {Data: []byte(`b`), ModTime: time.Unix(1, 0)},
+	}
+
+	r := esitmpl.NewRegistry(fsys, []string{"*.html"})
+
+	notify := r.PollNotifier(time.Millisecond)
+
+	fsys["a.html"] = &fstest.MapFile{Data: []byte(`a`), ModTime: time.Unix(2, 0)}
+	fsys["c.html"] = &fstest.MapFile{Data: []byte(`c`)}
+	delete(fsys, "b.html")
+
+	names, err := notify(context.Background())
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	if diff := cmp.Diff([]string{"a.html", "b.html", "c.html"}, names); diff != "" {
+		t.Errorf("names mismatch (-want +got):\n%s", diff)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := notify(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestRegistry_Watch(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.html": {Data: []byte(`a`)},
+	}
+
+	r := esitmpl.NewRegistry(fsys, nil)
+
+	if err := r.Load(); err != nil {
+		t.Fatalf("failed to load templates: %v", err)
+	}
+
+	changes := []func(){
+		func() { fsys["a.html"] = &fstest.MapFile{Data: []byte(`a2`)} },
+		func() { fsys["a.html"] = &fstest.MapFile{Data: []byte(`<esi:choose>`)} },
+	}
+
+	errNotifier := errors.New("notifier failed")
+
+	notify := func(context.Context) ([]string, error) {
+		if len(changes) == 0 {
+			return nil, errNotifier
+		}
+
+		changes[0]()
+		changes = changes[1:]
+
+		return []string{"a.html"}, nil
+	}
+
+	var reloadErrs []error
+
+	err := r.Watch(context.Background(), notify, func(err error) {
+		reloadErrs = append(reloadErrs, err)
+	})
+	if !errors.Is(err, errNotifier) {
+		t.Errorf("got error %v, want %v", err, errNotifier)
+	}
+
+	if len(reloadErrs) != 1 {
+		t.Errorf("got %d reload errors, want 1", len(reloadErrs))
+	}
+
+	if got := render(t, r, "a.html"); got != "a2" {
+		t.Errorf("got %q, want %q", got, "a2")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err = r.Watch(ctx, func(ctx context.Context) ([]string, error) {
+		return nil, ctx.Err()
+	}, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+}
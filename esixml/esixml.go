@@ -7,10 +7,13 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"iter"
 	"strconv"
 	"strings"
 	"unicode"
 	"unicode/utf8"
+
+	"github.com/nussjustin/esi/internal/diag"
 )
 
 // See also https://www.w3.org/TR/esi-lang/, 3. ESI Elements.
@@ -116,6 +119,48 @@ func bytesToString(b []byte) string {
 	return string(b)
 }
 
+// ErrNeedMoreData is returned by [Reader.Next] when reading data passed via [Reader.Feed] and the data fed so far
+// does not contain a complete token.
+//
+// Unlike other errors, ErrNeedMoreData is not permanent. After feeding more data, Next can be called again.
+var ErrNeedMoreData = errors.New("need more data")
+
+// ControlByteError is returned when encountering a NUL byte or other control byte while using [ControlBytesReject]
+// or inside ESI elements if the policy is not [ControlBytesAllow].
+type ControlByteError struct {
+	// At is the position in the input where the error occurred.
+	At int
+
+	// Byte is the control byte.
+	Byte byte
+}
+
+// Code returns a machine-readable code identifying the type of the error.
+func (*ControlByteError) Code() string {
+	return "esixml.control_byte"
+}
+
+// Error returns a human-readable error message.
+func (c *ControlByteError) Error() string {
+	return fmt.Sprintf("control byte 0x%02x at offset %d", c.Byte, c.At)
+}
+
+// Is checks if the given error matches the receiver.
+func (c *ControlByteError) Is(err error) bool {
+	var o *ControlByteError
+	return errors.As(err, &o) && *o == *c
+}
+
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (c *ControlByteError) MarshalJSON() ([]byte, error) {
+	return diag.Marshal(c, diag.Diagnostic{Offset: diag.Int(c.At), Got: fmt.Sprintf("0x%02x", c.Byte)})
+}
+
+// Offset returns c.At.
+func (c *ControlByteError) Offset() int {
+	return c.At
+}
+
 // DuplicateAttributeError is returned when encountering an ESI element with duplicate attributes.
 type DuplicateAttributeError struct {
 	// Offset is the position in the input where the error occurred.
@@ -125,6 +170,11 @@ type DuplicateAttributeError struct {
 	Name string
 }
 
+// Code returns a machine-readable code identifying the type of the error.
+func (*DuplicateAttributeError) Code() string {
+	return "esixml.duplicate_attribute"
+}
+
 // Error returns a human-readable error message.
 func (d *DuplicateAttributeError) Error() string {
 	return fmt.Sprintf("duplicate attribute %q at offset %d", d.Name, d.At)
@@ -136,6 +186,11 @@ func (d *DuplicateAttributeError) Is(err error) bool {
 	return errors.As(err, &o) && *o == *d
 }
 
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (d *DuplicateAttributeError) MarshalJSON() ([]byte, error) {
+	return diag.Marshal(d, diag.Diagnostic{Offset: diag.Int(d.At), Attribute: d.Name})
+}
+
 // Offset returns d.At.
 func (d *DuplicateAttributeError) Offset() int {
 	return d.At
@@ -147,6 +202,11 @@ type InvalidNameError struct {
 	At int
 }
 
+// Code returns a machine-readable code identifying the type of the error.
+func (*InvalidNameError) Code() string {
+	return "esixml.invalid_name"
+}
+
 // Error returns a human-readable error message.
 func (i *InvalidNameError) Error() string {
 	return fmt.Sprintf("invalid name at offset %d", i.At)
@@ -158,11 +218,48 @@ func (i *InvalidNameError) Is(err error) bool {
 	return errors.As(err, &o) && *o == *i
 }
 
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (i *InvalidNameError) MarshalJSON() ([]byte, error) {
+	return diag.Marshal(i, diag.Diagnostic{Offset: diag.Int(i.At)})
+}
+
 // Offset returns i.At.
 func (i *InvalidNameError) Offset() int {
 	return i.At
 }
 
+// InvalidUTF8Error is returned when encountering invalid UTF-8 in data while using [WithUTF8Validation].
+type InvalidUTF8Error struct {
+	// At is the position in the input where the error occurred.
+	At int
+}
+
+// Code returns a machine-readable code identifying the type of the error.
+func (*InvalidUTF8Error) Code() string {
+	return "esixml.invalid_utf8"
+}
+
+// Error returns a human-readable error message.
+func (i *InvalidUTF8Error) Error() string {
+	return fmt.Sprintf("invalid UTF-8 at offset %d", i.At)
+}
+
+// Is checks if the given error matches the receiver.
+func (i *InvalidUTF8Error) Is(err error) bool {
+	var o *InvalidUTF8Error
+	return errors.As(err, &o) && *o == *i
+}
+
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (i *InvalidUTF8Error) MarshalJSON() ([]byte, error) {
+	return diag.Marshal(i, diag.Diagnostic{Offset: diag.Int(i.At)})
+}
+
+// Offset returns i.At.
+func (i *InvalidUTF8Error) Offset() int {
+	return i.At
+}
+
 // SyntaxError is returned when encountering invalid XML when processing ESI elements.
 type SyntaxError struct {
 	// Offset is the position in the input where the error occurred.
@@ -175,6 +272,11 @@ type SyntaxError struct {
 	Underlying error
 }
 
+// Code returns a machine-readable code identifying the type of the error.
+func (*SyntaxError) Code() string {
+	return "esixml.syntax"
+}
+
 // Error returns a human-readable error message.
 func (s *SyntaxError) Error() string {
 	switch {
@@ -195,6 +297,11 @@ func (s *SyntaxError) Is(err error) bool {
 	return errors.As(err, &o) && o.At == s.At && o.Message == s.Message
 }
 
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (s *SyntaxError) MarshalJSON() ([]byte, error) {
+	return diag.Marshal(s, diag.Diagnostic{Offset: diag.Int(s.At), Cause: diag.Cause(s.Underlying)})
+}
+
 // Offset returns s.At.
 func (s *SyntaxError) Offset() int {
 	return s.At
@@ -217,6 +324,11 @@ type UnexpectedCharacterError struct {
 	Expected byte
 }
 
+// Code returns a machine-readable code identifying the type of the error.
+func (*UnexpectedCharacterError) Code() string {
+	return "esixml.unexpected_character"
+}
+
 // Error returns a human-readable error message.
 func (u *UnexpectedCharacterError) Error() string {
 	return fmt.Sprintf("unexpected character '%c' at offset %d, '%c' expected", u.Got, u.At, u.Expected)
@@ -228,6 +340,15 @@ func (u *UnexpectedCharacterError) Is(err error) bool {
 	return errors.As(err, &o) && *o == *u
 }
 
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (u *UnexpectedCharacterError) MarshalJSON() ([]byte, error) {
+	return diag.Marshal(u, diag.Diagnostic{
+		Offset:   diag.Int(u.At),
+		Expected: []string{string(u.Expected)},
+		Got:      string(u.Got),
+	})
+}
+
 // Offset returns u.At.
 func (u *UnexpectedCharacterError) Offset() int {
 	return u.At
@@ -242,6 +363,11 @@ type UnexpectedEndOfInput struct {
 	Expected byte
 }
 
+// Code returns a machine-readable code identifying the type of the error.
+func (*UnexpectedEndOfInput) Code() string {
+	return "esixml.unexpected_end_of_input"
+}
+
 // Error returns a human-readable error message.
 func (u *UnexpectedEndOfInput) Error() string {
 	if u.Expected == 0 {
@@ -256,6 +382,15 @@ func (u *UnexpectedEndOfInput) Is(err error) bool {
 	return errors.As(err, &o) && *o == *u
 }
 
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (u *UnexpectedEndOfInput) MarshalJSON() ([]byte, error) {
+	d := diag.Diagnostic{Offset: diag.Int(u.At)}
+	if u.Expected != 0 {
+		d.Expected = []string{string(u.Expected)}
+	}
+	return diag.Marshal(u, d)
+}
+
 // Offset returns u.At.
 func (u *UnexpectedEndOfInput) Offset() int {
 	return u.At
@@ -267,6 +402,11 @@ type UnsupportedEntityError struct {
 	Offset int
 }
 
+// Code returns a machine-readable code identifying the type of the error.
+func (*UnsupportedEntityError) Code() string {
+	return "esixml.unsupported_entity"
+}
+
 // Error returns a human-readable error message.
 func (u *UnsupportedEntityError) Error() string {
 	return fmt.Sprintf("unsupported XML entity at offset %d", u.Offset)
@@ -278,10 +418,22 @@ func (u *UnsupportedEntityError) Is(err error) bool {
 	return errors.As(err, &o) && *o == *u
 }
 
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (u *UnsupportedEntityError) MarshalJSON() ([]byte, error) {
+	return diag.Marshal(u, diag.Diagnostic{Offset: diag.Int(u.Offset)})
+}
+
 type Attr struct {
-	// Position contains the position of the attribute in the input.
+	// Position contains the position of the attribute in the input, from the start of the name to the end of the
+	// value.
 	Position Position
 
+	// NamePosition contains the position of the attribute name in the input.
+	NamePosition Position
+
+	// ValuePosition contains the position of the raw attribute value in the input, excluding any quotes.
+	ValuePosition Position
+
 	// Name contains the attribute name.
 	Name Name
 
@@ -328,6 +480,10 @@ func (p Position) String() string {
 // Token represents a parsed "token" returned by a [Reader].
 type Token struct {
 	// Position contains the position of the token in the input.
+	//
+	// Positions are byte offsets, including the offset configured using [WithStartOffset]. For the last token,
+	// including a data token that is terminated by the end of the input, End is exactly the offset of the end of the
+	// input.
 	Position Position
 
 	// Type describes the type of the token.
@@ -339,7 +495,8 @@ type Token struct {
 	// Attr are the attributes of the XML element if Type is [TokenTypeElementStart].
 	Attr []Attr
 
-	// Data contains the raw data if Type is [TokenTypeData].
+	// Data contains the raw data if Type is [TokenTypeData], or the complete declaration if Type is
+	// [TokenTypeXMLDeclaration] or [TokenTypeDoctype].
 	//
 	// The data may be anything, including valid XML.
 	Data []byte
@@ -348,14 +505,14 @@ type Token struct {
 	Closed bool
 }
 
-func (t *Token) hasAttr(name Name) bool {
-	for _, attr := range t.Attr {
+func (t *Token) attrIndex(name Name) int {
+	for i, attr := range t.Attr {
 		if attr.Name == name {
-			return true
+			return i
 		}
 	}
 
-	return false
+	return -1
 }
 
 // TokenType is an enum of the possible types of tokens.
@@ -372,6 +529,8 @@ const (
 	TokenTypeCommentStart
 
 	// TokenTypeESICommentStart is used for tokens representing the start of an ESI comment, aka "<!--esi".
+	//
+	// These tokens are not returned when using [WithoutESIComments].
 	TokenTypeESICommentStart
 
 	// TokenTypeStartElement indicates that a [Token] represents a starting ESI element, e.g. "<esi:include".
@@ -382,6 +541,16 @@ const (
 
 	// TokenTypeData indicates that a [Token] contains raw, unprocessed data.
 	TokenTypeData
+
+	// TokenTypeXMLDeclaration is used for tokens representing an XML declaration, e.g. "<?xml version="1.0"?>".
+	//
+	// Tokens of this type are only returned when using [WithDeclarationTokens].
+	TokenTypeXMLDeclaration
+
+	// TokenTypeDoctype is used for tokens representing a document type declaration, e.g. "<!DOCTYPE html>".
+	//
+	// Tokens of this type are only returned when using [WithDeclarationTokens].
+	TokenTypeDoctype
 )
 
 // String returns the name of the type.
@@ -401,33 +570,295 @@ func (t TokenType) String() string {
 		return "TokenTypeEndElement"
 	case TokenTypeData:
 		return "TokenTypeData"
+	case TokenTypeXMLDeclaration:
+		return "TokenTypeXMLDeclaration"
+	case TokenTypeDoctype:
+		return "TokenTypeDoctype"
 	default:
 		panic("unknown token type")
 	}
 }
 
+// ReaderOpt is the type for functions that can be used to customize the behaviour of a [Reader].
+type ReaderOpt func(*readerOptions)
+
+type readerOptions struct {
+	controlBytePolicy   ControlBytePolicy
+	declarationTokens   bool
+	disableESIComments  bool
+	duplicateAttrPolicy DuplicateAttrPolicy
+	entities            map[string]string
+	maxDataSize         int
+	recoverSyntax       bool
+	startOffset         int
+	stripCDATA          bool
+	validateUTF8        bool
+}
+
+// ControlBytePolicy defines how a [Reader] handles NUL bytes and other control bytes.
+//
+// Control bytes are all bytes below 0x20, except for tabs, line feeds and carriage returns, and the DEL byte (0x7f).
+//
+// Inside ESI elements, control bytes are only allowed inside quoted attribute values. Everywhere else inside an ESI
+// element, a control byte results in a [ControlByteError] unless the policy is [ControlBytesAllow].
+type ControlBytePolicy uint8
+
+const (
+	// ControlBytesAllow passes control bytes through as is.
+	//
+	// This is the default.
+	ControlBytesAllow ControlBytePolicy = iota
+
+	// ControlBytesReject causes a [ControlByteError] to be returned for the first control byte in the input.
+	ControlBytesReject
+
+	// ControlBytesStrip removes control bytes from data and quoted attribute values.
+	ControlBytesStrip
+
+	// ControlBytesReplace replaces control bytes in data and quoted attribute values with the Unicode replacement
+	// character U+FFFD.
+	ControlBytesReplace
+)
+
+// String returns the name of the policy.
+func (c ControlBytePolicy) String() string {
+	switch c {
+	case ControlBytesAllow:
+		return "ControlBytesAllow"
+	case ControlBytesReject:
+		return "ControlBytesReject"
+	case ControlBytesStrip:
+		return "ControlBytesStrip"
+	case ControlBytesReplace:
+		return "ControlBytesReplace"
+	default:
+		panic("unknown control byte policy")
+	}
+}
+
+// DuplicateAttrPolicy defines how a [Reader] handles elements with multiple attributes of the same name.
+type DuplicateAttrPolicy uint8
+
+const (
+	// DuplicateAttrReject causes a [DuplicateAttributeError] to be returned for duplicate attributes.
+	//
+	// This is the default.
+	DuplicateAttrReject DuplicateAttrPolicy = iota
+
+	// DuplicateAttrKeepFirst keeps the first attribute and ignores all later attributes with the same name.
+	DuplicateAttrKeepFirst
+
+	// DuplicateAttrKeepLast keeps the last attribute with a given name.
+	//
+	// The attribute replaces the first attribute with the same name, keeping the position of the first attribute in
+	// the list of attributes.
+	DuplicateAttrKeepLast
+)
+
+// String returns the name of the policy.
+func (d DuplicateAttrPolicy) String() string {
+	switch d {
+	case DuplicateAttrReject:
+		return "DuplicateAttrReject"
+	case DuplicateAttrKeepFirst:
+		return "DuplicateAttrKeepFirst"
+	case DuplicateAttrKeepLast:
+		return "DuplicateAttrKeepLast"
+	default:
+		panic("unknown duplicate attribute policy")
+	}
+}
+
+// WithCDATAStripping configures a [Reader] to remove the "<![CDATA[" and "]]>" markers around CDATA sections from
+// the data of [TokenTypeData] tokens, so that only the content of the sections is returned.
+//
+// The content of each CDATA section is returned in separate tokens, whose positions exclude the removed markers.
+//
+// By default, CDATA sections are returned as is, including the markers. See [Reader] for how CDATA sections are
+// handled.
+func WithCDATAStripping() ReaderOpt {
+	return func(r *readerOptions) {
+		r.stripCDATA = true
+	}
+}
+
+// WithControlBytePolicy specifies how NUL bytes and other control bytes are handled.
+//
+// When using [ControlBytesStrip] or [ControlBytesReplace], the length of [Token.Data] may differ from the length of
+// the input described by [Token.Position].
+//
+// The default is [ControlBytesAllow].
+func WithControlBytePolicy(policy ControlBytePolicy) ReaderOpt {
+	return func(r *readerOptions) {
+		r.controlBytePolicy = policy
+	}
+}
+
+// WithDeclarationTokens enables returning XML declarations ("<?xml ...?>") and document type declarations
+// ("<!DOCTYPE ...>") outside of comments as separate tokens of type [TokenTypeXMLDeclaration] and [TokenTypeDoctype].
+//
+// By default, declarations are returned as part of [TokenTypeData] tokens.
+func WithDeclarationTokens() ReaderOpt {
+	return func(r *readerOptions) {
+		r.declarationTokens = true
+	}
+}
+
+// WithDuplicateAttrPolicy specifies how duplicate attributes on ESI elements are handled.
+//
+// The default is [DuplicateAttrReject].
+func WithDuplicateAttrPolicy(policy DuplicateAttrPolicy) ReaderOpt {
+	return func(r *readerOptions) {
+		r.duplicateAttrPolicy = policy
+	}
+}
+
+// WithEntities registers additional named entities that can be used inside quoted attribute values, for example
+// entities defined in the DOCTYPE of a document.
+//
+// Entity names are case-insensitive. The predefined XML entities (lt, gt, amp, apos and quot) can not be overridden.
+//
+// If WithEntities is given multiple times, the entities are merged, with later values taking precedence.
+func WithEntities(entities map[string]string) ReaderOpt {
+	return func(r *readerOptions) {
+		if r.entities == nil {
+			r.entities = make(map[string]string, len(entities))
+		}
+
+		for name, value := range entities {
+			r.entities[strings.ToLower(name)] = value
+		}
+	}
+}
+
+// WithMaxDataSize configures a [Reader] to split data into multiple [TokenTypeData] tokens, so that no token
+// contains more than n bytes.
+//
+// Tokens are only split at rune boundaries, so that each token contains complete UTF-8 sequences if the input is
+// valid UTF-8.
+//
+// This bounds the memory needed for a single token when reading documents with large amounts of data between
+// elements. See also [github.com/nussjustin/esi.WithSpill].
+//
+// If n is 0, data tokens are not limited. This is the default.
+//
+// If n is < 0, WithMaxDataSize panics.
+func WithMaxDataSize(n int) ReaderOpt {
+	if n < 0 {
+		panic("WithMaxDataSize called with n < 0")
+	}
+
+	return func(r *readerOptions) {
+		r.maxDataSize = n
+	}
+}
+
+// WithStartOffset configures a [Reader] to report positions as if the input started at the given offset.
+//
+// This is useful when reading only the remaining part of a larger document, so that positions are relative to the
+// start of the whole document.
+//
+// If offset is < 0, WithStartOffset panics.
+func WithStartOffset(offset int) ReaderOpt {
+	if offset < 0 {
+		panic("WithStartOffset called with offset < 0")
+	}
+
+	return func(r *readerOptions) {
+		r.startOffset = offset
+	}
+}
+
+// WithSyntaxErrorRecovery configures a [Reader] to recover from syntax errors in ESI start and end tags.
+//
+// Instead of failing with an error, the invalid tag is returned as part of a [TokenTypeData] token, up to and
+// including the next '>' character, and reading continues after it. This is useful for documents where text that
+// looks like an ESI tag appears in places where it is not meant as markup, for example "<esi:" inside inline
+// JavaScript.
+//
+// Unlike [Reader.Recover], the skipped input is not lost. Errors that are not caused by invalid markup, for example an
+// unexpected end of input or a read error, are still returned.
+//
+// Tags longer than the internal buffer of the Reader can not be recovered. For these the error is returned as usual.
+func WithSyntaxErrorRecovery() ReaderOpt {
+	return func(r *readerOptions) {
+		r.recoverSyntax = true
+	}
+}
+
+// WithUTF8Validation configures a [Reader] to ensure that the data of all [TokenTypeData] tokens is valid UTF-8.
+//
+// Invalid UTF-8 results in an [InvalidUTF8Error]. When reading data passed via [Reader.Feed], data tokens are only
+// split at rune boundaries, so that a rune split between multiple calls to Feed is returned as part of a single token.
+func WithUTF8Validation() ReaderOpt {
+	return func(r *readerOptions) {
+		r.validateUTF8 = true
+	}
+}
+
+// WithoutESIComments disables the special handling of ESI comments ("<!--esi ...-->").
+//
+// ESI comments are then read like XML comments, starting with a [TokenTypeCommentStart] token, so that their content
+// is kept as is instead of being exposed when processed.
+//
+// By default, ESI comments start with a [TokenTypeESICommentStart] token.
+func WithoutESIComments() ReaderOpt {
+	return func(r *readerOptions) {
+		r.disableESIComments = true
+	}
+}
+
+// ChecksData returns true if a [Reader] using the given options checks or modifies the data outside of ESI elements,
+// that is if the options include [WithUTF8Validation] or a [ControlBytePolicy] other than [ControlBytesAllow].
+//
+// Code that copies data without reading it, for example to skip data that can not contain ESI markup, must not do so
+// if ChecksData returns true.
+func ChecksData(opts ...ReaderOpt) bool {
+	var o readerOptions
+
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return o.validateUTF8 || o.controlBytePolicy != ControlBytesAllow
+}
+
 // Reader allows reading ESI tags and attributes from a []byte.
 //
 // It only looks for opening and closing ESI tags and simply returns all other data unprocessed.
+//
+// ESI markup inside CDATA sections ("<![CDATA[ ... ]]>") is not interpreted. CDATA sections, including ESI tags
+// inside them, are returned as part of [TokenTypeData] tokens. CDATA sections are recognized in ESI comments, but not
+// in XML comments. An unterminated CDATA section extends to the end of the input.
 type Reader struct {
-	br     bufio.Reader
-	offset int
-	err    error
-
-	attrBuf [32]byte
-	nameBuf [32]byte
+	s    Scanner
+	err  error
+	opts readerOptions
 
+	inCDATA   bool
 	inComment bool
 
+	// recoverBuf contains a copy of the tag that is currently parsed, if syntax error recovery is enabled.
+	recoverBuf []byte
+
+	// attrIndexes maps attribute names to their index in the current element, once the element has more than
+	// maxLinearAttrs attributes. See Reader.attrIndex.
+	attrIndexes map[Name]int
+
+	feeding    bool
+	feed       []byte
+	feedClosed bool
+	feedReader bytes.Reader
+
 	stateFn func(*Reader) (Token, error)
 }
 
-// NewReader returns a new Reader set to read from in.
+// NewReader returns a new Reader set to read from in, using the given options.
 //
 // This is a shorthand for creating a new [Reader] and calling [Reader.Reset] on it.
-func NewReader(in io.Reader) *Reader {
+func NewReader(in io.Reader, opts ...ReaderOpt) *Reader {
 	r := &Reader{}
-	r.Reset(in)
+	r.Reset(in, opts...)
 	return r
 }
 
@@ -450,12 +881,74 @@ func (r *Reader) All(yield func(Token, error) bool) {
 	}
 }
 
+// Drive calls fn for each remaining token from the reader.
+//
+// Drive is an alternative to [Reader.All] and [Reader.Tokens] that avoids the overhead of iterators, which can be
+// useful in hot paths.
+//
+// If fn returns an error, Drive stops and returns the error. Otherwise Drive returns the first error returned by
+// [Reader.Next], or nil once all data was read.
+func (r *Reader) Drive(fn func(Token) error) error {
+	for {
+		t, err := r.Next()
+
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if err := fn(t); err != nil {
+			return err
+		}
+	}
+}
+
+// Tokens returns an iterator over all remaining tokens from the reader.
+//
+// This is the same as [Reader.All], but as a function returning an [iter.Seq2], for use in places that expect one.
+func (r *Reader) Tokens() iter.Seq2[Token, error] {
+	return r.All
+}
+
+// Done returns true if [Reader.Next] will not return any more tokens, either because the end of the input was
+// reached or because an error occurred.
+//
+// Done may already return true after Next returned the last token, before Next returned [io.EOF]. While waiting for
+// more data passed via [Reader.Feed], Done returns false.
+//
+// See also [Reader.Err].
+func (r *Reader) Done() bool {
+	return r.err != nil
+}
+
+// Err returns the error that stopped the Reader, if any.
+//
+// Unlike [Reader.Next], Err returns nil if the end of the input was reached without errors. [ErrNeedMoreData] is
+// never returned, since it is not permanent.
+func (r *Reader) Err() error {
+	if errors.Is(r.err, io.EOF) {
+		return nil
+	}
+
+	return r.err
+}
+
 // Next returns the next token if any.
 //
 // If an error occurred, future calls will return the same error.
 //
 // After all data was read, if there were no previous errors, Next will return [io.EOF].
+//
+// When reading data passed via [Reader.Feed], Next returns [ErrNeedMoreData] if no complete token is available and
+// [Reader.CloseFeed] was not yet called.
 func (r *Reader) Next() (Token, error) {
+	if r.feeding {
+		return r.nextFed()
+	}
+
 	var token Token
 
 	for {
@@ -473,115 +966,277 @@ func (r *Reader) Next() (Token, error) {
 
 // Reset resets the Reader to read from in.
 //
+// If in is nil, the Reader instead reads data passed to it via [Reader.Feed].
+//
+// Options from previous calls to NewReader or Reset are discarded and replaced by the given options.
+//
 // This allows re-using the reader for different inputs.
-func (r *Reader) Reset(in io.Reader) {
-	clear(r.nameBuf[:])
-	clear(r.attrBuf[:])
+func (r *Reader) Reset(in io.Reader, opts ...ReaderOpt) {
+	if in == nil {
+		in = &r.feedReader
+	}
+
+	r.opts = readerOptions{}
+
+	for _, opt := range opts {
+		opt(&r.opts)
+	}
 
-	r.br.Reset(in)
-	r.offset = 0
+	r.s.Reset(in)
+	r.s.SetControlBytePolicy(r.opts.controlBytePolicy)
+	r.s.SetEntities(r.opts.entities)
+	r.s.offset = r.opts.startOffset
 	r.err = nil
+	r.inCDATA = false
 	r.inComment = false
+	r.feeding = in == &r.feedReader
+	r.feed = r.feed[:0]
+	r.feedClosed = false
+	r.feedReader.Reset(nil)
 	r.stateFn = (*Reader).parseElementOrData
 }
 
-func (r *Reader) consume(b byte) bool {
-	b1, err := r.br.ReadByte()
-	if err != nil {
-		return false
+// Feed appends data to the input of the Reader.
+//
+// Feed can only be used if the Reader was reset using a nil [io.Reader]. Tokens are returned by [Reader.Next] as soon
+// as the data fed so far contains them. Data tokens may be split at arbitrary positions, so that data can be passed
+// on before the whole input was read.
+//
+// Once all data was fed, [Reader.CloseFeed] must be called to mark the end of the input.
+//
+// Feed panics if the Reader is not reading fed data or if [Reader.CloseFeed] was already called.
+func (r *Reader) Feed(data []byte) {
+	if !r.feeding {
+		panic("Feed called on Reader with io.Reader input")
+	}
+
+	if r.feedClosed {
+		panic("Feed called after CloseFeed")
+	}
+
+	r.feed = append(r.feed, data...)
+}
+
+// CloseFeed marks the end of the data passed via [Reader.Feed].
+//
+// After calling CloseFeed, [Reader.Next] will no longer return [ErrNeedMoreData] and instead return [io.EOF] once all
+// data was read.
+//
+// CloseFeed panics if the Reader is not reading fed data.
+func (r *Reader) CloseFeed() {
+	if !r.feeding {
+		panic("CloseFeed called on Reader with io.Reader input")
+	}
+
+	r.feedClosed = true
+}
+
+// Recover clears a syntax error returned by [Reader.Next] so that reading can continue after the invalid markup.
+//
+// On success, the rest of the invalid markup is skipped by discarding the input up to and including the next '>'
+// character and Recover returns true. Skipped input is not returned as data.
+//
+// Recover returns false and keeps the error if it was not caused by invalid markup, for example because of an error
+// when reading from the underlying [io.Reader] or because of an unexpected end of input, or if the Reader is reading
+// data passed via [Reader.Feed].
+//
+// If there was no error, Recover does nothing and returns true.
+func (r *Reader) Recover() bool {
+	if r.err == nil {
+		return true
 	}
 
-	if b1 != b {
-		_ = r.br.UnreadByte()
+	if r.feeding || !isSyntaxError(r.err) {
 		return false
 	}
 
-	r.offset++
-	return true
+	r.err = nil
+	r.stateFn = (*Reader).parseElementOrData
+
+	for {
+		b, err := r.s.ReadByte()
+		if err != nil || b == '>' {
+			return true
+		}
+	}
 }
 
-func (r *Reader) consumeOrError(b byte) error {
-	b1, err := r.br.ReadByte()
-	if err != nil {
-		if !errors.Is(err, io.EOF) {
-			return err
+func isSyntaxError(err error) bool {
+	var (
+		dupAttrErr     *DuplicateAttributeError
+		invalidNameErr *InvalidNameError
+		syntaxErr      *SyntaxError
+		unexpCharErr   *UnexpectedCharacterError
+		entityErr      *UnsupportedEntityError
+	)
+
+	return errors.As(err, &dupAttrErr) ||
+		errors.As(err, &invalidNameErr) ||
+		errors.As(err, &syntaxErr) ||
+		errors.As(err, &unexpCharErr) ||
+		errors.As(err, &entityErr)
+}
+
+func (r *Reader) nextFed() (Token, error) {
+	if r.err != nil {
+		return Token{}, r.err
+	}
+
+	offset, inCDATA, inComment, stateFn := r.s.offset, r.inCDATA, r.inComment, r.stateFn
+
+	r.feedReader.Reset(r.feed)
+	r.s.br.Reset(&r.feedReader)
+
+	var token Token
+	var err error
+
+	for token.Type == TokenTypeInvalid && err == nil {
+		token, err = r.stateFn(r)
+	}
+
+	if r.feedClosed {
+		r.err = err
+		r.feed = r.feed[r.s.offset-offset:]
+
+		if token.Type == TokenTypeInvalid {
+			return Token{}, err
+		}
+
+		return token, nil
+	}
+
+	var eoi *UnexpectedEndOfInput
+
+	switch {
+	case err == nil:
+	case token.Type == TokenTypeData && (errors.Is(err, io.EOF) || errors.Is(err, ErrNeedMoreData)):
+		// The data is complete, but we do not know yet what comes after it
+	case errors.Is(err, io.EOF), errors.Is(err, ErrNeedMoreData), errors.As(err, &eoi):
+		r.s.offset, r.inCDATA, r.inComment, r.stateFn = offset, inCDATA, inComment, stateFn
+		r.err = nil
+
+		return Token{}, ErrNeedMoreData
+	default:
+		r.err = err
+		return Token{}, err
+	}
+
+	r.err = nil
+	r.feed = r.feed[r.s.offset-offset:]
+
+	return token, nil
+}
+
+func (r *Reader) needMoreData(peeked, want int) bool {
+	return r.feeding && !r.feedClosed && peeked < want
+}
+
+func (r *Reader) createDataToken(data []byte, err error) (Token, error) {
+	if len(data) == 0 {
+		return Token{}, err
+	}
+
+	if r.opts.validateUTF8 {
+		if r.needMoreData(0, 1) {
+			// Keep incomplete runes at the end of the data for the next token
+			n := incompleteRuneSuffix(data)
+
+			data = data[:len(data)-n]
+			r.s.offset -= n
+
+			if len(data) == 0 {
+				return Token{}, err
+			}
 		}
 
-		return &UnexpectedEndOfInput{
-			At:       r.offset,
-			Expected: b,
+		if !utf8.Valid(data) {
+			return Token{}, &InvalidUTF8Error{At: r.s.offset - len(data) + indexInvalidUTF8(data)}
 		}
 	}
 
-	if b1 != b {
-		_ = r.br.UnreadByte()
+	start := r.s.offset - len(data)
+
+	if r.opts.controlBytePolicy != ControlBytesAllow {
+		if i := indexControlByte(data); i != -1 {
+			if r.opts.controlBytePolicy == ControlBytesReject {
+				return Token{}, &ControlByteError{At: start + i, Byte: data[i]}
+			}
 
-		return &UnexpectedCharacterError{
-			At:       r.offset,
-			Got:      b1,
-			Expected: b,
+			data = replaceControlBytes(data, i, r.opts.controlBytePolicy)
 		}
 	}
 
-	r.offset++
-	return nil
+	return Token{
+		Type: TokenTypeData,
+		Position: Position{
+			Start: start,
+			End:   r.s.offset,
+		},
+		Data: data,
+	}, err
 }
 
-func (r *Reader) discardSpaces() {
-	for {
-		c, err := r.br.ReadByte()
-		if err != nil {
-			return
+// incompleteRuneSuffix returns the length of the incomplete rune at the end of b, if any.
+func incompleteRuneSuffix(b []byte) int {
+	for i := 1; i <= utf8.UTFMax-1 && i <= len(b); i++ {
+		if !utf8.RuneStart(b[len(b)-i]) {
+			continue
 		}
 
-		switch c {
-		case ' ', '\r', '\n', '\t':
-			r.offset++
-		default:
-			_ = r.br.UnreadByte()
-			return
+		if utf8.FullRune(b[len(b)-i:]) {
+			return 0
 		}
+
+		return i
 	}
+
+	return 0
 }
 
-func (r *Reader) peek() (byte, bool) {
-	b, _ := r.br.Peek(1)
-	if len(b) == 0 {
-		return 0, false
+// indexInvalidUTF8 returns the index of the first invalid UTF-8 sequence in b or -1 if b is valid UTF-8.
+func indexInvalidUTF8(b []byte) int {
+	for i := 0; i < len(b); {
+		r, size := utf8.DecodeRune(b[i:])
+		if r == utf8.RuneError && size == 1 {
+			return i
+		}
+
+		i += size
 	}
-	return b[0], true
+
+	return -1
 }
 
-func (r *Reader) readByte() (byte, error) {
-	b, err := r.br.ReadByte()
-	if err != nil {
-		if errors.Is(err, io.EOF) {
-			err = &UnexpectedEndOfInput{At: r.offset}
+// indexControlByte returns the index of the first control byte in b or -1 if there is none.
+func indexControlByte(b []byte) int {
+	for i, c := range b {
+		if isControlByte(c) {
+			return i
 		}
-		return 0, err
 	}
-	r.offset++
-	return b, nil
+
+	return -1
 }
 
-func (r *Reader) unreadByte() {
-	_ = r.br.UnreadByte()
-	r.offset--
+func isControlByte(b byte) bool {
+	return b < 0x20 && b != '\t' && b != '\n' && b != '\r' || b == 0x7f
 }
 
-func (r *Reader) createDataToken(data []byte, err error) (Token, error) {
-	if len(data) == 0 {
-		return Token{}, err
+// replaceControlBytes strips or replaces all control bytes in b, starting at index i, based on the given policy.
+func replaceControlBytes(b []byte, i int, policy ControlBytePolicy) []byte {
+	out := make([]byte, i, len(b)+2*(len(b)-i))
+	copy(out, b[:i])
+
+	for _, c := range b[i:] {
+		switch {
+		case !isControlByte(c):
+			out = append(out, c)
+		case policy == ControlBytesReplace:
+			out = utf8.AppendRune(out, utf8.RuneError)
+		}
 	}
 
-	return Token{
-		Type: TokenTypeData,
-		Position: Position{
-			Start: r.offset - len(data),
-			End:   r.offset,
-		},
-		Data: data,
-	}, err
+	return out
 }
 
 func (r *Reader) parseComment() (Token, error) {
@@ -590,9 +1245,9 @@ func (r *Reader) parseComment() (Token, error) {
 	findDash := func(b []byte) int { return bytes.IndexByte(b, '-') }
 
 	for {
-		newData, err := appendBeforeIndex(data, &r.br, findDash)
+		newData, full, err := appendBeforeIndex(data, &r.s.br, findDash, r.opts.maxDataSize)
 
-		r.offset += len(newData) - len(data)
+		r.s.offset += len(newData) - len(data)
 		r.err = err
 
 		data = newData
@@ -601,7 +1256,15 @@ func (r *Reader) parseComment() (Token, error) {
 			return r.createDataToken(data, err)
 		}
 
-		next, _ := r.br.Peek(3)
+		if full {
+			return r.createDataToken(data, nil)
+		}
+
+		next, _ := r.s.br.Peek(3)
+
+		if r.needMoreData(len(next), 3) {
+			return r.createDataToken(data, ErrNeedMoreData)
+		}
 
 		var nextStateFn func(*Reader) (Token, error)
 
@@ -609,9 +1272,13 @@ func (r *Reader) parseComment() (Token, error) {
 		case bytes.HasPrefix(next, []byte("-->")):
 			nextStateFn = (*Reader).parseCommentEnd
 		default:
+			if r.opts.maxDataSize > 0 && len(data) >= r.opts.maxDataSize {
+				return r.createDataToken(data, nil)
+			}
+
 			// We know that there is at least one more readable character, so we can ignore the error
 			data = append(data, '-')
-			r.consume('-')
+			r.s.Consume('-')
 			continue
 		}
 
@@ -622,20 +1289,20 @@ func (r *Reader) parseComment() (Token, error) {
 }
 
 func (r *Reader) parseCommentEnd() (Token, error) {
-	t := Token{Type: TokenTypeCommentEnd, Position: Position{Start: r.offset}}
+	t := Token{Type: TokenTypeCommentEnd, Position: Position{Start: r.s.offset}}
 
 	// An error here should be impossible, but we check just in case
-	if err := r.consumeOrError('-'); err != nil {
+	if err := r.s.ConsumeOrError('-'); err != nil {
 		return Token{}, err
 	}
-	if err := r.consumeOrError('-'); err != nil {
+	if err := r.s.ConsumeOrError('-'); err != nil {
 		return Token{}, err
 	}
-	if err := r.consumeOrError('>'); err != nil {
+	if err := r.s.ConsumeOrError('>'); err != nil {
 		return Token{}, err
 	}
 
-	t.Position.End = r.offset
+	t.Position.End = r.s.offset
 
 	r.inComment = false
 	r.stateFn = (*Reader).parseElementOrData
@@ -643,56 +1310,97 @@ func (r *Reader) parseCommentEnd() (Token, error) {
 }
 
 func (r *Reader) parseCommentStart() (Token, error) {
-	t := Token{Type: TokenTypeCommentStart, Position: Position{Start: r.offset}}
+	t := Token{Type: TokenTypeCommentStart, Position: Position{Start: r.s.offset}}
 
 	// An error here should be impossible, but we check just in case
-	if err := r.consumeOrError('<'); err != nil {
+	if err := r.s.ConsumeOrError('<'); err != nil {
 		return Token{}, err
 	}
-	if err := r.consumeOrError('!'); err != nil {
+	if err := r.s.ConsumeOrError('!'); err != nil {
 		return Token{}, err
 	}
-	if err := r.consumeOrError('-'); err != nil {
+	if err := r.s.ConsumeOrError('-'); err != nil {
 		return Token{}, err
 	}
-	if err := r.consumeOrError('-'); err != nil {
+	if err := r.s.ConsumeOrError('-'); err != nil {
 		return Token{}, err
 	}
 
-	t.Position.End = r.offset
+	t.Position.End = r.s.offset
 
 	r.inComment = true
 	r.stateFn = (*Reader).parseComment
 	return t, nil
 }
 
+// parseDeclaration reads a declaration up to and including the closing '>'.
+//
+// A '>' inside quoted strings or inside an internal DTD subset enclosed in brackets does not end the declaration.
+func (r *Reader) parseDeclaration(typ TokenType) (Token, error) {
+	t := Token{Type: typ, Position: Position{Start: r.s.offset}}
+
+	var depth int
+	var quote byte
+
+	for {
+		c, err := r.s.ReadByte()
+		if err != nil {
+			return Token{}, err
+		}
+
+		t.Data = append(t.Data, c)
+
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']' && depth > 0:
+			depth--
+		case c == '>' && depth == 0:
+			t.Position.End = r.s.offset
+
+			r.stateFn = (*Reader).parseElementOrData
+			return t, nil
+		}
+	}
+}
+
+func (r *Reader) parseDoctype() (Token, error) {
+	return r.parseDeclaration(TokenTypeDoctype)
+}
+
 func (r *Reader) parseESICommentStart() (Token, error) {
-	t := Token{Type: TokenTypeESICommentStart, Position: Position{Start: r.offset}}
+	t := Token{Type: TokenTypeESICommentStart, Position: Position{Start: r.s.offset}}
 
 	// An error here should be impossible, but we check just in case
-	if err := r.consumeOrError('<'); err != nil {
+	if err := r.s.ConsumeOrError('<'); err != nil {
 		return Token{}, err
 	}
-	if err := r.consumeOrError('!'); err != nil {
+	if err := r.s.ConsumeOrError('!'); err != nil {
 		return Token{}, err
 	}
-	if err := r.consumeOrError('-'); err != nil {
+	if err := r.s.ConsumeOrError('-'); err != nil {
 		return Token{}, err
 	}
-	if err := r.consumeOrError('-'); err != nil {
+	if err := r.s.ConsumeOrError('-'); err != nil {
 		return Token{}, err
 	}
-	if err := r.consumeOrError('e'); err != nil {
+	if err := r.s.ConsumeOrError('e'); err != nil {
 		return Token{}, err
 	}
-	if err := r.consumeOrError('s'); err != nil {
+	if err := r.s.ConsumeOrError('s'); err != nil {
 		return Token{}, err
 	}
-	if err := r.consumeOrError('i'); err != nil {
+	if err := r.s.ConsumeOrError('i'); err != nil {
 		return Token{}, err
 	}
 
-	t.Position.End = r.offset
+	t.Position.End = r.s.offset
 
 	r.inComment = true
 	r.stateFn = (*Reader).parseElementOrData
@@ -700,34 +1408,43 @@ func (r *Reader) parseESICommentStart() (Token, error) {
 }
 
 func (r *Reader) parseEndElement() (Token, error) {
-	t := Token{Type: TokenTypeEndElement, Position: Position{Start: r.offset}}
+	t := Token{Type: TokenTypeEndElement, Position: Position{Start: r.s.offset}}
 
 	// An error here should be impossible, but we check just in case
-	if err := r.consumeOrError('<'); err != nil {
+	if err := r.s.ConsumeOrError('<'); err != nil {
 		return Token{}, err
 	}
-	if err := r.consumeOrError('/'); err != nil {
+	if err := r.s.ConsumeOrError('/'); err != nil {
 		return Token{}, err
 	}
 
 	var err error
 
-	if t.Name, err = r.readName(false); err != nil {
+	if t.Name, err = r.s.ReadName(false); err != nil {
 		return Token{}, err
 	}
 
-	r.discardSpaces()
+	r.s.DiscardSpaces()
 
-	if err := r.consumeOrError('>'); err != nil {
+	if err := r.s.ConsumeOrError('>'); err != nil {
 		return Token{}, err
 	}
 
-	t.Position.End = r.offset
+	t.Position.End = r.s.offset
 
 	r.stateFn = (*Reader).parseElementOrData
 	return t, nil
 }
 
+func (r *Reader) parseEndElementOrRecover() (Token, error) {
+	return r.parseOrRecover((*Reader).parseEndElement)
+}
+
+var (
+	cdataStart = []byte("<![CDATA[")
+	cdataEnd   = []byte("]]>")
+)
+
 func (r *Reader) parseElementOrData() (Token, error) {
 	var data []byte
 
@@ -740,10 +1457,19 @@ func (r *Reader) parseElementOrData() (Token, error) {
 		return -1
 	}
 
+	findCDATAEnd := func(b []byte) int {
+		return bytes.IndexByte(b, ']')
+	}
+
 	for {
-		newData, err := appendBeforeIndex(data, &r.br, findDashOrLessThan)
+		find := findDashOrLessThan
+		if r.inCDATA {
+			find = findCDATAEnd
+		}
 
-		r.offset += len(newData) - len(data)
+		newData, full, err := appendBeforeIndex(data, &r.s.br, find, r.opts.maxDataSize)
+
+		r.s.offset += len(newData) - len(data)
 		r.err = err
 
 		data = newData
@@ -752,27 +1478,67 @@ func (r *Reader) parseElementOrData() (Token, error) {
 			return r.createDataToken(data, err)
 		}
 
+		if full {
+			return r.createDataToken(data, nil)
+		}
+
 		var nextStateFn func(*Reader) (Token, error)
 
-		next, err := r.br.Peek(7)
+		peek := 9 // <![CDATA[ or <!DOCTYPE
+
+		next, err := r.s.br.Peek(peek)
 		if len(next) == 0 {
 			return Token{}, err
 		}
 
+		if r.needMoreData(len(next), peek) {
+			return r.createDataToken(data, ErrNeedMoreData)
+		}
+
 		switch {
+		case r.inCDATA && bytes.HasPrefix(next, cdataEnd):
+			if r.splitBeforeCDATAMarker(data, cdataEnd) {
+				return r.createDataToken(data, nil)
+			}
+
+			data = r.consumeCDATAMarker(data, cdataEnd)
+			r.inCDATA = false
+			continue
+		case r.inCDATA:
+			// Markup inside CDATA sections is not interpreted.
+		case bytes.HasPrefix(next, cdataStart):
+			if r.splitBeforeCDATAMarker(data, cdataStart) {
+				return r.createDataToken(data, nil)
+			}
+
+			data = r.consumeCDATAMarker(data, cdataStart)
+			r.inCDATA = true
+			continue
+		case r.opts.declarationTokens && !r.inComment && isXMLDeclarationStart(next):
+			nextStateFn = (*Reader).parseXMLDeclaration
+		case r.opts.declarationTokens && !r.inComment && isDoctypeStart(next):
+			nextStateFn = (*Reader).parseDoctype
 		case len(next) >= 5 && next[0] == '<' && // <esi:
 			(next[1] == 'e' || next[1] == 'E') &&
 			(next[2] == 's' || next[2] == 'S') &&
 			(next[3] == 'i' || next[3] == 'I') &&
 			next[4] == ':':
 			nextStateFn = (*Reader).parseStartElement
+
+			if r.opts.recoverSyntax {
+				nextStateFn = (*Reader).parseStartElementOrRecover
+			}
 		case len(next) >= 6 && next[0] == '<' && next[1] == '/' && // </esi:
 			(next[2] == 'e' || next[2] == 'E') &&
 			(next[3] == 's' || next[3] == 'S') &&
 			(next[4] == 'i' || next[4] == 'I') &&
 			next[5] == ':':
 			nextStateFn = (*Reader).parseEndElement
-		case !r.inComment && len(next) >= 7 && // <!--esi
+
+			if r.opts.recoverSyntax {
+				nextStateFn = (*Reader).parseEndElementOrRecover
+			}
+		case !r.inComment && !r.opts.disableESIComments && len(next) >= 7 && // <!--esi
 			next[0] == '<' && next[1] == '!' &&
 			next[2] == '-' && next[3] == '-' &&
 			(next[4] == 'e' || next[4] == 'E') &&
@@ -783,10 +1549,16 @@ func (r *Reader) parseElementOrData() (Token, error) {
 			nextStateFn = (*Reader).parseCommentStart
 		case r.inComment && bytes.HasPrefix(next, []byte("-->")):
 			nextStateFn = (*Reader).parseCommentEnd
-		default:
+		}
+
+		if nextStateFn == nil {
+			if r.opts.maxDataSize > 0 && len(data) >= r.opts.maxDataSize {
+				return r.createDataToken(data, nil)
+			}
+
 			// We know that there is at least one more readable character, so we can ignore the error
 			data = append(data, next[0])
-			r.consume(next[0])
+			r.s.Consume(next[0])
 			continue
 		}
 
@@ -796,77 +1568,200 @@ func (r *Reader) parseElementOrData() (Token, error) {
 	}
 }
 
+// splitBeforeCDATAMarker returns true if data must be returned before consuming the given CDATA marker.
+//
+// This is the case if the marker is stripped, so that positions inside tokens stay correct, or if the marker would
+// exceed the maximum data size.
+func (r *Reader) splitBeforeCDATAMarker(data []byte, marker []byte) bool {
+	if len(data) == 0 {
+		return false
+	}
+
+	return r.opts.stripCDATA || (r.opts.maxDataSize > 0 && len(data)+len(marker) > r.opts.maxDataSize)
+}
+
+// consumeCDATAMarker consumes the given CDATA marker and, unless stripping is enabled, appends it to data.
+func (r *Reader) consumeCDATAMarker(data []byte, marker []byte) []byte {
+	if !r.opts.stripCDATA {
+		data = append(data, marker...)
+	}
+
+	// The marker was already peeked, so this can not fail.
+	_, _ = r.s.Discard(len(marker))
+
+	return data
+}
+
+// parseOrRecover calls parse and, if parse fails with a syntax error, returns the invalid markup up to and including
+// the next '>' as data instead.
+func (r *Reader) parseOrRecover(parse func(*Reader) (Token, error)) (Token, error) {
+	start := r.s.offset
+
+	r.recoverBuf = append(r.recoverBuf[:0], peekTag(&r.s.br)...)
+
+	t, err := parse(r)
+	if err == nil || !isSyntaxError(err) || r.s.offset-start > len(r.recoverBuf) {
+		return t, err
+	}
+
+	data := append([]byte(nil), r.recoverBuf[:r.s.offset-start]...)
+
+	for len(data) == 0 || data[len(data)-1] != '>' {
+		b, err := r.s.ReadByte()
+		if err != nil {
+			if r.needMoreData(0, 1) {
+				return Token{}, err
+			}
+
+			break
+		}
+
+		data = append(data, b)
+	}
+
+	r.stateFn = (*Reader).parseElementOrData
+
+	return r.createDataToken(data, nil)
+}
+
+// maxLinearAttrs is the number of attributes up to which duplicate attributes are detected using a linear search.
+//
+// For elements with more attributes, a map is used to avoid quadratic behaviour.
+const maxLinearAttrs = 8
+
+// attrIndex returns the index of the attribute with the given name in t.Attr or -1 if there is no such attribute.
+func (r *Reader) attrIndex(t *Token, name Name) int {
+	if len(t.Attr) <= maxLinearAttrs {
+		return t.attrIndex(name)
+	}
+
+	if len(r.attrIndexes) == 0 {
+		if r.attrIndexes == nil {
+			r.attrIndexes = make(map[Name]int, len(t.Attr)*2)
+		}
+
+		for i, attr := range t.Attr {
+			r.attrIndexes[attr.Name] = i
+		}
+	}
+
+	if i, ok := r.attrIndexes[name]; ok {
+		return i
+	}
+
+	return -1
+}
+
 func (r *Reader) parseStartElement() (Token, error) {
-	t := Token{Type: TokenTypeStartElement, Position: Position{Start: r.offset}}
+	t := Token{Type: TokenTypeStartElement, Position: Position{Start: r.s.offset}}
 
 	// An error here should be impossible, but we check just in case
-	if err := r.consumeOrError('<'); err != nil {
+	if err := r.s.ConsumeOrError('<'); err != nil {
 		return Token{}, err
 	}
 
 	var err error
 
-	if t.Name, err = r.readName(false); err != nil {
+	if t.Name, err = r.s.ReadName(false); err != nil {
 		return Token{}, err
 	}
 
+	clear(r.attrIndexes)
+
 	for {
-		r.discardSpaces()
+		r.s.DiscardSpaces()
 
-		if r.consume('/') {
+		if r.s.Consume('/') {
 			t.Closed = true
 
-			if err := r.consumeOrError('>'); err != nil {
+			if err := r.s.ConsumeOrError('>'); err != nil {
 				return Token{}, err
 			}
 
 			break
 		}
 
-		if r.consume('>') {
+		if r.s.Consume('>') {
 			break
 		}
 
-		offset := r.offset
+		offset := r.s.offset
 
-		attrName, err := r.readName(false)
+		attrName, err := r.s.ReadName(false)
 		if err != nil {
 			return Token{}, err
 		}
 
-		r.discardSpaces()
+		nameEnd := r.s.offset
+
+		r.s.DiscardSpaces()
 
-		if err := r.consumeOrError('='); err != nil {
+		if err := r.s.ConsumeOrError('='); err != nil {
 			return Token{}, err
 		}
 
-		attrValue, err := r.readAttrValue()
+		valueStart := r.s.offset
+
+		quoted := false
+		if b, _ := r.s.Peek(); b == '"' || b == '\'' {
+			quoted = true
+		}
+
+		attrValue, err := r.s.ReadAttrValue()
 		if err != nil {
 			return Token{}, err
 		}
 
+		valueEnd := r.s.offset
+
+		if quoted {
+			valueStart, valueEnd = valueStart+1, valueEnd-1
+		}
+
 		if t.Attr == nil {
 			t.Attr = make([]Attr, 0, 4)
 		}
 
-		if t.hasAttr(attrName) {
-			return Token{}, &DuplicateAttributeError{At: offset, Name: attrName.Local}
+		attr := Attr{
+			Position:      Position{Start: offset, End: r.s.offset},
+			NamePosition:  Position{Start: offset, End: nameEnd},
+			ValuePosition: Position{Start: valueStart, End: valueEnd},
+			Name:          attrName,
+			Value:         attrValue,
 		}
 
-		t.Attr = append(t.Attr, Attr{
-			Position: Position{Start: offset, End: r.offset},
-			Name:     attrName,
-			Value:    attrValue,
-		})
+		index := r.attrIndex(&t, attrName)
+
+		switch {
+		case index == -1:
+			t.Attr = append(t.Attr, attr)
+
+			if len(r.attrIndexes) > 0 {
+				r.attrIndexes[attrName] = len(t.Attr) - 1
+			}
+		case r.opts.duplicateAttrPolicy == DuplicateAttrKeepFirst:
+		case r.opts.duplicateAttrPolicy == DuplicateAttrKeepLast:
+			t.Attr[index] = attr
+		default:
+			return Token{}, &DuplicateAttributeError{At: offset, Name: attrName.Local}
+		}
 	}
 
-	t.Position.End = r.offset
+	t.Position.End = r.s.offset
 
 	r.stateFn = (*Reader).parseElementOrData
 	return t, nil
 }
 
-func appendBeforeIndex(dst []byte, br *bufio.Reader, f func([]byte) int) ([]byte, error) {
+func (r *Reader) parseStartElementOrRecover() (Token, error) {
+	return r.parseOrRecover((*Reader).parseStartElement)
+}
+
+func (r *Reader) parseXMLDeclaration() (Token, error) {
+	return r.parseDeclaration(TokenTypeXMLDeclaration)
+}
+
+func appendBeforeIndex(dst []byte, br *bufio.Reader, f func([]byte) int, limit int) ([]byte, bool, error) {
 	for {
 		buf, err := br.Peek(1024)
 
@@ -874,15 +1769,19 @@ func appendBeforeIndex(dst []byte, br *bufio.Reader, f func([]byte) int) ([]byte
 		case err != nil && len(buf) != 0:
 			// Try to process the bytes that we could read
 		case err != nil:
-			return dst, err
+			return dst, false, err
 		}
 
-		end, found := len(buf), false
+		end, found, full := len(buf), false, false
 
 		if idx := f(buf); idx != -1 {
 			end, found = idx, true
 		}
 
+		if limit > 0 && len(dst)+end > limit {
+			end, found, full = limitedEnd(buf, limit-len(dst), len(dst) == 0), false, true
+		}
+
 		// Avoid many small reallocations
 		if dst == nil && end > 0 {
 			dst = make([]byte, 0, 128)
@@ -892,12 +1791,30 @@ func appendBeforeIndex(dst []byte, br *bufio.Reader, f func([]byte) int) ([]byte
 
 		_, _ = br.Discard(end)
 
-		if found {
-			return dst, nil
+		if found || full {
+			return dst, full, nil
 		}
 	}
 }
 
+// limitedEnd returns the largest index <= room in buf that is at the start of a rune.
+//
+// If there is no such index other than 0 and force is true, the index after the first rune is returned instead, so
+// that progress is made even if room is smaller than the first rune.
+func limitedEnd(buf []byte, room int, force bool) int {
+	end := room
+
+	for end > 0 && !utf8.RuneStart(buf[end]) {
+		end--
+	}
+
+	if end == 0 && force {
+		_, end = utf8.DecodeRune(buf)
+	}
+
+	return end
+}
+
 // From https://github.com/golang/go/blob/7a2689b152785010ee2013fb220a048bfe31e49f/src/encoding/xml/xml.go#L1289-L1482
 var first = &unicode.RangeTable{
 	R16: []unicode.Range16{
@@ -1212,6 +2129,57 @@ var second = &unicode.RangeTable{
 	},
 }
 
+// peekTag returns the buffered input up to and including the first '>' that is not inside a quoted attribute value,
+// reading more data as needed.
+//
+// If the end of the tag can not be found, because of an error or because the buffer is full, all buffered data is
+// returned.
+func peekTag(br *bufio.Reader) []byte {
+	n := max(br.Buffered(), 1)
+
+	for {
+		b, err := br.Peek(n)
+
+		var quote byte
+
+		for i, c := range b {
+			switch {
+			case quote != 0:
+				if c == quote {
+					quote = 0
+				}
+			case c == '"' || c == '\'':
+				quote = c
+			case c == '>':
+				return b[:i+1]
+			}
+		}
+
+		if err != nil {
+			return b
+		}
+
+		n = br.Buffered() + 1
+	}
+}
+
+func isDoctypeStart(b []byte) bool {
+	return len(b) >= 9 && bytes.EqualFold(b[:9], []byte("<!DOCTYPE"))
+}
+
+func isXMLDeclarationStart(b []byte) bool {
+	if len(b) < 6 || !bytes.HasPrefix(b, []byte("<?xml")) {
+		return false
+	}
+
+	switch b[5] {
+	case ' ', '\r', '\n', '\t':
+		return true
+	default:
+		return false
+	}
+}
+
 // From https://github.com/golang/go/blob/7a2689b152785010ee2013fb220a048bfe31e49f/src/encoding/xml/xml.go#L1229-L1234
 func isNameByte(c byte) bool {
 	return 'A' <= c && c <= 'Z' ||
@@ -1244,171 +2212,3 @@ func isName(s []byte) bool {
 	}
 	return true
 }
-
-func (r *Reader) readAttrValue() (string, error) {
-	if b, _ := r.peek(); b == '"' || b == '\'' {
-		return r.readQuotedAttrValue()
-	}
-
-	buf := r.attrBuf[:0]
-
-	for {
-		b, err := r.readByte()
-		if err != nil {
-			return "", err
-		}
-
-		// https://www.w3.org/TR/REC-html40/intro/sgmltut.html#h-3.2.2
-		if 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' ||
-			'0' <= b && b <= '9' || b == '_' || b == ':' || b == '-' {
-			buf = append(buf, b)
-			continue
-		}
-
-		r.unreadByte()
-
-		return bytesToString(buf), nil
-	}
-}
-
-var entity = map[string]rune{
-	"lt":   '<',
-	"gt":   '>',
-	"amp":  '&',
-	"apos": '\'',
-	"quot": '"',
-}
-
-func (r *Reader) readQuotedAttrValue() (string, error) {
-	// This is only called from readAttrValue, where we already checked that there is a quote byte available, so
-	// no need to check the error
-	quote, _ := r.readByte()
-
-	buf := r.attrBuf[:0]
-
-	for {
-		b, err := r.readByte()
-		if err != nil {
-			return "", err
-		}
-
-		switch b {
-		case quote:
-			return bytesToString(buf), nil
-		case '<':
-			return "", &SyntaxError{At: r.offset - 1, Message: "unescaped < inside quoted string"}
-		case '\r':
-			// \r and \r\n must be converted to \n, so we simply treat \r as \n and consume the next \n if any
-			_ = r.consume('\n')
-
-			buf = append(buf, '\n')
-		case '&':
-			escBuf := buf[len(buf):]
-
-			if r.consume('#') {
-				b, err := r.readByte()
-				if err != nil {
-					return "", err
-				}
-
-				base := 10
-				if b == 'x' {
-					base = 16
-
-					b, err = r.readByte()
-					if err != nil {
-						return "", err
-					}
-				}
-
-				for '0' <= b && b <= '9' ||
-					base == 16 && 'a' <= b && b <= 'f' ||
-					base == 16 && 'A' <= b && b <= 'F' {
-					escBuf = append(escBuf, b)
-
-					b, err = r.readByte()
-					if err != nil {
-						return "", err
-					}
-				}
-
-				r.unreadByte()
-
-				if len(escBuf) == 0 {
-					return "", &UnexpectedCharacterError{At: r.offset, Got: b}
-				}
-
-				if err := r.consumeOrError(';'); err != nil {
-					return "", err
-				}
-
-				n, err := strconv.ParseUint(string(escBuf), base, 64)
-				if err != nil || n > unicode.MaxRune {
-					return "", &SyntaxError{At: r.offset - len(escBuf), Message: "invalid number in escape sequence"}
-				}
-
-				buf = append(buf, string(rune(n))...)
-			} else {
-				offset := r.offset
-
-				name, err := r.readName(true)
-				if err != nil {
-					return "", err
-				}
-
-				if err := r.consumeOrError(';'); err != nil {
-					return "", err
-				}
-
-				e, ok := entity[name.Local]
-				if !ok {
-					return "", &UnsupportedEntityError{Offset: offset}
-				}
-
-				buf = append(buf, string(e)...)
-			}
-		default:
-			buf = append(buf, b)
-		}
-	}
-}
-
-func (r *Reader) readName(local bool) (Name, error) {
-	offset := r.offset
-
-	b, err := r.readByte()
-	if err != nil {
-		return Name{}, err
-	}
-
-	if b < utf8.RuneSelf && !isNameByte(b) {
-		return Name{}, &InvalidNameError{At: offset}
-	}
-
-	name := append(r.nameBuf[:0], b)
-
-	for {
-		b, ok := r.peek()
-		if !ok {
-			break
-		}
-
-		if b < utf8.RuneSelf && !isNameByte(b) {
-			break
-		}
-
-		_, _ = r.readByte()
-
-		name = append(name, b)
-	}
-
-	if !isName(name) {
-		return Name{}, &InvalidNameError{At: offset}
-	}
-
-	if local && bytes.IndexByte(name, ':') != -1 {
-		return Name{}, &SyntaxError{At: offset, Message: "name without namespace expected"}
-	}
-
-	return bytesToName(name), nil
-}
@@ -3,10 +3,11 @@ package esixml_test
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
-	"math"
 	"strings"
 	"testing"
+	"unicode/utf8"
 
 	"github.com/google/go-cmp/cmp"
 
@@ -19,10 +20,36 @@ func (b noProgressReader) Read([]byte) (n int, err error) {
 	return 0, io.ErrNoProgress
 }
 
-func TestReader(t *testing.T) {
-	// Marker value that can be used to specify that a token ends at the end of the input string
-	const endIsEOF = math.MinInt
+func TestChecksData(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Opts     []esixml.ReaderOpt
+		Expected bool
+	}{
+		{Name: "none"},
+		{Name: "other options", Opts: []esixml.ReaderOpt{esixml.WithCDATAStripping(), esixml.WithMaxDataSize(8)}},
+		{
+			Name: "control bytes allowed",
+			Opts: []esixml.ReaderOpt{esixml.WithControlBytePolicy(esixml.ControlBytesAllow)},
+		},
+		{
+			Name:     "control bytes stripped",
+			Opts:     []esixml.ReaderOpt{esixml.WithControlBytePolicy(esixml.ControlBytesStrip)},
+			Expected: true,
+		},
+		{Name: "UTF-8 validation", Opts: []esixml.ReaderOpt{esixml.WithUTF8Validation()}, Expected: true},
+	}
 
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			if got := esixml.ChecksData(testCase.Opts...); got != testCase.Expected {
+				t.Errorf("got %t, want %t", got, testCase.Expected)
+			}
+		})
+	}
+}
+
+func TestReader(t *testing.T) {
 	testCases := []struct {
 		Name        string
 		Input       string
@@ -40,7 +67,7 @@ func TestReader(t *testing.T) {
 			Tokens: []esixml.Token{
 				{
 					Type:     esixml.TokenTypeStartElement,
-					Position: esixml.Position{End: endIsEOF},
+					Position: esixml.Position{End: 13},
 					Name:     esixml.Name{Space: "esi", Local: "element"},
 				},
 			},
@@ -51,28 +78,36 @@ func TestReader(t *testing.T) {
 			Tokens: []esixml.Token{
 				{
 					Type:     esixml.TokenTypeStartElement,
-					Position: esixml.Position{End: endIsEOF},
+					Position: esixml.Position{End: 74},
 					Name:     esixml.Name{Space: "esi", Local: "element"},
 					Attr: []esixml.Attr{
 						{
-							Position: esixml.Position{Start: 13, End: 25},
-							Name:     esixml.Name{Space: "", Local: "attr1"},
-							Value:    "value1",
+							Position:      esixml.Position{Start: 13, End: 25},
+							NamePosition:  esixml.Position{Start: 13, End: 18},
+							ValuePosition: esixml.Position{Start: 19, End: 25},
+							Name:          esixml.Name{Space: "", Local: "attr1"},
+							Value:         "value1",
 						},
 						{
-							Position: esixml.Position{Start: 26, End: 40},
-							Name:     esixml.Name{Space: "", Local: "attr2"},
-							Value:    "value2",
+							Position:      esixml.Position{Start: 26, End: 40},
+							NamePosition:  esixml.Position{Start: 26, End: 31},
+							ValuePosition: esixml.Position{Start: 33, End: 39},
+							Name:          esixml.Name{Space: "", Local: "attr2"},
+							Value:         "value2",
 						},
 						{
-							Position: esixml.Position{Start: 41, End: 55},
-							Name:     esixml.Name{Space: "", Local: "attr3"},
-							Value:    "value3",
+							Position:      esixml.Position{Start: 41, End: 55},
+							NamePosition:  esixml.Position{Start: 41, End: 46},
+							ValuePosition: esixml.Position{Start: 48, End: 54},
+							Name:          esixml.Name{Space: "", Local: "attr3"},
+							Value:         "value3",
 						},
 						{
-							Position: esixml.Position{Start: 56, End: 73},
-							Name:     esixml.Name{Space: "ns", Local: "attr4"},
-							Value:    "value4",
+							Position:      esixml.Position{Start: 56, End: 73},
+							NamePosition:  esixml.Position{Start: 56, End: 64},
+							ValuePosition: esixml.Position{Start: 66, End: 72},
+							Name:          esixml.Name{Space: "ns", Local: "attr4"},
+							Value:         "value4",
 						},
 					},
 				},
@@ -83,7 +118,7 @@ func TestReader(t *testing.T) {
 			Input: `<esi:element/>`,
 			Tokens: []esixml.Token{
 				{
-					Position: esixml.Position{End: endIsEOF},
+					Position: esixml.Position{End: 14},
 					Type:     esixml.TokenTypeStartElement,
 					Name:     esixml.Name{Space: "esi", Local: "element"},
 					Closed:   true,
@@ -100,29 +135,37 @@ func TestReader(t *testing.T) {
 			Input: `<esi:element attr1=value1 attr2="value2" attr3='value3' ns:attr4="value4"/>`,
 			Tokens: []esixml.Token{
 				{
-					Position: esixml.Position{End: endIsEOF},
+					Position: esixml.Position{End: 75},
 					Type:     esixml.TokenTypeStartElement,
 					Name:     esixml.Name{Space: "esi", Local: "element"},
 					Attr: []esixml.Attr{
 						{
-							Position: esixml.Position{Start: 13, End: 25},
-							Name:     esixml.Name{Space: "", Local: "attr1"},
-							Value:    "value1",
+							Position:      esixml.Position{Start: 13, End: 25},
+							NamePosition:  esixml.Position{Start: 13, End: 18},
+							ValuePosition: esixml.Position{Start: 19, End: 25},
+							Name:          esixml.Name{Space: "", Local: "attr1"},
+							Value:         "value1",
 						},
 						{
-							Position: esixml.Position{Start: 26, End: 40},
-							Name:     esixml.Name{Space: "", Local: "attr2"},
-							Value:    "value2",
+							Position:      esixml.Position{Start: 26, End: 40},
+							NamePosition:  esixml.Position{Start: 26, End: 31},
+							ValuePosition: esixml.Position{Start: 33, End: 39},
+							Name:          esixml.Name{Space: "", Local: "attr2"},
+							Value:         "value2",
 						},
 						{
-							Position: esixml.Position{Start: 41, End: 55},
-							Name:     esixml.Name{Space: "", Local: "attr3"},
-							Value:    "value3",
+							Position:      esixml.Position{Start: 41, End: 55},
+							NamePosition:  esixml.Position{Start: 41, End: 46},
+							ValuePosition: esixml.Position{Start: 48, End: 54},
+							Name:          esixml.Name{Space: "", Local: "attr3"},
+							Value:         "value3",
 						},
 						{
-							Position: esixml.Position{Start: 56, End: 73},
-							Name:     esixml.Name{Space: "ns", Local: "attr4"},
-							Value:    "value4",
+							Position:      esixml.Position{Start: 56, End: 73},
+							NamePosition:  esixml.Position{Start: 56, End: 64},
+							ValuePosition: esixml.Position{Start: 66, End: 72},
+							Name:          esixml.Name{Space: "ns", Local: "attr4"},
+							Value:         "value4",
 						},
 					},
 					Closed: true,
@@ -139,7 +182,7 @@ func TestReader(t *testing.T) {
 			Input: `</esi:element>`,
 			Tokens: []esixml.Token{
 				{
-					Position: esixml.Position{End: endIsEOF},
+					Position: esixml.Position{End: 14},
 					Type:     esixml.TokenTypeEndElement,
 					Name:     esixml.Name{Space: "esi", Local: "element"},
 				},
@@ -155,7 +198,7 @@ func TestReader(t *testing.T) {
 			Input: `< /esi:element>`,
 			Tokens: []esixml.Token{
 				{
-					Position: esixml.Position{End: endIsEOF},
+					Position: esixml.Position{End: 15},
 					Type:     esixml.TokenTypeData,
 					Data:     []byte(`< /esi:element>`),
 				},
@@ -166,7 +209,7 @@ func TestReader(t *testing.T) {
 			Input: `</ esi:element>`,
 			Tokens: []esixml.Token{
 				{
-					Position: esixml.Position{End: endIsEOF},
+					Position: esixml.Position{End: 15},
 					Type:     esixml.TokenTypeData,
 					Data:     []byte(`</ esi:element>`),
 				},
@@ -177,7 +220,7 @@ func TestReader(t *testing.T) {
 			Input: `<element>`,
 			Tokens: []esixml.Token{
 				{
-					Position: esixml.Position{End: endIsEOF},
+					Position: esixml.Position{End: 9},
 					Type:     esixml.TokenTypeData,
 					Data:     []byte(`<element>`),
 				},
@@ -188,7 +231,7 @@ func TestReader(t *testing.T) {
 			Input: `<element attr1=value1 attr2="value2" attr3='value3' ns:attr4="value4">`,
 			Tokens: []esixml.Token{
 				{
-					Position: esixml.Position{End: endIsEOF},
+					Position: esixml.Position{End: 70},
 					Type:     esixml.TokenTypeData,
 					Data:     []byte(`<element attr1=value1 attr2="value2" attr3='value3' ns:attr4="value4">`),
 				},
@@ -199,7 +242,7 @@ func TestReader(t *testing.T) {
 			Input: `<element/>`,
 			Tokens: []esixml.Token{
 				{
-					Position: esixml.Position{End: endIsEOF},
+					Position: esixml.Position{End: 10},
 					Type:     esixml.TokenTypeData,
 					Data:     []byte(`<element/>`),
 				},
@@ -210,7 +253,7 @@ func TestReader(t *testing.T) {
 			Input: `<element attr1=value1 attr2="value2" attr3='value3' ns:attr4="value4"/>`,
 			Tokens: []esixml.Token{
 				{
-					Position: esixml.Position{End: endIsEOF},
+					Position: esixml.Position{End: 71},
 					Type:     esixml.TokenTypeData,
 					Data:     []byte(`<element attr1=value1 attr2="value2" attr3='value3' ns:attr4="value4"/>`),
 				},
@@ -221,7 +264,7 @@ func TestReader(t *testing.T) {
 			Input: `<element attr1=value1 attr2="value2" attr3='value3' ns:attr4="value4"/ >`,
 			Tokens: []esixml.Token{
 				{
-					Position: esixml.Position{End: endIsEOF},
+					Position: esixml.Position{End: 72},
 					Type:     esixml.TokenTypeData,
 					Data:     []byte(`<element attr1=value1 attr2="value2" attr3='value3' ns:attr4="value4"/ >`),
 				},
@@ -232,7 +275,7 @@ func TestReader(t *testing.T) {
 			Input: `<element/ >`,
 			Tokens: []esixml.Token{
 				{
-					Position: esixml.Position{End: endIsEOF},
+					Position: esixml.Position{End: 11},
 					Type:     esixml.TokenTypeData,
 					Data:     []byte(`<element/ >`),
 				},
@@ -243,7 +286,7 @@ func TestReader(t *testing.T) {
 			Input: `<element attr1=value1 attr2="value2" attr3='value3' ns:attr4="value4"/ >`,
 			Tokens: []esixml.Token{
 				{
-					Position: esixml.Position{End: endIsEOF},
+					Position: esixml.Position{End: 72},
 					Type:     esixml.TokenTypeData,
 					Data:     []byte(`<element attr1=value1 attr2="value2" attr3='value3' ns:attr4="value4"/ >`),
 				},
@@ -254,7 +297,7 @@ func TestReader(t *testing.T) {
 			Input: `</element>`,
 			Tokens: []esixml.Token{
 				{
-					Position: esixml.Position{End: endIsEOF},
+					Position: esixml.Position{End: 10},
 					Type:     esixml.TokenTypeData,
 					Data:     []byte(`</element>`),
 				},
@@ -265,7 +308,7 @@ func TestReader(t *testing.T) {
 			Input: `</element attr1=value1>`,
 			Tokens: []esixml.Token{
 				{
-					Position: esixml.Position{End: endIsEOF},
+					Position: esixml.Position{End: 23},
 					Type:     esixml.TokenTypeData,
 					Data:     []byte(`</element attr1=value1>`),
 				},
@@ -276,14 +319,16 @@ func TestReader(t *testing.T) {
 			Input: `<esi:element attr =value>`,
 			Tokens: []esixml.Token{
 				{
-					Position: esixml.Position{End: endIsEOF},
+					Position: esixml.Position{End: 25},
 					Type:     esixml.TokenTypeStartElement,
 					Name:     esixml.Name{Space: "esi", Local: "element"},
 					Attr: []esixml.Attr{
 						{
-							Position: esixml.Position{Start: 13, End: 24},
-							Name:     esixml.Name{Space: "", Local: "attr"},
-							Value:    "value",
+							Position:      esixml.Position{Start: 13, End: 24},
+							NamePosition:  esixml.Position{Start: 13, End: 17},
+							ValuePosition: esixml.Position{Start: 19, End: 24},
+							Name:          esixml.Name{Space: "", Local: "attr"},
+							Value:         "value",
 						},
 					},
 				},
@@ -299,14 +344,16 @@ func TestReader(t *testing.T) {
 			Input: `<esi:element attr=value>`,
 			Tokens: []esixml.Token{
 				{
-					Position: esixml.Position{End: endIsEOF},
+					Position: esixml.Position{End: 24},
 					Type:     esixml.TokenTypeStartElement,
 					Name:     esixml.Name{Space: "esi", Local: "element"},
 					Attr: []esixml.Attr{
 						{
-							Position: esixml.Position{Start: 13, End: 23},
-							Name:     esixml.Name{Space: "", Local: "attr"},
-							Value:    "value",
+							Position:      esixml.Position{Start: 13, End: 23},
+							NamePosition:  esixml.Position{Start: 13, End: 17},
+							ValuePosition: esixml.Position{Start: 18, End: 23},
+							Name:          esixml.Name{Space: "", Local: "attr"},
+							Value:         "value",
 						},
 					},
 				},
@@ -317,14 +364,16 @@ func TestReader(t *testing.T) {
 			Input: `<esi:element attr=value/>`,
 			Tokens: []esixml.Token{
 				{
-					Position: esixml.Position{End: endIsEOF},
+					Position: esixml.Position{End: 25},
 					Type:     esixml.TokenTypeStartElement,
 					Name:     esixml.Name{Space: "esi", Local: "element"},
 					Attr: []esixml.Attr{
 						{
-							Position: esixml.Position{Start: 13, End: 23},
-							Name:     esixml.Name{Space: "", Local: "attr"},
-							Value:    "value",
+							Position:      esixml.Position{Start: 13, End: 23},
+							NamePosition:  esixml.Position{Start: 13, End: 17},
+							ValuePosition: esixml.Position{Start: 18, End: 23},
+							Name:          esixml.Name{Space: "", Local: "attr"},
+							Value:         "value",
 						},
 					},
 					Closed: true,
@@ -356,7 +405,7 @@ func TestReader(t *testing.T) {
 			Input: `<^esi:element>`,
 			Tokens: []esixml.Token{
 				{
-					Position: esixml.Position{End: endIsEOF},
+					Position: esixml.Position{End: 14},
 					Type:     esixml.TokenTypeData,
 					Data:     []byte(`<^esi:element>`),
 				},
@@ -412,14 +461,16 @@ func TestReader(t *testing.T) {
 			Input: `<esi:element attr="multi` + "\r" + `line">`,
 			Tokens: []esixml.Token{
 				{
-					Position: esixml.Position{End: endIsEOF},
+					Position: esixml.Position{End: 31},
 					Type:     esixml.TokenTypeStartElement,
 					Name:     esixml.Name{Space: "esi", Local: "element"},
 					Attr: []esixml.Attr{
 						{
-							Position: esixml.Position{Start: 13, End: 30},
-							Name:     esixml.Name{Space: "", Local: "attr"},
-							Value:    "multi\nline",
+							Position:      esixml.Position{Start: 13, End: 30},
+							NamePosition:  esixml.Position{Start: 13, End: 17},
+							ValuePosition: esixml.Position{Start: 19, End: 29},
+							Name:          esixml.Name{Space: "", Local: "attr"},
+							Value:         "multi\nline",
 						},
 					},
 				},
@@ -430,14 +481,16 @@ func TestReader(t *testing.T) {
 			Input: `<esi:element attr="multi` + "\r\n" + `line">`,
 			Tokens: []esixml.Token{
 				{
-					Position: esixml.Position{End: endIsEOF},
+					Position: esixml.Position{End: 32},
 					Type:     esixml.TokenTypeStartElement,
 					Name:     esixml.Name{Space: "esi", Local: "element"},
 					Attr: []esixml.Attr{
 						{
-							Position: esixml.Position{Start: 13, End: 31},
-							Name:     esixml.Name{Space: "", Local: "attr"},
-							Value:    "multi\nline",
+							Position:      esixml.Position{Start: 13, End: 31},
+							NamePosition:  esixml.Position{Start: 13, End: 17},
+							ValuePosition: esixml.Position{Start: 19, End: 30},
+							Name:          esixml.Name{Space: "", Local: "attr"},
+							Value:         "multi\nline",
 						},
 					},
 				},
@@ -476,14 +529,16 @@ func TestReader(t *testing.T) {
 			Input: `<esi:element attr="a &amp; b">`,
 			Tokens: []esixml.Token{
 				{
-					Position: esixml.Position{End: endIsEOF},
+					Position: esixml.Position{End: 30},
 					Type:     esixml.TokenTypeStartElement,
 					Name:     esixml.Name{Space: "esi", Local: "element"},
 					Attr: []esixml.Attr{
 						{
-							Position: esixml.Position{Start: 13, End: 29},
-							Name:     esixml.Name{Space: "", Local: "attr"},
-							Value:    "a & b",
+							Position:      esixml.Position{Start: 13, End: 29},
+							NamePosition:  esixml.Position{Start: 13, End: 17},
+							ValuePosition: esixml.Position{Start: 19, End: 28},
+							Name:          esixml.Name{Space: "", Local: "attr"},
+							Value:         "a & b",
 						},
 					},
 				},
@@ -504,14 +559,16 @@ func TestReader(t *testing.T) {
 			Input: `<esi:element attr="does this work&#63;">`,
 			Tokens: []esixml.Token{
 				{
-					Position: esixml.Position{End: endIsEOF},
+					Position: esixml.Position{End: 40},
 					Type:     esixml.TokenTypeStartElement,
 					Name:     esixml.Name{Space: "esi", Local: "element"},
 					Attr: []esixml.Attr{
 						{
-							Position: esixml.Position{Start: 13, End: 39},
-							Name:     esixml.Name{Space: "", Local: "attr"},
-							Value:    "does this work?",
+							Position:      esixml.Position{Start: 13, End: 39},
+							NamePosition:  esixml.Position{Start: 13, End: 17},
+							ValuePosition: esixml.Position{Start: 19, End: 38},
+							Name:          esixml.Name{Space: "", Local: "attr"},
+							Value:         "does this work?",
 						},
 					},
 				},
@@ -527,14 +584,16 @@ func TestReader(t *testing.T) {
 			Input: `<esi:element attr="does this work&#x3F;">`,
 			Tokens: []esixml.Token{
 				{
-					Position: esixml.Position{End: endIsEOF},
+					Position: esixml.Position{End: 41},
 					Type:     esixml.TokenTypeStartElement,
 					Name:     esixml.Name{Space: "esi", Local: "element"},
 					Attr: []esixml.Attr{
 						{
-							Position: esixml.Position{Start: 13, End: 40},
-							Name:     esixml.Name{Space: "", Local: "attr"},
-							Value:    "does this work?",
+							Position:      esixml.Position{Start: 13, End: 40},
+							NamePosition:  esixml.Position{Start: 13, End: 17},
+							ValuePosition: esixml.Position{Start: 19, End: 39},
+							Name:          esixml.Name{Space: "", Local: "attr"},
+							Value:         "does this work?",
 						},
 					},
 				},
@@ -579,9 +638,11 @@ func TestReader(t *testing.T) {
 					Name:     esixml.Name{Space: "esi", Local: "element"},
 					Attr: []esixml.Attr{
 						{
-							Position: esixml.Position{Start: 13, End: 26},
-							Name:     esixml.Name{Space: "", Local: "attr1"},
-							Value:    "value1",
+							Position:      esixml.Position{Start: 13, End: 26},
+							NamePosition:  esixml.Position{Start: 13, End: 18},
+							ValuePosition: esixml.Position{Start: 20, End: 26},
+							Name:          esixml.Name{Space: "", Local: "attr1"},
+							Value:         "value1",
 						},
 					},
 					Closed: true,
@@ -598,14 +659,18 @@ func TestReader(t *testing.T) {
 					Name:     esixml.Name{Space: "esi", Local: "element"},
 					Attr: []esixml.Attr{
 						{
-							Position: esixml.Position{Start: 13, End: 25},
-							Name:     esixml.Name{Space: "", Local: "attr1"},
-							Value:    "value1",
+							Position:      esixml.Position{Start: 13, End: 25},
+							NamePosition:  esixml.Position{Start: 13, End: 18},
+							ValuePosition: esixml.Position{Start: 19, End: 25},
+							Name:          esixml.Name{Space: "", Local: "attr1"},
+							Value:         "value1",
 						},
 						{
-							Position: esixml.Position{Start: 27, End: 41},
-							Name:     esixml.Name{Space: "", Local: "attr2"},
-							Value:    "value2",
+							Position:      esixml.Position{Start: 27, End: 41},
+							NamePosition:  esixml.Position{Start: 27, End: 32},
+							ValuePosition: esixml.Position{Start: 34, End: 40},
+							Name:          esixml.Name{Space: "", Local: "attr2"},
+							Value:         "value2",
 						},
 					},
 					Closed: true,
@@ -689,6 +754,43 @@ func TestReader(t *testing.T) {
 				{Position: esixml.Position{Start: 25, End: 37}, Type: esixml.TokenTypeData, Data: []byte(" content -->")},
 			},
 		},
+		{
+			Name:  "CDATA",
+			Input: `a<![CDATA[<esi:include src="x"/> -- ]] ]]>b`,
+			Tokens: []esixml.Token{
+				{
+					Position: esixml.Position{End: 43},
+					Type:     esixml.TokenTypeData,
+					Data:     []byte(`a<![CDATA[<esi:include src="x"/> -- ]] ]]>b`),
+				},
+			},
+		},
+		{
+			Name:  "CDATA inside ESI comment",
+			Input: "<!--esi <![CDATA[-->]]> -->",
+			Tokens: []esixml.Token{
+				{Position: esixml.Position{Start: 0, End: 7}, Type: esixml.TokenTypeESICommentStart},
+				{Position: esixml.Position{Start: 7, End: 24}, Type: esixml.TokenTypeData, Data: []byte(" <![CDATA[-->]]> ")},
+				{Position: esixml.Position{Start: 24, End: 27}, Type: esixml.TokenTypeCommentEnd},
+			},
+		},
+		{
+			Name:  "CDATA inside XML comment",
+			Input: "<!-- <![CDATA[ -->]]>",
+			Tokens: []esixml.Token{
+				{Position: esixml.Position{End: 4}, Type: esixml.TokenTypeCommentStart},
+				{Position: esixml.Position{Start: 4, End: 15}, Type: esixml.TokenTypeData, Data: []byte(" <![CDATA[ ")},
+				{Position: esixml.Position{Start: 15, End: 18}, Type: esixml.TokenTypeCommentEnd},
+				{Position: esixml.Position{Start: 18, End: 21}, Type: esixml.TokenTypeData, Data: []byte("]]>")},
+			},
+		},
+		{
+			Name:  "unterminated CDATA",
+			Input: "<![CDATA[<esi:include/>",
+			Tokens: []esixml.Token{
+				{Position: esixml.Position{End: 23}, Type: esixml.TokenTypeData, Data: []byte("<![CDATA[<esi:include/>")},
+			},
+		},
 
 		{
 			Name: "complex",
@@ -768,19 +870,25 @@ func TestReader(t *testing.T) {
 					Name:     esixml.Name{Space: "esi", Local: "include"},
 					Attr: []esixml.Attr{
 						{
-							Position: esixml.Position{Start: 38, End: 70},
-							Name:     esixml.Name{Space: "", Local: "src"},
-							Value:    "https://example.com/1.html",
+							Position:      esixml.Position{Start: 38, End: 70},
+							NamePosition:  esixml.Position{Start: 38, End: 41},
+							ValuePosition: esixml.Position{Start: 43, End: 69},
+							Name:          esixml.Name{Space: "", Local: "src"},
+							Value:         "https://example.com/1.html",
 						},
 						{
-							Position: esixml.Position{Start: 71, End: 107},
-							Name:     esixml.Name{Space: "", Local: "alt"},
-							Value:    "https://bak.example.com/2.html",
+							Position:      esixml.Position{Start: 71, End: 107},
+							NamePosition:  esixml.Position{Start: 71, End: 74},
+							ValuePosition: esixml.Position{Start: 76, End: 106},
+							Name:          esixml.Name{Space: "", Local: "alt"},
+							Value:         "https://bak.example.com/2.html",
 						},
 						{
-							Position: esixml.Position{Start: 108, End: 126},
-							Name:     esixml.Name{Space: "", Local: "onerror"},
-							Value:    "continue",
+							Position:      esixml.Position{Start: 108, End: 126},
+							NamePosition:  esixml.Position{Start: 108, End: 115},
+							ValuePosition: esixml.Position{Start: 117, End: 125},
+							Name:          esixml.Name{Space: "", Local: "onerror"},
+							Value:         "continue",
 						},
 					},
 					Closed: true,
@@ -796,14 +904,18 @@ func TestReader(t *testing.T) {
 					Name:     esixml.Name{Space: "esi", Local: "inline"},
 					Attr: []esixml.Attr{
 						{
-							Position: esixml.Position{Start: 168, End: 178},
-							Name:     esixml.Name{Space: "", Local: "name"},
-							Value:    "URI",
+							Position:      esixml.Position{Start: 168, End: 178},
+							NamePosition:  esixml.Position{Start: 168, End: 172},
+							ValuePosition: esixml.Position{Start: 174, End: 177},
+							Name:          esixml.Name{Space: "", Local: "name"},
+							Value:         "URI",
 						},
 						{
-							Position: esixml.Position{Start: 179, End: 201},
-							Name:     esixml.Name{Space: "", Local: "fetchable"},
-							Value:    "{yes | no}",
+							Position:      esixml.Position{Start: 179, End: 201},
+							NamePosition:  esixml.Position{Start: 179, End: 188},
+							ValuePosition: esixml.Position{Start: 190, End: 200},
+							Name:          esixml.Name{Space: "", Local: "fetchable"},
+							Value:         "{yes | no}",
 						},
 					},
 				},
@@ -838,9 +950,11 @@ func TestReader(t *testing.T) {
 					Name:     esixml.Name{Space: "esi", Local: "when"},
 					Attr: []esixml.Attr{
 						{
-							Position: esixml.Position{Start: 315, End: 355},
-							Name:     esixml.Name{Space: "", Local: "test"},
-							Value:    "$(HTTP_COOKIE{group})=='Advanced'",
+							Position:      esixml.Position{Start: 315, End: 355},
+							NamePosition:  esixml.Position{Start: 315, End: 319},
+							ValuePosition: esixml.Position{Start: 321, End: 354},
+							Name:          esixml.Name{Space: "", Local: "test"},
+							Value:         "$(HTTP_COOKIE{group})=='Advanced'",
 						},
 					},
 				},
@@ -855,9 +969,11 @@ func TestReader(t *testing.T) {
 					Name:     esixml.Name{Space: "esi", Local: "include"},
 					Attr: []esixml.Attr{
 						{
-							Position: esixml.Position{Start: 372, End: 415},
-							Name:     esixml.Name{Space: "", Local: "src"},
-							Value:    "https://www.example.com/advanced.html",
+							Position:      esixml.Position{Start: 372, End: 415},
+							NamePosition:  esixml.Position{Start: 372, End: 375},
+							ValuePosition: esixml.Position{Start: 377, End: 414},
+							Name:          esixml.Name{Space: "", Local: "src"},
+							Value:         "https://www.example.com/advanced.html",
 						},
 					},
 					Closed: true,
@@ -883,9 +999,11 @@ func TestReader(t *testing.T) {
 					Name:     esixml.Name{Space: "esi", Local: "when"},
 					Attr: []esixml.Attr{
 						{
-							Position: esixml.Position{Start: 442, End: 484},
-							Name:     esixml.Name{Space: "", Local: "test"},
-							Value:    "$(HTTP_COOKIE{group})=='Basic User'",
+							Position:      esixml.Position{Start: 442, End: 484},
+							NamePosition:  esixml.Position{Start: 442, End: 446},
+							ValuePosition: esixml.Position{Start: 448, End: 483},
+							Name:          esixml.Name{Space: "", Local: "test"},
+							Value:         "$(HTTP_COOKIE{group})=='Basic User'",
 						},
 					},
 				},
@@ -900,9 +1018,11 @@ func TestReader(t *testing.T) {
 					Name:     esixml.Name{Space: "esi", Local: "include"},
 					Attr: []esixml.Attr{
 						{
-							Position: esixml.Position{Start: 501, End: 541},
-							Name:     esixml.Name{Space: "", Local: "src"},
-							Value:    "https://www.example.com/basic.html",
+							Position:      esixml.Position{Start: 501, End: 541},
+							NamePosition:  esixml.Position{Start: 501, End: 504},
+							ValuePosition: esixml.Position{Start: 506, End: 540},
+							Name:          esixml.Name{Space: "", Local: "src"},
+							Value:         "https://www.example.com/basic.html",
 						},
 					},
 					Closed: true,
@@ -938,9 +1058,11 @@ func TestReader(t *testing.T) {
 					Name:     esixml.Name{Space: "esi", Local: "include"},
 					Attr: []esixml.Attr{
 						{
-							Position: esixml.Position{Start: 589, End: 632},
-							Name:     esixml.Name{Space: "", Local: "src"},
-							Value:    "https://www.example.com/new_user.html",
+							Position:      esixml.Position{Start: 589, End: 632},
+							NamePosition:  esixml.Position{Start: 589, End: 592},
+							ValuePosition: esixml.Position{Start: 594, End: 631},
+							Name:          esixml.Name{Space: "", Local: "src"},
+							Value:         "https://www.example.com/new_user.html",
 						},
 					},
 					Closed: true,
@@ -996,9 +1118,11 @@ func TestReader(t *testing.T) {
 					Name:     esixml.Name{Space: "esi", Local: "comment"},
 					Attr: []esixml.Attr{
 						{
-							Position: esixml.Position{Start: 734, End: 754},
-							Name:     esixml.Name{Space: "", Local: "text"},
-							Value:    "Include an ad",
+							Position:      esixml.Position{Start: 734, End: 754},
+							NamePosition:  esixml.Position{Start: 734, End: 738},
+							ValuePosition: esixml.Position{Start: 740, End: 753},
+							Name:          esixml.Name{Space: "", Local: "text"},
+							Value:         "Include an ad",
 						},
 					},
 					Closed: true,
@@ -1014,9 +1138,11 @@ func TestReader(t *testing.T) {
 					Name:     esixml.Name{Space: "esi", Local: "include"},
 					Attr: []esixml.Attr{
 						{
-							Position: esixml.Position{Start: 772, End: 810},
-							Name:     esixml.Name{Space: "", Local: "src"},
-							Value:    "https://www.example.com/ad1.html",
+							Position:      esixml.Position{Start: 772, End: 810},
+							NamePosition:  esixml.Position{Start: 772, End: 775},
+							ValuePosition: esixml.Position{Start: 777, End: 809},
+							Name:          esixml.Name{Space: "", Local: "src"},
+							Value:         "https://www.example.com/ad1.html",
 						},
 					},
 					Closed: true,
@@ -1052,9 +1178,11 @@ func TestReader(t *testing.T) {
 					Name:     esixml.Name{Space: "esi", Local: "comment"},
 					Attr: []esixml.Attr{
 						{
-							Position: esixml.Position{Start: 858, End: 893},
-							Name:     esixml.Name{Space: "", Local: "text"},
-							Value:    "Just write some HTML instead",
+							Position:      esixml.Position{Start: 858, End: 893},
+							NamePosition:  esixml.Position{Start: 858, End: 862},
+							ValuePosition: esixml.Position{Start: 864, End: 892},
+							Name:          esixml.Name{Space: "", Local: "text"},
+							Value:         "Just write some HTML instead",
 						},
 					},
 					Closed: true,
@@ -1090,9 +1218,11 @@ func TestReader(t *testing.T) {
 					Name:     esixml.Name{Space: "esi", Local: "comment"},
 					Attr: []esixml.Attr{
 						{
-							Position: esixml.Position{Start: 1007, End: 1060},
-							Name:     esixml.Name{Space: "", Local: "text"},
-							Value:    "the following animation will have a 24 hr TTL.",
+							Position:      esixml.Position{Start: 1007, End: 1060},
+							NamePosition:  esixml.Position{Start: 1007, End: 1011},
+							ValuePosition: esixml.Position{Start: 1013, End: 1059},
+							Name:          esixml.Name{Space: "", Local: "text"},
+							Value:         "the following animation will have a 24 hr TTL.",
 						},
 					},
 					Closed: true,
@@ -1159,7 +1289,7 @@ func TestReader(t *testing.T) {
 				{Position: esixml.Position{Start: 1426, End: 1439}, Type: esixml.TokenTypeData, Data: []byte(" XML comment ")},
 				{Position: esixml.Position{Start: 1439, End: 1442}, Type: esixml.TokenTypeCommentEnd},
 				{
-					Position: esixml.Position{Start: 1442, End: endIsEOF},
+					Position: esixml.Position{Start: 1442, End: 1467},
 					Type:     esixml.TokenTypeData,
 					Data:     []byte("\n\n<footer>Footer</footer>"),
 				},
@@ -1176,9 +1306,11 @@ func TestReader(t *testing.T) {
 					Name:     esixml.Name{Space: "esi", Local: "include"},
 					Attr: []esixml.Attr{
 						{
-							Position: esixml.Position{Start: 13, End: 24},
-							Name:     esixml.Name{Local: "src"},
-							Value:    "VaLuE",
+							Position:      esixml.Position{Start: 13, End: 24},
+							NamePosition:  esixml.Position{Start: 13, End: 16},
+							ValuePosition: esixml.Position{Start: 18, End: 23},
+							Name:          esixml.Name{Local: "src"},
+							Value:         "VaLuE",
 						},
 					},
 				},
@@ -1204,9 +1336,11 @@ func TestReader(t *testing.T) {
 					Name:     esixml.Name{Space: "esi", Local: "include"},
 					Attr: []esixml.Attr{
 						{
-							Position: esixml.Position{Start: 13, End: 24},
-							Name:     esixml.Name{Local: "src"},
-							Value:    "/test",
+							Position:      esixml.Position{Start: 13, End: 24},
+							NamePosition:  esixml.Position{Start: 13, End: 16},
+							ValuePosition: esixml.Position{Start: 18, End: 23},
+							Name:          esixml.Name{Local: "src"},
+							Value:         "/test",
 						},
 					},
 				},
@@ -1220,15 +1354,7 @@ func TestReader(t *testing.T) {
 			inputReader := testCase.InputReader
 
 			if inputReader == nil {
-				input := strings.TrimSpace(testCase.Input)
-
-				for i, token := range testCase.Tokens {
-					if token.Position.End == endIsEOF {
-						testCase.Tokens[i].Position.End = len(input)
-					}
-				}
-
-				inputReader = strings.NewReader(input)
+				inputReader = strings.NewReader(strings.TrimSpace(testCase.Input))
 			}
 
 			var gotTokens []esixml.Token
@@ -1268,87 +1394,1264 @@ func TestReader(t *testing.T) {
 	}
 }
 
-func BenchmarkReader(b *testing.B) {
-	var r esixml.Reader
+func TestReader_Done(t *testing.T) {
+	t.Run("end of input", func(t *testing.T) {
+		const input = `a<esi:comment text="b"/>c`
 
-	data := strings.TrimSpace(`
-<header>Header</header>
+		r := esixml.NewReader(strings.NewReader(input))
 
-<esi:include src="https://example.com/1.html" alt="https://bak.example.com/2.html" onerror="continue"/>
+		var last esixml.Token
 
-<p>Paragraph between</p>
+		for !r.Done() {
+			token, err := r.Next()
+			if err != nil {
+				t.Fatalf("got error %v", err)
+			}
 
-<esi:inline name="URI" fetchable="{yes | no}"> 
-	fragment to be stored within an ESI processor 
-</esi:inline>
+			last = token
+		}
 
-<p>Paragraph between</p>
+		if got, want := last.Position, (esixml.Position{Start: len(input) - 1, End: len(input)}); got != want {
+			t.Errorf("got position %v for last token, want %v", got, want)
+		}
 
-<esi:choose> 
-	<esi:when test="$(HTTP_COOKIE{group})=='Advanced'"> 
-		<esi:include src="https://www.example.com/advanced.html"/> 
-	</esi:when> 
-	<esi:when test="$(HTTP_COOKIE{group})=='Basic User'">
-		<esi:include src="https://www.example.com/basic.html"/>
-	</esi:when> 
-	<esi:otherwise> 
-		<esi:include src="https://www.example.com/new_user.html"/> 
-	</esi:otherwise>
-</esi:choose>
+		if err := r.Err(); err != nil {
+			t.Errorf("got error %v, want nil", err)
+		}
 
-<p>Paragraph between</p>
+		if _, err := r.Next(); !errors.Is(err, io.EOF) {
+			t.Errorf("got error %v, want %v", err, io.EOF)
+		}
+	})
 
-<esi:try> 
-	<esi:attempt>
-		<esi:comment text="Include an ad"/> 
-		<esi:include src="https://www.example.com/ad1.html"/> 
-	</esi:attempt>
-	<esi:except> 
-		<esi:comment text="Just write some HTML instead"/> 
-		<a href=www.akamai.com>www.example.com</a>
-	</esi:except> 
-</esi:try>
+	t.Run("error", func(t *testing.T) {
+		r := esixml.NewReader(strings.NewReader(`a<esi:`))
 
-<p>Paragraph between</p>
+		_ = r.Drive(func(esixml.Token) error { return nil })
 
-<esi:comment text="the following animation will have a 24 hr TTL." />
+		if !r.Done() {
+			t.Error("got Done() = false, want true")
+		}
 
-<p>Paragraph between</p>
+		want := &esixml.UnexpectedEndOfInput{At: 6}
+		if err := r.Err(); !errors.Is(err, want) {
+			t.Errorf("got error %v, want %v", err, want)
+		}
+	})
 
-<esi:remove> 
-	<a href="https://www.example.com">www.example.com</a>
-</esi:remove>
+	t.Run("feed", func(t *testing.T) {
+		const input = `a<esi:comment text="b"/>c`
 
-<p>Paragraph between</p>
+		r := esixml.NewReader(nil, esixml.WithStartOffset(10))
+		r.Feed([]byte(input))
 
-<esi:vars>
-	<img src="https://www.example.com/$(HTTP_COOKIE{type})/hello.gif"/ >
-</esi:vars>
+		var last esixml.Token
 
-<some"><invalid<xml:<elements that="should be </ignored>
+		for {
+			token, err := r.Next()
+			if errors.Is(err, esixml.ErrNeedMoreData) {
+				break
+			}
 
-<name:spaced-element></name:spaced-element>
+			if err != nil {
+				t.Fatalf("got error %v", err)
+			}
 
-<!--esi ESI comment -->
+			last = token
+		}
 
-<!-- XML comment -->
+		if r.Done() {
+			t.Error("got Done() = true while waiting for more data, want false")
+		}
 
-<footer>Footer</footer>`,
-	)
+		if err := r.Err(); err != nil {
+			t.Errorf("got error %v, want nil", err)
+		}
 
-	sr := strings.NewReader(data)
+		if got, want := last.Position.End, 10+len(input); got != want {
+			t.Errorf("got end %d for last token, want %d", got, want)
+		}
+
+		r.CloseFeed()
+
+		if _, err := r.Next(); !errors.Is(err, io.EOF) {
+			t.Errorf("got error %v, want %v", err, io.EOF)
+		}
 
-	b.ReportAllocs()
-	b.SetBytes(int64(len(data)))
+		if !r.Done() {
+			t.Error("got Done() = false after end of input, want true")
+		}
+	})
+}
 
-	for b.Loop() {
-		sr.Reset(data)
-		r.Reset(sr)
+func TestReader_Drive(t *testing.T) {
+	const input = `a<esi:comment text="b"/>c`
 
-		for _, err := range r.All {
+	t.Run("all tokens", func(t *testing.T) {
+		var got, want []esixml.Token
+
+		for token, err := range esixml.NewReader(strings.NewReader(input)).All {
 			if err != nil {
-				b.Fatal(err)
+				t.Fatalf("got error %v", err)
+			}
+
+			want = append(want, token)
+		}
+
+		err := esixml.NewReader(strings.NewReader(input)).Drive(func(token esixml.Token) error {
+			got = append(got, token)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("tokens mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("callback error", func(t *testing.T) {
+		errStop := errors.New("stop")
+
+		var calls int
+
+		err := esixml.NewReader(strings.NewReader(input)).Drive(func(esixml.Token) error {
+			calls++
+			return errStop
+		})
+		if !errors.Is(err, errStop) {
+			t.Errorf("got error %v, want %v", err, errStop)
+		}
+
+		if calls != 1 {
+			t.Errorf("got %d calls, want 1", calls)
+		}
+	})
+
+	t.Run("reader error", func(t *testing.T) {
+		var calls int
+
+		err := esixml.NewReader(strings.NewReader(`a<esi:`)).Drive(func(esixml.Token) error {
+			calls++
+			return nil
+		})
+		if want := (&esixml.UnexpectedEndOfInput{At: 6}); !errors.Is(err, want) {
+			t.Errorf("got error %v, want %v", err, want)
+		}
+
+		if calls != 1 {
+			t.Errorf("got %d calls, want 1", calls)
+		}
+	})
+}
+
+func TestReader_Tokens(t *testing.T) {
+	var got []esixml.TokenType
+
+	for token, err := range esixml.NewReader(strings.NewReader(`a<esi:comment text="b"/>c`)).Tokens() {
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		got = append(got, token.Type)
+	}
+
+	want := []esixml.TokenType{esixml.TokenTypeData, esixml.TokenTypeStartElement, esixml.TokenTypeData}
+
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("token types mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestReader_WithEntities(t *testing.T) {
+	const input = `<esi:include src="/&custom;/&Other;/&amp;"/>`
+
+	r := esixml.NewReader(strings.NewReader(input),
+		esixml.WithEntities(map[string]string{"custom": "a", "other": "x"}),
+		esixml.WithEntities(map[string]string{"OTHER": "b", "amp": "ignored"}))
+
+	token, err := r.Next()
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	if got, want := token.Attr[0].Value, "/a/b/&"; got != want {
+		t.Errorf("got value %q, want %q", got, want)
+	}
+
+	r.Reset(strings.NewReader(input))
+
+	if _, err := r.Next(); !errors.Is(err, &esixml.UnsupportedEntityError{Offset: 20}) {
+		t.Errorf("got error %v after Reset, want %v", err, &esixml.UnsupportedEntityError{Offset: 20})
+	}
+}
+
+func TestReader_WithCDATAStripping(t *testing.T) {
+	const input = `a<![CDATA[<esi:include src="x"/>]]]>b<![CDATA[]]><esi:remove/><!--<![CDATA[-->`
+
+	want := []esixml.Token{
+		{Position: esixml.Position{End: 1}, Type: esixml.TokenTypeData, Data: []byte("a")},
+		{Position: esixml.Position{Start: 10, End: 33}, Type: esixml.TokenTypeData, Data: []byte(`<esi:include src="x"/>]`)},
+		{Position: esixml.Position{Start: 36, End: 37}, Type: esixml.TokenTypeData, Data: []byte("b")},
+		{
+			Position: esixml.Position{Start: 49, End: 62},
+			Type:     esixml.TokenTypeStartElement,
+			Name:     esixml.Name{Space: "esi", Local: "remove"},
+			Closed:   true,
+		},
+		{Position: esixml.Position{Start: 62, End: 66}, Type: esixml.TokenTypeCommentStart},
+		{Position: esixml.Position{Start: 66, End: 75}, Type: esixml.TokenTypeData, Data: []byte("<![CDATA[")},
+		{Position: esixml.Position{Start: 75, End: 78}, Type: esixml.TokenTypeCommentEnd},
+	}
+
+	var got []esixml.Token
+
+	for token, err := range esixml.NewReader(strings.NewReader(input), esixml.WithCDATAStripping()).All {
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		got = append(got, token)
+	}
+
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("tokens mismatch (-want +got):\n%s", diff)
+	}
+
+	r := esixml.NewReader(nil, esixml.WithCDATAStripping())
+
+	got = got[:0]
+
+	for i := 0; ; {
+		token, err := r.Next()
+
+		switch {
+		case errors.Is(err, esixml.ErrNeedMoreData):
+			r.Feed([]byte{input[i]})
+
+			if i++; i == len(input) {
+				r.CloseFeed()
+			}
+
+			continue
+		case errors.Is(err, io.EOF):
+		case err != nil:
+			t.Fatalf("got error %v", err)
+		default:
+			// Merge adjacent data tokens, since the fed reader may split them at arbitrary positions
+			if n := len(got); n > 0 && token.Type == esixml.TokenTypeData && got[n-1].Type == esixml.TokenTypeData &&
+				got[n-1].Position.End == token.Position.Start {
+				got[n-1].Position.End = token.Position.End
+				got[n-1].Data = append(got[n-1].Data, token.Data...)
+			} else {
+				got = append(got, token)
+			}
+
+			continue
+		}
+
+		break
+	}
+
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("fed tokens mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestReader_WithControlBytePolicy(t *testing.T) {
+	const input = "a\x00b<esi:include src=\"/\x01x\"/>\x7f"
+
+	element := func(src string) esixml.Token {
+		return esixml.Token{
+			Position: esixml.Position{Start: 3, End: 27},
+			Type:     esixml.TokenTypeStartElement,
+			Name:     esixml.Name{Space: "esi", Local: "include"},
+			Attr: []esixml.Attr{
+				{
+					Position:      esixml.Position{Start: 16, End: 25},
+					NamePosition:  esixml.Position{Start: 16, End: 19},
+					ValuePosition: esixml.Position{Start: 21, End: 24},
+					Name:          esixml.Name{Local: "src"},
+					Value:         src,
+				},
+			},
+			Closed: true,
+		}
+	}
+
+	testCases := []struct {
+		Policy esixml.ControlBytePolicy
+		Input  string
+		Tokens []esixml.Token
+		Error  error
+	}{
+		{
+			Policy: esixml.ControlBytesAllow,
+			Input:  input,
+			Tokens: []esixml.Token{
+				{Position: esixml.Position{Start: 0, End: 3}, Type: esixml.TokenTypeData, Data: []byte("a\x00b")},
+				element("/\x01x"),
+				{Position: esixml.Position{Start: 27, End: 28}, Type: esixml.TokenTypeData, Data: []byte("\x7f")},
+			},
+		},
+		{
+			Policy: esixml.ControlBytesReject,
+			Input:  input,
+			Error:  &esixml.ControlByteError{At: 1, Byte: 0},
+		},
+		{
+			Policy: esixml.ControlBytesReject,
+			Input:  "a\tb\r\n<esi:include src=\"/\x01x\"/>",
+			Tokens: []esixml.Token{
+				{Position: esixml.Position{Start: 0, End: 5}, Type: esixml.TokenTypeData, Data: []byte("a\tb\r\n")},
+			},
+			Error: &esixml.ControlByteError{At: 24, Byte: 1},
+		},
+		{
+			Policy: esixml.ControlBytesStrip,
+			Input:  input,
+			Tokens: []esixml.Token{
+				{Position: esixml.Position{Start: 0, End: 3}, Type: esixml.TokenTypeData, Data: []byte("ab")},
+				element("/x"),
+				{Position: esixml.Position{Start: 27, End: 28}, Type: esixml.TokenTypeData, Data: []byte{}},
+			},
+		},
+		{
+			Policy: esixml.ControlBytesReplace,
+			Input:  input,
+			Tokens: []esixml.Token{
+				{Position: esixml.Position{Start: 0, End: 3}, Type: esixml.TokenTypeData, Data: []byte("a\uFFFDb")},
+				element("/\uFFFDx"),
+				{Position: esixml.Position{Start: 27, End: 28}, Type: esixml.TokenTypeData, Data: []byte("\uFFFD")},
+			},
+		},
+		{
+			Policy: esixml.ControlBytesReplace,
+			Input:  "<esi:include \x00src=\"/\"/>",
+			Error:  &esixml.ControlByteError{At: 13, Byte: 0},
+		},
+		{
+			Policy: esixml.ControlBytesStrip,
+			Input:  "<esi:include src=/\x00/>",
+			Error:  &esixml.ControlByteError{At: 18, Byte: 0},
+		},
+		{
+			Policy: esixml.ControlBytesStrip,
+			Input:  "<esi:include src=\"/\"\x00/>",
+			Error:  &esixml.ControlByteError{At: 20, Byte: 0},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Policy.String(), func(t *testing.T) {
+			r := esixml.NewReader(strings.NewReader(testCase.Input), esixml.WithControlBytePolicy(testCase.Policy))
+
+			var got []esixml.Token
+
+			for token, err := range r.All {
+				if err != nil {
+					if !errors.Is(err, testCase.Error) {
+						t.Errorf("got error %v, want %v", err, testCase.Error)
+					}
+
+					break
+				}
+
+				got = append(got, token)
+			}
+
+			if diff := cmp.Diff(testCase.Tokens, got); diff != "" {
+				t.Errorf("tokens mismatch (-want +got):\n%s", diff)
 			}
+		})
+	}
+}
+
+func TestReader_WithDeclarationTokens(t *testing.T) {
+	const input = `<?xml version="1.0" encoding="UTF-8"?>` + "\n" +
+		`<!doctype html [<!ENTITY a "<b>">]>` + "\n" +
+		`<!-- <!DOCTYPE x> --><?xml-stylesheet href="x"?>`
+
+	want := []esixml.Token{
+		{
+			Position: esixml.Position{Start: 0, End: 38},
+			Type:     esixml.TokenTypeXMLDeclaration,
+			Data:     []byte(`<?xml version="1.0" encoding="UTF-8"?>`),
+		},
+		{Position: esixml.Position{Start: 38, End: 39}, Type: esixml.TokenTypeData, Data: []byte("\n")},
+		{
+			Position: esixml.Position{Start: 39, End: 74},
+			Type:     esixml.TokenTypeDoctype,
+			Data:     []byte(`<!doctype html [<!ENTITY a "<b>">]>`),
+		},
+		{Position: esixml.Position{Start: 74, End: 75}, Type: esixml.TokenTypeData, Data: []byte("\n")},
+		{Position: esixml.Position{Start: 75, End: 79}, Type: esixml.TokenTypeCommentStart},
+		{Position: esixml.Position{Start: 79, End: 93}, Type: esixml.TokenTypeData, Data: []byte(" <!DOCTYPE x> ")},
+		{Position: esixml.Position{Start: 93, End: 96}, Type: esixml.TokenTypeCommentEnd},
+		{
+			Position: esixml.Position{Start: 96, End: 123},
+			Type:     esixml.TokenTypeData,
+			Data:     []byte(`<?xml-stylesheet href="x"?>`),
+		},
+	}
+
+	var got []esixml.Token
+
+	for token, err := range esixml.NewReader(strings.NewReader(input), esixml.WithDeclarationTokens()).All {
+		if err != nil {
+			t.Fatalf("got error %v", err)
 		}
+
+		got = append(got, token)
+	}
+
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("tokens mismatch (-want +got):\n%s", diff)
+	}
+
+	r := esixml.NewReader(nil, esixml.WithDeclarationTokens())
+
+	got = got[:0]
+
+	for i := 0; ; {
+		token, err := r.Next()
+
+		switch {
+		case errors.Is(err, esixml.ErrNeedMoreData):
+			r.Feed([]byte{input[i]})
+
+			if i++; i == len(input) {
+				r.CloseFeed()
+			}
+
+			continue
+		case errors.Is(err, io.EOF):
+		case err != nil:
+			t.Fatalf("got error %v", err)
+		default:
+			// Merge data tokens, since the fed reader may split them at arbitrary positions
+			if n := len(got); n > 0 && token.Type == esixml.TokenTypeData && got[n-1].Type == esixml.TokenTypeData {
+				got[n-1].Position.End = token.Position.End
+				got[n-1].Data = append(got[n-1].Data, token.Data...)
+			} else {
+				got = append(got, token)
+			}
+
+			continue
+		}
+
+		break
+	}
+
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("fed tokens mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestReader_WithDeclarationTokens_Unterminated(t *testing.T) {
+	r := esixml.NewReader(strings.NewReader(`<!DOCTYPE html`), esixml.WithDeclarationTokens())
+
+	if _, err := r.Next(); !errors.Is(err, &esixml.UnexpectedEndOfInput{At: 14}) {
+		t.Errorf("got error %v, want %v", err, &esixml.UnexpectedEndOfInput{At: 14})
+	}
+}
+
+func TestReader_WithDuplicateAttrPolicy(t *testing.T) {
+	const input = `<esi:element attr1=value1 attr2=value2 attr1=value3>`
+
+	testCases := []struct {
+		Policy esixml.DuplicateAttrPolicy
+		Attr   []esixml.Attr
+		Error  error
+	}{
+		{
+			Policy: esixml.DuplicateAttrReject,
+			Error:  &esixml.DuplicateAttributeError{At: 39, Name: "attr1"},
+		},
+		{
+			Policy: esixml.DuplicateAttrKeepFirst,
+			Attr: []esixml.Attr{
+				{
+					Position:      esixml.Position{Start: 13, End: 25},
+					NamePosition:  esixml.Position{Start: 13, End: 18},
+					ValuePosition: esixml.Position{Start: 19, End: 25},
+					Name:          esixml.Name{Local: "attr1"},
+					Value:         "value1",
+				},
+				{
+					Position:      esixml.Position{Start: 26, End: 38},
+					NamePosition:  esixml.Position{Start: 26, End: 31},
+					ValuePosition: esixml.Position{Start: 32, End: 38},
+					Name:          esixml.Name{Local: "attr2"},
+					Value:         "value2",
+				},
+			},
+		},
+		{
+			Policy: esixml.DuplicateAttrKeepLast,
+			Attr: []esixml.Attr{
+				{
+					Position:      esixml.Position{Start: 39, End: 51},
+					NamePosition:  esixml.Position{Start: 39, End: 44},
+					ValuePosition: esixml.Position{Start: 45, End: 51},
+					Name:          esixml.Name{Local: "attr1"},
+					Value:         "value3",
+				},
+				{
+					Position:      esixml.Position{Start: 26, End: 38},
+					NamePosition:  esixml.Position{Start: 26, End: 31},
+					ValuePosition: esixml.Position{Start: 32, End: 38},
+					Name:          esixml.Name{Local: "attr2"},
+					Value:         "value2",
+				},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Policy.String(), func(t *testing.T) {
+			r := esixml.NewReader(strings.NewReader(input), esixml.WithDuplicateAttrPolicy(testCase.Policy))
+
+			token, err := r.Next()
+			if !errors.Is(err, testCase.Error) {
+				t.Errorf("got error %v, want %v", err, testCase.Error)
+			}
+
+			if diff := cmp.Diff(testCase.Attr, token.Attr); diff != "" {
+				t.Errorf("Attr mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestReader_WithDuplicateAttrPolicy_ManyAttributes(t *testing.T) {
+	var sb strings.Builder
+
+	sb.WriteString("<esi:element")
+
+	for i := range 16 {
+		fmt.Fprintf(&sb, " attr%02d=first", i)
+	}
+
+	dupOffset := sb.Len() + 1
+
+	sb.WriteString(" attr03=second attr12=second>")
+
+	input := sb.String()
+
+	testCases := []struct {
+		Policy esixml.DuplicateAttrPolicy
+		Values map[string]string
+		Error  error
+	}{
+		{
+			Policy: esixml.DuplicateAttrReject,
+			Error:  &esixml.DuplicateAttributeError{At: dupOffset, Name: "attr03"},
+		},
+		{
+			Policy: esixml.DuplicateAttrKeepFirst,
+			Values: map[string]string{"attr03": "first", "attr12": "first"},
+		},
+		{
+			Policy: esixml.DuplicateAttrKeepLast,
+			Values: map[string]string{"attr03": "second", "attr12": "second"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Policy.String(), func(t *testing.T) {
+			// Read the element twice to verify that no state is kept between elements.
+			r := esixml.NewReader(strings.NewReader(input+input), esixml.WithDuplicateAttrPolicy(testCase.Policy))
+
+			for range 2 {
+				token, err := r.Next()
+				if !errors.Is(err, testCase.Error) {
+					t.Errorf("got error %v, want %v", err, testCase.Error)
+				}
+
+				if testCase.Error != nil {
+					return
+				}
+
+				if got, want := len(token.Attr), 16; got != want {
+					t.Errorf("got %d attributes, want %d", got, want)
+				}
+
+				for _, attr := range token.Attr {
+					if want, ok := testCase.Values[attr.Name.Local]; ok && attr.Value != want {
+						t.Errorf("got value %q for attribute %s, want %q", attr.Value, attr.Name.Local, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestReader_WithMaxDataSize(t *testing.T) {
+	testCases := []struct {
+		Name  string
+		Input string
+		Max   int
+		Data  []string
+	}{
+		{
+			Name:  "short",
+			Input: `abc`,
+			Max:   4,
+			Data:  []string{"abc"},
+		},
+		{
+			Name:  "split",
+			Input: `abcdefghij<esi:comment text="x"/>klm`,
+			Max:   4,
+			Data:  []string{"abcd", "efgh", "ij", "klm"},
+		},
+		{
+			Name:  "dashes and tags",
+			Input: `a--<<--<b>--x`,
+			Max:   3,
+			Data:  []string{"a--", "<<-", "-<b", ">--", "x"},
+		},
+		{
+			Name:  "comment",
+			Input: `<!--abc-def-->`,
+			Max:   3,
+			Data:  []string{"abc", "-de", "f"},
+		},
+		{
+			Name:  "CDATA",
+			Input: `ab<![CDATA[<esi:x/>]]>c`,
+			Max:   10,
+			Data:  []string{"ab", "<![CDATA[<", "esi:x/>]]>", "c"},
+		},
+		{
+			Name:  "runes",
+			Input: `aäöü`,
+			Max:   2,
+			Data:  []string{"a", "ä", "ö", "ü"},
+		},
+		{
+			Name:  "rune larger than limit",
+			Input: `äöü`,
+			Max:   1,
+			Data:  []string{"ä", "ö", "ü"},
+		},
+		{
+			Name:  "long",
+			Input: strings.Repeat("x", 2500),
+			Max:   1000,
+			Data:  []string{strings.Repeat("x", 1000), strings.Repeat("x", 1000), strings.Repeat("x", 500)},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			var data []string
+			var offset int
+
+			for tok, err := range esixml.NewReader(strings.NewReader(testCase.Input), esixml.WithMaxDataSize(testCase.Max)).All {
+				if err != nil {
+					t.Fatalf("got error %v", err)
+				}
+
+				if tok.Position.Start < offset {
+					t.Errorf("got token starting at %d, want >= %d", tok.Position.Start, offset)
+				}
+
+				offset = tok.Position.End
+
+				if tok.Type != esixml.TokenTypeData {
+					continue
+				}
+
+				if got, want := tok.Position.End-tok.Position.Start, len(tok.Data); got != want {
+					t.Errorf("got position length %d, want %d", got, want)
+				}
+
+				data = append(data, string(tok.Data))
+			}
+
+			if diff := cmp.Diff(testCase.Data, data); diff != "" {
+				t.Errorf("data mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestReader_WithStartOffset(t *testing.T) {
+	r := esixml.NewReader(strings.NewReader(`<esi:include src="/"/>data<esi:`), esixml.WithStartOffset(100))
+
+	want := []esixml.Token{
+		{
+			Position: esixml.Position{Start: 100, End: 122},
+			Type:     esixml.TokenTypeStartElement,
+			Name:     esixml.Name{Space: "esi", Local: "include"},
+			Attr: []esixml.Attr{
+				{
+					Position:      esixml.Position{Start: 113, End: 120},
+					NamePosition:  esixml.Position{Start: 113, End: 116},
+					ValuePosition: esixml.Position{Start: 118, End: 119},
+					Name:          esixml.Name{Local: "src"},
+					Value:         "/",
+				},
+			},
+			Closed: true,
+		},
+		{Position: esixml.Position{Start: 122, End: 126}, Type: esixml.TokenTypeData, Data: []byte("data")},
+	}
+
+	for i := range want {
+		got, err := r.Next()
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		if diff := cmp.Diff(want[i], got); diff != "" {
+			t.Errorf("token %d mismatch (-want +got):\n%s", i, diff)
+		}
+	}
+
+	if _, err := r.Next(); !errors.Is(err, &esixml.UnexpectedEndOfInput{At: 131}) {
+		t.Errorf("got error %v, want %v", err, &esixml.UnexpectedEndOfInput{At: 131})
+	}
+}
+
+func TestReader_WithSyntaxErrorRecovery(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Input    string
+		Expected []string
+		Error    error
+	}{
+		{
+			Name:     "inline script",
+			Input:    `<script>if (a <esi:x) { b() }</script><esi:include src="/a"/>c`,
+			Expected: []string{`<script>if (a `, `<esi:x) { b() }</script>`, `esi:include`, `c`},
+		},
+		{
+			Name:     "invalid end element",
+			Input:    `a</esi:remove b>c</esi:remove>`,
+			Expected: []string{`a`, `</esi:remove b>`, `c`, `/esi:remove`},
+		},
+		{
+			Name:     "quoted greater than",
+			Input:    `<esi:include src="a>b" 1>c`,
+			Expected: []string{`<esi:include src="a>b" 1>`, `c`},
+		},
+		{
+			Name:     "duplicate attribute",
+			Input:    `<esi:include src="/a" src="/b"/>`,
+			Expected: []string{`<esi:include src="/a" src="/b"/>`},
+		},
+		{
+			Name:     "no closing greater than",
+			Input:    `a<esi:x!`,
+			Expected: []string{`a`, `<esi:x!`},
+		},
+		{
+			Name:     "unexpected end of input",
+			Input:    `a<esi:include src="/a`,
+			Expected: []string{`a`},
+			Error:    &esixml.UnexpectedEndOfInput{At: 21},
+		},
+	}
+
+	tokenString := func(token esixml.Token) string {
+		switch token.Type {
+		case esixml.TokenTypeStartElement:
+			return token.Name.String()
+		case esixml.TokenTypeEndElement:
+			return "/" + token.Name.String()
+		default:
+			return string(token.Data)
+		}
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			r := esixml.NewReader(strings.NewReader(testCase.Input), esixml.WithSyntaxErrorRecovery())
+
+			var got []string
+			var gotErr error
+
+			for token, err := range r.All {
+				if err != nil {
+					gotErr = err
+					break
+				}
+
+				got = append(got, tokenString(token))
+			}
+
+			if diff := cmp.Diff(testCase.Expected, got); diff != "" {
+				t.Errorf("tokens mismatch (-want +got):\n%s", diff)
+			}
+
+			if !errors.Is(gotErr, testCase.Error) {
+				t.Errorf("got error %v, want %v", gotErr, testCase.Error)
+			}
+
+			r.Reset(nil, esixml.WithSyntaxErrorRecovery())
+
+			var fed strings.Builder
+
+			for i := range len(testCase.Input) {
+				r.Feed([]byte{testCase.Input[i]})
+
+				if i == len(testCase.Input)-1 {
+					r.CloseFeed()
+				}
+
+				for {
+					token, err := r.Next()
+					if err != nil {
+						break
+					}
+
+					if token.Type == esixml.TokenTypeData {
+						fed.Write(token.Data)
+					}
+				}
+			}
+
+			var want strings.Builder
+
+			for _, s := range testCase.Expected {
+				if !strings.HasPrefix(s, "esi:") && !strings.HasPrefix(s, "/esi:") {
+					want.WriteString(s)
+				}
+			}
+
+			if fed.String() != want.String() {
+				t.Errorf("fed data mismatch: got %q, want %q", fed.String(), want.String())
+			}
+		})
+	}
+}
+
+func TestReader_WithUTF8Validation(t *testing.T) {
+	readFed := func(input string) ([]esixml.Token, error) {
+		r := esixml.NewReader(nil, esixml.WithUTF8Validation())
+
+		var got []esixml.Token
+
+		for i := 0; ; {
+			token, err := r.Next()
+
+			switch {
+			case errors.Is(err, esixml.ErrNeedMoreData):
+				r.Feed([]byte{input[i]})
+
+				if i++; i == len(input) {
+					r.CloseFeed()
+				}
+			case errors.Is(err, io.EOF):
+				return got, nil
+			case err != nil:
+				return got, err
+			default:
+				got = append(got, token)
+			}
+		}
+	}
+
+	t.Run("Valid", func(t *testing.T) {
+		const input = "a\u00e4<esi:include src=\"/\"/>\u00f6\u20ac\U0001F600"
+
+		got, err := readFed(input)
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		var data []byte
+
+		for _, token := range got {
+			if token.Type != esixml.TokenTypeData {
+				continue
+			}
+
+			if !utf8.Valid(token.Data) {
+				t.Errorf("got invalid UTF-8 %q in token at %v", token.Data, token.Position)
+			}
+
+			if want := input[token.Position.Start:token.Position.End]; string(token.Data) != want {
+				t.Errorf("got data %q at %v, want %q", token.Data, token.Position, want)
+			}
+
+			data = append(data, token.Data...)
+		}
+
+		if diff := cmp.Diff("a\u00e4\u00f6\u20ac\U0001F600", string(data)); diff != "" {
+			t.Errorf("data mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	testCases := []struct {
+		Name  string
+		Input string
+		Error error
+	}{
+		{Name: "Invalid", Input: "ab\xffc", Error: &esixml.InvalidUTF8Error{At: 2}},
+		{Name: "Invalid after element", Input: "a<esi:include src=\"/\"/>b\xc3(", Error: &esixml.InvalidUTF8Error{At: 24}},
+		{Name: "Incomplete at end", Input: "ab\xe2\x82", Error: &esixml.InvalidUTF8Error{At: 2}},
+		{Name: "Comment", Input: "<!--esi a\xff-->", Error: &esixml.InvalidUTF8Error{At: 9}},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			r := esixml.NewReader(strings.NewReader(testCase.Input), esixml.WithUTF8Validation())
+
+			var err error
+
+			for _, err = range r.All {
+				if err != nil {
+					break
+				}
+			}
+
+			if !errors.Is(err, testCase.Error) {
+				t.Errorf("got error %v, want %v", err, testCase.Error)
+			}
+
+			if _, err := readFed(testCase.Input); !errors.Is(err, testCase.Error) {
+				t.Errorf("got error %v when feeding data, want %v", err, testCase.Error)
+			}
+		})
+	}
+}
+
+func TestReader_WithoutESIComments(t *testing.T) {
+	const input = `<!--esi <esi:vars>$(HTTP_HOST)</esi:vars> -->`
+
+	want := []esixml.Token{
+		{Position: esixml.Position{Start: 0, End: 4}, Type: esixml.TokenTypeCommentStart},
+		{
+			Position: esixml.Position{Start: 4, End: 42},
+			Type:     esixml.TokenTypeData,
+			Data:     []byte("esi <esi:vars>$(HTTP_HOST)</esi:vars> "),
+		},
+		{Position: esixml.Position{Start: 42, End: 45}, Type: esixml.TokenTypeCommentEnd},
+	}
+
+	var got []esixml.Token
+
+	for token, err := range esixml.NewReader(strings.NewReader(input), esixml.WithoutESIComments()).All {
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		got = append(got, token)
+	}
+
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("tokens mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestReader_Recover(t *testing.T) {
+	const input = `a<esi:include src="/&bad;"/>b<esi:include a b/>c`
+
+	r := esixml.NewReader(strings.NewReader(input))
+
+	var got []string
+
+	for {
+		token, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			if !r.Recover() {
+				t.Fatalf("failed to recover from error %v", err)
+			}
+
+			got = append(got, "error")
+			continue
+		}
+
+		got = append(got, string(token.Data))
+	}
+
+	if diff := cmp.Diff([]string{"a", "error", "b", "error", "c"}, got); diff != "" {
+		t.Errorf("tokens mismatch (-want +got):\n%s", diff)
+	}
+
+	r.Reset(strings.NewReader(`<esi:include src="/`))
+
+	if _, err := r.Next(); err == nil {
+		t.Fatal("expected error")
+	}
+
+	if r.Recover() {
+		t.Error("Recover() returned true after unexpected end of input")
+	}
+
+	r.Reset(nil)
+	r.Feed([]byte(`<esi:include a b/>`))
+	r.CloseFeed()
+
+	if _, err := r.Next(); err == nil {
+		t.Fatal("expected error")
+	}
+
+	if r.Recover() {
+		t.Error("Recover() returned true for fed data")
+	}
+}
+
+func TestReader_Feed(t *testing.T) {
+	const input = `<p>before</p> <esi:include src="/a&amp;b" alt='/alt'
+		onerror=continue/>-- <!--esi <esi:remove>removed</esi:remove> --> <!-- - comment -- --> <esi:vars>
+		$(HTTP_HOST)</esi:vars><esi:invalid attr="<"/>`
+
+	readAll := func(t *testing.T, r *esixml.Reader, chunkSize int) ([]esixml.Token, error) {
+		t.Helper()
+
+		var tokens []esixml.Token
+
+		remaining := input
+
+		for {
+			token, err := r.Next()
+
+			switch {
+			case errors.Is(err, esixml.ErrNeedMoreData):
+				if remaining == "" {
+					t.Fatal("got ErrNeedMoreData after CloseFeed")
+				}
+
+				chunk := remaining[:min(chunkSize, len(remaining))]
+				remaining = remaining[len(chunk):]
+
+				r.Feed([]byte(chunk))
+
+				if remaining == "" {
+					r.CloseFeed()
+				}
+
+				continue
+			case err != nil:
+				return tokens, err
+			}
+
+			// Merge data tokens, since the fed reader may split them at arbitrary positions
+			if n := len(tokens); n > 0 && token.Type == esixml.TokenTypeData && tokens[n-1].Type == esixml.TokenTypeData {
+				tokens[n-1].Position.End = token.Position.End
+				tokens[n-1].Data = append(tokens[n-1].Data, token.Data...)
+				continue
+			}
+
+			tokens = append(tokens, token)
+		}
+	}
+
+	wantReader := esixml.NewReader(strings.NewReader(input))
+
+	var wantTokens []esixml.Token
+	var wantErr error
+
+	for token, err := range wantReader.All {
+		if err != nil {
+			wantErr = err
+			break
+		}
+
+		wantTokens = append(wantTokens, token)
+	}
+
+	if wantErr == nil {
+		t.Fatal("expected input to produce an error")
+	}
+
+	for chunkSize := 1; chunkSize <= len(input); chunkSize++ {
+		r := esixml.NewReader(nil)
+
+		gotTokens, gotErr := readAll(t, r, chunkSize)
+
+		if diff := cmp.Diff(wantTokens, gotTokens); diff != "" {
+			t.Errorf("chunk size %d: tokens mismatch (-want +got):\n%s", chunkSize, diff)
+		}
+
+		if !errors.Is(gotErr, wantErr) {
+			t.Errorf("chunk size %d: got error %v, want %v", chunkSize, gotErr, wantErr)
+		}
+
+		if _, err := r.Next(); !errors.Is(err, gotErr) {
+			t.Errorf("chunk size %d: calling Next() after error: got error %v, want %v", chunkSize, err, gotErr)
+		}
+	}
+}
+
+func BenchmarkReader(b *testing.B) {
+	var r esixml.Reader
+
+	data := strings.TrimSpace(`
+<header>Header</header>
+
+<esi:include src="https://example.com/1.html" alt="https://bak.example.com/2.html" onerror="continue"/>
+
+<p>Paragraph between</p>
+
+<esi:inline name="URI" fetchable="{yes | no}"> 
+	fragment to be stored within an ESI processor 
+</esi:inline>
+
+<p>Paragraph between</p>
+
+<esi:choose> 
+	<esi:when test="$(HTTP_COOKIE{group})=='Advanced'"> 
+		<esi:include src="https://www.example.com/advanced.html"/> 
+	</esi:when> 
+	<esi:when test="$(HTTP_COOKIE{group})=='Basic User'">
+		<esi:include src="https://www.example.com/basic.html"/>
+	</esi:when> 
+	<esi:otherwise> 
+		<esi:include src="https://www.example.com/new_user.html"/> 
+	</esi:otherwise>
+</esi:choose>
+
+<p>Paragraph between</p>
+
+<esi:try> 
+	<esi:attempt>
+		<esi:comment text="Include an ad"/> 
+		<esi:include src="https://www.example.com/ad1.html"/> 
+	</esi:attempt>
+	<esi:except> 
+		<esi:comment text="Just write some HTML instead"/> 
+		<a href=www.akamai.com>www.example.com</a>
+	</esi:except> 
+</esi:try>
+
+<p>Paragraph between</p>
+
+<esi:comment text="the following animation will have a 24 hr TTL." />
+
+<p>Paragraph between</p>
+
+<esi:remove> 
+	<a href="https://www.example.com">www.example.com</a>
+</esi:remove>
+
+<p>Paragraph between</p>
+
+<esi:vars>
+	<img src="https://www.example.com/$(HTTP_COOKIE{type})/hello.gif"/ >
+</esi:vars>
+
+<some"><invalid<xml:<elements that="should be </ignored>
+
+<name:spaced-element></name:spaced-element>
+
+<!--esi ESI comment -->
+
+<!-- XML comment -->
+
+<footer>Footer</footer>`,
+	)
+
+	sr := strings.NewReader(data)
+
+	b.Run("All", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+
+		for b.Loop() {
+			sr.Reset(data)
+			r.Reset(sr)
+
+			for _, err := range r.All {
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	b.Run("Drive", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+
+		for b.Loop() {
+			sr.Reset(data)
+			r.Reset(sr)
+
+			if err := r.Drive(func(esixml.Token) error { return nil }); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("Next", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+
+		for b.Loop() {
+			sr.Reset(data)
+			r.Reset(sr)
+
+			for {
+				_, err := r.Next()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	b.Run("Tokens", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+
+		for b.Loop() {
+			sr.Reset(data)
+			r.Reset(sr)
+
+			for _, err := range r.Tokens() {
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
+
+func BenchmarkReader_Attributes(b *testing.B) {
+	for _, n := range []int{4, 8, 16, 64} {
+		var sb strings.Builder
+
+		sb.WriteString("<esi:element")
+
+		for i := range n {
+			fmt.Fprintf(&sb, " attr%d=value", i)
+		}
+
+		sb.WriteString("/>")
+
+		data := sb.String()
+
+		b.Run(fmt.Sprintf("%d", n), func(b *testing.B) {
+			var r esixml.Reader
+
+			sr := strings.NewReader(data)
+
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+
+			for b.Loop() {
+				sr.Reset(data)
+				r.Reset(sr)
+
+				if _, err := r.Next(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
 	}
 }
@@ -0,0 +1,131 @@
+package esixml
+
+import (
+	"sync"
+	"unicode/utf8"
+)
+
+// offsetIndexBlockSize is the number of bytes between two checkpoints of an [OffsetIndex].
+const offsetIndexBlockSize = 256
+
+// OffsetIndex converts byte offsets, as used by [Position] and all errors, into rune offsets or UTF-16 code unit
+// offsets, as used for example by editors and the Language Server Protocol.
+//
+// The index is built lazily on the first conversion and stores a checkpoint for every 256 bytes of input, so that each
+// conversion only needs to scan a small part of the input.
+//
+// Offsets are expected to be at the start of a rune. For offsets inside a multi-byte rune the offset of the following
+// rune is returned. Invalid UTF-8 bytes are counted as a single rune and UTF-16 code unit each.
+//
+// OffsetIndex is safe for concurrent use.
+type OffsetIndex struct {
+	data []byte
+
+	once sync.Once
+
+	// starts contains the offset of the first rune starting at or after the beginning of each block, while runes and
+	// utf16 contain the number of runes and UTF-16 code units before that rune.
+	starts []int
+	runes  []int
+	utf16  []int
+}
+
+// NewOffsetIndex returns a new OffsetIndex for the given input.
+//
+// The data must not be modified while the index is in use.
+func NewOffsetIndex(data []byte) *OffsetIndex {
+	return &OffsetIndex{data: data}
+}
+
+// RuneOffset returns the number of runes before the given byte offset.
+//
+// Offsets < 0 or greater than the length of the input are clamped.
+func (x *OffsetIndex) RuneOffset(offset int) int {
+	runes, _ := x.convert(offset)
+	return runes
+}
+
+// RunePosition returns the given position converted from byte offsets to rune offsets.
+func (x *OffsetIndex) RunePosition(pos Position) Position {
+	return Position{Start: x.RuneOffset(pos.Start), End: x.RuneOffset(pos.End)}
+}
+
+// UTF16Offset returns the number of UTF-16 code units needed to encode the input before the given byte offset.
+//
+// Offsets < 0 or greater than the length of the input are clamped.
+func (x *OffsetIndex) UTF16Offset(offset int) int {
+	_, utf16 := x.convert(offset)
+	return utf16
+}
+
+// UTF16Position returns the given position converted from byte offsets to UTF-16 code unit offsets.
+func (x *OffsetIndex) UTF16Position(pos Position) Position {
+	return Position{Start: x.UTF16Offset(pos.Start), End: x.UTF16Offset(pos.End)}
+}
+
+func (x *OffsetIndex) build() {
+	blocks := len(x.data)/offsetIndexBlockSize + 1
+
+	x.starts = make([]int, blocks)
+	x.runes = make([]int, blocks)
+	x.utf16 = make([]int, blocks)
+
+	var start, runes, utf16 int
+
+	for i := 1; i < blocks; i++ {
+		r, u, next := countRunes(x.data, start, i*offsetIndexBlockSize)
+
+		start = next
+		runes += r
+		utf16 += u
+
+		x.starts[i] = start
+		x.runes[i] = runes
+		x.utf16[i] = utf16
+	}
+}
+
+func (x *OffsetIndex) convert(offset int) (runes, utf16 int) {
+	x.once.Do(x.build)
+
+	offset = max(0, min(offset, len(x.data)))
+
+	block := offset / offsetIndexBlockSize
+
+	// The offset is inside a rune that started in the previous block.
+	if offset <= x.starts[block] {
+		return x.runes[block], x.utf16[block]
+	}
+
+	r, u, _ := countRunes(x.data, x.starts[block], offset)
+
+	return x.runes[block] + r, x.utf16[block] + u
+}
+
+// countRunes returns the number of runes and UTF-16 code units in b that start in the range [from, to), as well as the
+// offset of the first rune starting at or after to.
+//
+// Invalid UTF-8 bytes are counted as a single rune and UTF-16 code unit each, like the [utf8.RuneError] they are
+// decoded to.
+func countRunes(b []byte, from, to int) (runes, utf16, next int) {
+	for next = from; next < to; {
+		r, size := utf8.DecodeRune(b[next:])
+
+		runes++
+		utf16 += utf16RuneLen(r)
+		next += size
+	}
+
+	return runes, utf16, next
+}
+
+// utf16RuneLen returns the number of UTF-16 code units needed to encode r.
+//
+// Runes outside the Basic Multilingual Plane need 2 UTF-16 code units.
+func utf16RuneLen(r rune) int {
+	if r >= 0x10000 {
+		return 2
+	}
+
+	return 1
+}
@@ -0,0 +1,96 @@
+package esixml_test
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/nussjustin/esi/esixml"
+)
+
+func TestOffsetIndex(t *testing.T) {
+	// Mix ASCII, 2, 3 and 4 byte runes and make the input span multiple blocks
+	input := strings.Repeat("a<esi:include src=\"/ä\"/>€😀\n", 40)
+
+	x := esixml.NewOffsetIndex([]byte(input))
+
+	for offset := 0; offset <= len(input); offset++ {
+		if offset < len(input) && !utf8.RuneStart(input[offset]) {
+			continue
+		}
+
+		prefix := input[:offset]
+
+		if got, want := x.RuneOffset(offset), utf8.RuneCountInString(prefix); got != want {
+			t.Fatalf("RuneOffset(%d): got %d, want %d", offset, got, want)
+		}
+
+		if got, want := x.UTF16Offset(offset), len(utf16.Encode([]rune(prefix))); got != want {
+			t.Fatalf("UTF16Offset(%d): got %d, want %d", offset, got, want)
+		}
+	}
+
+	if got, want := x.RuneOffset(-1), 0; got != want {
+		t.Errorf("RuneOffset(-1): got %d, want %d", got, want)
+	}
+
+	if got, want := x.RuneOffset(len(input)+10), utf8.RuneCountInString(input); got != want {
+		t.Errorf("RuneOffset(len+10): got %d, want %d", got, want)
+	}
+
+	pos := esixml.Position{Start: len("a<esi:include src=\"/ä\"/>€"), End: len("a<esi:include src=\"/ä\"/>€😀")}
+
+	if got, want := x.RunePosition(pos), (esixml.Position{Start: 25, End: 26}); got != want {
+		t.Errorf("RunePosition(%v): got %v, want %v", pos, got, want)
+	}
+
+	if got, want := x.UTF16Position(pos), (esixml.Position{Start: 25, End: 27}); got != want {
+		t.Errorf("UTF16Position(%v): got %v, want %v", pos, got, want)
+	}
+}
+
+func TestOffsetIndex_InvalidUTF8(t *testing.T) {
+	x := esixml.NewOffsetIndex([]byte("a\x80b"))
+
+	if got, want := x.RuneOffset(3), 3; got != want {
+		t.Errorf("RuneOffset(3): got %d, want %d", got, want)
+	}
+
+	if got, want := x.UTF16Offset(3), 3; got != want {
+		t.Errorf("UTF16Offset(3): got %d, want %d", got, want)
+	}
+
+	// Mix invalid bytes, truncated sequences and valid runes and make the input span multiple blocks
+	input := strings.Repeat("a\x80\xF0\x9F\xFFb\xE2\x82ä😀\xF4\x90\x80\x80", 40)
+
+	x = esixml.NewOffsetIndex([]byte(input))
+
+	for offset := range input {
+		prefix := input[:offset]
+
+		if got, want := x.RuneOffset(offset), len([]rune(prefix)); got != want {
+			t.Fatalf("RuneOffset(%d): got %d, want %d", offset, got, want)
+		}
+
+		if got, want := x.UTF16Offset(offset), len(utf16.Encode([]rune(prefix))); got != want {
+			t.Fatalf("UTF16Offset(%d): got %d, want %d", offset, got, want)
+		}
+	}
+
+	if got, want := x.RuneOffset(len(input)), len([]rune(input)); got != want {
+		t.Errorf("RuneOffset(len): got %d, want %d", got, want)
+	}
+}
+
+func TestOffsetIndex_Empty(t *testing.T) {
+	x := esixml.NewOffsetIndex(nil)
+
+	if got := x.RuneOffset(0); got != 0 {
+		t.Errorf("RuneOffset(0): got %d, want 0", got)
+	}
+
+	if got := x.UTF16Offset(5); got != 0 {
+		t.Errorf("UTF16Offset(5): got %d, want 0", got)
+	}
+}
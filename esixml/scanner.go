@@ -0,0 +1,391 @@
+package esixml
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Scanner implements low-level reading of XML syntax like names and attribute values.
+//
+// It is used by [Reader] and can be used to implement readers for other tag dialects.
+type Scanner struct {
+	br     bufio.Reader
+	offset int
+
+	attrBuf [32]byte
+	nameBuf [32]byte
+
+	controlBytes ControlBytePolicy
+	entities     map[string]string
+}
+
+// NewScanner returns a new Scanner set to read from in.
+//
+// This is a shorthand for creating a new [Scanner] and calling [Scanner.Reset] on it.
+func NewScanner(in io.Reader) *Scanner {
+	s := &Scanner{}
+	s.Reset(in)
+	return s
+}
+
+// Reset resets the Scanner to read from in and resets the offset to 0.
+func (s *Scanner) Reset(in io.Reader) {
+	clear(s.nameBuf[:])
+	clear(s.attrBuf[:])
+
+	s.br.Reset(in)
+	s.offset = 0
+}
+
+// SetControlBytePolicy sets how control bytes are handled by the Scanner.
+//
+// Unless policy is [ControlBytesAllow], control bytes inside quoted attribute values are rejected, stripped or
+// replaced based on the policy and control bytes encountered by [Scanner.ConsumeOrError], [Scanner.ReadAttrValue]
+// and [Scanner.ReadName] outside of quoted attribute values result in a [*ControlByteError].
+//
+// The policy is kept when calling [Scanner.Reset].
+func (s *Scanner) SetControlBytePolicy(policy ControlBytePolicy) {
+	s.controlBytes = policy
+}
+
+// SetEntities sets additional named entities that are recognized by [Scanner.ReadAttrValue].
+//
+// The keys of the map must be lower case. The predefined XML entities can not be overridden.
+//
+// The entities are kept when calling [Scanner.Reset].
+func (s *Scanner) SetEntities(entities map[string]string) {
+	s.entities = entities
+}
+
+// Offset returns the number of bytes consumed so far.
+func (s *Scanner) Offset() int {
+	return s.offset
+}
+
+// PeekBytes returns the next n bytes without consuming them.
+//
+// If fewer than n bytes are available, PeekBytes returns the available bytes together with an error.
+//
+// The returned slice is only valid until the next call to a method on the Scanner.
+func (s *Scanner) PeekBytes(n int) ([]byte, error) {
+	return s.br.Peek(n)
+}
+
+// Discard skips the next n bytes, returning the number of bytes discarded.
+func (s *Scanner) Discard(n int) (int, error) {
+	n, err := s.br.Discard(n)
+	s.offset += n
+	return n, err
+}
+
+// Consume reads the next byte if it is equal to b and returns true if the byte was read.
+func (s *Scanner) Consume(b byte) bool {
+	b1, err := s.br.ReadByte()
+	if err != nil {
+		return false
+	}
+
+	if b1 != b {
+		_ = s.br.UnreadByte()
+		return false
+	}
+
+	s.offset++
+	return true
+}
+
+// ConsumeOrError reads the next byte if it is equal to b.
+//
+// If the next byte is not equal to b, an [*UnexpectedCharacterError] is returned and the byte is not consumed. If
+// there is no more data an [*UnexpectedEndOfInput] is returned.
+func (s *Scanner) ConsumeOrError(b byte) error {
+	b1, err := s.br.ReadByte()
+	if err != nil {
+		if !errors.Is(err, io.EOF) {
+			return err
+		}
+
+		return &UnexpectedEndOfInput{
+			At:       s.offset,
+			Expected: b,
+		}
+	}
+
+	if b1 != b {
+		_ = s.br.UnreadByte()
+
+		if s.rejectControlByte(b1) {
+			return &ControlByteError{At: s.offset, Byte: b1}
+		}
+
+		return &UnexpectedCharacterError{
+			At:       s.offset,
+			Got:      b1,
+			Expected: b,
+		}
+	}
+
+	s.offset++
+	return nil
+}
+
+// DiscardSpaces reads and discards all whitespace until the next non-whitespace byte.
+func (s *Scanner) DiscardSpaces() {
+	for {
+		c, err := s.br.ReadByte()
+		if err != nil {
+			return
+		}
+
+		switch c {
+		case ' ', '\r', '\n', '\t':
+			s.offset++
+		default:
+			_ = s.br.UnreadByte()
+			return
+		}
+	}
+}
+
+// Peek returns the next byte without consuming it.
+//
+// If there is no more data, Peek returns false.
+func (s *Scanner) Peek() (byte, bool) {
+	b, _ := s.br.Peek(1)
+	if len(b) == 0 {
+		return 0, false
+	}
+	return b[0], true
+}
+
+// ReadByte reads and returns the next byte.
+//
+// If there is no more data, an [*UnexpectedEndOfInput] is returned.
+func (s *Scanner) ReadByte() (byte, error) {
+	b, err := s.br.ReadByte()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = &UnexpectedEndOfInput{At: s.offset}
+		}
+		return 0, err
+	}
+	s.offset++
+	return b, nil
+}
+
+// UnreadByte unreads the last byte read by [Scanner.ReadByte].
+//
+// Only the most recently read byte can be unread.
+func (s *Scanner) UnreadByte() error {
+	if err := s.br.UnreadByte(); err != nil {
+		return err
+	}
+	s.offset--
+	return nil
+}
+
+// ReadAttrValue reads an attribute value.
+//
+// The value can either be quoted using single or double quotes or be unquoted. Character references, the
+// predefined XML entities and entities set using [Scanner.SetEntities] inside quoted values are unescaped.
+func (s *Scanner) ReadAttrValue() (string, error) {
+	if b, _ := s.Peek(); b == '"' || b == '\'' {
+		return s.readQuotedAttrValue()
+	}
+
+	buf := s.attrBuf[:0]
+
+	for {
+		b, err := s.ReadByte()
+		if err != nil {
+			return "", err
+		}
+
+		// https://www.w3.org/TR/REC-html40/intro/sgmltut.html#h-3.2.2
+		if 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' ||
+			'0' <= b && b <= '9' || b == '_' || b == ':' || b == '-' {
+			buf = append(buf, b)
+			continue
+		}
+
+		_ = s.UnreadByte()
+
+		if s.rejectControlByte(b) {
+			return "", &ControlByteError{At: s.offset, Byte: b}
+		}
+
+		return bytesToString(buf), nil
+	}
+}
+
+var entity = map[string]rune{
+	"lt":   '<',
+	"gt":   '>',
+	"amp":  '&',
+	"apos": '\'',
+	"quot": '"',
+}
+
+func (s *Scanner) readQuotedAttrValue() (string, error) {
+	// This is only called from readAttrValue, where we already checked that there is a quote byte available, so
+	// no need to check the error
+	quote, _ := s.ReadByte()
+
+	buf := s.attrBuf[:0]
+
+	for {
+		b, err := s.ReadByte()
+		if err != nil {
+			return "", err
+		}
+
+		switch b {
+		case quote:
+			return bytesToString(buf), nil
+		case '<':
+			return "", &SyntaxError{At: s.offset - 1, Message: "unescaped < inside quoted string"}
+		case '\r':
+			// \r and \r\n must be converted to \n, so we simply treat \r as \n and consume the next \n if any
+			_ = s.Consume('\n')
+
+			buf = append(buf, '\n')
+		case '&':
+			escBuf := buf[len(buf):]
+
+			if s.Consume('#') {
+				b, err := s.ReadByte()
+				if err != nil {
+					return "", err
+				}
+
+				base := 10
+				if b == 'x' {
+					base = 16
+
+					b, err = s.ReadByte()
+					if err != nil {
+						return "", err
+					}
+				}
+
+				for '0' <= b && b <= '9' ||
+					base == 16 && 'a' <= b && b <= 'f' ||
+					base == 16 && 'A' <= b && b <= 'F' {
+					escBuf = append(escBuf, b)
+
+					b, err = s.ReadByte()
+					if err != nil {
+						return "", err
+					}
+				}
+
+				_ = s.UnreadByte()
+
+				if len(escBuf) == 0 {
+					return "", &UnexpectedCharacterError{At: s.offset, Got: b}
+				}
+
+				if err := s.ConsumeOrError(';'); err != nil {
+					return "", err
+				}
+
+				n, err := strconv.ParseUint(string(escBuf), base, 64)
+				if err != nil || n > unicode.MaxRune {
+					return "", &SyntaxError{At: s.offset - len(escBuf), Message: "invalid number in escape sequence"}
+				}
+
+				buf = append(buf, string(rune(n))...)
+			} else {
+				offset := s.offset
+
+				name, err := s.ReadName(true)
+				if err != nil {
+					return "", err
+				}
+
+				if err := s.ConsumeOrError(';'); err != nil {
+					return "", err
+				}
+
+				if e, ok := entity[name.Local]; ok {
+					buf = append(buf, string(e)...)
+				} else if v, ok := s.entities[name.Local]; ok {
+					buf = append(buf, v...)
+				} else {
+					return "", &UnsupportedEntityError{Offset: offset}
+				}
+			}
+		default:
+			if s.controlBytes == ControlBytesAllow || !isControlByte(b) {
+				buf = append(buf, b)
+				break
+			}
+
+			switch s.controlBytes {
+			case ControlBytesStrip:
+				// Skip the byte
+			case ControlBytesReplace:
+				buf = utf8.AppendRune(buf, utf8.RuneError)
+			default:
+				return "", &ControlByteError{At: s.offset - 1, Byte: b}
+			}
+		}
+	}
+}
+
+// rejectControlByte returns true if b is a control byte that is not allowed based on the control byte policy.
+func (s *Scanner) rejectControlByte(b byte) bool {
+	return s.controlBytes != ControlBytesAllow && isControlByte(b)
+}
+
+// ReadName reads an XML name.
+//
+// If local is true, the name must not contain a namespace.
+func (s *Scanner) ReadName(local bool) (Name, error) {
+	offset := s.offset
+
+	b, err := s.ReadByte()
+	if err != nil {
+		return Name{}, err
+	}
+
+	if s.rejectControlByte(b) {
+		return Name{}, &ControlByteError{At: offset, Byte: b}
+	}
+
+	if b < utf8.RuneSelf && !isNameByte(b) {
+		return Name{}, &InvalidNameError{At: offset}
+	}
+
+	name := append(s.nameBuf[:0], b)
+
+	for {
+		b, ok := s.Peek()
+		if !ok {
+			break
+		}
+
+		if b < utf8.RuneSelf && !isNameByte(b) {
+			break
+		}
+
+		_, _ = s.ReadByte()
+
+		name = append(name, b)
+	}
+
+	if !isName(name) {
+		return Name{}, &InvalidNameError{At: offset}
+	}
+
+	if local && bytes.IndexByte(name, ':') != -1 {
+		return Name{}, &SyntaxError{At: offset, Message: "name without namespace expected"}
+	}
+
+	return bytesToName(name), nil
+}
@@ -0,0 +1,125 @@
+package esixml_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/nussjustin/esi/esixml"
+)
+
+func TestScanner(t *testing.T) {
+	// Reads a SSI style directive like <!--#include virtual="/path" -->
+	s := esixml.NewScanner(strings.NewReader(`<!--#include virtual="/a&amp;b" file=c -->rest`))
+
+	for _, b := range []byte("<!--#") {
+		if err := s.ConsumeOrError(b); err != nil {
+			t.Fatalf("ConsumeOrError(%q): %s", b, err)
+		}
+	}
+
+	name, err := s.ReadName(true)
+	if err != nil {
+		t.Fatalf("ReadName: %s", err)
+	}
+
+	if diff := cmp.Diff(esixml.Name{Local: "include"}, name); diff != "" {
+		t.Errorf("ReadName: mismatch (-want +got):\n%s", diff)
+	}
+
+	var attrs []esixml.Attr
+
+	for {
+		s.DiscardSpaces()
+
+		if b, _ := s.Peek(); b == '-' {
+			break
+		}
+
+		start := s.Offset()
+
+		attrName, err := s.ReadName(false)
+		if err != nil {
+			t.Fatalf("ReadName: %s", err)
+		}
+
+		if err := s.ConsumeOrError('='); err != nil {
+			t.Fatalf("ConsumeOrError('='): %s", err)
+		}
+
+		attrValue, err := s.ReadAttrValue()
+		if err != nil {
+			t.Fatalf("ReadAttrValue: %s", err)
+		}
+
+		attrs = append(attrs, esixml.Attr{
+			Position: esixml.Position{Start: start, End: s.Offset()},
+			Name:     attrName,
+			Value:    attrValue,
+		})
+	}
+
+	wantAttrs := []esixml.Attr{
+		{Position: esixml.Position{Start: 13, End: 31}, Name: esixml.Name{Local: "virtual"}, Value: "/a&b"},
+		{Position: esixml.Position{Start: 32, End: 38}, Name: esixml.Name{Local: "file"}, Value: "c"},
+	}
+
+	if diff := cmp.Diff(wantAttrs, attrs); diff != "" {
+		t.Errorf("attributes mismatch (-want +got):\n%s", diff)
+	}
+
+	if next, _ := s.PeekBytes(3); string(next) != "-->" {
+		t.Fatalf("PeekBytes(3): got %q, want %q", next, "-->")
+	}
+
+	if n, err := s.Discard(3); n != 3 || err != nil {
+		t.Fatalf("Discard(3): got (%d, %v), want (3, nil)", n, err)
+	}
+
+	if got, want := s.Offset(), 42; got != want {
+		t.Errorf("Offset: got %d, want %d", got, want)
+	}
+}
+
+func TestScanner_Errors(t *testing.T) {
+	s := esixml.NewScanner(strings.NewReader(`ab`))
+
+	if s.Consume('b') {
+		t.Error("Consume('b'): got true, want false")
+	}
+
+	wantUnexpected := &esixml.UnexpectedCharacterError{At: 0, Got: 'a', Expected: 'b'}
+
+	if err := s.ConsumeOrError('b'); !cmp.Equal(wantUnexpected, err) {
+		t.Errorf("ConsumeOrError('b'): got %v, want %v", err, wantUnexpected)
+	}
+
+	if b, err := s.ReadByte(); b != 'a' || err != nil {
+		t.Fatalf("ReadByte: got (%q, %v), want ('a', nil)", b, err)
+	}
+
+	if err := s.UnreadByte(); err != nil {
+		t.Fatalf("UnreadByte: %s", err)
+	}
+
+	if got, want := s.Offset(), 0; got != want {
+		t.Errorf("Offset: got %d, want %d", got, want)
+	}
+
+	if !s.Consume('a') || !s.Consume('b') {
+		t.Fatal("Consume: got false, want true")
+	}
+
+	wantEOI := &esixml.UnexpectedEndOfInput{At: 2, Expected: 'c'}
+
+	if err := s.ConsumeOrError('c'); !cmp.Equal(wantEOI, err) {
+		t.Errorf("ConsumeOrError('c'): got %v, want %v", err, wantEOI)
+	}
+
+	s.Reset(strings.NewReader(`1name`))
+
+	if _, err := s.ReadName(false); !cmp.Equal(&esixml.InvalidNameError{At: 0}, err) {
+		t.Errorf("ReadName: got %v, want %v", err, &esixml.InvalidNameError{At: 0})
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nussjustin/esi/esihttp"
+	"github.com/nussjustin/esi/esiproc"
+)
+
+// maxCachedFragments is the maximum number of fragments kept by a [fragmentCache].
+const maxCachedFragments = 1024
+
+// fragmentCache is an [esiproc.Client] that caches fragments in memory, based on the freshness of the responses as
+// returned by [esihttp.ResponseFreshness].
+//
+// Fragments are cached by their absolute URL. Since the cache is shared by all clients, fragments that depend on
+// cookies or other request headers must be marked as private or uncacheable by the origin.
+type fragmentCache struct {
+	next esiproc.Client
+	now  func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	data    []byte
+	expires time.Time
+}
+
+var _ esiproc.Client = (*fragmentCache)(nil)
+
+// Do implements the [esiproc.Client] interface.
+func (c *fragmentCache) Do(ctx context.Context, urlStr string, extra map[string]string) ([]byte, error) {
+	key := urlStr
+
+	if r := esihttp.OriginalRequest(ctx); r != nil {
+		if u, err := r.URL.Parse(urlStr); err == nil {
+			key = u.String()
+		}
+	}
+
+	if data, ok := c.get(key); ok {
+		esiproc.ReportCacheHit(ctx)
+		return data, nil
+	}
+
+	var rec esihttp.FreshnessRecorder
+
+	data, err := c.next.Do(esihttp.WithFreshnessRecorder(ctx, &rec), urlStr, extra)
+	if err != nil {
+		return nil, err
+	}
+
+	if ttl, ok := rec.TTL(); ok && ttl > 0 {
+		c.set(key, data, ttl)
+	}
+
+	return data, nil
+}
+
+func (c *fragmentCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	if !c.now().Before(e.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+
+	return e.data, true
+}
+
+func (c *fragmentCache) set(key string, data []byte, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+
+	if len(c.entries) >= maxCachedFragments {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+
+	if len(c.entries) >= maxCachedFragments {
+		return
+	}
+
+	if c.entries == nil {
+		c.entries = make(map[string]cacheEntry)
+	}
+
+	c.entries[key] = cacheEntry{data: data, expires: now.Add(ttl)}
+}
@@ -0,0 +1,208 @@
+// Command edge-server is a minimal ESI-processing reverse proxy, demonstrating how the packages of this module fit
+// together.
+//
+// The server forwards all requests to an origin server and processes HTML responses using an [esiproc.Processor]
+// before sending them to the client. Includes are fetched via HTTP from the origin, with fragments being cached in
+// memory based on their Surrogate-Control, Cache-Control and Expires headers. Basic metrics are served as JSON under
+// /_metrics.
+//
+// Usage:
+//
+//	edge-server -listen localhost:8080 -origin http://localhost:8081
+//
+// The server is meant as an example and starting point and is not tuned for production use.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/nussjustin/esi/esiexpr"
+	"github.com/nussjustin/esi/esihttp"
+	"github.com/nussjustin/esi/esiproc"
+)
+
+// surrogateName is the device token used in Surrogate-Capability and Surrogate-Control headers.
+const surrogateName = "edge-server"
+
+// config contains the configuration of a [server].
+type config struct {
+	// Origin is the URL of the origin server.
+	Origin *url.URL
+
+	// Concurrency is the maximum number of concurrent fragment requests per page.
+	Concurrency int
+
+	// DebugSecret enables debug comments for requests with an X-Esi-Debug header containing the secret, if not empty.
+	DebugSecret string
+
+	// FragmentTimeout is the maximum time for fetching a single fragment.
+	FragmentTimeout time.Duration
+
+	// PageTimeout is the maximum time for processing a page.
+	PageTimeout time.Duration
+
+	// Transport is used for requests to the origin. If nil, [http.DefaultTransport] is used.
+	Transport http.RoundTripper
+}
+
+// server is an [http.Handler] that proxies requests to an origin and processes the responses.
+type server struct {
+	config config
+
+	proxy   *httputil.ReverseProxy
+	proc    *esiproc.Processor
+	cache   *fragmentCache
+	metrics *metrics
+
+	handler *esihttp.Handler
+}
+
+func newServer(c config) *server {
+	transport := c.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	s := &server{
+		config: c,
+		proxy: &httputil.ReverseProxy{
+			Rewrite: func(r *httputil.ProxyRequest) {
+				r.SetURL(c.Origin)
+
+				// Compressed responses can not be processed, so only request uncompressed responses.
+				r.Out.Header.Del("Accept-Encoding")
+			},
+			Transport: transport,
+		},
+		metrics: newMetrics(),
+	}
+
+	s.cache = &fragmentCache{
+		next: &esihttp.Client{HTTPClient: &http.Client{Transport: transport}},
+		now:  time.Now,
+	}
+
+	env := esihttp.NewEnv(&esihttp.EnvConfig{Escaping: esiexpr.EscapingURL})
+
+	// The content of esi:vars elements is HTML, so values must be escaped differently than in URLs.
+	varsEnv := *env
+	varsEnv.Escaping = esiexpr.EscapingHTML
+
+	s.proc = esiproc.New(
+		esiproc.WithClient(esiproc.ClientWithTimeout(s.cache, c.FragmentTimeout)),
+		esiproc.WithClientConcurrency(max(c.Concurrency, 1)),
+		esiproc.WithEvalFunc(env.Eval),
+		esiproc.WithInterpolateFunc(env.Interpolate),
+		esiproc.WithVarsInterpolateFunc(varsEnv.Interpolate),
+		esiproc.WithInjectionGuard(),
+		esiproc.WithMinIncludeBudget(10*time.Millisecond),
+	)
+
+	if c.PageTimeout > 0 {
+		s.proc = s.proc.With(esiproc.WithContextFunc(func(ctx context.Context) (context.Context, func()) {
+			return context.WithTimeout(ctx, c.PageTimeout)
+		}))
+	}
+
+	if c.DebugSecret != "" {
+		s.proc = s.proc.With(esiproc.WithDebugComments(esihttp.DebugEnabled(esihttp.DefaultDebugHeader, c.DebugSecret)))
+	}
+
+	s.handler = &esihttp.Handler{
+		Handler:       s.proxy,
+		Processor:     s.proc,
+		SurrogateName: surrogateName,
+		ErrorHandler: func(r *http.Request, err error) {
+			log.Printf("failed to process %s: %s", r.URL, err)
+		},
+		ResultHandler: func(_ *http.Request, res *esiproc.Result, err error) {
+			s.metrics.observe(res, err)
+		},
+	}
+
+	return s
+}
+
+// ServeHTTP implements the [http.Handler] interface.
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.metrics.requests.Add(1)
+
+	// Relative URLs of includes are resolved against the URL of the request, so it must point to the origin.
+	r = r.Clone(r.Context())
+	r.URL = s.config.Origin.ResolveReference(&url.URL{Path: r.URL.Path, RawQuery: r.URL.RawQuery})
+
+	s.handler.ServeHTTP(w, r)
+}
+
+func main() {
+	listen := flag.String("listen", "localhost:8080", "address to listen on")
+	origin := flag.String("origin", "http://localhost:8081", "URL of the origin server")
+	concurrency := flag.Int("concurrency", 8, "maximum number of concurrent fragment requests per page")
+	debugSecret := flag.String("debug-secret", "", "secret for enabling debug comments via the X-Esi-Debug header")
+	fragmentTimeout := flag.Duration("fragment-timeout", time.Second, "maximum time for fetching a single fragment")
+	pageTimeout := flag.Duration("page-timeout", 5*time.Second, "maximum time for processing a page")
+	flag.Parse()
+
+	originURL, err := url.Parse(*origin)
+	if err != nil {
+		log.Fatalf("invalid origin URL: %s", err)
+	}
+
+	s := newServer(config{
+		Origin:          originURL,
+		Concurrency:     *concurrency,
+		DebugSecret:     *debugSecret,
+		FragmentTimeout: *fragmentTimeout,
+		PageTimeout:     *pageTimeout,
+	})
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /_metrics", s.metrics)
+	mux.Handle("/", s)
+
+	httpServer := &http.Server{
+		Addr:              *listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
+			log.Printf("failed to shut down server: %s", err)
+		}
+
+		if err := s.proc.Close(shutdownCtx); err != nil {
+			log.Printf("failed to close processor: %s", err)
+		}
+	}()
+
+	log.Printf("listening on %s, proxying to %s", *listen, originURL)
+
+	if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+
+	<-done
+}
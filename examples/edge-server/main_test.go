@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestOrigin(t *testing.T, fragmentRequests *atomic.Int64) *url.URL {
+	t.Helper()
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /page", func(w http.ResponseWriter, r *http.Request) {
+		if got, want := r.Header.Get("Surrogate-Capability"), `edge-server="ESI/1.0"`; got != want {
+			t.Errorf("got Surrogate-Capability %q, want %q", got, want)
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Surrogate-Control", `content="ESI/1.0"`)
+		_, _ = io.WriteString(w, `<p><esi:include src="/fragment"/></p>`+
+			`<esi:choose>`+
+			`<esi:when test="$(HTTP_COOKIE{group})=='admin'">admin</esi:when>`+
+			`<esi:otherwise>user</esi:otherwise>`+
+			`</esi:choose>`)
+	})
+
+	mux.HandleFunc("GET /fragment", func(w http.ResponseWriter, _ *http.Request) {
+		fragmentRequests.Add(1)
+
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = io.WriteString(w, "fragment")
+	})
+
+	mux.HandleFunc("GET /script.js", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/javascript")
+		_, _ = io.WriteString(w, `const s = '<esi:include src="/fragment"/>';`)
+	})
+
+	origin := httptest.NewServer(mux)
+	t.Cleanup(origin.Close)
+
+	u, err := url.Parse(origin.URL)
+	if err != nil {
+		t.Fatalf("failed to parse origin URL: %s", err)
+	}
+
+	return u
+}
+
+func TestServer(t *testing.T) {
+	var fragmentRequests atomic.Int64
+
+	s := newServer(config{
+		Origin:          newTestOrigin(t, &fragmentRequests),
+		Concurrency:     2,
+		FragmentTimeout: time.Second,
+		PageTimeout:     5 * time.Second,
+	})
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /_metrics", s.metrics)
+	mux.Handle("/", s)
+
+	edge := httptest.NewServer(mux)
+	t.Cleanup(edge.Close)
+
+	get := func(path string, cookie *http.Cookie) string {
+		t.Helper()
+
+		req, err := http.NewRequest(http.MethodGet, edge.URL+path, nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %s", err)
+		}
+
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+
+		resp, err := edge.Client().Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %s", err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+
+		if got := resp.Header.Get("Surrogate-Control"); got != "" {
+			t.Errorf("got Surrogate-Control %q, want none", got)
+		}
+
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("failed to read body: %s", err)
+		}
+
+		return string(body)
+	}
+
+	if got, want := get("/page", nil), `<p>fragment</p>user`; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if got, want := get("/page", &http.Cookie{Name: "group", Value: "admin"}), `<p>fragment</p>admin`; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if got, want := get("/script.js", nil), `const s = '<esi:include src="/fragment"/>';`; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if got, want := fragmentRequests.Load(), int64(1); got != want {
+		t.Errorf("got %d fragment requests, want %d", got, want)
+	}
+
+	var got map[string]int
+
+	if err := json.Unmarshal([]byte(get("/_metrics", nil)), &got); err != nil {
+		t.Fatalf("failed to decode metrics: %s", err)
+	}
+
+	want := map[string]int{
+		"requests":   3,
+		"processed":  2,
+		"failed":     0,
+		"fetched":    2,
+		"includes":   2,
+		"cache_hits": 1,
+		"degraded":   0,
+	}
+
+	for name, want := range want {
+		if got[name] != want {
+			t.Errorf("got %d for metric %s, want %d", got[name], name, want)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+
+	"github.com/nussjustin/esi/esiproc"
+)
+
+// metrics contains counters about processed requests.
+//
+// The counters are served as JSON by [metrics.ServeHTTP].
+type metrics struct {
+	vars expvar.Map
+
+	requests  expvar.Int
+	processed expvar.Int
+	failed    expvar.Int
+	fetched   expvar.Int
+	includes  expvar.Int
+	cacheHits expvar.Int
+	degraded  expvar.Int
+}
+
+func newMetrics() *metrics {
+	m := &metrics{}
+	m.vars.Set("requests", &m.requests)
+	m.vars.Set("processed", &m.processed)
+	m.vars.Set("failed", &m.failed)
+	m.vars.Set("fetched", &m.fetched)
+	m.vars.Set("includes", &m.includes)
+	m.vars.Set("cache_hits", &m.cacheHits)
+	m.vars.Set("degraded", &m.degraded)
+	return m
+}
+
+// ServeHTTP implements the [http.Handler] interface.
+func (m *metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte(m.vars.String()))
+}
+
+// observe updates the counters based on the result of processing a page.
+func (m *metrics) observe(res *esiproc.Result, err error) {
+	m.processed.Add(1)
+
+	if err != nil {
+		m.failed.Add(1)
+	}
+
+	m.fetched.Add(int64(res.Fetched))
+	m.includes.Add(int64(len(res.Includes)))
+	m.cacheHits.Add(int64(res.CacheHits()))
+
+	for range res.Degraded() {
+		m.degraded.Add(1)
+	}
+}
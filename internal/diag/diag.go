@@ -0,0 +1,73 @@
+// Package diag implements the JSON encoding shared by the error types of all packages.
+package diag
+
+import "encoding/json"
+
+// Diagnostic is the JSON representation of an error.
+//
+// The field names are part of the public API and must not be changed.
+type Diagnostic struct {
+	Code      string          `json:"code"`
+	Message   string          `json:"message"`
+	Offset    *int            `json:"offset,omitempty"`
+	Start     *int            `json:"start,omitempty"`
+	End       *int            `json:"end,omitempty"`
+	Element   string          `json:"element,omitempty"`
+	Attribute string          `json:"attribute,omitempty"`
+	Expected  []string        `json:"expected,omitempty"`
+	Got       string          `json:"got,omitempty"`
+	Details   map[string]any  `json:"details,omitempty"`
+	Cause     json.RawMessage `json:"cause,omitempty"`
+}
+
+// Coder is implemented by all error types in this module.
+type Coder interface {
+	error
+
+	Code() string
+}
+
+// Cause returns the JSON encoding of err for use as [Diagnostic.Cause].
+//
+// If err implements both [Coder] and [json.Marshaler], the result of MarshalJSON is used. Otherwise, the result only
+// contains the error message. If err is nil, Cause returns nil.
+func Cause(err error) json.RawMessage {
+	if err == nil {
+		return nil
+	}
+
+	if c, ok := err.(coderMarshaler); ok {
+		if b, err := c.MarshalJSON(); err == nil {
+			return b
+		}
+	}
+
+	b, _ := json.Marshal(struct {
+		Message string `json:"message"`
+	}{err.Error()})
+
+	return b
+}
+
+type coderMarshaler interface {
+	Coder
+	json.Marshaler
+}
+
+// Int returns a pointer to v.
+func Int(v int) *int {
+	return &v
+}
+
+// Marshal sets the code and message of d based on err and returns the JSON encoding of d.
+func Marshal(err Coder, d Diagnostic) ([]byte, error) {
+	d.Code = err.Code()
+	d.Message = err.Error()
+
+	return json.Marshal(d)
+}
+
+// Position returns pointers to start and end, for use with [Diagnostic.Start] and [Diagnostic.End].
+func Position(start, end int) (*int, *int) {
+	return &start, &end
+}
@@ -0,0 +1,28 @@
+// Package markup implements the detection of ESI markup shared by the packages that scan data without parsing it.
+package markup
+
+// IsStart reports whether b starts with an ESI start tag ("<esi:"), an ESI end tag ("</esi:") or, if comments is true,
+// an ESI comment ("<!--esi").
+//
+// The "esi" prefix is matched case-insensitively.
+func IsStart[T []byte | string](b T, comments bool) bool {
+	switch {
+	case len(b) < 5 || b[0] != '<':
+		return false
+	case isESI(b[1:]) && b[4] == ':': // <esi:
+		return true
+	case len(b) >= 6 && b[1] == '/' && isESI(b[2:]) && b[5] == ':': // </esi:
+		return true
+	case comments && len(b) >= 7 && b[1] == '!' && b[2] == '-' && b[3] == '-' && isESI(b[4:]): // <!--esi
+		return true
+	default:
+		return false
+	}
+}
+
+func isESI[T []byte | string](b T) bool {
+	return len(b) >= 3 &&
+		(b[0] == 'e' || b[0] == 'E') &&
+		(b[1] == 's' || b[1] == 'S') &&
+		(b[2] == 'i' || b[2] == 'I')
+}
@@ -1,12 +1,16 @@
 package esi
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
+	"os"
 	"slices"
+	"strings"
 
 	"github.com/nussjustin/esi/esixml"
+	"github.com/nussjustin/esi/internal/diag"
 )
 
 // DuplicateElementError is returned when multiple elements with the same name are found where only one is allowed.
@@ -17,6 +21,11 @@ type DuplicateElementError struct {
 	Name esixml.Name
 }
 
+// Code returns a machine-readable code identifying the type of the error.
+func (*DuplicateElementError) Code() string {
+	return "esi.duplicate_element"
+}
+
 // Error returns a human-readable error message.
 func (d *DuplicateElementError) Error() string {
 	return fmt.Sprintf(`duplicate element %s at position %s`, d.Name, d.Position)
@@ -28,6 +37,12 @@ func (d *DuplicateElementError) Is(err error) bool {
 	return errors.As(err, &o) && *o == *d
 }
 
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (d *DuplicateElementError) MarshalJSON() ([]byte, error) {
+	start, end := diag.Position(d.Position.Start, d.Position.End)
+	return diag.Marshal(d, diag.Diagnostic{Start: start, End: end, Element: d.Name.String()})
+}
+
 // EmptyElementError is returned when an element that requires content is specified as self-closed.
 type EmptyElementError struct {
 	Position Position
@@ -36,6 +51,11 @@ type EmptyElementError struct {
 	Name esixml.Name
 }
 
+// Code returns a machine-readable code identifying the type of the error.
+func (*EmptyElementError) Code() string {
+	return "esi.empty_element"
+}
+
 // Error returns a human-readable error message.
 func (e *EmptyElementError) Error() string {
 	return fmt.Sprintf(
@@ -51,6 +71,12 @@ func (e *EmptyElementError) Is(err error) bool {
 	return errors.As(err, &o) && *o == *e
 }
 
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (e *EmptyElementError) MarshalJSON() ([]byte, error) {
+	start, end := diag.Position(e.Position.Start, e.Position.End)
+	return diag.Marshal(e, diag.Diagnostic{Start: start, End: end, Element: e.Name.String()})
+}
+
 // InvalidAttributeValueError is returned when an attribute value is invalid for the specific attribute.
 type InvalidAttributeValueError struct {
 	Position Position
@@ -68,6 +94,11 @@ type InvalidAttributeValueError struct {
 	Allowed []string
 }
 
+// Code returns a machine-readable code identifying the type of the error.
+func (*InvalidAttributeValueError) Code() string {
+	return "esi.invalid_attribute_value"
+}
+
 // Error returns a human-readable error message.
 func (i *InvalidAttributeValueError) Error() string {
 	return fmt.Sprintf(
@@ -85,6 +116,19 @@ func (i *InvalidAttributeValueError) Is(err error) bool {
 	return errors.As(err, &o) && o.Element == i.Element && o.Name == i.Name && o.Value == i.Value && slices.Equal(o.Allowed, i.Allowed) //nolint:lll
 }
 
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (i *InvalidAttributeValueError) MarshalJSON() ([]byte, error) {
+	start, end := diag.Position(i.Position.Start, i.Position.End)
+	return diag.Marshal(i, diag.Diagnostic{
+		Start:     start,
+		End:       end,
+		Element:   i.Element.String(),
+		Attribute: i.Name.String(),
+		Expected:  i.Allowed,
+		Got:       i.Value,
+	})
+}
+
 // InvalidElementError is returned when an invalid <esi:*> element is found.
 type InvalidElementError struct {
 	Position Position
@@ -93,6 +137,11 @@ type InvalidElementError struct {
 	Name esixml.Name
 }
 
+// Code returns a machine-readable code identifying the type of the error.
+func (*InvalidElementError) Code() string {
+	return "esi.invalid_element"
+}
+
 // Error returns a human-readable error message.
 func (i *InvalidElementError) Error() string {
 	return fmt.Sprintf(`invalid element %s at position %s`, i.Name, i.Position)
@@ -104,6 +153,12 @@ func (i *InvalidElementError) Is(err error) bool {
 	return errors.As(err, &o) && *o == *i
 }
 
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (i *InvalidElementError) MarshalJSON() ([]byte, error) {
+	start, end := diag.Position(i.Position.Start, i.Position.End)
+	return diag.Marshal(i, diag.Diagnostic{Start: start, End: end, Element: i.Name.String()})
+}
+
 // MissingAttributeError is returned when a required attribute is missing on an element.
 type MissingAttributeError struct {
 	Position Position
@@ -115,6 +170,11 @@ type MissingAttributeError struct {
 	Attribute esixml.Name
 }
 
+// Code returns a machine-readable code identifying the type of the error.
+func (*MissingAttributeError) Code() string {
+	return "esi.missing_attribute"
+}
+
 // Error returns a human-readable error message.
 func (m *MissingAttributeError) Error() string {
 	return fmt.Sprintf(`missing attribute %s in element %s at position %s`, m.Attribute, m.Element, m.Position)
@@ -126,17 +186,50 @@ func (m *MissingAttributeError) Is(err error) bool {
 	return errors.As(err, &o) && *o == *m
 }
 
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (m *MissingAttributeError) MarshalJSON() ([]byte, error) {
+	start, end := diag.Position(m.Position.Start, m.Position.End)
+	return diag.Marshal(m, diag.Diagnostic{
+		Start:     start,
+		End:       end,
+		Element:   m.Element.String(),
+		Attribute: m.Attribute.String(),
+	})
+}
+
 // MissingElementError is returned when a required child element is not found inside another element.
 type MissingElementError struct {
+	// Position is the position of the end tag of the parent element, where the missing element was detected.
 	Position Position
 
+	// OpeningPosition is the position of the start tag of the parent element.
+	OpeningPosition Position
+
 	// Name is the element name.
 	Name esixml.Name
+
+	// Parent is the name of the element that requires the missing element.
+	Parent esixml.Name
+}
+
+// Code returns a machine-readable code identifying the type of the error.
+func (*MissingElementError) Code() string {
+	return "esi.missing_element"
 }
 
 // Error returns a human-readable error message.
 func (m *MissingElementError) Error() string {
-	return fmt.Sprintf(`missing element %s at position %s`, m.Name, m.Position)
+	if m.Parent == (esixml.Name{}) {
+		return fmt.Sprintf(`missing element %s at position %s`, m.Name, m.Position)
+	}
+
+	return fmt.Sprintf(
+		`missing element %s in element %s at position %s (opened at position %s)`,
+		m.Name,
+		m.Parent,
+		m.Position,
+		m.OpeningPosition,
+	)
 }
 
 // Is checks if the given error matches the receiver.
@@ -145,6 +238,21 @@ func (m *MissingElementError) Is(err error) bool {
 	return errors.As(err, &o) && *o == *m
 }
 
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (m *MissingElementError) MarshalJSON() ([]byte, error) {
+	start, end := diag.Position(m.Position.Start, m.Position.End)
+
+	d := diag.Diagnostic{Start: start, End: end, Element: m.Name.String()}
+	if m.Parent != (esixml.Name{}) {
+		d.Details = map[string]any{
+			"parent":        m.Parent.String(),
+			"opening_start": m.OpeningPosition.Start,
+			"opening_end":   m.OpeningPosition.End,
+		}
+	}
+	return diag.Marshal(m, d)
+}
+
 // UnclosedElementError is returned when an empty element is not closed directly.
 type UnclosedElementError struct {
 	Position Position
@@ -153,6 +261,11 @@ type UnclosedElementError struct {
 	Name esixml.Name
 }
 
+// Code returns a machine-readable code identifying the type of the error.
+func (*UnclosedElementError) Code() string {
+	return "esi.unclosed_element"
+}
+
 // Error returns a human-readable error message.
 func (u *UnclosedElementError) Error() string {
 	return fmt.Sprintf(`unclosed element %s at position %s`, u.Name, u.Position)
@@ -164,6 +277,52 @@ func (u *UnclosedElementError) Is(err error) bool {
 	return errors.As(err, &o) && *o == *u
 }
 
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (u *UnclosedElementError) MarshalJSON() ([]byte, error) {
+	start, end := diag.Position(u.Position.Start, u.Position.End)
+	return diag.Marshal(u, diag.Diagnostic{Start: start, End: end, Element: u.Name.String()})
+}
+
+// UnexpectedAttributeError is returned when an element has an attribute that is not allowed.
+//
+// See [WithRejectNamespacedAttrs].
+type UnexpectedAttributeError struct {
+	Position Position
+
+	// Element is the element name.
+	Element esixml.Name
+
+	// Attribute is the name of the attribute.
+	Attribute esixml.Name
+}
+
+// Code returns a machine-readable code identifying the type of the error.
+func (*UnexpectedAttributeError) Code() string {
+	return "esi.unexpected_attribute"
+}
+
+// Error returns a human-readable error message.
+func (u *UnexpectedAttributeError) Error() string {
+	return fmt.Sprintf(`unexpected attribute %s in element %s at position %s`, u.Attribute, u.Element, u.Position)
+}
+
+// Is checks if the given error matches the receiver.
+func (u *UnexpectedAttributeError) Is(err error) bool {
+	var o *UnexpectedAttributeError
+	return errors.As(err, &o) && *o == *u
+}
+
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (u *UnexpectedAttributeError) MarshalJSON() ([]byte, error) {
+	start, end := diag.Position(u.Position.Start, u.Position.End)
+	return diag.Marshal(u, diag.Diagnostic{
+		Start:     start,
+		End:       end,
+		Element:   u.Element.String(),
+		Attribute: u.Attribute.String(),
+	})
+}
+
 // UnexpectedElementError is returned when a specific element was expected, but a different one was encountered.
 type UnexpectedElementError struct {
 	Position Position
@@ -172,6 +331,11 @@ type UnexpectedElementError struct {
 	Name esixml.Name
 }
 
+// Code returns a machine-readable code identifying the type of the error.
+func (*UnexpectedElementError) Code() string {
+	return "esi.unexpected_element"
+}
+
 // Error returns a human-readable error message.
 func (u *UnexpectedElementError) Error() string {
 	return fmt.Sprintf(`unexpected element %s at position %s`, u.Name, u.Position)
@@ -183,6 +347,12 @@ func (u *UnexpectedElementError) Is(err error) bool {
 	return errors.As(err, &o) && *o == *u
 }
 
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (u *UnexpectedElementError) MarshalJSON() ([]byte, error) {
+	start, end := diag.Position(u.Position.Start, u.Position.End)
+	return diag.Marshal(u, diag.Diagnostic{Start: start, End: end, Element: u.Name.String()})
+}
+
 // UnexpectedEndElementError is returned when an end-element is found that does not match the currently open element.
 type UnexpectedEndElementError struct {
 	Position Position
@@ -194,6 +364,11 @@ type UnexpectedEndElementError struct {
 	Expected esixml.Name
 }
 
+// Code returns a machine-readable code identifying the type of the error.
+func (*UnexpectedEndElementError) Code() string {
+	return "esi.unexpected_end_element"
+}
+
 // Error returns a human-readable error message.
 func (u *UnexpectedEndElementError) Error() string {
 	if u.Expected.Local == "" {
@@ -209,6 +384,17 @@ func (u *UnexpectedEndElementError) Is(err error) bool {
 	return errors.As(err, &o) && *o == *u
 }
 
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (u *UnexpectedEndElementError) MarshalJSON() ([]byte, error) {
+	start, end := diag.Position(u.Position.Start, u.Position.End)
+
+	d := diag.Diagnostic{Start: start, End: end, Element: u.Name.String()}
+	if u.Expected.Local != "" {
+		d.Expected = []string{u.Expected.String()}
+	}
+	return diag.Marshal(u, d)
+}
+
 // UnexpectedTokenError is returned when a specific token type was expected, but a different type was found.
 type UnexpectedTokenError struct {
 	Position Position
@@ -220,6 +406,11 @@ type UnexpectedTokenError struct {
 	Expected []esixml.TokenType
 }
 
+// Code returns a machine-readable code identifying the type of the error.
+func (*UnexpectedTokenError) Code() string {
+	return "esi.unexpected_token"
+}
+
 // Error returns a human-readable error message.
 func (u *UnexpectedTokenError) Error() string {
 	return fmt.Sprintf(`unexpected token %s at position %s`, u.Type, u.Position)
@@ -231,14 +422,52 @@ func (u *UnexpectedTokenError) Is(err error) bool {
 	return errors.As(err, &o) && o.Type == u.Type && slices.Equal(o.Expected, u.Expected)
 }
 
+// MarshalJSON implements the [encoding/json.Marshaler] interface.
+func (u *UnexpectedTokenError) MarshalJSON() ([]byte, error) {
+	start, end := diag.Position(u.Position.Start, u.Position.End)
+
+	d := diag.Diagnostic{Start: start, End: end, Got: u.Type.String()}
+	for _, t := range u.Expected {
+		d.Expected = append(d.Expected, t.String())
+	}
+	return diag.Marshal(u, d)
+}
+
 // Node is the interface implemented by all ESI elements as well as [RawData].
 type Node interface {
 	// Pos returns the start and end position of the Node.
+	//
+	// Positions are absolute byte offsets from the start of the parsed input, with the start being inclusive and the
+	// end being exclusive. For elements the range includes both the start and end tag, or the whole tag for self-closed
+	// elements. See also [NodeBytes].
 	Pos() (start, end int)
 
 	node()
 }
 
+// NodeBytes returns the part of doc that corresponds to the position of node.
+//
+// The doc must be the complete input from which node was parsed. When using [esixml.WithStartOffset], doc must be the
+// data that the offsets refer to.
+//
+// For elements, the result is the exact original markup including the start and end tags. The returned slice shares
+// its memory with doc and has its capacity limited to its length, so that no data needs to be copied or re-serialized,
+// for example when passing unsupported elements through as is or when reporting errors.
+//
+// If node is nil or its position is not inside doc, nil is returned.
+func NodeBytes(doc []byte, node Node) []byte {
+	if node == nil {
+		return nil
+	}
+
+	start, end := node.Pos()
+	if start < 0 || start > end || end > len(doc) {
+		return nil
+	}
+
+	return doc[start:end:end]
+}
+
 // Element is the interface implemented by all Node types that are based on ESI elements.
 type Element interface {
 	Node
@@ -269,7 +498,7 @@ func (*AttemptElement) node() {}
 
 // Name returns the element name.
 func (e *AttemptElement) Name() esixml.Name {
-	return esixml.Name{Space: "esi", Local: "attempt"}
+	return esixml.Name{Space: Namespace, Local: NameAttempt}
 }
 
 // Pos returns the start and end position of the element.
@@ -299,7 +528,7 @@ func (*ChooseElement) node() {}
 
 // Name returns the element name.
 func (e *ChooseElement) Name() esixml.Name {
-	return esixml.Name{Space: "esi", Local: "choose"}
+	return esixml.Name{Space: Namespace, Local: NameChoose}
 }
 
 // Pos returns the start and end position of the element.
@@ -345,7 +574,7 @@ func (*CommentElement) node() {}
 
 // Name returns the element name.
 func (e *CommentElement) Name() esixml.Name {
-	return esixml.Name{Space: "esi", Local: "comment"}
+	return esixml.Name{Space: Namespace, Local: NameComment}
 }
 
 // Pos returns the start and end position of the element.
@@ -353,6 +582,25 @@ func (e *CommentElement) Pos() (start, end int) {
 	return e.Position.Pos()
 }
 
+// Doctype represents a document type declaration like <!DOCTYPE html>.
+//
+// Doctype nodes are only returned when the [esixml.WithDeclarationTokens] reader option is used.
+type Doctype struct {
+	Position Position
+
+	// Bytes contains the complete declaration.
+	Bytes []byte
+}
+
+var _ Node = (*Doctype)(nil)
+
+func (*Doctype) node() {}
+
+// Pos returns the start and end position of the declaration.
+func (d *Doctype) Pos() (start, end int) {
+	return d.Position.Pos()
+}
+
 // ExceptElement represents a <esi:except> element.
 //
 // See https://www.w3.org/TR/esi-lang/, 3.3 try | attempt | except.
@@ -372,7 +620,7 @@ func (*ExceptElement) node() {}
 
 // Name returns the element name.
 func (e *ExceptElement) Name() esixml.Name {
-	return esixml.Name{Space: "esi", Local: "except"}
+	return esixml.Name{Space: Namespace, Local: NameExcept}
 }
 
 // Pos returns the start and end position of the element.
@@ -392,6 +640,14 @@ type IncludeElement struct {
 	// Alt contains the alternative source that should be included, if the normal source is unavailable.
 	Alt string
 
+	// FragmentName contains the value of the non-standard name attribute, if any.
+	//
+	// Since the attribute is non-standard, it is also contained in Attr.
+	//
+	// Named includes can be referenced later in the same document. See
+	// [github.com/nussjustin/esi/esiproc.Processor] for details.
+	FragmentName string
+
 	// OnError contains the specified behaviour for errors.
 	OnError ErrorBehaviour
 
@@ -405,7 +661,7 @@ func (*IncludeElement) node() {}
 
 // Name returns the element name.
 func (e *IncludeElement) Name() esixml.Name {
-	return esixml.Name{Space: "esi", Local: "include"}
+	return esixml.Name{Space: Namespace, Local: NameInclude}
 }
 
 // Pos returns the start and end position of the element.
@@ -438,7 +694,7 @@ func (*InlineElement) node() {}
 
 // Name returns the element name.
 func (e *InlineElement) Name() esixml.Name {
-	return esixml.Name{Space: "esi", Local: "inline"}
+	return esixml.Name{Space: Namespace, Local: NameInline}
 }
 
 // Pos returns the start and end position of the element.
@@ -465,7 +721,7 @@ func (*OtherwiseElement) node() {}
 
 // Name returns the element name.
 func (e *OtherwiseElement) Name() esixml.Name {
-	return esixml.Name{Space: "esi", Local: "otherwise"}
+	return esixml.Name{Space: Namespace, Local: NameOtherwise}
 }
 
 // Pos returns the start and end position of the element.
@@ -480,7 +736,14 @@ type RawData struct {
 	Position Position
 
 	// Bytes contains the unprocessed data.
+	//
+	// Bytes is nil if the data was spilled. See [WithSpill].
 	Bytes []byte
+
+	// Spill references the data if it was written to a temporary file, instead of being kept in memory.
+	//
+	// See [WithSpill].
+	Spill *Spill
 }
 
 func (*RawData) node() {}
@@ -509,7 +772,7 @@ func (*RemoveElement) node() {}
 
 // Name returns the element name.
 func (e *RemoveElement) Name() esixml.Name {
-	return esixml.Name{Space: "esi", Local: "remove"}
+	return esixml.Name{Space: Namespace, Local: NameRemove}
 }
 
 // Pos returns the start and end position of the element.
@@ -539,7 +802,7 @@ func (*TryElement) node() {}
 
 // Name returns the element name.
 func (e *TryElement) Name() esixml.Name {
-	return esixml.Name{Space: "esi", Local: "try"}
+	return esixml.Name{Space: Namespace, Local: NameTry}
 }
 
 // Pos returns the start and end position of the element.
@@ -566,7 +829,7 @@ func (*VarsElement) node() {}
 
 // Name returns the element name.
 func (e *VarsElement) Name() esixml.Name {
-	return esixml.Name{Space: "esi", Local: "vars"}
+	return esixml.Name{Space: Namespace, Local: NameVars}
 }
 
 // Pos returns the start and end position of the element.
@@ -596,7 +859,7 @@ func (*WhenElement) node() {}
 
 // Name returns the element name.
 func (e *WhenElement) Name() esixml.Name {
-	return esixml.Name{Space: "esi", Local: "when"}
+	return esixml.Name{Space: Namespace, Local: NameWhen}
 }
 
 // Pos returns the start and end position of the element.
@@ -623,6 +886,118 @@ func (e *XMLComment) Pos() (start, end int) {
 	return e.Position.Pos()
 }
 
+// XMLDeclaration represents an XML declaration like <?xml version="1.0" encoding="UTF-8"?>.
+//
+// XMLDeclaration nodes are only returned when the [esixml.WithDeclarationTokens] reader option is used.
+type XMLDeclaration struct {
+	Position Position
+
+	// Bytes contains the complete declaration.
+	Bytes []byte
+}
+
+var _ Node = (*XMLDeclaration)(nil)
+
+func (*XMLDeclaration) node() {}
+
+// Encoding returns the value of the encoding pseudo-attribute of the declaration or an empty string if the
+// declaration does not specify an encoding.
+func (d *XMLDeclaration) Encoding() string {
+	b := d.Bytes
+
+	for {
+		i := bytes.Index(b, []byte("encoding"))
+		if i == -1 {
+			return ""
+		}
+
+		b = bytes.TrimLeft(b[i+len("encoding"):], " \r\n\t")
+
+		if len(b) == 0 || b[0] != '=' {
+			continue
+		}
+
+		b = bytes.TrimLeft(b[1:], " \r\n\t")
+
+		if len(b) == 0 || (b[0] != '"' && b[0] != '\'') {
+			return ""
+		}
+
+		end := bytes.IndexByte(b[1:], b[0])
+		if end == -1 {
+			return ""
+		}
+
+		return string(b[1 : end+1])
+	}
+}
+
+// Pos returns the start and end position of the declaration.
+func (d *XMLDeclaration) Pos() (start, end int) {
+	return d.Position.Pos()
+}
+
+// ParserOpt is the type for functions that can be used to customize the behaviour of a [Parser].
+type ParserOpt func(*parserOptions)
+
+type parserOptions struct {
+	mapNamespacedAttrs    bool
+	readerOpts            []esixml.ReaderOpt
+	rejectNamespacedAttrs bool
+	spillDir              string
+	spillThreshold        int
+}
+
+// WithESINamespacedAttrs configures the [Parser] to treat attributes in the esi namespace on ESI elements, like
+// esi:onerror, as if they had no namespace.
+//
+// This allows parsing documents written for dialects that use namespaced attributes. For example, the attributes of
+//
+//	<esi:include esi:src="/a" esi:onerror="continue"/>
+//
+// are parsed into [IncludeElement.Source] and [IncludeElement.OnError] instead of being kept in
+// [IncludeElement.Attr].
+//
+// If an element has the same attribute with and without the namespace, an [*esixml.DuplicateAttributeError] is
+// returned.
+func WithESINamespacedAttrs() ParserOpt {
+	return func(p *parserOptions) {
+		p.mapNamespacedAttrs = true
+	}
+}
+
+// WithRejectNamespacedAttrs configures the [Parser] to return an [*UnexpectedAttributeError] for attributes with a
+// namespace on ESI elements, instead of keeping them in the Attr field of the element.
+//
+// When combined with [WithESINamespacedAttrs], attributes in the esi namespace are still accepted.
+func WithRejectNamespacedAttrs() ParserOpt {
+	return func(p *parserOptions) {
+		p.rejectNamespacedAttrs = true
+	}
+}
+
+// WithReaderOptions specifies options for the underlying [esixml.Reader].
+//
+// If WithReaderOptions is given multiple times, all options are used in order.
+func WithReaderOptions(opts ...esixml.ReaderOpt) ParserOpt {
+	return func(p *parserOptions) {
+		p.readerOpts = append(p.readerOpts, opts...)
+	}
+}
+
+// ChecksData returns true if a [Parser] using the given options checks or modifies the data outside of ESI elements.
+//
+// See [esixml.ChecksData] for details.
+func ChecksData(opts ...ParserOpt) bool {
+	var o parserOptions
+
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return esixml.ChecksData(o.readerOpts...)
+}
+
 // Parser implements parsing of documents containing ESI instructions, returning the parsed elements and the unprocessed
 // data.
 type Parser struct {
@@ -630,27 +1005,71 @@ type Parser struct {
 	unreadToken esixml.Token
 	err         error
 
+	// length of the stack before the state that returned err.
+	errStackLen int
+
 	// current stack. nil values mark the start of a scope.
 	stack []Node
 
 	stateFn func(*Parser) (Node, error)
+
+	opts parserOptions
+
+	// spillFile contains spilled data and spillSize is the number of bytes written to it. See [WithSpill].
+	spillFile *os.File
+	spillSize int64
 }
 
-// NewParser returns a new Parser set to read from in.
+// NewParser returns a new Parser set to read from in, using the given options.
 //
 // This is a shorthand for creating a new [Parser] and calling [Parser.Reset] on it.
-func NewParser(in io.Reader) *Parser {
+func NewParser(in io.Reader, opts ...ParserOpt) *Parser {
 	p := &Parser{}
-	p.Reset(in)
+	p.Reset(in, opts...)
 	return p
 }
 
+// Parse parses the complete document doc using a new [Parser] with the given options and returns all nodes.
+//
+// Parse accepts both []byte and string, so that documents held as string, for example when loaded from a cache, can
+// be parsed without first converting them to []byte, which would copy the whole document.
+//
+// If an error occurs, the nodes parsed before the error are returned together with the error.
+func Parse[T []byte | string](doc T, opts ...ParserOpt) (Nodes, error) {
+	var nodes Nodes
+
+	for node, err := range NewParser(newDocReader(doc), opts...).All {
+		if err != nil {
+			return nodes, err
+		}
+
+		nodes = append(nodes, node)
+	}
+
+	return nodes, nil
+}
+
+// newDocReader returns an [io.Reader] that reads from doc without copying it.
+func newDocReader[T []byte | string](doc T) io.Reader {
+	switch doc := any(doc).(type) {
+	case []byte:
+		return bytes.NewReader(doc)
+	case string:
+		return strings.NewReader(doc)
+	default:
+		panic("unreachable")
+	}
+}
+
 // All yields all remaining nodes from the parser.
+//
+// When parsing data passed via [Parser.Feed], All stops once all nodes that can be parsed from the data fed so far were
+// yielded.
 func (p *Parser) All(yield func(Node, error) bool) {
 	for {
 		node, err := p.Next()
 
-		if errors.Is(err, io.EOF) {
+		if errors.Is(err, io.EOF) || errors.Is(err, esixml.ErrNeedMoreData) {
 			return
 		}
 
@@ -666,13 +1085,18 @@ func (p *Parser) All(yield func(Node, error) bool) {
 
 // Next returns the next Node if any.
 //
-// If an error occurred, future calls till return the same error.
+// If an error occurred, future calls till return the same error, unless [Parser.Recover] is called.
 //
 // After all data was read, if there were no previous errors, Next will return [io.EOF].
+//
+// When parsing data passed via [Parser.Feed], Next returns [esixml.ErrNeedMoreData] if the data fed so far does not
+// contain another complete node and [Parser.CloseFeed] was not yet called.
 func (p *Parser) Next() (Node, error) {
 	var node Node
 
 	for p.err == nil {
+		p.errStackLen = len(p.stack)
+
 		node, p.err = p.stateFn(p)
 
 		if node != nil {
@@ -680,6 +1104,11 @@ func (p *Parser) Next() (Node, error) {
 		}
 	}
 
+	if errors.Is(p.err, esixml.ErrNeedMoreData) {
+		p.err = nil
+		return nil, esixml.ErrNeedMoreData
+	}
+
 	if !errors.Is(p.err, io.EOF) {
 		return nil, p.err
 	}
@@ -699,10 +1128,57 @@ func (p *Parser) Next() (Node, error) {
 	return nil, io.EOF
 }
 
+// Recover clears an error returned by [Parser.Next] so that parsing can continue after the element that caused it.
+//
+// This allows tools like linters or editors to collect multiple independent errors from a single document by calling
+// Recover after each error and continuing to call Next until it returns [io.EOF] or Recover returns false.
+//
+// The invalid element is skipped and not returned, but its children may be returned as normal nodes, for example if
+// the start tag of an element was invalid. If the closing tag of an element was invalid, the element stays open and
+// may still be closed by a later closing tag. Syntax errors in the underlying markup are recovered from using
+// [esixml.Reader.Recover].
+//
+// Recover returns false and keeps the error if parsing can not continue, for example because of an error when reading
+// the input, because the end of the input was reached or because the underlying reader could not recover.
+//
+// If there was no error, Recover does nothing and returns true.
+func (p *Parser) Recover() bool {
+	switch {
+	case p.err == nil:
+		return true
+	case errors.Is(p.err, io.EOF), errors.Is(p.err, io.ErrUnexpectedEOF), errors.Is(p.err, esixml.ErrNeedMoreData):
+		return false
+	}
+
+	if !p.reader.Recover() {
+		return false
+	}
+
+	// If the element was already removed from its scope when the error occurred (for example because of missing
+	// children), it is still at the top of the stack and needs to be dropped.
+	if len(p.stack) < p.errStackLen {
+		p.stack = p.stack[:len(p.stack)-1]
+	}
+
+	p.err = nil
+	p.unreadToken = esixml.Token{}
+	p.stateFn = (*Parser).parseDataOrElement
+
+	return true
+}
+
 // Reset resets the Parser to read from in.
 //
+// If in is nil, the Parser instead parses data passed to it via [Parser.Feed].
+//
+// Options from previous calls to NewParser or Reset are discarded and replaced by the given options.
+//
 // This allows re-using the parser for different inputs.
-func (p *Parser) Reset(in io.Reader) {
+//
+// Any temporary file used for spilled data is released, like when calling [Parser.Close].
+func (p *Parser) Reset(in io.Reader, opts ...ParserOpt) {
+	_ = p.Close()
+
 	if len(p.stack) == 0 || cap(p.stack) > 32 {
 		p.stack = make([]Node, 0, 32)
 	} else {
@@ -713,7 +1189,41 @@ func (p *Parser) Reset(in io.Reader) {
 	p.stack = p.stack[:0]
 	p.unreadToken = esixml.Token{}
 	p.stateFn = (*Parser).parseDataOrElement
-	p.reader.Reset(in)
+
+	p.opts = parserOptions{}
+
+	for _, opt := range opts {
+		opt(&p.opts)
+	}
+
+	readerOpts := p.opts.readerOpts
+
+	if p.opts.spillThreshold > 0 {
+		readerOpts = append(readerOpts[:len(readerOpts):len(readerOpts)],
+			esixml.WithMaxDataSize(min(p.opts.spillThreshold, spillChunkSize)))
+	}
+
+	p.reader.Reset(in, readerOpts...)
+}
+
+// Feed appends data to the input of the Parser.
+//
+// Feed can only be used if the Parser was reset using a nil [io.Reader]. After feeding data, [Parser.Next] or
+// [Parser.All] can be used to get all nodes that could be parsed so far. This allows processing documents while they
+// are still being received, for example by processing the nodes yielded by [Parser.All] after each call to Feed.
+//
+// Once all data was fed, [Parser.CloseFeed] must be called to mark the end of the input.
+//
+// See also [esixml.Reader.Feed].
+func (p *Parser) Feed(data []byte) {
+	p.reader.Feed(data)
+}
+
+// CloseFeed marks the end of the data passed via [Parser.Feed].
+//
+// See also [esixml.Reader.CloseFeed].
+func (p *Parser) CloseFeed() {
+	p.reader.CloseFeed()
 }
 
 func (p *Parser) nextToken() (esixml.Token, error) {
@@ -923,6 +1433,7 @@ func (p *Parser) parseChooseElementEnd() (Node, error) {
 	children := p.exitScope()
 
 	el := p.current().(*ChooseElement)
+	opening := el.Position
 	el.Position.End = tok.Position.End
 
 	for _, node := range children {
@@ -940,7 +1451,12 @@ func (p *Parser) parseChooseElementEnd() (Node, error) {
 	}
 
 	if len(el.When) == 0 {
-		return nil, &MissingElementError{Position: tok.Position, Name: esixml.Name{Space: "esi", Local: "when"}}
+		return nil, &MissingElementError{
+			Position:        tok.Position,
+			OpeningPosition: opening,
+			Name:            esixml.Name{Space: Namespace, Local: NameWhen},
+			Parent:          el.Name(),
+		}
 	}
 
 	p.stateFn = (*Parser).parseDataOrElement
@@ -983,6 +1499,10 @@ func (p *Parser) parseData() (Node, error) {
 
 	p.stateFn = (*Parser).parseDataOrElement
 
+	if p.opts.spillThreshold > 0 {
+		return p.parseSpillableData(tok)
+	}
+
 	return p.pushNestedOrReturn(&RawData{
 		Position: tok.Position,
 		Bytes:    tok.Data,
@@ -1010,12 +1530,29 @@ func (p *Parser) parseDataOrElement() (Node, error) {
 		p.stateFn = (*Parser).parseEndElement
 	case esixml.TokenTypeData:
 		p.stateFn = (*Parser).parseData
+	case esixml.TokenTypeXMLDeclaration, esixml.TokenTypeDoctype:
+		p.stateFn = (*Parser).parseDeclaration
 	}
 
 	p.unreadToken = tok
 	return nil, nil
 }
 
+func (p *Parser) parseDeclaration() (Node, error) {
+	tok, err := p.mustNextToken()
+	if err != nil {
+		return nil, err
+	}
+
+	p.stateFn = (*Parser).parseDataOrElement
+
+	if tok.Type == esixml.TokenTypeDoctype {
+		return p.pushNestedOrReturn(&Doctype{Position: tok.Position, Bytes: tok.Data}), nil
+	}
+
+	return p.pushNestedOrReturn(&XMLDeclaration{Position: tok.Position, Bytes: tok.Data}), nil
+}
+
 func (p *Parser) parseESICommentStart() (Node, error) {
 	tok, err := p.mustNextTyped(esixml.TokenTypeESICommentStart)
 	if err != nil {
@@ -1114,10 +1651,43 @@ func (p *Parser) parseElement() (Node, error) {
 		return nil, &InvalidElementError{Position: tok.Position, Name: tok.Name}
 	}
 
+	if err := p.checkNamespacedAttrs(&tok); err != nil {
+		return nil, err
+	}
+
 	p.unreadToken = tok
 	return nil, nil
 }
 
+func (p *Parser) checkNamespacedAttrs(tok *esixml.Token) error {
+	if !p.opts.mapNamespacedAttrs && !p.opts.rejectNamespacedAttrs {
+		return nil
+	}
+
+	for i, attr := range tok.Attr {
+		if attr.Name.Space == "" {
+			continue
+		}
+
+		if p.opts.mapNamespacedAttrs && attr.Name.Space == Namespace {
+			name := esixml.Name{Local: attr.Name.Local}
+
+			if slices.ContainsFunc(tok.Attr, func(o esixml.Attr) bool { return o.Name == name }) {
+				return &esixml.DuplicateAttributeError{At: attr.Position.Start, Name: name.Local}
+			}
+
+			tok.Attr[i].Name = name
+			continue
+		}
+
+		if p.opts.rejectNamespacedAttrs {
+			return &UnexpectedAttributeError{Position: attr.Position, Element: tok.Name, Attribute: attr.Name}
+		}
+	}
+
+	return nil
+}
+
 func (p *Parser) parseEndElement() (Node, error) {
 	tok, err := p.mustNextTyped(esixml.TokenTypeEndElement)
 	if err != nil {
@@ -1202,6 +1772,9 @@ func (p *Parser) parseIncludeElement() (Node, error) {
 
 	alt, _ := takeAttr(&tok.Attr, "alt")
 
+	// The name attribute is non-standard, so keep it in Attr
+	name, _ := findAttr(tok.Attr, "name")
+
 	onError, ok := takeAttr(&tok.Attr, "onerror")
 	if ok && onError.Value != string(ErrorBehaviourContinue) {
 		return nil, &InvalidAttributeValueError{
@@ -1223,11 +1796,12 @@ func (p *Parser) parseIncludeElement() (Node, error) {
 	p.stateFn = (*Parser).parseDataOrElement
 
 	return p.pushNestedOrReturn(&IncludeElement{
-		Position: tok.Position,
-		Attr:     tok.Attr,
-		Alt:      alt.Value,
-		OnError:  ErrorBehaviour(onError.Value),
-		Source:   src.Value,
+		Position:     tok.Position,
+		Attr:         tok.Attr,
+		Alt:          alt.Value,
+		FragmentName: name.Value,
+		OnError:      ErrorBehaviour(onError.Value),
+		Source:       src.Value,
 	}), nil
 }
 
@@ -1385,6 +1959,7 @@ func (p *Parser) parseTryElementEnd() (Node, error) {
 	children := p.exitScope()
 
 	el := p.current().(*TryElement)
+	opening := el.Position
 	el.Position.End = tok.Position.End
 
 	for _, node := range children {
@@ -1405,11 +1980,21 @@ func (p *Parser) parseTryElementEnd() (Node, error) {
 	}
 
 	if el.Attempt == nil {
-		return nil, &MissingElementError{Position: tok.Position, Name: esixml.Name{Space: "esi", Local: "attempt"}}
+		return nil, &MissingElementError{
+			Position:        tok.Position,
+			OpeningPosition: opening,
+			Name:            esixml.Name{Space: Namespace, Local: NameAttempt},
+			Parent:          el.Name(),
+		}
 	}
 
 	if el.Except == nil {
-		return nil, &MissingElementError{Position: tok.Position, Name: esixml.Name{Space: "esi", Local: "except"}}
+		return nil, &MissingElementError{
+			Position:        tok.Position,
+			OpeningPosition: opening,
+			Name:            esixml.Name{Space: Namespace, Local: NameExcept},
+			Parent:          el.Name(),
+		}
 	}
 
 	p.stateFn = (*Parser).parseDataOrElement
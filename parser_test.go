@@ -3,8 +3,12 @@ package esi_test
 import (
 	"bytes"
 	"errors"
+	"fmt"
+	"io"
+	"slices"
 	"strings"
 	"testing"
+	"testing/iotest"
 
 	"github.com/google/go-cmp/cmp"
 
@@ -20,11 +24,14 @@ func TestParse(t *testing.T) {
 		return esi.Position{Start: start, End: end}
 	}
 
+	// attr assumes attributes in the form name="value"
 	attr := func(start, end int, name, value string) esixml.Attr {
 		return esixml.Attr{
-			Position: position(start, end),
-			Name:     esixml.Name{Local: name},
-			Value:    value,
+			Position:      position(start, end),
+			NamePosition:  position(start, start+len(name)),
+			ValuePosition: position(start+len(name)+2, end-1),
+			Name:          esixml.Name{Local: name},
+			Value:         value,
 		}
 	}
 
@@ -200,7 +207,12 @@ func TestParse(t *testing.T) {
 					Start: 12,
 					End:   25,
 				},
-				Name: nsname("when"),
+				OpeningPosition: esi.Position{
+					Start: 0,
+					End:   12,
+				},
+				Name:   nsname("when"),
+				Parent: nsname("choose"),
 			},
 		},
 		{
@@ -420,6 +432,33 @@ func TestParse(t *testing.T) {
 				},
 			},
 		},
+		{
+			Name:  "include with name",
+			Input: `<esi:include src="/test" name="nav" ttl="10s"/>`,
+			Nodes: []esi.Node{
+				&esi.IncludeElement{
+					Position: position(0, 47),
+					Attr: []esixml.Attr{
+						{
+							Position:      position(25, 35),
+							NamePosition:  position(25, 29),
+							ValuePosition: position(31, 34),
+							Name:          name("name"),
+							Value:         "nav",
+						},
+						{
+							Position:      position(36, 45),
+							NamePosition:  position(36, 39),
+							ValuePosition: position(41, 44),
+							Name:          name("ttl"),
+							Value:         "10s",
+						},
+					},
+					FragmentName: "nav",
+					Source:       "/test",
+				},
+			},
+		},
 		{
 			Name:  "include with onerror",
 			Input: `<esi:include src="/test" onerror="continue"/>`,
@@ -745,7 +784,12 @@ func TestParse(t *testing.T) {
 					Start: 52,
 					End:   62,
 				},
-				Name: nsname("attempt"),
+				OpeningPosition: esi.Position{
+					Start: 0,
+					End:   9,
+				},
+				Name:   nsname("attempt"),
+				Parent: nsname("try"),
 			},
 		},
 		{
@@ -777,7 +821,12 @@ func TestParse(t *testing.T) {
 					Start: 55,
 					End:   65,
 				},
-				Name: nsname("except"),
+				OpeningPosition: esi.Position{
+					Start: 0,
+					End:   9,
+				},
+				Name:   nsname("except"),
+				Parent: nsname("try"),
 			},
 		},
 		{
@@ -866,7 +915,12 @@ func TestParse(t *testing.T) {
 					Start: 9,
 					End:   19,
 				},
-				Name: nsname("attempt"),
+				OpeningPosition: esi.Position{
+					Start: 0,
+					End:   9,
+				},
+				Name:   nsname("attempt"),
+				Parent: nsname("try"),
 			},
 		},
 		{
@@ -1425,6 +1479,476 @@ func TestParse(t *testing.T) {
 	}
 }
 
+func TestParser_WithReaderOptions(t *testing.T) {
+	p := esi.NewParser(strings.NewReader(`<esi:include src="/&path;"/>`),
+		esi.WithReaderOptions(esixml.WithEntities(map[string]string{"path": "custom"})))
+
+	node, err := p.Next()
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	if got, want := node.(*esi.IncludeElement).Source, "/custom"; got != want {
+		t.Errorf("got source %q, want %q", got, want)
+	}
+}
+
+func TestParser_NamespacedAttrs(t *testing.T) {
+	const input = `<esi:include esi:src="/a" esi:onerror="continue" x:y="1"/>`
+
+	testCases := []struct {
+		Name    string
+		Input   string
+		Opts    []esi.ParserOpt
+		Source  string
+		OnError esi.ErrorBehaviour
+		Attr    []esixml.Name
+		Error   error
+	}{
+		{
+			Name:  "default",
+			Input: `<esi:include src="/a" esi:onerror="continue" x:y="1"/>`,
+			Attr: []esixml.Name{
+				{Space: "esi", Local: "onerror"},
+				{Space: "x", Local: "y"},
+			},
+			Source: "/a",
+		},
+		{
+			Name:    "esi namespace",
+			Input:   input,
+			Opts:    []esi.ParserOpt{esi.WithESINamespacedAttrs()},
+			Source:  "/a",
+			OnError: esi.ErrorBehaviourContinue,
+			Attr:    []esixml.Name{{Space: "x", Local: "y"}},
+		},
+		{
+			Name:  "esi namespace with duplicate",
+			Input: `<esi:include src="/a" esi:src="/b"/>`,
+			Opts:  []esi.ParserOpt{esi.WithESINamespacedAttrs()},
+			Error: &esixml.DuplicateAttributeError{At: 22, Name: "src"},
+		},
+		{
+			Name:  "reject",
+			Input: input,
+			Opts:  []esi.ParserOpt{esi.WithRejectNamespacedAttrs()},
+			Error: &esi.UnexpectedAttributeError{
+				Position:  esi.Position{Start: 13, End: 25},
+				Element:   esixml.Name{Space: "esi", Local: "include"},
+				Attribute: esixml.Name{Space: "esi", Local: "src"},
+			},
+		},
+		{
+			Name:  "reject with esi namespace",
+			Input: input,
+			Opts:  []esi.ParserOpt{esi.WithESINamespacedAttrs(), esi.WithRejectNamespacedAttrs()},
+			Error: &esi.UnexpectedAttributeError{
+				Position:  esi.Position{Start: 49, End: 56},
+				Element:   esixml.Name{Space: "esi", Local: "include"},
+				Attribute: esixml.Name{Space: "x", Local: "y"},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			node, err := esi.NewParser(strings.NewReader(testCase.Input), testCase.Opts...).Next()
+			if !errors.Is(err, testCase.Error) {
+				t.Fatalf("got error %v, want %v", err, testCase.Error)
+			}
+
+			if testCase.Error != nil {
+				return
+			}
+
+			include := node.(*esi.IncludeElement)
+
+			if include.Source != testCase.Source || include.OnError != testCase.OnError {
+				t.Errorf("got source %q and onerror %q, want %q and %q",
+					include.Source, include.OnError, testCase.Source, testCase.OnError)
+			}
+
+			var names []esixml.Name
+
+			for _, attr := range include.Attr {
+				names = append(names, attr.Name)
+			}
+
+			if diff := cmp.Diff(testCase.Attr, names); diff != "" {
+				t.Errorf("attributes mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParser_Declarations(t *testing.T) {
+	const input = `<?xml version="1.0" encoding='ISO-8859-1'?><!DOCTYPE html><esi:remove><!DOCTYPE x></esi:remove>`
+
+	p := esi.NewParser(strings.NewReader(input), esi.WithReaderOptions(esixml.WithDeclarationTokens()))
+
+	var got esi.Nodes
+
+	for node, err := range p.All {
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		got = append(got, node)
+	}
+
+	want := esi.Nodes{
+		&esi.XMLDeclaration{
+			Position: esi.Position{Start: 0, End: 43},
+			Bytes:    []byte(`<?xml version="1.0" encoding='ISO-8859-1'?>`),
+		},
+		&esi.Doctype{
+			Position: esi.Position{Start: 43, End: 58},
+			Bytes:    []byte(`<!DOCTYPE html>`),
+		},
+		&esi.RemoveElement{
+			Position: esi.Position{Start: 58, End: 95},
+			Nodes: []esi.Node{
+				&esi.Doctype{
+					Position: esi.Position{Start: 70, End: 82},
+					Bytes:    []byte(`<!DOCTYPE x>`),
+				},
+			},
+		},
+	}
+
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("nodes mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestParser_WithoutESIComments(t *testing.T) {
+	const input = `<!--esi text -->`
+
+	p := esi.NewParser(strings.NewReader(input), esi.WithReaderOptions(esixml.WithoutESIComments()))
+
+	var got esi.Nodes
+
+	for node, err := range p.All {
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		got = append(got, node)
+	}
+
+	want := esi.Nodes{
+		&esi.XMLComment{
+			Position: esi.Position{Start: 0, End: 16},
+			Nodes: []esi.Node{
+				&esi.RawData{Position: esi.Position{Start: 4, End: 13}, Bytes: []byte("esi text ")},
+			},
+		},
+	}
+
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("nodes mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestXMLDeclaration_Encoding(t *testing.T) {
+	testCases := []struct {
+		Input string
+		Want  string
+	}{
+		{Input: `<?xml version="1.0"?>`, Want: ""},
+		{Input: `<?xml version="1.0" encoding="UTF-8"?>`, Want: "UTF-8"},
+		{Input: `<?xml version='1.0' encoding = 'ISO-8859-1' standalone="yes"?>`, Want: "ISO-8859-1"},
+		{Input: `<?xml version="1.0" encoding=UTF-8?>`, Want: ""},
+		{Input: `<?xml version="1.0" encoding="UTF-8?>`, Want: ""},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Input, func(t *testing.T) {
+			d := &esi.XMLDeclaration{Bytes: []byte(testCase.Input)}
+
+			if got := d.Encoding(); got != testCase.Want {
+				t.Errorf("got encoding %q, want %q", got, testCase.Want)
+			}
+		})
+	}
+}
+
+func TestMissingElementError_Error(t *testing.T) {
+	_, err := esi.NewParser(strings.NewReader(`<esi:choose>a</esi:choose>`)).Next()
+
+	want := `missing element esi:when in element esi:choose at position 13:26 (opened at position 0:12)`
+
+	if err == nil || err.Error() != want {
+		t.Errorf("got error %v, want %s", err, want)
+	}
+}
+
+func TestParser_Recover(t *testing.T) {
+	const input = `a<esi:foo/>b<esi:choose></esi:choose>c<esi:include/>d` +
+		`<esi:remove><esi:try></esi:try>e</esi:remove>` +
+		`<esi:include src="/&bad;"/>f</esi:vars><esi:include src="/g"/>`
+
+	p := esi.NewParser(strings.NewReader(input))
+
+	var got []string
+
+	for {
+		node, err := p.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			got = append(got, fmt.Sprintf("%T", err))
+
+			if !p.Recover() {
+				t.Fatalf("failed to recover from error %v", err)
+			}
+
+			continue
+		}
+
+		got = append(got, string(esi.NodeBytes([]byte(input), node)))
+	}
+
+	want := []string{
+		"a",
+		"*esi.InvalidElementError",
+		"b",
+		"*esi.MissingElementError",
+		"c",
+		"*esi.MissingAttributeError",
+		"d",
+		"*esi.MissingElementError",
+		"<esi:remove><esi:try></esi:try>e</esi:remove>",
+		"*esixml.UnsupportedEntityError",
+		"f",
+		"*esi.UnexpectedEndElementError",
+		`<esi:include src="/g"/>`,
+	}
+
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("nodes and errors mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestParser_Recover_Unrecoverable(t *testing.T) {
+	p := esi.NewParser(strings.NewReader(`<esi:remove>`))
+
+	if !p.Recover() {
+		t.Error("Recover() returned false without error")
+	}
+
+	if _, err := p.Next(); !errors.As(err, new(*esi.UnclosedElementError)) {
+		t.Fatalf("got error %v, want UnclosedElementError", err)
+	}
+
+	if p.Recover() {
+		t.Error("Recover() returned true after end of input")
+	}
+
+	p.Reset(iotest.ErrReader(io.ErrNoProgress))
+
+	if _, err := p.Next(); !errors.Is(err, io.ErrNoProgress) {
+		t.Fatalf("got error %v, want %v", err, io.ErrNoProgress)
+	}
+
+	if p.Recover() {
+		t.Error("Recover() returned true after read error")
+	}
+}
+
+func TestParse_Input(t *testing.T) {
+	const input = `before<esi:include src="/test"/><esi:remove>removed</esi:remove>after`
+
+	want := esi.Nodes{
+		&esi.RawData{Position: esi.Position{Start: 0, End: 6}, Bytes: []byte("before")},
+		&esi.IncludeElement{Position: esi.Position{Start: 6, End: 32}, Source: "/test"},
+		&esi.RemoveElement{
+			Position: esi.Position{Start: 32, End: 64},
+			Nodes:    []esi.Node{&esi.RawData{Position: esi.Position{Start: 44, End: 51}, Bytes: []byte("removed")}},
+		},
+		&esi.RawData{Position: esi.Position{Start: 64, End: 69}, Bytes: []byte("after")},
+	}
+
+	t.Run("bytes", func(t *testing.T) {
+		got, err := esi.Parse([]byte(input))
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("Parse(...): (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("string", func(t *testing.T) {
+		got, err := esi.Parse(input)
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("Parse(...): (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("options", func(t *testing.T) {
+		got, err := esi.Parse(`<esi:include src="/test"/>`, esi.WithReaderOptions(esixml.WithStartOffset(10)))
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		want := esi.Nodes{&esi.IncludeElement{Position: esi.Position{Start: 10, End: 36}, Source: "/test"}}
+
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("Parse(...): (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		got, err := esi.Parse(`before<esi:include/>after`)
+
+		if want := (&esi.MissingAttributeError{}); !errors.As(err, &want) {
+			t.Errorf("got error %v, want MissingAttributeError", err)
+		}
+
+		want := esi.Nodes{&esi.RawData{Position: esi.Position{Start: 0, End: 6}, Bytes: []byte("before")}}
+
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("Parse(...): (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestNodeBytes(t *testing.T) {
+	doc := []byte(`before<esi:include src="/test"/><esi:remove>removed</esi:remove>after`)
+
+	var got []string
+
+	for node, err := range esi.NewParser(bytes.NewReader(doc)).All {
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		got = append(got, string(esi.NodeBytes(doc, node)))
+	}
+
+	want := []string{
+		`before`,
+		`<esi:include src="/test"/>`,
+		`<esi:remove>removed</esi:remove>`,
+		`after`,
+	}
+
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("NodeBytes(...): (-want +got):\n%s", diff)
+	}
+
+	invalid := []esi.Node{
+		nil,
+		&esi.RawData{Position: esi.Position{Start: -1, End: 2}},
+		&esi.RawData{Position: esi.Position{Start: 5, End: 2}},
+		&esi.RawData{Position: esi.Position{Start: 0, End: len(doc) + 1}},
+	}
+
+	for _, node := range invalid {
+		if got := esi.NodeBytes(doc, node); got != nil {
+			t.Errorf("NodeBytes(doc, %v): got %q, want nil", node, got)
+		}
+	}
+}
+
+func TestParser_Feed(t *testing.T) {
+	const input = `<p>before</p>
+<esi:include src="/include" alt="/alt" onerror="continue"/>
+<esi:choose>
+	<esi:when test="$(HTTP_COOKIE{group})=='Advanced'">advanced</esi:when>
+	<esi:otherwise>other</esi:otherwise>
+</esi:choose>
+<esi:try>
+	<esi:attempt><esi:include src="/attempt"/></esi:attempt>
+	<esi:except>except</esi:except>
+</esi:try>
+<!--esi <esi:remove>removed</esi:remove> -->
+<!-- comment -->
+<p>after</p>`
+
+	// The fed parser may split data at arbitrary positions, so merge adjacent data before comparing.
+	mergeRawData := cmp.Transformer("mergeRawData", func(nodes []esi.Node) []esi.Node {
+		var merged []esi.Node
+
+		for _, node := range nodes {
+			data, ok := node.(*esi.RawData)
+			if !ok {
+				merged = append(merged, node)
+				continue
+			}
+
+			if n := len(merged); n > 0 {
+				if prev, ok := merged[n-1].(*esi.RawData); ok {
+					merged[n-1] = &esi.RawData{
+						Position: esi.Position{Start: prev.Position.Start, End: data.Position.End},
+						Bytes:    append(slices.Clone(prev.Bytes), data.Bytes...),
+					}
+					continue
+				}
+			}
+
+			merged = append(merged, data)
+		}
+
+		return merged
+	})
+
+	var want []esi.Node
+
+	for node, err := range esi.NewParser(strings.NewReader(input)).All {
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		want = append(want, node)
+	}
+
+	for chunkSize := 1; chunkSize <= len(input); chunkSize++ {
+		p := esi.NewParser(nil)
+
+		var got []esi.Node
+
+		for remaining := input; ; {
+			node, err := p.Next()
+
+			if errors.Is(err, esixml.ErrNeedMoreData) {
+				chunk := remaining[:min(chunkSize, len(remaining))]
+				remaining = remaining[len(chunk):]
+
+				p.Feed([]byte(chunk))
+
+				if remaining == "" {
+					p.CloseFeed()
+				}
+
+				continue
+			}
+
+			if errors.Is(err, io.EOF) {
+				break
+			}
+
+			if err != nil {
+				t.Fatalf("chunk size %d: got error %v", chunkSize, err)
+			}
+
+			got = append(got, node)
+		}
+
+		if diff := cmp.Diff(want, got, mergeRawData); diff != "" {
+			t.Errorf("chunk size %d: (-want +got):\n%s", chunkSize, diff)
+		}
+	}
+}
+
 func BenchmarkParse(b *testing.B) {
 	input := strings.TrimSpace(`
 <header>Header</header>
@@ -0,0 +1,161 @@
+package esi
+
+import (
+	"io"
+	"os"
+
+	"github.com/nussjustin/esi/esixml"
+)
+
+// spillChunkSize is the maximum size of the data tokens read by a [Parser] when using [WithSpill].
+const spillChunkSize = 32 * 1024
+
+// Spill references the data of a [RawData] node that was written to a temporary file instead of being kept in memory.
+//
+// See [WithSpill].
+type Spill struct {
+	// Source contains the data.
+	Source io.ReaderAt
+
+	// Offset is the offset of the data in Source.
+	Offset int64
+
+	// Length is the length of the data in bytes.
+	Length int64
+}
+
+// Reader returns a new reader for the referenced data.
+func (s *Spill) Reader() *io.SectionReader {
+	return io.NewSectionReader(s.Source, s.Offset, s.Length)
+}
+
+// WithSpill configures the [Parser] to write top-level [RawData] nodes with more than threshold bytes to a temporary
+// file, instead of keeping the data in memory.
+//
+// For these nodes, [RawData.Bytes] is nil and [RawData.Spill] references the data in the file. This keeps the memory
+// needed for parsing bounded, even for documents with megabytes of data between ESI elements, while still allowing
+// the data to be streamed to the output, for example using [RawData.WriteTo].
+//
+// The file is created in dir, or the default directory for temporary files if dir is empty, once the first node is
+// spilled. It is released by [Parser.Close] or [Parser.Reset], after which spilled nodes can no longer be read.
+//
+// Only data outside of ESI elements is spilled. Data inside elements is always kept in memory.
+//
+// If threshold is <= 0, WithSpill panics.
+func WithSpill(threshold int, dir string) ParserOpt {
+	if threshold <= 0 {
+		panic("WithSpill called with threshold <= 0")
+	}
+
+	return func(p *parserOptions) {
+		p.spillThreshold = threshold
+		p.spillDir = dir
+	}
+}
+
+// Close releases the temporary file used for spilled data, if any.
+//
+// Spilled [RawData] nodes returned by the parser can not be read after Close. See [WithSpill].
+func (p *Parser) Close() error {
+	if p.spillFile == nil {
+		return nil
+	}
+
+	f := p.spillFile
+
+	p.spillFile, p.spillSize = nil, 0
+
+	err := f.Close()
+
+	// The file was already removed after creation, unless the platform does not allow removing open files.
+	if removeErr := os.Remove(f.Name()); removeErr != nil && !os.IsNotExist(removeErr) && err == nil {
+		err = removeErr
+	}
+
+	return err
+}
+
+// WriteTo writes the data of r to w, reading it from [RawData.Spill] if the data was spilled.
+//
+// It implements the [io.WriterTo] interface.
+func (r *RawData) WriteTo(w io.Writer) (int64, error) {
+	if r.Spill == nil {
+		n, err := w.Write(r.Bytes)
+		return int64(n), err
+	}
+
+	return io.Copy(w, r.Spill.Reader())
+}
+
+// parseSpillableData parses data starting with the given token, merging the data tokens split by the reader.
+//
+// If the data is outside of elements and exceeds the configured threshold, it is spilled.
+func (p *Parser) parseSpillableData(tok esixml.Token) (Node, error) {
+	data := &RawData{Position: tok.Position, Bytes: tok.Data}
+
+	topLevel := len(p.stack) == 0
+
+	for {
+		next, err := p.reader.Next()
+		if err != nil {
+			// The reader returns the error again on the next call, so that it is handled by the next state.
+			break
+		}
+
+		if next.Type != esixml.TokenTypeData {
+			p.unreadToken = next
+			break
+		}
+
+		data.Position.End = next.Position.End
+
+		if !topLevel || (data.Spill == nil && len(data.Bytes)+len(next.Data) <= p.opts.spillThreshold) {
+			data.Bytes = append(data.Bytes, next.Data...)
+			continue
+		}
+
+		if data.Spill == nil {
+			spill, err := p.spill(data.Bytes)
+			if err != nil {
+				return nil, err
+			}
+
+			data.Bytes, data.Spill = nil, spill
+		}
+
+		spill, err := p.spill(next.Data)
+		if err != nil {
+			return nil, err
+		}
+
+		data.Spill.Length += spill.Length
+	}
+
+	return p.pushNestedOrReturn(data), nil
+}
+
+// spill appends b to the temporary file, creating it if needed.
+func (p *Parser) spill(b []byte) (*Spill, error) {
+	if p.spillFile == nil {
+		f, err := os.CreateTemp(p.opts.spillDir, "esi-spill-*")
+		if err != nil {
+			return nil, err
+		}
+
+		// On most platforms the file can be removed while open, so that it is cleaned up even if Close is not called.
+		_ = os.Remove(f.Name())
+
+		p.spillFile = f
+	}
+
+	n, err := p.spillFile.Write(b)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Spill{Source: p.spillFile, Offset: p.spillSize, Length: int64(n)}
+
+	p.spillSize += int64(n)
+
+	return s, nil
+}
@@ -0,0 +1,109 @@
+package esi_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/nussjustin/esi"
+)
+
+func TestParser_WithSpill(t *testing.T) {
+	large := strings.Repeat("<p>large data</p>\n", 100)
+	nested := strings.Repeat("nested", 100)
+
+	input := large + `<esi:comment text="x"/>small<esi:vars>` + nested + `</esi:vars>` + large
+
+	dir := t.TempDir()
+
+	p := esi.NewParser(strings.NewReader(input), esi.WithSpill(128, dir))
+
+	var nodes esi.Nodes
+
+	for node, err := range p.All {
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		nodes = append(nodes, node)
+	}
+
+	if len(nodes) != 5 {
+		t.Fatalf("got %d nodes, want 5", len(nodes))
+	}
+
+	checkSpilled := func(node esi.Node, start int) {
+		t.Helper()
+
+		data := node.(*esi.RawData)
+
+		if data.Bytes != nil || data.Spill == nil {
+			t.Fatalf("got data %q with spill %v, want spilled data", data.Bytes, data.Spill)
+		}
+
+		if want := (esi.Position{Start: start, End: start + len(large)}); data.Position != want {
+			t.Errorf("got position %v, want %v", data.Position, want)
+		}
+
+		var buf bytes.Buffer
+
+		if _, err := data.WriteTo(&buf); err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		if buf.String() != large {
+			t.Errorf("got spilled data %q, want %q", buf.String(), large)
+		}
+	}
+
+	checkSpilled(nodes[0], 0)
+	checkSpilled(nodes[4], len(input)-len(large))
+
+	if data := nodes[2].(*esi.RawData); data.Spill != nil || string(data.Bytes) != "small" {
+		t.Errorf("got data %q with spill %v, want %q", data.Bytes, data.Spill, "small")
+	}
+
+	if data := nodes[3].(*esi.VarsElement).Nodes[0].(*esi.RawData); data.Spill != nil || string(data.Bytes) != nested {
+		t.Errorf("got nested data %q with spill %v, want %q", data.Bytes, data.Spill, nested)
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatalf("got error %v from Close", err)
+	}
+
+	if _, err := nodes[0].(*esi.RawData).WriteTo(io.Discard); err == nil {
+		t.Errorf("got no error when reading spilled data after Close")
+	}
+
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Errorf("got entries %v and error %v after Close, want empty directory", entries, err)
+	}
+}
+
+func TestParser_WithSpill_TrimWhitespace(t *testing.T) {
+	large := strings.Repeat("data\n", 100)
+
+	input := "  <esi:comment text=\"x\"/>  \n" + large + "  <esi:comment text=\"y\"/>\n"
+
+	p := esi.NewParser(strings.NewReader(input), esi.WithSpill(64, t.TempDir()))
+	defer func() { _ = p.Close() }()
+
+	var buf bytes.Buffer
+
+	for node, err := range esi.TrimWhitespace(p.All) {
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		if data, ok := node.(*esi.RawData); ok {
+			_, _ = data.WriteTo(&buf)
+		}
+	}
+
+	// Spilled data is not trimmed
+	if got, want := buf.String(), "  \n"+large+"  "; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
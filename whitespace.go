@@ -0,0 +1,267 @@
+package esi
+
+import (
+	"bytes"
+	"iter"
+)
+
+// TrimWhitespace returns a sequence that yields all nodes from nodes, with whitespace around ESI block elements
+// removed.
+//
+// Block elements are elements that do not produce output themselves. These are esi:attempt, esi:choose, esi:comment,
+// esi:except, esi:otherwise, esi:remove, esi:try and esi:when as well as ESI comments (<!--esi ... -->).
+//
+// For the start and end tags of each block element, the following rules apply:
+//
+//   - Spaces and tabs between the start of the line and the tag are removed.
+//   - If the tag is followed by only spaces and tabs until the end of the line, these and the newline are removed.
+//
+// This allows placing block elements on their own lines without leaving empty lines in the output.
+//
+// Elements with modified children are copies of the original elements. Other nodes are yielded as is, or, if data
+// was trimmed, as new [RawData] nodes with adjusted positions. Spilled data (see [WithSpill]) is never trimmed.
+func TrimWhitespace(nodes iter.Seq2[Node, error]) iter.Seq2[Node, error] {
+	return func(yield func(Node, error) bool) {
+		t := whitespaceTrimmer{
+			clone:     true,
+			lineStart: true,
+			yield: func(node Node) bool {
+				return yield(node, nil)
+			},
+		}
+
+		for node, err := range nodes {
+			if err != nil {
+				if t.flush(false) {
+					yield(nil, err)
+				}
+				return
+			}
+
+			if !t.add(node) {
+				return
+			}
+		}
+
+		t.flush(false)
+	}
+}
+
+type whitespaceTrimmer struct {
+	// clone is true if elements must be cloned before modifying their children.
+	clone bool
+
+	// lineStart is true if the pending data starts at the start of a line.
+	lineStart bool
+
+	// trimNext is true if the last element was a block element.
+	trimNext bool
+
+	pending []*RawData
+
+	yield func(Node) bool
+}
+
+func (t *whitespaceTrimmer) add(node Node) bool {
+	if data, ok := node.(*RawData); ok && data.Spill == nil {
+		t.pending = append(t.pending, data)
+		return true
+	}
+
+	if data, ok := node.(*RawData); ok {
+		if !t.flush(false) {
+			return false
+		}
+
+		t.lineStart, t.trimNext = false, false
+
+		return t.yield(data)
+	}
+
+	block := isBlockNode(node)
+
+	if !t.flush(block) {
+		return false
+	}
+
+	t.lineStart, t.trimNext = false, block
+
+	if t.clone && hasChildren(node) {
+		node = CloneNode(node)
+	}
+
+	trimChildren(node)
+
+	return t.yield(node)
+}
+
+func (t *whitespaceTrimmer) flush(beforeBlock bool) bool {
+	if len(t.pending) == 0 {
+		return true
+	}
+
+	data := mergeData(t.pending)
+
+	clear(t.pending)
+	t.pending = t.pending[:0]
+
+	if t.trimNext {
+		var trimmed bool
+		data, trimmed = trimLineEnd(data)
+		t.lineStart = t.lineStart || trimmed
+	}
+
+	if beforeBlock {
+		data = trimLineStart(data, t.lineStart)
+	}
+
+	t.lineStart, t.trimNext = false, false
+
+	if len(data.Bytes) == 0 {
+		return true
+	}
+
+	return t.yield(data)
+}
+
+func hasChildren(node Node) bool {
+	switch node.(type) {
+	case *AttemptElement, *ChooseElement, *Comment, *ExceptElement, *InlineElement, *OtherwiseElement,
+		*RemoveElement, *TryElement, *VarsElement, *WhenElement, *XMLComment:
+		return true
+	default:
+		return false
+	}
+}
+
+func isBlockNode(node Node) bool {
+	switch node.(type) {
+	case *AttemptElement, *ChooseElement, *Comment, *CommentElement, *ExceptElement, *OtherwiseElement,
+		*RemoveElement, *TryElement, *WhenElement:
+		return true
+	default:
+		return false
+	}
+}
+
+func mergeData(data []*RawData) *RawData {
+	if len(data) == 1 {
+		return data[0]
+	}
+
+	var buf bytes.Buffer
+
+	for _, d := range data {
+		buf.Write(d.Bytes)
+	}
+
+	return &RawData{
+		Position: Position{Start: data[0].Position.Start, End: data[len(data)-1].Position.End},
+		Bytes:    buf.Bytes(),
+	}
+}
+
+func sliceData(data *RawData, start, end int) *RawData {
+	if start == 0 && end == len(data.Bytes) {
+		return data
+	}
+
+	return &RawData{
+		Position: Position{Start: data.Position.Start + start, End: data.Position.Start + end},
+		Bytes:    data.Bytes[start:end],
+	}
+}
+
+// trimChildren trims the children of the given element in place.
+func trimChildren(node Node) {
+	block := isBlockNode(node)
+
+	switch v := node.(type) {
+	case *AttemptElement:
+		v.Nodes = trimNodes(v.Nodes, block)
+	case *ChooseElement:
+		for _, w := range v.When {
+			trimChildren(w)
+		}
+
+		if v.Otherwise != nil {
+			trimChildren(v.Otherwise)
+		}
+	case *Comment:
+		v.Nodes = trimNodes(v.Nodes, block)
+	case *ExceptElement:
+		v.Nodes = trimNodes(v.Nodes, block)
+	case *InlineElement:
+		v.Nodes = trimNodes(v.Nodes, block)
+	case *OtherwiseElement:
+		v.Nodes = trimNodes(v.Nodes, block)
+	case *RemoveElement:
+		v.Nodes = trimNodes(v.Nodes, block)
+	case *TryElement:
+		if v.Attempt != nil {
+			trimChildren(v.Attempt)
+		}
+
+		if v.Except != nil {
+			trimChildren(v.Except)
+		}
+	case *VarsElement:
+		v.Nodes = trimNodes(v.Nodes, block)
+	case *WhenElement:
+		v.Nodes = trimNodes(v.Nodes, block)
+	case *XMLComment:
+		v.Nodes = trimNodes(v.Nodes, block)
+	}
+}
+
+// trimLineEnd removes leading spaces and tabs followed by a newline. It returns true if data was removed.
+func trimLineEnd(data *RawData) (*RawData, bool) {
+	for i, b := range data.Bytes {
+		switch b {
+		case ' ', '\t', '\r':
+		case '\n':
+			return sliceData(data, i+1, len(data.Bytes)), true
+		default:
+			return data, false
+		}
+	}
+
+	return data, false
+}
+
+// trimLineStart removes trailing spaces and tabs after the last newline. If there is no newline, the spaces and tabs
+// are only removed if lineStart is true.
+func trimLineStart(data *RawData, lineStart bool) *RawData {
+	i := bytes.LastIndexByte(data.Bytes, '\n')
+	if i == -1 && !lineStart {
+		return data
+	}
+
+	if len(bytes.Trim(data.Bytes[i+1:], " \t")) != 0 {
+		return data
+	}
+
+	return sliceData(data, 0, i+1)
+}
+
+// trimNodes trims whitespace in a list of already cloned nodes. If block is true, the nodes are the children of a
+// block element, and whitespace after the start tag and before the end tag is trimmed.
+func trimNodes(nodes []Node, block bool) []Node {
+	var result []Node
+
+	t := whitespaceTrimmer{
+		trimNext: block,
+		yield: func(node Node) bool {
+			result = append(result, node)
+			return true
+		},
+	}
+
+	for _, node := range nodes {
+		t.add(node)
+	}
+
+	t.flush(block)
+
+	return result
+}
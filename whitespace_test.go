@@ -0,0 +1,197 @@
+package esi_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/nussjustin/esi"
+	"github.com/nussjustin/esi/esixml"
+)
+
+// render writes the data of all nodes, ignoring the ESI markup itself, to check which whitespace was trimmed.
+func render(buf *bytes.Buffer, nodes []esi.Node) {
+	for _, node := range nodes {
+		switch v := node.(type) {
+		case *esi.RawData:
+			buf.Write(v.Bytes)
+		case *esi.ChooseElement:
+			for _, w := range v.When {
+				buf.WriteString("[when]")
+				render(buf, w.Nodes)
+			}
+
+			if v.Otherwise != nil {
+				buf.WriteString("[otherwise]")
+				render(buf, v.Otherwise.Nodes)
+			}
+		case *esi.CommentElement:
+			buf.WriteString("[comment]")
+		case *esi.IncludeElement:
+			buf.WriteString("[include]")
+		case *esi.RemoveElement:
+			buf.WriteString("[remove]")
+			render(buf, v.Nodes)
+		case *esi.VarsElement:
+			buf.WriteString("[vars]")
+			render(buf, v.Nodes)
+		}
+	}
+}
+
+func TestTrimWhitespace(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Input    string
+		Expected string
+	}{
+		{
+			Name:     "no elements",
+			Input:    "  before\n  after  \n",
+			Expected: "  before\n  after  \n",
+		},
+		{
+			Name:     "comment on own line",
+			Input:    "before\n  <esi:comment text=\"x\"/>  \nafter",
+			Expected: "before\n[comment]after",
+		},
+		{
+			Name:     "comment at start of document",
+			Input:    "  <esi:comment text=\"x\"/>\r\nafter",
+			Expected: "[comment]after",
+		},
+		{
+			Name:     "inline comment",
+			Input:    "before <esi:comment text=\"x\"/> after\n",
+			Expected: "before [comment] after\n",
+		},
+		{
+			Name:     "include is kept",
+			Input:    "before\n  <esi:include src=\"/\"/>\nafter",
+			Expected: "before\n  [include]\nafter",
+		},
+		{
+			Name: "choose",
+			Input: "before\n" +
+				"<esi:choose>\n" +
+				"  <esi:when test=\"$(A)\">\n" +
+				"    a\n" +
+				"  </esi:when>\n" +
+				"  <esi:otherwise>\n" +
+				"    b\n" +
+				"  </esi:otherwise>\n" +
+				"</esi:choose>\n" +
+				"after\n",
+			Expected: "before\n[when]    a\n[otherwise]    b\nafter\n",
+		},
+		{
+			Name:     "consecutive blocks",
+			Input:    "before\n<esi:comment text=\"x\"/>\n  <esi:remove>\n  removed\n  </esi:remove>\n\nafter",
+			Expected: "before\n[comment][remove]  removed\n\nafter",
+		},
+		{
+			Name:     "nested in vars",
+			Input:    "<esi:vars>\n  <esi:comment text=\"x\"/>\n  $(A)\n</esi:vars>",
+			Expected: "[vars]\n[comment]  $(A)\n",
+		},
+		{
+			Name:     "text after tag",
+			Input:    "before\n  <esi:comment text=\"x\"/> text\n",
+			Expected: "before\n[comment] text\n",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			original := parseAll(t, testCase.Input)
+
+			var nodes []esi.Node
+
+			for node, err := range esi.TrimWhitespace(esi.NewParser(strings.NewReader(testCase.Input)).All) {
+				if err != nil {
+					t.Fatalf("got error %v", err)
+				}
+
+				nodes = append(nodes, node)
+			}
+
+			var buf bytes.Buffer
+			render(&buf, nodes)
+
+			if got := buf.String(); got != testCase.Expected {
+				t.Errorf("got %q, want %q", got, testCase.Expected)
+			}
+
+			if diff := cmp.Diff(original, parseAll(t, testCase.Input)); diff != "" {
+				t.Errorf("original nodes were modified (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestTrimWhitespace_Feed(t *testing.T) {
+	const input = "before\n  <esi:comment text=\"x\"/>\nafter"
+
+	// Feed the input byte by byte, so that data is split into multiple nodes
+	nodes := func(yield func(esi.Node, error) bool) {
+		p := esi.NewParser(nil)
+
+		for i := range len(input) + 1 {
+			if i == len(input) {
+				p.CloseFeed()
+			} else {
+				p.Feed([]byte{input[i]})
+			}
+
+			for {
+				node, err := p.Next()
+				if errors.Is(err, esixml.ErrNeedMoreData) || errors.Is(err, io.EOF) {
+					break
+				}
+
+				if !yield(node, err) || err != nil {
+					return
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+
+	for node, err := range esi.TrimWhitespace(nodes) {
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		render(&buf, []esi.Node{node})
+	}
+
+	if got, want := buf.String(), "before\n[comment]after"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestTrimWhitespace_Error(t *testing.T) {
+	var got []string
+
+	for node, err := range esi.TrimWhitespace(esi.NewParser(strings.NewReader("before\n  <esi:foo/>")).All) {
+		if err != nil {
+			var invalidErr *esi.InvalidElementError
+			if !errors.As(err, &invalidErr) {
+				t.Errorf("got error %v, want InvalidElementError", err)
+			}
+
+			break
+		}
+
+		got = append(got, string(node.(*esi.RawData).Bytes))
+	}
+
+	if diff := cmp.Diff([]string{"before\n  "}, got); diff != "" {
+		t.Errorf("nodes mismatch (-want +got):\n%s", diff)
+	}
+}